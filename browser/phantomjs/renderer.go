@@ -19,6 +19,7 @@ import (
 
 	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
 	"github.com/HouzuoGuo/laitos/platform"
 )
 
@@ -670,7 +671,7 @@ func (instance *Instance) Kill() {
 				instance.logger.Warning("Kill", "", nil, "failed to kill process")
 			}
 		}
-		if err := os.Remove(instance.RenderImagePath); err != nil && !os.IsNotExist(err) {
+		if err := misc.SecureErase(instance.RenderImagePath); err != nil {
 			instance.logger.Warning("Kill", "", err, "failed to delete rendered web page at \"%s\"", instance.RenderImagePath)
 		}
 		if serverJSFile := instance.serverJSFile; serverJSFile != nil {
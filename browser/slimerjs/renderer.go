@@ -790,7 +790,7 @@ func (instance *Instance) Kill() {
 		}
 		instance.containerName = ""
 		// Clean up after temporary files and directories
-		if err := os.RemoveAll(instance.RenderImageDir); err != nil && !os.IsNotExist(err) {
+		if err := misc.SecureErase(instance.RenderImageDir); err != nil {
 			instance.logger.Warning("Kill", "", err, "failed to delete rendered web page at \"%s\"", instance.RenderImageDir)
 		}
 		if serverJSFile := instance.serverJSFile; serverJSFile != nil {
@@ -1,8 +1,10 @@
 package autounlock
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
@@ -16,30 +18,133 @@ import (
 	"github.com/HouzuoGuo/laitos/testingstub"
 )
 
-const (
-	/*
-		The constants ContentLocationMagic and PasswordInputName are copied from passwdserver package in order to avoid
-		import cycle. Looks ugly, sorry.
-	*/
+// unlockStats times the successful unlock attempts.
+var unlockStats = misc.GetStats("autounlock.Unlocks")
 
+const (
 	/*
 		ContentLocationMagic is a rather randomly typed string that is sent as Content-Location header value when a
 		client successfully reaches the password unlock URL (and only that URL). Clients may look for this magic
 		in order to know that the URL reached indeed belongs to a laitos password input web server.
 	*/
-	ContentLocationMagic = "vmseuijt5oj4d5x7fygfqj4398"
+	ContentLocationMagic = inet.PasswdServerContentLocationMagic
 	// PasswordInputName is the HTML element name that accepts password input.
-	PasswordInputName = "password"
+	PasswordInputName = inet.PasswdServerPasswordInputName
+)
+
+const (
+	/*
+		RetryMinIntervalSec is the interval before the first retry of a peer that could not be unlocked. The interval
+		doubles after each consecutive failure, up to the daemon's IntervalSec.
+	*/
+	RetryMinIntervalSec = 30
 )
 
+// ErrPinMismatch is returned when none of the server certificates matches the pinned public keys of a peer.
+var ErrPinMismatch = inet.ErrPinMismatch
+
+/*
+Peer is a laitos server whose password input server ("passwdserver") is reachable via one or more URLs. The URLs are
+tried one after another until one of them is reachable.
+*/
+type Peer struct {
+	URLs     []string `json:"URLs"`     // URLs are the locations of the password input server, in the order of preference.
+	Password string   `json:"Password"` // Password is the password that unlocks the program data of the peer.
+	/*
+		PinnedPublicKeys are the base64-encoded SHA256 digests of the SubjectPublicKeyInfo of certificates trusted to
+		identify the peer. If present, the URLs must be HTTPS, and the password is only submitted to a server whose leaf
+		certificate carries a pinned public key, regardless of the certificate authority.
+		Calculate the digest of a certificate via:
+		openssl x509 -in cert.pem -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+	*/
+	PinnedPublicKeys []string `json:"PinnedPublicKeys"`
+
+	tlsConfig   *tls.Config
+	failures    int       // failures is the number of consecutive attempts that did not reach or unlock the peer.
+	nextAttempt time.Time // nextAttempt is the time at which the peer is to be tried again.
+}
+
+// initialise validates the peer configuration and prepares the TLS configuration that verifies the pinned public keys.
+func (peer *Peer) initialise() error {
+	if len(peer.URLs) == 0 || peer.Password == "" {
+		return errors.New("autounlock.Initialise: peer URLs and passwords must not be blank")
+	}
+	for _, aURL := range peer.URLs {
+		parsedURL, err := url.Parse(aURL)
+		if aURL == "" || err != nil {
+			return fmt.Errorf("autounlock.Initialise: failed to parse URL \"%s\" - %v", aURL, err)
+		}
+		if len(peer.PinnedPublicKeys) > 0 && parsedURL.Scheme != "https" {
+			return fmt.Errorf("autounlock.Initialise: URL \"%s\" must use https to verify the pinned public keys", aURL)
+		}
+	}
+	peer.tlsConfig = nil
+	peer.failures = 0
+	peer.nextAttempt = time.Time{}
+	if len(peer.PinnedPublicKeys) == 0 {
+		return nil
+	}
+	pins, err := inet.ParsePublicKeyPins(peer.PinnedPublicKeys)
+	if err != nil {
+		return fmt.Errorf("autounlock.Initialise: %v", err)
+	}
+	peer.tlsConfig = inet.GetPinnedTLSConfig(pins)
+	return nil
+}
+
+/*
+tryUnlock tries the peer's URLs one after another, and submits the password to the first reachable URL if it belongs
+to a password input server. It returns an error if none of the URLs is reachable or the submission fails.
+*/
+func (peer *Peer) tryUnlock() (isPasswdServer bool, response string, err error) {
+	var probeErrs []string
+	for _, aURL := range peer.URLs {
+		client := inet.PasswdServerClient{URL: aURL, TLSConfig: peer.tlsConfig}
+		isServer, _, probeErr := client.Probe()
+		if probeErr != nil {
+			probeErrs = append(probeErrs, probeErr.Error())
+			continue
+		}
+		if !isServer {
+			return false, "", nil
+		}
+		response, err = client.Submit(peer.Password, "")
+		return true, response, err
+	}
+	return false, "", fmt.Errorf("none of the URLs is reachable - %s", strings.Join(probeErrs, "; "))
+}
+
+/*
+scheduleNextAttempt schedules the next attempt at the regular interval after a successful attempt. After a failed
+attempt, the next attempt is scheduled using exponential backoff with jitter, so that the peer is retried promptly at
+first and increasingly less often afterwards.
+*/
+func (peer *Peer) scheduleNextAttempt(success bool, intervalSec int) {
+	if success {
+		peer.failures = 0
+		peer.nextAttempt = time.Now().Add(time.Duration(intervalSec) * time.Second)
+		return
+	}
+	peer.failures++
+	delaySec := intervalSec
+	if peer.failures < 16 && RetryMinIntervalSec<<uint(peer.failures-1) < intervalSec {
+		delaySec = RetryMinIntervalSec << uint(peer.failures-1)
+	}
+	// Wait for at least half of the delay, and a random portion of the other half.
+	delay := time.Duration(delaySec) * time.Second
+	peer.nextAttempt = time.Now().Add(delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1)))
+}
+
 /*
 Daemon periodically probes URLs where laitos password input servers ("passwdserver") are located in order to unlock
 their program data, and submits stored passwords to those laitos URLs to unlock their data.
 */
 type Daemon struct {
 	URLAndPassword map[string]string `json:"URLAndPassword"` // URLAndPassword is a mapping between URL and corresponding password.
+	Peers          []Peer            `json:"Peers"`          // Peers are the servers to unlock, each may be reachable via several URLs.
 	IntervalSec    int               `json:"IntervalSec"`    // IntervalSec is the interval at which URLs are checked.
 
+	peers         []*Peer   // peers are the servers from both URLAndPassword and Peers.
 	loopIsRunning int32     // loopIsRunning has value 1 only when the daemon loop is running.
 	stop          chan bool // stop signals daemon loop to stop
 	logger        lalog.Logger
@@ -51,12 +156,19 @@ func (daemon *Daemon) Initialise() error {
 	}
 	daemon.logger = lalog.Logger{ComponentName: "autounlock", ComponentID: []lalog.LoggerIDField{{Key: "Intv", Value: daemon.IntervalSec}}}
 	// Make sure that all URLs and passwords are present, and URLs can be parsed.
+	daemon.peers = make([]*Peer, 0, len(daemon.URLAndPassword)+len(daemon.Peers))
 	for aURL, passwd := range daemon.URLAndPassword {
 		if aURL == "" || passwd == "" {
 			return errors.New("autounlock.Initialise: URLs and passwords must not be blank")
 		}
-		if _, err := url.Parse(aURL); err != nil {
-			return fmt.Errorf("autounlock.Initialise: failed to parse URL \"%s\" - %v", aURL, err)
+		daemon.peers = append(daemon.peers, &Peer{URLs: []string{aURL}, Password: passwd})
+	}
+	for i := range daemon.Peers {
+		daemon.peers = append(daemon.peers, &daemon.Peers[i])
+	}
+	for _, peer := range daemon.peers {
+		if err := peer.initialise(); err != nil {
+			return err
 		}
 	}
 	daemon.stop = make(chan bool)
@@ -65,47 +177,39 @@ func (daemon *Daemon) Initialise() error {
 
 // StartAndBlock starts the loop that probes URLs.
 func (daemon *Daemon) StartAndBlock() error {
-	daemon.logger.Info("StartAndBlock", "", nil, "going to probe %d URLs", len(daemon.URLAndPassword))
+	daemon.logger.Info("StartAndBlock", "", nil, "going to probe %d peers", len(daemon.peers))
 	for {
 		if misc.EmergencyLockDown {
 			atomic.StoreInt32(&daemon.loopIsRunning, 0)
 			return misc.ErrEmergencyLockDown
 		}
 		atomic.StoreInt32(&daemon.loopIsRunning, 1)
-		// Probe the URLs one after another
-		for aURL, passwd := range daemon.URLAndPassword {
-			parsedURL, parseErr := url.Parse(aURL)
-			if parseErr == nil {
-				probeResp, probeErr := inet.DoHTTP(inet.HTTPRequest{TimeoutSec: 10}, strings.Replace(aURL, "%", "%%", -1))
-				if probeErr == nil && probeResp.StatusCode/200 == 1 && probeResp.Header.Get("Content-Location") == ContentLocationMagic {
-					// The URL is responding successfully and is indeed a password input web server
-					begin := time.Now().UnixNano()
-					daemon.logger.Warning("StartAndBlock", "", nil, "trying to unlock data on domain %s", parsedURL.Host)
-					// Use form submission to input password
-					submitResp, submitErr := inet.DoHTTP(inet.HTTPRequest{
-						// While unlocking is going on, the system is often freshly booted and quite busy, hence giving it plenty of time to respond.
-						TimeoutSec:  30,
-						Method:      http.MethodPost,
-						ContentType: "application/x-www-form-urlencoded",
-						Body:        strings.NewReader(url.Values{PasswordInputName: []string{passwd}}.Encode()),
-					}, strings.Replace(aURL, "%", "%%", -1))
-					if submitErr != nil {
-						daemon.logger.Warning("StartAndBlock", "", submitErr, "failed to submit password to domain %s", parsedURL.Host)
-					} else if submitHTTPErr := submitResp.Non2xxToError(); submitHTTPErr != nil {
-						daemon.logger.Warning("StartAndBlock", "", submitHTTPErr, "failed to submit password to domain %s", parsedURL.Host)
-					} else {
-						daemon.logger.Warning("StartAndBlock", "", nil, "successfully unlocked domain %s, response is: %s", parsedURL.Host, submitResp.GetBodyUpTo(1024))
-					}
-					misc.AutoUnlockStats.Trigger(float64(time.Now().UnixNano() - begin))
+		// Probe the peers that are due for another attempt, and find out when the next peer is due.
+		nextAttempt := time.Now().Add(time.Duration(daemon.IntervalSec) * time.Second)
+		for _, peer := range daemon.peers {
+			if time.Now().After(peer.nextAttempt) {
+				begin := time.Now().UnixNano()
+				isPasswdServer, submitResp, submitErr := peer.tryUnlock()
+				if submitErr != nil {
+					daemon.logger.Warning("StartAndBlock", "", submitErr, "failed to unlock peer %s (attempt %d)", peer.URLs[0], peer.failures+1)
+				} else if isPasswdServer {
+					daemon.logger.Warning("StartAndBlock", "", nil, "successfully unlocked peer %s, response is: %s", peer.URLs[0], submitResp)
 				}
+				if submitErr != nil || isPasswdServer {
+					unlockStats.Trigger(float64(time.Now().UnixNano() - begin))
+				}
+				peer.scheduleNextAttempt(submitErr == nil, daemon.IntervalSec)
+			}
+			if peer.nextAttempt.Before(nextAttempt) {
+				nextAttempt = peer.nextAttempt
 			}
 		}
 		select {
 		case <-daemon.stop:
 			atomic.StoreInt32(&daemon.loopIsRunning, 0)
 			return nil
-		case <-time.After(time.Duration(daemon.IntervalSec) * time.Second):
-			// Just waiting for the interval
+		case <-time.After(time.Until(nextAttempt)):
+			// Just waiting for the next attempt
 		}
 	}
 }
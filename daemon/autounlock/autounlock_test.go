@@ -1,10 +1,79 @@
 package autounlock
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDaemon_StartAndBlock(t *testing.T) {
 	d := &Daemon{URLAndPassword: map[string]string{}, IntervalSec: 1}
 	TestAutoUnlock(d, t)
 }
+
+func TestPeer_tryUnlock(t *testing.T) {
+	var unlockedWith string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Location", ContentLocationMagic)
+		} else {
+			unlockedWith = r.FormValue(PasswordInputName)
+			_, _ = w.Write([]byte("unlocked"))
+		}
+	}))
+	defer srv.Close()
+	digest := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	goodPin := base64.StdEncoding.EncodeToString(digest[:])
+	badPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	// Pinned public keys require https URLs and valid digests
+	for _, peer := range []Peer{
+		{URLs: []string{"http://localhost"}, Password: "a", PinnedPublicKeys: []string{goodPin}},
+		{URLs: []string{srv.URL}, Password: "a", PinnedPublicKeys: []string{"bad"}},
+		{URLs: []string{}, Password: "a"},
+	} {
+		if err := peer.initialise(); err == nil {
+			t.Fatalf("should have failed: %+v", peer)
+		}
+	}
+
+	// The password must not be submitted to a server of unknown identity
+	peer := Peer{URLs: []string{srv.URL}, Password: "pass", PinnedPublicKeys: []string{badPin}}
+	if err := peer.initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := peer.tryUnlock(); err == nil || !strings.Contains(err.Error(), ErrPinMismatch.Error()) || unlockedWith != "" {
+		t.Fatal(err, unlockedWith)
+	}
+
+	// Fail over from an unreachable URL to the pinned server
+	peer = Peer{URLs: []string{"https://localhost:1", srv.URL}, Password: "pass", PinnedPublicKeys: []string{badPin, goodPin}}
+	if err := peer.initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if isPasswdServer, resp, err := peer.tryUnlock(); err != nil || !isPasswdServer || resp != "unlocked" || unlockedWith != "pass" {
+		t.Fatal(isPasswdServer, string(resp), err, unlockedWith)
+	}
+}
+
+func TestPeer_scheduleNextAttempt(t *testing.T) {
+	peer := Peer{}
+	for i := 1; i <= 20; i++ {
+		peer.scheduleNextAttempt(false, 600)
+		delaySec := RetryMinIntervalSec << uint(i-1)
+		if delaySec > 600 || i > 16 {
+			delaySec = 600
+		}
+		if wait := time.Until(peer.nextAttempt); wait < time.Duration(delaySec)*time.Second/2-time.Second || wait > time.Duration(delaySec)*time.Second {
+			t.Fatal(i, wait)
+		}
+	}
+	peer.scheduleNextAttempt(true, 600)
+	if wait := time.Until(peer.nextAttempt); peer.failures != 0 || wait < 599*time.Second || wait > 600*time.Second {
+		t.Fatal(peer.failures, wait)
+	}
+}
@@ -0,0 +1,101 @@
+package common
+
+import (
+	"net"
+	"sync"
+)
+
+/*
+ConnLimit caps the number of connections that a single client (identified by IP) may keep open at the same time. Unlike
+the per-second rate limit, it prevents a client from accumulating a large number of lingering connections while staying
+within its allowed rate.
+*/
+type ConnLimit struct {
+	// MaxConnsPerIP is the maximum number of concurrent connections from a single IP. 0 means there is no limit.
+	MaxConnsPerIP int
+
+	mutex sync.Mutex
+	conns map[string]int
+}
+
+// Acquire counts a new connection from the client IP, and returns false if the client already has too many connections open.
+func (limit *ConnLimit) Acquire(clientIP string) bool {
+	if limit.MaxConnsPerIP < 1 {
+		return true
+	}
+	limit.mutex.Lock()
+	defer limit.mutex.Unlock()
+	if limit.conns == nil {
+		limit.conns = make(map[string]int)
+	}
+	if limit.conns[clientIP] >= limit.MaxConnsPerIP {
+		return false
+	}
+	limit.conns[clientIP]++
+	return true
+}
+
+// Release discounts a connection from the client IP that was earlier counted by Acquire.
+func (limit *ConnLimit) Release(clientIP string) {
+	if limit.MaxConnsPerIP < 1 {
+		return
+	}
+	limit.mutex.Lock()
+	defer limit.mutex.Unlock()
+	if limit.conns[clientIP] <= 1 {
+		delete(limit.conns, clientIP)
+	} else {
+		limit.conns[clientIP]--
+	}
+}
+
+// Count returns the number of open connections from the client IP.
+func (limit *ConnLimit) Count(clientIP string) int {
+	limit.mutex.Lock()
+	defer limit.mutex.Unlock()
+	return limit.conns[clientIP]
+}
+
+/*
+ConnLimitListener wraps a listener to apply a concurrent connection limit to its clients. Connections beyond the limit
+are closed right away and never handed over to the caller of Accept. It is useful to servers that accept connections
+on their own, such as the HTTP server from standard library.
+*/
+type ConnLimitListener struct {
+	net.Listener
+	Limit *ConnLimit
+}
+
+// Accept waits for and returns the next connection from a client that has not exceeded the limit.
+func (listener *ConnLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := listener.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		clientIP := conn.RemoteAddr().String()
+		if host, _, err := net.SplitHostPort(clientIP); err == nil {
+			clientIP = host
+		}
+		if !listener.Limit.Acquire(clientIP) {
+			_ = conn.Close()
+			continue
+		}
+		return &limitedConn{Conn: conn, limit: listener.Limit, clientIP: clientIP}, nil
+	}
+}
+
+// limitedConn releases the connection from the concurrent connection limit when it is closed.
+type limitedConn struct {
+	net.Conn
+	limit    *ConnLimit
+	clientIP string
+	release  sync.Once
+}
+
+func (conn *limitedConn) Close() error {
+	conn.release.Do(func() {
+		conn.limit.Release(conn.clientIP)
+	})
+	return conn.Conn.Close()
+}
@@ -0,0 +1,122 @@
+package common
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnLimit(t *testing.T) {
+	limit := &ConnLimit{MaxConnsPerIP: 2}
+	if !limit.Acquire("1.1.1.1") || !limit.Acquire("1.1.1.1") || limit.Acquire("1.1.1.1") {
+		t.Fatal("did not limit")
+	}
+	if !limit.Acquire("2.2.2.2") {
+		t.Fatal("should not limit another IP")
+	}
+	limit.Release("1.1.1.1")
+	if limit.Count("1.1.1.1") != 1 || !limit.Acquire("1.1.1.1") {
+		t.Fatal("did not release")
+	}
+	limit.Release("2.2.2.2")
+	if limit.Count("2.2.2.2") != 0 {
+		t.Fatal("did not release")
+	}
+	// No limit
+	unlimited := &ConnLimit{}
+	for i := 0; i < 100; i++ {
+		if !unlimited.Acquire("1.1.1.1") {
+			t.Fatal("should not limit")
+		}
+	}
+}
+
+func TestTCPServer_MaxConnsPerIP(t *testing.T) {
+	srv := &TCPServer{ListenAddr: "127.0.0.1", ListenPort: 62177, AppName: "TestTCPServer_MaxConnsPerIP", App: &slowApp{delay: 1 * time.Second}, LimitPerSec: 10, MaxConnsPerIP: 2}
+	srv.Initialise()
+	go func() {
+		if err := srv.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer srv.Stop()
+	time.Sleep(1 * time.Second)
+	clients := make([]net.Conn, 0)
+	for i := 0; i < 3; i++ {
+		client, err := net.Dial("tcp", "127.0.0.1:62177")
+		if err != nil {
+			t.Fatal(err)
+		}
+		clients = append(clients, client)
+		time.Sleep(100 * time.Millisecond)
+	}
+	// The third connection is closed right away
+	if resp, err := ioutil.ReadAll(clients[2]); err != nil || len(resp) != 0 {
+		t.Fatal(err, string(resp))
+	}
+	for _, client := range clients[:2] {
+		if resp, err := ioutil.ReadAll(client); err != nil || string(resp) != "slow" {
+			t.Fatal(err, string(resp))
+		}
+	}
+	// The finished conversations no longer count toward the limit
+	time.Sleep(100 * time.Millisecond)
+	if count := srv.connLimit.Count("127.0.0.1"); count != 0 {
+		t.Fatal(count)
+	}
+	client, err := net.Dial("tcp", "127.0.0.1:62177")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := ioutil.ReadAll(client); err != nil || string(resp) != "slow" {
+		t.Fatal(err, string(resp))
+	}
+}
+
+func TestConnLimitListener(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:62178")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &ConnLimitListener{Listener: tcpListener, Limit: &ConnLimit{MaxConnsPerIP: 1}}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	first, err := net.Dial("tcp", "127.0.0.1:62178")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	serverConn := <-accepted
+	// The second connection is closed by the listener
+	second, err := net.Dial("tcp", "127.0.0.1:62178")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := ioutil.ReadAll(second); err != nil || len(resp) != 0 {
+		t.Fatal(err, string(resp))
+	}
+	// Closing the accepted connection makes room for a new one, closing it twice does not discount it twice
+	_ = serverConn.Close()
+	_ = serverConn.Close()
+	third, err := net.Dial("tcp", "127.0.0.1:62178")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer third.Close()
+	select {
+	case conn := <-accepted:
+		_ = conn.Close()
+	case <-time.After(3 * time.Second):
+		t.Fatal("did not accept the new connection")
+	}
+}
@@ -0,0 +1,55 @@
+package common
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// listeningPorts are the TCP and UDP ports that daemons have started listening on, keyed by network and port (e.g. "tcp/53").
+	listeningPorts      = make(map[string]bool)
+	listeningPortsMutex = new(sync.Mutex)
+)
+
+// MarkListening memorises that a daemon has started listening on the port of the network type (tcp or udp).
+func MarkListening(network string, port int) {
+	if port < 1 {
+		return
+	}
+	listeningPortsMutex.Lock()
+	defer listeningPortsMutex.Unlock()
+	listeningPorts[fmt.Sprintf("%s/%d", network, port)] = true
+}
+
+// getNotListening returns the TCP and UDP ports (e.g. "tcp/53") that are not yet listened on, zero ports are ignored.
+func getNotListening(tcpPorts, udpPorts []int) (ret []string) {
+	listeningPortsMutex.Lock()
+	defer listeningPortsMutex.Unlock()
+	for network, ports := range map[string][]int{"tcp": tcpPorts, "udp": udpPorts} {
+		for _, port := range ports {
+			if key := fmt.Sprintf("%s/%d", network, port); port > 0 && !listeningPorts[key] {
+				ret = append(ret, key)
+			}
+		}
+	}
+	sort.Strings(ret)
+	return
+}
+
+/*
+WaitForListeners blocks until daemons have started listening on all of the TCP and UDP ports, or until the timeout
+elapses. It returns the ports (e.g. "tcp/53") that are still not listened on by then. Privileges may be dropped safely
+once daemons have bound their privileged ports.
+*/
+func WaitForListeners(tcpPorts, udpPorts []int, timeout time.Duration) []string {
+	deadline := time.Now().Add(timeout)
+	for {
+		notListening := getNotListening(tcpPorts, udpPorts)
+		if len(notListening) == 0 || !time.Now().Before(deadline) {
+			return notListening
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,41 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+func TestWaitForListeners(t *testing.T) {
+	// Zero ports are never waited for
+	if notListening := WaitForListeners([]int{0}, []int{0}, time.Second); len(notListening) != 0 {
+		t.Fatal(notListening)
+	}
+	// Time out on ports that nobody listens on
+	start := time.Now()
+	if notListening := WaitForListeners([]int{62183}, []int{62184}, 500*time.Millisecond); !reflect.DeepEqual(notListening, []string{"tcp/62183", "udp/62184"}) {
+		t.Fatal(notListening)
+	}
+	if elapsed := time.Since(start); elapsed < 500*time.Millisecond || elapsed > 2*time.Second {
+		t.Fatal(elapsed)
+	}
+	// The barrier is lifted as soon as the ports are listened on
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		tcpListener, err := ListenTCP(lalog.Logger{}, "127.0.0.1", 62183)
+		if err != nil {
+			panic(err)
+		}
+		defer tcpListener.Close()
+		udpConn, err := ListenUDP(lalog.Logger{}, "127.0.0.1", 62184)
+		if err != nil {
+			panic(err)
+		}
+		defer udpConn.Close()
+	}()
+	if notListening := WaitForListeners([]int{62183}, []int{62184}, 10*time.Second); len(notListening) != 0 {
+		t.Fatal(notListening)
+	}
+}
@@ -0,0 +1,81 @@
+package common
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+/*
+DrainTimeoutSec is the maximum number of seconds that TCP and UDP servers wait for their ongoing conversations to finish
+after being told to stop. Afterwards the remaining client connections are closed forcibly.
+*/
+var DrainTimeoutSec = 10
+
+// NewDrainContext returns a context that expires after the drain period of DrainTimeoutSec.
+func NewDrainContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), time.Duration(DrainTimeoutSec)*time.Second)
+}
+
+// drainPollInterval is the interval at which a stopping server checks whether its ongoing conversations have finished.
+const drainPollInterval = 50 * time.Millisecond
+
+/*
+conversationTracker keeps track of the ongoing conversations of a server, so that the server may wait for them to
+finish before shutting down.
+*/
+type conversationTracker struct {
+	mutex         sync.Mutex
+	conversations map[*conversation]struct{}
+}
+
+// conversation is an ongoing conversation, its closer (if any) terminates the conversation forcibly.
+type conversation struct {
+	closer io.Closer
+}
+
+// begin memorises a new conversation and returns the function to be called when the conversation finishes.
+func (tracker *conversationTracker) begin(closer io.Closer) (finish func()) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	if tracker.conversations == nil {
+		tracker.conversations = make(map[*conversation]struct{})
+	}
+	conv := &conversation{closer: closer}
+	tracker.conversations[conv] = struct{}{}
+	return func() {
+		tracker.mutex.Lock()
+		delete(tracker.conversations, conv)
+		tracker.mutex.Unlock()
+	}
+}
+
+// count returns the number of ongoing conversations.
+func (tracker *conversationTracker) count() int {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	return len(tracker.conversations)
+}
+
+/*
+drain waits for the ongoing conversations to finish. If the context expires beforehand, the remaining conversations are
+closed forcibly and the context error is returned.
+*/
+func (tracker *conversationTracker) drain(ctx context.Context) error {
+	for tracker.count() > 0 {
+		select {
+		case <-ctx.Done():
+			tracker.mutex.Lock()
+			for conv := range tracker.conversations {
+				if conv.closer != nil {
+					_ = conv.closer.Close()
+				}
+			}
+			tracker.mutex.Unlock()
+			return ctx.Err()
+		case <-time.After(drainPollInterval):
+		}
+	}
+	return nil
+}
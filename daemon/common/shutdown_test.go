@@ -0,0 +1,126 @@
+package common
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+// slowApp responds to TCP and UDP clients after a delay.
+type slowApp struct {
+	delay time.Duration
+}
+
+func (app *slowApp) GetTCPStatsCollector() *misc.Stats {
+	return misc.NewStats()
+}
+
+func (app *slowApp) HandleTCPConnection(logger lalog.Logger, clientIP string, conn *net.TCPConn) {
+	time.Sleep(app.delay)
+	_, _ = conn.Write([]byte("slow"))
+}
+
+func (app *slowApp) GetUDPStatsCollector() *misc.Stats {
+	return misc.NewStats()
+}
+
+func (app *slowApp) HandleUDPClient(logger lalog.Logger, clientIP string, client *net.UDPAddr, packet []byte, srv *net.UDPConn) {
+	time.Sleep(app.delay)
+	_, _ = srv.WriteToUDP([]byte("slow"), client)
+}
+
+func TestTCPServer_Shutdown(t *testing.T) {
+	srv := NewTCPServer("127.0.0.1", 62176, "TestTCPServer_Shutdown", &slowApp{delay: 1 * time.Second}, 5, 0)
+	go func() {
+		if err := srv.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(1 * time.Second)
+	client, err := net.Dial("tcp", "127.0.0.1:62176")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// The ongoing conversation finishes before shutdown completes
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := ioutil.ReadAll(client); err != nil || string(resp) != "slow" {
+		t.Fatal(err, string(resp))
+	}
+	if _, err := net.Dial("tcp", "127.0.0.1:62176"); err == nil {
+		t.Fatal("did not stop listening")
+	}
+
+	// The conversation that does not finish in time is terminated
+	srv = NewTCPServer("127.0.0.1", 62176, "TestTCPServer_Shutdown", &slowApp{delay: 3 * time.Second}, 5, 0)
+	go func() {
+		if err := srv.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(1 * time.Second)
+	client, err = net.Dial("tcp", "127.0.0.1:62176")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	if resp, _ := ioutil.ReadAll(client); len(resp) != 0 {
+		t.Fatal(string(resp))
+	}
+}
+
+func TestUDPServer_Shutdown(t *testing.T) {
+	srv := NewUDPServer("127.0.0.1", 12384, "TestUDPServer_Shutdown", &slowApp{delay: 1 * time.Second}, 5, 0)
+	stopped := make(chan struct{})
+	go func() {
+		if err := srv.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+		close(stopped)
+	}()
+	time.Sleep(1 * time.Second)
+	client, err := net.Dial("udp", "127.0.0.1:12384")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// The response of the ongoing conversation is delivered before the server socket is closed
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("did not stop")
+	}
+	buf := make([]byte, 16)
+	if err := client.SetReadDeadline(time.Now().Add(3 * time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := client.Read(buf); err != nil || string(buf[:n]) != "slow" {
+		t.Fatal(err, string(buf[:n]))
+	}
+	// The server may start again after shutdown
+	go func() {
+		if err := srv.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(1 * time.Second)
+	srv.Stop()
+}
@@ -0,0 +1,120 @@
+package common
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/platform"
+)
+
+// inheritedSocket is a listening socket passed down by systemd socket activation.
+type inheritedSocket struct {
+	file *os.File
+	addr net.Addr
+}
+
+var (
+	inheritedSockets     []inheritedSocket
+	inheritedSocketsOnce = new(sync.Once)
+)
+
+/*
+getInheritedSockets returns the sockets passed down by systemd socket activation along with their listening addresses.
+The sockets are kept open for the lifetime of the program, so that a daemon restarted by configuration reload listens on
+the very same socket without losing the connections queued in the meantime.
+*/
+func getInheritedSockets() []inheritedSocket {
+	inheritedSocketsOnce.Do(func() {
+		for _, file := range platform.GetInheritedSocketFiles() {
+			// Both functions duplicate the file descriptor, closing the duplicate leaves the inherited socket intact.
+			if listener, err := net.FileListener(file); err == nil {
+				inheritedSockets = append(inheritedSockets, inheritedSocket{file: file, addr: listener.Addr()})
+				_ = listener.Close()
+			} else if conn, err := net.FilePacketConn(file); err == nil {
+				inheritedSockets = append(inheritedSockets, inheritedSocket{file: file, addr: conn.LocalAddr()})
+				_ = conn.Close()
+			}
+		}
+	})
+	return inheritedSockets
+}
+
+// isSameListenIP returns true if the socket's IP address satisfies the IP address that a server wishes to listen on.
+func isSameListenIP(listenAddr string, sockIP net.IP) bool {
+	if listenAddr == "" {
+		return true
+	}
+	ip := net.ParseIP(listenAddr)
+	if ip == nil {
+		// A host name is never resolved for the comparison
+		return false
+	}
+	// A socket bound to all network interfaces satisfies any specific address too
+	return ip.IsUnspecified() || sockIP.IsUnspecified() || ip.Equal(sockIP)
+}
+
+// findInheritedSocket returns the file of an inherited socket of the network type (tcp or udp) that listens on the address and port.
+func findInheritedSocket(network, listenAddr string, port int) *os.File {
+	for _, sock := range getInheritedSockets() {
+		switch addr := sock.addr.(type) {
+		case *net.TCPAddr:
+			if network == "tcp" && addr.Port == port && isSameListenIP(listenAddr, addr.IP) {
+				return sock.file
+			}
+		case *net.UDPAddr:
+			if network == "udp" && addr.Port == port && isSameListenIP(listenAddr, addr.IP) {
+				return sock.file
+			}
+		}
+	}
+	return nil
+}
+
+/*
+ListenTCP returns a TCP listener on the address and port. If systemd socket activation has passed down a socket that
+listens on the port, the listener uses the socket instead of binding the port, which allows laitos to serve privileged
+ports without running as root.
+*/
+func ListenTCP(logger lalog.Logger, listenAddr string, port int) (net.Listener, error) {
+	if file := findInheritedSocket("tcp", listenAddr, port); file != nil {
+		logger.Info("ListenTCP", "", nil, "using the socket passed down by systemd (%s) for TCP port %d", file.Name(), port)
+		listener, err := net.FileListener(file)
+		if err == nil {
+			MarkListening("tcp", port)
+		}
+		return listener, err
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(listenAddr, strconv.Itoa(port)))
+	if err == nil {
+		MarkListening("tcp", port)
+	}
+	return listener, err
+}
+
+/*
+ListenUDP returns a UDP socket on the address and port. If systemd socket activation has passed down a socket that
+listens on the port, the socket is used instead of binding the port.
+*/
+func ListenUDP(logger lalog.Logger, listenAddr string, port int) (*net.UDPConn, error) {
+	if file := findInheritedSocket("udp", listenAddr, port); file != nil {
+		logger.Info("ListenUDP", "", nil, "using the socket passed down by systemd (%s) for UDP port %d", file.Name(), port)
+		conn, err := net.FilePacketConn(file)
+		if err != nil {
+			return nil, err
+		}
+		MarkListening("udp", port)
+		return conn.(*net.UDPConn), nil
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(listenAddr, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err == nil {
+		MarkListening("udp", port)
+	}
+	return conn, err
+}
@@ -0,0 +1,76 @@
+package common
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+func TestListenInheritedSockets(t *testing.T) {
+	tcpListener, err := net.Listen("tcp", "127.0.0.1:62179")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcpFile, err := tcpListener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpFile.Close()
+	_ = tcpListener.Close()
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 62179})
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpFile, err := udpConn.File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpFile.Close()
+	_ = udpConn.Close()
+	// Pretend that systemd has passed down the sockets
+	inheritedSocketsOnce = new(sync.Once)
+	inheritedSocketsOnce.Do(func() {})
+	inheritedSockets = []inheritedSocket{
+		{file: tcpFile, addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 62179}},
+		{file: udpFile, addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 62179}},
+	}
+	defer func() {
+		inheritedSockets = nil
+		inheritedSocketsOnce = new(sync.Once)
+	}()
+
+	if file := findInheritedSocket("tcp", "127.0.0.2", 62179); file != nil {
+		t.Fatal("should not have matched a different IP")
+	}
+	if file := findInheritedSocket("tcp", "0.0.0.0", 62180); file != nil {
+		t.Fatal("should not have matched a different port")
+	}
+	// The inherited socket remains usable after the listener is closed, e.g. when a daemon restarts
+	for i := 0; i < 2; i++ {
+		listener, err := ListenTCP(lalog.Logger{}, "0.0.0.0", 62179)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client, err := net.Dial("tcp", "127.0.0.1:62179")
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = server.Close()
+		_ = client.Close()
+		_ = listener.Close()
+	}
+	conn, err := ListenUDP(lalog.Logger{}, "127.0.0.1", 62179)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.LocalAddr().(*net.UDPAddr).Port != 62179 {
+		t.Fatal(conn.LocalAddr())
+	}
+}
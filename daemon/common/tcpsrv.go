@@ -1,11 +1,13 @@
 package common
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/misc"
 	"net"
-	"strconv"
+	"os"
 	"strings"
 	"sync"
 	"time"
@@ -20,6 +22,8 @@ const (
 		Server application should always override the default IO timeout by setting a new timeout in connection handler.
 	*/
 	ServerDefaultIOTimeoutSec = 10 * 60
+	// ServerTLSHandshakeTimeoutSec is the timeout of TLS handshake with a client of a TCP server that terminates TLS.
+	ServerTLSHandshakeTimeoutSec = 30
 )
 
 // TCPApp defines routines for a TCP server application to accept, process, and interact with client connections.
@@ -30,6 +34,15 @@ type TCPApp interface {
 	HandleTCPConnection(lalog.Logger, string, *net.TCPConn)
 }
 
+/*
+TLSApp defines the routine for a TCP server application to interact with client connections over TLS, the TLS handshake
+is completed by the TCP server before handing over the connection.
+*/
+type TLSApp interface {
+	// HandleTLSConnection converses with the TLS client. The client connection is closed by server upon returning from the implementation.
+	HandleTLSConnection(lalog.Logger, string, *tls.Conn)
+}
+
 // TCPServer implements common routines for a TCP server that interacts with unlimited number of clients while applying a rate limit.
 type TCPServer struct {
 	// ListenAddr is the IP address to listen on. Use 0.0.0.0 to listen on all network interfaces.
@@ -46,21 +59,76 @@ type TCPServer struct {
 		terminated.
 	*/
 	LimitPerSec int
+	/*
+		GlobalLimitPerSec is the maximum number of connections acceptable from all clients combined per second, it protects
+		the host from floods of rotating source IPs that never trigger LimitPerSec. 0 means there is no aggregate limit.
+	*/
+	GlobalLimitPerSec int
+	/*
+		BurstPerIP is the number of actions a single IP may make in quick succession, it turns LimitPerSec into the
+		sustained rate of a token bucket. 0 means LimitPerSec is enforced on each interval of one second.
+	*/
+	BurstPerIP int
+	/*
+		LimitPerSecOverrides are the per-IP limits of the clients in the networks of CIDR notation (e.g. "192.0.2.0/24"),
+		they take precedence over LimitPerSec. A limit of 0 exempts the clients from the per-IP rate limit.
+	*/
+	LimitPerSecOverrides map[string]int
+	/*
+		MaxConnsPerIP is the maximum number of connections a single IP may keep open at the same time, regardless of how
+		slowly they were made. Connections beyond the limit are closed right away. 0 means there is no limit.
+	*/
+	MaxConnsPerIP int
+	/*
+		TLSConfig turns the server into a TLS server, which completes TLS handshake with each client and then hands the
+		connection over to the app's HandleTLSConnection. The app must implement TLSApp in addition to TCPApp.
+	*/
+	TLSConfig *tls.Config
+	/*
+		UnixSocketPath, if not empty, makes the server listen on a Unix domain socket at the path in addition to the TCP
+		port, or instead of the TCP port if ListenPort is 0. The app must implement UnixSocketApp.
+	*/
+	UnixSocketPath string
+	// UnixSocketPerm is the file permission of the Unix domain socket (default to 0600).
+	UnixSocketPerm os.FileMode
 
-	mutex     *sync.Mutex
-	logger    lalog.Logger
-	rateLimit *misc.RateLimit
-	listener  net.Listener
+	mutex           *sync.Mutex
+	logger          lalog.Logger
+	rateLimit       *misc.RateLimit
+	globalRateLimit *misc.RateLimit
+	connLimit       *ConnLimit
+	listener        net.Listener
+	unixListener    net.Listener
+	conversations   *conversationTracker
 }
 
 // NewTCPServer constructs a new TCP server and initialises its internal structures.
-func NewTCPServer(listenAddr string, listenPort int, appName string, app TCPApp, limitPerSec int) (srv *TCPServer) {
+func NewTCPServer(listenAddr string, listenPort int, appName string, app TCPApp, limitPerSec, globalLimitPerSec int) (srv *TCPServer) {
+	srv = &TCPServer{
+		ListenAddr:        listenAddr,
+		ListenPort:        listenPort,
+		AppName:           appName,
+		App:               app,
+		LimitPerSec:       limitPerSec,
+		GlobalLimitPerSec: globalLimitPerSec,
+	}
+	srv.Initialise()
+	return
+}
+
+/*
+NewTLSServer constructs a new TCP server that terminates TLS for the application, and initialises its internal
+structures. The application must implement TLSApp.
+*/
+func NewTLSServer(listenAddr string, listenPort int, appName string, app TCPApp, tlsConfig *tls.Config, limitPerSec, globalLimitPerSec int) (srv *TCPServer) {
 	srv = &TCPServer{
-		ListenAddr:  listenAddr,
-		ListenPort:  listenPort,
-		AppName:     appName,
-		App:         app,
-		LimitPerSec: limitPerSec,
+		ListenAddr:        listenAddr,
+		ListenPort:        listenPort,
+		AppName:           appName,
+		App:               app,
+		LimitPerSec:       limitPerSec,
+		GlobalLimitPerSec: globalLimitPerSec,
+		TLSConfig:         tlsConfig,
 	}
 	srv.Initialise()
 	return
@@ -69,37 +137,81 @@ func NewTCPServer(listenAddr string, listenPort int, appName string, app TCPApp,
 // Initialise initialises the internal structures of the TCP server, preparing it for accepting clients.
 func (srv *TCPServer) Initialise() {
 	srv.mutex = new(sync.Mutex)
+	srv.conversations = new(conversationTracker)
 	srv.logger = lalog.Logger{
 		ComponentName: srv.AppName,
 		ComponentID:   []lalog.LoggerIDField{{Key: "Addr", Value: srv.ListenAddr}, {Key: "TCPPort", Value: srv.ListenPort}},
 	}
-	srv.rateLimit = &misc.RateLimit{Logger: srv.logger, UnitSecs: 1, MaxCount: srv.LimitPerSec}
+	srv.rateLimit = &misc.RateLimit{Logger: srv.logger, UnitSecs: 1, MaxCount: srv.LimitPerSec, Overrides: srv.LimitPerSecOverrides}
+	if srv.BurstPerIP > 0 {
+		srv.rateLimit.Algorithm = misc.RateLimitTokenBucket
+		srv.rateLimit.Burst = srv.BurstPerIP
+	}
 	srv.rateLimit.Initialise()
+	srv.globalRateLimit = nil
+	if srv.GlobalLimitPerSec > 0 {
+		// Token bucket tolerates a short burst of legitimate clients while capping the sustained rate
+		srv.globalRateLimit = &misc.RateLimit{Logger: srv.logger, UnitSecs: 1, MaxCount: srv.GlobalLimitPerSec, Algorithm: misc.RateLimitTokenBucket}
+		srv.globalRateLimit.Initialise()
+	}
+	srv.connLimit = &ConnLimit{MaxConnsPerIP: srv.MaxConnsPerIP}
 }
 
 /*
-StartAndBlock starts TCP listener to process client connections and blocks until the server is told to stop.
-Call this function after having initialised the TCP server.
+StartAndBlock starts TCP listener, and the Unix domain socket listener if configured, to process client connections and
+blocks until the server is told to stop. Call this function after having initialised the TCP server.
 */
 func (srv *TCPServer) StartAndBlock() error {
 	srv.mutex.Lock()
-	if srv.listener != nil {
+	if srv.listener != nil || srv.unixListener != nil {
 		srv.mutex.Unlock()
 		return fmt.Errorf("TCPServer.StartAndBlock(%s): listener on port %d must not be started a second time", srv.AppName, srv.ListenPort)
 	}
-	srv.logger.Info("StartAndBlock", "", nil, "starting TCP listener")
-	var err error
-	srv.listener, err = net.Listen("tcp", net.JoinHostPort(srv.ListenAddr, strconv.Itoa(srv.ListenPort)))
+	if _, isTLSApp := srv.App.(TLSApp); srv.TLSConfig != nil && !isTLSApp {
+		srv.mutex.Unlock()
+		return fmt.Errorf("TCPServer.StartAndBlock(%s): the app must be able to handle TLS connections", srv.AppName)
+	}
+	var listener, unixListener net.Listener
+	if srv.UnixSocketPath != "" {
+		var err error
+		if unixListener, err = srv.listenUnixSocket(); err != nil {
+			srv.mutex.Unlock()
+			return err
+		}
+		srv.unixListener = unixListener
+	}
+	if srv.ListenPort > 0 || srv.UnixSocketPath == "" {
+		srv.logger.Info("StartAndBlock", "", nil, "starting TCP listener")
+		var err error
+		listener, err = ListenTCP(srv.logger, srv.ListenAddr, srv.ListenPort)
+		if err != nil {
+			if unixListener != nil {
+				srv.logger.MaybeMinorError(unixListener.Close())
+				srv.unixListener = nil
+			}
+			srv.mutex.Unlock()
+			return fmt.Errorf("TCPServer.StartAndBlock(%s): failed to listen on port %d - %v", srv.AppName, srv.ListenPort, err)
+		}
+		srv.listener = listener
+	}
 	srv.mutex.Unlock()
-	if err != nil {
-		return fmt.Errorf("TCPServer.StartAndBlock(%s): failed to listen on port %d - %v", srv.AppName, srv.ListenPort, err)
+	if listener == nil {
+		// The server only listens on the Unix domain socket
+		return srv.acceptUnixClients(unixListener)
+	}
+	if unixListener != nil {
+		go func() {
+			if err := srv.acceptUnixClients(unixListener); err != nil {
+				srv.logger.Warning("StartAndBlock", "", err, "Unix domain socket listener stopped")
+			}
+		}()
 	}
 	for {
 		if misc.EmergencyLockDown {
 			srv.logger.Warning("StartAndBlock", "", misc.ErrEmergencyLockDown, "")
 			return misc.ErrEmergencyLockDown
 		}
-		client, err := srv.listener.Accept()
+		client, err := listener.Accept()
 		if err != nil {
 			if strings.Contains(err.Error(), "closed") {
 				return nil
@@ -109,51 +221,129 @@ func (srv *TCPServer) StartAndBlock() error {
 		// Check client IP against rate limit
 		tcpClient := client.(*net.TCPConn)
 		clientIP := tcpClient.RemoteAddr().(*net.TCPAddr).IP.String()
-		if !srv.rateLimit.Add(clientIP, true) {
+		if !srv.AddAndCheckRateLimit(clientIP) {
 			srv.logger.MaybeMinorError(tcpClient.Close())
 			continue
 		}
-		go srv.handleConnection(clientIP, tcpClient)
+		if !srv.connLimit.Acquire(clientIP) {
+			srv.logger.Info("StartAndBlock", clientIP, nil, "closing the connection as the client already has %d connections open", srv.MaxConnsPerIP)
+			srv.logger.MaybeMinorError(tcpClient.Close())
+			continue
+		}
+		finish, ok := srv.beginConversation(listener, tcpClient)
+		if !ok {
+			srv.connLimit.Release(clientIP)
+			continue
+		}
+		go func() {
+			defer finish()
+			defer srv.connLimit.Release(clientIP)
+			srv.handleConnection(clientIP, tcpClient)
+		}()
+	}
+}
+
+/*
+beginConversation memorises the client connection as an ongoing conversation, so that the server waits for it to finish
+when shutting down. If the listener has already been stopped, the client is disconnected and the function returns false.
+*/
+func (srv *TCPServer) beginConversation(listener net.Listener, client net.Conn) (finish func(), ok bool) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if listener != srv.listener && listener != srv.unixListener {
+		srv.logger.MaybeMinorError(client.Close())
+		return nil, false
 	}
+	return srv.conversations.begin(client), true
 }
 
 // AddAndCheckRateLimit may be optionally invoked by TCP application in the middle of an ongoing conversation to check whether conversation is going on too fast.
 func (srv *TCPServer) AddAndCheckRateLimit(clientIP string) bool {
-	return srv.rateLimit.Add(clientIP, true)
+	// The client's own hits are checked first, so that a single flooding client does not use up the aggregate limit.
+	if !srv.rateLimit.Add(clientIP, true) {
+		return false
+	}
+	return srv.globalRateLimit == nil || srv.globalRateLimit.Add(misc.GlobalRateLimitActor, true)
 }
 
 // handleConnection is launched in an independent goroutine by StartAndBlock to interact with a connected client.
 func (srv *TCPServer) handleConnection(clientIP string, client *net.TCPConn) {
 	// Put processing duration into statistics
 	beginTimeNano := time.Now().UnixNano()
+	// All log messages produced while handling this connection carry the same trace ID
+	logger := srv.logger.WithTraceID(lalog.NewTraceID())
 	defer func() {
-		srv.logger.MaybeMinorError(client.Close())
+		logger.MaybeMinorError(client.Close())
 		srv.App.GetTCPStatsCollector().Trigger(float64(time.Now().UnixNano() - beginTimeNano))
 	}()
-	srv.logger.Info("handleConnection", clientIP, nil, "connection is accepted")
+	logger.Info("handleConnection", clientIP, nil, "connection is accepted")
 	// Turn on keep-alive for OS to detect and remove dead clients
 	if err := client.SetKeepAlive(true); err != nil {
-		srv.logger.Warning("handleConnection", clientIP, err, "failed to turn on keep alive, terminating the connection.")
+		logger.Warning("handleConnection", clientIP, err, "failed to turn on keep alive, terminating the connection.")
 		return
 	}
 	if err := client.SetKeepAlivePeriod(ServerDefaultIOTimeoutSec / 3); err != nil {
-		srv.logger.Warning("handleConnection", clientIP, err, "failed to turn on keep alive, terminating the connection.")
+		logger.Warning("handleConnection", clientIP, err, "failed to turn on keep alive, terminating the connection.")
 		return
 	}
 	// Apply the default IO timeout to prevent a potentially malfunctioning connection handler from hanging
 	if err := client.SetReadDeadline(time.Now().Add(ServerDefaultIOTimeoutSec * time.Second)); err != nil {
-		srv.logger.Warning("handleConnection", clientIP, err, "failed to set default read deadline, terminating the connection.")
+		logger.Warning("handleConnection", clientIP, err, "failed to set default read deadline, terminating the connection.")
 		return
 	}
 	if err := client.SetWriteDeadline(time.Now().Add(ServerDefaultIOTimeoutSec * time.Second)); err != nil {
-		srv.logger.Warning("handleConnection", clientIP, err, "failed to set default write deadline, terminating the connection.")
+		logger.Warning("handleConnection", clientIP, err, "failed to set default write deadline, terminating the connection.")
+		return
+	}
+	if srv.TLSConfig == nil {
+		srv.App.HandleTCPConnection(logger, clientIP, client)
 		return
 	}
-	srv.App.HandleTCPConnection(srv.logger, clientIP, client)
+	// Complete TLS handshake before handing the connection over to the app
+	tlsConn := tls.Server(client, srv.TLSConfig)
+	if err := tlsConn.SetDeadline(time.Now().Add(ServerTLSHandshakeTimeoutSec * time.Second)); err != nil {
+		logger.Warning("handleConnection", clientIP, err, "failed to set handshake deadline, terminating the connection.")
+		return
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		logger.Warning("handleConnection", clientIP, err, "TLS handshake failed")
+		return
+	}
+	if certs := tlsConn.ConnectionState().PeerCertificates; len(certs) > 0 {
+		logger.Info("handleConnection", clientIP, nil, "client presented certificate of \"%s\"", certs[0].Subject.CommonName)
+	}
+	// Restore the default IO timeout for the app
+	if err := tlsConn.SetDeadline(time.Now().Add(ServerDefaultIOTimeoutSec * time.Second)); err != nil {
+		logger.Warning("handleConnection", clientIP, err, "failed to set default deadline, terminating the connection.")
+		return
+	}
+	srv.App.(TLSApp).HandleTLSConnection(logger, clientIP, tlsConn)
+	logger.MaybeMinorError(tlsConn.Close())
 }
 
-// Stop the TCP server from accepting new connections. Ongoing connections will continue nonetheless.
+/*
+Stop the TCP server from accepting new connections, and wait for ongoing conversations to finish for up to the drain
+period of DrainTimeoutSec.
+*/
 func (srv *TCPServer) Stop() {
+	ctx, cancel := NewDrainContext()
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.logger.Warning("Stop", "", err, "closed the connections that did not finish in time")
+	}
+}
+
+/*
+Shutdown stops the TCP server from accepting new connections, and then waits for ongoing conversations to finish. If the
+context expires beforehand, the remaining client connections are closed and the context error is returned.
+*/
+func (srv *TCPServer) Shutdown(ctx context.Context) error {
+	srv.stopListeners()
+	return srv.conversations.drain(ctx)
+}
+
+// stopListeners closes the TCP listener and the Unix domain socket listener.
+func (srv *TCPServer) stopListeners() {
 	srv.mutex.Lock()
 	defer srv.mutex.Unlock()
 	if srv.listener != nil {
@@ -162,4 +352,11 @@ func (srv *TCPServer) Stop() {
 		}
 		srv.listener = nil
 	}
+	if srv.unixListener != nil {
+		// Closing the listener also removes the socket file
+		if err := srv.unixListener.Close(); err != nil {
+			srv.logger.Warning("Stop", "", err, "failed to stop Unix domain socket listener")
+		}
+		srv.unixListener = nil
+	}
 }
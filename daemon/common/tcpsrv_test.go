@@ -2,10 +2,14 @@ package common
 
 import (
 	"bufio"
+	"crypto/tls"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -30,6 +34,12 @@ func (app *TCPTestApp) HandleTCPConnection(logger lalog.Logger, clientIP string,
 	}
 }
 
+func (app *TCPTestApp) HandleTLSConnection(logger lalog.Logger, clientIP string, conn *tls.Conn) {
+	if n, err := conn.Write([]byte("hello tls")); err != nil || n != 9 {
+		log.Panicf("n %d err %v", n, err)
+	}
+}
+
 func TestTCPServer(t *testing.T) {
 	srv := TCPServer{
 		ListenAddr:  "127.0.0.1",
@@ -111,3 +121,111 @@ func TestTCPServer(t *testing.T) {
 	srv.Stop()
 	srv.Stop()
 }
+
+func TestTCPServer_GlobalLimit(t *testing.T) {
+	srv := NewTCPServer("127.0.0.1", 62173, "TestTCPServer_GlobalLimit", &TCPTestApp{stats: misc.NewStats()}, 5, 3)
+	// Each client is well within its own limit, though the aggregate of all clients is not.
+	for i := 0; i < 3; i++ {
+		if !srv.AddAndCheckRateLimit(fmt.Sprintf("192.0.2.%d", i)) {
+			t.Fatal("should not have hit global limit", i)
+		}
+	}
+	if srv.AddAndCheckRateLimit("192.0.2.100") {
+		t.Fatal("should have hit global limit")
+	}
+	// A client that exceeds its own limit does not consume the aggregate limit
+	srv = NewTCPServer("127.0.0.1", 62173, "TestTCPServer_GlobalLimit", &TCPTestApp{stats: misc.NewStats()}, 1, 3)
+	for i := 0; i < 10; i++ {
+		srv.AddAndCheckRateLimit("192.0.2.1")
+	}
+	if !srv.AddAndCheckRateLimit("192.0.2.2") {
+		t.Fatal("should not have hit global limit")
+	}
+}
+
+func TestTCPServer_BurstAndOverrides(t *testing.T) {
+	srv := &TCPServer{ListenAddr: "127.0.0.1", ListenPort: 62173, AppName: "TestTCPServer_BurstAndOverrides", App: &TCPTestApp{stats: misc.NewStats()},
+		LimitPerSec: 1, BurstPerIP: 3, LimitPerSecOverrides: map[string]int{"192.0.2.0/24": 0}}
+	srv.Initialise()
+	// The burst is allowed right away
+	for i := 0; i < 3; i++ {
+		if !srv.AddAndCheckRateLimit("198.51.100.1") {
+			t.Fatal("should not have hit limit", i)
+		}
+	}
+	if srv.AddAndCheckRateLimit("198.51.100.1") {
+		t.Fatal("should have hit limit")
+	}
+	// Exempted clients are not limited
+	for i := 0; i < 10; i++ {
+		if !srv.AddAndCheckRateLimit("192.0.2.1") {
+			t.Fatal("should not have hit limit", i)
+		}
+	}
+}
+
+func TestTLSServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-TestTLSServer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	if err := WriteTestCertificate(certPath, keyPath, "TestTLSServer"); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := NewServerTLSConfig(certPath, "", ""); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, _, err := NewServerTLSConfig(certPath, keyPath, "/this/file/does/not/exist"); err == nil {
+		t.Fatal("did not error")
+	}
+	tlsConfig, _, err := NewServerTLSConfig(certPath, keyPath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewTLSServer("127.0.0.1", 62174, "TestTLSServer", &TCPTestApp{stats: misc.NewStats()}, tlsConfig, 5, 0)
+	go func() {
+		if err := srv.StartAndBlock(); err != nil {
+			panic(err)
+		}
+	}()
+	defer srv.Stop()
+	time.Sleep(1 * time.Second)
+
+	// The server completes TLS handshake before the app converses with the client
+	client, err := tls.Dial("tcp", "127.0.0.1:62174", &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if str, err := ioutil.ReadAll(client); err != nil || string(str) != "hello tls" {
+		t.Fatal(err, string(str))
+	}
+	// Plain TCP clients fail the handshake and do not reach the app
+	plainClient, err := net.Dial("tcp", "127.0.0.1:62174")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = plainClient.Write([]byte("hello\r\n"))
+	if str, _ := ioutil.ReadAll(plainClient); string(str) == "hello tls" {
+		t.Fatal(string(str))
+	}
+
+	// The app must be capable of handling TLS connections
+	plainApp := &TCPServer{ListenAddr: "127.0.0.1", ListenPort: 62175, AppName: "TestTLSServer", App: &plainTestApp{}, TLSConfig: tlsConfig, LimitPerSec: 5}
+	plainApp.Initialise()
+	if err := plainApp.StartAndBlock(); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+// plainTestApp is a TCP application that cannot handle TLS connections.
+type plainTestApp struct{}
+
+func (app *plainTestApp) GetTCPStatsCollector() *misc.Stats {
+	return misc.NewStats()
+}
+
+func (app *plainTestApp) HandleTCPConnection(lalog.Logger, string, *net.TCPConn) {
+}
@@ -0,0 +1,170 @@
+package common
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+// CertReloadIntervalSec is the minimum interval between checks of whether certificate files have been renewed on disk.
+const CertReloadIntervalSec = 60
+
+/*
+CertificateLoader reads a TLS certificate and key from PEM files (which may be encrypted), and serves the certificate to
+TLS servers. When the files are renewed on disk, for example by an ACME client such as certbot, the loader reads the new
+certificate for subsequent connections without restarting the server.
+*/
+type CertificateLoader struct {
+	CertPath string
+	KeyPath  string
+
+	mutex     sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time // modTime is the latest modification time among the certificate and key files.
+	lastCheck time.Time
+	logger    lalog.Logger
+}
+
+// getModTime returns the latest modification time among the certificate and key files.
+func (loader *CertificateLoader) getModTime() (ret time.Time, err error) {
+	for _, path := range []string{loader.CertPath, loader.KeyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(ret) {
+			ret = info.ModTime()
+		}
+	}
+	return
+}
+
+// Load reads the certificate and key files. It must be called before serving the certificate.
+func (loader *CertificateLoader) Load() error {
+	loader.mutex.Lock()
+	defer loader.mutex.Unlock()
+	loader.logger = lalog.Logger{ComponentName: "CertificateLoader", ComponentID: []lalog.LoggerIDField{{Key: "Cert", Value: loader.CertPath}}}
+	return loader.load()
+}
+
+func (loader *CertificateLoader) load() error {
+	modTime, err := loader.getModTime()
+	if err != nil {
+		return fmt.Errorf("CertificateLoader: failed to read certificate or key - %v", err)
+	}
+	contents, _, err := misc.DecryptIfNecessary(misc.ProgramDataDecryptionPassword, loader.CertPath, loader.KeyPath)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair(contents[0], contents[1])
+	if err != nil {
+		return fmt.Errorf("CertificateLoader: failed to load certificate or key - %v", err)
+	}
+	loader.cert = &cert
+	loader.modTime = modTime
+	loader.lastCheck = time.Now()
+	return nil
+}
+
+/*
+GetCertificate returns the certificate for a TLS handshake, it is meant to be used as tls.Config's GetCertificate
+function. If the certificate files have been renewed, the new certificate is loaded and returned; should the new files be
+unusable, the previous certificate continues to be served.
+*/
+func (loader *CertificateLoader) GetCertificate(_ *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	loader.mutex.Lock()
+	defer loader.mutex.Unlock()
+	if loader.cert == nil {
+		return nil, fmt.Errorf("CertificateLoader: certificate %s has not been loaded", loader.CertPath)
+	}
+	if time.Since(loader.lastCheck) < CertReloadIntervalSec*time.Second {
+		return loader.cert, nil
+	}
+	loader.lastCheck = time.Now()
+	if modTime, err := loader.getModTime(); err == nil && !modTime.Equal(loader.modTime) {
+		if err := loader.load(); err == nil {
+			loader.logger.Info("GetCertificate", "", nil, "loaded the renewed certificate")
+		} else {
+			loader.logger.Warning("GetCertificate", "", err, "failed to load the renewed certificate, continue to use the previous one")
+		}
+	}
+	return loader.cert, nil
+}
+
+/*
+NewServerTLSConfig returns the TLS configuration of a server that serves the certificate and key, which are reloaded
+after renewal (e.g. by an ACME client). If the client CA path is not empty, the server only accepts clients that present
+a certificate issued by the certificate authorities.
+*/
+func NewServerTLSConfig(certPath, keyPath, clientCAPath string) (*tls.Config, *CertificateLoader, error) {
+	if certPath == "" || keyPath == "" {
+		return nil, nil, fmt.Errorf("NewServerTLSConfig: TLS certificate and key paths must be specified")
+	}
+	loader := &CertificateLoader{CertPath: certPath, KeyPath: keyPath}
+	if err := loader.Load(); err != nil {
+		return nil, nil, err
+	}
+	config := &tls.Config{
+		GetCertificate: loader.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if clientCAPath != "" {
+		caPEM, err := ioutil.ReadFile(clientCAPath)
+		if err != nil {
+			return nil, nil, fmt.Errorf("NewServerTLSConfig: failed to read client certificate authorities - %v", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			return nil, nil, fmt.Errorf("NewServerTLSConfig: %s does not contain PEM-encoded certificates", clientCAPath)
+		}
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, loader, nil
+}
+
+/*
+WriteTestCertificate writes a new self-signed certificate and its key into PEM files, it is meant for test cases. The
+certificate is good for both server and client authentication, and it is also the certificate authority of itself.
+*/
+func WriteTestCertificate(certPath, keyPath, commonName string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+}
@@ -0,0 +1,77 @@
+package common
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCertificateLoader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-TestCertificateLoader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+
+	loader := &CertificateLoader{CertPath: certPath, KeyPath: keyPath}
+	if _, err := loader.GetCertificate(nil); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := loader.Load(); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := WriteTestCertificate(certPath, keyPath, "first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := loader.Load(); err != nil {
+		t.Fatal(err)
+	}
+	getCommonName := func() string {
+		cert, err := loader.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed.Subject.CommonName
+	}
+	if name := getCommonName(); name != "first" {
+		t.Fatal(name)
+	}
+
+	// The renewed certificate is not picked up until the next check
+	if err := WriteTestCertificate(certPath, keyPath, "second"); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(certPath, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if name := getCommonName(); name != "first" {
+		t.Fatal(name)
+	}
+	loader.lastCheck = time.Time{}
+	if name := getCommonName(); name != "second" {
+		t.Fatal(name)
+	}
+
+	// An unusable renewal leaves the previous certificate in place
+	if err := ioutil.WriteFile(keyPath, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future = future.Add(time.Minute)
+	if err := os.Chtimes(keyPath, future, future); err != nil {
+		t.Fatal(err)
+	}
+	loader.lastCheck = time.Time{}
+	if name := getCommonName(); name != "second" {
+		t.Fatal(name)
+	}
+}
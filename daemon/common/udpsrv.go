@@ -1,15 +1,18 @@
 package common
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/platform"
 )
 
 const (
@@ -41,21 +44,45 @@ type UDPServer struct {
 		terminated.
 	*/
 	LimitPerSec int
+	/*
+		GlobalLimitPerSec is the maximum number of conversations acceptable from all clients combined per second, it protects
+		the host from floods of rotating source IPs that never trigger LimitPerSec. 0 means there is no aggregate limit.
+	*/
+	GlobalLimitPerSec int
+	/*
+		BurstPerIP is the number of actions a single IP may make in quick succession, it turns LimitPerSec into the
+		sustained rate of a token bucket. 0 means LimitPerSec is enforced on each interval of one second.
+	*/
+	BurstPerIP int
+	/*
+		LimitPerSecOverrides are the per-IP limits of the clients in the networks of CIDR notation (e.g. "192.0.2.0/24"),
+		they take precedence over LimitPerSec. A limit of 0 exempts the clients from the per-IP rate limit.
+	*/
+	LimitPerSecOverrides map[string]int
+	/*
+		NumReceivers is the number of sockets that listen on the port together using SO_REUSEPORT, each read by its own
+		goroutine, so that the kernel spreads incoming packets among them. It raises the throughput on multi-core hosts
+		where a single receive loop is the bottleneck. Values below 2 mean a single socket.
+	*/
+	NumReceivers int
 
-	mutex     *sync.Mutex
-	logger    lalog.Logger
-	rateLimit *misc.RateLimit
-	udpServer *net.UDPConn
+	mutex           *sync.Mutex
+	logger          lalog.Logger
+	rateLimit       *misc.RateLimit
+	globalRateLimit *misc.RateLimit
+	udpServers      []*net.UDPConn
+	conversations   *conversationTracker
 }
 
 // NewUDPServer constructs a new UDP server and initialises its internal structures.
-func NewUDPServer(listenAddr string, listenPort int, appName string, app UDPApp, limitPerSec int) (srv *UDPServer) {
+func NewUDPServer(listenAddr string, listenPort int, appName string, app UDPApp, limitPerSec, globalLimitPerSec int) (srv *UDPServer) {
 	srv = &UDPServer{
-		ListenAddr:  listenAddr,
-		ListenPort:  listenPort,
-		AppName:     appName,
-		App:         app,
-		LimitPerSec: limitPerSec,
+		ListenAddr:        listenAddr,
+		ListenPort:        listenPort,
+		AppName:           appName,
+		App:               app,
+		LimitPerSec:       limitPerSec,
+		GlobalLimitPerSec: globalLimitPerSec,
 	}
 	srv.Initialise()
 	return
@@ -64,6 +91,7 @@ func NewUDPServer(listenAddr string, listenPort int, appName string, app UDPApp,
 // Initialise initialises the internal structures of UDP server, preparing it for processing clients.
 func (srv *UDPServer) Initialise() {
 	srv.mutex = new(sync.Mutex)
+	srv.conversations = new(conversationTracker)
 	srv.logger = lalog.Logger{
 		ComponentName: srv.AppName,
 		ComponentID:   []lalog.LoggerIDField{{Key: "Addr", Value: srv.ListenAddr}, {Key: "UDPPort", Value: srv.ListenPort}},
@@ -73,8 +101,18 @@ func (srv *UDPServer) Initialise() {
 		MaxCount: srv.LimitPerSec,
 		Logger:   srv.logger,
 	}
-	srv.rateLimit = &misc.RateLimit{Logger: srv.logger, UnitSecs: 1, MaxCount: srv.LimitPerSec}
+	srv.rateLimit = &misc.RateLimit{Logger: srv.logger, UnitSecs: 1, MaxCount: srv.LimitPerSec, Overrides: srv.LimitPerSecOverrides}
+	if srv.BurstPerIP > 0 {
+		srv.rateLimit.Algorithm = misc.RateLimitTokenBucket
+		srv.rateLimit.Burst = srv.BurstPerIP
+	}
 	srv.rateLimit.Initialise()
+	srv.globalRateLimit = nil
+	if srv.GlobalLimitPerSec > 0 {
+		// Token bucket tolerates a short burst of legitimate clients while capping the sustained rate
+		srv.globalRateLimit = &misc.RateLimit{Logger: srv.logger, UnitSecs: 1, MaxCount: srv.GlobalLimitPerSec, Algorithm: misc.RateLimitTokenBucket}
+		srv.globalRateLimit.Initialise()
+	}
 }
 
 /*
@@ -83,30 +121,93 @@ Call this function after having initialised the UDP server.
 */
 func (srv *UDPServer) StartAndBlock() error {
 	srv.mutex.Lock()
-	if srv.udpServer != nil {
+	if srv.udpServers != nil {
 		srv.mutex.Unlock()
 		return fmt.Errorf("UDPServer.StartAndBlock(%s): listener on port %d must not be started a second time", srv.AppName, srv.ListenPort)
 	}
 	srv.logger.Info("StartAndBlock", "", nil, "starting UDP listener")
-	var err error
-	listenUDPAddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(srv.ListenAddr, strconv.Itoa(srv.ListenPort)))
+	conns, err := srv.listen()
 	if err != nil {
-		return fmt.Errorf("UDPServer.StartAndBlock(%s): failed to resolve listning address %s - %v", srv.AppName, srv.ListenAddr, err)
+		srv.mutex.Unlock()
+		return fmt.Errorf("UDPServer.StartAndBlock(%s): failed to listen on port %d - %v", srv.AppName, srv.ListenPort, err)
 	}
-	srv.udpServer, err = net.ListenUDP("udp", listenUDPAddr)
+	srv.udpServers = conns
 	srv.mutex.Unlock()
+	if len(conns) == 1 {
+		return srv.receive(conns[0])
+	}
+	// Each socket is read by its own receive loop, the first failure stops the server.
+	errs := make(chan error, len(conns))
+	for _, conn := range conns {
+		go func(conn *net.UDPConn) {
+			errs <- srv.receive(conn)
+		}(conn)
+	}
+	err = <-errs
 	if err != nil {
-		return fmt.Errorf("UDPServer.StartAndBlock(%s): failed to listen on port %d - %v", srv.AppName, srv.ListenPort, err)
+		srv.Stop()
 	}
+	for i := 1; i < len(conns); i++ {
+		<-errs
+	}
+	return err
+}
+
+/*
+listen opens the sockets that listen on the port. If systemd socket activation has passed down a socket for the port,
+or the server uses a single receiver, there will be only one socket. Otherwise the sockets share the port via
+SO_REUSEPORT, falling back to a single socket if the system does not support it.
+*/
+func (srv *UDPServer) listen() ([]*net.UDPConn, error) {
+	if srv.NumReceivers < 2 || findInheritedSocket("udp", srv.ListenAddr, srv.ListenPort) != nil {
+		conn, err := ListenUDP(srv.logger, srv.ListenAddr, srv.ListenPort)
+		if err != nil {
+			return nil, err
+		}
+		return []*net.UDPConn{conn}, nil
+	}
+	listenConfig := net.ListenConfig{
+		Control: func(_, _ string, rawConn syscall.RawConn) error {
+			return platform.SetReusePort(rawConn)
+		},
+	}
+	conns := make([]*net.UDPConn, 0, srv.NumReceivers)
+	port := srv.ListenPort
+	for i := 0; i < srv.NumReceivers; i++ {
+		conn, err := listenConfig.ListenPacket(context.Background(), "udp", net.JoinHostPort(srv.ListenAddr, strconv.Itoa(port)))
+		if err != nil {
+			if i == 0 {
+				srv.logger.Warning("listen", "", err, "failed to listen with SO_REUSEPORT, falling back to a single receiver")
+				conn, err := ListenUDP(srv.logger, srv.ListenAddr, srv.ListenPort)
+				if err != nil {
+					return nil, err
+				}
+				return []*net.UDPConn{conn}, nil
+			}
+			for _, opened := range conns {
+				srv.logger.MaybeMinorError(opened.Close())
+			}
+			return nil, err
+		}
+		conns = append(conns, conn.(*net.UDPConn))
+		// The remaining sockets join the port picked by the system for the first one, in case the listen port is 0.
+		port = conn.LocalAddr().(*net.UDPAddr).Port
+	}
+	MarkListening("udp", srv.ListenPort)
+	return conns, nil
+}
+
+// receive reads packets from the socket and processes them in their own goroutines, until the server is told to stop.
+func (srv *UDPServer) receive(conn *net.UDPConn) error {
 	packet := make([]byte, MaxUDPPacketSize)
 	for {
 		if misc.EmergencyLockDown {
 			srv.logger.Warning("StartAndBlock", "", misc.ErrEmergencyLockDown, "")
 			return misc.ErrEmergencyLockDown
 		}
-		packetLen, clientAddr, err := srv.udpServer.ReadFromUDP(packet)
+		packetLen, clientAddr, err := conn.ReadFromUDP(packet)
 		if err != nil {
-			if strings.Contains(err.Error(), "closed") {
+			if strings.Contains(err.Error(), "closed") || srv.isStopped(conn) {
 				return nil
 			}
 			return fmt.Errorf("UDPServer.StartAndBlock(%s): failed to read from next client - %v", srv.AppName, err)
@@ -116,49 +217,122 @@ func (srv *UDPServer) StartAndBlock() error {
 		}
 		// Check client IP against rate limit
 		clientIP := clientAddr.IP.String()
-		if !srv.rateLimit.Add(clientIP, true) {
+		if !srv.AddAndCheckRateLimit(clientIP) {
 			continue
 		}
-		go srv.handleClient(clientIP, clientAddr, packet[:packetLen])
+		finish, ok := srv.beginConversation(conn)
+		if !ok {
+			return nil
+		}
+		// The buffer is reused by the next read, hence the conversation gets a copy of the packet.
+		packetCopy := make([]byte, packetLen)
+		copy(packetCopy, packet[:packetLen])
+		go func() {
+			defer finish()
+			srv.handleClient(conn, clientIP, clientAddr, packetCopy)
+		}()
 	}
 }
 
+// isStopped returns true if the server has been told to stop reading from the connection.
+func (srv *UDPServer) isStopped(conn *net.UDPConn) bool {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	return !srv.isListening(conn)
+}
+
+// isListening returns true if the connection is among the server's current sockets. The caller must hold the mutex.
+func (srv *UDPServer) isListening(conn *net.UDPConn) bool {
+	for _, listening := range srv.udpServers {
+		if listening == conn {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+beginConversation memorises an ongoing conversation, so that the server waits for it to finish when shutting down. If
+the server has already been told to stop, the function returns false.
+*/
+func (srv *UDPServer) beginConversation(conn *net.UDPConn) (finish func(), ok bool) {
+	srv.mutex.Lock()
+	defer srv.mutex.Unlock()
+	if !srv.isListening(conn) {
+		return nil, false
+	}
+	// The conversations share the server socket, which is closed after they finish or the drain period expires.
+	return srv.conversations.begin(nil), true
+}
+
 // AddAndCheckRateLimit may be optionally invoked by UDP application in the middle of an ongoing conversation to check whether conversation is going on too fast.
 func (srv *UDPServer) AddAndCheckRateLimit(clientIP string) bool {
-	return srv.rateLimit.Add(clientIP, true)
+	// The client's own hits are checked first, so that a single flooding client does not use up the aggregate limit.
+	if !srv.rateLimit.Add(clientIP, true) {
+		return false
+	}
+	return srv.globalRateLimit == nil || srv.globalRateLimit.Add(misc.GlobalRateLimitActor, true)
 }
 
 // handleConnection is launched in an independent goroutine by StartAndBlock to interact with a connected client.
-func (srv *UDPServer) handleClient(clientIP string, clientAddr *net.UDPAddr, packet []byte) {
+func (srv *UDPServer) handleClient(conn *net.UDPConn, clientIP string, clientAddr *net.UDPAddr, packet []byte) {
 	// Put processing duration into statistics
 	beginTimeNano := time.Now().UnixNano()
 	defer func() {
 		srv.App.GetUDPStatsCollector().Trigger(float64(time.Now().UnixNano() - beginTimeNano))
 	}()
-	srv.logger.Info("handleClient", clientIP, nil, "conversation started")
+	// All log messages produced while handling this conversation carry the same trace ID
+	logger := srv.logger.WithTraceID(lalog.NewTraceID())
+	logger.Info("handleClient", clientIP, nil, "conversation started")
 	// Apply the default IO timeout to prevent a potentially malfunctioning connection handler from hanging
-	if err := srv.udpServer.SetWriteDeadline(time.Now().Add(ServerDefaultIOTimeoutSec * time.Second)); err != nil {
-		srv.logger.Warning("handleClient", clientIP, err, "failed to set default write deadline, terminating the conversation.")
+	if err := conn.SetWriteDeadline(time.Now().Add(ServerDefaultIOTimeoutSec * time.Second)); err != nil {
+		logger.Warning("handleClient", clientIP, err, "failed to set default write deadline, terminating the conversation.")
 		return
 	}
-	srv.App.HandleUDPClient(srv.logger, clientIP, clientAddr, packet, srv.udpServer)
+	srv.App.HandleUDPClient(logger, clientIP, clientAddr, packet, conn)
 }
 
 // IsRunning returns true only if the server has started and has not been told to stop.
 func (srv *UDPServer) IsRunning() bool {
 	srv.mutex.Lock()
 	defer srv.mutex.Unlock()
-	return srv.udpServer != nil
+	return srv.udpServers != nil
 }
 
-// Stop the UDP server from accepting new clients. Ongoing conversations will continue nonetheless.
+/*
+Stop the UDP server from accepting new clients, and wait for ongoing conversations to finish for up to the drain period
+of DrainTimeoutSec.
+*/
 func (srv *UDPServer) Stop() {
+	ctx, cancel := NewDrainContext()
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.logger.Warning("Stop", "", err, "closed the listener before all conversations finished")
+	}
+}
+
+/*
+Shutdown stops the UDP server from reading new packets, and then waits for ongoing conversations to finish before closing
+the server socket, so that their responses are delivered. If the context expires beforehand, the server socket is closed
+right away and the context error is returned.
+*/
+func (srv *UDPServer) Shutdown(ctx context.Context) error {
 	srv.mutex.Lock()
-	defer srv.mutex.Unlock()
-	if srv.udpServer != nil {
-		if err := srv.udpServer.Close(); err != nil {
-			srv.logger.Warning("Stop", "", err, "failed to stop UDP server listener")
+	conns := srv.udpServers
+	srv.udpServers = nil
+	for _, conn := range conns {
+		// Interrupt the ongoing read so that the server loop notices the shutdown
+		srv.logger.MaybeMinorError(conn.SetReadDeadline(time.Now()))
+	}
+	srv.mutex.Unlock()
+	if conns == nil {
+		return nil
+	}
+	err := srv.conversations.drain(ctx)
+	for _, conn := range conns {
+		if closeErr := conn.Close(); closeErr != nil {
+			srv.logger.Warning("Shutdown", "", closeErr, "failed to stop UDP server listener")
 		}
-		srv.udpServer = nil
 	}
+	return err
 }
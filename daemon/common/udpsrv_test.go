@@ -128,3 +128,90 @@ func TestUDPServer(t *testing.T) {
 		t.Fatal("must not be running anymore")
 	}
 }
+
+func TestUDPServer_Overrides(t *testing.T) {
+	srv := UDPServer{
+		ListenAddr:           "127.0.0.1",
+		ListenPort:           12386,
+		AppName:              "TestUDPServer_Overrides",
+		App:                  &UDPTestApp{stats: misc.NewStats()},
+		LimitPerSec:          1,
+		BurstPerIP:           3,
+		LimitPerSecOverrides: map[string]int{"192.0.2.0/24": 0, "2001:db8::/32": 10},
+	}
+	srv.Initialise()
+	for i := 0; i < 3; i++ {
+		if !srv.AddAndCheckRateLimit("198.51.100.1") {
+			t.Fatal("should not have hit limit", i)
+		}
+	}
+	if srv.AddAndCheckRateLimit("198.51.100.1") {
+		t.Fatal("should have hit limit")
+	}
+	// Exempted clients are not limited
+	for i := 0; i < 10; i++ {
+		if !srv.AddAndCheckRateLimit("192.0.2.1") {
+			t.Fatal("should not have hit limit", i)
+		}
+	}
+	// The burst of an override is proportional to its limit
+	for i := 0; i < 30; i++ {
+		if !srv.AddAndCheckRateLimit("2001:db8::1") {
+			t.Fatal("should not have hit limit", i)
+		}
+	}
+	if srv.AddAndCheckRateLimit("2001:db8::1") {
+		t.Fatal("should have hit limit")
+	}
+}
+
+func TestUDPServer_NumReceivers(t *testing.T) {
+	srv := UDPServer{
+		ListenAddr:   "127.0.0.1",
+		ListenPort:   12385,
+		AppName:      "TestUDPServer_NumReceivers",
+		App:          &UDPTestApp{stats: misc.NewStats()},
+		LimitPerSec:  100,
+		NumReceivers: 4,
+	}
+	srv.Initialise()
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- srv.StartAndBlock()
+	}()
+	time.Sleep(1 * time.Second)
+	srv.mutex.Lock()
+	numSockets := len(srv.udpServers)
+	srv.mutex.Unlock()
+	if numSockets != 4 {
+		t.Fatal(numSockets)
+	}
+	// Clients of different source ports are spread among the sockets, all of them get a response.
+	for i := 0; i < 20; i++ {
+		client, err := net.Dial("udp", "127.0.0.1:12385")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := client.Write([]byte{0}); err != nil || n != 1 {
+			t.Fatal(err, n)
+		}
+		buf := make([]byte, 5)
+		_ = client.SetReadDeadline(time.Now().Add(3 * time.Second))
+		if n, err := client.Read(buf); err != nil || string(buf[:n]) != "hello" {
+			t.Fatal(err, string(buf[:n]))
+		}
+		_ = client.Close()
+	}
+	srv.Stop()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("did not shut down")
+	}
+	if srv.IsRunning() {
+		t.Fatal("should not be running")
+	}
+}
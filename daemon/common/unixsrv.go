@@ -0,0 +1,101 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+/*
+UnixSocketClientID identifies the clients of Unix domain socket listeners in log entries and rate limit. The clients are
+local programs, they share the same rate limit.
+*/
+const UnixSocketClientID = "unix-socket"
+
+// UnixSocketApp defines the routine for a TCP server application to interact with clients of the Unix domain socket listener.
+type UnixSocketApp interface {
+	// HandleUnixConnection converses with the Unix domain socket client. The client connection is closed by server upon returning from the implementation.
+	HandleUnixConnection(lalog.Logger, string, *net.UnixConn)
+}
+
+// listenUnixSocket starts listening on the Unix domain socket path, and applies the file permission to the socket.
+func (srv *TCPServer) listenUnixSocket() (net.Listener, error) {
+	if _, isUnixApp := srv.App.(UnixSocketApp); !isUnixApp {
+		return nil, fmt.Errorf("TCPServer.StartAndBlock(%s): the app must be able to handle Unix domain socket connections", srv.AppName)
+	}
+	srv.logger.Info("StartAndBlock", "", nil, "starting Unix domain socket listener on %s", srv.UnixSocketPath)
+	// Remove the socket file left behind by an earlier process that did not exit cleanly
+	if info, err := os.Lstat(srv.UnixSocketPath); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("TCPServer.StartAndBlock(%s): %s exists and is not a socket", srv.AppName, srv.UnixSocketPath)
+		}
+		if err := os.Remove(srv.UnixSocketPath); err != nil {
+			return nil, fmt.Errorf("TCPServer.StartAndBlock(%s): failed to remove stale socket %s - %v", srv.AppName, srv.UnixSocketPath, err)
+		}
+	}
+	listener, err := net.Listen("unix", srv.UnixSocketPath)
+	if err != nil {
+		return nil, fmt.Errorf("TCPServer.StartAndBlock(%s): failed to listen on %s - %v", srv.AppName, srv.UnixSocketPath, err)
+	}
+	perm := srv.UnixSocketPerm
+	if perm == 0 {
+		perm = 0600
+	}
+	if err := os.Chmod(srv.UnixSocketPath, perm); err != nil {
+		_ = listener.Close()
+		return nil, fmt.Errorf("TCPServer.StartAndBlock(%s): failed to change permission of %s - %v", srv.AppName, srv.UnixSocketPath, err)
+	}
+	return listener, nil
+}
+
+// acceptUnixClients accepts and processes Unix domain socket clients until the listener is closed.
+func (srv *TCPServer) acceptUnixClients(listener net.Listener) error {
+	for {
+		if misc.EmergencyLockDown {
+			srv.logger.Warning("acceptUnixClients", "", misc.ErrEmergencyLockDown, "")
+			return misc.ErrEmergencyLockDown
+		}
+		client, err := listener.Accept()
+		if err != nil {
+			if strings.Contains(err.Error(), "closed") {
+				return nil
+			}
+			return fmt.Errorf("TCPServer.StartAndBlock(%s): failed to accept new Unix domain socket connection - %v", srv.AppName, err)
+		}
+		unixClient := client.(*net.UnixConn)
+		if !srv.AddAndCheckRateLimit(UnixSocketClientID) {
+			srv.logger.MaybeMinorError(unixClient.Close())
+			continue
+		}
+		finish, ok := srv.beginConversation(listener, unixClient)
+		if !ok {
+			continue
+		}
+		go func() {
+			defer finish()
+			srv.handleUnixConnection(unixClient)
+		}()
+	}
+}
+
+// handleUnixConnection is launched in an independent goroutine by acceptUnixClients to interact with a connected client.
+func (srv *TCPServer) handleUnixConnection(client *net.UnixConn) {
+	beginTimeNano := time.Now().UnixNano()
+	logger := srv.logger.WithTraceID(lalog.NewTraceID())
+	defer func() {
+		logger.MaybeMinorError(client.Close())
+		srv.App.GetTCPStatsCollector().Trigger(float64(time.Now().UnixNano() - beginTimeNano))
+	}()
+	logger.Info("handleUnixConnection", UnixSocketClientID, nil, "connection is accepted")
+	// Apply the default IO timeout to prevent a potentially malfunctioning connection handler from hanging
+	if err := client.SetDeadline(time.Now().Add(ServerDefaultIOTimeoutSec * time.Second)); err != nil {
+		logger.Warning("handleUnixConnection", UnixSocketClientID, err, "failed to set default deadline, terminating the connection.")
+		return
+	}
+	srv.App.(UnixSocketApp).HandleUnixConnection(logger, UnixSocketClientID, client)
+}
@@ -0,0 +1,74 @@
+package common
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+func (app *TCPTestApp) HandleUnixConnection(logger lalog.Logger, clientID string, conn *net.UnixConn) {
+	_, _ = conn.Write([]byte("hello " + clientID))
+}
+
+func TestTCPServer_UnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-TestTCPServer_UnixSocket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socketPath := filepath.Join(dir, "test.sock")
+	// A stale socket file is replaced, but other files are not.
+	if err := ioutil.WriteFile(socketPath, []byte{}, 0600); err != nil {
+		t.Fatal(err)
+	}
+	srv := NewTCPServer("127.0.0.1", 0, "TestTCPServer_UnixSocket", &TCPTestApp{stats: misc.NewStats()}, 5, 0)
+	srv.UnixSocketPath = socketPath
+	if err := srv.StartAndBlock(); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := os.Remove(socketPath); err != nil {
+		t.Fatal(err)
+	}
+	// The app must be capable of handling Unix domain socket connections
+	plainApp := NewTCPServer("127.0.0.1", 0, "TestTCPServer_UnixSocket", &plainTestApp{}, 5, 0)
+	plainApp.UnixSocketPath = socketPath
+	if err := plainApp.StartAndBlock(); err == nil {
+		t.Fatal("did not error")
+	}
+
+	// Listen on the Unix domain socket only
+	srv.UnixSocketPerm = 0640
+	stopped := make(chan struct{})
+	go func() {
+		if err := srv.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+		close(stopped)
+	}()
+	time.Sleep(1 * time.Second)
+	if info, err := os.Stat(socketPath); err != nil || info.Mode().Perm() != 0640 {
+		t.Fatal(err, info)
+	}
+	client, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := ioutil.ReadAll(client); err != nil || string(resp) != "hello "+UnixSocketClientID {
+		t.Fatal(err, string(resp))
+	}
+	srv.Stop()
+	select {
+	case <-stopped:
+	case <-time.After(3 * time.Second):
+		t.Fatal("did not stop")
+	}
+	if _, err := os.Stat(socketPath); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
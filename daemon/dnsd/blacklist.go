@@ -1,11 +1,19 @@
 package dnsd
 
 import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
 	"strings"
 	"sync"
 
 	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
 )
 
 const (
@@ -14,14 +22,132 @@ const (
 		The limit prevents an exceedingly long third party host file from taking too much memory.
 	*/
 	MaxNameEntriesToExtract = 50000
+	// BlackListMaxBytes is the maximum size of a single hosts file to be downloaded.
+	BlackListMaxBytes = 32 * 1048576
 )
 
-// HostsFileURLs is a collection of URLs where up-to-date ad/malware/spyware blacklist hosts files are published.
-var HostsFileURLs = []string{
-	"http://winhelp2002.mvps.org/hosts.txt",
-	"http://pgl.yoyo.org/adservers/serverlist.php?hostformat=hosts&showintro=0&mimetype=plaintext",
-	"http://www.malwaredomainlist.com/hostslist/hosts.txt",
-	"http://someonewhocares.org/hosts/hosts",
+const (
+	BlacklistFormatHosts   = "hosts"   // BlacklistFormatHosts is the format of hosts file, e.g. "0.0.0.0 ads.example.com".
+	BlacklistFormatDomains = "domains" // BlacklistFormatDomains is a plain list of domain names, one name per line.
+	BlacklistFormatAdBlock = "adblock" // BlacklistFormatAdBlock is the format of AdBlock filter list, e.g. "||ads.example.com^".
+)
+
+const (
+	BlockingModeNullIP   = "null-ip"  // BlockingModeNullIP answers blacklisted names with address 0.0.0.0.
+	BlockingModeNXDomain = "nxdomain" // BlockingModeNXDomain answers blacklisted names with "no such name" error.
+	BlockingModeRefused  = "refused"  // BlockingModeRefused answers blacklisted names with "refused" error.
+
+	// Response codes of DNS errors used by the blocking modes and DNSSEC validation.
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+	rcodeRefused  = 5
+)
+
+/*
+CompileBlacklistPattern turns a blacklist pattern into a regular expression that matches domain names in lower case
+(without trailing full-stop). The pattern is either a regular expression enclosed in slashes such as
+"/^ad[0-9]+\.example\.com$/", or a wildcard such as "*.doubleclick.net" where each asterisk matches any sequence of
+characters, including full-stops.
+*/
+func CompileBlacklistPattern(pattern string) (*regexp.Regexp, error) {
+	pattern = strings.TrimSpace(pattern)
+	if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		return regexp.Compile(pattern[1 : len(pattern)-1])
+	}
+	if pattern = normaliseDomainName(pattern); pattern == "" || strings.Trim(pattern, "*.") == "" {
+		return nil, fmt.Errorf("wildcard pattern \"%s\" would match every domain name", pattern)
+	}
+	return regexp.Compile("^" + strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1) + "$")
+}
+
+/*
+GetErrorResponse returns a DNS response packet (without prefix length bytes) that answers the query with an error
+response code, and without any resource record.
+*/
+func GetErrorResponse(queryNoLength []byte, rcode byte) []byte {
+	_, _, _, questionEnd := parseQuestion(queryNoLength)
+	if questionEnd == 0 {
+		return []byte{}
+	}
+	// Copy the transaction ID and question from input query into the response
+	resp := make([]byte, questionEnd)
+	copy(resp, queryNoLength[:questionEnd])
+	// Byte 2 - response, the query's opcode and recursion desired
+	resp[2] = 0x80 | queryNoLength[2]&0x79
+	// Byte 3 - recursion available, and the error
+	resp[3] = 0x80 | rcode&0x0f
+	// Exactly one question, no answer, authority, or additional records.
+	resp[4], resp[5] = 0, 1
+	for i := 6; i < 12; i++ {
+		resp[i] = 0
+	}
+	return resp
+}
+
+// getBlackListResponse returns a DNS response packet (without prefix length bytes) that blocks the blacklisted name.
+func (daemon *Daemon) getBlackListResponse(queryNoLength []byte) []byte {
+	switch daemon.BlockingMode {
+	case BlockingModeNXDomain:
+		return GetErrorResponse(queryNoLength, rcodeNXDomain)
+	case BlockingModeRefused:
+		return GetErrorResponse(queryNoLength, rcodeRefused)
+	default:
+		return GetBlackHoleResponse(queryNoLength)
+	}
+}
+
+/*
+BlacklistSource is a URL where an up-to-date ad/malware/spyware blacklist is published, along with the format of the
+blacklist.
+*/
+type BlacklistSource struct {
+	URL    string `json:"URL"`    // URL is the HTTP(S) location of the blacklist.
+	Format string `json:"Format"` // Format is one of "hosts", "domains", or "adblock", it is "hosts" by default.
+	Name   string `json:"Name"`   // Name identifies the source in stats, it is the host name of URL by default.
+
+	// numEntries is the number of names extracted from the source's latest download.
+	numEntries *lalog.Gauge
+}
+
+// Initialise validates the source and prepares its stats.
+func (src *BlacklistSource) Initialise() error {
+	u, err := url.Parse(src.URL)
+	if err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("blacklist source URL \"%s\" is not a valid HTTP(S) URL", src.URL)
+	}
+	if src.Format == "" {
+		src.Format = BlacklistFormatHosts
+	}
+	switch src.Format {
+	case BlacklistFormatHosts, BlacklistFormatDomains, BlacklistFormatAdBlock:
+	default:
+		return fmt.Errorf("blacklist source \"%s\" has an unknown format \"%s\"", src.URL, src.Format)
+	}
+	if src.Name == "" {
+		src.Name = u.Hostname()
+	}
+	src.numEntries = lalog.GetGauge("dnsd.BlacklistEntries." + src.Name)
+	return nil
+}
+
+// ExtractNames extracts domain names from the blacklist content according to the source's format.
+func (src *BlacklistSource) ExtractNames(content string) []string {
+	switch src.Format {
+	case BlacklistFormatDomains:
+		return ExtractNamesFromDomainList(content)
+	case BlacklistFormatAdBlock:
+		return ExtractNamesFromAdBlockContent(content)
+	default:
+		return ExtractNamesFromHostsContent(content)
+	}
+}
+
+// DefaultBlacklistSources are the blacklists downloaded by the DNS daemon if its configuration does not specify any.
+var DefaultBlacklistSources = []BlacklistSource{
+	{URL: "http://winhelp2002.mvps.org/hosts.txt", Format: BlacklistFormatHosts},
+	{URL: "http://pgl.yoyo.org/adservers/serverlist.php?hostformat=hosts&showintro=0&mimetype=plaintext", Format: BlacklistFormatHosts},
+	{URL: "http://www.malwaredomainlist.com/hostslist/hosts.txt", Format: BlacklistFormatHosts},
+	{URL: "http://someonewhocares.org/hosts/hosts", Format: BlacklistFormatHosts},
 }
 
 /*
@@ -43,28 +169,47 @@ var Whitelist = []string{
 }
 
 /*
-DownloadAllBlacklists attempts to download all hosts files and return combined list of domain names to block.
-The special cases of white listed names are removed from return value.
+DownloadAllBlacklists attempts to download blacklists from all (initialised) sources and return combined list of domain
+names to block. The special cases of white listed names are removed from return value.
 */
-func DownloadAllBlacklists(logger lalog.Logger) []string {
+func DownloadAllBlacklists(logger lalog.Logger, sources []BlacklistSource) []string {
+	tmpDir, err := ioutil.TempDir("", "laitos-blacklist")
+	if err != nil {
+		logger.Warning("DownloadAllBlacklists", "", err, "failed to create temporary directory")
+		return []string{}
+	}
+	defer func() {
+		logger.MaybeMinorError(os.RemoveAll(tmpDir))
+	}()
 	wg := new(sync.WaitGroup)
-	wg.Add(len(HostsFileURLs))
+	wg.Add(len(sources))
 
 	// Download all lists in parallel
-	lists := make([][]string, len(HostsFileURLs))
-	for i, url := range HostsFileURLs {
-		go func(i int, url string) {
-			resp, err := inet.DoHTTP(inet.HTTPRequest{TimeoutSec: BlackListDownloadTimeoutSec}, url)
+	lists := make([][]string, len(sources))
+	for i, src := range sources {
+		go func(i int, src BlacklistSource) {
+			defer wg.Done()
+			destPath := path.Join(tmpDir, fmt.Sprintf("blacklist-%d", i))
+			_, err := inet.DownloadFile(inet.DownloadRequest{
+				HTTPRequest: inet.HTTPRequest{TimeoutSec: BlackListDownloadTimeoutSec, MaxRetry: 3, MaxBytes: BlackListMaxBytes},
+				DestPath:    destPath,
+			}, src.URL)
+			var content []byte
 			if err == nil {
-				names := ExtractNamesFromHostsContent(string(resp.Body))
-				logger.Info("DownloadAllBlacklists", url, err, "downloaded %d names, please obey the license in which the list author publishes the data.", len(names))
+				content, err = ioutil.ReadFile(destPath)
+			}
+			if err == nil {
+				names := src.ExtractNames(string(content))
+				logger.Info("DownloadAllBlacklists", src.URL, err, "downloaded %d names in %s format, please obey the license in which the list author publishes the data.", len(names), src.Format)
 				lists[i] = names
 			} else {
-				logger.Warning("DownloadAllBlacklists", url, err, "failed to download blacklist")
+				logger.Warning("DownloadAllBlacklists", src.URL, err, "failed to download blacklist")
 				lists[i] = []string{}
 			}
-			defer wg.Done()
-		}(i, url)
+			if src.numEntries != nil {
+				src.numEntries.Set(int64(len(lists[i])))
+			}
+		}(i, src)
 	}
 	wg.Wait()
 	// Calculate unique set of domain names
@@ -87,6 +232,58 @@ func DownloadAllBlacklists(logger lalog.Logger) []string {
 	return ret
 }
 
+// isBlacklistableName returns true only if the domain name (in lower case) extracted from a blacklist may be blocked.
+func isBlacklistableName(name string) bool {
+	// Skip empty names, local names, and overly short names
+	// Also, domain name length may not exceed 253 characters according to various technical documents in the public domain.
+	return name != "" && !strings.HasSuffix(name, "localhost") && !strings.HasSuffix(name, "localdomain") &&
+		len(name) >= 4 && len(name) <= 253 && !strings.ContainsAny(name, " \t*/")
+}
+
+/*
+loadBlackListFile reads the blacklist saved by saveBlackListFile, and uses it as the blacklist from now on. The white
+listed names are not loaded.
+*/
+func (daemon *Daemon) loadBlackListFile() error {
+	content, err := ioutil.ReadFile(daemon.BlacklistFilePath)
+	if err != nil {
+		return err
+	}
+	blackList := make(map[string]struct{})
+	for _, line := range strings.Split(string(content), "\n") {
+		if entry := strings.TrimSpace(line); entry != "" && !daemon.isWhitelisted(entry) {
+			blackList[entry] = struct{}{}
+		}
+	}
+	daemon.blackListMutex.Lock()
+	daemon.blackList = blackList
+	daemon.blackListMutex.Unlock()
+	misc.DNSDBlackListSize.Set(int64(len(blackList)))
+	daemon.logger.Info("loadBlackListFile", "", nil, "loaded %d blacklist entries from \"%s\"", len(blackList), daemon.BlacklistFilePath)
+	return nil
+}
+
+/*
+saveBlackListFile writes the blacklist entries (names and IP addresses) into BlacklistFilePath, one entry per line. The
+file is replaced in whole, so that an interrupted write does not leave a partial blacklist behind.
+*/
+func (daemon *Daemon) saveBlackListFile(blackList map[string]struct{}) error {
+	var content bytes.Buffer
+	for entry := range blackList {
+		content.WriteString(entry)
+		content.WriteRune('\n')
+	}
+	tmpPath := daemon.BlacklistFilePath + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, content.Bytes(), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, daemon.BlacklistFilePath); err != nil {
+		_ = os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
 /*
 ExtractNamesFromHostsContent extracts domain names from hosts file content. It will not return empty lines, comments, and potentially
 illegal domain names.
@@ -120,10 +317,71 @@ func ExtractNamesFromHostsContent(content string) []string {
 		}
 		// Extract the name itself. Matching of black list name always takes place in lower case.
 		aName := strings.ToLower(strings.TrimSpace(line[:nameEnd]))
-		if aName == "" || strings.HasSuffix(aName, "localhost") || strings.HasSuffix(aName, "localdomain") ||
-			len(aName) < 4 || len(aName) > 253 {
-			// Skip empty names, local names, and overly short names
-			// Also, domain name length may not exceed 253 characters according to various technical documents in the public domain.
+		if !isBlacklistableName(aName) {
+			continue
+		}
+		ret = append(ret, aName)
+		if len(ret) > MaxNameEntriesToExtract {
+			// Avoid taking in too many names
+			break
+		}
+	}
+	return ret
+}
+
+/*
+ExtractNamesFromDomainList extracts domain names from a plain list of domain names, one name per line. It will not return
+empty lines, comments, and potentially illegal domain names.
+*/
+func ExtractNamesFromDomainList(content string) []string {
+	ret := make([]string, 0, 16384)
+	for _, line := range strings.Split(content, "\n") {
+		// Resolving a name that contains NULL byte triggers an internal panic in Go on Windows
+		if strings.ContainsRune(line, 0) {
+			continue
+		}
+		// Name may be followed by a comment
+		if commentStart := strings.IndexRune(line, '#'); commentStart != -1 {
+			line = line[:commentStart]
+		}
+		aName := strings.ToLower(strings.TrimSpace(line))
+		if !isBlacklistableName(aName) {
+			continue
+		}
+		ret = append(ret, aName)
+		if len(ret) > MaxNameEntriesToExtract {
+			// Avoid taking in too many names
+			break
+		}
+	}
+	return ret
+}
+
+/*
+ExtractNamesFromAdBlockContent extracts domain names from an AdBlock filter list. Only the rules that block an entire
+domain name (e.g. "||ads.example.com^", optionally followed by "$options") are used, the other rules such as exceptions,
+cosmetic filters, and URL patterns do not apply to DNS and are skipped.
+*/
+func ExtractNamesFromAdBlockContent(content string) []string {
+	ret := make([]string, 0, 16384)
+	for _, line := range strings.Split(content, "\n") {
+		// Resolving a name that contains NULL byte triggers an internal panic in Go on Windows
+		if strings.ContainsRune(line, 0) {
+			continue
+		}
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "||") {
+			// Skip comments, headers, exceptions, and other kinds of rules
+			continue
+		}
+		line = line[2:]
+		nameEnd := strings.IndexRune(line, '^')
+		// The name must be followed by the separator and nothing else other than options
+		if nameEnd == -1 || nameEnd+1 < len(line) && line[nameEnd+1] != '$' {
+			continue
+		}
+		aName := strings.ToLower(line[:nameEnd])
+		if !isBlacklistableName(aName) {
 			continue
 		}
 		ret = append(ret, aName)
@@ -1,15 +1,27 @@
 package dnsd
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
 )
 
 func TestDownloadAllBlacklists(t *testing.T) {
-	names := DownloadAllBlacklists(lalog.Logger{})
+	sources := make([]BlacklistSource, len(DefaultBlacklistSources))
+	copy(sources, DefaultBlacklistSources)
+	for i := range sources {
+		if err := sources[i].Initialise(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	names := DownloadAllBlacklists(lalog.Logger{}, sources)
 	if len(names) < 5000 {
 		t.Fatal("number of names is too little")
 	}
@@ -42,3 +54,122 @@ func TestExtractNamesFromHostsContent(t *testing.T) {
 		t.Fatal(names)
 	}
 }
+
+func TestBlacklistSource_Initialise(t *testing.T) {
+	for _, src := range []BlacklistSource{
+		{URL: ""},
+		{URL: "ftp://example.com/hosts"},
+		{URL: "https://example.com/hosts", Format: "json"},
+	} {
+		if err := src.Initialise(); err == nil {
+			t.Fatalf("did not error: %+v", src)
+		}
+	}
+	src := BlacklistSource{URL: "https://Example.com:8443/hosts.txt"}
+	if err := src.Initialise(); err != nil || src.Format != BlacklistFormatHosts || src.Name != "Example.com" || src.numEntries == nil {
+		t.Fatal(err, src)
+	}
+}
+
+func TestExtractNamesFromDomainList(t *testing.T) {
+	sample := fmt.Sprintf(`# comment
+ha
+Ads.Example.com
+  tracker.example.com   # comment
+*.wildcard.example.com
+
+bad%c.example.com
+`, 0)
+	names := ExtractNamesFromDomainList(sample)
+	if !reflect.DeepEqual(names, []string{"ads.example.com", "tracker.example.com"}) {
+		t.Fatal(names)
+	}
+	src := BlacklistSource{URL: "https://example.com/list", Format: BlacklistFormatDomains}
+	if err := src.Initialise(); err != nil || !reflect.DeepEqual(src.ExtractNames(sample), names) {
+		t.Fatal(err, src.ExtractNames(sample))
+	}
+}
+
+func TestExtractNamesFromAdBlockContent(t *testing.T) {
+	sample := `[Adblock Plus 2.0]
+! Title: sample
+||Ads.Example.com^
+||tracker.example.com^$third-party
+||ha^
+@@||good.example.com^
+example.com##.banner
+||cdn.example.com/ads/*
+||partial.example.com^/path
+/banner/*/img^
+`
+	names := ExtractNamesFromAdBlockContent(sample)
+	if !reflect.DeepEqual(names, []string{"ads.example.com", "tracker.example.com"}) {
+		t.Fatal(names)
+	}
+	src := BlacklistSource{URL: "https://example.com/list", Format: BlacklistFormatAdBlock}
+	if err := src.Initialise(); err != nil || !reflect.DeepEqual(src.ExtractNames(sample), names) {
+		t.Fatal(err, src.ExtractNames(sample))
+	}
+}
+
+func TestGetErrorResponse(t *testing.T) {
+	if packet := GetErrorResponse(githubComUDPQuery[:20], rcodeRefused); len(packet) != 0 {
+		t.Fatal(packet)
+	}
+	packet := GetErrorResponse(githubComUDPQuery, rcodeNXDomain)
+	if len(packet) != 28 || packet[0] != githubComUDPQuery[0] || packet[1] != githubComUDPQuery[1] || packet[2] != 0x81 || packet[3] != 0x83 ||
+		!reflect.DeepEqual(packet[4:12], []byte{0, 1, 0, 0, 0, 0, 0, 0}) || !reflect.DeepEqual(packet[12:], githubComUDPQuery[12:28]) {
+		t.Fatal(packet)
+	}
+}
+
+func TestDNSD_BlockingMode(t *testing.T) {
+	if misc.HostIsWindows() {
+		t.Skip("due to outstanding issues in Go, DNS server resolution routines cannot be tested on on Windows.")
+	}
+	if err := (&Daemon{BlockingMode: "drop"}).Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	daemon := Daemon{Address: "127.0.0.1", UDPPort: 62153, TCPPort: 18523}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	daemon.blackList = map[string]struct{}{"ads.example.com": {}}
+	go func() {
+		if err := daemon.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer daemon.Stop()
+	time.Sleep(2 * time.Second)
+
+	for _, network := range []string{"tcp", "udp"} {
+		port := daemon.TCPPort
+		if network == "udp" {
+			port = daemon.UDPPort
+		}
+		resolver := &net.Resolver{
+			PreferGo:     true,
+			StrictErrors: true,
+			Dial: func(ctx context.Context, _, address string) (conn net.Conn, e error) {
+				return net.Dial(network, fmt.Sprintf("127.0.0.1:%d", port))
+			},
+		}
+		daemon.BlockingMode = BlockingModeNullIP
+		if addrs, err := resolver.LookupIP(context.Background(), "ip4", "www.ads.example.com"); err != nil || len(addrs) != 1 || !addrs[0].Equal(net.IPv4zero) {
+			t.Fatal(network, addrs, err)
+		}
+		if addrs, err := resolver.LookupIP(context.Background(), "ip6", "www.ads.example.com"); err != nil || len(addrs) != 1 || !addrs[0].Equal(net.IPv6zero) {
+			t.Fatal(network, addrs, err)
+		}
+		daemon.BlockingMode = BlockingModeNXDomain
+		var dnsErr *net.DNSError
+		if addrs, err := resolver.LookupIPAddr(context.Background(), "www.ads.example.com"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Fatal(network, addrs, err)
+		}
+		daemon.BlockingMode = BlockingModeRefused
+		if addrs, err := resolver.LookupIPAddr(context.Background(), "www.ads.example.com"); !errors.As(err, &dnsErr) || dnsErr.IsNotFound {
+			t.Fatal(network, addrs, err)
+		}
+	}
+}
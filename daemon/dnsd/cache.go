@@ -0,0 +1,219 @@
+package dnsd
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+const (
+	DefaultCacheMaxEntries = 10000 // DefaultCacheMaxEntries is the default maximum number of responses kept in the response cache.
+	CacheMaxTTLSec         = 86400 // CacheMaxTTLSec is the maximum duration a response may stay in the cache, regardless of its TTL.
+)
+
+var (
+	// cacheHits is the number of queries answered by the response cache.
+	cacheHits = lalog.GetCounter("dnsd.CacheHits")
+	// cacheMisses is the number of queries forwarded to recursive resolvers after not being found in the response cache.
+	cacheMisses = lalog.GetCounter("dnsd.CacheMisses")
+)
+
+// cacheKey identifies the question of a cached response.
+type cacheKey struct {
+	name   string
+	qType  uint16
+	qClass uint16
+}
+
+// cacheEntry is a response from recursive resolver, along with the location of TTL of its resource records.
+type cacheEntry struct {
+	resp       []byte
+	ttlOffsets []int
+	storedAt   time.Time
+	expiry     time.Time
+}
+
+/*
+ResponseCache keeps the responses from recursive resolvers in memory keyed by the question (name, type, and class), so
+that repeated queries are answered right away without consulting the resolvers. A cached response expires according to
+the lowest TTL among its resource records, and the remaining TTL is given to the client.
+*/
+type ResponseCache struct {
+	MaxEntries int // MaxEntries is the maximum number of responses to keep.
+
+	mutex   *sync.Mutex
+	entries map[cacheKey]*cacheEntry
+}
+
+// NewResponseCache constructs a new instance of ResponseCache and initialises its internal state.
+func NewResponseCache(maxEntries int) *ResponseCache {
+	return &ResponseCache{
+		MaxEntries: maxEntries,
+		mutex:      new(sync.Mutex),
+		entries:    make(map[cacheKey]*cacheEntry),
+	}
+}
+
+// skipName returns the index right after the domain name that begins at the index, the name may end with a compression pointer.
+func skipName(packet []byte, i int) (int, bool) {
+	for {
+		if i >= len(packet) {
+			return 0, false
+		}
+		labelLen := int(packet[i])
+		if labelLen&0xc0 == 0xc0 {
+			return i + 2, i+2 <= len(packet)
+		} else if labelLen == 0 {
+			return i + 1, true
+		}
+		i += 1 + labelLen
+	}
+}
+
+/*
+parseResponseTTLs returns the location of TTL of each resource record in the response, and the lowest TTL among them.
+The function returns false if the response is not suitable for caching, e.g. it is truncated, it indicates a server
+failure, or it does not carry any resource record.
+*/
+func parseResponseTTLs(resp []byte) (ttlOffsets []int, minTTL uint32, ok bool) {
+	if len(resp) < 12 {
+		return nil, 0, false
+	}
+	// Must be a response that is not truncated, and the response code must be either "no error" or "no such name".
+	if resp[2]&0x80 == 0 || resp[2]&0x02 != 0 || resp[3]&0x0f != 0 && resp[3]&0x0f != 3 {
+		return nil, 0, false
+	}
+	i := 12
+	for q := 0; q < int(binary.BigEndian.Uint16(resp[4:6])); q++ {
+		if i, ok = skipName(resp, i); !ok {
+			return nil, 0, false
+		}
+		i += 4
+	}
+	numRecords := int(binary.BigEndian.Uint16(resp[6:8])) + int(binary.BigEndian.Uint16(resp[8:10])) + int(binary.BigEndian.Uint16(resp[10:12]))
+	minTTL = CacheMaxTTLSec
+	for r := 0; r < numRecords; r++ {
+		if i, ok = skipName(resp, i); !ok || i+10 > len(resp) {
+			return nil, 0, false
+		}
+		// The TTL of EDNS pseudo record (type OPT) carries flags instead
+		if rrType := binary.BigEndian.Uint16(resp[i : i+2]); rrType != typeOPT {
+			ttlOffsets = append(ttlOffsets, i+4)
+			if ttl := binary.BigEndian.Uint32(resp[i+4 : i+8]); ttl < minTTL {
+				minTTL = ttl
+			}
+		}
+		i += 10 + int(binary.BigEndian.Uint16(resp[i+8:i+10]))
+		if i > len(resp) {
+			return nil, 0, false
+		}
+	}
+	return ttlOffsets, minTTL, len(ttlOffsets) > 0 && minTTL > 0
+}
+
+/*
+Get returns a copy of the cached response to the query, with the TTL of its resource records reduced by the time spent in
+cache. The function returns nil if the response is not cached, has expired, or is longer than the maximum length.
+*/
+func (cache *ResponseCache) Get(queryNoLength []byte, maxLen int) []byte {
+	if cache == nil {
+		return nil
+	}
+	name, qType, qClass, _ := parseQuestion(queryNoLength)
+	if name == "" {
+		return nil
+	}
+	key := cacheKey{name: name, qType: qType, qClass: qClass}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	entry, exists := cache.entries[key]
+	if !exists || len(entry.resp) > maxLen {
+		cacheMisses.Add(1)
+		return nil
+	}
+	now := time.Now()
+	if !now.Before(entry.expiry) {
+		delete(cache.entries, key)
+		cacheMisses.Add(1)
+		return nil
+	}
+	cacheHits.Add(1)
+	resp := make([]byte, len(entry.resp))
+	copy(resp, entry.resp)
+	elapsed := uint32(now.Sub(entry.storedAt) / time.Second)
+	for _, offset := range entry.ttlOffsets {
+		if ttl := binary.BigEndian.Uint32(resp[offset : offset+4]); ttl > elapsed {
+			binary.BigEndian.PutUint32(resp[offset:offset+4], ttl-elapsed)
+		} else {
+			binary.BigEndian.PutUint32(resp[offset:offset+4], 1)
+		}
+	}
+	// Match transaction ID of the query
+	resp[0] = queryNoLength[0]
+	resp[1] = queryNoLength[1]
+	return resp
+}
+
+// Put stores a copy of the response to the query, if the response is suitable for caching.
+func (cache *ResponseCache) Put(queryNoLength, resp []byte) {
+	if cache == nil {
+		return
+	}
+	name, qType, qClass, _ := parseQuestion(queryNoLength)
+	if name == "" {
+		return
+	}
+	ttlOffsets, minTTL, ok := parseResponseTTLs(resp)
+	if !ok {
+		return
+	}
+	now := time.Now()
+	entry := &cacheEntry{
+		resp:       make([]byte, len(resp)),
+		ttlOffsets: ttlOffsets,
+		storedAt:   now,
+		expiry:     now.Add(time.Duration(minTTL) * time.Second),
+	}
+	copy(entry.resp, resp)
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if len(cache.entries) >= cache.MaxEntries {
+		// Make room by evicting the expired responses, and then arbitrary ones if the cache is still full.
+		for key, existing := range cache.entries {
+			if !now.Before(existing.expiry) {
+				delete(cache.entries, key)
+			}
+		}
+		for key := range cache.entries {
+			if len(cache.entries) < cache.MaxEntries {
+				break
+			}
+			delete(cache.entries, key)
+		}
+	}
+	cache.entries[cacheKey{name: name, qType: qType, qClass: qClass}] = entry
+}
+
+// Purge removes all cached responses and returns the number of responses removed.
+func (cache *ResponseCache) Purge() int {
+	if cache == nil {
+		return 0
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	count := len(cache.entries)
+	cache.entries = make(map[cacheKey]*cacheEntry)
+	return count
+}
+
+// Len returns the number of cached responses, including those that have expired but not yet been removed.
+func (cache *ResponseCache) Len() int {
+	if cache == nil {
+		return 0
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	return len(cache.entries)
+}
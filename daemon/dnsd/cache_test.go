@@ -0,0 +1,94 @@
+package dnsd
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// makeTestQueryAndResponse returns an A query of the domain name and a response that answers 1.2.3.4 with a TTL of 60 seconds.
+func makeTestQueryAndResponse(t *testing.T, name string) (query, resp []byte) {
+	encodedName, err := encodeDomainName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query = append([]byte{0x12, 0x34, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}, encodedName...)
+	query = append(query, 0, typeA, 0, classIN)
+	resp = append([]byte{0x12, 0x34, 0x81, 0x80, 0, 1, 0, 1, 0, 0, 0, 0}, query[12:]...)
+	resp = append(resp, 0xc0, 0x0c, 0, typeA, 0, classIN, 0, 0, 0, 60, 0, 4, 1, 2, 3, 4)
+	return
+}
+
+func TestParseResponseTTLs(t *testing.T) {
+	query, resp := makeTestQueryAndResponse(t, "example.com")
+	if offsets, minTTL, ok := parseResponseTTLs(resp); !ok || minTTL != 60 || len(offsets) != 1 || offsets[0] != len(query)+6 {
+		t.Fatal(offsets, minTTL, ok)
+	}
+	// Truncated response
+	resp[2] |= 0x02
+	if _, _, ok := parseResponseTTLs(resp); ok {
+		t.Fatal("should not have cached a truncated response")
+	}
+	resp[2] &^= 0x02
+	// Server failure
+	resp[3] = 0x82
+	if _, _, ok := parseResponseTTLs(resp); ok {
+		t.Fatal("should not have cached a server failure")
+	}
+	resp[3] = 0x80
+	// Malformed response
+	if _, _, ok := parseResponseTTLs(resp[:len(resp)-3]); ok {
+		t.Fatal("should not have cached a malformed response")
+	}
+	// Response without a record
+	if _, _, ok := parseResponseTTLs(append([]byte{0x12, 0x34, 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}, query[12:]...)); ok {
+		t.Fatal("should not have cached an empty response")
+	}
+}
+
+func TestResponseCache(t *testing.T) {
+	var nilCache *ResponseCache
+	nilCache.Put(nil, nil)
+	if nilCache.Get(nil, MaxPacketSize) != nil || nilCache.Purge() != 0 || nilCache.Len() != 0 {
+		t.Fatal("nil cache should do nothing")
+	}
+
+	cache := NewResponseCache(2)
+	query, resp := makeTestQueryAndResponse(t, "example.com")
+	if cache.Get(query, MaxPacketSize) != nil {
+		t.Fatal("should not have hit")
+	}
+	cache.Put(query, resp)
+	// The cached response answers a query of different ID and name in different case
+	query[0], query[1], query[13] = 0x56, 0x78, 'E'
+	cached := cache.Get(query, MaxPacketSize)
+	if len(cached) != len(resp) || cached[0] != 0x56 || cached[1] != 0x78 || cached[len(cached)-1] != 4 {
+		t.Fatal(cached)
+	}
+	if cache.Get(query, len(resp)-1) != nil {
+		t.Fatal("should not have answered a response that is too long")
+	}
+	// TTL is reduced by the time spent in cache
+	entry := cache.entries[cacheKey{name: "example.com", qType: typeA, qClass: classIN}]
+	entry.storedAt = entry.storedAt.Add(-50 * time.Second)
+	cached = cache.Get(query, MaxPacketSize)
+	if ttl := binary.BigEndian.Uint32(cached[entry.ttlOffsets[0] : entry.ttlOffsets[0]+4]); ttl != 10 {
+		t.Fatal(ttl)
+	}
+	// Expired response is removed
+	entry.expiry = time.Now()
+	if cache.Get(query, MaxPacketSize) != nil || cache.Len() != 0 {
+		t.Fatal("should not have answered an expired response")
+	}
+	// The number of entries is capped
+	for _, name := range []string{"a.example.com", "b.example.com", "c.example.com"} {
+		query, resp := makeTestQueryAndResponse(t, name)
+		cache.Put(query, resp)
+	}
+	if cache.Len() != 2 {
+		t.Fatal(cache.Len())
+	}
+	if count := cache.Purge(); count != 2 || cache.Len() != 0 {
+		t.Fatal(count)
+	}
+}
@@ -0,0 +1,254 @@
+package dnsd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+const (
+	CustomRecordTTL = 300 // CustomRecordTTL is the TTL of custom record answers, in number of seconds.
+
+	// DNS resource record types that may be defined as custom records.
+	typeA     = 1
+	typeCNAME = 5
+	typeMX    = 15
+	typeTXT   = 16
+	typeAAAA  = 28
+	classIN   = 1
+)
+
+// MXRecord is a mail exchange host and its preference among the mail exchanges of a domain name.
+type MXRecord struct {
+	Host string `json:"Host"` // Host is the domain name of the mail exchange.
+	Pref int    `json:"Pref"` // Pref is the preference of the mail exchange, lower value is more preferred.
+}
+
+/*
+CustomRecord is a set of static resource records of a domain name, the DNS daemon answers queries of these records on its
+own instead of consulting forwarders.
+*/
+type CustomRecord struct {
+	A     []string   `json:"A"`     // A is the IPv4 addresses of the domain name.
+	AAAA  []string   `json:"AAAA"`  // AAAA is the IPv6 addresses of the domain name.
+	CNAME string     `json:"CNAME"` // CNAME is the canonical name the domain name is an alias of, it excludes all other records.
+	TXT   []string   `json:"TXT"`   // TXT is the text entries of the domain name, each up to 255 characters long.
+	MX    []MXRecord `json:"MX"`    // MX is the mail exchanges of the domain name.
+
+	// answers are the resource record data of each type, prepared by Initialise.
+	answers map[uint16][][]byte
+}
+
+// normaliseDomainName turns a domain name into lower case and removes the trailing full-stop.
+func normaliseDomainName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+// encodeDomainName returns the domain name in the wire format of DNS, as a series of length-prefixed labels.
+func encodeDomainName(name string) ([]byte, error) {
+	var ret []byte
+	for _, label := range strings.Split(normaliseDomainName(name), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("domain name \"%s\" has an empty or overly long label", name)
+		}
+		ret = append(ret, byte(len(label)))
+		ret = append(ret, label...)
+	}
+	ret = append(ret, 0)
+	if len(ret) > 255 {
+		return nil, fmt.Errorf("domain name \"%s\" is too long", name)
+	}
+	return ret, nil
+}
+
+// Initialise validates the records and prepares their answers.
+func (rec *CustomRecord) Initialise(name string) error {
+	rec.answers = make(map[uint16][][]byte)
+	if rec.CNAME != "" {
+		if len(rec.A) > 0 || len(rec.AAAA) > 0 || len(rec.TXT) > 0 || len(rec.MX) > 0 {
+			return fmt.Errorf("custom record \"%s\" may not have other records along with CNAME", name)
+		}
+		target, err := encodeDomainName(rec.CNAME)
+		if err != nil {
+			return fmt.Errorf("custom record \"%s\": %v", name, err)
+		}
+		rec.answers[typeCNAME] = [][]byte{target}
+	}
+	for _, addr := range rec.A {
+		ip := net.ParseIP(addr)
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("custom record \"%s\": \"%s\" is not an IPv4 address", name, addr)
+		}
+		rec.answers[typeA] = append(rec.answers[typeA], ip.To4())
+	}
+	for _, addr := range rec.AAAA {
+		ip := net.ParseIP(addr)
+		if ip == nil || ip.To4() != nil {
+			return fmt.Errorf("custom record \"%s\": \"%s\" is not an IPv6 address", name, addr)
+		}
+		rec.answers[typeAAAA] = append(rec.answers[typeAAAA], ip.To16())
+	}
+	for _, text := range rec.TXT {
+		if len(text) > 255 {
+			return fmt.Errorf("custom record \"%s\": text entry is longer than 255 characters", name)
+		}
+		rec.answers[typeTXT] = append(rec.answers[typeTXT], append([]byte{byte(len(text))}, text...))
+	}
+	for _, mx := range rec.MX {
+		if mx.Pref < 0 || mx.Pref > 65535 {
+			return fmt.Errorf("custom record \"%s\": MX preference must be between 0 and 65535", name)
+		}
+		host, err := encodeDomainName(mx.Host)
+		if err != nil {
+			return fmt.Errorf("custom record \"%s\": %v", name, err)
+		}
+		rec.answers[typeMX] = append(rec.answers[typeMX], append([]byte{byte(mx.Pref / 256), byte(mx.Pref % 256)}, host...))
+	}
+	return nil
+}
+
+// reverseDomainName returns the domain name for reverse lookup (PTR query) of the IP address, under in-addr.arpa or ip6.arpa.
+func reverseDomainName(ip net.IP) string {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", ipv4[3], ipv4[2], ipv4[1], ipv4[0])
+	}
+	ipv6 := ip.To16()
+	labels := make([]string, 0, 2*len(ipv6)+1)
+	for i := len(ipv6) - 1; i >= 0; i-- {
+		labels = append(labels, fmt.Sprintf("%x", ipv6[i]&0x0f), fmt.Sprintf("%x", ipv6[i]>>4))
+	}
+	return strings.Join(append(labels, "ip6.arpa"), ".")
+}
+
+/*
+synthesisePTRRecords adds a PTR custom record for each IPv4 and IPv6 address among the custom records, so that reverse
+lookups of the addresses are answered by the domain names. An address shared by several domain names gets a PTR record
+for each of them. Explicitly defined custom records of the reverse lookup names are left intact.
+*/
+func synthesisePTRRecords(records map[string]*CustomRecord) error {
+	names := make([]string, 0, len(records))
+	for name := range records {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ptrRecords := make(map[string]*CustomRecord)
+	for _, name := range names {
+		rec := records[name]
+		encodedName, err := encodeDomainName(name)
+		if err != nil {
+			return fmt.Errorf("custom record \"%s\": %v", name, err)
+		}
+		for _, addr := range append(append([]string{}, rec.A...), rec.AAAA...) {
+			reverseName := reverseDomainName(net.ParseIP(addr))
+			if _, exists := records[reverseName]; exists {
+				continue
+			}
+			ptr, exists := ptrRecords[reverseName]
+			if !exists {
+				ptr = &CustomRecord{answers: make(map[uint16][][]byte)}
+				ptrRecords[reverseName] = ptr
+			}
+			ptr.answers[typePTR] = append(ptr.answers[typePTR], encodedName)
+		}
+	}
+	for reverseName, ptr := range ptrRecords {
+		records[reverseName] = ptr
+	}
+	return nil
+}
+
+/*
+parseQuestion returns the queried name (in lower case, without trailing full-stop), type, and class of the first question
+in the query packet, as well as the index right after the question. If the question cannot be parsed, the function will
+return an empty name.
+*/
+func parseQuestion(packet []byte) (name string, qType, qClass uint16, end int) {
+	labels, qType, qClass, end := parseQuestionLabels(packet)
+	if len(labels) == 0 {
+		return "", 0, 0, 0
+	}
+	return strings.ToLower(strings.Join(labels, ".")), qType, qClass, end
+}
+
+/*
+parseQuestionLabels returns the labels of queried name in their original letter case, type, and class of the first
+question in the query packet, as well as the index right after the question. If the question cannot be parsed, the
+function will return no labels.
+*/
+func parseQuestionLabels(packet []byte) (labels []string, qType, qClass uint16, end int) {
+	if len(packet) < MinNameQuerySize || binary.BigEndian.Uint16(packet[4:6]) < 1 {
+		return nil, 0, 0, 0
+	}
+	i := 12
+	for {
+		if i >= len(packet) {
+			return nil, 0, 0, 0
+		}
+		labelLen := int(packet[i])
+		if labelLen == 0 {
+			i++
+			break
+		}
+		// A query does not use compression pointers in its question
+		if labelLen > 63 || i+1+labelLen > len(packet) {
+			return nil, 0, 0, 0
+		}
+		labels = append(labels, string(packet[i+1:i+1+labelLen]))
+		i += 1 + labelLen
+	}
+	if i+4 > len(packet) || len(labels) == 0 {
+		return nil, 0, 0, 0
+	}
+	return labels, binary.BigEndian.Uint16(packet[i : i+2]), binary.BigEndian.Uint16(packet[i+2 : i+4]), i + 4
+}
+
+/*
+answerCustomRecord returns a response packet (without prefix length bytes) that answers the query from custom records.
+If the queried name does not have custom records, the function will return nil, and the query should be handled as usual.
+*/
+func (daemon *Daemon) answerCustomRecord(logger lalog.Logger, clientIP string, queryNoLength []byte) []byte {
+	if len(daemon.CustomRecords) == 0 {
+		return nil
+	}
+	name, qType, qClass, questionEnd := parseQuestion(queryNoLength)
+	if name == "" || qClass != classIN {
+		return nil
+	}
+	rec, exists := daemon.customRecords[name]
+	if !exists {
+		return nil
+	}
+	logger.Info("answerCustomRecord", clientIP, nil, "answer query \"%s\" of type %d from custom records", name, qType)
+	daemon.queryLog.Record(clientIP, name, qType, QueryDecisionCustom)
+	// Answer with the canonical name regardless of the queried type, or with the records of the queried type.
+	answerType := qType
+	if _, isAlias := rec.answers[typeCNAME]; isAlias {
+		answerType = typeCNAME
+	}
+	answers := rec.answers[answerType]
+	// Copy the question from input query into the response
+	resp := make([]byte, 0, questionEnd+len(answers)*64)
+	resp = append(resp, queryNoLength[:questionEnd]...)
+	// Byte 2 - response, the query's opcode, authoritative answer, the query's recursion desired
+	resp[2] = 0x80 | queryNoLength[2]&0x79 | 0x04
+	// Byte 3 - recursion available, no error
+	resp[3] = 0x80
+	// Exactly one question, followed by answers, no authority or additional records.
+	binary.BigEndian.PutUint16(resp[4:6], 1)
+	binary.BigEndian.PutUint16(resp[6:8], uint16(len(answers)))
+	binary.BigEndian.PutUint16(resp[8:10], 0)
+	binary.BigEndian.PutUint16(resp[10:12], 0)
+	for _, data := range answers {
+		// Name is a pointer to the queried name in question
+		resp = append(resp, 0xc0, 0x0c)
+		resp = append(resp, byte(answerType>>8), byte(answerType), 0, classIN)
+		resp = append(resp, 0, 0, byte(CustomRecordTTL>>8), byte(CustomRecordTTL&0xff))
+		resp = append(resp, byte(len(data)>>8), byte(len(data)))
+		resp = append(resp, data...)
+	}
+	return resp
+}
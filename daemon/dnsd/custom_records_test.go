@@ -0,0 +1,147 @@
+package dnsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+func TestCustomRecord_Initialise(t *testing.T) {
+	for _, rec := range []CustomRecord{
+		{A: []string{"::1"}},
+		{AAAA: []string{"1.2.3.4"}},
+		{A: []string{"1.2.3.4"}, CNAME: "example.com"},
+		{TXT: []string{strings.Repeat("a", 256)}},
+		{MX: []MXRecord{{Host: "mail..example.com", Pref: 10}}},
+		{MX: []MXRecord{{Host: "mail.example.com", Pref: 65536}}},
+	} {
+		if err := rec.Initialise("example.com"); err == nil {
+			t.Fatalf("did not error: %+v", rec)
+		}
+	}
+}
+
+func TestParseQuestion(t *testing.T) {
+	if name, qType, qClass, end := parseQuestion(githubComUDPQuery); name != "github.com" || qType != typeA || qClass != classIN || end != 28 {
+		t.Fatal(name, qType, qClass, end)
+	}
+	for _, packet := range [][]byte{nil, githubComUDPQuery[:20], githubComUDPQuery[:26]} {
+		if name, _, _, _ := parseQuestion(packet); name != "" {
+			t.Fatal(name)
+		}
+	}
+}
+
+func TestSynthesisePTRRecords(t *testing.T) {
+	if name := reverseDomainName(net.ParseIP("192.168.0.10")); name != "10.0.168.192.in-addr.arpa" {
+		t.Fatal(name)
+	}
+	if name := reverseDomainName(net.ParseIP("2001:db8::567:89ab")); name != "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa" {
+		t.Fatal(name)
+	}
+	records := map[string]*CustomRecord{
+		"a.lan":                 {A: []string{"10.0.0.1"}},
+		"b.lan":                 {A: []string{"10.0.0.1", "10.0.0.2"}},
+		"2.0.0.10.in-addr.arpa": {TXT: []string{"explicitly defined"}},
+		"alias.lan":             {CNAME: "a.lan"},
+	}
+	for name, rec := range records {
+		if err := rec.Initialise(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := synthesisePTRRecords(records); err != nil {
+		t.Fatal(err)
+	}
+	aLan, _ := encodeDomainName("a.lan")
+	bLan, _ := encodeDomainName("b.lan")
+	if ptr := records["1.0.0.10.in-addr.arpa"]; ptr == nil || !reflect.DeepEqual(ptr.answers[typePTR], [][]byte{aLan, bLan}) {
+		t.Fatalf("%+v", ptr)
+	}
+	if rec := records["2.0.0.10.in-addr.arpa"]; len(rec.answers[typePTR]) != 0 || len(rec.answers[typeTXT]) != 1 {
+		t.Fatalf("%+v", rec)
+	}
+	if len(records) != 5 {
+		t.Fatal(records)
+	}
+}
+
+func TestDNSD_CustomRecords(t *testing.T) {
+	if misc.HostIsWindows() {
+		t.Skip("due to outstanding issues in Go, DNS server resolution routines cannot be tested on on Windows.")
+	}
+	daemon := Daemon{
+		Address: "127.0.0.1",
+		UDPPort: 62152,
+		TCPPort: 18522,
+		// Custom record answers are recorded in the query log
+		QueryLogEntries: 100,
+		CustomRecords: map[string]*CustomRecord{
+			"Lab.Example.com.": {
+				A:    []string{"192.168.0.10", "192.168.0.11"},
+				AAAA: []string{"fd00::10"},
+				TXT:  []string{"hello lab"},
+				MX:   []MXRecord{{Host: "mail.lab.example.com", Pref: 10}},
+			},
+			"www.lab.example.com": {CNAME: "lab.example.com"},
+		},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if err := daemon.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer daemon.Stop()
+	time.Sleep(2 * time.Second)
+
+	for _, network := range []string{"tcp", "udp"} {
+		port := daemon.TCPPort
+		if network == "udp" {
+			port = daemon.UDPPort
+		}
+		resolver := &net.Resolver{
+			PreferGo:     true,
+			StrictErrors: true,
+			Dial: func(ctx context.Context, _, address string) (conn net.Conn, e error) {
+				return net.Dial(network, fmt.Sprintf("127.0.0.1:%d", port))
+			},
+		}
+		addrs, err := resolver.LookupHost(context.Background(), "LAB.example.com")
+		sort.Strings(addrs)
+		if err != nil || !reflect.DeepEqual(addrs, []string{"192.168.0.10", "192.168.0.11", "fd00::10"}) {
+			t.Fatal(network, addrs, err)
+		}
+		if txt, err := resolver.LookupTXT(context.Background(), "lab.example.com"); err != nil || !reflect.DeepEqual(txt, []string{"hello lab"}) {
+			t.Fatal(network, txt, err)
+		}
+		if mx, err := resolver.LookupMX(context.Background(), "lab.example.com"); err != nil || len(mx) != 1 || mx[0].Host != "mail.lab.example.com." || mx[0].Pref != 10 {
+			t.Fatal(network, mx, err)
+		}
+		if cname, err := resolver.LookupCNAME(context.Background(), "www.lab.example.com"); err != nil || cname != "lab.example.com." {
+			t.Fatal(network, cname, err)
+		}
+		// Reverse lookups are answered by the synthesised PTR records
+		for _, addr := range []string{"192.168.0.11", "fd00::10"} {
+			if names, err := resolver.LookupAddr(context.Background(), addr); err != nil || !reflect.DeepEqual(names, []string{"lab.example.com."}) {
+				t.Fatal(network, addr, names, err)
+			}
+		}
+	}
+	queryLog, err := daemon.GetQueryLog("127.0.0.1")
+	if err != nil || !strings.Contains(queryLog, " 127.0.0.1 TXT lab.example.com custom\n") || !strings.Contains(queryLog, " 127.0.0.1 CNAME www.lab.example.com custom\n") {
+		t.Fatal(queryLog, err)
+	}
+	if queryLog, err := daemon.GetQueryLog("127.0.0.2"); err != nil || queryLog != "" {
+		t.Fatal(queryLog, err)
+	}
+}
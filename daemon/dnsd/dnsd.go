@@ -3,10 +3,14 @@ package dnsd
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
+	"net/http"
+	"os"
 	"reflect"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -22,6 +26,13 @@ import (
 	"github.com/HouzuoGuo/laitos/misc"
 )
 
+var (
+	// statsTCP times the DNS queries received over TCP.
+	statsTCP = misc.GetStats("dnsd.TCP")
+	// statsUDP times the DNS queries received over UDP.
+	statsUDP = misc.GetStats("dnsd.UDP")
+)
+
 const (
 	RateLimitIntervalSec        = 1         // Rate limit is calculated at 1 second interval
 	ForwarderTimeoutSec         = 1 * 2     // ForwarderTimeoutSec is the IO timeout for a round trip interaction with forwarders
@@ -84,17 +95,40 @@ type TCPForwarderQuery struct {
 
 // A DNS forwarder daemon that selectively refuse to answer certain A record requests made against advertisement servers.
 type Daemon struct {
-	Address              string                    `json:"Address"`              // Network address for both TCP and UDP to listen to, e.g. 0.0.0.0 for all network interfaces.
-	AllowQueryIPPrefixes []string                  `json:"AllowQueryIPPrefixes"` // AllowQueryIPPrefixes are the string prefixes in IPv4 and IPv6 client addresses that are allowed to query the DNS server.
-	PerIPLimit           int                       `json:"PerIPLimit"`           // PerIPLimit is approximately how many concurrent users are expected to be using the server from same IP address
-	Forwarders           []string                  `json:"Forwarders"`           // DefaultForwarders are recursive DNS resolvers that will resolve name queries. They must support both TCP and UDP.
-	Processor            *toolbox.CommandProcessor `json:"-"`                    // Processor enables TXT queries to execute toolbox command
-
-	UDPPort int `json:"UDPPort"` // UDP port to listen on
-	TCPPort int `json:"TCPPort"` // TCP port to listen on
-
-	tcpServer *common.TCPServer
-	udpServer *common.UDPServer
+	Address               string                    `json:"Address"`               // Network address for both TCP and UDP to listen to, e.g. 0.0.0.0 for all network interfaces.
+	AllowQueryIPPrefixes  []string                  `json:"AllowQueryIPPrefixes"`  // AllowQueryIPPrefixes are the string prefixes in IPv4 and IPv6 client addresses that are allowed to query the DNS server.
+	PerIPLimit            int                       `json:"PerIPLimit"`            // PerIPLimit is approximately how many concurrent users are expected to be using the server from same IP address
+	PerIPBurst            int                       `json:"PerIPBurst"`            // PerIPBurst is the number of queries a client may make in quick succession, 0 means no burst beyond PerIPLimit.
+	PerIPLimitOverrides   map[string]int            `json:"PerIPLimitOverrides"`   // PerIPLimitOverrides are the PerIPLimit of clients in the networks (CIDR), 0 exempts them from the limit.
+	GlobalLimit           int                       `json:"GlobalLimit"`           // GlobalLimit is the maximum number of queries acceptable from all clients combined per second, 0 means unlimited.
+	Forwarders            []string                  `json:"Forwarders"`            // DefaultForwarders are recursive DNS resolvers that will resolve name queries. They must support both TCP and UDP.
+	ConditionalForwarders map[string]string         `json:"ConditionalForwarders"` // ConditionalForwarders are the resolvers (host:port) that exclusively resolve the names under their domain names.
+	Processor             *toolbox.CommandProcessor `json:"-"`                     // Processor enables TXT and A queries to execute toolbox command
+	CustomRecords         map[string]*CustomRecord  `json:"CustomRecords"`         // CustomRecords are static records of domain names (e.g. of a home lab) answered without consulting forwarders.
+	BlacklistSources      []BlacklistSource         `json:"BlacklistSources"`      // BlacklistSources are the blacklists to download, DefaultBlacklistSources are used if left empty.
+	BlacklistFilePath     string                    `json:"BlacklistFilePath"`     // BlacklistFilePath is the file that keeps the latest blacklist across restarts, empty means not to keep it.
+	BlockingMode          string                    `json:"BlockingMode"`          // BlockingMode is how blacklisted names are answered: "null-ip" (default), "nxdomain", or "refused".
+	Whitelist             []string                  `json:"Whitelist"`             // Whitelist are the domain names (along with their sub-domains) that are never blocked, even if they appear in black lists.
+	BlacklistPatterns     []string                  `json:"BlacklistPatterns"`     // BlacklistPatterns are wildcards (e.g. "*.doubleclick.net") and regular expressions (e.g. "/^ad[0-9]+\./") of domain names to block.
+	CacheMaxEntries       int                       `json:"CacheMaxEntries"`       // CacheMaxEntries is the maximum number of forwarder responses to cache, a negative number disables the cache.
+	QueryLogEntries       int                       `json:"QueryLogEntries"`       // QueryLogEntries is the number of most recent queries to keep in the query log, 0 disables the query log.
+	ValidateDNSSEC        bool                      `json:"ValidateDNSSEC"`        // ValidateDNSSEC validates the DNSSEC signatures of forwarder responses, and answers SERVFAIL to those failing validation.
+
+	UDPPort      int `json:"UDPPort"`      // UDP port to listen on
+	UDPReceivers int `json:"UDPReceivers"` // UDPReceivers is the number of sockets sharing the UDP port (SO_REUSEPORT), each read by its own goroutine.
+	TCPPort      int `json:"TCPPort"`      // TCP port to listen on
+	DoHPort      int `json:"DoHPort"`      // DoHPort is the TCP port to listen on for DNS-over-HTTPS queries, 0 disables the listener.
+	DoTPort      int `json:"DoTPort"`      // DoTPort is the TCP port to listen on for DNS-over-TLS queries (usually 853), 0 disables the listener.
+
+	TLSCertPath string `json:"TLSCertPath"` // TLSCertPath is the path to PEM-encoded TLS certificate of the DNS-over-HTTPS and DNS-over-TLS listeners.
+	TLSKeyPath  string `json:"TLSKeyPath"`  // TLSKeyPath is the path to PEM-encoded TLS certificate key of the DNS-over-HTTPS and DNS-over-TLS listeners.
+
+	tcpServer      *common.TCPServer
+	udpServer      *common.UDPServer
+	tlsServer      *common.TCPServer
+	tlsConfig      *tls.Config
+	dohServer      *http.Server
+	dohServerMutex *sync.Mutex
 
 	/*
 		blackList is a map of domain names (in lower case) and their resolved IP addresses that should be blocked. In
@@ -104,14 +138,36 @@ type Daemon struct {
 	*/
 	blackList         map[string]struct{}
 	blackListUpdating int32 // blackListUpdating is set to 1 when black list is being updated, and 0 otherwise.
+	// whitelist is the set of white listed domain names in lower case, without trailing full-stop.
+	whitelist map[string]struct{}
+	// blacklistPatterns are the compiled BlacklistPatterns.
+	blacklistPatterns []*regexp.Regexp
+	// conditionalForwarders are the forwarder addresses keyed by domain name in lower case, without trailing full-stop.
+	conditionalForwarders map[string]string
 
 	myPublicIP           string          // myPublicIP is the latest public IP address of the laitos server.
 	blackListMutex       *sync.RWMutex   // Protect against concurrent access to black list
-	allowQueryMutex      *sync.Mutex     // allowQueryMutex guards against concurrent access to AllowQueryIPPrefixes.
+	allowQueryMutex      *sync.Mutex     // allowQueryMutex guards against concurrent access to AllowQueryIPPrefixes and allowQuerySubnets.
+	allowQuerySubnets    []*net.IPNet    // allowQuerySubnets are the subnets of clients, such as VPN clients, that other daemons allow to query.
 	allowQueryLastUpdate int64           // allowQueryLastUpdate is the Unix timestamp of the very latest automatic placement of computer's public IP into the array of AllowQueryIPPrefixes.
 	rateLimit            *misc.RateLimit // Rate limit counter
 	logger               lalog.Logger
 
+	// customRecords are the custom records keyed by domain name in lower case, without trailing full-stop.
+	customRecords map[string]*CustomRecord
+
+	// cache keeps the recent responses from forwarders, it is nil if the cache is disabled.
+	cache *ResponseCache
+
+	// queryLog keeps the most recent queries and the decisions made about them, it is nil if the query log is disabled.
+	queryLog *QueryLog
+
+	// forwarderPool keeps track of the health and latency of forwarders, and picks a forwarder for each query.
+	forwarderPool *ForwarderPool
+
+	// dnssecValidator validates forwarder responses, it is nil if DNSSEC validation is disabled.
+	dnssecValidator *DNSSECValidator
+
 	// latestCommands remembers the result of most recently executed toolbox commands.
 	latestCommands *LatestCommands
 
@@ -124,10 +180,10 @@ func (daemon *Daemon) Initialise() error {
 	if daemon.Address == "" {
 		daemon.Address = "0.0.0.0"
 	}
-	if daemon.UDPPort < 1 && daemon.TCPPort < 1 {
+	if daemon.UDPPort < 1 && daemon.TCPPort < 1 && daemon.DoHPort < 1 && daemon.DoTPort < 1 {
 		/*
-			If any port is left at 0, the DNS daemon will not listen for that protocol. But if both are at 0, then
-			by default listen for both protocols.
+			If any port is left at 0, the DNS daemon will not listen for that protocol. But if all are at 0, then
+			by default listen for both TCP and UDP.
 		*/
 		daemon.TCPPort = 53
 		daemon.UDPPort = 53
@@ -139,6 +195,11 @@ func (daemon *Daemon) Initialise() error {
 		daemon.Forwarders = make([]string, len(DefaultForwarders))
 		copy(daemon.Forwarders, DefaultForwarders)
 	}
+	for _, forwarder := range daemon.Forwarders {
+		if err := checkForwarderAddress(forwarder); err != nil {
+			return fmt.Errorf("dnsd.Initialise: %v", err)
+		}
+	}
 	daemon.logger = lalog.Logger{
 		ComponentName: "dnsd",
 		ComponentID:   []lalog.LoggerIDField{{Key: "TCP", Value: daemon.TCPPort}, {Key: "UDP", Value: daemon.UDPPort}},
@@ -160,26 +221,220 @@ func (daemon *Daemon) Initialise() error {
 		}
 	}
 
+	if daemon.PerIPBurst < 0 {
+		return errors.New("DNSD.Initialise: PerIPBurst may not be negative")
+	}
+	for cidr, limit := range daemon.PerIPLimitOverrides {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			return fmt.Errorf("DNSD.Initialise: PerIPLimitOverrides has a malformed network \"%s\" - %v", cidr, err)
+		}
+		if limit < 0 {
+			return fmt.Errorf("DNSD.Initialise: PerIPLimitOverrides has a negative limit (\"%s\": %d)", cidr, limit)
+		}
+	}
+
+	if len(daemon.BlacklistSources) == 0 {
+		daemon.BlacklistSources = make([]BlacklistSource, len(DefaultBlacklistSources))
+		copy(daemon.BlacklistSources, DefaultBlacklistSources)
+	}
+	for i := range daemon.BlacklistSources {
+		if err := daemon.BlacklistSources[i].Initialise(); err != nil {
+			return fmt.Errorf("dnsd.Initialise: %v", err)
+		}
+	}
+	switch daemon.BlockingMode {
+	case "":
+		daemon.BlockingMode = BlockingModeNullIP
+	case BlockingModeNullIP, BlockingModeNXDomain, BlockingModeRefused:
+	default:
+		return fmt.Errorf("dnsd.Initialise: BlockingMode must be one of \"%s\", \"%s\", or \"%s\"", BlockingModeNullIP, BlockingModeNXDomain, BlockingModeRefused)
+	}
+	daemon.whitelist = make(map[string]struct{})
+	for _, name := range daemon.Whitelist {
+		if name = normaliseDomainName(name); name == "" {
+			return errors.New("dnsd.Initialise: white listed domain names may not contain empty string")
+		}
+		daemon.whitelist[name] = struct{}{}
+	}
+	daemon.blacklistPatterns = make([]*regexp.Regexp, 0, len(daemon.BlacklistPatterns))
+	for _, pattern := range daemon.BlacklistPatterns {
+		compiled, err := CompileBlacklistPattern(pattern)
+		if err != nil {
+			return fmt.Errorf("dnsd.Initialise: bad blacklist pattern \"%s\" - %v", pattern, err)
+		}
+		daemon.blacklistPatterns = append(daemon.blacklistPatterns, compiled)
+	}
+
+	daemon.conditionalForwarders = make(map[string]string)
+	for name, forwarder := range daemon.ConditionalForwarders {
+		if name = normaliseDomainName(name); name == "" || forwarder == "" {
+			return errors.New("dnsd.Initialise: conditional forwarders may not contain empty domain name or address")
+		}
+		// Use the default DNS port if a plain address does not come with a port
+		if _, _, err := net.SplitHostPort(forwarder); err != nil && !strings.Contains(forwarder, "://") {
+			forwarder = net.JoinHostPort(forwarder, "53")
+		}
+		if err := checkForwarderAddress(forwarder); err != nil {
+			return fmt.Errorf("dnsd.Initialise: %v", err)
+		}
+		daemon.conditionalForwarders[name] = forwarder
+	}
+
+	daemon.customRecords = make(map[string]*CustomRecord)
+	for name, rec := range daemon.CustomRecords {
+		if rec == nil {
+			return fmt.Errorf("dnsd.Initialise: custom record \"%s\" is empty", name)
+		}
+		if err := rec.Initialise(name); err != nil {
+			return fmt.Errorf("dnsd.Initialise: %v", err)
+		}
+		daemon.customRecords[normaliseDomainName(name)] = rec
+	}
+	// Answer reverse lookups of the custom records' addresses locally instead of forwarding them
+	if err := synthesisePTRRecords(daemon.customRecords); err != nil {
+		return fmt.Errorf("dnsd.Initialise: %v", err)
+	}
+
 	daemon.allowQueryMutex = new(sync.Mutex)
 	daemon.blackListMutex = new(sync.RWMutex)
 	daemon.blackList = make(map[string]struct{})
+	// Block the names from the latest blacklist right away, without waiting for the blacklist to be downloaded again.
+	if daemon.BlacklistFilePath != "" {
+		if err := daemon.loadBlackListFile(); err != nil && !os.IsNotExist(err) {
+			daemon.logger.Warning("Initialise", "", err, "failed to load blacklist from \"%s\"", daemon.BlacklistFilePath)
+		}
+	}
 
 	daemon.rateLimit = &misc.RateLimit{
-		MaxCount: daemon.PerIPLimit,
-		UnitSecs: RateLimitIntervalSec,
-		Logger:   daemon.logger,
+		MaxCount:  daemon.PerIPLimit,
+		UnitSecs:  RateLimitIntervalSec,
+		Overrides: daemon.PerIPLimitOverrides,
+		Logger:    daemon.logger,
+	}
+	if daemon.PerIPBurst > 0 {
+		daemon.rateLimit.Algorithm = misc.RateLimitTokenBucket
+		daemon.rateLimit.Burst = daemon.PerIPBurst
 	}
 	daemon.rateLimit.Initialise()
 
 	daemon.latestCommands = NewLatestCommands()
-	daemon.tcpServer = common.NewTCPServer(daemon.Address, daemon.TCPPort, "dnsd", daemon, daemon.PerIPLimit)
-	daemon.udpServer = common.NewUDPServer(daemon.Address, daemon.UDPPort, "dnsd", daemon, daemon.PerIPLimit)
+	if daemon.CacheMaxEntries == 0 {
+		daemon.CacheMaxEntries = DefaultCacheMaxEntries
+	}
+	daemon.cache = nil
+	if daemon.CacheMaxEntries > 0 {
+		daemon.cache = NewResponseCache(daemon.CacheMaxEntries)
+	}
+	misc.DNSCachePurger = daemon.PurgeCache
+	daemon.queryLog = nil
+	if daemon.QueryLogEntries > 0 {
+		daemon.queryLog = NewQueryLog(daemon.QueryLogEntries)
+	}
+	misc.DNSQueryLogReader = daemon.GetQueryLog
+	daemon.forwarderPool = NewForwarderPool(daemon.Forwarders, daemon.logger)
+	misc.DNSForwarderStatsReader = daemon.forwarderPool.GetStats
+	daemon.dnssecValidator = nil
+	if daemon.ValidateDNSSEC {
+		daemon.dnssecValidator = &DNSSECValidator{Forwarders: daemon.Forwarders}
+		if err := daemon.dnssecValidator.Initialise(daemon.logger); err != nil {
+			return fmt.Errorf("dnsd.Initialise: %v", err)
+		}
+	}
+	daemon.dohServerMutex = new(sync.Mutex)
+	if daemon.DoHPort > 0 || daemon.DoTPort > 0 {
+		if err := daemon.initialiseTLS(); err != nil {
+			return err
+		}
+	}
+	daemon.tcpServer = &common.TCPServer{
+		ListenAddr:           daemon.Address,
+		ListenPort:           daemon.TCPPort,
+		AppName:              "dnsd",
+		App:                  daemon,
+		LimitPerSec:          daemon.PerIPLimit,
+		GlobalLimitPerSec:    daemon.GlobalLimit,
+		BurstPerIP:           daemon.PerIPBurst,
+		LimitPerSecOverrides: daemon.PerIPLimitOverrides,
+	}
+	daemon.tcpServer.Initialise()
+	daemon.udpServer = &common.UDPServer{
+		ListenAddr:           daemon.Address,
+		ListenPort:           daemon.UDPPort,
+		AppName:              "dnsd",
+		App:                  daemon,
+		LimitPerSec:          daemon.PerIPLimit,
+		GlobalLimitPerSec:    daemon.GlobalLimit,
+		BurstPerIP:           daemon.PerIPBurst,
+		LimitPerSecOverrides: daemon.PerIPLimitOverrides,
+		NumReceivers:         daemon.UDPReceivers,
+	}
+	daemon.udpServer.Initialise()
+	daemon.tlsServer = &common.TCPServer{
+		ListenAddr:           daemon.Address,
+		ListenPort:           daemon.DoTPort,
+		AppName:              "dnsd-tls",
+		App:                  daemon,
+		TLSConfig:            daemon.tlsConfig,
+		LimitPerSec:          daemon.PerIPLimit,
+		GlobalLimitPerSec:    daemon.GlobalLimit,
+		BurstPerIP:           daemon.PerIPBurst,
+		LimitPerSecOverrides: daemon.PerIPLimitOverrides,
+	}
+	daemon.tlsServer.Initialise()
 
 	// Always allow server itself to query the DNS servers via its public IP
 	daemon.allowMyPublicIP()
 	return nil
 }
 
+/*
+validateForwarderResponse validates the DNSSEC signatures of the forwarder's response, if DNSSEC validation is enabled.
+A response that fails validation is replaced by a SERVFAIL response.
+*/
+func (daemon *Daemon) validateForwarderResponse(logger lalog.Logger, clientIP string, queryNoLength, respNoLength []byte) []byte {
+	if daemon.dnssecValidator == nil {
+		return respNoLength
+	}
+	validated, err := daemon.dnssecValidator.Validate(respNoLength)
+	if err != nil {
+		name, _, _, _ := parseQuestion(queryNoLength)
+		logger.Warning("validateForwarderResponse", clientIP, err, "response to \"%s\" failed DNSSEC validation", name)
+		return GetErrorResponse(queryNoLength, rcodeServFail)
+	}
+	return validated
+}
+
+/*
+answerForClient returns the response to be given to the client. When DNSSEC validation is enabled, the forwarder is asked
+for DNSSEC records, which are then stripped from the response unless the client asked for them as well. The cache keeps
+the response as received from the forwarder.
+*/
+func (daemon *Daemon) answerForClient(queryNoLength, respNoLength []byte) []byte {
+	if daemon.dnssecValidator == nil || respNoLength == nil {
+		return respNoLength
+	}
+	return StripDNSSECRecords(queryNoLength, respNoLength)
+}
+
+// PurgeCache removes all responses from the response cache and returns the number of responses removed.
+func (daemon *Daemon) PurgeCache() int {
+	count := daemon.cache.Purge()
+	daemon.logger.Info("PurgeCache", "", nil, "removed %d responses from cache", count)
+	return count
+}
+
+// initialiseTLS prepares the TLS configuration shared by DNS-over-HTTPS and DNS-over-TLS listeners.
+func (daemon *Daemon) initialiseTLS() (err error) {
+	if daemon.TLSCertPath == "" || daemon.TLSKeyPath == "" {
+		return errors.New("dnsd.Initialise: TLSCertPath and TLSKeyPath must be specified to use DoHPort or DoTPort")
+	}
+	daemon.tlsConfig, _, err = common.NewServerTLSConfig(daemon.TLSCertPath, daemon.TLSKeyPath, "")
+	if err != nil {
+		return fmt.Errorf("dnsd.Initialise: %v", err)
+	}
+	return nil
+}
+
 // allowMyPublicIP refreshes the public IP address of the DNS server, so that Internet clients that use laitos server as VPN server may use it for DNS as well.
 func (daemon *Daemon) allowMyPublicIP() {
 	if daemon.allowQueryLastUpdate+PublicIPRefreshIntervalSec >= time.Now().Unix() {
@@ -201,6 +456,25 @@ func (daemon *Daemon) allowMyPublicIP() {
 	daemon.logger.Info("allowMyPublicIP", "", nil, "the latest public IP address %s of this computer is now allowed to query", daemon.myPublicIP)
 }
 
+/*
+AllowQuerySubnet allows clients whose IP address belongs to the subnet to query the DNS server. Other daemons use it to
+let their clients, such as VPN clients, use the DNS server. Call this function after having called Initialise().
+*/
+func (daemon *Daemon) AllowQuerySubnet(subnet *net.IPNet) {
+	if subnet == nil {
+		return
+	}
+	daemon.allowQueryMutex.Lock()
+	defer daemon.allowQueryMutex.Unlock()
+	for _, existing := range daemon.allowQuerySubnets {
+		if existing.String() == subnet.String() {
+			return
+		}
+	}
+	daemon.allowQuerySubnets = append(daemon.allowQuerySubnets, subnet)
+	daemon.logger.Info("AllowQuerySubnet", "", nil, "clients of subnet %s are now allowed to query", subnet.String())
+}
+
 // checkAllowClientIP returns true only if the input IP address is among the allowed addresses.
 func (daemon *Daemon) checkAllowClientIP(clientIP string) bool {
 	if clientIP == "" || len(clientIP) > 64 {
@@ -220,6 +494,13 @@ func (daemon *Daemon) checkAllowClientIP(clientIP string) bool {
 			return true
 		}
 	}
+	if ip := net.ParseIP(clientIP); ip != nil {
+		for _, subnet := range daemon.allowQuerySubnets {
+			if subnet.Contains(ip) {
+				return true
+			}
+		}
+	}
 	return false
 }
 
@@ -237,7 +518,7 @@ func (daemon *Daemon) UpdateBlackList(maxEntries int) {
 	}()
 
 	// Download black list data from all sources
-	allNames := DownloadAllBlacklists(daemon.logger)
+	allNames := DownloadAllBlacklists(daemon.logger, daemon.BlacklistSources)
 	if len(allNames) > maxEntries {
 		allNames = allNames[:maxEntries]
 	}
@@ -271,6 +552,10 @@ func (daemon *Daemon) UpdateBlackList(maxEntries int) {
 				if strings.ContainsRune(name, 0) {
 					continue
 				}
+				// Do not block a white listed name, nor the IP addresses it resolves to.
+				if daemon.isWhitelisted(name) {
+					continue
+				}
 				ips, err := net.LookupIP(name)
 				newBlackListMutex.Lock()
 				newBlackList[name] = struct{}{}
@@ -292,18 +577,25 @@ func (daemon *Daemon) UpdateBlackList(maxEntries int) {
 	daemon.blackListMutex.Lock()
 	daemon.blackList = newBlackList
 	daemon.blackListMutex.Unlock()
+	misc.DNSDBlackListSize.Set(int64(len(newBlackList)))
 	daemon.logger.Info("UpdateBlackList", "", nil, "out of %d domains, %d are successfully resolved into %d IPs, %d failed, and now blacklist has %d entries",
 		len(allNames), countResolvedNames, countResolvedIPs, countNonResolvableNames, len(newBlackList))
+	// Keep the blacklist for the next start up, but do not let an unsuccessful download overwrite the previous one.
+	if daemon.BlacklistFilePath != "" && len(newBlackList) > 0 {
+		if err := daemon.saveBlackListFile(newBlackList); err != nil {
+			daemon.logger.Warning("UpdateBlackList", "", err, "failed to save blacklist to \"%s\"", daemon.BlacklistFilePath)
+		}
+	}
 }
 
 /*
 You may call this function only after having called Initialise()!
-Start DNS daemon on configured TCP and UDP ports. Block caller until both listeners are told to stop.
-If either TCP or UDP port fails to listen, all listeners are closed and an error is returned.
+Start DNS daemon on configured TCP, UDP, DNS-over-HTTPS, and DNS-over-TLS ports. Block caller until all listeners are told to stop.
+If any of the ports fails to listen, all listeners are closed and an error is returned.
 */
 func (daemon *Daemon) StartAndBlock() error {
 	// Update ad-block black list in background
-	stopAdBlockUpdater := make(chan bool, 2)
+	stopAdBlockUpdater := make(chan bool, 4)
 	go func() {
 		firstTime := true
 		nextRunAt := time.Now().Add(BlacklistInitialDelaySec * time.Second)
@@ -330,9 +622,12 @@ func (daemon *Daemon) StartAndBlock() error {
 		}
 	}()
 
+	// Probe forwarders periodically in background
+	daemon.forwarderPool.StartHealthCheck()
+
 	// Start server listeners
 	numListeners := 0
-	errChan := make(chan error, 2)
+	errChan := make(chan error, 4)
 	if daemon.UDPPort != 0 {
 		numListeners++
 		go func() {
@@ -349,6 +644,22 @@ func (daemon *Daemon) StartAndBlock() error {
 			stopAdBlockUpdater <- true
 		}()
 	}
+	if daemon.DoHPort != 0 {
+		numListeners++
+		go func() {
+			err := daemon.startAndBlockDoH()
+			errChan <- err
+			stopAdBlockUpdater <- true
+		}()
+	}
+	if daemon.DoTPort != 0 {
+		numListeners++
+		go func() {
+			err := daemon.tlsServer.StartAndBlock()
+			errChan <- err
+			stopAdBlockUpdater <- true
+		}()
+	}
 	for i := 0; i < numListeners; i++ {
 		if err := <-errChan; err != nil {
 			daemon.Stop()
@@ -358,15 +669,53 @@ func (daemon *Daemon) StartAndBlock() error {
 	return nil
 }
 
-// Close all of open TCP and UDP listeners so that they will cease processing incoming connections.
+// Close all of open TCP, UDP, DNS-over-HTTPS, and DNS-over-TLS listeners so that they will cease processing incoming connections.
 func (daemon *Daemon) Stop() {
+	daemon.forwarderPool.StopHealthCheck()
 	daemon.tcpServer.Stop()
 	daemon.udpServer.Stop()
+	daemon.stopDoH()
+	daemon.tlsServer.Stop()
+}
+
+// isWhitelisted returns true only if the domain name (in lower case) or any of its parent domain names is white listed.
+func (daemon *Daemon) isWhitelisted(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	for {
+		if _, whitelisted := daemon.whitelist[name]; whitelisted {
+			return true
+		}
+		index := strings.IndexRune(name, '.')
+		if index < 1 || index == len(name)-1 {
+			return false
+		}
+		name = name[index+1:]
+	}
+}
+
+/*
+getConditionalForwarder returns the address of the conditional forwarder responsible for the name or its closest parent
+domain name, or an empty string if no conditional forwarder is responsible for the name.
+*/
+func (daemon *Daemon) getConditionalForwarder(name string) string {
+	name = strings.TrimSuffix(name, ".")
+	for {
+		if forwarder, exists := daemon.conditionalForwarders[name]; exists {
+			return forwarder
+		}
+		index := strings.IndexRune(name, '.')
+		if index < 1 || index == len(name)-1 {
+			return ""
+		}
+		name = name[index+1:]
+	}
 }
 
 /*
 IsInBlacklist returns true only if the input domain name or IP address is black listed. If the domain name represents
 a sub-domain name, then the function strips the sub-domain portion in order to check it against black list.
+The domain name is also black listed if it matches any of the wildcard and regular expression patterns.
+A white listed domain name and its sub-domains are never considered black listed.
 */
 func (daemon *Daemon) IsInBlacklist(nameOrIP string) bool {
 	daemon.blackListMutex.RLock()
@@ -377,6 +726,15 @@ func (daemon *Daemon) IsInBlacklist(nameOrIP string) bool {
 	}
 	// Black list only contains lower case names, hence converting the input name to lower case for matching.
 	nameOrIP = strings.ToLower(strings.TrimSpace(nameOrIP))
+	if daemon.isWhitelisted(nameOrIP) {
+		return false
+	}
+	// Match the wildcard and regular expression patterns against the entire name
+	for _, pattern := range daemon.blacklistPatterns {
+		if pattern.MatchString(strings.TrimSuffix(nameOrIP, ".")) {
+			return true
+		}
+	}
 	/*
 		Starting from the requested domain name, strip down sub-domain name to make candidates for black list match.
 		Stripping down an IP address is meaningless but will do no harm.
@@ -408,6 +766,9 @@ func (daemon *Daemon) IsInBlacklist(nameOrIP string) bool {
 // nameQueryMagic is a series of bytes that appears in a DNS name (A) query.
 var nameQueryMagic = []byte{0, 1, 0, 1}
 
+// nameQueryMagicAAAA is a series of bytes that appears in a DNS IPv6 address (AAAA) query.
+var nameQueryMagicAAAA = []byte{0, 28, 0, 1}
+
 // textQueryMagic is a series of bytes that appears in a DNS text query.
 var textQueryMagic = []byte{0, 16, 0, 1}
 
@@ -468,6 +829,20 @@ func TestServer(dnsd *Daemon, t testingstub.T) {
 		},
 	}
 	testResolveNameAndBlackList(t, dnsd, udpResolver)
+	if dnsd.DoHPort != 0 {
+		testDoH(dnsd, t)
+	}
+	if dnsd.DoTPort != 0 {
+		// The test certificate is self-signed
+		tlsResolver := &net.Resolver{
+			PreferGo:     true,
+			StrictErrors: true,
+			Dial: func(ctx context.Context, network, address string) (conn net.Conn, e error) {
+				return tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", dnsd.DoTPort), &tls.Config{InsecureSkipVerify: true})
+			},
+		}
+		testResolveNameAndBlackList(t, dnsd, tlsResolver)
+	}
 	// Daemon must stop in a second
 	dnsd.Stop()
 	time.Sleep(1 * time.Second)
@@ -1,10 +1,15 @@
 package dnsd
 
 import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
 
+	"github.com/HouzuoGuo/laitos/daemon/common"
 	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/toolbox"
 )
@@ -25,12 +30,91 @@ func TestUpdateBlackList(t *testing.T) {
 	}
 }
 
+func TestIsInBlacklist(t *testing.T) {
+	daemon := Daemon{Whitelist: []string{"Good.Example.com."}}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	daemon.blackList = map[string]struct{}{"example.com": {}, "ads.example.com": {}, "tracker.net": {}, "1.2.3.4": {}}
+	for _, name := range []string{"example.com", "ads.example.com", "www.ads.example.com", "TRACKER.net", "1.2.3.4", "other.example.com"} {
+		if !daemon.IsInBlacklist(name) {
+			t.Fatal("should have blocked", name)
+		}
+	}
+	for _, name := range []string{"good.example.com", "www.GOOD.example.com", "good.example.com.", "github.com", "4.3.2.1"} {
+		if daemon.IsInBlacklist(name) {
+			t.Fatal("should not have blocked", name)
+		}
+	}
+	daemon = Daemon{Whitelist: []string{" "}}
+	if err := daemon.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	// Wildcard and regular expression patterns
+	daemon = Daemon{
+		Whitelist:         []string{"good.doubleclick.net"},
+		BlacklistPatterns: []string{"*.doubleclick.net", "metrics*.Example.com.", `/^ad[0-9]+\.[a-z]+\.com$/`},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"ad.doubleclick.net", "a.b.DoubleClick.net.", "metrics.example.com", "metrics-eu1.example.com", "ad123.tracker.com"} {
+		if !daemon.IsInBlacklist(name) {
+			t.Fatal("should have blocked", name)
+		}
+	}
+	for _, name := range []string{"doubleclick.net", "good.doubleclick.net", "notdoubleclick.net", "www.metrics.example.com.evil", "ad.tracker.com", "xad1.tracker.com"} {
+		if daemon.IsInBlacklist(name) {
+			t.Fatal("should not have blocked", name)
+		}
+	}
+	for _, bad := range []string{"*", "*.*", "/[a-/"} {
+		daemon = Daemon{BlacklistPatterns: []string{bad}}
+		if err := daemon.Initialise(); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+}
+
+func TestBlackListFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-TestBlackListFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "blacklist")
+	daemon := Daemon{BlacklistFilePath: filePath}
+	// The file does not yet exist
+	if err := daemon.Initialise(); err != nil || len(daemon.blackList) != 0 {
+		t.Fatal(err, daemon.blackList)
+	}
+	if err := daemon.saveBlackListFile(map[string]struct{}{"ads.example.com": {}, "good.example.com": {}, "1.2.3.4": {}}); err != nil {
+		t.Fatal(err)
+	}
+	// The white listed name is not loaded
+	daemon = Daemon{BlacklistFilePath: filePath, Whitelist: []string{"good.example.com"}}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(daemon.blackList, map[string]struct{}{"ads.example.com": {}, "1.2.3.4": {}}) {
+		t.Fatal(daemon.blackList)
+	}
+	if !daemon.IsInBlacklist("www.ads.example.com") || daemon.IsInBlacklist("good.example.com") {
+		t.Fatal("incorrect blacklist")
+	}
+}
+
 func TestCheckAllowClientIP(t *testing.T) {
 	daemon := Daemon{AllowQueryIPPrefixes: []string{"192.", "100."}}
 	if err := daemon.Initialise(); err != nil {
 		t.Fatal(err)
 	}
-	for _, client := range []string{"127.0.0.1", "::1", "127.0.100.1", "192.168.0.1", "100.0.0.0", inet.GetPublicIP()} {
+	allowedClients := []string{"127.0.0.1", "::1", "127.0.100.1", "192.168.0.1", "100.0.0.0"}
+	// The public IP is unknown when the computer is offline
+	if publicIP := inet.GetPublicIP(); publicIP != "" {
+		allowedClients = append(allowedClients, publicIP)
+	}
+	for _, client := range allowedClients {
 		if !daemon.checkAllowClientIP(client) {
 			t.Fatal("should have allowed", client)
 		}
@@ -40,6 +124,16 @@ func TestCheckAllowClientIP(t *testing.T) {
 			t.Fatal("should have blocked", client)
 		}
 	}
+	_, subnet, _ := net.ParseCIDR("172.16.0.0/20")
+	daemon.AllowQuerySubnet(subnet)
+	daemon.AllowQuerySubnet(subnet)
+	if !daemon.checkAllowClientIP("172.16.0.1") || !daemon.checkAllowClientIP("172.16.15.255") || len(daemon.allowQuerySubnets) != 1 {
+		t.Fatal(daemon.allowQuerySubnets)
+	}
+	// The subnet does not extend to the addresses that merely share its string prefix
+	if daemon.checkAllowClientIP("172.16.16.1") || daemon.checkAllowClientIP("172.160.0.1") {
+		t.Fatal("should have blocked clients outside of the subnet")
+	}
 }
 
 func TestDNSD(t *testing.T) {
@@ -82,6 +176,77 @@ func TestDNSD(t *testing.T) {
 	if err := daemon.Initialise(); err != nil {
 		t.Fatal(err)
 	}
+	// DNS-over-HTTPS and DNS-over-TLS require certificate and key
+	daemon.DoHPort = 18520
+	daemon.DoTPort = 18521
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "TLSCertPath") {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "laitos-TestDNSD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	daemon.TLSCertPath = filepath.Join(dir, "cert.pem")
+	daemon.TLSKeyPath = filepath.Join(dir, "key.pem")
+	if err := common.WriteTestCertificate(daemon.TLSCertPath, daemon.TLSKeyPath, "laitos-test"); err != nil {
+		t.Fatal(err)
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
 
 	TestServer(&daemon, t)
 }
+
+func TestDNSD_RateLimitOverrides(t *testing.T) {
+	daemon := Daemon{
+		Address:             "127.0.0.1",
+		UDPPort:             62157,
+		TCPPort:             18527,
+		PerIPLimit:          2,
+		PerIPBurst:          -1,
+		PerIPLimitOverrides: map[string]int{"192.168.1.1/32": 0, "192.168.0.0/16": 5},
+	}
+	if err := daemon.Initialise(); err == nil {
+		t.Fatal("did not error on negative burst")
+	}
+	daemon.PerIPBurst = 4
+	daemon.PerIPLimitOverrides["192.168."] = 1
+	if err := daemon.Initialise(); err == nil {
+		t.Fatal("did not error on malformed network")
+	}
+	delete(daemon.PerIPLimitOverrides, "192.168.")
+	daemon.PerIPLimitOverrides["10.0.0.0/8"] = -1
+	if err := daemon.Initialise(); err == nil {
+		t.Fatal("did not error on negative limit")
+	}
+	delete(daemon.PerIPLimitOverrides, "10.0.0.0/8")
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	// A stranger gets the burst of PerIPBurst
+	for i := 0; i < 4; i++ {
+		if !daemon.udpServer.AddAndCheckRateLimit("203.0.113.1") {
+			t.Fatal(i)
+		}
+	}
+	if daemon.udpServer.AddAndCheckRateLimit("203.0.113.1") {
+		t.Fatal("should have hit limit")
+	}
+	// The burst of an override is proportional to its limit
+	for i := 0; i < 10; i++ {
+		if !daemon.tcpServer.AddAndCheckRateLimit("192.168.0.2") {
+			t.Fatal(i)
+		}
+	}
+	if daemon.tcpServer.AddAndCheckRateLimit("192.168.0.2") {
+		t.Fatal("should have hit limit")
+	}
+	// The busy home router is exempted
+	for i := 0; i < 100; i++ {
+		if !daemon.udpServer.AddAndCheckRateLimit("192.168.1.1") || !daemon.rateLimit.Add("192.168.1.1", true) {
+			t.Fatal(i)
+		}
+	}
+}
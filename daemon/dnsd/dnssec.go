@@ -0,0 +1,819 @@
+package dnsd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+const (
+	// DNSSECZoneCacheTTLSec is the number of seconds to remember the validated keys (or the lack of them) of a zone.
+	DNSSECZoneCacheTTLSec = 3600
+	// DNSSECZoneCacheMaxEntries is the maximum number of zones to remember before the cache is cleared.
+	DNSSECZoneCacheMaxEntries = 10000
+	// DNSSECMaxChainLength is the maximum number of CNAME and DNAME redirections from the question name to the answer.
+	DNSSECMaxChainLength = 16
+)
+
+/*
+RootTrustAnchors are the DS records of the root zone's key signing keys (KSK-2017 and KSK-2024) in presentation format,
+as published by IANA. They are the starting point of DNSSEC chain of trust.
+*/
+var RootTrustAnchors = []string{
+	"20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D",
+	"38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// dnssecZone is the outcome of following the chain of trust to the zone that a domain name belongs to.
+type dnssecZone struct {
+	name     string    // name is the zone apex.
+	keys     []*dnskey // keys are the validated zone keys.
+	insecure bool      // insecure is true if the zone is proven to be unsigned, in which case keys are empty.
+	expiry   time.Time
+}
+
+/*
+DNSSECValidator validates the signatures of responses from forwarders by following the DNSSEC chain of trust from the
+root zone. The DS and DNSKEY records needed along the way are queried from the forwarders over TCP.
+*/
+type DNSSECValidator struct {
+	Forwarders   []string // Forwarders are the recursive resolvers to query for DS and DNSKEY records.
+	TrustAnchors []string // TrustAnchors are the DS records of root zone in presentation format, RootTrustAnchors are used if left empty.
+
+	// exchange queries the forwarders for the name and type, it may be substituted by test cases.
+	exchange func(name string, qType uint16) (*dnsMessage, error)
+	anchors  []*dsRecord
+	mutex    *sync.Mutex
+	zones    map[string]*dnssecZone
+	logger   lalog.Logger
+}
+
+// Initialise parses the trust anchors and initialises internal states.
+func (validator *DNSSECValidator) Initialise(logger lalog.Logger) error {
+	if len(validator.TrustAnchors) == 0 {
+		validator.TrustAnchors = RootTrustAnchors
+	}
+	validator.anchors = make([]*dsRecord, 0, len(validator.TrustAnchors))
+	for _, anchor := range validator.TrustAnchors {
+		ds, err := parseDSPresentation(anchor)
+		if err != nil {
+			return fmt.Errorf("DNSSECValidator.Initialise: malformed trust anchor \"%s\" - %v", anchor, err)
+		}
+		validator.anchors = append(validator.anchors, ds)
+	}
+	if validator.exchange == nil {
+		if len(validator.Forwarders) == 0 {
+			return errors.New("DNSSECValidator.Initialise: forwarders must not be empty")
+		}
+		validator.exchange = validator.exchangeTCP
+	}
+	validator.mutex = new(sync.Mutex)
+	validator.zones = make(map[string]*dnssecZone)
+	validator.logger = logger
+	return nil
+}
+
+// parseDSPresentation parses a DS record in presentation format, e.g. "20326 8 2 E06D44B8...".
+func parseDSPresentation(text string) (*dsRecord, error) {
+	fields := strings.Fields(text)
+	if len(fields) < 4 {
+		return nil, errors.New("expecting key tag, algorithm, digest type, and digest")
+	}
+	keyTag, err := strconv.ParseUint(fields[0], 10, 16)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, err := strconv.ParseUint(fields[1], 10, 8)
+	if err != nil {
+		return nil, err
+	}
+	digestType, err := strconv.ParseUint(fields[2], 10, 8)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := hex.DecodeString(strings.Join(fields[3:], ""))
+	if err != nil {
+		return nil, err
+	}
+	return &dsRecord{KeyTag: uint16(keyTag), Algorithm: uint8(algorithm), DigestType: uint8(digestType), Digest: digest}, nil
+}
+
+/*
+PrepareQuery returns a copy of the query (without prefix length bytes) that asks the forwarder for DNSSEC records by
+setting the EDNS "DNSSEC OK" flag, and asks it to leave the validation to the DNS daemon by setting the "checking
+disabled" flag. An EDNS OPT record is added to the query if it does not already have one.
+*/
+func PrepareQuery(queryNoLength []byte) []byte {
+	if len(queryNoLength) < 12 {
+		return queryNoLength
+	}
+	ret := make([]byte, len(queryNoLength))
+	copy(ret, queryNoLength)
+	// Byte 3 - checking disabled
+	ret[3] |= 0x10
+	if i := findOPT(ret); i > 0 {
+		// The flags are in the lower half of OPT's TTL field, DNSSEC OK is the most significant bit.
+		ret[i+6] |= 0x80
+		return ret
+	}
+	binary.BigEndian.PutUint16(ret[10:12], binary.BigEndian.Uint16(ret[10:12])+1)
+	// Root name, type OPT, payload size 4096, DNSSEC OK, and no option.
+	return append(ret, 0, 0, typeOPT, 0x10, 0x00, 0, 0, 0x80, 0, 0, 0)
+}
+
+/*
+StripDNSSECRecords returns a copy of the response to the query prepared by PrepareQuery, without the records that the
+client did not ask for. DNSSEC records (RRSIG, NSEC, and NSEC3) are only given to a client that sets the "DNSSEC OK" flag
+(RFC 4035 section 3.2.1), and the EDNS OPT record is only given to a client that has one in its query (RFC 6891 section
+7). The "checking disabled" flag of the response is restored to that of the query.
+*/
+func StripDNSSECRecords(queryNoLength, respNoLength []byte) []byte {
+	if len(queryNoLength) < 12 || len(respNoLength) < 12 {
+		return respNoLength
+	}
+	ret := make([]byte, len(respNoLength))
+	copy(ret, respNoLength)
+	// Byte 3 - checking disabled
+	ret[3] = ret[3]&^0x10 | queryNoLength[3]&0x10
+	queryOPT := findOPT(queryNoLength)
+	if queryOPT > 0 && queryNoLength[queryOPT+6]&0x80 != 0 {
+		return ret
+	}
+	// The response's DNSSEC OK flag mirrors that of the query (RFC 3225 section 3)
+	if i := findOPT(ret); i > 0 {
+		ret[i+6] &^= 0x80
+	}
+	_, qType, _, questionEnd := parseQuestion(ret)
+	msg, err := parseMessage(ret)
+	if questionEnd == 0 || err != nil {
+		return ret
+	}
+	keep := func(rr resourceRecord) bool {
+		switch rr.Type {
+		case typeRRSIG, typeNSEC, typeNSEC3:
+			return rr.Type == qType
+		case typeOPT:
+			return queryOPT > 0
+		}
+		return true
+	}
+	var sections [3][]resourceRecord
+	var stripped bool
+	for s, records := range [][]resourceRecord{msg.Answer, msg.Authority, msg.Additional} {
+		for _, rr := range records {
+			if keep(rr) {
+				sections[s] = append(sections[s], rr)
+			} else {
+				stripped = true
+			}
+		}
+	}
+	if !stripped {
+		return ret
+	}
+	// Write the remaining records without name compression, as the stripped records may be referred to by pointers.
+	ret = ret[:questionEnd]
+	for s, records := range sections {
+		binary.BigEndian.PutUint16(ret[6+2*s:8+2*s], uint16(len(records)))
+		for _, rr := range records {
+			ret = append(ret, nameToWire(rr.Name)...)
+			ret = append(ret, byte(rr.Type>>8), byte(rr.Type), byte(rr.Class>>8), byte(rr.Class))
+			ret = append(ret, byte(rr.TTL>>24), byte(rr.TTL>>16), byte(rr.TTL>>8), byte(rr.TTL))
+			ret = append(ret, byte(len(rr.RData)>>8), byte(len(rr.RData)))
+			ret = append(ret, rr.RData...)
+		}
+	}
+	return ret
+}
+
+/*
+Validate validates the DNSSEC signatures of the response (without prefix length bytes) from a forwarder. If the
+response is proven authentic, its copy is returned with the "authentic data" flag set; if the response comes from
+unsigned zones, its copy is returned with the flag cleared. An error is returned if the response fails validation, in
+which case the response must not be given to the client. Truncated responses and failure responses are returned as-is,
+as they do not carry records to validate.
+*/
+func (validator *DNSSECValidator) Validate(respNoLength []byte) ([]byte, error) {
+	if len(respNoLength) < 12 || respNoLength[2]&0x02 != 0 {
+		return respNoLength, nil
+	}
+	msg, err := parseMessage(respNoLength)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse response - %v", err)
+	}
+	if msg.Rcode() != 0 && msg.Rcode() != rcodeNXDomain {
+		return respNoLength, nil
+	}
+	qName, qType := ".", uint16(0)
+	if binary.BigEndian.Uint16(respNoLength[4:6]) > 0 {
+		var questionEnd int
+		if qName, questionEnd, err = readName(respNoLength, 12); err != nil {
+			return nil, err
+		}
+		if questionEnd+2 > len(respNoLength) {
+			return nil, errors.New("question is truncated")
+		}
+		qType = binary.BigEndian.Uint16(respNoLength[questionEnd : questionEnd+2])
+	}
+	secure, err := validator.validateMessage(msg, qName, qType)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]byte, len(respNoLength))
+	copy(ret, respNoLength)
+	// Byte 3 - authentic data
+	if secure {
+		ret[3] |= 0x20
+	} else {
+		ret[3] &^= 0x20
+	}
+	return ret, nil
+}
+
+// groupRRsets groups the resource records by owner name and type, leaving out signatures and EDNS pseudo records.
+func groupRRsets(records []resourceRecord) (ret [][]resourceRecord) {
+	for _, rr := range records {
+		if rr.Type == typeRRSIG || rr.Type == typeOPT {
+			continue
+		}
+		found := false
+		for i, rrset := range ret {
+			if rrset[0].Name == rr.Name && rrset[0].Type == rr.Type && rrset[0].Class == rr.Class {
+				ret[i] = append(ret[i], rr)
+				found = true
+				break
+			}
+		}
+		if !found {
+			ret = append(ret, []resourceRecord{rr})
+		}
+	}
+	return
+}
+
+// filterRRset returns the records of the owner name and type.
+func filterRRset(records []resourceRecord, name string, rrType uint16) (ret []resourceRecord) {
+	for _, rr := range records {
+		if rr.Name == name && rr.Type == rrType {
+			ret = append(ret, rr)
+		}
+	}
+	return
+}
+
+/*
+validateMessage validates the RRsets of the answer section, or those of the authority section in a negative response.
+It returns true only if all of them are authentic, and false if some of them come from unsigned zones. An authentic
+negative response must also prove that the name does not exist, or that the name does not have records of the type.
+*/
+func (validator *DNSSECValidator) validateMessage(msg *dnsMessage, qName string, qType uint16) (bool, error) {
+	rrsets := groupRRsets(msg.Answer)
+	records := msg.Answer
+	negative := len(rrsets) == 0
+	if negative {
+		// A negative response is proven by the signed SOA and NSEC (or NSEC3) records of the zone
+		records = msg.Authority
+		for _, rrset := range groupRRsets(msg.Authority) {
+			if rrType := rrset[0].Type; rrType == typeSOA || rrType == typeNSEC || rrType == typeNSEC3 {
+				rrsets = append(rrsets, rrset)
+			}
+		}
+	}
+	if len(rrsets) == 0 {
+		zone, err := validator.zoneOf(qName)
+		if err != nil {
+			return false, err
+		} else if !zone.insecure {
+			return false, fmt.Errorf("negative response to %s is not accompanied by proof of non-existence", qName)
+		}
+		return false, nil
+	}
+	synthesised := make([]bool, len(rrsets))
+	if !negative {
+		var err error
+		if synthesised, err = followAnswerChain(rrsets, qName, qType); err != nil {
+			return false, err
+		}
+	}
+	secure := true
+	for i, rrset := range rrsets {
+		// CNAME records synthesised from a DNAME record do not carry signatures, the signed DNAME record vouches for them.
+		if synthesised[i] {
+			continue
+		}
+		rrsetSecure, err := validator.validateRRset(rrset, records)
+		if err != nil {
+			return false, fmt.Errorf("failed to validate %s records of type %d - %v", rrset[0].Name, rrset[0].Type, err)
+		}
+		secure = secure && rrsetSecure
+	}
+	if secure && negative {
+		if err := proveNonExistence(msg.Authority, qName, qType, msg.Rcode() == rcodeNXDomain); err != nil {
+			return false, err
+		}
+	}
+	return secure, nil
+}
+
+/*
+followAnswerChain follows the CNAME and DNAME records of the answer RRsets from the question name to the records of the
+question type. It returns an error if some of the RRsets are not on the chain, which means they do not answer the
+question. For each RRset, the return value tells whether it is a CNAME record synthesised from a DNAME record on the
+chain - the owner is under the DNAME owner, and the target is the result of the DNAME substitution.
+*/
+func followAnswerChain(rrsets [][]resourceRecord, qName string, qType uint16) (synthesised []bool, err error) {
+	synthesised = make([]bool, len(rrsets))
+	onChain := make([]bool, len(rrsets))
+	name := qName
+	for hop := 0; ; hop++ {
+		if hop > DNSSECMaxChainLength {
+			return nil, fmt.Errorf("the chain of CNAME and DNAME records from %s is too long", qName)
+		}
+		cname, dname, answered := -1, -1, false
+		for i, rrset := range rrsets {
+			owner, rrType := rrset[0].Name, rrset[0].Type
+			switch {
+			case owner == name && (rrType == qType || qType == typeANY):
+				onChain[i] = true
+				answered = true
+			case owner == name && rrType == typeCNAME:
+				cname = i
+			case rrType == typeDNAME && owner != name && isSubdomain(name, owner):
+				// The DNAME record of the closest ancestor applies
+				if dname == -1 || countLabels(owner) > countLabels(rrsets[dname][0].Name) {
+					dname = i
+				}
+			}
+		}
+		if answered {
+			break
+		}
+		var next string
+		if cname != -1 {
+			if len(rrsets[cname]) != 1 {
+				return nil, fmt.Errorf("%s has more than one CNAME record", name)
+			}
+			if next, _, err = readName(rrsets[cname][0].RData, 0); err != nil {
+				return nil, err
+			}
+			onChain[cname] = true
+		}
+		if dname != -1 {
+			if len(rrsets[dname]) != 1 {
+				return nil, fmt.Errorf("%s has more than one DNAME record", rrsets[dname][0].Name)
+			}
+			target, _, err := readName(rrsets[dname][0].RData, 0)
+			if err != nil {
+				return nil, err
+			}
+			substituted := substituteDNAME(name, rrsets[dname][0].Name, target)
+			if cname != -1 && next != substituted {
+				return nil, fmt.Errorf("the CNAME record of %s does not match the DNAME substitution %s", name, substituted)
+			}
+			onChain[dname] = true
+			if cname != -1 {
+				synthesised[cname] = true
+			}
+			next = substituted
+		}
+		if next == "" {
+			// The chain ends without records of the question type, e.g. the target is not in the cache of the forwarder.
+			break
+		}
+		name = next
+	}
+	for i, rrset := range rrsets {
+		if !onChain[i] {
+			return nil, fmt.Errorf("%s records of type %d are not on the chain of answers to %s", rrset[0].Name, rrset[0].Type, qName)
+		}
+	}
+	return synthesised, nil
+}
+
+// substituteDNAME returns the name with its DNAME owner suffix replaced by the DNAME target.
+func substituteDNAME(name, owner, target string) string {
+	prefix := name
+	if owner != "." {
+		prefix = name[:len(name)-len(owner)]
+	}
+	if target == "." {
+		return prefix
+	}
+	return prefix + target
+}
+
+/*
+validateRRset returns true only if the RRset carries a valid signature made by the keys of its zone, and false if the
+RRset comes from an unsigned zone.
+*/
+func (validator *DNSSECValidator) validateRRset(rrset, records []resourceRecord) (bool, error) {
+	owner := rrset[0].Name
+	/*
+		The signer name tells the zone of the RRset, which saves looking up DS records of every intermediate name
+		between the zone apex and the owner name. Without a signature, the RRset must be proven to come from an
+		unsigned zone.
+	*/
+	zoneName := owner
+	for _, rr := range records {
+		if rr.Type != typeRRSIG || rr.Name != owner {
+			continue
+		}
+		if sig, err := parseRRSIG(rr.RData); err == nil && sig.TypeCovered == rrset[0].Type && isSubdomain(owner, sig.SignerName) {
+			zoneName = sig.SignerName
+			break
+		}
+	}
+	zone, err := validator.zoneOf(zoneName)
+	if err != nil {
+		return false, err
+	} else if zone.insecure {
+		return false, nil
+	}
+	if err := verifyRRset(rrset, records, zone.name, zone.keys); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+/*
+verifyRRset returns nil only if the RRset carries a signature (among the records) made by one of the keys of the signer
+zone, and the signature is currently valid.
+*/
+func verifyRRset(rrset, records []resourceRecord, signer string, keys []*dnskey) error {
+	if len(rrset) == 0 {
+		return errors.New("RRset is empty")
+	}
+	now := uint32(time.Now().Unix())
+	lastErr := fmt.Errorf("missing signature made by the keys of zone %s", signer)
+	for _, rr := range records {
+		if rr.Type != typeRRSIG || rr.Name != rrset[0].Name {
+			continue
+		}
+		sig, err := parseRRSIG(rr.RData)
+		if err != nil || sig.TypeCovered != rrset[0].Type || sig.SignerName != signer || int(sig.Labels) > countLabels(rr.Name) {
+			continue
+		}
+		if !sig.isValidAt(now) {
+			lastErr = errors.New("signature has expired or is not yet valid")
+			continue
+		}
+		signedData := sig.signedData(rrset)
+		for _, key := range keys {
+			if key.KeyTag != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if lastErr = key.verify(signedData, sig.Signature); lastErr == nil {
+				return nil
+			}
+		}
+	}
+	return lastErr
+}
+
+/*
+zoneOf follows the chain of trust from the root zone down to the domain name, and returns the zone that the name
+belongs to, along with the zone's validated keys. The outcome is cached for each name along the way.
+*/
+func (validator *DNSSECValidator) zoneOf(name string) (*dnssecZone, error) {
+	validator.mutex.Lock()
+	cached, exists := validator.zones[name]
+	validator.mutex.Unlock()
+	if exists && time.Now().Before(cached.expiry) {
+		return cached, nil
+	}
+	var zone *dnssecZone
+	if name == "." {
+		keys, err := validator.getZoneKeys(".", validator.anchors)
+		if err != nil {
+			return nil, err
+		}
+		zone = &dnssecZone{name: ".", keys: keys, insecure: len(keys) == 0}
+	} else {
+		parent, err := validator.zoneOf(parentName(name))
+		if err != nil {
+			return nil, err
+		}
+		zone = parent
+		if !parent.insecure {
+			if zone, err = validator.findZoneCut(name, parent); err != nil {
+				return nil, err
+			}
+		}
+	}
+	cached = &dnssecZone{name: zone.name, keys: zone.keys, insecure: zone.insecure, expiry: time.Now().Add(DNSSECZoneCacheTTLSec * time.Second)}
+	validator.mutex.Lock()
+	if len(validator.zones) >= DNSSECZoneCacheMaxEntries {
+		validator.zones = make(map[string]*dnssecZone)
+	}
+	validator.zones[name] = cached
+	validator.mutex.Unlock()
+	return cached, nil
+}
+
+/*
+findZoneCut queries the DS records of the name, which reside in the parent zone. A signed zone begins at the name if
+the DS records are present, otherwise the parent zone must prove either that the name is an unsigned delegation, or
+that the name belongs to the parent zone.
+*/
+func (validator *DNSSECValidator) findZoneCut(name string, parent *dnssecZone) (*dnssecZone, error) {
+	resp, err := validator.exchange(name, typeDS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query DS records of %s - %v", name, err)
+	}
+	if resp.Rcode() != 0 && resp.Rcode() != rcodeNXDomain {
+		return nil, fmt.Errorf("DS query of %s failed with response code %d", name, resp.Rcode())
+	}
+	if dsRRset := filterRRset(resp.Answer, name, typeDS); len(dsRRset) > 0 {
+		if err := verifyRRset(dsRRset, resp.Answer, parent.name, parent.keys); err != nil {
+			return nil, fmt.Errorf("failed to validate DS records of %s - %v", name, err)
+		}
+		dsSet := make([]*dsRecord, 0, len(dsRRset))
+		for _, rr := range dsRRset {
+			ds, err := parseDS(rr.RData)
+			if err != nil {
+				return nil, err
+			}
+			dsSet = append(dsSet, ds)
+		}
+		keys, err := validator.getZoneKeys(name, dsSet)
+		if err != nil {
+			return nil, err
+		}
+		return &dnssecZone{name: name, keys: keys, insecure: len(keys) == 0}, nil
+	}
+	// A name owning a CNAME cannot be a delegation
+	if len(filterRRset(resp.Answer, name, typeCNAME)) > 0 {
+		return parent, nil
+	}
+	proven, delegation := false, false
+	for _, rrset := range groupRRsets(resp.Authority) {
+		rrType := rrset[0].Type
+		if rrType != typeNSEC && rrType != typeNSEC3 {
+			continue
+		}
+		if err := verifyRRset(rrset, resp.Authority, parent.name, parent.keys); err != nil {
+			return nil, fmt.Errorf("failed to validate denial of DS records of %s - %v", name, err)
+		}
+		proven = true
+		for _, rr := range rrset {
+			delegation = delegation || isUnsignedDelegation(name, rr)
+		}
+	}
+	if !proven {
+		return nil, fmt.Errorf("absence of DS records of %s is not proven", name)
+	}
+	if delegation {
+		return &dnssecZone{name: name, insecure: true}, nil
+	}
+	return parent, nil
+}
+
+/*
+isUnsignedDelegation returns true if the NSEC or NSEC3 record proves that the name is a delegation (an NS record
+without SOA or DS), or that the name may be an unsigned delegation skipped by an NSEC3 opt-out span.
+*/
+func isUnsignedDelegation(name string, rr resourceRecord) bool {
+	if bitmap, matches := nsecMatches(rr, name); matches {
+		return typeBitmapHas(bitmap, typeNS) && !typeBitmapHas(bitmap, typeSOA) && !typeBitmapHas(bitmap, typeDS)
+	}
+	if rec, matches := nsec3Matches(rr, name); matches {
+		return typeBitmapHas(rec.TypeBitmap, typeNS) && !typeBitmapHas(rec.TypeBitmap, typeSOA) && !typeBitmapHas(rec.TypeBitmap, typeDS)
+	}
+	rec, covers := nsec3Covers(rr, name)
+	return covers && rec.OptOut
+}
+
+// nsecMatches returns the type bitmap of the NSEC record if the record is owned by the name.
+func nsecMatches(rr resourceRecord, name string) ([]byte, bool) {
+	if rr.Type != typeNSEC || rr.Name != name {
+		return nil, false
+	}
+	_, bitmapStart, err := readName(rr.RData, 0)
+	if err != nil {
+		return nil, false
+	}
+	return rr.RData[bitmapStart:], true
+}
+
+/*
+nsecCovers returns true only if the name falls between the owner and the next name of the NSEC record in canonical
+order, the next name of the last record in the zone wraps around to the zone apex. Names underneath a delegation are
+not covered, as they belong to the child zone.
+*/
+func nsecCovers(rr resourceRecord, name string) bool {
+	if rr.Type != typeNSEC || compareCanonical(rr.Name, name) >= 0 {
+		return false
+	}
+	next, bitmapStart, err := readName(rr.RData, 0)
+	if err != nil {
+		return false
+	}
+	if bitmap := rr.RData[bitmapStart:]; isSubdomain(name, rr.Name) && typeBitmapHas(bitmap, typeNS) && !typeBitmapHas(bitmap, typeSOA) {
+		return false
+	}
+	if compareCanonical(next, rr.Name) <= 0 {
+		return isSubdomain(name, next)
+	}
+	return compareCanonical(name, next) < 0
+}
+
+// readNSEC3 parses the NSEC3 record that uses a supported hash algorithm, along with the hash carried by its owner name.
+func readNSEC3(rr resourceRecord) (rec *nsec3, ownerHash []byte, ok bool) {
+	if rr.Type != typeNSEC3 {
+		return nil, nil, false
+	}
+	rec, err := parseNSEC3(rr.RData)
+	if err != nil || rec.HashAlgorithm != 1 {
+		return nil, nil, false
+	}
+	if ownerHash, err = nsec3OwnerHash(rr.Name); err != nil {
+		return nil, nil, false
+	}
+	return rec, ownerHash, true
+}
+
+// nsec3Matches returns the NSEC3 record if its owner hash is the hash of the name.
+func nsec3Matches(rr resourceRecord, name string) (*nsec3, bool) {
+	rec, ownerHash, ok := readNSEC3(rr)
+	if !ok || !isSubdomain(name, parentName(rr.Name)) {
+		return nil, false
+	}
+	return rec, bytes.Equal(ownerHash, rec.hashName(name))
+}
+
+// nsec3Covers returns the NSEC3 record if the hash of the name falls between its owner hash and the next hash.
+func nsec3Covers(rr resourceRecord, name string) (*nsec3, bool) {
+	rec, ownerHash, ok := readNSEC3(rr)
+	if !ok || !isSubdomain(name, parentName(rr.Name)) {
+		return nil, false
+	}
+	hash := rec.hashName(name)
+	// The last record of the zone wraps around to the first.
+	covers := bytes.Compare(ownerHash, hash) < 0 && bytes.Compare(hash, rec.NextHashed) < 0
+	if bytes.Compare(ownerHash, rec.NextHashed) >= 0 {
+		covers = bytes.Compare(ownerHash, hash) < 0 || bytes.Compare(hash, rec.NextHashed) < 0
+	}
+	return rec, covers
+}
+
+/*
+proveClosestEncloser looks for the NSEC3 proof (RFC 5155 section 7.2.1) that consists of a record matching the closest
+encloser of the name, and a record covering the next closer name. It returns the closest encloser and whether the
+covering record is an opt-out span.
+*/
+func proveClosestEncloser(authority []resourceRecord, name string) (encloser string, optOut bool, proven bool) {
+	for encloser, nextCloser := parentName(name), name; ; encloser, nextCloser = parentName(encloser), encloser {
+		for _, rr := range authority {
+			if _, matches := nsec3Matches(rr, encloser); !matches {
+				continue
+			}
+			for _, cover := range authority {
+				if rec, covers := nsec3Covers(cover, nextCloser); covers {
+					return encloser, rec.OptOut, true
+				}
+			}
+			return "", false, false
+		}
+		if encloser == "." {
+			return "", false, false
+		}
+	}
+}
+
+// wildcardOf returns the wildcard name directly underneath the domain name.
+func wildcardOf(name string) string {
+	if name == "." {
+		return "*."
+	}
+	return "*." + name
+}
+
+/*
+proveNonExistence returns an error unless the NSEC or NSEC3 records of the authority section prove that the name does
+not exist (NXDOMAIN), or that the name or the wildcard that would have matched the name exists without records of the
+type (NODATA).
+*/
+func proveNonExistence(authority []resourceRecord, qName string, qType uint16, nxDomain bool) error {
+	lacksType := func(bitmap []byte) bool {
+		return !typeBitmapHas(bitmap, qType) && !typeBitmapHas(bitmap, typeCNAME)
+	}
+	nameCovered := false
+	for _, rr := range authority {
+		nameCovered = nameCovered || nsecCovers(rr, qName)
+		if nxDomain {
+			continue
+		}
+		if bitmap, matches := nsecMatches(rr, qName); matches && lacksType(bitmap) {
+			return nil
+		}
+		if rec, matches := nsec3Matches(rr, qName); matches && lacksType(rec.TypeBitmap) {
+			return nil
+		}
+	}
+	if nameCovered {
+		if nxDomain {
+			return nil
+		}
+		// The name does not exist, and the wildcard that would have matched the name does not have the type.
+		for _, rr := range authority {
+			if rr.Type == typeNSEC && strings.HasPrefix(rr.Name, "*.") && isSubdomain(qName, rr.Name[2:]) {
+				if bitmap, matches := nsecMatches(rr, rr.Name); matches && lacksType(bitmap) {
+					return nil
+				}
+			}
+		}
+	}
+	if encloser, optOut, proven := proveClosestEncloser(authority, qName); proven {
+		if nxDomain || qType == typeDS && optOut {
+			return nil
+		}
+		for _, rr := range authority {
+			if rec, matches := nsec3Matches(rr, wildcardOf(encloser)); matches && lacksType(rec.TypeBitmap) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("negative response to %s (type %d) is not proven by NSEC or NSEC3 records", qName, qType)
+}
+
+/*
+getZoneKeys queries the DNSKEY records of the zone, and returns the zone keys after validating them against the DS
+records from the parent zone. If none of the DS records uses a supported algorithm and digest type, the zone is treated
+as unsigned and the function returns no key.
+*/
+func (validator *DNSSECValidator) getZoneKeys(zone string, dsSet []*dsRecord) ([]*dnskey, error) {
+	supported := false
+	for _, ds := range dsSet {
+		switch ds.Algorithm {
+		case algRSASHA256, algRSASHA512, algECDSAP256SHA256, algECDSAP384SHA384, algED25519:
+			switch ds.DigestType {
+			case digestSHA1, digestSHA256, digestSHA384:
+				supported = true
+			}
+		}
+	}
+	if !supported {
+		return nil, nil
+	}
+	resp, err := validator.exchange(zone, typeDNSKEY)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query DNSKEY records of %s - %v", zone, err)
+	}
+	keyRRset := filterRRset(resp.Answer, zone, typeDNSKEY)
+	var keys, entryKeys []*dnskey
+	for _, rr := range keyRRset {
+		key, err := parseDNSKEY(rr.RData)
+		if err != nil || !key.isUsableZoneKey() {
+			continue
+		}
+		keys = append(keys, key)
+		for _, ds := range dsSet {
+			if ds.matches(zone, key) {
+				entryKeys = append(entryKeys, key)
+				break
+			}
+		}
+	}
+	if len(entryKeys) == 0 {
+		return nil, fmt.Errorf("none of the DNSKEY records of %s matches its DS records", zone)
+	}
+	// The DNSKEY RRset must be signed by a key that matches DS record
+	if err := verifyRRset(keyRRset, resp.Answer, zone, entryKeys); err != nil {
+		return nil, fmt.Errorf("failed to validate DNSKEY records of %s - %v", zone, err)
+	}
+	return keys, nil
+}
+
+// exchangeTCP queries a randomly chosen forwarder over TCP (or TLS and HTTPS, if the forwarder uses them) for the DNSSEC records of the name and type.
+func (validator *DNSSECValidator) exchangeTCP(name string, qType uint16) (*dnsMessage, error) {
+	query := make([]byte, 12)
+	id := uint16(rand.Intn(65536))
+	binary.BigEndian.PutUint16(query[0:2], id)
+	// Recursion desired, checking disabled, one question, and one additional record (OPT).
+	query[2], query[3], query[5], query[11] = 0x01, 0x10, 1, 1
+	query = append(query, nameToWire(name)...)
+	query = append(query, byte(qType>>8), byte(qType), 0, classIN)
+	query = append(query, 0, 0, typeOPT, 0x10, 0x00, 0, 0, 0x80, 0, 0, 0)
+
+	forwarder := validator.Forwarders[rand.Intn(len(validator.Forwarders))]
+	resp, err := exchangeWithForwarder(validator.logger, "tcp", forwarder, query)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := parseMessage(resp)
+	if err != nil {
+		return nil, err
+	} else if msg.ID != id {
+		return nil, errors.New("response transaction ID does not match the query")
+	}
+	return msg, nil
+}
@@ -0,0 +1,541 @@
+package dnsd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+const (
+	// DNS resource record types involved in DNSSEC validation.
+	typeNS     = 2
+	typeSOA    = 6
+	typePTR    = 12
+	typeSRV    = 33
+	typeDNAME  = 39
+	typeDS     = 43
+	typeRRSIG  = 46
+	typeNSEC   = 47
+	typeDNSKEY = 48
+	typeNSEC3  = 50
+	typeANY    = 255
+
+	// DNSSEC signing algorithms supported by the validator.
+	algRSASHA256       = 8
+	algRSASHA512       = 10
+	algECDSAP256SHA256 = 13
+	algECDSAP384SHA384 = 14
+	algED25519         = 15
+
+	// DS digest types supported by the validator.
+	digestSHA1   = 1
+	digestSHA256 = 2
+	digestSHA384 = 4
+)
+
+// resourceRecord is a resource record of a DNS message, its RDATA is in the canonical form defined by RFC 4034.
+type resourceRecord struct {
+	Name  string // Name is the owner name in lower case, with a trailing full-stop.
+	Type  uint16
+	Class uint16
+	TTL   uint32
+	RData []byte
+}
+
+// dnsMessage is a parsed DNS message, the questions are not kept.
+type dnsMessage struct {
+	ID         uint16
+	Flags      uint16
+	Answer     []resourceRecord
+	Authority  []resourceRecord
+	Additional []resourceRecord
+}
+
+// Rcode returns the response code of the message.
+func (msg *dnsMessage) Rcode() int {
+	return int(msg.Flags & 0x0f)
+}
+
+// readName reads the (possibly compressed) domain name at the index of the message, and returns the name in lower case
+// with a trailing full-stop, along with the index right after the name.
+func readName(msg []byte, i int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if i >= len(msg) {
+			return "", 0, errors.New("domain name is truncated")
+		}
+		labelLen := int(msg[i])
+		if labelLen&0xc0 == 0xc0 {
+			if i+2 > len(msg) {
+				return "", 0, errors.New("compression pointer is truncated")
+			}
+			if end == -1 {
+				end = i + 2
+			}
+			if jumps++; jumps > 64 {
+				return "", 0, errors.New("too many compression pointers")
+			}
+			i = int(binary.BigEndian.Uint16(msg[i:i+2]) & 0x3fff)
+			continue
+		} else if labelLen > 63 {
+			return "", 0, errors.New("unsupported label type")
+		} else if labelLen == 0 {
+			i++
+			break
+		}
+		if i+1+labelLen > len(msg) {
+			return "", 0, errors.New("label is truncated")
+		}
+		label := strings.ToLower(string(msg[i+1 : i+1+labelLen]))
+		if strings.ContainsRune(label, '.') {
+			return "", 0, errors.New("label contains a full-stop")
+		}
+		labels = append(labels, label)
+		i += 1 + labelLen
+	}
+	if end == -1 {
+		end = i
+	}
+	return strings.Join(labels, ".") + ".", end, nil
+}
+
+// nameToWire returns the domain name (with a trailing full-stop) in the uncompressed wire format.
+func nameToWire(name string) []byte {
+	var ret []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label != "" {
+			ret = append(ret, byte(len(label)))
+			ret = append(ret, label...)
+		}
+	}
+	return append(ret, 0)
+}
+
+// countLabels returns the number of labels in the domain name, the root has no label.
+func countLabels(name string) int {
+	if name == "." {
+		return 0
+	}
+	return strings.Count(strings.TrimSuffix(name, "."), ".") + 1
+}
+
+// parentName returns the parent domain name of the name, the parent of root is root itself.
+func parentName(name string) string {
+	if index := strings.IndexRune(name, '.'); index != -1 && index < len(name)-1 {
+		return name[index+1:]
+	}
+	return "."
+}
+
+// isSubdomain returns true only if the name is identical to the parent or resides under the parent.
+func isSubdomain(name, parent string) bool {
+	return parent == "." || name == parent || strings.HasSuffix(name, "."+parent)
+}
+
+// compareCanonical compares the domain names in the canonical order (RFC 4034 section 6.1), the result is -1, 0, or 1.
+func compareCanonical(a, b string) int {
+	aLabels, bLabels := strings.Split(strings.TrimSuffix(a, "."), "."), strings.Split(strings.TrimSuffix(b, "."), ".")
+	if a == "." {
+		aLabels = nil
+	}
+	if b == "." {
+		bLabels = nil
+	}
+	for i := 1; i <= len(aLabels) && i <= len(bLabels); i++ {
+		if ret := strings.Compare(aLabels[len(aLabels)-i], bLabels[len(bLabels)-i]); ret != 0 {
+			return ret
+		}
+	}
+	switch {
+	case len(aLabels) < len(bLabels):
+		return -1
+	case len(aLabels) > len(bLabels):
+		return 1
+	}
+	return 0
+}
+
+// canonicalRData returns the RDATA in canonical form, in which the embedded domain names are uncompressed and in lower case.
+func canonicalRData(msg []byte, rrType uint16, start, end int) ([]byte, error) {
+	// The number of leading bytes before an embedded domain name
+	var namePrefix int
+	switch rrType {
+	case typeNS, typeCNAME, typePTR, typeDNAME:
+	case typeMX:
+		namePrefix = 2
+	case typeSRV:
+		namePrefix = 6
+	case typeSOA:
+		// SOA carries two names, followed by 20 bytes of serial number and timers.
+		mname, i, err := readName(msg, start)
+		if err != nil {
+			return nil, err
+		}
+		rname, i, err := readName(msg, i)
+		if err != nil || i+20 != end {
+			return nil, fmt.Errorf("malformed SOA record - %v", err)
+		}
+		ret := append(nameToWire(mname), nameToWire(rname)...)
+		return append(ret, msg[i:end]...), nil
+	default:
+		return append([]byte{}, msg[start:end]...), nil
+	}
+	if start+namePrefix > end {
+		return nil, errors.New("malformed record data")
+	}
+	name, i, err := readName(msg, start+namePrefix)
+	if err != nil || i != end {
+		return nil, fmt.Errorf("malformed record data - %v", err)
+	}
+	return append(append([]byte{}, msg[start:start+namePrefix]...), nameToWire(name)...), nil
+}
+
+// parseMessage parses a DNS message (without prefix length bytes).
+func parseMessage(msg []byte) (*dnsMessage, error) {
+	if len(msg) < 12 {
+		return nil, errors.New("message is too short")
+	}
+	ret := &dnsMessage{ID: binary.BigEndian.Uint16(msg[0:2]), Flags: binary.BigEndian.Uint16(msg[2:4])}
+	i := 12
+	var err error
+	for q := 0; q < int(binary.BigEndian.Uint16(msg[4:6])); q++ {
+		if _, i, err = readName(msg, i); err != nil {
+			return nil, err
+		}
+		if i += 4; i > len(msg) {
+			return nil, errors.New("question is truncated")
+		}
+	}
+	for section, count := range []int{int(binary.BigEndian.Uint16(msg[6:8])), int(binary.BigEndian.Uint16(msg[8:10])), int(binary.BigEndian.Uint16(msg[10:12]))} {
+		for r := 0; r < count; r++ {
+			var rr resourceRecord
+			if rr.Name, i, err = readName(msg, i); err != nil {
+				return nil, err
+			}
+			if i+10 > len(msg) {
+				return nil, errors.New("resource record is truncated")
+			}
+			rr.Type = binary.BigEndian.Uint16(msg[i : i+2])
+			rr.Class = binary.BigEndian.Uint16(msg[i+2 : i+4])
+			rr.TTL = binary.BigEndian.Uint32(msg[i+4 : i+8])
+			rdataEnd := i + 10 + int(binary.BigEndian.Uint16(msg[i+8:i+10]))
+			if rdataEnd > len(msg) {
+				return nil, errors.New("resource record data is truncated")
+			}
+			if rr.RData, err = canonicalRData(msg, rr.Type, i+10, rdataEnd); err != nil {
+				return nil, err
+			}
+			i = rdataEnd
+			switch section {
+			case 0:
+				ret.Answer = append(ret.Answer, rr)
+			case 1:
+				ret.Authority = append(ret.Authority, rr)
+			default:
+				ret.Additional = append(ret.Additional, rr)
+			}
+		}
+	}
+	return ret, nil
+}
+
+// rrsig is the RDATA of an RRSIG record.
+type rrsig struct {
+	TypeCovered uint16
+	Algorithm   uint8
+	Labels      uint8
+	OriginalTTL uint32
+	Expiration  uint32
+	Inception   uint32
+	KeyTag      uint16
+	SignerName  string
+	Signature   []byte
+	// signedRData is the RDATA without the signature, which precedes the resource records in the signed data.
+	signedRData []byte
+}
+
+// parseRRSIG parses the RDATA of an RRSIG record.
+func parseRRSIG(rdata []byte) (*rrsig, error) {
+	if len(rdata) < 19 {
+		return nil, errors.New("RRSIG is too short")
+	}
+	signer, i, err := readName(rdata, 18)
+	if err != nil {
+		return nil, err
+	}
+	return &rrsig{
+		TypeCovered: binary.BigEndian.Uint16(rdata[0:2]),
+		Algorithm:   rdata[2],
+		Labels:      rdata[3],
+		OriginalTTL: binary.BigEndian.Uint32(rdata[4:8]),
+		Expiration:  binary.BigEndian.Uint32(rdata[8:12]),
+		Inception:   binary.BigEndian.Uint32(rdata[12:16]),
+		KeyTag:      binary.BigEndian.Uint16(rdata[16:18]),
+		SignerName:  signer,
+		Signature:   rdata[i:],
+		signedRData: append(append([]byte{}, rdata[:18]...), nameToWire(signer)...),
+	}, nil
+}
+
+// isValidAt returns true only if the signature is valid at the Unix timestamp, according to serial number arithmetic.
+func (sig *rrsig) isValidAt(now uint32) bool {
+	return int32(sig.Expiration-now) >= 0 && int32(now-sig.Inception) >= 0
+}
+
+// signedData returns the data covered by the signature over the RRset (RFC 4034 section 3.1.8.1).
+func (sig *rrsig) signedData(rrset []resourceRecord) []byte {
+	if len(rrset) == 0 {
+		return nil
+	}
+	// The owner name of a wildcard expansion is the wildcard itself
+	owner := rrset[0].Name
+	if labels := countLabels(owner); int(sig.Labels) < labels {
+		split := strings.Split(strings.TrimSuffix(owner, "."), ".")
+		owner = "*." + strings.Join(split[labels-int(sig.Labels):], ".") + "."
+	}
+	ownerWire := nameToWire(owner)
+	rdatas := make([][]byte, 0, len(rrset))
+	for _, rr := range rrset {
+		rdatas = append(rdatas, rr.RData)
+	}
+	sort.Slice(rdatas, func(i, j int) bool { return bytes.Compare(rdatas[i], rdatas[j]) < 0 })
+	data := append([]byte{}, sig.signedRData...)
+	for i, rdata := range rdatas {
+		// Duplicated records are signed only once
+		if i > 0 && bytes.Equal(rdata, rdatas[i-1]) {
+			continue
+		}
+		data = append(data, ownerWire...)
+		data = append(data, byte(rrset[0].Type>>8), byte(rrset[0].Type), byte(rrset[0].Class>>8), byte(rrset[0].Class))
+		data = append(data, byte(sig.OriginalTTL>>24), byte(sig.OriginalTTL>>16), byte(sig.OriginalTTL>>8), byte(sig.OriginalTTL))
+		data = append(data, byte(len(rdata)>>8), byte(len(rdata)))
+		data = append(data, rdata...)
+	}
+	return data
+}
+
+// dnskey is the RDATA of a DNSKEY record.
+type dnskey struct {
+	Flags     uint16
+	Protocol  uint8
+	Algorithm uint8
+	PublicKey []byte
+	KeyTag    uint16
+	rdata     []byte
+}
+
+// parseDNSKEY parses the RDATA of a DNSKEY record.
+func parseDNSKEY(rdata []byte) (*dnskey, error) {
+	if len(rdata) < 5 {
+		return nil, errors.New("DNSKEY is too short")
+	}
+	// Calculate key tag according to RFC 4034 appendix B
+	var tag uint32
+	for i, b := range rdata {
+		if i&1 == 1 {
+			tag += uint32(b)
+		} else {
+			tag += uint32(b) << 8
+		}
+	}
+	tag += tag >> 16 & 0xffff
+	return &dnskey{
+		Flags:     binary.BigEndian.Uint16(rdata[0:2]),
+		Protocol:  rdata[2],
+		Algorithm: rdata[3],
+		PublicKey: rdata[4:],
+		KeyTag:    uint16(tag),
+		rdata:     rdata,
+	}, nil
+}
+
+// isUsableZoneKey returns true only if the key is a DNSSEC zone key that has not been revoked.
+func (key *dnskey) isUsableZoneKey() bool {
+	return key.Flags&0x0100 != 0 && key.Flags&0x0080 == 0 && key.Protocol == 3
+}
+
+// verify returns nil only if the signature over the data is made by the key.
+func (key *dnskey) verify(data, signature []byte) error {
+	switch key.Algorithm {
+	case algRSASHA256, algRSASHA512:
+		// The public key is made of exponent length (one or three bytes), exponent, and modulus.
+		pubKey := key.PublicKey
+		if len(pubKey) < 3 {
+			return errors.New("RSA public key is too short")
+		}
+		expLen, expStart := int(pubKey[0]), 1
+		if expLen == 0 {
+			expLen, expStart = int(binary.BigEndian.Uint16(pubKey[1:3])), 3
+		}
+		if expLen > 4 || expStart+expLen >= len(pubKey) {
+			return errors.New("unsupported RSA public key exponent")
+		}
+		var exp int
+		for _, b := range pubKey[expStart : expStart+expLen] {
+			exp = exp<<8 | int(b)
+		}
+		rsaKey := &rsa.PublicKey{N: new(big.Int).SetBytes(pubKey[expStart+expLen:]), E: exp}
+		if key.Algorithm == algRSASHA256 {
+			digest := sha256.Sum256(data)
+			return rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature)
+		}
+		digest := sha512.Sum512(data)
+		return rsa.VerifyPKCS1v15(rsaKey, crypto.SHA512, digest[:], signature)
+	case algECDSAP256SHA256, algECDSAP384SHA384:
+		curve, digest := elliptic.P256(), sha256.Sum256(data)
+		verifyDigest := digest[:]
+		if key.Algorithm == algECDSAP384SHA384 {
+			curve = elliptic.P384()
+			digest384 := sha512.Sum384(data)
+			verifyDigest = digest384[:]
+		}
+		size := curve.Params().BitSize / 8
+		if len(key.PublicKey) != 2*size || len(signature) != 2*size {
+			return errors.New("malformed ECDSA public key or signature")
+		}
+		ecdsaKey := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(key.PublicKey[:size]),
+			Y:     new(big.Int).SetBytes(key.PublicKey[size:]),
+		}
+		if !ecdsa.Verify(ecdsaKey, verifyDigest, new(big.Int).SetBytes(signature[:size]), new(big.Int).SetBytes(signature[size:])) {
+			return errors.New("ECDSA signature mismatch")
+		}
+		return nil
+	case algED25519:
+		if len(key.PublicKey) != ed25519.PublicKeySize {
+			return errors.New("malformed ED25519 public key")
+		}
+		if !ed25519.Verify(ed25519.PublicKey(key.PublicKey), data, signature) {
+			return errors.New("ED25519 signature mismatch")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %d", key.Algorithm)
+	}
+}
+
+// dsRecord is the RDATA of a DS record.
+type dsRecord struct {
+	KeyTag     uint16
+	Algorithm  uint8
+	DigestType uint8
+	Digest     []byte
+}
+
+// parseDS parses the RDATA of a DS record.
+func parseDS(rdata []byte) (*dsRecord, error) {
+	if len(rdata) < 5 {
+		return nil, errors.New("DS is too short")
+	}
+	return &dsRecord{
+		KeyTag:     binary.BigEndian.Uint16(rdata[0:2]),
+		Algorithm:  rdata[2],
+		DigestType: rdata[3],
+		Digest:     rdata[4:],
+	}, nil
+}
+
+// matches returns true only if the DS record is a digest of the DNSKEY of the zone.
+func (ds *dsRecord) matches(zone string, key *dnskey) bool {
+	if ds.KeyTag != key.KeyTag || ds.Algorithm != key.Algorithm {
+		return false
+	}
+	data := append(nameToWire(zone), key.rdata...)
+	var digest []byte
+	switch ds.DigestType {
+	case digestSHA1:
+		sum := sha1.Sum(data)
+		digest = sum[:]
+	case digestSHA256:
+		sum := sha256.Sum256(data)
+		digest = sum[:]
+	case digestSHA384:
+		sum := sha512.Sum384(data)
+		digest = sum[:]
+	default:
+		return false
+	}
+	return bytes.Equal(digest, ds.Digest)
+}
+
+// typeBitmapHas returns true only if the type bitmap of NSEC or NSEC3 record (RFC 4034 section 4.1.2) has the type.
+func typeBitmapHas(bitmap []byte, rrType uint16) bool {
+	for i := 0; i+2 <= len(bitmap); {
+		window, length := bitmap[i], int(bitmap[i+1])
+		if i+2+length > len(bitmap) {
+			return false
+		}
+		if uint16(window) == rrType>>8 {
+			byteIndex := int(rrType&0xff) / 8
+			return byteIndex < length && bitmap[i+2+byteIndex]&(0x80>>(rrType%8)) != 0
+		}
+		i += 2 + length
+	}
+	return false
+}
+
+// nsec3 is the RDATA of an NSEC3 record.
+type nsec3 struct {
+	HashAlgorithm uint8
+	OptOut        bool
+	Iterations    uint16
+	Salt          []byte
+	NextHashed    []byte
+	TypeBitmap    []byte
+}
+
+// parseNSEC3 parses the RDATA of an NSEC3 record.
+func parseNSEC3(rdata []byte) (*nsec3, error) {
+	if len(rdata) < 5 {
+		return nil, errors.New("NSEC3 is too short")
+	}
+	saltEnd := 5 + int(rdata[4])
+	if saltEnd+1 > len(rdata) {
+		return nil, errors.New("NSEC3 salt is truncated")
+	}
+	hashEnd := saltEnd + 1 + int(rdata[saltEnd])
+	if hashEnd > len(rdata) {
+		return nil, errors.New("NSEC3 next hashed owner is truncated")
+	}
+	return &nsec3{
+		HashAlgorithm: rdata[0],
+		OptOut:        rdata[1]&0x01 != 0,
+		Iterations:    binary.BigEndian.Uint16(rdata[2:4]),
+		Salt:          rdata[5:saltEnd],
+		NextHashed:    rdata[saltEnd+1 : hashEnd],
+		TypeBitmap:    rdata[hashEnd:],
+	}, nil
+}
+
+// hashName returns the NSEC3 hash (RFC 5155 section 5) of the domain name.
+func (rec *nsec3) hashName(name string) []byte {
+	hash := sha1.Sum(append(nameToWire(name), rec.Salt...))
+	for i := 0; i < int(rec.Iterations); i++ {
+		hash = sha1.Sum(append(hash[:], rec.Salt...))
+	}
+	return hash[:]
+}
+
+// nsec3OwnerHash decodes the hash carried by the first label of an NSEC3 owner name.
+func nsec3OwnerHash(owner string) ([]byte, error) {
+	label := owner
+	if index := strings.IndexRune(owner, '.'); index != -1 {
+		label = owner[:index]
+	}
+	return base32.HexEncoding.WithPadding(base32.NoPadding).DecodeString(strings.ToUpper(label))
+}
@@ -0,0 +1,444 @@
+package dnsd
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+func TestReadName(t *testing.T) {
+	// "github.coM" is in the question, the answer record refers to it via a compression pointer.
+	resp := append(append([]byte{}, githubComUDPQuery[:28]...), 0xc0, 12)
+	if name, end, err := readName(resp, 12); err != nil || name != "github.com." || end != 24 {
+		t.Fatal(name, end, err)
+	}
+	if name, end, err := readName(resp, 28); err != nil || name != "github.com." || end != 30 {
+		t.Fatal(name, end, err)
+	}
+	// Pointer loop
+	if _, _, err := readName([]byte{0xc0, 0}, 0); err == nil {
+		t.Fatal("did not error")
+	}
+	if countLabels(".") != 0 || countLabels("www.example.com.") != 3 || parentName("www.example.com.") != "example.com." || parentName("com.") != "." {
+		t.Fatal("unexpected name manipulation")
+	}
+	if !isSubdomain("www.example.com.", "example.com.") || isSubdomain("wwwexample.com.", "example.com.") || !isSubdomain("com.", ".") {
+		t.Fatal("unexpected sub-domain")
+	}
+}
+
+func TestPrepareQuery(t *testing.T) {
+	// The test query already has an OPT record
+	query := PrepareQuery(githubComUDPQuery)
+	if len(query) != len(githubComUDPQuery) || query[3]&0x10 == 0 || query[35]&0x80 == 0 || githubComUDPQuery[35] != 0 {
+		t.Fatal(hex.EncodeToString(query))
+	}
+	// Without OPT record, a new one is appended.
+	noOPT := append([]byte{}, githubComUDPQuery[:28]...)
+	noOPT[11] = 0
+	query = PrepareQuery(noOPT)
+	if query[11] != 1 || query[3]&0x10 == 0 || GetUDPPayloadSize(query) != 4096 {
+		t.Fatal(hex.EncodeToString(query))
+	}
+	if i := findOPT(query); i == 0 || query[i+6]&0x80 == 0 {
+		t.Fatal(hex.EncodeToString(query))
+	}
+}
+
+func TestStripDNSSECRecords(t *testing.T) {
+	zone := newTestZone(t, "example.com.")
+	a := resourceRecord{Name: "www.example.com.", Type: typeA, Class: classIN, TTL: 300, RData: []byte{1, 2, 3, 4}}
+	soa := resourceRecord{Name: "example.com.", Type: typeSOA, Class: classIN, TTL: 300, RData: append(append(nameToWire("ns.example.com."), nameToWire("admin.example.com.")...), make([]byte, 20)...)}
+	nsec := testNSEC("example.com.", "www.example.com.", typeSOA, typeNSEC, typeRRSIG)
+	resp := buildTestResponse("www.example.com.", typeA, 0, []resourceRecord{a, zone.sign(t, a)}, []resourceRecord{soa, zone.sign(t, soa), nsec, zone.sign(t, nsec)})
+	// The forwarder answers with the "checking disabled" flag and an OPT record with "DNSSEC OK" flag
+	resp[3] |= 0x10
+	resp[11] = 1
+	resp = append(resp, 0, 0, typeOPT, 0x10, 0x00, 0, 0, 0x80, 0, 0, 0)
+
+	// A client without EDNS receives neither the DNSSEC records nor the OPT record
+	noOPT := append([]byte{}, githubComUDPQuery[:28]...)
+	noOPT[11] = 0
+	stripped := StripDNSSECRecords(noOPT, resp)
+	msg, err := parseMessage(stripped)
+	if err != nil || len(msg.Answer) != 1 || msg.Answer[0].Type != typeA || len(msg.Authority) != 1 || msg.Authority[0].Type != typeSOA || len(msg.Additional) != 0 {
+		t.Fatal(err, hex.EncodeToString(stripped))
+	}
+	if stripped[3]&0x10 != 0 || !bytes.Equal(stripped[:2], resp[:2]) || resp[3]&0x10 == 0 {
+		t.Fatal(hex.EncodeToString(stripped))
+	}
+	if len(stripped) > MaxUDPResponseSize {
+		t.Fatal(len(stripped))
+	}
+
+	// A client with EDNS but without "DNSSEC OK" receives the OPT record with the flag cleared
+	stripped = StripDNSSECRecords(githubComUDPQuery, resp)
+	msg, err = parseMessage(stripped)
+	if err != nil || len(msg.Answer) != 1 || len(msg.Authority) != 1 || len(msg.Additional) != 1 || msg.Additional[0].Type != typeOPT || msg.Additional[0].TTL&0x8000 != 0 {
+		t.Fatal(err, hex.EncodeToString(stripped))
+	}
+
+	// A client asking for DNSSEC records receives all of them
+	doQuery := PrepareQuery(githubComUDPQuery)
+	doQuery[3] &^= 0x10
+	stripped = StripDNSSECRecords(doQuery, resp)
+	if len(stripped) != len(resp) || stripped[3]&0x10 != 0 || !bytes.Equal(stripped[4:], resp[4:]) {
+		t.Fatal(hex.EncodeToString(stripped))
+	}
+
+	// A client asking for the RRSIG records receives them in the answer
+	rrsigResp := buildTestResponse("www.example.com.", typeRRSIG, 0, []resourceRecord{zone.sign(t, a)}, nil)
+	rrsigQuery := append([]byte{}, noOPT...)
+	rrsigQuery[25] = typeRRSIG
+	if stripped = StripDNSSECRecords(rrsigQuery, rrsigResp); !bytes.Equal(stripped, rrsigResp) {
+		t.Fatal(hex.EncodeToString(stripped))
+	}
+}
+
+func TestDNSKEY_Verify(t *testing.T) {
+	// The test vector comes from RFC 8080 section 6.1
+	seed, _ := base64.StdEncoding.DecodeString("ODIyNjAzODQ2MjgwODAxMjI2NDUxOTAyMDQxNDIyNjI=")
+	pubKey := ed25519.NewKeyFromSeed(seed).Public().(ed25519.PublicKey)
+	key, err := parseDNSKEY(append([]byte{1, 1, 3, algED25519}, pubKey...))
+	if err != nil || key.KeyTag != 3613 || !key.isUsableZoneKey() {
+		t.Fatal(key, err)
+	}
+	ds, _ := parseDSPresentation("3613 15 2 3aa5ab37efce57f737fc1627013fee07bdf241bd10f3b1964ab55c78e79a304b")
+	if !ds.matches("example.com.", key) || ds.matches("example.net.", key) {
+		t.Fatal("DS mismatch")
+	}
+	signature, _ := base64.StdEncoding.DecodeString("oL9krJun7xfBOIWcGHi7mag5/hdZrKWw15jPGrHpjQeRAvTdszaPD+QLs3fx8A4M3e23mRZ9VrbpMngwcrqNAg==")
+	rdata := []byte{0, typeMX, algED25519, 2, 0, 0, 0x0e, 0x10}
+	rdata = appendUint32(rdata, 1440021600)
+	rdata = appendUint32(rdata, 1438207200)
+	rdata = append(rdata, 3613>>8, 3613&0xff)
+	rdata = append(append(rdata, nameToWire("example.com.")...), signature...)
+	sig, err := parseRRSIG(rdata)
+	if err != nil || sig.SignerName != "example.com." || sig.KeyTag != 3613 || !sig.isValidAt(1440000000) || sig.isValidAt(1440021601) {
+		t.Fatal(sig, err)
+	}
+	rrset := []resourceRecord{{Name: "example.com.", Type: typeMX, Class: classIN, TTL: 3600, RData: append([]byte{0, 10}, nameToWire("mail.example.com.")...)}}
+	if err := key.verify(sig.signedData(rrset), sig.Signature); err != nil {
+		t.Fatal(err)
+	}
+	rrset[0].RData[1] = 20
+	if err := key.verify(sig.signedData(rrset), sig.Signature); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+// appendUint32 appends the integer in big endian.
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+// fixedSizeBytes returns the integer in big endian, padded with leading zeros to the size.
+func fixedSizeBytes(v *big.Int, size int) []byte {
+	b := v.Bytes()
+	return append(make([]byte, size-len(b)), b...)
+}
+
+// testZone is a DNSSEC signed zone used by test cases.
+type testZone struct {
+	name    string
+	privKey *ecdsa.PrivateKey
+	keyRR   resourceRecord
+	key     *dnskey
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdata := append([]byte{1, 1, 3, algECDSAP256SHA256}, fixedSizeBytes(privKey.PublicKey.X, 32)...)
+	rdata = append(rdata, fixedSizeBytes(privKey.PublicKey.Y, 32)...)
+	key, _ := parseDNSKEY(rdata)
+	return &testZone{
+		name:    name,
+		privKey: privKey,
+		keyRR:   resourceRecord{Name: name, Type: typeDNSKEY, Class: classIN, TTL: 3600, RData: rdata},
+		key:     key,
+	}
+}
+
+// ds returns the DS record of the zone key.
+func (zone *testZone) ds() resourceRecord {
+	digest := sha256.Sum256(append(nameToWire(zone.name), zone.keyRR.RData...))
+	rdata := append([]byte{byte(zone.key.KeyTag >> 8), byte(zone.key.KeyTag), algECDSAP256SHA256, digestSHA256}, digest[:]...)
+	return resourceRecord{Name: zone.name, Type: typeDS, Class: classIN, TTL: 3600, RData: rdata}
+}
+
+// sign returns the RRSIG record over the RRset made by the zone key.
+func (zone *testZone) sign(t *testing.T, rrset ...resourceRecord) resourceRecord {
+	now := uint32(time.Now().Unix())
+	rdata := []byte{byte(rrset[0].Type >> 8), byte(rrset[0].Type), algECDSAP256SHA256, byte(countLabels(rrset[0].Name))}
+	rdata = appendUint32(rdata, rrset[0].TTL)
+	rdata = appendUint32(rdata, now+3600)
+	rdata = appendUint32(rdata, now-3600)
+	rdata = append(rdata, byte(zone.key.KeyTag>>8), byte(zone.key.KeyTag))
+	rdata = append(rdata, nameToWire(zone.name)...)
+	sig, _ := parseRRSIG(rdata)
+	digest := sha256.Sum256(sig.signedData(rrset))
+	r, s, err := ecdsa.Sign(rand.Reader, zone.privKey, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	rdata = append(rdata, fixedSizeBytes(r, 32)...)
+	rdata = append(rdata, fixedSizeBytes(s, 32)...)
+	return resourceRecord{Name: rrset[0].Name, Type: typeRRSIG, Class: classIN, TTL: rrset[0].TTL, RData: rdata}
+}
+
+// testNSEC returns an NSEC record of the name, its type bitmap has the types (all below 256).
+func testNSEC(name, next string, types ...uint16) resourceRecord {
+	bitmap := make([]byte, 32)
+	for _, rrType := range types {
+		bitmap[rrType/8] |= 0x80 >> (rrType % 8)
+	}
+	rdata := append(nameToWire(next), 0, 32)
+	return resourceRecord{Name: name, Type: typeNSEC, Class: classIN, TTL: 3600, RData: append(rdata, bitmap...)}
+}
+
+// testNSEC3 returns an NSEC3 record (no salt, no extra iteration) in the zone that spans from the owner hash to the next
+// hash. Its type bitmap has the types (all below 256).
+func testNSEC3(zone string, ownerHash, nextHash []byte, optOut bool, types ...uint16) resourceRecord {
+	owner := strings.ToLower(base32.HexEncoding.WithPadding(base32.NoPadding).EncodeToString(ownerHash)) + "." + zone
+	bitmap := make([]byte, 32)
+	for _, rrType := range types {
+		bitmap[rrType/8] |= 0x80 >> (rrType % 8)
+	}
+	var flags byte
+	if optOut {
+		flags = 1
+	}
+	rdata := append([]byte{1, flags, 0, 0, 0, byte(len(nextHash))}, nextHash...)
+	return resourceRecord{Name: owner, Type: typeNSEC3, Class: classIN, TTL: 3600, RData: append(append(rdata, 0, 32), bitmap...)}
+}
+
+// buildTestResponse returns a response packet to the question, the records are written without name compression.
+func buildTestResponse(qName string, qType uint16, rcode byte, answer, authority []resourceRecord) []byte {
+	resp := []byte{0x12, 0x34, 0x81, 0x80 | rcode, 0, 1, 0, byte(len(answer)), 0, byte(len(authority)), 0, 0}
+	resp = append(resp, nameToWire(qName)...)
+	resp = append(resp, byte(qType>>8), byte(qType), 0, classIN)
+	for _, rr := range append(append([]resourceRecord{}, answer...), authority...) {
+		resp = append(resp, nameToWire(rr.Name)...)
+		resp = append(resp, byte(rr.Type>>8), byte(rr.Type), byte(rr.Class>>8), byte(rr.Class))
+		resp = appendUint32(resp, rr.TTL)
+		resp = append(resp, byte(len(rr.RData)>>8), byte(len(rr.RData)))
+		resp = append(resp, rr.RData...)
+	}
+	return resp
+}
+
+func TestDNSSECValidator(t *testing.T) {
+	root, com, example, attacker := newTestZone(t, "."), newTestZone(t, "com."), newTestZone(t, "example.com."), newTestZone(t, "attacker.com.")
+	rootDS := root.ds()
+	// The records known to the fake forwarder, keyed by name and type.
+	records := map[string]*dnsMessage{}
+	addAnswer := func(zone *testZone, rrset ...resourceRecord) {
+		records[fmt.Sprintf("%s %d", rrset[0].Name, rrset[0].Type)] = &dnsMessage{Answer: append(rrset, zone.sign(t, rrset...))}
+	}
+	addAnswer(root, root.keyRR)
+	addAnswer(com, com.keyRR)
+	addAnswer(example, example.keyRR)
+	addAnswer(root, com.ds())
+	addAnswer(com, example.ds())
+	addAnswer(attacker, attacker.keyRR)
+	addAnswer(com, attacker.ds())
+	// unsigned.com is an unsigned delegation
+	unsignedNSEC := testNSEC("unsigned.com.", "zzz.com.", typeNS, typeRRSIG, typeNSEC)
+	records["unsigned.com. 43"] = &dnsMessage{Authority: []resourceRecord{unsignedNSEC, com.sign(t, unsignedNSEC)}}
+	// www.example.com is not a zone cut
+	wwwNSEC := testNSEC("www.example.com.", "zzz.example.com.", typeA, typeRRSIG, typeNSEC)
+	records["www.example.com. 43"] = &dnsMessage{Authority: []resourceRecord{wwwNSEC, example.sign(t, wwwNSEC)}}
+
+	validator := &DNSSECValidator{
+		TrustAnchors: []string{fmt.Sprintf("%d %d %d %X", root.key.KeyTag, algECDSAP256SHA256, digestSHA256, rootDS.RData[4:])},
+		exchange: func(name string, qType uint16) (*dnsMessage, error) {
+			if msg, exists := records[fmt.Sprintf("%s %d", name, qType)]; exists {
+				return msg, nil
+			}
+			return nil, errors.New("no such record")
+		},
+	}
+	if err := validator.Initialise(lalog.Logger{}); err != nil {
+		t.Fatal(err)
+	}
+
+	wwwA := resourceRecord{Name: "www.example.com.", Type: typeA, Class: classIN, TTL: 300, RData: []byte{1, 2, 3, 4}}
+	wwwSig := example.sign(t, wwwA)
+	// Signed answer from a signed zone
+	resp, err := validator.Validate(buildTestResponse("WWW.example.com.", typeA, 0, []resourceRecord{wwwA, wwwSig}, nil))
+	if err != nil || resp[3]&0x20 == 0 {
+		t.Fatal(resp, err)
+	}
+	// Tampered answer
+	tampered := wwwA
+	tampered.RData = []byte{6, 6, 6, 6}
+	if _, err := validator.Validate(buildTestResponse("www.example.com.", typeA, 0, []resourceRecord{tampered, wwwSig}, nil)); err == nil || !strings.Contains(err.Error(), "www.example.com.") {
+		t.Fatal(err)
+	}
+	// Signature is stripped from the answer
+	if _, err := validator.Validate(buildTestResponse("www.example.com.", typeA, 0, []resourceRecord{wwwA}, nil)); err == nil {
+		t.Fatal("did not error")
+	}
+	// Signature made by a key outside of the chain of trust
+	impostor := newTestZone(t, "example.com.")
+	if _, err := validator.Validate(buildTestResponse("www.example.com.", typeA, 0, []resourceRecord{wwwA, impostor.sign(t, wwwA)}, nil)); err == nil {
+		t.Fatal("did not error")
+	}
+	// Unsigned answer from an unsigned zone
+	unsignedA := resourceRecord{Name: "www.unsigned.com.", Type: typeA, Class: classIN, TTL: 300, RData: []byte{1, 2, 3, 4}}
+	unsignedResp := buildTestResponse("www.unsigned.com.", typeA, 0, []resourceRecord{unsignedA}, nil)
+	unsignedResp[3] |= 0x20
+	if resp, err := validator.Validate(unsignedResp); err != nil || resp[3]&0x20 != 0 {
+		t.Fatal(resp, err)
+	}
+	// Signed negative response
+	soa := resourceRecord{Name: "example.com.", Type: typeSOA, Class: classIN, TTL: 300, RData: append(append(nameToWire("ns.example.com."), nameToWire("admin.example.com.")...), make([]byte, 20)...)}
+	nsec := testNSEC("example.com.", "www.example.com.", typeSOA, typeNS, typeRRSIG, typeNSEC, typeDNSKEY)
+	negative := []resourceRecord{soa, example.sign(t, soa), nsec, example.sign(t, nsec)}
+	if resp, err := validator.Validate(buildTestResponse("nonexistent.example.com.", typeA, rcodeNXDomain, nil, negative)); err != nil || resp[3]&0x20 == 0 {
+		t.Fatal(resp, err)
+	}
+	// NXDOMAIN proof that does not cover the name
+	if _, err := validator.Validate(buildTestResponse("zzz.example.com.", typeA, rcodeNXDomain, nil, negative)); err == nil {
+		t.Fatal("did not error")
+	}
+	// NODATA proof made by the NSEC record of the name
+	noData := []resourceRecord{soa, example.sign(t, soa), wwwNSEC, example.sign(t, wwwNSEC)}
+	if resp, err := validator.Validate(buildTestResponse("www.example.com.", typeAAAA, 0, nil, noData)); err != nil || resp[3]&0x20 == 0 {
+		t.Fatal(resp, err)
+	}
+	if _, err := validator.Validate(buildTestResponse("www.example.com.", typeA, 0, nil, noData)); err == nil {
+		t.Fatal("did not error")
+	}
+	// The NSEC record covering a name is not a NODATA proof of the name
+	if _, err := validator.Validate(buildTestResponse("nonexistent.example.com.", typeA, 0, nil, negative)); err == nil {
+		t.Fatal("did not error")
+	}
+	// NXDOMAIN proof made by NSEC3 records of the closest encloser and the next closer name
+	nsec3Hash := (&nsec3{HashAlgorithm: 1}).hashName
+	lowest, highest := make([]byte, 20), bytes.Repeat([]byte{0xff}, 20)
+	// The span of apex record is too narrow to cover any other name
+	apexNext := nsec3Hash("example.com.")
+	apexNext[len(apexNext)-1]++
+	apexNSEC3 := testNSEC3("example.com.", nsec3Hash("example.com."), apexNext, false, typeSOA, typeNS, typeRRSIG, typeDNSKEY)
+	coverNSEC3 := testNSEC3("example.com.", lowest, highest, false)
+	nsec3Negative := []resourceRecord{soa, example.sign(t, soa), apexNSEC3, example.sign(t, apexNSEC3), coverNSEC3, example.sign(t, coverNSEC3)}
+	if resp, err := validator.Validate(buildTestResponse("a.nonexistent.example.com.", typeA, rcodeNXDomain, nil, nsec3Negative)); err != nil || resp[3]&0x20 == 0 {
+		t.Fatal(resp, err)
+	}
+	// NSEC3 span that does not cover the next closer name
+	foreignFrom := nsec3Hash("nonexistent.example.com.")
+	foreignFrom[len(foreignFrom)-1]++
+	foreignNSEC3 := testNSEC3("example.com.", foreignFrom, highest, false)
+	nsec3Negative = []resourceRecord{soa, example.sign(t, soa), apexNSEC3, example.sign(t, apexNSEC3), foreignNSEC3, example.sign(t, foreignNSEC3)}
+	if _, err := validator.Validate(buildTestResponse("a.nonexistent.example.com.", typeA, rcodeNXDomain, nil, nsec3Negative)); err == nil {
+		t.Fatal("did not error")
+	}
+	// NODATA proof made by the NSEC3 record of the name
+	if resp, err := validator.Validate(buildTestResponse("example.com.", typeA, 0, nil, []resourceRecord{soa, example.sign(t, soa), apexNSEC3, example.sign(t, apexNSEC3)})); err != nil || resp[3]&0x20 == 0 {
+		t.Fatal(resp, err)
+	}
+	if _, err := validator.Validate(buildTestResponse("example.com.", typeSOA, 0, nil, []resourceRecord{soa, example.sign(t, soa), apexNSEC3, example.sign(t, apexNSEC3)})); err == nil {
+		t.Fatal("did not error")
+	}
+	// Negative response without proof
+	if _, err := validator.Validate(buildTestResponse("www.example.com.", typeAAAA, 0, nil, []resourceRecord{soa})); err == nil {
+		t.Fatal("did not error")
+	}
+	// The CNAME record synthesised from a DNAME record is not signed
+	dname := resourceRecord{Name: "old.example.com.", Type: typeDNAME, Class: classIN, TTL: 300, RData: nameToWire("example.com.")}
+	synthesised := resourceRecord{Name: "www.old.example.com.", Type: typeCNAME, Class: classIN, TTL: 300, RData: nameToWire("www.example.com.")}
+	dnameAnswer := []resourceRecord{dname, example.sign(t, dname), synthesised, wwwA, wwwSig}
+	if resp, err := validator.Validate(buildTestResponse("www.old.example.com.", typeA, 0, dnameAnswer, nil)); err != nil || resp[3]&0x20 == 0 {
+		t.Fatal(resp, err)
+	}
+	// The unsigned CNAME record does not match the DNAME substitution
+	evilA := resourceRecord{Name: "evil.example.com.", Type: typeA, Class: classIN, TTL: 300, RData: []byte{6, 6, 6, 6}}
+	forgedCNAME := resourceRecord{Name: "www.old.example.com.", Type: typeCNAME, Class: classIN, TTL: 300, RData: nameToWire("evil.example.com.")}
+	forgedAnswer := []resourceRecord{dname, example.sign(t, dname), forgedCNAME, evilA, example.sign(t, evilA)}
+	if _, err := validator.Validate(buildTestResponse("www.old.example.com.", typeA, 0, forgedAnswer, nil)); err == nil {
+		t.Fatal("did not error")
+	}
+	// The attacker's own signed DNAME record does not vouch for the forged CNAME record of another domain
+	attackerDNAME := resourceRecord{Name: "attacker.com.", Type: typeDNAME, Class: classIN, TTL: 300, RData: nameToWire("example.com.")}
+	forgedCNAME = resourceRecord{Name: "www.bank.com.", Type: typeCNAME, Class: classIN, TTL: 300, RData: nameToWire("evil.example.com.")}
+	forgedAnswer = []resourceRecord{attackerDNAME, attacker.sign(t, attackerDNAME), forgedCNAME, evilA, example.sign(t, evilA)}
+	if _, err := validator.Validate(buildTestResponse("www.bank.com.", typeA, 0, forgedAnswer, nil)); err == nil {
+		t.Fatal("did not error")
+	}
+	// Signed records that do not answer the question
+	if _, err := validator.Validate(buildTestResponse("www.bank.com.", typeA, 0, []resourceRecord{evilA, example.sign(t, evilA)}, nil)); err == nil || !strings.Contains(err.Error(), "not on the chain") {
+		t.Fatal(err)
+	}
+	// Truncated and server failure responses are not validated
+	truncated := buildTestResponse("www.example.com.", typeA, 0, []resourceRecord{tampered}, nil)
+	truncated[2] |= 0x02
+	if resp, err := validator.Validate(truncated); err != nil || len(resp) != len(truncated) {
+		t.Fatal(resp, err)
+	}
+	if resp, err := validator.Validate(buildTestResponse("www.example.com.", typeA, rcodeServFail, nil, nil)); err != nil || resp == nil {
+		t.Fatal(resp, err)
+	}
+}
+
+func TestCompareCanonical(t *testing.T) {
+	// The example of canonical order in RFC 4034 section 6.1
+	names := []string{"example.", "a.example.", "yljkjljk.a.example.", "z.a.example.", "zabc.a.example.", "z.example.", "*.z.example."}
+	for i := 1; i < len(names); i++ {
+		if compareCanonical(names[i-1], names[i]) != -1 || compareCanonical(names[i], names[i-1]) != 1 {
+			t.Fatal(names[i-1], names[i])
+		}
+	}
+	if compareCanonical(".", "example.") != -1 || compareCanonical("a.example.", "a.example.") != 0 {
+		t.Fatal("wrong order")
+	}
+}
+
+func TestIsUnsignedDelegation(t *testing.T) {
+	// NSEC
+	if !isUnsignedDelegation("sub.example.com.", testNSEC("sub.example.com.", "zzz.example.com.", typeNS, typeNSEC)) {
+		t.Fatal("should have been a delegation")
+	}
+	for _, rr := range []resourceRecord{
+		testNSEC("other.example.com.", "zzz.example.com.", typeNS, typeNSEC),
+		testNSEC("sub.example.com.", "zzz.example.com.", typeNS, typeSOA, typeNSEC),
+		testNSEC("sub.example.com.", "zzz.example.com.", typeNS, typeDS, typeNSEC),
+	} {
+		if isUnsignedDelegation("sub.example.com.", rr) {
+			t.Fatal(rr)
+		}
+	}
+	// NSEC3 that matches the name
+	subHash := (&nsec3{HashAlgorithm: 1}).hashName("sub.example.com.")
+	lowest, highest := make([]byte, 20), bytes.Repeat([]byte{0xff}, 20)
+	if !isUnsignedDelegation("sub.example.com.", testNSEC3("example.com.", subHash, highest, false, typeNS)) {
+		t.Fatal("should have been a delegation")
+	}
+	if isUnsignedDelegation("sub.example.com.", testNSEC3("example.com.", subHash, highest, false, typeNS, typeDS)) {
+		t.Fatal("should not have been a delegation")
+	}
+	// NSEC3 span that covers the name, only an opt-out span may skip an unsigned delegation.
+	if !isUnsignedDelegation("sub.example.com.", testNSEC3("example.com.", lowest, highest, true)) {
+		t.Fatal("should have been a delegation")
+	}
+	if isUnsignedDelegation("sub.example.com.", testNSEC3("example.com.", lowest, highest, false)) {
+		t.Fatal("should not have been a delegation")
+	}
+}
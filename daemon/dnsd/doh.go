@@ -0,0 +1,208 @@
+package dnsd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/testingstub"
+)
+
+const (
+	DoHPath         = "/dns-query"              // DoHPath is the URL path of DNS-over-HTTPS endpoint, as suggested by RFC 8484.
+	DoHContentType  = "application/dns-message" // DoHContentType is the content type of DNS-over-HTTPS query and response bodies.
+	DoHIOTimeoutSec = ClientTimeoutSec          // DoHIOTimeoutSec is the IO timeout of DNS-over-HTTPS requests and responses.
+)
+
+// statsDoH times the DNS queries received over HTTPS.
+var statsDoH = misc.GetStats("dnsd.DoH")
+
+/*
+readDoHQuery retrieves the DNS query packet from a DNS-over-HTTPS request. A GET request carries the query in "dns"
+parameter encoded in base64url without padding, and a POST request carries the query in its body.
+*/
+func readDoHQuery(r *http.Request) ([]byte, error) {
+	switch r.Method {
+	case http.MethodGet:
+		return base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+	case http.MethodPost:
+		if contentType := r.Header.Get("Content-Type"); !strings.HasPrefix(contentType, DoHContentType) {
+			return nil, fmt.Errorf("unexpected content type \"%s\"", contentType)
+		}
+		return misc.ReadAllUpTo(r.Body, MaxPacketSize+1)
+	default:
+		return nil, fmt.Errorf("unexpected method %s", r.Method)
+	}
+}
+
+/*
+HandleDoHQuery answers a DNS query made over HTTPS (RFC 8484). Just like queries made over TCP and UDP, the query may be
+answered by a toolbox command, the blacklist, or a recursive resolver.
+*/
+func (daemon *Daemon) HandleDoHQuery(w http.ResponseWriter, r *http.Request) {
+	beginTimeNano := time.Now().UnixNano()
+	defer func() {
+		statsDoH.Trigger(float64(time.Now().UnixNano() - beginTimeNano))
+	}()
+	clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		clientIP = r.RemoteAddr
+	}
+	if !daemon.rateLimit.Add(clientIP, true) {
+		http.Error(w, "", http.StatusTooManyRequests)
+		return
+	}
+	queryBody, err := readDoHQuery(r)
+	if err != nil {
+		daemon.logger.Warning("HandleDoHQuery", clientIP, err, "failed to read query")
+		http.Error(w, "failed to read query", http.StatusBadRequest)
+		return
+	}
+	if len(queryBody) > MaxPacketSize || len(queryBody) < MinNameQuerySize {
+		daemon.logger.Warning("HandleDoHQuery", clientIP, nil, "invalid query length from client")
+		http.Error(w, "invalid query length", http.StatusBadRequest)
+		return
+	}
+	// Formulate a response in the same way as answering a TCP query
+	queryLen := []byte{byte(len(queryBody) / 256), byte(len(queryBody) % 256)}
+	var respBody []byte
+	if isTextQuery(queryBody) {
+		_, respBody = daemon.handleTCPTextQuery(daemon.logger, clientIP, queryLen, queryBody)
+	} else {
+		_, respBody = daemon.handleTCPNameOrOtherQuery(daemon.logger, clientIP, queryLen, queryBody)
+	}
+	if len(respBody) < 2 {
+		http.Error(w, "failed to resolve the query", http.StatusBadGateway)
+		return
+	}
+	// Match transaction ID of original query, though DoH clients usually use 0.
+	respBody[0] = queryBody[0]
+	respBody[1] = queryBody[1]
+	w.Header().Set("Content-Type", DoHContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(respBody)))
+	_, _ = w.Write(respBody)
+}
+
+// startAndBlockDoH serves DNS-over-HTTPS queries. Blocks caller until the listener is told to stop.
+func (daemon *Daemon) startAndBlockDoH() error {
+	mux := http.NewServeMux()
+	mux.HandleFunc(DoHPath, daemon.HandleDoHQuery)
+	server := &http.Server{
+		Addr:         net.JoinHostPort(daemon.Address, strconv.Itoa(daemon.DoHPort)),
+		Handler:      mux,
+		ReadTimeout:  DoHIOTimeoutSec * time.Second,
+		WriteTimeout: DoHIOTimeoutSec * time.Second,
+		TLSConfig:    daemon.tlsConfig,
+	}
+	daemon.dohServerMutex.Lock()
+	daemon.dohServer = server
+	daemon.dohServerMutex.Unlock()
+	daemon.logger.Info("startAndBlockDoH", "", nil, "going to listen for DNS-over-HTTPS queries on port %d", daemon.DoHPort)
+	listener, err := common.ListenTCP(daemon.logger, daemon.Address, daemon.DoHPort)
+	if err != nil {
+		return fmt.Errorf("dnsd.startAndBlockDoH: failed to listen on %s:%d - %v", daemon.Address, daemon.DoHPort, err)
+	}
+	if err := server.ServeTLS(listener, "", ""); err != nil && err != http.ErrServerClosed {
+		return fmt.Errorf("dnsd.startAndBlockDoH: failed to listen on %s:%d - %v", daemon.Address, daemon.DoHPort, err)
+	}
+	return nil
+}
+
+// stopDoH stops the DNS-over-HTTPS listener after ongoing queries are answered.
+func (daemon *Daemon) stopDoH() {
+	daemon.dohServerMutex.Lock()
+	server := daemon.dohServer
+	daemon.dohServer = nil
+	daemon.dohServerMutex.Unlock()
+	if server == nil {
+		return
+	}
+	ctx, cancel := common.NewDrainContext()
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		daemon.logger.Warning("stopDoH", "", err, "closing the connections that did not finish in time")
+		daemon.logger.MaybeMinorError(server.Close())
+	}
+}
+
+/*
+newDoHTestResolver returns a resolver that sends its queries to the DNS-over-HTTPS listener. The queries written by the
+resolver are relayed in POST requests made by the HTTP client.
+*/
+func newDoHTestResolver(client *http.Client, dohURL string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo:     true,
+		StrictErrors: true,
+		Dial: func(ctx context.Context, network, address string) (conn net.Conn, e error) {
+			// The resolver frames its queries with a length prefix, just like it does over TCP.
+			resolverConn, relayConn := net.Pipe()
+			go func() {
+				defer relayConn.Close()
+				for {
+					queryLen := make([]byte, 2)
+					if _, err := io.ReadFull(relayConn, queryLen); err != nil {
+						return
+					}
+					query := make([]byte, int(queryLen[0])*256+int(queryLen[1]))
+					if _, err := io.ReadFull(relayConn, query); err != nil {
+						return
+					}
+					resp, err := client.Post(dohURL, DoHContentType, bytes.NewReader(query))
+					if err != nil {
+						return
+					}
+					respBody, err := ioutil.ReadAll(resp.Body)
+					_ = resp.Body.Close()
+					if err != nil || resp.StatusCode != http.StatusOK {
+						return
+					}
+					if _, err := relayConn.Write(append([]byte{byte(len(respBody) / 256), byte(len(respBody) % 256)}, respBody...)); err != nil {
+						return
+					}
+				}
+			}()
+			return resolverConn, nil
+		},
+	}
+}
+
+// testDoH runs test cases against the DNS-over-HTTPS listener.
+func testDoH(dnsd *Daemon, t testingstub.T) {
+	// The test certificate is self-signed
+	client := &http.Client{
+		Timeout:   DoHIOTimeoutSec * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	dohURL := fmt.Sprintf("https://127.0.0.1:%d%s", dnsd.DoHPort, DoHPath)
+	// Malformed queries
+	if resp, err := client.Get(dohURL + "?dns=!!!"); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal(err, resp)
+	}
+	if resp, err := client.Post(dohURL, "text/plain", strings.NewReader("aaaaaaaaaaaaaaaaaaaa")); err != nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatal(err, resp)
+	}
+	// Look up github.com A record in a GET request
+	query := []byte{0, 0, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0, 6, 'g', 'i', 't', 'h', 'u', 'b', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1}
+	resp, err := client.Get(dohURL + "?dns=" + base64.RawURLEncoding.EncodeToString(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil || resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != DoHContentType || len(respBody) < len(query) {
+		t.Fatal(err, resp.StatusCode, respBody)
+	}
+	// Run the common test cases using a resolver that relays its queries in POST requests
+	testResolveNameAndBlackList(t, dnsd, newDoHTestResolver(client, dohURL))
+}
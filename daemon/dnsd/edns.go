@@ -0,0 +1,81 @@
+package dnsd
+
+import "encoding/binary"
+
+const (
+	// MaxUDPResponseSize is the largest response that may be answered over UDP to a client that does not use EDNS.
+	MaxUDPResponseSize = 512
+	// typeOPT is the type of EDNS pseudo resource record, which carries the client's UDP payload size in its class field.
+	typeOPT = 41
+)
+
+/*
+GetUDPPayloadSize returns the size of the largest UDP response the client is able to receive, as advertised by the EDNS
+(RFC 6891) OPT record of its query. Without the OPT record, the size is 512 bytes as limited by the original DNS
+specification.
+*/
+func GetUDPPayloadSize(queryNoLength []byte) int {
+	i := findOPT(queryNoLength)
+	if i == 0 {
+		return MaxUDPResponseSize
+	}
+	size := int(binary.BigEndian.Uint16(queryNoLength[i+2 : i+4]))
+	// A size smaller than 512 is treated as 512, and the size is capped by the largest packet the daemon handles.
+	if size < MaxUDPResponseSize {
+		return MaxUDPResponseSize
+	} else if size > MaxPacketSize {
+		return MaxPacketSize
+	}
+	return size
+}
+
+// findOPT returns the index of the type field of the EDNS OPT record in the packet, or 0 if the packet does not have one.
+func findOPT(packet []byte) int {
+	_, _, _, i := parseQuestion(packet)
+	if i == 0 {
+		return 0
+	}
+	numRecords := int(binary.BigEndian.Uint16(packet[6:8])) + int(binary.BigEndian.Uint16(packet[8:10])) + int(binary.BigEndian.Uint16(packet[10:12]))
+	for r := 0; r < numRecords; r++ {
+		var ok bool
+		if i, ok = skipName(packet, i); !ok || i+10 > len(packet) {
+			break
+		}
+		if rrType := binary.BigEndian.Uint16(packet[i : i+2]); rrType == typeOPT {
+			return i
+		}
+		i += 10 + int(binary.BigEndian.Uint16(packet[i+8:i+10]))
+	}
+	return 0
+}
+
+/*
+TruncateResponse returns the response as-is if it is no longer than the maximum length. Otherwise, it returns the
+header and question of the response with the truncation (TC) flag set, so that the client will retry the query over
+TCP.
+*/
+func TruncateResponse(resp []byte, maxLen int) []byte {
+	if len(resp) <= maxLen {
+		return resp
+	}
+	_, _, _, questionEnd := parseQuestion(resp)
+	if questionEnd == 0 || questionEnd > maxLen {
+		// Without a question, the response only keeps its header
+		questionEnd = 12
+		if len(resp) < questionEnd {
+			return resp
+		}
+	}
+	truncated := make([]byte, questionEnd)
+	copy(truncated, resp[:questionEnd])
+	// Byte 2 - set the truncation flag
+	truncated[2] |= 0x02
+	// Keep the question if it is there, and remove all resource records.
+	if questionEnd == 12 {
+		binary.BigEndian.PutUint16(truncated[4:6], 0)
+	}
+	binary.BigEndian.PutUint16(truncated[6:8], 0)
+	binary.BigEndian.PutUint16(truncated[8:10], 0)
+	binary.BigEndian.PutUint16(truncated[10:12], 0)
+	return truncated
+}
@@ -0,0 +1,52 @@
+package dnsd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetUDPPayloadSize(t *testing.T) {
+	if size := GetUDPPayloadSize(nil); size != MaxUDPResponseSize {
+		t.Fatal(size)
+	}
+	// The test query advertises 4096 bytes in its OPT record
+	if size := GetUDPPayloadSize(githubComUDPQuery); size != 4096 {
+		t.Fatal(size)
+	}
+	query := make([]byte, len(githubComUDPQuery))
+	copy(query, githubComUDPQuery)
+	for _, c := range []struct {
+		advertised []byte
+		expected   int
+	}{
+		{[]byte{0, 100}, MaxUDPResponseSize},
+		{[]byte{0x04, 0xd0}, 1232},
+		{[]byte{0xff, 0xff}, MaxPacketSize},
+	} {
+		copy(query[31:33], c.advertised)
+		if size := GetUDPPayloadSize(query); size != c.expected {
+			t.Fatal(c.advertised, size)
+		}
+	}
+	// Query without OPT record
+	query, _ = makeTestQueryAndResponse(t, "example.com")
+	if size := GetUDPPayloadSize(query); size != MaxUDPResponseSize {
+		t.Fatal(size)
+	}
+}
+
+func TestTruncateResponse(t *testing.T) {
+	query, resp := makeTestQueryAndResponse(t, "example.com")
+	if truncated := TruncateResponse(resp, len(resp)); !reflect.DeepEqual(truncated, resp) {
+		t.Fatal(truncated)
+	}
+	truncated := TruncateResponse(resp, len(resp)-1)
+	if len(truncated) != len(query) || truncated[2] != 0x83 || !reflect.DeepEqual(truncated[4:12], []byte{0, 1, 0, 0, 0, 0, 0, 0}) ||
+		!reflect.DeepEqual(truncated[12:], query[12:]) {
+		t.Fatal(truncated)
+	}
+	// The question does not fit either
+	if truncated := TruncateResponse(resp, 13); len(truncated) != 12 || truncated[2] != 0x83 || !reflect.DeepEqual(truncated[4:12], make([]byte, 8)) {
+		t.Fatal(truncated)
+	}
+}
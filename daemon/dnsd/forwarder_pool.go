@@ -0,0 +1,226 @@
+package dnsd
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+const (
+	ForwarderHealthCheckIntervalSec = 60  // ForwarderHealthCheckIntervalSec is the interval between health probes made to each forwarder.
+	ForwarderUnhealthyThreshold     = 3   // ForwarderUnhealthyThreshold is the number of consecutive failures that mark a forwarder unhealthy.
+	ForwarderMaxAttempts            = 2   // ForwarderMaxAttempts is the number of forwarders to try for a query before giving up.
+	forwarderLatencyWeight          = 0.3 // forwarderLatencyWeight is the weight of the latest sample in the moving average of forwarder latency.
+)
+
+// forwarderStatus is the health and latency of a forwarder.
+type forwarderStatus struct {
+	address             string
+	healthy             bool
+	consecutiveFailures int
+	latency             time.Duration // latency is the moving average of round trip duration, 0 means not yet measured.
+	numSuccess          int64
+	numFailure          int64
+}
+
+/*
+ForwarderPool keeps track of the health and latency of forwarders. Each forwarder is probed periodically, and the
+outcome of each query forwarded to it is also taken into account. Forwarders that failed repeatedly are skipped until
+they recover, and the ones with lower latency are preferred.
+*/
+type ForwarderPool struct {
+	// probe measures the round trip duration of a query to the forwarder, it may be substituted by test cases.
+	probe     func(address string) (time.Duration, error)
+	mutex     *sync.Mutex
+	statuses  []*forwarderStatus
+	stopCheck chan struct{}
+	logger    lalog.Logger
+}
+
+// NewForwarderPool constructs a new instance of ForwarderPool and initialises its internal state. All forwarders begin healthy.
+func NewForwarderPool(addresses []string, logger lalog.Logger) *ForwarderPool {
+	pool := &ForwarderPool{
+		mutex:    new(sync.Mutex),
+		statuses: make([]*forwarderStatus, 0, len(addresses)),
+		logger:   logger,
+	}
+	pool.probe = pool.probeForwarder
+	for _, address := range addresses {
+		pool.statuses = append(pool.statuses, &forwarderStatus{address: address, healthy: true})
+	}
+	return pool
+}
+
+/*
+Pick returns a forwarder for the next query, excluding those that have already been tried. Among two randomly chosen
+healthy forwarders, the one with lower latency is returned. If none of the forwarders is healthy, a random one is
+returned regardless. The function returns an empty string if all forwarders have been tried.
+*/
+func (pool *ForwarderPool) Pick(tried ...string) string {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	var healthy, candidates []*forwarderStatus
+	for _, status := range pool.statuses {
+		isTried := false
+		for _, address := range tried {
+			if status.address == address {
+				isTried = true
+				break
+			}
+		}
+		if !isTried {
+			candidates = append(candidates, status)
+			if status.healthy {
+				healthy = append(healthy, status)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return ""
+	}
+	if len(healthy) == 0 {
+		return candidates[rand.Intn(len(candidates))].address
+	}
+	first, second := healthy[rand.Intn(len(healthy))], healthy[rand.Intn(len(healthy))]
+	if second.latency < first.latency {
+		return second.address
+	}
+	return first.address
+}
+
+// ReportSuccess records a successful round trip made to the forwarder and the duration it took.
+func (pool *ForwarderPool) ReportSuccess(address string, latency time.Duration) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for _, status := range pool.statuses {
+		if status.address == address {
+			if !status.healthy {
+				pool.logger.Info("ReportSuccess", address, nil, "forwarder has recovered")
+			}
+			status.healthy = true
+			status.consecutiveFailures = 0
+			status.numSuccess++
+			if status.latency == 0 {
+				status.latency = latency
+			} else {
+				status.latency = time.Duration(forwarderLatencyWeight*float64(latency) + (1-forwarderLatencyWeight)*float64(status.latency))
+			}
+			return
+		}
+	}
+}
+
+// ReportFailure records a failed round trip made to the forwarder, the forwarder becomes unhealthy after repeated failures.
+func (pool *ForwarderPool) ReportFailure(address string) {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	for _, status := range pool.statuses {
+		if status.address == address {
+			status.consecutiveFailures++
+			status.numFailure++
+			if status.healthy && status.consecutiveFailures >= ForwarderUnhealthyThreshold {
+				pool.logger.Warning("ReportFailure", address, nil, "forwarder is unhealthy after %d consecutive failures", status.consecutiveFailures)
+				status.healthy = false
+			}
+			return
+		}
+	}
+}
+
+// CheckAll probes all forwarders in parallel and records the outcome.
+func (pool *ForwarderPool) CheckAll() {
+	pool.mutex.Lock()
+	addresses := make([]string, 0, len(pool.statuses))
+	for _, status := range pool.statuses {
+		addresses = append(addresses, status.address)
+	}
+	pool.mutex.Unlock()
+	wg := new(sync.WaitGroup)
+	for _, address := range addresses {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			if latency, err := pool.probe(address); err == nil {
+				pool.ReportSuccess(address, latency)
+			} else {
+				pool.ReportFailure(address)
+			}
+		}(address)
+	}
+	wg.Wait()
+}
+
+// StartHealthCheck probes all forwarders periodically in background, until StopHealthCheck is called.
+func (pool *ForwarderPool) StartHealthCheck() {
+	pool.mutex.Lock()
+	if pool.stopCheck != nil {
+		pool.mutex.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	pool.stopCheck = stop
+	pool.mutex.Unlock()
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(ForwarderHealthCheckIntervalSec * time.Second):
+				pool.CheckAll()
+			}
+		}
+	}()
+}
+
+// StopHealthCheck stops the periodic health probes. It is safe to call the function more than once.
+func (pool *ForwarderPool) StopHealthCheck() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	if pool.stopCheck != nil {
+		close(pool.stopCheck)
+		pool.stopCheck = nil
+	}
+}
+
+/*
+GetStats returns the health, average latency, and number of successful and failed round trips of each forwarder, one
+forwarder per line.
+*/
+func (pool *ForwarderPool) GetStats() string {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+	var out bytes.Buffer
+	for _, status := range pool.statuses {
+		health := "healthy"
+		if !status.healthy {
+			health = "unhealthy"
+		}
+		out.WriteString(fmt.Sprintf("%-26s %-9s latency %4dms, %d succeeded, %d failed\n",
+			status.address, health, status.latency/time.Millisecond, status.numSuccess, status.numFailure))
+	}
+	return out.String()
+}
+
+// probeForwarder asks the forwarder for the name servers of root zone, and returns the round trip duration.
+func (pool *ForwarderPool) probeForwarder(address string) (time.Duration, error) {
+	// Random transaction ID, recursion desired, one question: "." NS IN.
+	id := uint16(rand.Intn(65536))
+	query := []byte{byte(id >> 8), byte(id), 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, typeNS, 0, classIN}
+	start := time.Now()
+	resp, err := exchangeWithForwarder(pool.logger, "udp", address, query)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp) < 12 || resp[0] != query[0] || resp[1] != query[1] || resp[2]&0x80 == 0 {
+		return 0, fmt.Errorf("malformed response from forwarder %s", address)
+	}
+	// Server failure and refusal indicate that the forwarder is unable to serve queries
+	if rcode := resp[3] & 0x0f; rcode == rcodeServFail || rcode == rcodeRefused {
+		return 0, fmt.Errorf("forwarder %s responded with error code %d", address, rcode)
+	}
+	return time.Since(start), nil
+}
@@ -0,0 +1,163 @@
+package dnsd
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+func TestForwarderPool(t *testing.T) {
+	pool := NewForwarderPool([]string{"a", "b", "c"}, lalog.Logger{})
+	// All forwarders are healthy to begin with
+	for i := 0; i < 100; i++ {
+		if picked := pool.Pick("a", "b"); picked != "c" {
+			t.Fatal(picked)
+		}
+	}
+	if picked := pool.Pick("a", "b", "c"); picked != "" {
+		t.Fatal(picked)
+	}
+	// Repeated failures make a forwarder unhealthy
+	for i := 0; i < ForwarderUnhealthyThreshold; i++ {
+		pool.ReportFailure("a")
+	}
+	for i := 0; i < 100; i++ {
+		if picked := pool.Pick(); picked == "a" {
+			t.Fatal(picked)
+		}
+	}
+	// The lower latency forwarder is preferred
+	pool.ReportSuccess("b", 10*time.Millisecond)
+	pool.ReportSuccess("c", 500*time.Millisecond)
+	numB := 0
+	for i := 0; i < 100; i++ {
+		if pool.Pick() == "b" {
+			numB++
+		}
+	}
+	if numB < 60 {
+		t.Fatal(numB)
+	}
+	// Unhealthy forwarders are still picked when none is healthy
+	pool.ReportFailure("b")
+	pool.ReportFailure("b")
+	pool.ReportFailure("b")
+	if picked := pool.Pick("c"); picked != "a" && picked != "b" {
+		t.Fatal(picked)
+	}
+	// Probes restore the health of forwarders
+	pool.probe = func(address string) (time.Duration, error) {
+		if address == "c" {
+			return 0, errors.New("probe failure")
+		}
+		return time.Millisecond, nil
+	}
+	pool.CheckAll()
+	stats := pool.GetStats()
+	if !strings.Contains(stats, "a                          healthy   latency    1ms, 1 succeeded, 3 failed\n") ||
+		!strings.Contains(stats, "c                          healthy   latency  500ms, 1 succeeded, 1 failed\n") {
+		t.Fatal(stats)
+	}
+	pool.StartHealthCheck()
+	pool.StopHealthCheck()
+	pool.StopHealthCheck()
+}
+
+// startTestForwarders starts a UDP forwarder that answers every query with an empty response, and returns its address
+// along with the address of a forwarder that does not respond.
+func startTestForwarders(t *testing.T) (goodAddr, badAddr string, stop func()) {
+	goodForwarder, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		for {
+			n, addr, err := goodForwarder.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = goodForwarder.WriteToUDP(GetErrorResponse(buf[:n], 0), addr)
+		}
+	}()
+	// Nothing listens on the port of the bad forwarder
+	badForwarder, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	badAddr = badForwarder.LocalAddr().String()
+	_ = badForwarder.Close()
+	return goodForwarder.LocalAddr().String(), badAddr, func() {
+		_ = goodForwarder.Close()
+	}
+}
+
+func TestDNSD_ForwarderFailover(t *testing.T) {
+	goodAddr, badAddr, stop := startTestForwarders(t)
+	defer stop()
+
+	daemon := Daemon{
+		Address:         "127.0.0.1",
+		UDPPort:         62154,
+		TCPPort:         18524,
+		CacheMaxEntries: -1,
+		Forwarders:      []string{badAddr, goodAddr},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if respLen, resp := daemon.handleUDPRecursiveQuery(daemon.logger, "127.0.0.1", githubComUDPQuery); respLen == 0 || resp[0] != githubComUDPQuery[0] || resp[1] != githubComUDPQuery[1] {
+			t.Fatal(respLen, resp)
+		}
+	}
+	if stats := daemon.forwarderPool.GetStats(); !strings.Contains(stats, badAddr) || !strings.Contains(stats, "unhealthy") {
+		t.Fatal(stats)
+	}
+}
+
+func TestDNSD_ConditionalForwarders(t *testing.T) {
+	goodAddr, badAddr, stop := startTestForwarders(t)
+	defer stop()
+	host, port, _ := net.SplitHostPort(goodAddr)
+	daemon := Daemon{
+		Address:         "127.0.0.1",
+		UDPPort:         62155,
+		TCPPort:         18525,
+		CacheMaxEntries: -1,
+		ValidateDNSSEC:  true,
+		Forwarders:      []string{badAddr},
+		ConditionalForwarders: map[string]string{
+			"Corp.Example.com.": goodAddr,
+			"lab.example.com":   host,
+		},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if forwarder := daemon.getConditionalForwarder("www.corp.example.com"); forwarder != goodAddr {
+		t.Fatal(forwarder)
+	}
+	if forwarder := daemon.getConditionalForwarder("lab.example.com"); forwarder != host+":53" {
+		t.Fatal(forwarder)
+	}
+	if forwarder := daemon.getConditionalForwarder("example.com"); forwarder != "" {
+		t.Fatal(forwarder)
+	}
+	daemon.conditionalForwarders["lab.example.com"] = net.JoinHostPort(host, port)
+	for _, name := range []string{"corp.example.com.", "www.corp.example.com.", "lab.example.com."} {
+		query := append([]byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}, nameToWire(name)...)
+		query = append(query, 0, typeA, 0, classIN)
+		if respLen, resp := daemon.handleUDPRecursiveQuery(daemon.logger, "127.0.0.1", query); respLen == 0 || resp[0] != 0x12 || resp[3]&0x0f != 0 {
+			t.Fatal(name, respLen, resp)
+		}
+	}
+	// Other names go to the regular forwarders
+	if respLen, _ := daemon.handleUDPRecursiveQuery(daemon.logger, "127.0.0.1", githubComUDPQuery); respLen != 0 {
+		t.Fatal(respLen)
+	}
+}
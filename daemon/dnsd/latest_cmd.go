@@ -1,6 +1,7 @@
 package dnsd
 
 import (
+	"context"
 	"sync"
 	"time"
 
@@ -39,8 +40,9 @@ Execute looks for an ongoing or past execution of the command input. If an ongoi
 then the function waits until result is ready from the ongoing execution and returns it; if the same command has been
 executed recently, the function will return the past execution result; otherwise, the command execution begins right
 away.
+The trace ID, if not empty, is carried by the command for identifying its log messages.
 */
-func (rec *LatestCommands) Execute(cmdProcessor *toolbox.CommandProcessor, clientIP, cmdInput string) (result *toolbox.Result) {
+func (rec *LatestCommands) Execute(cmdProcessor *toolbox.CommandProcessor, clientIP, traceID, cmdInput string) (result *toolbox.Result) {
 	// Purge old result
 	rec.purgeAfterTTL()
 	// If execution of the command is ongoing, or has recently completed.
@@ -69,10 +71,17 @@ execute:
 	rec.mutex.Lock()
 	rec.latestResult[cmdInput] = nil
 	rec.mutex.Unlock()
-	// Execute the command and leave the lock available for another command that runs in parallel
-	result = cmdProcessor.Process(toolbox.Command{
+	/*
+		Execute the command and leave the lock available for another command that runs in parallel. The recursive DNS
+		server may give up on the query and retry several times, hence the execution is not tied to an individual query,
+		instead it is aborted once the result can no longer be retrieved by the retries.
+	*/
+	ctx, cancel := context.WithTimeout(context.Background(), TextCommandReplyTTL*time.Second)
+	defer cancel()
+	result = cmdProcessor.Process(ctx, toolbox.Command{
 		ClientID:   clientIP,
 		DaemonName: "dnsd",
+		TraceID:    traceID,
 		TimeoutSec: TextCommandReplyTTL - 1,
 		Content:    cmdInput,
 	}, true)
@@ -0,0 +1,127 @@
+package dnsd
+
+import (
+	"encoding/binary"
+	"strconv"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+const (
+	/*
+		NameCommandChunkRecords is the maximum number of A records in each chunk of toolbox command output answered to
+		a name query. The first record describes the chunk, and each of the others carries 3 bytes of output. Along with
+		a query name of maximum length, the response fits comfortably in a 512-byte UDP packet.
+	*/
+	NameCommandChunkRecords = 15
+	// NameCommandChunkSize is the maximum number of output bytes carried by each chunk.
+	NameCommandChunkSize = (NameCommandChunkRecords - 1) * 3
+	/*
+		nameCommandFirstOctet is the first octet of the address in the first A record of a chunk, the first octet of each
+		following record increases by one. The addresses are public, so that resolvers protecting their clients from DNS
+		rebinding do not filter them out.
+	*/
+	nameCommandFirstOctet = 200
+)
+
+/*
+DecodeNameCommandInput decodes the chunk number and toolbox command from the labels of an A query name, such as
+"_0.abcdpin.echo0hi.example.com". The first label consists of the command prefix and chunk number, the labels that
+follow and precede the domain name are the command input, which is decoded in the same way as in a TXT query. If the
+name does not carry a toolbox command, the function returns an empty command.
+*/
+func DecodeNameCommandInput(labels []string) (chunk int, decodedCommand string) {
+	if len(labels) < 4 || len(labels[0]) < 2 || labels[0][0] != ToolboxCommandPrefix {
+		return 0, ""
+	}
+	chunk, err := strconv.Atoi(labels[0][1:])
+	if err != nil || chunk < 0 || chunk > 0xffff {
+		return 0, ""
+	}
+	return chunk, DecodeDTMFCommandInput(string(ToolboxCommandPrefix) + strings.Join(labels[1:], "."))
+}
+
+/*
+MakeNameCommandResponse returns a DNS response packet (without prefix length bytes) that answers the A query with a
+chunk of toolbox command output. The address in the first A record is made of the first octet, the total number of
+chunks (2 bytes), and the number of output bytes in this chunk. Each of the following A records has the next first
+octet followed by 3 bytes of output, the last record is padded with 0s. The first octet lets clients restore the
+order of records, which is often shuffled by resolvers. If the chunk number exceeds the total, the response carries
+the first record alone.
+*/
+func MakeNameCommandResponse(queryNoLength []byte, output string, chunk int) []byte {
+	_, _, _, questionEnd := parseQuestionLabels(queryNoLength)
+	if questionEnd == 0 {
+		return []byte{}
+	}
+	totalChunks := (len(output) + NameCommandChunkSize - 1) / NameCommandChunkSize
+	if totalChunks > 0xffff {
+		totalChunks = 0xffff
+	}
+	var data []byte
+	if chunk < totalChunks {
+		start := chunk * NameCommandChunkSize
+		end := start + NameCommandChunkSize
+		if end > len(output) {
+			end = len(output)
+		}
+		data = []byte(output[start:end])
+	}
+	// The chunk description comes first, followed by the output bytes 3 at a time.
+	addresses := [][]byte{{nameCommandFirstOctet, byte(totalChunks >> 8), byte(totalChunks), byte(len(data))}}
+	for i := 0; i < len(data); i += 3 {
+		addr := []byte{byte(nameCommandFirstOctet + len(addresses)), 0, 0, 0}
+		copy(addr[1:], data[i:])
+		addresses = append(addresses, addr)
+	}
+	// Copy the question from input query into the response
+	resp := make([]byte, 0, questionEnd+len(addresses)*16)
+	resp = append(resp, queryNoLength[:questionEnd]...)
+	// Byte 2 - response, the query's opcode, authoritative answer, the query's recursion desired
+	resp[2] = 0x80 | queryNoLength[2]&0x79 | 0x04
+	// Byte 3 - recursion available, no error
+	resp[3] = 0x80
+	// Exactly one question, followed by answers, no authority or additional records.
+	binary.BigEndian.PutUint16(resp[4:6], 1)
+	binary.BigEndian.PutUint16(resp[6:8], uint16(len(addresses)))
+	binary.BigEndian.PutUint16(resp[8:10], 0)
+	binary.BigEndian.PutUint16(resp[10:12], 0)
+	for _, addr := range addresses {
+		// Name is a pointer to the queried name in question
+		resp = append(resp, 0xc0, 0x0c)
+		resp = append(resp, 0, typeA, 0, classIN)
+		resp = append(resp, 0, 0, byte(TextCommandReplyTTL>>8), byte(TextCommandReplyTTL&0xff))
+		resp = append(resp, 0, 4)
+		resp = append(resp, addr...)
+	}
+	return resp
+}
+
+/*
+answerNameCommand executes the toolbox command carried by an A query and returns a response packet (without prefix
+length bytes) that answers the requested chunk of command output. The command is executed once for all chunks, as
+clients retrieve the chunks with sequential queries while the result of recent executions is remembered.
+The function returns false if the query does not carry a toolbox command. If the command fails the PIN check, the
+function returns true along with a nil response, and the query should be forwarded without logging the queried name.
+*/
+func (daemon *Daemon) answerNameCommand(logger lalog.Logger, clientIP string, queryNoLength []byte) (respBody []byte, isCommand bool) {
+	labels, qType, qClass, _ := parseQuestionLabels(queryNoLength)
+	if qType != typeA || qClass != classIN {
+		return nil, false
+	}
+	chunk, dtmfDecoded := DecodeNameCommandInput(labels)
+	if len(dtmfDecoded) < 2 {
+		return nil, false
+	}
+	cmdResult := daemon.latestCommands.Execute(daemon.Processor, clientIP, logger.TraceID(), dtmfDecoded)
+	if cmdResult.Error == toolbox.ErrPINAndShortcutNotFound {
+		logger.Info("answerNameCommand", clientIP, nil, "input has command prefix but failed PIN check")
+		daemon.logRedactedQuery(clientIP, queryNoLength, QueryDecisionForwarded)
+		return nil, true
+	}
+	logger.Info("answerNameCommand", clientIP, nil, "processed a toolbox command, answering output chunk %d", chunk)
+	daemon.logRedactedQuery(clientIP, queryNoLength, QueryDecisionToolbox)
+	return MakeNameCommandResponse(queryNoLength, cmdResult.CombinedOutput, chunk), true
+}
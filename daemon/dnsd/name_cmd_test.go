@@ -0,0 +1,131 @@
+package dnsd
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+// makeNameQuery returns an A query packet of the name.
+func makeNameQuery(name string) []byte {
+	query := append([]byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}, nameToWire(name)...)
+	return append(query, 0, typeA, 0, classIN)
+}
+
+// readNameCommandResponse returns the total number of chunks and the output bytes carried by a chunk.
+func readNameCommandResponse(t *testing.T, resp []byte) (totalChunks int, data []byte) {
+	msg, err := parseMessage(resp)
+	if err != nil || len(msg.Answer) == 0 {
+		t.Fatal(msg, err)
+	}
+	// Resolvers may shuffle the records, the first octet restores their order.
+	addresses := make([][]byte, 0, len(msg.Answer))
+	for _, answer := range msg.Answer {
+		if answer.Type != typeA || len(answer.RData) != 4 || answer.TTL != TextCommandReplyTTL {
+			t.Fatal(answer)
+		}
+		addresses = append(addresses, answer.RData)
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return addresses[i][0] < addresses[j][0]
+	})
+	if addresses[0][0] != nameCommandFirstOctet {
+		t.Fatal(addresses)
+	}
+	for _, addr := range addresses[1:] {
+		data = append(data, addr[1:]...)
+	}
+	return int(addresses[0][1])*256 + int(addresses[0][2]), data[:addresses[0][3]]
+}
+
+func TestDecodeNameCommandInput(t *testing.T) {
+	for _, name := range []string{"", "example.com", "_0.example.com", "_.verysecret.example.com", "_x.verysecret.example.com",
+		"_-1.verysecret.example.com", "_65536.verysecret.example.com", "0.verysecret.example.com"} {
+		if _, cmd := DecodeNameCommandInput(strings.Split(name, ".")); cmd != "" {
+			t.Fatal(name, cmd)
+		}
+	}
+	if chunk, cmd := DecodeNameCommandInput(strings.Split("_12.verysecret142s0.echo0Hi.example.com", ".")); chunk != 12 || cmd != "verysecret.s echo Hi" {
+		t.Fatal(chunk, cmd)
+	}
+}
+
+func TestMakeNameCommandResponse(t *testing.T) {
+	query := makeNameQuery("_0.verysecret.example.com.")
+	if resp := MakeNameCommandResponse(query[:12], "", 0); len(resp) != 0 {
+		t.Fatal(resp)
+	}
+	// Empty output has no chunk
+	if total, data := readNameCommandResponse(t, MakeNameCommandResponse(query, "", 0)); total != 0 || len(data) != 0 {
+		t.Fatal(total, data)
+	}
+	output := strings.Repeat("0123456789", 10)
+	var assembled []byte
+	for chunk := 0; chunk < 3; chunk++ {
+		resp := MakeNameCommandResponse(query, output, chunk)
+		if resp[0] != 0x12 || resp[1] != 0x34 || resp[2]&0x80 == 0 || len(resp) > 512 {
+			t.Fatal(resp)
+		}
+		total, data := readNameCommandResponse(t, resp)
+		if total != 3 {
+			t.Fatal(total)
+		}
+		assembled = append(assembled, data...)
+	}
+	if string(assembled) != output {
+		t.Fatal(string(assembled))
+	}
+	// A chunk beyond the total carries no output
+	if total, data := readNameCommandResponse(t, MakeNameCommandResponse(query, output, 3)); total != 3 || len(data) != 0 {
+		t.Fatal(total, data)
+	}
+}
+
+func TestDNSD_NameCommand(t *testing.T) {
+	goodAddr, _, stop := startTestForwarders(t)
+	defer stop()
+	// Allow the command output to span several chunks
+	processor := toolbox.GetTestCommandProcessor()
+	processor.ResultFilters[0].(*toolbox.LintText).MaxLength = 100
+	daemon := Daemon{
+		Address:         "127.0.0.1",
+		UDPPort:         62156,
+		TCPPort:         18526,
+		CacheMaxEntries: -1,
+		QueryLogEntries: 10,
+		Forwarders:      []string{goodAddr},
+		Processor:       processor,
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	// The command output spans several chunks retrieved by sequential queries
+	cmdLabels := toolbox.TestCommandProcessorPIN + "142s0echo0" + strings.Repeat("abcdefghij", 3) + "." + strings.Repeat("abcdefghij", 3)
+	var output []byte
+	for chunk, total := 0, 1; chunk < total; chunk++ {
+		query := makeNameQuery("_" + strconv.Itoa(chunk) + "." + cmdLabels + ".example.com.")
+		respLen, resp := daemon.handleUDPNameOrOtherQuery(daemon.logger, "127.0.0.1", query)
+		var data []byte
+		total, data = readNameCommandResponse(t, resp[:respLen])
+		output = append(output, data...)
+		// The same chunk is answered over TCP too
+		_, tcpResp := daemon.handleTCPNameOrOtherQuery(daemon.logger, "127.0.0.1", nil, query)
+		if _, tcpData := readNameCommandResponse(t, tcpResp); string(tcpData) != string(data) {
+			t.Fatal(string(tcpData), string(data))
+		}
+	}
+	if string(output) != strings.Repeat("abcdefghij", 6) {
+		t.Fatal(string(output))
+	}
+	// Queries failing the PIN check are forwarded without revealing the name in query log
+	query := makeNameQuery("_0.badpin142s0echo0hi.example.com.")
+	if respLen, resp := daemon.handleUDPNameOrOtherQuery(daemon.logger, "127.0.0.1", query); respLen == 0 || resp[0] != 0x12 {
+		t.Fatal(respLen, resp)
+	}
+	if log, err := daemon.GetQueryLog(""); err != nil || strings.Contains(log, "badpin") || !strings.Contains(log, QueryLogRedactedName) {
+		t.Fatal(log, err)
+	}
+}
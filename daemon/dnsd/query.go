@@ -31,12 +31,22 @@ var StandardResponseNoError = []byte{129, 128} // DNS response packet flag - sta
 //                            Domain     A    IN      TTL 1466  IPv4     0.0.0.0
 var BlackHoleAnswer = []byte{192, 12, 0, 1, 0, 1, 0, 0, 5, 186, 0, 4, 0, 0, 0, 0} // DNS answer 0.0.0.0
 
-// GetBlackHoleResponse returns a DNS response packet (without prefix length bytes) that points queried name to 0.0.0.0.
+//                                Domain     AAAA  IN      TTL 1466  IPv6     ::
+var BlackHoleAnswerAAAA = []byte{192, 12, 0, 28, 0, 1, 0, 0, 5, 186, 0, 16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0} // DNS answer ::
+
+/*
+GetBlackHoleResponse returns a DNS response packet (without prefix length bytes) that points queried name to 0.0.0.0,
+or to :: if the query is an IPv6 address (AAAA) query.
+*/
 func GetBlackHoleResponse(queryNoLength []byte) []byte {
 	if queryNoLength == nil || len(queryNoLength) < MinNameQuerySize {
 		return []byte{}
 	}
-	answerPacket := make([]byte, 2+2+len(queryNoLength)-4+len(BlackHoleAnswer))
+	blackHoleAnswer := BlackHoleAnswer
+	if _, qType, _, _ := parseQuestion(queryNoLength); qType == typeAAAA {
+		blackHoleAnswer = BlackHoleAnswerAAAA
+	}
+	answerPacket := make([]byte, 2+2+len(queryNoLength)-4+len(blackHoleAnswer))
 	// Match transaction ID of original query
 	answerPacket[0] = queryNoLength[0]
 	answerPacket[1] = queryNoLength[1]
@@ -47,8 +57,8 @@ func GetBlackHoleResponse(queryNoLength []byte) []byte {
 	// There is exactly one answer RR
 	answerPacket[6] = 0
 	answerPacket[7] = 1
-	// Answer 0.0.0.0 to the query
-	copy(answerPacket[len(answerPacket)-len(BlackHoleAnswer):], BlackHoleAnswer)
+	// Answer 0.0.0.0 (or ::) to the query
+	copy(answerPacket[len(answerPacket)-len(blackHoleAnswer):], blackHoleAnswer)
 	return answerPacket
 }
 
@@ -110,14 +120,18 @@ func recoverFullStopSymbols(in []byte) {
 }
 
 /*
-ExtractDomainName extracts domain name requested by input query packet. If the function fails to identify a domain name,
-it will return an empty string.
+ExtractDomainName extracts domain name requested by input name (A or AAAA) query packet. If the function fails to
+identify a domain name, it will return an empty string.
 */
 func ExtractDomainName(packet []byte) string {
 	if packet == nil || len(packet) < MinNameQuerySize {
 		return ""
 	}
 	indexTypeAClassIN := bytes.Index(packet[13:], nameQueryMagic)
+	if indexTypeAClassIN < 1 {
+		// The query may also be an IPv6 address (AAAA) query
+		indexTypeAClassIN = bytes.Index(packet[13:], nameQueryMagicAAAA)
+	}
 	if indexTypeAClassIN < 1 {
 		return ""
 	}
@@ -0,0 +1,138 @@
+package dnsd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// Decisions made by the DNS daemon about a query.
+	QueryDecisionForwarded   = "forwarded"   // The query was answered by a forwarder (or the response cache).
+	QueryDecisionBlacklisted = "blacklisted" // The query was answered with a black hole address.
+	QueryDecisionToolbox     = "toolbox"     // The query carried a toolbox command.
+	QueryDecisionCustom      = "custom"      // The query was answered from custom records.
+
+	// QueryLogRedactedName is logged in place of the queried name that may carry a toolbox command or a mistyped PIN.
+	QueryLogRedactedName = "(redacted)"
+)
+
+// queryTypeNames are the textual names of common DNS query types.
+var queryTypeNames = map[uint16]string{
+	typeA:     "A",
+	2:         "NS",
+	typeCNAME: "CNAME",
+	6:         "SOA",
+	12:        "PTR",
+	typeMX:    "MX",
+	typeTXT:   "TXT",
+	typeAAAA:  "AAAA",
+	33:        "SRV",
+	255:       "ANY",
+}
+
+// QueryLogEntry records a query received by the DNS daemon and the decision made about it.
+type QueryLogEntry struct {
+	Time     time.Time
+	ClientIP string
+	Name     string
+	Type     uint16
+	Decision string
+}
+
+// String returns the entry in a single line of text.
+func (entry QueryLogEntry) String() string {
+	typeName, exists := queryTypeNames[entry.Type]
+	if !exists {
+		typeName = fmt.Sprintf("TYPE%d", entry.Type)
+	}
+	return fmt.Sprintf("%s %s %s %s %s", entry.Time.Format("2006-01-02 15:04:05"), entry.ClientIP, typeName, entry.Name, entry.Decision)
+}
+
+// QueryLog keeps the most recent queries received by the DNS daemon in a ring buffer of fixed size.
+type QueryLog struct {
+	mutex   *sync.Mutex
+	entries []QueryLogEntry
+	next    int // next is the index of the entry to be overwritten by the next query
+	full    bool
+}
+
+// NewQueryLog constructs a new instance of QueryLog and initialises its internal state.
+func NewQueryLog(maxEntries int) *QueryLog {
+	return &QueryLog{
+		mutex:   new(sync.Mutex),
+		entries: make([]QueryLogEntry, maxEntries),
+	}
+}
+
+// Record remembers a query, replacing the oldest entry if the log is full.
+func (log *QueryLog) Record(clientIP, name string, qType uint16, decision string) {
+	if log == nil || len(log.entries) == 0 {
+		return
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	log.entries[log.next] = QueryLogEntry{Time: time.Now(), ClientIP: clientIP, Name: name, Type: qType, Decision: decision}
+	log.next++
+	if log.next == len(log.entries) {
+		log.next = 0
+		log.full = true
+	}
+}
+
+// Get returns the recorded queries made by the client IP (or all clients if it is empty), the most recent query comes first.
+func (log *QueryLog) Get(clientIP string) (ret []QueryLogEntry) {
+	if log == nil {
+		return
+	}
+	log.mutex.Lock()
+	defer log.mutex.Unlock()
+	count := log.next
+	if log.full {
+		count = len(log.entries)
+	}
+	ret = make([]QueryLogEntry, 0, count)
+	for i := 1; i <= count; i++ {
+		entry := log.entries[(log.next-i+len(log.entries))%len(log.entries)]
+		if clientIP == "" || entry.ClientIP == clientIP {
+			ret = append(ret, entry)
+		}
+	}
+	return
+}
+
+// logQuery records the query made by the client in the query log, if the query log is enabled.
+func (daemon *Daemon) logQuery(clientIP string, queryNoLength []byte, decision string) {
+	if daemon.queryLog == nil {
+		return
+	}
+	name, qType, _, _ := parseQuestion(queryNoLength)
+	daemon.queryLog.Record(clientIP, name, qType, decision)
+}
+
+// logRedactedQuery records the query made by the client in the query log without revealing the queried name.
+func (daemon *Daemon) logRedactedQuery(clientIP string, queryNoLength []byte, decision string) {
+	if daemon.queryLog == nil {
+		return
+	}
+	_, qType, _, _ := parseQuestion(queryNoLength)
+	daemon.queryLog.Record(clientIP, QueryLogRedactedName, qType, decision)
+}
+
+/*
+GetQueryLog returns the recorded queries made by the client IP (or all clients if it is empty) in lines of text, the
+most recent query comes first.
+*/
+func (daemon *Daemon) GetQueryLog(clientIP string) (string, error) {
+	if daemon.queryLog == nil {
+		return "", errors.New("DNS query log is not enabled")
+	}
+	var out bytes.Buffer
+	for _, entry := range daemon.queryLog.Get(clientIP) {
+		out.WriteString(entry.String())
+		out.WriteRune('\n')
+	}
+	return out.String(), nil
+}
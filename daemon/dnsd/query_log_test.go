@@ -0,0 +1,49 @@
+package dnsd
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestQueryLog(t *testing.T) {
+	var nilLog *QueryLog
+	nilLog.Record("1.1.1.1", "example.com", typeA, QueryDecisionForwarded)
+	if entries := nilLog.Get(""); len(entries) != 0 {
+		t.Fatal(entries)
+	}
+
+	queryLog := NewQueryLog(3)
+	if entries := queryLog.Get(""); len(entries) != 0 {
+		t.Fatal(entries)
+	}
+	queryLog.Record("1.1.1.1", "a.example.com", typeA, QueryDecisionForwarded)
+	queryLog.Record("2.2.2.2", "b.example.com", typeAAAA, QueryDecisionBlacklisted)
+	getNames := func(clientIP string) (names []string) {
+		for _, entry := range queryLog.Get(clientIP) {
+			names = append(names, entry.Name)
+		}
+		return
+	}
+	if names := getNames(""); !reflect.DeepEqual(names, []string{"b.example.com", "a.example.com"}) {
+		t.Fatal(names)
+	}
+	// The oldest entries are overwritten
+	queryLog.Record("1.1.1.1", "c.example.com", typeTXT, QueryDecisionToolbox)
+	queryLog.Record("1.1.1.1", "d.example.com", 65, QueryDecisionCustom)
+	if names := getNames(""); !reflect.DeepEqual(names, []string{"d.example.com", "c.example.com", "b.example.com"}) {
+		t.Fatal(names)
+	}
+	if names := getNames("1.1.1.1"); !reflect.DeepEqual(names, []string{"d.example.com", "c.example.com"}) {
+		t.Fatal(names)
+	}
+	if names := getNames("3.3.3.3"); len(names) != 0 {
+		t.Fatal(names)
+	}
+	if line := queryLog.Get("")[0].String(); !strings.HasSuffix(line, " 1.1.1.1 TYPE65 d.example.com custom") {
+		t.Fatal(line)
+	}
+	if line := queryLog.Get("")[2].String(); !strings.HasSuffix(line, " 2.2.2.2 AAAA b.example.com blacklisted") {
+		t.Fatal(line)
+	}
+}
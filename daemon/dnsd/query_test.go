@@ -51,6 +51,13 @@ func TestExtractDomainName(t *testing.T) {
 	if name := ExtractDomainName(githubComTCPQuery[2:]); name != "github.coM" {
 		t.Fatal(name)
 	}
+	// AAAA query
+	aaaaQuery := make([]byte, len(githubComUDPQuery))
+	copy(aaaaQuery, githubComUDPQuery)
+	aaaaQuery[25] = 28
+	if name := ExtractDomainName(aaaaQuery); name != "github.coM" {
+		t.Fatal(name)
+	}
 }
 
 func TestGetBlackHoleResponse(t *testing.T) {
@@ -67,6 +74,17 @@ func TestGetBlackHoleResponse(t *testing.T) {
 	if packet := GetBlackHoleResponse(githubComUDPQuery); !reflect.DeepEqual(packet, match) {
 		t.Fatal(hex.EncodeToString(packet))
 	}
+	// AAAA query is answered with ::
+	aaaaQuery := make([]byte, len(githubComUDPQuery))
+	copy(aaaaQuery, githubComUDPQuery)
+	aaaaQuery[25] = 28
+	match, err = hex.DecodeString("e575818000010001000000010667697468756203636f4d00001c00010000291000000000000000c00c001c0001000005ba001000000000000000000000000000000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet := GetBlackHoleResponse(aaaaQuery); !reflect.DeepEqual(packet, match) {
+		t.Fatal(hex.EncodeToString(packet))
+	}
 }
 
 func TestDecodeDTMFCommandInput(t *testing.T) {
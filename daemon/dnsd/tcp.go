@@ -1,7 +1,10 @@
 package dnsd
 
 import (
-	"math/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"time"
 
@@ -13,15 +16,25 @@ import (
 
 // GetTCPStatsCollector returns stats collector for the TCP server of this daemon.
 func (daemon *Daemon) GetTCPStatsCollector() *misc.Stats {
-	return misc.DNSDStatsTCP
+	return statsTCP
 }
 
-// HandleConnection converses with a TCP DNS client.
+// HandleTCPConnection converses with a TCP DNS client.
 func (daemon *Daemon) HandleTCPConnection(logger lalog.Logger, ip string, conn *net.TCPConn) {
+	daemon.handleStreamQuery(logger, ip, conn)
+}
+
+// HandleTLSConnection converses with a DNS-over-TLS client, the queries are framed in the same way as they are over TCP.
+func (daemon *Daemon) HandleTLSConnection(logger lalog.Logger, ip string, conn *tls.Conn) {
+	daemon.handleStreamQuery(logger, ip, conn)
+}
+
+// handleStreamQuery reads a length-prefixed query from a TCP or TLS client, and answers it with a length-prefixed response.
+func (daemon *Daemon) handleStreamQuery(logger lalog.Logger, ip string, conn net.Conn) {
 	// Read query length
 	logger.MaybeMinorError(conn.SetDeadline(time.Now().Add(ClientTimeoutSec * time.Second)))
 	queryLen := make([]byte, 2)
-	_, err := conn.Read(queryLen)
+	_, err := io.ReadFull(conn, queryLen)
 	if err != nil {
 		logger.Warning("handleTCPQuery", ip, err, "failed to read query length from client")
 		return
@@ -33,7 +46,7 @@ func (daemon *Daemon) HandleTCPConnection(logger lalog.Logger, ip string, conn *
 		return
 	}
 	queryBody := make([]byte, queryLenInteger)
-	_, err = conn.Read(queryBody)
+	_, err = io.ReadFull(conn, queryBody)
 	if err != nil {
 		logger.Warning("handleTCPQuery", ip, err, "failed to read query from client")
 		return
@@ -42,10 +55,10 @@ func (daemon *Daemon) HandleTCPConnection(logger lalog.Logger, ip string, conn *
 	var respBody, respLen []byte
 	if isTextQuery(queryBody) {
 		// Handle toolbox command that arrives as a text query
-		respLen, respBody = daemon.handleTCPTextQuery(ip, queryLen, queryBody)
+		respLen, respBody = daemon.handleTCPTextQuery(logger, ip, queryLen, queryBody)
 	} else {
 		// Handle other query types such as name query
-		respLen, respBody = daemon.handleTCPNameOrOtherQuery(ip, queryLen, queryBody)
+		respLen, respBody = daemon.handleTCPNameOrOtherQuery(logger, ip, queryLen, queryBody)
 	}
 	// Close client connection in case there is no appropriate response
 	if respBody == nil || len(respBody) < 2 {
@@ -63,22 +76,27 @@ func (daemon *Daemon) HandleTCPConnection(logger lalog.Logger, ip string, conn *
 	}
 }
 
-func (daemon *Daemon) handleTCPTextQuery(clientIP string, queryLen, queryBody []byte) (respLen, respBody []byte) {
+func (daemon *Daemon) handleTCPTextQuery(logger lalog.Logger, clientIP string, queryLen, queryBody []byte) (respLen, respBody []byte) {
+	if respBody = daemon.answerCustomRecord(logger, clientIP, queryBody); respBody != nil {
+		return []byte{byte(len(respBody) / 256), byte(len(respBody) % 256)}, respBody
+	}
 	queriedName := ExtractTextQueryInput(queryBody)
 	if daemon.processQueryTestCaseFunc != nil {
 		daemon.processQueryTestCaseFunc(queriedName)
 	}
 	if dtmfDecoded := DecodeDTMFCommandInput(queriedName); len(dtmfDecoded) > 1 {
-		cmdResult := daemon.latestCommands.Execute(daemon.Processor, clientIP, dtmfDecoded)
+		cmdResult := daemon.latestCommands.Execute(daemon.Processor, clientIP, logger.TraceID(), dtmfDecoded)
 		if cmdResult.Error == toolbox.ErrPINAndShortcutNotFound {
 			/*
 				Because the prefix may appear in an ordinary text record query that is not a toolbox command, when there is
 				a PIN mismatch, forward to recursive resolver as if the query is indeed not a toolbox command.
 			*/
-			daemon.logger.Info("handleTCPTextQuery", clientIP, nil, "input has command prefix but failed PIN check, forward to recursive resolver.")
+			logger.Info("handleTCPTextQuery", clientIP, nil, "input has command prefix but failed PIN check, forward to recursive resolver.")
+			daemon.logRedactedQuery(clientIP, queryBody, QueryDecisionForwarded)
 			goto forwardToRecursiveResolver
 		} else {
-			daemon.logger.Info("handleTCPTextQuery", clientIP, nil, "processed a toolbox command")
+			logger.Info("handleTCPTextQuery", clientIP, nil, "processed a toolbox command")
+			daemon.logRedactedQuery(clientIP, queryBody, QueryDecisionToolbox)
 
 			respBody = MakeTextResponse(queryBody, cmdResult.CombinedOutput)
 			respLenInt := len(respBody)
@@ -86,37 +104,51 @@ func (daemon *Daemon) handleTCPTextQuery(clientIP string, queryLen, queryBody []
 			return
 		}
 	} else {
-		daemon.logger.Info("handleTCPTextQuery", clientIP, nil, "handle query \"%s\"", string(queriedName))
+		logger.Info("handleTCPTextQuery", clientIP, nil, "handle query \"%s\"", string(queriedName))
+		daemon.logQuery(clientIP, queryBody, QueryDecisionForwarded)
 	}
 forwardToRecursiveResolver:
 	// There's a chance of being a typo in the PIN entry, make sure this function does not log the request input.
-	return daemon.handleTCPRecursiveQuery(clientIP, queryLen, queryBody)
+	return daemon.handleTCPRecursiveQuery(logger, clientIP, queryLen, queryBody)
 }
 
-func (daemon *Daemon) handleTCPNameOrOtherQuery(clientIP string, queryLen, queryBody []byte) (respLen, respBody []byte) {
+func (daemon *Daemon) handleTCPNameOrOtherQuery(logger lalog.Logger, clientIP string, queryLen, queryBody []byte) (respLen, respBody []byte) {
+	if respBody = daemon.answerCustomRecord(logger, clientIP, queryBody); respBody != nil {
+		return []byte{byte(len(respBody) / 256), byte(len(respBody) % 256)}, respBody
+	}
+	// Handle toolbox command that arrives as an A query
+	if respBody, isCommand := daemon.answerNameCommand(logger, clientIP, queryBody); isCommand {
+		if respBody != nil {
+			return []byte{byte(len(respBody) / 256), byte(len(respBody) % 256)}, respBody
+		}
+		// There's a chance of being a typo in the PIN entry, make sure the queried name is not logged.
+		return daemon.handleTCPRecursiveQuery(logger, clientIP, queryLen, queryBody)
+	}
 	respLen = make([]byte, 0)
 	respBody = make([]byte, 0)
 	if !daemon.checkAllowClientIP(clientIP) {
-		daemon.logger.Warning("handleTCPNameOrOtherQuery", clientIP, nil, "client IP is not allowed to query")
+		logger.Warning("handleTCPNameOrOtherQuery", clientIP, nil, "client IP is not allowed to query")
 		return
 	}
 	domainName := ExtractDomainName(queryBody)
 	if domainName == "" {
-		daemon.logger.Info("handleTCPNameOrOtherQuery", clientIP, nil, "handle non-name query")
+		logger.Info("handleTCPNameOrOtherQuery", clientIP, nil, "handle non-name query")
 	} else {
 		if daemon.processQueryTestCaseFunc != nil {
 			daemon.processQueryTestCaseFunc(domainName)
 		}
-		daemon.logger.Info("handleTCPNameOrOtherQuery", clientIP, nil, "handle query \"%s\"", domainName)
+		logger.Info("handleTCPNameOrOtherQuery", clientIP, nil, "handle query \"%s\"", domainName)
 	}
 	if daemon.IsInBlacklist(domainName) {
-		// Black hole response returns a
-		daemon.logger.Info("handleTCPNameOrOtherQuery", clientIP, nil, "handle black-listed \"%s\"", domainName)
-		respBody = GetBlackHoleResponse(queryBody)
+		// Answer the black-listed domain name according to the blocking mode
+		logger.Info("handleTCPNameOrOtherQuery", clientIP, nil, "handle black-listed \"%s\"", domainName)
+		daemon.logQuery(clientIP, queryBody, QueryDecisionBlacklisted)
+		respBody = daemon.getBlackListResponse(queryBody)
 		respLenInt := len(respBody)
 		respLen = []byte{byte(respLenInt / 256), byte(respLenInt % 256)}
 	} else {
-		respLen, respBody = daemon.handleTCPRecursiveQuery(clientIP, queryLen, queryBody)
+		daemon.logQuery(clientIP, queryBody, QueryDecisionForwarded)
+		respLen, respBody = daemon.handleTCPRecursiveQuery(logger, clientIP, queryLen, queryBody)
 	}
 	return
 }
@@ -126,47 +158,87 @@ handleTCPRecursiveQuery forward the input query to a randomly chosen recursive r
 Be aware that toolbox command processor may invoke this function with an incorrect PIN entry similar to the real PIN,
 therefore this function must not log the input packet content in any way.
 */
-func (daemon *Daemon) handleTCPRecursiveQuery(clientIP string, queryLen, queryBody []byte) (respLen, respBody []byte) {
+func (daemon *Daemon) handleTCPRecursiveQuery(logger lalog.Logger, clientIP string, queryLen, queryBody []byte) (respLen, respBody []byte) {
 	respLen = make([]byte, 0)
 	respBody = make([]byte, 0)
 	if !daemon.checkAllowClientIP(clientIP) {
-		daemon.logger.Warning("handleTCPRecursiveQuery", clientIP, nil, "client IP is not allowed to query")
+		logger.Warning("handleTCPRecursiveQuery", clientIP, nil, "client IP is not allowed to query")
 		return
 	}
-	randForwarder := daemon.Forwarders[rand.Intn(len(daemon.Forwarders))]
-	// Forward the query to a randomly chosen recursive resolver
-	myForwarder, err := net.DialTimeout("tcp", randForwarder, ForwarderTimeoutSec*time.Second)
+	if respBody = daemon.answerForClient(queryBody, daemon.cache.Get(queryBody, MaxPacketSize)); respBody != nil {
+		return []byte{byte(len(respBody) / 256), byte(len(respBody) % 256)}, respBody
+	}
+	// Names under the domain of a conditional forwarder are only resolved by that forwarder, without DNSSEC validation.
+	name, _, _, _ := parseQuestion(queryBody)
+	conditionalForwarder := daemon.getConditionalForwarder(name)
+	// Ask the forwarder for DNSSEC records only if DNSSEC validation is enabled
+	forwardQuery := queryBody
+	if daemon.dnssecValidator != nil && conditionalForwarder == "" {
+		forwardQuery = PrepareQuery(queryBody)
+	}
+	// Forward the query to a healthy recursive resolver, and fail over to another one if the resolver does not respond.
+	var tried []string
+	for attempt := 0; attempt < ForwarderMaxAttempts; attempt++ {
+		forwarder := conditionalForwarder
+		if forwarder == "" {
+			forwarder = daemon.forwarderPool.Pick(tried...)
+		}
+		if forwarder == "" {
+			break
+		}
+		tried = append(tried, forwarder)
+		start := time.Now()
+		resp, err := exchangeWithForwarder(logger, "tcp", forwarder, forwardQuery)
+		if err != nil {
+			daemon.forwarderPool.ReportFailure(forwarder)
+			logger.Warning("handleTCPRecursiveQuery", clientIP, err, "failed to query forwarder %s", forwarder)
+			continue
+		}
+		daemon.forwarderPool.ReportSuccess(forwarder, time.Since(start))
+		respBody = resp
+		if conditionalForwarder == "" {
+			respBody = daemon.validateForwarderResponse(logger, clientIP, queryBody, resp)
+		}
+		daemon.cache.Put(queryBody, respBody)
+		respBody = daemon.answerForClient(queryBody, respBody)
+		return []byte{byte(len(respBody) / 256), byte(len(respBody) % 256)}, respBody
+	}
+	return
+}
+
+// forwardTCPQuery sends the query (without prefix length bytes) to the forwarder over TCP and returns its response.
+func forwardTCPQuery(logger lalog.Logger, forwarder string, queryBody []byte) ([]byte, error) {
+	myForwarder, err := net.DialTimeout("tcp", forwarder, ForwarderTimeoutSec*time.Second)
 	if err != nil {
-		daemon.logger.Warning("handleTCPRecursiveQuery", clientIP, err, "failed to connect to forwarder")
-		return
+		return nil, fmt.Errorf("failed to connect to forwarder - %v", err)
 	}
+	return exchangeStreamQuery(logger, myForwarder, queryBody)
+}
+
+/*
+exchangeStreamQuery sends the query (without prefix length bytes) over the connection to a forwarder using TCP framing,
+returns the response, and closes the connection.
+*/
+func exchangeStreamQuery(logger lalog.Logger, myForwarder net.Conn, queryBody []byte) ([]byte, error) {
 	defer func() {
-		daemon.logger.MaybeMinorError(myForwarder.Close())
+		logger.MaybeMinorError(myForwarder.Close())
 	}()
-	// Send original query to the resolver without modification
-	daemon.logger.MaybeMinorError(myForwarder.SetDeadline(time.Now().Add(ForwarderTimeoutSec * time.Second)))
-	if _, err = myForwarder.Write(queryLen); err != nil {
-		daemon.logger.Warning("handleTCPRecursiveQuery", clientIP, err, "failed to write length to forwarder")
-		return
-	} else if _, err = myForwarder.Write(queryBody); err != nil {
-		daemon.logger.Warning("handleTCPRecursiveQuery", clientIP, err, "failed to write query to forwarder")
-		return
+	logger.MaybeMinorError(myForwarder.SetDeadline(time.Now().Add(ForwarderTimeoutSec * time.Second)))
+	if _, err := myForwarder.Write(append([]byte{byte(len(queryBody) / 256), byte(len(queryBody) % 256)}, queryBody...)); err != nil {
+		return nil, fmt.Errorf("failed to write query to forwarder - %v", err)
 	}
 	// Read resolver's response
-	respLen = make([]byte, 2)
-	if _, err = myForwarder.Read(respLen); err != nil {
-		daemon.logger.Warning("handleTCPRecursiveQuery", clientIP, err, "failed to read length from forwarder")
-		return
+	respLen := make([]byte, 2)
+	if _, err := io.ReadFull(myForwarder, respLen); err != nil {
+		return nil, fmt.Errorf("failed to read length from forwarder - %v", err)
 	}
 	respLenInt := int(respLen[0])*256 + int(respLen[1])
 	if respLenInt > MaxPacketSize || respLenInt < 1 {
-		daemon.logger.Warning("handleTCPRecursiveQuery", clientIP, nil, "bad response length from forwarder")
-		return
+		return nil, errors.New("bad response length from forwarder")
 	}
-	respBody = make([]byte, respLenInt)
-	if _, err = myForwarder.Read(respBody); err != nil {
-		daemon.logger.Warning("handleTCPRecursiveQuery", clientIP, err, "failed to read response from forwarder")
-		return
+	respBody := make([]byte, respLenInt)
+	if _, err := io.ReadFull(myForwarder, respBody); err != nil {
+		return nil, fmt.Errorf("failed to read response from forwarder - %v", err)
 	}
-	return
+	return respBody, nil
 }
@@ -1,7 +1,8 @@
 package dnsd
 
 import (
-	"math/rand"
+	"errors"
+	"fmt"
 	"net"
 	"time"
 
@@ -13,7 +14,7 @@ import (
 
 // GetUDPStatsCollector returns stats collector for the UDP server of this daemon.
 func (daemon *Daemon) GetUDPStatsCollector() *misc.Stats {
-	return misc.DNSDStatsUDP
+	return statsUDP
 }
 
 // Read a feature command from each input line, then invoke the requested feature and write the execution result back to client.
@@ -26,10 +27,10 @@ func (daemon *Daemon) HandleUDPClient(logger lalog.Logger, ip string, client *ne
 	var respBody []byte
 	if isTextQuery(packet) {
 		// Handle toolbox command that arrives as a text query
-		respLenInt, respBody = daemon.handleUDPTextQuery(ip, packet)
+		respLenInt, respBody = daemon.handleUDPTextQuery(logger, ip, packet)
 	} else {
 		// Handle other query types such as name query
-		respLenInt, respBody = daemon.handleUDPNameOrOtherQuery(ip, packet)
+		respLenInt, respBody = daemon.handleUDPNameOrOtherQuery(logger, ip, packet)
 	}
 	// Ignore the request if there is no appropriate response
 	if respBody == nil || len(respBody) < 3 {
@@ -38,60 +39,81 @@ func (daemon *Daemon) HandleUDPClient(logger lalog.Logger, ip string, client *ne
 	// Send response to the client, match transaction ID of original query.
 	respBody[0] = packet[0]
 	respBody[1] = packet[1]
+	// Let the client retry over TCP if the response does not fit in its UDP payload size
+	respBody = TruncateResponse(respBody[:respLenInt], GetUDPPayloadSize(packet))
 	// Set deadline for responding to my DNS client because the query reader and response writer do not share the same timeout
 	logger.MaybeMinorError(srv.SetWriteDeadline(time.Now().Add(ClientTimeoutSec * time.Second)))
-	if _, err := srv.WriteTo(respBody[:respLenInt], client); err != nil {
+	if _, err := srv.WriteTo(respBody, client); err != nil {
 		logger.Warning("HandleUDPQuery", ip, err, "failed to answer to client")
 		return
 	}
 }
 
-func (daemon *Daemon) handleUDPTextQuery(clientIP string, queryBody []byte) (respLenInt int, respBody []byte) {
+func (daemon *Daemon) handleUDPTextQuery(logger lalog.Logger, clientIP string, queryBody []byte) (respLenInt int, respBody []byte) {
+	if respBody = daemon.answerCustomRecord(logger, clientIP, queryBody); respBody != nil {
+		return len(respBody), respBody
+	}
 	queriedName := ExtractTextQueryInput(queryBody)
 	if daemon.processQueryTestCaseFunc != nil {
 		daemon.processQueryTestCaseFunc(queriedName)
 	}
 	if dtmfDecoded := DecodeDTMFCommandInput(queriedName); len(dtmfDecoded) > 1 {
-		cmdResult := daemon.latestCommands.Execute(daemon.Processor, clientIP, dtmfDecoded)
+		cmdResult := daemon.latestCommands.Execute(daemon.Processor, clientIP, logger.TraceID(), dtmfDecoded)
 		if cmdResult.Error == toolbox.ErrPINAndShortcutNotFound {
 			/*
 				Because the prefix may appear in an ordinary text record query that is not a toolbox command, when there is
 				a PIN mismatch, forward to recursive resolver as if the query is indeed not a toolbox command.
 			*/
-			daemon.logger.Info("handleUDPTextQuery", clientIP, nil, "input has command prefix but failed PIN check")
+			logger.Info("handleUDPTextQuery", clientIP, nil, "input has command prefix but failed PIN check")
+			daemon.logRedactedQuery(clientIP, queryBody, QueryDecisionForwarded)
 			goto forwardToRecursiveResolver
 		} else {
-			daemon.logger.Info("handleUDPTextQuery", clientIP, nil, "processed a toolbox command")
+			logger.Info("handleUDPTextQuery", clientIP, nil, "processed a toolbox command")
+			daemon.logRedactedQuery(clientIP, queryBody, QueryDecisionToolbox)
 			respBody = MakeTextResponse(queryBody, cmdResult.CombinedOutput)
 			return len(respBody), respBody
 		}
 	} else {
-		daemon.logger.Info("handleUDPTextQuery", clientIP, nil, "handle query \"%s\"", string(queriedName))
+		logger.Info("handleUDPTextQuery", clientIP, nil, "handle query \"%s\"", string(queriedName))
+		daemon.logQuery(clientIP, queryBody, QueryDecisionForwarded)
 	}
 forwardToRecursiveResolver:
 	// There's a chance of being a typo in the PIN entry, make sure this function does not log the request input.
-	return daemon.handleUDPRecursiveQuery(clientIP, queryBody)
+	return daemon.handleUDPRecursiveQuery(logger, clientIP, queryBody)
 }
 
-func (daemon *Daemon) handleUDPNameOrOtherQuery(clientIP string, queryBody []byte) (respLenInt int, respBody []byte) {
+func (daemon *Daemon) handleUDPNameOrOtherQuery(logger lalog.Logger, clientIP string, queryBody []byte) (respLenInt int, respBody []byte) {
+	if respBody = daemon.answerCustomRecord(logger, clientIP, queryBody); respBody != nil {
+		return len(respBody), respBody
+	}
+	// Handle toolbox command that arrives as an A query
+	if respBody, isCommand := daemon.answerNameCommand(logger, clientIP, queryBody); isCommand {
+		if respBody != nil {
+			return len(respBody), respBody
+		}
+		// There's a chance of being a typo in the PIN entry, make sure the queried name is not logged.
+		return daemon.handleUDPRecursiveQuery(logger, clientIP, queryBody)
+	}
 	// Handle other query types such as name query
 	domainName := ExtractDomainName(queryBody)
 	if domainName == "" {
-		daemon.logger.Info("handleUDPNameOrOtherQuery", clientIP, nil, "handle non-name query")
+		logger.Info("handleUDPNameOrOtherQuery", clientIP, nil, "handle non-name query")
 	} else {
 		if daemon.processQueryTestCaseFunc != nil {
 			daemon.processQueryTestCaseFunc(domainName)
 		}
-		daemon.logger.Info("handleUDPNameOrOtherQuery", clientIP, nil, "handle query \"%s\"", domainName)
+		logger.Info("handleUDPNameOrOtherQuery", clientIP, nil, "handle query \"%s\"", domainName)
 	}
 	if daemon.IsInBlacklist(domainName) {
-		// Formulate a black-hole response to black-listed domain name
-		daemon.logger.Info("handleUDPNameOrOtherQuery", clientIP, nil, "handle black-listed \"%s\"", domainName)
-		respBody = GetBlackHoleResponse(queryBody)
+		// Answer the black-listed domain name according to the blocking mode
+		logger.Info("handleUDPNameOrOtherQuery", clientIP, nil, "handle black-listed \"%s\"", domainName)
+		daemon.logQuery(clientIP, queryBody, QueryDecisionBlacklisted)
+		respBody = daemon.getBlackListResponse(queryBody)
 		respLenInt = len(respBody)
 		return
 	}
-	return daemon.handleUDPRecursiveQuery(clientIP, queryBody)
+	daemon.logQuery(clientIP, queryBody, QueryDecisionForwarded)
+	return daemon.handleUDPRecursiveQuery(logger, clientIP, queryBody)
 }
 
 /*
@@ -99,33 +121,74 @@ handleUDPRecursiveQuery forward the input query to a randomly chosen recursive r
 Be aware that toolbox command processor may invoke this function with an incorrect PIN entry similar to the real PIN,
 therefore this function must not log the input packet content in any way.
 */
-func (daemon *Daemon) handleUDPRecursiveQuery(clientIP string, queryBody []byte) (respLenInt int, respBody []byte) {
+func (daemon *Daemon) handleUDPRecursiveQuery(logger lalog.Logger, clientIP string, queryBody []byte) (respLenInt int, respBody []byte) {
 	respBody = make([]byte, 0)
 	if !daemon.checkAllowClientIP(clientIP) {
-		daemon.logger.Warning("handleUDPRecursiveQuery", clientIP, nil, "client IP is not allowed to query")
+		logger.Warning("handleUDPRecursiveQuery", clientIP, nil, "client IP is not allowed to query")
 		return
 	}
-	// Forward the query to a randomly chosen recursive resolver and return its response
-	randForwarder := daemon.Forwarders[rand.Intn(len(daemon.Forwarders))]
-	forwarderConn, err := net.DialTimeout("udp", randForwarder, ForwarderTimeoutSec*time.Second)
+	// Answer from cache if possible, as long as the response fits in the client's UDP payload size.
+	if respBody = daemon.answerForClient(queryBody, daemon.cache.Get(queryBody, MaxPacketSize)); respBody != nil && len(respBody) <= GetUDPPayloadSize(queryBody) {
+		return len(respBody), respBody
+	}
+	// Names under the domain of a conditional forwarder are only resolved by that forwarder, without DNSSEC validation.
+	name, _, _, _ := parseQuestion(queryBody)
+	conditionalForwarder := daemon.getConditionalForwarder(name)
+	// Ask the forwarder for DNSSEC records only if DNSSEC validation is enabled
+	forwardQuery := queryBody
+	if daemon.dnssecValidator != nil && conditionalForwarder == "" {
+		forwardQuery = PrepareQuery(queryBody)
+	}
+	// Forward the query to a healthy recursive resolver, and fail over to another one if the resolver does not respond.
+	var tried []string
+	for attempt := 0; attempt < ForwarderMaxAttempts; attempt++ {
+		forwarder := conditionalForwarder
+		if forwarder == "" {
+			forwarder = daemon.forwarderPool.Pick(tried...)
+		}
+		if forwarder == "" {
+			break
+		}
+		tried = append(tried, forwarder)
+		start := time.Now()
+		resp, err := exchangeWithForwarder(logger, "udp", forwarder, forwardQuery)
+		if err != nil {
+			daemon.forwarderPool.ReportFailure(forwarder)
+			logger.Warning("handleUDPRecursiveQuery", clientIP, err, "failed to query forwarder %s", forwarder)
+			continue
+		}
+		daemon.forwarderPool.ReportSuccess(forwarder, time.Since(start))
+		respBody = resp
+		if conditionalForwarder == "" {
+			respBody = daemon.validateForwarderResponse(logger, clientIP, queryBody, resp)
+		}
+		daemon.cache.Put(queryBody, respBody)
+		respBody = daemon.answerForClient(queryBody, respBody)
+		return len(respBody), respBody
+	}
+	return 0, make([]byte, 0)
+}
+
+// forwardUDPQuery sends the query to the forwarder over UDP and returns its response.
+func forwardUDPQuery(logger lalog.Logger, forwarder string, queryBody []byte) ([]byte, error) {
+	forwarderConn, err := net.DialTimeout("udp", forwarder, ForwarderTimeoutSec*time.Second)
 	if err != nil {
-		daemon.logger.Warning("handleUDPRecursiveQuery", clientIP, err, "failed to dial forwarder's address")
-		return
+		return nil, fmt.Errorf("failed to dial forwarder's address - %v", err)
 	}
-	daemon.logger.MaybeMinorError(forwarderConn.SetDeadline(time.Now().Add(ForwarderTimeoutSec * time.Second)))
+	defer func() {
+		logger.MaybeMinorError(forwarderConn.Close())
+	}()
+	logger.MaybeMinorError(forwarderConn.SetDeadline(time.Now().Add(ForwarderTimeoutSec * time.Second)))
 	if _, err := forwarderConn.Write(queryBody); err != nil {
-		daemon.logger.Warning("handleUDPRecursiveQuery", clientIP, err, "failed to write to forwarder")
-		return
+		return nil, fmt.Errorf("failed to write to forwarder - %v", err)
 	}
-	respBody = make([]byte, MaxPacketSize)
-	respLenInt, err = forwarderConn.Read(respBody)
+	respBody := make([]byte, MaxPacketSize)
+	respLenInt, err := forwarderConn.Read(respBody)
 	if err != nil {
-		daemon.logger.Warning("handleUDPRecursiveQuery", clientIP, err, "failed to read from forwarder")
-		return
+		return nil, fmt.Errorf("failed to read from forwarder - %v", err)
 	}
 	if respLenInt < 3 {
-		daemon.logger.Warning("handleUDPRecursiveQuery", clientIP, err, "forwarder response is abnormally small")
-		return
+		return nil, errors.New("forwarder response is abnormally small")
 	}
-	return
+	return respBody[:respLenInt], nil
 }
@@ -0,0 +1,112 @@
+package dnsd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+const (
+	ForwarderSchemeTLS   = "tls://"   // ForwarderSchemeTLS prefixes the address of a DNS-over-TLS forwarder, e.g. "tls://1.1.1.1:853".
+	ForwarderSchemeHTTPS = "https://" // ForwarderSchemeHTTPS prefixes the URL of a DNS-over-HTTPS forwarder, e.g. "https://dns.quad9.net/dns-query".
+	DefaultDoTPort       = "853"      // DefaultDoTPort is the port of DNS-over-TLS forwarder used if the address does not come with a port.
+)
+
+/*
+checkForwarderAddress returns an error if the forwarder address is not one of "host:port", "tls://host[:port]", or
+"https://host/path".
+*/
+func checkForwarderAddress(forwarder string) error {
+	switch {
+	case strings.HasPrefix(forwarder, ForwarderSchemeTLS):
+		if host, _ := splitDoTAddress(forwarder); host == "" {
+			return fmt.Errorf("DNS-over-TLS forwarder \"%s\" does not have a host name", forwarder)
+		}
+	case strings.HasPrefix(forwarder, ForwarderSchemeHTTPS):
+		if u, err := url.Parse(forwarder); err != nil || u.Host == "" {
+			return fmt.Errorf("DNS-over-HTTPS forwarder \"%s\" is not a valid URL", forwarder)
+		}
+	case strings.Contains(forwarder, "://"):
+		return fmt.Errorf("forwarder \"%s\" uses an unsupported scheme", forwarder)
+	default:
+		if _, _, err := net.SplitHostPort(forwarder); err != nil {
+			return fmt.Errorf("forwarder \"%s\" must be in the form of host:port - %v", forwarder, err)
+		}
+	}
+	return nil
+}
+
+// splitDoTAddress returns the host name and "host:port" address of a DNS-over-TLS forwarder.
+func splitDoTAddress(forwarder string) (host, address string) {
+	address = strings.TrimSuffix(strings.TrimPrefix(forwarder, ForwarderSchemeTLS), "/")
+	var err error
+	if host, _, err = net.SplitHostPort(address); err != nil {
+		host = strings.TrimSuffix(strings.TrimPrefix(address, "["), "]")
+		address = net.JoinHostPort(host, DefaultDoTPort)
+	}
+	return
+}
+
+/*
+exchangeWithForwarder sends the query (without prefix length bytes) to the forwarder and returns its response. Queries
+to DNS-over-TLS and DNS-over-HTTPS forwarders are encrypted, regardless of the network (tcp or udp) the client query
+came from; queries to a plain forwarder use the same network as the client query.
+*/
+func exchangeWithForwarder(logger lalog.Logger, network, forwarder string, queryBody []byte) ([]byte, error) {
+	switch {
+	case strings.HasPrefix(forwarder, ForwarderSchemeTLS):
+		return forwardTLSQuery(logger, forwarder, queryBody)
+	case strings.HasPrefix(forwarder, ForwarderSchemeHTTPS):
+		return forwardDoHQuery(forwarder, queryBody)
+	case network == "udp":
+		return forwardUDPQuery(logger, forwarder, queryBody)
+	default:
+		return forwardTCPQuery(logger, forwarder, queryBody)
+	}
+}
+
+// forwardTLSQuery sends the query (without prefix length bytes) to the forwarder over TLS (RFC 7858) and returns its response.
+func forwardTLSQuery(logger lalog.Logger, forwarder string, queryBody []byte) ([]byte, error) {
+	host, address := splitDoTAddress(forwarder)
+	tlsConfig := &tls.Config{}
+	if inet.DefaultTLSTrust != nil {
+		tlsConfig = inet.DefaultTLSTrust.GetTLSConfig(host)
+	}
+	tlsConfig.ServerName = host
+	myForwarder, err := tls.DialWithDialer(&net.Dialer{Timeout: ForwarderTimeoutSec * time.Second}, "tcp", address, tlsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to forwarder - %v", err)
+	}
+	return exchangeStreamQuery(logger, myForwarder, queryBody)
+}
+
+// forwardDoHQuery sends the query (without prefix length bytes) to the forwarder over HTTPS (RFC 8484) and returns its response.
+func forwardDoHQuery(forwarder string, queryBody []byte) ([]byte, error) {
+	resp, err := inet.DoHTTP(inet.HTTPRequest{
+		TimeoutSec:  ForwarderTimeoutSec,
+		Method:      http.MethodPost,
+		Header:      http.Header{"Accept": []string{DoHContentType}},
+		ContentType: DoHContentType,
+		Body:        bytes.NewReader(queryBody),
+		MaxBytes:    MaxPacketSize,
+		// The forwarder pool fails over to another forwarder instead
+		MaxRetry: 1,
+	}, strings.Replace(forwarder, "%", "%%", -1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query forwarder - %v", err)
+	} else if err := resp.Non2xxToError(); err != nil {
+		return nil, err
+	} else if len(resp.Body) < 12 {
+		return nil, errors.New("forwarder response is abnormally small")
+	}
+	return resp.Body, nil
+}
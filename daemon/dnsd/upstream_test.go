@@ -0,0 +1,108 @@
+package dnsd
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+func TestCheckForwarderAddress(t *testing.T) {
+	for _, good := range []string{"9.9.9.9:53", "[2620:fe::fe]:53", "tls://1.1.1.1", "tls://dns.quad9.net:853", "https://dns.quad9.net/dns-query"} {
+		if err := checkForwarderAddress(good); err != nil {
+			t.Fatal(good, err)
+		}
+	}
+	for _, bad := range []string{"9.9.9.9", "tls://", "https://", "quic://dns.adguard.com"} {
+		if err := checkForwarderAddress(bad); err == nil {
+			t.Fatal("did not error", bad)
+		}
+	}
+	if host, address := splitDoTAddress("tls://1.1.1.1"); host != "1.1.1.1" || address != "1.1.1.1:853" {
+		t.Fatal(host, address)
+	}
+	if host, address := splitDoTAddress("tls://[2606:4700:4700::1111]:8853"); host != "2606:4700:4700::1111" || address != "[2606:4700:4700::1111]:8853" {
+		t.Fatal(host, address)
+	}
+}
+
+func TestEncryptedForwarders(t *testing.T) {
+	// The DNS-over-HTTPS forwarder answers every query with an empty response
+	dohServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query, err := ioutil.ReadAll(r.Body)
+		if err != nil || r.Header.Get("Content-Type") != DoHContentType {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", DoHContentType)
+		_, _ = w.Write(GetErrorResponse(query, 0))
+	}))
+	defer dohServer.Close()
+	// The DNS-over-TLS forwarder uses the same certificate
+	dotListener, err := tls.Listen("tcp", "127.0.0.1:0", dohServer.TLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dotListener.Close()
+	go func() {
+		for {
+			conn, err := dotListener.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				queryLen := make([]byte, 2)
+				if _, err := io.ReadFull(conn, queryLen); err != nil {
+					return
+				}
+				query := make([]byte, int(queryLen[0])*256+int(queryLen[1]))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				resp := GetErrorResponse(query, 0)
+				_, _ = conn.Write(append([]byte{byte(len(resp) / 256), byte(len(resp) % 256)}, resp...))
+			}(conn)
+		}
+	}()
+	// Trust and pin the self-signed certificate of test servers
+	bundle, err := ioutil.TempFile("", "laitos-TestEncryptedForwarders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(bundle.Name())
+	if err := pem.Encode(bundle, &pem.Block{Type: "CERTIFICATE", Bytes: dohServer.Certificate().Raw}); err != nil {
+		t.Fatal(err)
+	}
+	_ = bundle.Close()
+	digest := sha256.Sum256(dohServer.Certificate().RawSubjectPublicKeyInfo)
+	inet.DefaultTLSTrust = &inet.TLSTrust{
+		CABundlePaths:    []string{bundle.Name()},
+		PinnedPublicKeys: map[string][]string{"127.0.0.1": {base64.StdEncoding.EncodeToString(digest[:])}},
+	}
+	defer func() {
+		inet.DefaultTLSTrust = nil
+	}()
+	if err := inet.DefaultTLSTrust.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, forwarder := range []string{"tls://" + dotListener.Addr().String(), dohServer.URL + DoHPath} {
+		for _, network := range []string{"tcp", "udp"} {
+			resp, err := exchangeWithForwarder(lalog.Logger{}, network, forwarder, githubComUDPQuery)
+			if err != nil || len(resp) < 12 || resp[0] != githubComUDPQuery[0] || resp[1] != githubComUDPQuery[1] || resp[3]&0x0f != 0 {
+				t.Fatal(forwarder, network, resp, err)
+			}
+		}
+	}
+}
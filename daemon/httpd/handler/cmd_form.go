@@ -51,11 +51,13 @@ func (form *HandleCommandForm) Handle(w http.ResponseWriter, r *http.Request) {
 		if cmd := r.FormValue("cmd"); cmd == "" {
 			_, _ = w.Write([]byte(fmt.Sprintf(HandleCommandFormPage, r.RequestURI, "")))
 		} else {
-			result := form.cmdProc.Process(toolbox.Command{
+			result := form.cmdProc.Process(r.Context(), toolbox.Command{
 				DaemonName: "httpd",
+				TraceID:    lalog.TraceIDFromContext(r.Context()),
 				ClientID:   GetRealClientIP(r),
 				Content:    cmd,
 				TimeoutSec: HTTPClienAppCommandTimeout,
+				Encrypted:  r.TLS != nil,
 			}, true)
 			_, _ = w.Write([]byte(fmt.Sprintf(HandleCommandFormPage, r.RequestURI, html.EscapeString(result.CombinedOutput))))
 		}
@@ -0,0 +1,40 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+/*
+HandleDNSQueryLog serves the most recent queries received by the DNS daemon in text, newest first. Specify parameter
+"client" to retrieve the queries made by a single client IP.
+*/
+type HandleDNSQueryLog struct {
+	logger lalog.Logger
+}
+
+func (queryLog *HandleDNSQueryLog) Initialise(logger lalog.Logger, _ *toolbox.CommandProcessor) error {
+	queryLog.logger = logger
+	return nil
+}
+
+func (queryLog *HandleDNSQueryLog) Handle(w http.ResponseWriter, r *http.Request) {
+	result := toolbox.GetDNSQueryLog(r.FormValue("client"))
+	if result.Error != nil {
+		http.Error(w, result.Error.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	NoCache(w)
+	_, _ = w.Write([]byte(result.Output))
+}
+
+func (_ *HandleDNSQueryLog) GetRateLimitFactor() int {
+	return 2
+}
+
+func (_ *HandleDNSQueryLog) SelfTest() error {
+	return nil
+}
@@ -14,6 +14,7 @@ import (
 	"time"
 
 	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
 	"github.com/HouzuoGuo/laitos/toolbox"
 )
 
@@ -80,7 +81,7 @@ func (upload *HandleFileUpload) periodicallyDeleteExpiredFiles() {
 		for _, fileInfo := range files {
 			if fileInfo.ModTime().Before(time.Now().Add(-(FileUploadExpireInSec * time.Second))) {
 				anyFileExpired = true
-				upload.logger.Info("periodicallyDeleteExpiredFiles", "", os.Remove(fileInfo.Name()), "delete expired file")
+				upload.logger.Info("periodicallyDeleteExpiredFiles", fileInfo.Name(), misc.SecureErase(filepath.Join(fileUploadStorage, fileInfo.Name())), "delete expired file")
 			}
 		}
 		if !anyFileExpired {
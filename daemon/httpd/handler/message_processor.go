@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/toolbox"
@@ -13,7 +14,7 @@ import (
 
 /*
 HandleReportsRetrieval works as a frontend to the store&forward message processor, allowing visitors to view historical reports and
-assign an app command for a subject to retireve in its next report.
+queue app commands for a subject to retrieve in its next reports.
 */
 type HandleReportsRetrieval struct {
 	cmdProc *toolbox.CommandProcessor
@@ -39,20 +40,26 @@ func (hand *HandleReportsRetrieval) Handle(w http.ResponseWriter, r *http.Reques
 	clearOutgoingCmd := r.FormValue("clear")
 	if toHost != "" {
 		w.Header().Set("Content-Type", "text/plain")
+		msgProc := &hand.cmdProc.Features.MessageProcessor
 		if clearOutgoingCmd == "" {
-			// Store a new outgoing command (?tohost=abc&cmd=xxxxx)
+			// Queue a new outgoing command (?tohost=abc&cmd=xxxxx)
 			if outgoingAppCmd != "" {
-				hand.cmdProc.Features.MessageProcessor.SetOutgoingCommand(toHost, outgoingAppCmd)
-				_, _ = w.Write([]byte(fmt.Sprintf("The next reply made in response to %s's report will carry an app command %d characters long.\r\n", toHost, len(outgoingAppCmd))))
+				queueLen := msgProc.QueueOutgoingCommand(toHost, outgoingAppCmd)
+				_, _ = w.Write([]byte(fmt.Sprintf("A reply made in response to %s's report will carry an app command %d characters long, there are %d commands in the queue.\r\n", toHost, len(outgoingAppCmd), queueLen)))
 			}
 		} else {
-			// Clear outgoing command for a host (?tohost=abc&clear=x)
-			hand.cmdProc.Features.MessageProcessor.SetOutgoingCommand(toHost, "")
-			_, _ = w.Write([]byte(fmt.Sprintf("Cleared outgoing command for host %s.\r\n", toHost)))
+			// Clear outgoing commands for a host (?tohost=abc&clear=x)
+			msgProc.SetOutgoingCommand(toHost, "")
+			_, _ = w.Write([]byte(fmt.Sprintf("Cleared outgoing commands for host %s.\r\n", toHost)))
 		}
 		_, _ = w.Write([]byte(fmt.Sprintf("All outgoing commands:\r\n")))
-		for host, cmd := range hand.cmdProc.Features.MessageProcessor.GetAllOutgoingCommands() {
-			_, _ = w.Write([]byte(fmt.Sprintf("%s: %v\r\n", host, cmd)))
+		for host := range msgProc.GetAllOutgoingCommands() {
+			_, _ = w.Write([]byte(fmt.Sprintf("%s: %v\r\n", host, msgProc.GetOutgoingCommandQueue(host))))
+		}
+		// The subject returns the result of each command in its subsequent report
+		_, _ = w.Write([]byte(fmt.Sprintf("Command results from %s:\r\n", toHost)))
+		for _, result := range msgProc.GetOutgoingCommandResults(toHost) {
+			_, _ = w.Write([]byte(fmt.Sprintf("%s (received at %s, ran for %d seconds): %s\r\n", result.Command, result.ReceivedAt.Format(time.RFC3339), result.RunDurationSec, result.Result)))
 		}
 		return
 	}
@@ -116,8 +123,9 @@ func (hand *HandleAppCommand) Handle(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
-	result := hand.cmdProc.Process(toolbox.Command{
+	result := hand.cmdProc.Process(r.Context(), toolbox.Command{
 		DaemonName: "httpd",
+		TraceID:    lalog.TraceIDFromContext(r.Context()),
 		ClientID:   GetRealClientIP(r),
 		Content:    cmd,
 		TimeoutSec: HTTPClienAppCommandTimeout,
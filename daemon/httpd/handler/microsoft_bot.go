@@ -2,6 +2,7 @@ package handler
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
@@ -192,8 +193,9 @@ func (hand *HandleMicrosoftBot) Handle(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Process feature command from incoming chat text
-		result := hand.cmdProc.Process(toolbox.Command{
+		result := hand.cmdProc.Process(context.Background(), toolbox.Command{
 			DaemonName: "httpd",
+			TraceID:    lalog.TraceIDFromContext(r.Context()),
 			ClientID:   convID,
 			TimeoutSec: MicrosoftBotCommandTimeoutSec,
 			Content:    incoming.Text,
@@ -0,0 +1,39 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+// HandlePrometheusMetrics serves the counters, gauges, and daemon stats in Prometheus text exposition format.
+type HandlePrometheusMetrics struct {
+	logger lalog.Logger
+}
+
+func (metrics *HandlePrometheusMetrics) Initialise(logger lalog.Logger, _ *toolbox.CommandProcessor) error {
+	metrics.logger = logger
+	return nil
+}
+
+func (metrics *HandlePrometheusMetrics) Handle(w http.ResponseWriter, r *http.Request) {
+	var result bytes.Buffer
+	if err := misc.WritePrometheusMetrics(&result); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	NoCache(w)
+	_, _ = w.Write(result.Bytes())
+}
+
+func (_ *HandlePrometheusMetrics) GetRateLimitFactor() int {
+	return 2
+}
+
+func (_ *HandlePrometheusMetrics) SelfTest() error {
+	return nil
+}
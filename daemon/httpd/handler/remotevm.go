@@ -44,8 +44,9 @@ const (
 <form action="%s" method="post">
 	<p>%s</p>
 	<p>
-		Info:
+		Info (since the previous page):
 		<textarea rows="3" cols="80">%s</textarea>
+		<input type="hidden" name="output_mark" value="%d"/>
 	</p>
 	<p>
 		Virtual machine:
@@ -126,13 +127,15 @@ func (handler *HandleVirtualMachine) Initialise(logger lalog.Logger, _ *toolbox.
 renderRemoteVMPage renders the HTML page that offers virtual machine control.
 Virtual machine screenshot sits in a <img> tag, though the image data is served by a differe, dedicated handler.
 */
-func (handler *HandleVirtualMachine) renderRemoteVMPage(requestURL string, err error, isoURL string, pointerX, pointerY int, pressKeys string) []byte {
+func (handler *HandleVirtualMachine) renderRemoteVMPage(requestURL string, err error, outputMark int64, isoURL string, pointerX, pointerY int, pressKeys string) []byte {
 	var errStr string
 	if err != nil {
 		errStr = err.Error()
 	}
+	// Only show the emulator output that came after the previous page, so that the latest progress stands out.
+	debugOutput, outputMark := handler.VM.GetDebugOutputSince(outputMark)
 	return []byte(fmt.Sprintf(HandleVirtualMachinePage,
-		requestURL, errStr, handler.VM.GetDebugOutput(),
+		requestURL, errStr, debugOutput, outputMark,
 		isoURL,
 		pointerX, pointerY,
 		pressKeys,
@@ -140,8 +143,9 @@ func (handler *HandleVirtualMachine) renderRemoteVMPage(requestURL string, err e
 }
 
 // parseSubmission reads form action (button) and form text fields input.
-func (handler *HandleVirtualMachine) parseSubmission(r *http.Request) (button, isoURL string, pointerX, pointerY int, pressKeys string) {
+func (handler *HandleVirtualMachine) parseSubmission(r *http.Request) (button string, outputMark int64, isoURL string, pointerX, pointerY int, pressKeys string) {
 	button = r.FormValue("action")
+	outputMark, _ = strconv.ParseInt(r.FormValue("output_mark"), 10, 64)
 	isoURL = r.FormValue("iso_url")
 	pointerX, _ = strconv.Atoi(r.FormValue("pointer_x"))
 	pointerY, _ = strconv.Atoi(r.FormValue("pointer_y"))
@@ -165,10 +169,10 @@ func (handler *HandleVirtualMachine) Handle(w http.ResponseWriter, r *http.Reque
 	NoCache(w)
 	if r.Method == http.MethodGet {
 		// Display the web page. Suggest user to download the default Linux distribution.
-		_, _ = w.Write(handler.renderRemoteVMPage(r.RequestURI, nil, DefaultLinuxDistributionURL, 0, 0, ""))
+		_, _ = w.Write(handler.renderRemoteVMPage(r.RequestURI, nil, 0, DefaultLinuxDistributionURL, 0, 0, ""))
 	} else if r.Method == http.MethodPost {
 		// Handle buttons
-		button, isoURL, pointerX, pointerY, pressKeys := handler.parseSubmission(r)
+		button, outputMark, isoURL, pointerX, pointerY, pressKeys := handler.parseSubmission(r)
 		var actionErr error
 		switch button {
 		case "Refresh Screen":
@@ -242,7 +246,7 @@ func (handler *HandleVirtualMachine) Handle(w http.ResponseWriter, r *http.Reque
 		default:
 			actionErr = fmt.Errorf("Unknown button action: %s", button)
 		}
-		_, _ = w.Write(handler.renderRemoteVMPage(r.RequestURI, actionErr, isoURL, pointerX, pointerY, pressKeys))
+		_, _ = w.Write(handler.renderRemoteVMPage(r.RequestURI, actionErr, outputMark, isoURL, pointerX, pointerY, pressKeys))
 	}
 }
 
@@ -277,7 +281,9 @@ func (handler *HandleVirtualMachineScreenshot) Handle(w http.ResponseWriter, r *
 		return
 	}
 	_ = screenshot.Close()
-	defer os.Remove(screenshot.Name())
+	defer func() {
+		_ = misc.SecureErase(screenshot.Name())
+	}()
 	if err := handler.VM.TakeScreenshot(screenshot.Name()); err != nil {
 		http.Error(w, "Failed to create temporary file: "+err.Error(), http.StatusInternalServerError)
 		return
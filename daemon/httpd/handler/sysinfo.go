@@ -29,9 +29,19 @@ func (info *HandleSystemInfo) Handle(w http.ResponseWriter, r *http.Request) {
 	var result bytes.Buffer
 	// Latest runtime info
 	result.WriteString(toolbox.GetRuntimeInfo())
+	result.WriteString("\nFile systems:\n")
+	result.WriteString(toolbox.GetDiskUsageInfo())
+	result.WriteString("\nNetwork interfaces:\n")
+	result.WriteString(misc.FormatNetInterfaceDelta(misc.GetNetInterfaceDelta()))
 	// Latest stats
-	result.WriteString("\nDaemon stats - low/avg/high/total seconds and (count):\n")
+	result.WriteString("\nDaemon stats - low/avg/high,total(count) | p50/p95/p99,rate in seconds:\n")
 	result.WriteString(misc.GetLatestStats())
+	result.WriteString("\nMetrics:\n")
+	result.WriteString(lalog.FormatMetrics())
+	if misc.DNSForwarderStatsReader != nil {
+		result.WriteString("\nDNS forwarders:\n")
+		result.WriteString(misc.DNSForwarderStatsReader())
+	}
 	// Warnings, logs, and stack traces, in that order.
 	result.WriteString("\nWarnings:\n")
 	result.WriteString(toolbox.GetLatestWarnings())
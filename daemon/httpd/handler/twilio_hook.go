@@ -78,8 +78,9 @@ func (hand *HandleTwilioSMSHook) Handle(w http.ResponseWriter, r *http.Request)
 		}
 	}
 	// SMS message is in "Body" parameter
-	ret := hand.cmdProc.Process(toolbox.Command{
+	ret := hand.cmdProc.Process(r.Context(), toolbox.Command{
 		DaemonName: "httpd",
+		TraceID:    lalog.TraceIDFromContext(r.Context()),
 		ClientID:   phoneNumber,
 		TimeoutSec: TwilioHandlerTimeoutSec,
 		Content:    r.FormValue("Body"),
@@ -196,8 +197,9 @@ func (hand *HandleTwilioCallCallback) Handle(w http.ResponseWriter, r *http.Requ
 		dtmfInput = dtmfInput[len(TwilioPhoneticSpellingMagic):]
 	}
 	// Run the toolbox command
-	ret := hand.cmdProc.Process(toolbox.Command{
+	ret := hand.cmdProc.Process(r.Context(), toolbox.Command{
 		DaemonName: "httpd",
+		TraceID:    lalog.TraceIDFromContext(r.Context()),
 		ClientID:   phoneNumber,
 		TimeoutSec: TwilioHandlerTimeoutSec,
 		Content:    toolbox.DTMFDecode(dtmfInput),
@@ -2,7 +2,6 @@ package httpd
 
 import (
 	"bytes"
-	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/json"
@@ -21,6 +20,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/HouzuoGuo/laitos/daemon/common"
 	"github.com/HouzuoGuo/laitos/daemon/httpd/handler"
 	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/lalog"
@@ -29,6 +29,9 @@ import (
 	"github.com/HouzuoGuo/laitos/toolbox"
 )
 
+// requestStats times the HTTP requests handled by all routes.
+var requestStats = misc.GetStats("httpd.Requests")
+
 const (
 	DirectoryHandlerRateLimitFactor = 8  // DirectoryHandlerRateLimitFactor is 7 times less expensive than the most expensive handler
 	RateLimitIntervalSec            = 1  // Rate limit is calculated at 1 second interval
@@ -73,16 +76,20 @@ type Daemon struct {
 	TLSCertPath      string            `json:"TLSCertPath"`      // (Optional) serve HTTPS via this certificate
 	TLSKeyPath       string            `json:"TLSKeyPath"`       // (Optional) serve HTTPS via this certificate (key)
 	PerIPLimit       int               `json:"PerIPLimit"`       // PerIPLimit is approximately how many concurrent users are expected to be using the server from same IP address
+	GlobalLimit      int               `json:"GlobalLimit"`      // GlobalLimit is the maximum number of requests acceptable from all clients combined per second, 0 means unlimited.
+	MaxConnsPerIP    int               `json:"MaxConnsPerIP"`    // MaxConnsPerIP is the maximum number of connections a client IP may keep open at the same time
 	ServeDirectories map[string]string `json:"ServeDirectories"` // Serve directories (value) on prefix paths (key)
 
 	HandlerCollection HandlerCollection          `json:"-"` // Specialised handlers that implement handler.HandlerFactory interface
 	Processor         *toolbox.CommandProcessor  `json:"-"` // Feature command processor
 	AllRateLimits     map[string]*misc.RateLimit `json:"-"` // Aggregate all routes and their rate limit counters
 
-	mux           *http.ServeMux
-	serverWithTLS *http.Server // serverWithTLS is an instance of HTTP server that will be started with TLS listener.
-	serverNoTLS   *http.Server // serverWithTLS is an instance of HTTP server that will be started with an ordinary listener.
-	logger        lalog.Logger
+	mux             *http.ServeMux
+	globalRateLimit *misc.RateLimit   // globalRateLimit counts the requests from all clients combined, it is nil if GlobalLimit is 0.
+	connLimit       *common.ConnLimit // connLimit counts the open connections of each client IP, it is shared by both listeners.
+	serverWithTLS   *http.Server      // serverWithTLS is an instance of HTTP server that will be started with TLS listener.
+	serverNoTLS     *http.Server      // serverWithTLS is an instance of HTTP server that will be started with an ordinary listener.
+	logger          lalog.Logger
 }
 
 // Return path to Handler among special handlers that matches the specified type. Primarily used by test case code.
@@ -113,13 +120,17 @@ func (daemon *Daemon) Middleware(rateLimit *misc.RateLimit, restrictedRequestSiz
 				Hence the status code here is OK.
 			*/
 			_, _ = w.Write([]byte(misc.ErrEmergencyLockDown.Error()))
-			misc.HTTPDStats.Trigger(float64(time.Now().UnixNano() - beginTimeNano))
+			requestStats.Trigger(float64(time.Now().UnixNano() - beginTimeNano))
 			return
 		}
 		// Check client IP against rate limit
 		remoteIP := handler.GetRealClientIP(r)
-		if rateLimit.Add(remoteIP, true) {
-			daemon.logger.Info("Handler", remoteIP, nil, "%s %s", r.Method, r.URL.Path)
+		if rateLimit.Add(remoteIP, true) && (daemon.globalRateLimit == nil || daemon.globalRateLimit.Add(misc.GlobalRateLimitActor, true)) {
+			// Identify log messages related to this request by a trace ID carried in the request context
+			traceID := lalog.NewTraceID()
+			r = r.WithContext(lalog.ContextWithTraceID(r.Context(), traceID))
+			logger := daemon.logger.WithTraceID(traceID)
+			logger.Info("Handler", remoteIP, nil, "%s %s", r.Method, r.URL.Path)
 			next(w, r)
 			if r.Body != nil {
 				_ = r.Body.Close()
@@ -127,7 +138,7 @@ func (daemon *Daemon) Middleware(rateLimit *misc.RateLimit, restrictedRequestSiz
 		} else {
 			http.Error(w, "", http.StatusTooManyRequests)
 		}
-		misc.HTTPDStats.Trigger(float64(time.Now().UnixNano() - beginTimeNano))
+		requestStats.Trigger(float64(time.Now().UnixNano() - beginTimeNano))
 	}
 }
 
@@ -156,6 +167,10 @@ func (daemon *Daemon) Initialise(urlRoutePrefixKey string) error {
 	if daemon.PerIPLimit < 1 {
 		daemon.PerIPLimit = 12 // reasonable for couple of users that use advanced API endpoints in parallel
 	}
+	if daemon.MaxConnsPerIP < 1 {
+		daemon.MaxConnsPerIP = 64 // browsers open a handful of connections per site, leaving room for several users behind a NAT
+	}
+	daemon.connLimit = &common.ConnLimit{MaxConnsPerIP: daemon.MaxConnsPerIP}
 	if daemon.Processor == nil || daemon.Processor.IsEmpty() {
 		daemon.logger.Info("Initialise", "", nil, "daemon will not be able to execute toolbox commands due to lack of command processor filter configuration")
 		daemon.Processor = toolbox.GetEmptyCommandProcessor()
@@ -219,6 +234,17 @@ func (daemon *Daemon) Initialise(urlRoutePrefixKey string) error {
 	for _, limit := range daemon.AllRateLimits {
 		limit.Initialise()
 	}
+	daemon.globalRateLimit = nil
+	if daemon.GlobalLimit > 0 {
+		// Token bucket lets the aggregate of all clients burst briefly instead of cutting everyone off at a window boundary
+		daemon.globalRateLimit = &misc.RateLimit{
+			UnitSecs:  RateLimitIntervalSec,
+			MaxCount:  daemon.GlobalLimit,
+			Algorithm: misc.RateLimitTokenBucket,
+			Logger:    daemon.logger,
+		}
+		daemon.globalRateLimit.Initialise()
+	}
 	return nil
 }
 
@@ -255,7 +281,11 @@ func (daemon *Daemon) StartAndBlockNoTLS(fallbackPort int) error {
 		WriteTimeout: IOTimeoutSec * time.Second,
 	}
 	daemon.logger.Info("StartAndBlockNoTLS", "", nil, "going to listen for HTTP connections")
-	if err := daemon.serverNoTLS.ListenAndServe(); err != nil {
+	listener, err := common.ListenTCP(daemon.logger, daemon.Address, daemon.PlainPort)
+	if err != nil {
+		return fmt.Errorf("httpd.StartAndBlockNoTLS: failed to listen on %s:%d - %v", daemon.Address, daemon.Port, err)
+	}
+	if err := daemon.serverNoTLS.Serve(&common.ConnLimitListener{Listener: listener, Limit: daemon.connLimit}); err != nil {
 		if strings.Contains(err.Error(), "closed") {
 			return nil
 		}
@@ -269,24 +299,24 @@ StartAndBlockWithTLS starts HTTP daemon and serve encrypted connections. Blocks
 You may call this function only after having called Initialise()!
 */
 func (daemon *Daemon) StartAndBlockWithTLS() error {
-	contents, _, err := misc.DecryptIfNecessary(misc.ProgramDataDecryptionPassword, daemon.TLSCertPath, daemon.TLSKeyPath)
-	if err != nil {
-		return err
-	}
-	tlsCert, err := tls.X509KeyPair(contents[0], contents[1])
-	if err != nil {
-		return fmt.Errorf("httpd.StartAndBlockWithTLS: failed to load certificate or key - %v", err)
+	// The loader picks up the certificate renewed on disk (e.g. by an ACME client) without restarting the server
+	certLoader := &common.CertificateLoader{CertPath: daemon.TLSCertPath, KeyPath: daemon.TLSKeyPath}
+	if err := certLoader.Load(); err != nil {
+		return fmt.Errorf("httpd.StartAndBlockWithTLS: %v", err)
 	}
 	daemon.serverWithTLS = &http.Server{
 		Addr:         net.JoinHostPort(daemon.Address, strconv.Itoa(daemon.Port)),
 		Handler:      daemon.mux,
 		ReadTimeout:  IOTimeoutSec * time.Second,
 		WriteTimeout: IOTimeoutSec * time.Second,
-		TLSConfig:    &tls.Config{Certificates: []tls.Certificate{tlsCert}},
+		TLSConfig:    &tls.Config{GetCertificate: certLoader.GetCertificate},
 	}
 	daemon.logger.Info("StartAndBlockWithTLS", "", nil, "going to listen for HTTPS connections")
-
-	if err := daemon.serverWithTLS.ListenAndServeTLS("", ""); err != nil {
+	listener, err := common.ListenTCP(daemon.logger, daemon.Address, daemon.Port)
+	if err != nil {
+		return fmt.Errorf("httpd.StartAndBlockWithTLS: failed to listen on %s:%d - %v", daemon.Address, daemon.Port, err)
+	}
+	if err := daemon.serverWithTLS.ServeTLS(&common.ConnLimitListener{Listener: listener, Limit: daemon.connLimit}, "", ""); err != nil {
 		if strings.Contains(err.Error(), "closed") {
 			return nil
 		}
@@ -298,10 +328,12 @@ func (daemon *Daemon) StartAndBlockWithTLS() error {
 // Stop HTTP daemon - the listener without TLS.
 func (daemon *Daemon) StopNoTLS() {
 	if server := daemon.serverNoTLS; server != nil {
-		constraints, cancel := context.WithTimeout(context.Background(), time.Duration(IOTimeoutSec+2)*time.Second)
+		// Wait for ongoing requests to be served, and then close the connections that did not finish in time.
+		ctx, cancel := common.NewDrainContext()
 		defer cancel()
-		if err := server.Shutdown(constraints); err != nil {
-			daemon.logger.Warning("StopNoTLS", "", err, "failed to shutdown")
+		if err := server.Shutdown(ctx); err != nil {
+			daemon.logger.Warning("StopNoTLS", "", err, "closing the connections that did not finish in time")
+			daemon.logger.MaybeMinorError(server.Close())
 		}
 	}
 }
@@ -309,10 +341,12 @@ func (daemon *Daemon) StopNoTLS() {
 // Stop HTTP daemon - the listener with TLS.
 func (daemon *Daemon) StopTLS() {
 	if server := daemon.serverWithTLS; server != nil {
-		constraints, cancel := context.WithTimeout(context.Background(), time.Duration(IOTimeoutSec+2)*time.Second)
+		// Wait for ongoing requests to be served, and then close the connections that did not finish in time.
+		ctx, cancel := common.NewDrainContext()
 		defer cancel()
-		if err := server.Shutdown(constraints); err != nil {
-			daemon.logger.Warning("StopTLS", "", err, "failed to shutdown")
+		if err := server.Shutdown(ctx); err != nil {
+			daemon.logger.Warning("StopTLS", "", err, "closing the connections that did not finish in time")
+			daemon.logger.MaybeMinorError(server.Close())
 		}
 	}
 }
@@ -325,6 +359,24 @@ func TestAPIHandlers(httpd *Daemon, t testingstub.T) {
 	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), "Stack traces:") {
 		t.Fatal(err, string(resp.Body))
 	}
+	// Prometheus metrics
+	resp, err = inet.DoHTTP(inet.HTTPRequest{}, addr+"/metrics")
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), "laitos_httpd_Requests_seconds_count") {
+		t.Fatal(err, string(resp.Body))
+	}
+	// DNS query log
+	oldQueryLogReader := misc.DNSQueryLogReader
+	misc.DNSQueryLogReader = nil
+	resp, err = inet.DoHTTP(inet.HTTPRequest{}, addr+"/dns_query_log")
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatal(err, string(resp.Body))
+	}
+	misc.DNSQueryLogReader = func(clientIP string) (string, error) { return "queries of " + clientIP, nil }
+	resp, err = inet.DoHTTP(inet.HTTPRequest{}, addr+"/dns_query_log?client=1.2.3.4")
+	misc.DNSQueryLogReader = oldQueryLogReader
+	if err != nil || resp.StatusCode != http.StatusOK || string(resp.Body) != "queries of 1.2.3.4" {
+		t.Fatal(err, string(resp.Body))
+	}
 	// Command Form
 	resp, err = inet.DoHTTP(inet.HTTPRequest{}, addr+"/cmd_form")
 	if err != nil || resp.StatusCode != http.StatusOK || !strings.Contains(string(resp.Body), "submit") {
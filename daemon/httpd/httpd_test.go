@@ -92,6 +92,8 @@ func TestHTTPD_StartAndBlock(t *testing.T) {
 	// Set up API handlers
 	daemon.Processor = toolbox.GetTestCommandProcessor()
 	daemon.HandlerCollection["/info"] = &handler.HandleSystemInfo{FeaturesToCheck: daemon.Processor.Features}
+	daemon.HandlerCollection["/metrics"] = &handler.HandlePrometheusMetrics{}
+	daemon.HandlerCollection["/dns_query_log"] = &handler.HandleDNSQueryLog{}
 	daemon.HandlerCollection["/cmd_form"] = &handler.HandleCommandForm{}
 	daemon.HandlerCollection["/upload"] = &handler.HandleFileUpload{}
 	daemon.HandlerCollection["/gitlab"] = &handler.HandleGitlabBrowser{PrivateToken: "token-does-not-matter-in-this-test"}
@@ -0,0 +1,105 @@
+package maintenance
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+// CustomCheckDefaultTimeoutSec is the default number of seconds a custom check script is given to run.
+const CustomCheckDefaultTimeoutSec = 60
+
+/*
+CustomCheck is an operator-defined health check. Its script is run by the system default script interpreter, and the
+check passes only if the script exits successfully and its output satisfies the expectations.
+*/
+type CustomCheck struct {
+	Name       string `json:"Name"`       // Name identifies the check in maintenance report.
+	Script     string `json:"Script"`     // Script is the command or script content to run.
+	TimeoutSec int    `json:"TimeoutSec"` // TimeoutSec is the number of seconds the script is given to run.
+	// ExpectOutputContains is a piece of text that must be found in the script output.
+	ExpectOutputContains string `json:"ExpectOutputContains"`
+	// ExpectOutputRegex is a regular expression that must match the script output.
+	ExpectOutputRegex string `json:"ExpectOutputRegex"`
+
+	regex *regexp.Regexp
+}
+
+// Initialise validates the check configuration and compiles its regular expression.
+func (check *CustomCheck) Initialise() error {
+	if check.Name == "" {
+		return errors.New("custom check must have a Name")
+	}
+	if check.Script == "" {
+		return fmt.Errorf("custom check \"%s\" must have a Script", check.Name)
+	}
+	if check.TimeoutSec < 1 {
+		check.TimeoutSec = CustomCheckDefaultTimeoutSec
+	}
+	check.regex = nil
+	if check.ExpectOutputRegex != "" {
+		var err error
+		if check.regex, err = regexp.Compile(check.ExpectOutputRegex); err != nil {
+			return fmt.Errorf("custom check \"%s\" has an invalid ExpectOutputRegex: %v", check.Name, err)
+		}
+	}
+	return nil
+}
+
+// Run runs the check script and returns an error if the script fails or its output does not meet the expectations.
+func (check *CustomCheck) Run() error {
+	out, err := misc.InvokeShell(check.TimeoutSec, misc.GetDefaultShellInterpreter(), check.Script)
+	out = strings.TrimSpace(out)
+	truncatedOut := lalog.TruncateString(out, MaxMessageLength)
+	if err != nil {
+		return fmt.Errorf("%v - %s", err, truncatedOut)
+	}
+	if check.ExpectOutputContains != "" && !strings.Contains(out, check.ExpectOutputContains) {
+		return fmt.Errorf("output does not contain \"%s\" - %s", check.ExpectOutputContains, truncatedOut)
+	}
+	if check.regex != nil && !check.regex.MatchString(out) {
+		return fmt.Errorf("output does not match \"%s\" - %s", check.ExpectOutputRegex, truncatedOut)
+	}
+	return nil
+}
+
+/*
+runCustomChecks runs all custom checks in parallel. It returns a text report of the pass/fail result of each check, and
+an error if any of the checks fails.
+*/
+func (daemon *Daemon) runCustomChecks() (string, error) {
+	if len(daemon.CustomChecks) == 0 {
+		return "", nil
+	}
+	checkErrs := make([]error, len(daemon.CustomChecks))
+	wait := new(sync.WaitGroup)
+	for i := range daemon.CustomChecks {
+		wait.Add(1)
+		go func(i int) {
+			checkErrs[i] = daemon.CustomChecks[i].Run()
+			wait.Done()
+		}(i)
+	}
+	wait.Wait()
+
+	var report bytes.Buffer
+	var failedNames []string
+	for i, check := range daemon.CustomChecks {
+		if checkErrs[i] == nil {
+			report.WriteString(fmt.Sprintf("PASS %s\n", check.Name))
+		} else {
+			report.WriteString(fmt.Sprintf("FAIL %s: %v\n", check.Name, checkErrs[i]))
+			failedNames = append(failedNames, check.Name)
+		}
+	}
+	if len(failedNames) == 0 {
+		return report.String(), nil
+	}
+	return report.String(), fmt.Errorf("failed custom checks: %s", strings.Join(failedNames, ", "))
+}
@@ -35,6 +35,16 @@ const (
 	InitialDelaySec = 180
 	// MaxMessageLength is the maximum length of each message entry coming from output of a maintenance action.
 	MaxMessageLength = 1024
+	// SensorCheckIntervalSec is the interval at which hardware temperature sensors are checked for overheating.
+	SensorCheckIntervalSec = 5 * 60
+	// ClockAdjustStep tells maintenance routine to immediately move the system clock to correct its offset.
+	ClockAdjustStep = "step"
+	// ClockAdjustSlew tells maintenance routine to gradually speed up or slow down the system clock to correct its offset.
+	ClockAdjustSlew = "slew"
+	// MinClockAdjustment is the smallest clock offset that the maintenance routine will correct.
+	MinClockAdjustment = 100 * time.Millisecond
+	// MaxClockSlew is the largest clock offset that will be slewed, a larger offset is stepped instead because slewing would take hours.
+	MaxClockSlew = 10 * time.Second
 )
 
 // ReportFilePath is the absolute file path to the text report from latest maintenance run.
@@ -53,6 +63,8 @@ type Daemon struct {
 		the host, the check is considered a failure.
 	*/
 	CheckTCPPorts map[string][]int `json:"CheckTCPPorts"`
+	// CustomChecks are operator-defined check scripts run during the routine maintenance, along with the built-in checks.
+	CustomChecks []CustomCheck `json:"CustomChecks"`
 	/*
 		BlockSystemLoginExcept is a list of Unix user names. If the array is not empty, system maintenance routine will
 		disable login access to all local users except the names among the array in an effort to harden system security.
@@ -68,6 +80,20 @@ type Daemon struct {
 	BlockPortsExcept []int `json:"BlockPortsExcept"`
 	// ThrottleIncomingConnections throttles incoming connections and other network packets to this number/second via iptables.
 	ThrottleIncomingPackets int `json:"ThrottleIncomingPackets"`
+	/*
+		LockDownFirewall programs the host firewall (nftables, iptables, or Windows Firewall) to block all incoming
+		traffic except the ports of enabled laitos daemons and remote administration (SSH, and RDP on Windows). It is
+		ignored if BlockPortsExcept is specified.
+	*/
+	LockDownFirewall bool `json:"LockDownFirewall"`
+	/*
+		FirewallSSHPorts are the TCP ports of the host's SSH server allowed by LockDownFirewall. If empty, the ports are
+		read from the sshd configuration file, or port 22 is allowed if the file does not specify any.
+	*/
+	FirewallSSHPorts []int `json:"FirewallSSHPorts"`
+	// FirewallTCPPorts and FirewallUDPPorts are the ports of enabled laitos daemons, they are allowed by LockDownFirewall.
+	FirewallTCPPorts []int `json:"-"`
+	FirewallUDPPorts []int `json:"-"`
 	// TuneLinux enables Linux kernel tuning routine as a maintenance step
 	TuneLinux bool `json:"TuneLinux"`
 	// EnhanceFileSecurity enables hardening of home directory security (ownership and permission).
@@ -83,6 +109,18 @@ type Daemon struct {
 	SwapFileSizeMB int `json:"SwapFileSizeMB"`
 	// SetTimeZone changes system time zone to the specified value (such as "UTC").
 	SetTimeZone string `json:"SetTimeZone"`
+	// NTPServers are queried for the offset of system clock. If the array is empty, misc.DefaultNTPServers are used.
+	NTPServers []string `json:"NTPServers"`
+	/*
+		AdjustClock corrects the system clock offset measured against NTPServers, either by ClockAdjustStep or
+		ClockAdjustSlew. If the value is empty, the offset is only reported.
+	*/
+	AdjustClock string `json:"AdjustClock"`
+	/*
+		MaxTemperatureCelsius is the hardware temperature at or above which the daemon warns of overheating. If the value
+		is 0, the critical temperature reported by each sensor is used instead.
+	*/
+	MaxTemperatureCelsius int `json:"MaxTemperatureCelsius"`
 
 	/*
 		IntervalSec determines the rate of execution of maintenance routine. This is not a sleep duration. The constant
@@ -95,8 +133,14 @@ type Daemon struct {
 	MailCmdRunnerToTest *mailcmd.CommandRunner  `json:"-"`          // MailCmdRunnerToTest is mail command runner to be tested during health check.
 	HTTPHandlersToCheck httpd.HandlerCollection `json:"-"`          // HTTPHandlersToCheck are the URL handlers of an HTTP daemon to be tested during health check.
 
+	// ReportTelegram, ReportMatrix, and ReportWebhooks deliver maintenance reports and alerts in addition to notification mails.
+	ReportTelegram []TelegramReport `json:"ReportTelegram"`
+	ReportMatrix   []MatrixReport   `json:"ReportMatrix"`
+	ReportWebhooks []WebhookReport  `json:"ReportWebhooks"`
+
 	lastStepTimestamp int64     // lastStepTimestamp is the unix timestamp at which the last maintenance stage or a stage stap took place
 	loopIsRunning     int32     // Value is 1 only when maintenance loop is running
+	overheating       bool      // overheating is true if the latest sensor check found a temperature sensor too hot
 	stop              chan bool // Signal maintenance loop to stop
 	logger            lalog.Logger
 }
@@ -148,10 +192,16 @@ func (daemon *Daemon) Execute() (string, bool) {
 	daemon.logger.Info("Execute", "", nil, "running now")
 	// Conduct system maintenance first to ensure an accurate reading of runtime information later on
 	maintResult := daemon.SystemMaintenance()
-	// Do three checks in parallel - ports, toolbox features, and mail command runner
-	var portsErr, featureErr, mailCmdRunnerErr, httpHandlersErr error
+	// Do the checks in parallel - ports, toolbox features, mail command runner, HTTP handlers, and custom checks
+	var portsErr, featureErr, mailCmdRunnerErr, httpHandlersErr, customChecksErr error
+	var customChecksReport string
 	waitAllChecks := new(sync.WaitGroup)
-	waitAllChecks.Add(4) // will wait for port checks, feature tests, mail command runner, and HTTP handler tests.
+	waitAllChecks.Add(5) // will wait for port checks, feature tests, mail command runner, HTTP handler tests, and custom checks.
+	go func() {
+		// Custom checks - the routine itself also uses concurrency internally
+		customChecksReport, customChecksErr = daemon.runCustomChecks()
+		waitAllChecks.Done()
+	}()
 	go func() {
 		// Port checks - the routine itself also uses concurrency internally
 		portsErr = daemon.runPortsCheck()
@@ -181,17 +231,46 @@ func (daemon *Daemon) Execute() (string, bool) {
 
 	waitAllChecks.Wait()
 
+	sensorReadings := misc.GetHardwareSensors()
+	overheatingSensors := misc.GetOverheatingSensors(sensorReadings, float64(daemon.MaxTemperatureCelsius))
+	disks, diskHealthErr := misc.GetDiskHealth()
+	failingDisks := misc.GetFailingDisks(disks)
+
 	// Results are now ready. When composing the mail body, place the most important&interesting piece of information at top.
-	allOK := portsErr == nil && featureErr == nil && mailCmdRunnerErr == nil && httpHandlersErr == nil
+	allOK := portsErr == nil && featureErr == nil && mailCmdRunnerErr == nil && httpHandlersErr == nil && customChecksErr == nil && len(overheatingSensors) == 0 && len(failingDisks) == 0
 	var result bytes.Buffer
 	if allOK {
 		result.WriteString("All OK\n")
 	} else {
 		result.WriteString("There are errors!!!\n")
 	}
+	// The summary comprises errors alone, it is delivered to chat channels that cannot fit the entire report.
+	var summary bytes.Buffer
+	for _, err := range []error{portsErr, featureErr, mailCmdRunnerErr, httpHandlersErr, customChecksErr} {
+		if err != nil {
+			summary.WriteString(fmt.Sprintf("%v\n", err))
+		}
+	}
+	if len(overheatingSensors) > 0 {
+		summary.WriteString("Hardware sensors are overheating:\n")
+		summary.WriteString(misc.FormatSensorReadings(overheatingSensors))
+	}
+	if len(failingDisks) > 0 {
+		summary.WriteString("Disks are failing:\n")
+		summary.WriteString(misc.FormatDiskHealth(failingDisks))
+	}
+	if allOK {
+		summary.WriteString("All OK\n")
+	}
 	result.WriteString(toolbox.GetRuntimeInfo())
-	result.WriteString("\nDaemon stats - low/avg/high/total seconds and (count):\n")
+	result.WriteString("\nFile systems:\n")
+	result.WriteString(toolbox.GetDiskUsageInfo())
+	result.WriteString("\nNetwork interfaces:\n")
+	result.WriteString(misc.FormatNetInterfaceDelta(misc.GetNetInterfaceDelta()))
+	result.WriteString("\nDaemon stats - low/avg/high,total(count) | p50/p95/p99,rate in seconds:\n")
 	result.WriteString(misc.GetLatestStats())
+	result.WriteString("\nMetrics:\n")
+	result.WriteString(lalog.FormatMetrics())
 	if portsErr == nil {
 		result.WriteString("\nPorts: OK\n")
 	} else {
@@ -212,6 +291,28 @@ func (daemon *Daemon) Execute() (string, bool) {
 	} else {
 		result.WriteString(fmt.Sprintf("\nHTTP handler errors: %v\n", httpHandlersErr))
 	}
+	if customChecksErr == nil {
+		result.WriteString("\nCustom checks (if present): OK\n")
+	} else {
+		result.WriteString(fmt.Sprintf("\nCustom check errors: %v\n", customChecksErr))
+	}
+	result.WriteString(customChecksReport)
+	if len(overheatingSensors) == 0 {
+		result.WriteString("\nHardware sensors (if present): OK\n")
+	} else {
+		result.WriteString("\nHardware sensors are overheating:\n")
+		result.WriteString(misc.FormatSensorReadings(overheatingSensors))
+	}
+	result.WriteString(misc.FormatSensorReadings(sensorReadings))
+	if diskHealthErr != nil {
+		result.WriteString(fmt.Sprintf("\nDisk health (S.M.A.R.T.): skipped - %v\n", diskHealthErr))
+	} else if len(failingDisks) == 0 {
+		result.WriteString("\nDisk health (S.M.A.R.T.): OK\n")
+	} else {
+		result.WriteString("\nDisks are failing:\n")
+		result.WriteString(misc.FormatDiskHealth(failingDisks))
+	}
+	result.WriteString(misc.FormatDiskHealth(disks))
 	result.WriteString("\nWarnings:\n")
 	result.WriteString(toolbox.GetLatestWarnings())
 	result.WriteString("\nLogs:\n")
@@ -234,6 +335,7 @@ func (daemon *Daemon) Execute() (string, bool) {
 	} else if err := daemon.MailClient.Send(inet.OutgoingMailSubjectKeyword+"-maintenance", result.String(), daemon.Recipients...); err != nil {
 		daemon.logger.Warning("Execute", "", err, "failed to send notification mail")
 	}
+	daemon.deliverToChannels(allOK, inet.OutgoingMailSubjectKeyword+"-maintenance", summary.String(), result.String())
 	// Leave the latest maintenance report in system temporary directory for inspection, overwrite existing report.
 	if err := ioutil.WriteFile(ReportFilePath, result.Bytes(), 0600); err != nil {
 		daemon.logger.Warning("Execute", "", err, "failed to persist latest maintenance report in %s, you may still find the report in Email or laitos program output.", ReportFilePath)
@@ -241,12 +343,51 @@ func (daemon *Daemon) Execute() (string, bool) {
 	return lalog.LintString(result.String(), inet.MaxMailBodySize), allOK
 }
 
+/*
+checkSensors reads hardware temperature sensors and warns of overheating. A notification mail is sent when overheating
+begins, rather than at each check.
+*/
+func (daemon *Daemon) checkSensors() {
+	overheatingSensors := misc.GetOverheatingSensors(misc.GetHardwareSensors(), float64(daemon.MaxTemperatureCelsius))
+	if len(overheatingSensors) == 0 {
+		if daemon.overheating {
+			daemon.logger.Info("checkSensors", "", nil, "hardware temperature is back to normal")
+		}
+		daemon.overheating = false
+		return
+	}
+	readings := misc.FormatSensorReadings(overheatingSensors)
+	daemon.logger.Warning("checkSensors", "", nil, "hardware is overheating - %s", strings.Replace(strings.TrimSpace(readings), "\n", "; ", -1))
+	if !daemon.overheating {
+		if daemon.Recipients != nil && len(daemon.Recipients) > 0 {
+			if err := daemon.MailClient.Send(inet.OutgoingMailSubjectKeyword+"-overheating", readings, daemon.Recipients...); err != nil {
+				daemon.logger.Warning("checkSensors", "", err, "failed to send notification mail")
+			}
+		}
+		daemon.deliverToChannels(false, inet.OutgoingMailSubjectKeyword+"-overheating", readings, readings)
+	}
+	daemon.overheating = true
+}
+
 func (daemon *Daemon) Initialise() error {
 	if daemon.IntervalSec < 1 {
 		daemon.IntervalSec = MinimumIntervalSec // quite reasonable to run maintenance daily
 	} else if daemon.IntervalSec < MinimumIntervalSec {
 		return fmt.Errorf("maintenance.StartAndBlock: IntervalSec must be at or above %d", MinimumIntervalSec)
 	}
+	if daemon.AdjustClock != "" && daemon.AdjustClock != ClockAdjustStep && daemon.AdjustClock != ClockAdjustSlew {
+		return fmt.Errorf("maintenance.Initialise: AdjustClock must be either empty, \"%s\", or \"%s\"", ClockAdjustStep, ClockAdjustSlew)
+	}
+	for _, channel := range daemon.getReportChannels() {
+		if err := channel.Initialise(); err != nil {
+			return fmt.Errorf("maintenance.Initialise: %v", err)
+		}
+	}
+	for i := range daemon.CustomChecks {
+		if err := daemon.CustomChecks[i].Initialise(); err != nil {
+			return fmt.Errorf("maintenance.Initialise: %v", err)
+		}
+	}
 	daemon.stop = make(chan bool)
 	daemon.logger = lalog.Logger{ComponentName: "maintenance", ComponentID: []lalog.LoggerIDField{{Key: "Intv", Value: daemon.IntervalSec}}}
 	return nil
@@ -262,6 +403,9 @@ func (daemon *Daemon) StartAndBlock() error {
 		InitialDelaySec, daemon.IntervalSec/3600)
 	// Maintenance is run for the very first time soon (2 minutes) after starting up
 	nextRunAt := time.Now().Add(InitialDelaySec * time.Second)
+	// Hardware sensors are checked far more often than the maintenance routine
+	sensorTicker := time.NewTicker(SensorCheckIntervalSec * time.Second)
+	defer sensorTicker.Stop()
 	for {
 		if misc.EmergencyLockDown {
 			atomic.StoreInt32(&daemon.loopIsRunning, 0)
@@ -273,6 +417,9 @@ func (daemon *Daemon) StartAndBlock() error {
 			case <-daemon.stop:
 				atomic.StoreInt32(&daemon.loopIsRunning, 0)
 				return nil
+			case <-sensorTicker.C:
+				daemon.checkSensors()
+				continue
 			case <-time.After(time.Until(nextRunAt)):
 				nextRunAt = nextRunAt.Add(time.Duration(daemon.IntervalSec) * time.Second)
 				daemon.Execute()
@@ -284,6 +431,9 @@ func (daemon *Daemon) StartAndBlock() error {
 			case <-daemon.stop:
 				atomic.StoreInt32(&daemon.loopIsRunning, 0)
 				return nil
+			case <-sensorTicker.C:
+				daemon.checkSensors()
+				continue
 			case <-time.After(time.Until(nextRunAt)):
 				nextRunAt = nextRunAt.Add(time.Duration(daemon.IntervalSec) * time.Second)
 				daemon.Execute()
@@ -365,6 +515,7 @@ func (daemon *Daemon) SystemMaintenance() string {
 	daemon.BlockUnusedLogin(out)
 	daemon.MaintainServices(out)
 	daemon.MaintainsIptables(out) // run this after service maintenance, because disabling firewall service may alter iptables.
+	daemon.LockDownHostFirewall(out)
 	daemon.EnhanceFileSecurity(out)
 
 	daemon.logPrintStage(out, "concluded system maintenance")
@@ -404,6 +555,20 @@ func TestMaintenance(check *Daemon, t testingstub.T) {
 	if _, err := os.Stat("/tmp/laitos-maintenance-pre-script-test"); err != nil {
 		t.Fatal("did not run pre script")
 	}
+	// Custom checks report their results, and a failed check is an error.
+	check.CustomChecks = []CustomCheck{
+		{Name: "echo-pass", Script: "echo hello-custom-check", ExpectOutputContains: "hello-custom", ExpectOutputRegex: "^hello-[a-z-]+$"},
+		{Name: "echo-fail", Script: "echo goodbye", ExpectOutputContains: "hello"},
+	}
+	if err := check.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if result, ok := check.Execute(); ok || !strings.Contains(result, "PASS echo-pass") ||
+		!strings.Contains(result, "FAIL echo-fail: output does not contain \"hello\" - goodbye") ||
+		!strings.Contains(result, "Custom check errors: failed custom checks: echo-fail") {
+		t.Fatal(result)
+	}
+	check.CustomChecks = nil
 	// Break a feature
 	check.FeaturesToTest.LookupByTrigger[".s"] = &toolbox.Shell{}
 	if result, ok := check.Execute(); ok || !strings.Contains(result, "Shell.SelfTest") { // broken shell configuration
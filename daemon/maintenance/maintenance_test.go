@@ -1,9 +1,17 @@
 package maintenance
 
 import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
 	"strings"
 	"testing"
 
+	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/toolbox"
 )
 
@@ -33,10 +41,134 @@ func TestMaintenance_Execute(t *testing.T) {
 	if err := maint.Initialise(); !strings.Contains(err.Error(), "IntervalSec") {
 		t.Fatal(err)
 	}
-	// Prepare settings for test
 	maint.IntervalSec = MinimumIntervalSec
+	maint.CustomChecks = []CustomCheck{{Name: "a", Script: "true", ExpectOutputRegex: "("}}
+	if err := maint.Initialise(); err == nil || !strings.Contains(err.Error(), "ExpectOutputRegex") {
+		t.Fatal(err)
+	}
+	maint.CustomChecks = []CustomCheck{{Name: "a"}}
+	if err := maint.Initialise(); err == nil || !strings.Contains(err.Error(), "Script") {
+		t.Fatal(err)
+	}
+	maint.CustomChecks = []CustomCheck{{Name: "a", Script: "true"}}
+	if err := maint.Initialise(); err != nil || maint.CustomChecks[0].TimeoutSec != CustomCheckDefaultTimeoutSec {
+		t.Fatal(err)
+	}
+	maint.CustomChecks = nil
+	// Prepare settings for test
 	if err := maint.Initialise(); err != nil {
 		t.Fatal(err)
 	}
 	TestMaintenance(&maint, t)
 }
+
+func TestFirewallRules(t *testing.T) {
+	if ports := uniquePorts([]int{443, 22, 0, 53, 443, 70000}); !reflect.DeepEqual(ports, []int{22, 53, 443}) {
+		t.Fatal(ports)
+	}
+	ruleset := getNftablesRuleset([]int{22, 443}, []int{53})
+	if !strings.Contains(ruleset, "policy drop;") || !strings.Contains(ruleset, "tcp dport { 22, 443 } accept") ||
+		!strings.Contains(ruleset, "udp dport { 53 } accept") {
+		t.Fatal(ruleset)
+	}
+	if ruleset := getNftablesRuleset([]int{22}, nil); strings.Contains(ruleset, "udp dport") {
+		t.Fatal(ruleset)
+	}
+	cmds := getIptablesCommands([]int{22}, []int{53}, true)
+	// The dropping rule must come after all accepting rules
+	if last := cmds[len(cmds)-1]; !reflect.DeepEqual(last, []string{"-A", FirewallRuleName, "-j", "DROP"}) {
+		t.Fatal(last)
+	}
+	if !reflect.DeepEqual(cmds[4], []string{"-A", FirewallRuleName, "-p", "ipv6-icmp", "-j", "ACCEPT"}) {
+		t.Fatal(cmds[4])
+	}
+	if len(cmds) != 8 {
+		t.Fatal(cmds)
+	}
+	// The rules of INPUT chain are left intact
+	for _, cmd := range cmds {
+		if cmd[1] != FirewallRuleName {
+			t.Fatal(cmd)
+		}
+	}
+	// SSH ports come from the configuration file of sshd
+	if ports := getSSHDPorts("# Port 23\nPort 2222\n  port 22\nPortX 1\nPort\nListenAddress 0.0.0.0\n"); !reflect.DeepEqual(ports, []int{2222, 22}) {
+		t.Fatal(ports)
+	}
+	if ports := (&Daemon{FirewallSSHPorts: []int{2022}}).getFirewallSSHPorts(); !reflect.DeepEqual(ports, []int{2022}) {
+		t.Fatal(ports)
+	}
+}
+
+func TestReportChannels(t *testing.T) {
+	var webhookBody WebhookReportBody
+	var webhookAuth string
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		webhookAuth = r.Header.Get("Authorization")
+		if err := json.NewDecoder(r.Body).Decode(&webhookBody); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer webhook.Close()
+	var matrixPath, matrixAuth, matrixBody string
+	matrix := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		matrixPath = r.URL.EscapedPath()
+		matrixAuth = r.Header.Get("Authorization")
+		body, _ := ioutil.ReadAll(r.Body)
+		matrixBody = string(body)
+	}))
+	defer matrix.Close()
+
+	maint := Daemon{ReportWebhooks: []WebhookReport{{URL: webhook.URL}}, ReportMatrix: []MatrixReport{{HomeServerURL: matrix.URL}}}
+	if err := maint.Initialise(); err == nil || !strings.Contains(err.Error(), "AccessToken") {
+		t.Fatal(err)
+	}
+	maint.ReportMatrix[0].AccessToken = "matrix-token"
+	maint.ReportMatrix[0].RoomID = "!room:example.com"
+	maint.ReportWebhooks[0].Severity = "wrong"
+	if err := maint.Initialise(); err == nil || !strings.Contains(err.Error(), "Severity") {
+		t.Fatal(err)
+	}
+	maint.ReportWebhooks[0].Severity = ReportSeverityWarning
+	maint.ReportWebhooks[0].Header = map[string]string{"Authorization": "webhook-secret"}
+	if err := maint.Initialise(); err != nil || maint.ReportMatrix[0].Severity != ReportSeverityInfo {
+		t.Fatal(err)
+	}
+
+	// A report without errors is only delivered to the channel of info severity
+	maint.deliverToChannels(true, "subject", "all good", "full report")
+	if !strings.HasPrefix(matrixPath, "/_matrix/client/r0/rooms/%21room%3Aexample.com/send/m.room.message/") ||
+		matrixAuth != "Bearer matrix-token" || !strings.Contains(matrixBody, `"body":"subject\nall good"`) {
+		t.Fatal(matrixPath, matrixAuth, matrixBody)
+	}
+	if webhookBody.Subject != "" {
+		t.Fatalf("%+v", webhookBody)
+	}
+	// A report with errors is delivered to all channels
+	maint.deliverToChannels(false, "subject", "bad", "full report")
+	if webhookAuth != "webhook-secret" || webhookBody.OK || webhookBody.Subject != "subject" ||
+		webhookBody.Summary != "bad" || webhookBody.Report != "full report" {
+		t.Fatalf("%+v", webhookBody)
+	}
+	if !strings.Contains(matrixBody, `"body":"subject\nbad"`) {
+		t.Fatal(matrixBody)
+	}
+}
+
+func TestTelegramReportRedactToken(t *testing.T) {
+	tg := TelegramReport{AuthorizationToken: "dummy-telegram-token", ChatID: 1}
+	if err := tg.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	// The error of a failed API call carries the API URL, and in turn the token.
+	apiErr := &url.Error{Op: "Post", URL: "https://api.telegram.org/botdummy-telegram-token/sendMessage", Err: errors.New("connection refused")}
+	if err := tg.redactToken(apiErr); err == nil || strings.Contains(err.Error(), "dummy-telegram-token") || !strings.Contains(err.Error(), lalog.RedactedLabel) {
+		t.Fatal(err)
+	}
+	if err := tg.redactToken(nil); err != nil {
+		t.Fatal(err)
+	}
+	if logged := lalog.Redact("failed to deliver report - " + apiErr.Error()); strings.Contains(logged, "dummy-telegram-token") {
+		t.Fatal(logged)
+	}
+}
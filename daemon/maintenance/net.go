@@ -2,6 +2,11 @@ package maintenance
 
 import (
 	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -90,3 +95,216 @@ func (daemon *Daemon) MaintainsIptables(out *bytes.Buffer) {
 	}
 	// Do not touch NAT and Forward as they might have been manipulated by docker daemon
 }
+
+const (
+	// FirewallSSHPort is the default TCP port of SSH server, it is allowed by the host firewall lock-down.
+	FirewallSSHPort = 22
+	// SSHDConfigPath is the configuration file of the host's SSH server, its ports are allowed by the host firewall lock-down.
+	SSHDConfigPath = "/etc/ssh/sshd_config"
+	// WindowsSSHDConfigPath is the configuration file of the OpenSSH server on Windows.
+	WindowsSSHDConfigPath = `C:\ProgramData\ssh\sshd_config`
+	// FirewallRDPPort is the TCP port of Windows remote desktop, it is always allowed by the host firewall lock-down on Windows.
+	FirewallRDPPort = 3389
+	/*
+		FirewallRuleName is the name of nftables table, iptables chain, and Windows Firewall rules created by the host
+		firewall lock-down.
+	*/
+	FirewallRuleName = "laitos"
+)
+
+// uniquePorts returns the valid port numbers among the input, sorted and without duplicates.
+func uniquePorts(ports []int) (ret []int) {
+	seen := make(map[int]bool)
+	for _, port := range ports {
+		if port > 0 && port < 65536 && !seen[port] {
+			seen[port] = true
+			ret = append(ret, port)
+		}
+	}
+	sort.Ints(ret)
+	return
+}
+
+// joinPorts returns the port numbers joined by the separator.
+func joinPorts(ports []int, separator string) string {
+	strs := make([]string, len(ports))
+	for i, port := range ports {
+		strs[i] = strconv.Itoa(port)
+	}
+	return strings.Join(strs, separator)
+}
+
+// getSSHDPorts returns the ports specified by the Port directives in the content of sshd configuration file.
+func getSSHDPorts(sshdConfig string) (ret []int) {
+	for _, line := range strings.Split(sshdConfig, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && strings.EqualFold(fields[0], "Port") {
+			if port, err := strconv.Atoi(fields[1]); err == nil {
+				ret = append(ret, port)
+			}
+		}
+	}
+	return
+}
+
+/*
+getFirewallSSHPorts returns the TCP ports of the host's SSH server to be allowed by the host firewall lock-down. They
+come from FirewallSSHPorts, or the sshd configuration file, or the default SSH port 22 in the absence of both.
+*/
+func (daemon *Daemon) getFirewallSSHPorts() []int {
+	if len(daemon.FirewallSSHPorts) > 0 {
+		return daemon.FirewallSSHPorts
+	}
+	configPath := SSHDConfigPath
+	if misc.HostIsWindows() {
+		configPath = WindowsSSHDConfigPath
+	}
+	if content, err := ioutil.ReadFile(configPath); err == nil {
+		if ports := getSSHDPorts(string(content)); len(ports) > 0 {
+			return ports
+		}
+	}
+	return []int{FirewallSSHPort}
+}
+
+/*
+getNftablesRuleset returns an nftables ruleset that replaces the laitos table with an input chain that drops all
+incoming traffic except the TCP and UDP ports, ICMP, localhost, and established connections.
+*/
+func getNftablesRuleset(tcpPorts, udpPorts []int) string {
+	var ruleset bytes.Buffer
+	// Creating the table before deleting it makes the deletion succeed even if the table did not exist
+	ruleset.WriteString(fmt.Sprintf("table inet %s\ndelete table inet %s\n", FirewallRuleName, FirewallRuleName))
+	ruleset.WriteString(fmt.Sprintf("table inet %s {\n\tchain input {\n", FirewallRuleName))
+	ruleset.WriteString("\t\ttype filter hook input priority 0; policy drop;\n")
+	ruleset.WriteString("\t\tct state invalid drop\n")
+	ruleset.WriteString("\t\tct state established,related accept\n")
+	ruleset.WriteString("\t\tiif lo accept\n")
+	ruleset.WriteString("\t\tmeta l4proto { icmp, ipv6-icmp } accept\n")
+	if len(tcpPorts) > 0 {
+		ruleset.WriteString(fmt.Sprintf("\t\ttcp dport { %s } accept\n", joinPorts(tcpPorts, ", ")))
+	}
+	if len(udpPorts) > 0 {
+		ruleset.WriteString(fmt.Sprintf("\t\tudp dport { %s } accept\n", joinPorts(udpPorts, ", ")))
+	}
+	ruleset.WriteString("\t}\n}\n")
+	return ruleset.String()
+}
+
+/*
+getIptablesCommands returns iptables (or ip6tables) commands that fill the laitos chain with rules that drop all
+incoming traffic except the TCP and UDP ports, ICMP, localhost, and established connections. The rules of INPUT chain
+are left intact. The accepting rules come before the dropping rule, so that an interrupted setup does not lock out the
+administrator. The chain must have been created, and it is hooked into INPUT chain afterwards.
+*/
+func getIptablesCommands(tcpPorts, udpPorts []int, ipv6 bool) [][]string {
+	icmp := "icmp"
+	if ipv6 {
+		icmp = "ipv6-icmp"
+	}
+	cmds := [][]string{
+		{"-F", FirewallRuleName},
+		{"-A", FirewallRuleName, "-m", "conntrack", "--ctstate", "INVALID", "-j", "DROP"},
+		{"-A", FirewallRuleName, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+		{"-A", FirewallRuleName, "-i", "lo", "-j", "ACCEPT"},
+		{"-A", FirewallRuleName, "-p", icmp, "-j", "ACCEPT"},
+	}
+	for _, port := range tcpPorts {
+		cmds = append(cmds, []string{"-A", FirewallRuleName, "-p", "tcp", "--dport", strconv.Itoa(port), "-j", "ACCEPT"})
+	}
+	for _, port := range udpPorts {
+		cmds = append(cmds, []string{"-A", FirewallRuleName, "-p", "udp", "--dport", strconv.Itoa(port), "-j", "ACCEPT"})
+	}
+	return append(cmds, []string{"-A", FirewallRuleName, "-j", "DROP"})
+}
+
+/*
+lockDownIptables programs the laitos chain of iptables (or ip6tables) and hooks it into the beginning of INPUT chain.
+If a step fails, the fail safe unhooks and removes the laitos chain to permit all incoming traffic again.
+*/
+func (daemon *Daemon) lockDownIptables(out *bytes.Buffer, program string, tcpPorts, udpPorts []int) {
+	env := []string{"PATH=" + platform.CommonPATH}
+	// Creating the chain fails harmlessly if the chain already exists
+	_, _ = platform.InvokeProgram(env, misc.CommonOSCmdTimeoutSec, program, "-N", FirewallRuleName)
+	cmds := getIptablesCommands(tcpPorts, udpPorts, program == "ip6tables")
+	// Hook the chain into INPUT chain unless it has been hooked by an earlier lock-down
+	if _, err := platform.InvokeProgram(env, misc.CommonOSCmdTimeoutSec, program, "-C", "INPUT", "-j", FirewallRuleName); err != nil {
+		cmds = append(cmds, []string{"-I", "INPUT", "-j", FirewallRuleName})
+	}
+	for _, args := range cmds {
+		ipOut, ipErr := platform.InvokeProgram(env, misc.CommonOSCmdTimeoutSec, program, args...)
+		if ipErr == nil {
+			continue
+		}
+		daemon.logPrintStageStep(out, "%s command failed for \"%s\" - %v - %s", program, strings.Join(args, " "), ipErr, ipOut)
+		// Fail safe removes the chain to permit all incoming traffic. The chain may have been hooked more than once.
+		for i := 0; i < 10; i++ {
+			if _, err := platform.InvokeProgram(env, misc.CommonOSCmdTimeoutSec, program, "-D", "INPUT", "-j", FirewallRuleName); err != nil {
+				break
+			}
+		}
+		_, _ = platform.InvokeProgram(env, misc.CommonOSCmdTimeoutSec, program, "-F", FirewallRuleName)
+		ipOut, ipErr = platform.InvokeProgram(env, misc.CommonOSCmdTimeoutSec, program, "-X", FirewallRuleName)
+		daemon.logPrintStageStep(out, "WARNING: %s fail safe removed the %s chain and allows ALL incoming traffic - %v - %s", program, FirewallRuleName, ipErr, ipOut)
+		return
+	}
+}
+
+/*
+LockDownHostFirewall programs the host firewall to block all incoming traffic except the ports of enabled laitos
+daemons and remote administration, so that a freshly created server is locked down automatically. On Linux the rules
+are programmed via nftables, or iptables if nftables is not available. On Windows the rules are programmed via Windows
+Firewall.
+*/
+func (daemon *Daemon) LockDownHostFirewall(out *bytes.Buffer) {
+	if !daemon.LockDownFirewall {
+		return
+	}
+	if len(daemon.BlockPortsExcept) > 0 {
+		daemon.logPrintStage(out, "skipped because BlockPortsExcept is in use: lock down host firewall")
+		return
+	}
+	tcpPorts := uniquePorts(append(daemon.getFirewallSSHPorts(), daemon.FirewallTCPPorts...))
+	udpPorts := uniquePorts(daemon.FirewallUDPPorts)
+	if misc.HostIsWindows() {
+		daemon.lockDownWindowsFirewall(out, uniquePorts(append(tcpPorts, FirewallRDPPort)), udpPorts)
+		return
+	}
+	if runtime.GOOS != "linux" {
+		daemon.logPrintStage(out, "skipped on non-Linux: lock down host firewall")
+		return
+	}
+	daemon.logPrintStage(out, "lock down host firewall to allow TCP ports %v and UDP ports %v", tcpPorts, udpPorts)
+	if _, err := exec.LookPath("nft"); err == nil {
+		nftOut, nftErr := platform.InvokeProgramWithOptions(platform.ProgramOptions{Stdin: strings.NewReader(getNftablesRuleset(tcpPorts, udpPorts))},
+			[]string{"PATH=" + platform.CommonPATH}, misc.CommonOSCmdTimeoutSec, "nft", "-f", "-")
+		daemon.logPrintStageStep(out, "nftables - %v - %s", nftErr, nftOut)
+		if nftErr == nil {
+			return
+		}
+	}
+	for _, program := range []string{"iptables", "ip6tables"} {
+		daemon.lockDownIptables(out, program, tcpPorts, udpPorts)
+	}
+}
+
+// lockDownWindowsFirewall turns on Windows Firewall to block all incoming traffic except the TCP and UDP ports.
+func (daemon *Daemon) lockDownWindowsFirewall(out *bytes.Buffer, tcpPorts, udpPorts []int) {
+	daemon.logPrintStage(out, "lock down windows firewall to allow TCP ports %v and UDP ports %v", tcpPorts, udpPorts)
+	netsh := [][]string{
+		// The rule deletion fails harmlessly if the rules did not exist
+		{"advfirewall", "firewall", "delete", "rule", "name=" + FirewallRuleName},
+		{"advfirewall", "firewall", "add", "rule", "name=" + FirewallRuleName, "dir=in", "action=allow", "protocol=TCP", "localport=" + joinPorts(tcpPorts, ",")},
+	}
+	if len(udpPorts) > 0 {
+		netsh = append(netsh, []string{"advfirewall", "firewall", "add", "rule", "name=" + FirewallRuleName, "dir=in", "action=allow", "protocol=UDP", "localport=" + joinPorts(udpPorts, ",")})
+	}
+	netsh = append(netsh,
+		[]string{"advfirewall", "set", "allprofiles", "firewallpolicy", "blockinbound,allowoutbound"},
+		[]string{"advfirewall", "set", "allprofiles", "state", "on"},
+	)
+	for _, args := range netsh {
+		netshOut, netshErr := platform.InvokeProgram(nil, misc.CommonOSCmdTimeoutSec, `C:\Windows\system32\netsh.exe`, args...)
+		daemon.logPrintStageStep(out, "netsh %s - %v - %s", strings.Join(args, " "), netshErr, strings.TrimSpace(netshOut))
+	}
+}
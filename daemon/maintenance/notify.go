@@ -0,0 +1,224 @@
+package maintenance
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+const (
+	// ReportSeverityInfo delivers every maintenance report to a channel.
+	ReportSeverityInfo = "info"
+	// ReportSeverityWarning delivers a maintenance report to a channel only if the report contains errors.
+	ReportSeverityWarning = "warning"
+	// ReportChannelTimeoutSec is the timeout of HTTP requests made to deliver a report.
+	ReportChannelTimeoutSec = 30
+	// MaxChatMessageLength is the maximum length of a report delivered to telegram and matrix chats.
+	MaxChatMessageLength = 4096
+)
+
+/*
+ReportChannel delivers maintenance reports and alerts to a destination other than email. Chat channels receive the
+summary, whereas webhooks receive both the summary and the full report.
+*/
+type ReportChannel interface {
+	// Initialise validates the channel configuration.
+	Initialise() error
+	// GetSeverity returns the severity threshold of the channel, either ReportSeverityInfo or ReportSeverityWarning.
+	GetSeverity() string
+	// Deliver sends the report to the channel.
+	Deliver(ok bool, subject, summary, report string) error
+}
+
+// initialiseSeverity validates the severity threshold and sets its default value.
+func initialiseSeverity(severity *string) error {
+	switch *severity {
+	case "":
+		*severity = ReportSeverityInfo
+	case ReportSeverityInfo, ReportSeverityWarning:
+	default:
+		return fmt.Errorf("Severity must be either \"%s\" or \"%s\"", ReportSeverityInfo, ReportSeverityWarning)
+	}
+	return nil
+}
+
+// TelegramReport delivers reports to a telegram chat via a telegram chat bot.
+type TelegramReport struct {
+	AuthorizationToken string `json:"AuthorizationToken"` // AuthorizationToken is the token of the telegram chat bot.
+	ChatID             int64  `json:"ChatID"`             // ChatID is the numeric ID of the chat to send reports to.
+	Severity           string `json:"Severity"`           // Severity is the threshold of reports to deliver.
+}
+
+func (tg *TelegramReport) Initialise() error {
+	if tg.AuthorizationToken == "" || tg.ChatID == 0 {
+		return errors.New("telegram report channel must have AuthorizationToken and ChatID")
+	}
+	// The URL of API calls carries the authorization token, keep it out of the log messages.
+	lalog.RegisterRedaction(tg.AuthorizationToken)
+	return initialiseSeverity(&tg.Severity)
+}
+
+func (tg *TelegramReport) GetSeverity() string {
+	return tg.Severity
+}
+
+func (tg *TelegramReport) Deliver(ok bool, subject, summary, report string) error {
+	resp, err := inet.DoHTTP(inet.HTTPRequest{
+		Method:     "POST",
+		TimeoutSec: ReportChannelTimeoutSec,
+		Body: strings.NewReader(url.Values{
+			"chat_id": []string{strconv.FormatInt(tg.ChatID, 10)},
+			"text":    []string{lalog.TruncateString(subject+"\n"+summary, MaxChatMessageLength)},
+		}.Encode()),
+	}, "https://api.telegram.org/bot%s/sendMessage", tg.AuthorizationToken)
+	if err == nil {
+		err = resp.Non2xxToError()
+	}
+	return tg.redactToken(err)
+}
+
+// redactToken removes the authorization token from the error of an API call, which may carry the API URL.
+func (tg *TelegramReport) redactToken(err error) error {
+	if err == nil || tg.AuthorizationToken == "" || !strings.Contains(err.Error(), tg.AuthorizationToken) {
+		return err
+	}
+	return errors.New(strings.Replace(err.Error(), tg.AuthorizationToken, lalog.RedactedLabel, -1))
+}
+
+// MatrixReport delivers reports to a matrix chat room.
+type MatrixReport struct {
+	HomeServerURL string `json:"HomeServerURL"` // HomeServerURL is the base URL of the matrix home server, e.g. https://matrix.org.
+	AccessToken   string `json:"AccessToken"`   // AccessToken is the access token of the matrix user who sends reports.
+	RoomID        string `json:"RoomID"`        // RoomID is the ID of the room to send reports to, e.g. !abcdefg:matrix.org.
+	Severity      string `json:"Severity"`      // Severity is the threshold of reports to deliver.
+}
+
+func (matrix *MatrixReport) Initialise() error {
+	if matrix.HomeServerURL == "" || matrix.AccessToken == "" || matrix.RoomID == "" {
+		return errors.New("matrix report channel must have HomeServerURL, AccessToken, and RoomID")
+	}
+	matrix.HomeServerURL = strings.TrimSuffix(matrix.HomeServerURL, "/")
+	return initialiseSeverity(&matrix.Severity)
+}
+
+func (matrix *MatrixReport) GetSeverity() string {
+	return matrix.Severity
+}
+
+func (matrix *MatrixReport) Deliver(ok bool, subject, summary, report string) error {
+	body, err := json.Marshal(map[string]string{
+		"msgtype": "m.text",
+		"body":    lalog.TruncateString(subject+"\n"+summary, MaxChatMessageLength),
+	})
+	if err != nil {
+		return err
+	}
+	// Each message is identified by a transaction ID unique to the access token
+	txnID := "laitos-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	resp, err := inet.DoHTTP(inet.HTTPRequest{
+		Method:      "PUT",
+		TimeoutSec:  ReportChannelTimeoutSec,
+		ContentType: "application/json",
+		Header:      map[string][]string{"Authorization": {"Bearer " + matrix.AccessToken}},
+		Body:        bytes.NewReader(body),
+	}, strings.Replace(matrix.HomeServerURL, "%", "%%", -1)+"/_matrix/client/r0/rooms/%s/send/m.room.message/%s", matrix.RoomID, txnID)
+	if err == nil {
+		err = resp.Non2xxToError()
+	}
+	return err
+}
+
+// WebhookReport delivers reports to a web hook in a JSON POST request.
+type WebhookReport struct {
+	URL string `json:"URL"` // URL is the address of the web hook.
+	// Header contains additional request headers, such as an authorization header expected by the web hook.
+	Header   map[string]string `json:"Header"`
+	Severity string            `json:"Severity"` // Severity is the threshold of reports to deliver.
+}
+
+// WebhookReportBody is the JSON object POSTed to a web hook.
+type WebhookReportBody struct {
+	Host    string `json:"Host"`    // Host is the host name of the laitos server.
+	OK      bool   `json:"OK"`      // OK is true only if the report does not contain errors.
+	Subject string `json:"Subject"` // Subject is the title of the report.
+	Summary string `json:"Summary"` // Summary is the brief report that comprises errors.
+	Report  string `json:"Report"`  // Report is the full maintenance report.
+}
+
+func (hook *WebhookReport) Initialise() error {
+	if hook.URL == "" {
+		return errors.New("web hook report channel must have URL")
+	}
+	return initialiseSeverity(&hook.Severity)
+}
+
+func (hook *WebhookReport) GetSeverity() string {
+	return hook.Severity
+}
+
+func (hook *WebhookReport) Deliver(ok bool, subject, summary, report string) error {
+	hostName, _ := os.Hostname()
+	body, err := json.Marshal(WebhookReportBody{
+		Host:    hostName,
+		OK:      ok,
+		Subject: subject,
+		Summary: summary,
+		Report:  report,
+	})
+	if err != nil {
+		return err
+	}
+	header := make(map[string][]string)
+	for key, value := range hook.Header {
+		header[key] = []string{value}
+	}
+	resp, err := inet.DoHTTP(inet.HTTPRequest{
+		Method:      "POST",
+		TimeoutSec:  ReportChannelTimeoutSec,
+		ContentType: "application/json",
+		Header:      header,
+		Body:        bytes.NewReader(body),
+	}, strings.Replace(hook.URL, "%", "%%", -1))
+	if err == nil {
+		err = resp.Non2xxToError()
+	}
+	return err
+}
+
+// getReportChannels returns all configured report channels other than email.
+func (daemon *Daemon) getReportChannels() (channels []ReportChannel) {
+	for i := range daemon.ReportTelegram {
+		channels = append(channels, &daemon.ReportTelegram[i])
+	}
+	for i := range daemon.ReportMatrix {
+		channels = append(channels, &daemon.ReportMatrix[i])
+	}
+	for i := range daemon.ReportWebhooks {
+		channels = append(channels, &daemon.ReportWebhooks[i])
+	}
+	return
+}
+
+/*
+deliverToChannels delivers the report to the channels whose severity threshold is met. Reports without errors are
+delivered only to the channels of ReportSeverityInfo.
+*/
+func (daemon *Daemon) deliverToChannels(ok bool, subject, summary, report string) {
+	for _, channel := range daemon.getReportChannels() {
+		if ok && channel.GetSeverity() != ReportSeverityInfo {
+			continue
+		}
+		if err := channel.Deliver(ok, subject, summary, report); err != nil {
+			daemon.logger.Warning("deliverToChannels", fmt.Sprintf("%T", channel), err, "failed to deliver report")
+		}
+	}
+}
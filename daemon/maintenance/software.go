@@ -254,7 +254,7 @@ func (daemon *Daemon) InstallSoftware(out *bytes.Buffer) {
 		"mailutils", "mailx", "minicom", "miscfiles", "moreutils", "mosh",
 		"nc", "netcat", "net-snmp", "net-snmp-utils", "net-tools", "nicstat", "nmap", "nmon", "nping",
 		"p7zip", "patchutils", "pciutils", "perf", "procps", "psmisc", "rsync",
-		"screen", "sensors", "snmp", "socat", "strace", "sudo", "sysinternals",
+		"screen", "sensors", "smartmontools", "snmp", "socat", "strace", "sudo", "sysinternals",
 		"tcpdump", "tcptraceroute", "telnet", "tmux", "tracepath", "traceroute", "tree", "tshark",
 		"unar", "uniutils", "unzip", "usbutils", "util-linux", "util-linux-user", "util-linux-locales", "vim", "wbritish", "wbritish-huge",
 		"wget", "whois", "wiggle", "yamllint", "zip",
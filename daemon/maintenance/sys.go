@@ -19,8 +19,36 @@ const (
 	SwapFilePath = "/laitos-swap-file"
 )
 
+/*
+AdjustSystemClock measures the offset of system clock against NTP servers, and then corrects the offset by stepping or
+slewing the clock according to configuration. TOTP-based features rely on an accurate system clock.
+*/
+func (daemon *Daemon) AdjustSystemClock(out *bytes.Buffer) {
+	daemon.logPrintStage(out, "measure clock offset")
+	result, err := misc.GetClockOffset(daemon.NTPServers, misc.NTPTimeoutSec)
+	if err != nil {
+		daemon.logPrintStageStep(out, "failed to query NTP servers: %v", err)
+		return
+	}
+	daemon.logPrintStageStep(out, "clock offset is %s according to %s (stratum %d, round trip %s)",
+		result.Offset.String(), result.Server, result.Stratum, result.RTT.String())
+	absOffset := result.Offset
+	if absOffset < 0 {
+		absOffset = -absOffset
+	}
+	if daemon.AdjustClock == "" || absOffset < MinClockAdjustment {
+		return
+	}
+	if daemon.AdjustClock == ClockAdjustSlew && absOffset <= MaxClockSlew {
+		daemon.logPrintStageStep(out, "slew clock by %s: %v", result.Offset.String(), platform.SlewSystemClock(result.Offset))
+	} else {
+		daemon.logPrintStageStep(out, "step clock by %s: %v", result.Offset.String(), platform.StepSystemClock(result.Offset))
+	}
+}
+
 // SynchroniseSystemClock uses three different tools to immediately synchronise system clock via NTP servers.
 func (daemon *Daemon) SynchroniseSystemClock(out *bytes.Buffer) {
+	daemon.AdjustSystemClock(out)
 	daemon.logPrintStage(out, "synchronise clock")
 	if misc.HostIsWindows() {
 		result, err := platform.InvokeProgram(nil, 120, `C:\Windows\system32\w32tm.exe`, "/config", `/manualpeerlist:"0.pool.ntp.org sg.pool.ntp.org us.pool.ntp.org fi.pool.ntp.org"`, "/syncfromflags:manual", "/reliable:yes", "/update")
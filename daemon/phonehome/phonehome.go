@@ -38,8 +38,23 @@ type MessageProcessorServer struct {
 	DNSDomainName string `json:"DNSDomainName"`
 	// Password is the password PIN that the server accepts for command execution.
 	Password string `json:"Password"`
+	/*
+		KeyID identifies this subject to the server when reports are sealed by SharedKey or ServerPublicKey. The server
+		stores the sealed reports under the key ID instead of the self-reported host name.
+	*/
+	KeyID string `json:"KeyID"`
+	// SharedKey is the pre-shared key that encrypts and authenticates the reports and responses exchanged with the server.
+	SharedKey string `json:"SharedKey"`
+	/*
+		ServerPublicKey is the base64-encoded X25519 public key of the server. Together with the daemon's private key,
+		it encrypts and authenticates the reports and responses exchanged with the server.
+	*/
+	ServerPublicKey string `json:"ServerPublicKey"`
 	// HostName is the host name portion of server app command execution URL, it is calculated by Initialise function.
 	HostName string `json:"-"`
+
+	// reportKey seals the reports sent to the server, it is nil if reports are sent in plain.
+	reportKey *toolbox.ReportKey
 }
 
 /*
@@ -52,6 +67,8 @@ type Daemon struct {
 
 	// ReportIntervalSec is the interval in seconds at which this daemon reports to the servers.
 	ReportIntervalSec int `json:"ReportIntervalSec"`
+	// PrivateKey is the base64-encoded X25519 private key of this subject, used with the servers that have ServerPublicKey.
+	PrivateKey string `json:"PrivateKey"`
 
 	// LocalMessageProcessor answers to servers' app command requests
 	LocalMessageProcessor *toolbox.MessageProcessor `json:"-"`
@@ -104,6 +121,21 @@ func (daemon *Daemon) Initialise() error {
 			}
 			srv.HostName = u.Hostname()
 		}
+		srv.reportKey = nil
+		var err error
+		if srv.SharedKey != "" && srv.ServerPublicKey != "" {
+			return fmt.Errorf("phonehome.Initialise: server configuration for %s must not have both SharedKey and ServerPublicKey", srv.HostName)
+		} else if srv.SharedKey != "" {
+			srv.reportKey, err = toolbox.NewSharedReportKey(srv.KeyID, srv.SharedKey)
+		} else if srv.ServerPublicKey != "" {
+			if daemon.PrivateKey == "" {
+				return fmt.Errorf("phonehome.Initialise: PrivateKey must be present to use the ServerPublicKey of %s", srv.HostName)
+			}
+			srv.reportKey, err = toolbox.NewPublicReportKey(srv.KeyID, daemon.PrivateKey, srv.ServerPublicKey)
+		}
+		if err != nil {
+			return fmt.Errorf("phonehome.Initialise: server configuration for %s has an invalid key - %v", srv.HostName, err)
+		}
 	}
 	daemon.logger = lalog.Logger{ComponentName: "phonehome"}
 	return nil
@@ -149,6 +181,30 @@ func (daemon *Daemon) getReportForServer(serverHostName string, shortenMyHostNam
 	return report.SerialiseCompact()
 }
 
+/*
+getReportCmd returns the app command that carries the latest report to the server. If the server uses a key, the
+report is sealed, and the nonce of the sealed report is returned for opening the server response.
+*/
+func (daemon *Daemon) getReportCmd(srv *MessageProcessorServer, viaDNS bool) (reportCmd string, nonce []byte, err error) {
+	cmdPrefix := daemon.getTwoFACode(srv) + toolbox.StoreAndForwardMessageProcessorTrigger
+	report := daemon.getReportForServer(srv.HostName, viaDNS)
+	if srv.reportKey == nil {
+		return cmdPrefix + report, nil, nil
+	}
+	maxLen := 0
+	if viaDNS {
+		// The sealed report cannot be truncated by GetDNSQuery, work out its maximum length in advance.
+		labelsCapacity := 246 - len(srv.DNSDomainName)
+		// Each label of up to 60 characters is followed by a full-stop
+		maxLen = labelsCapacity - (labelsCapacity+60)/61 - len(EncodeToDTMF(cmdPrefix+srv.reportKey.SealedReportPrefix()))
+	}
+	sealed, nonce, err := srv.reportKey.SealReport(report, maxLen)
+	if err != nil {
+		return "", nil, err
+	}
+	return cmdPrefix + sealed, nonce, nil
+}
+
 // StartAndBlock starts the periodic reports and blocks caller until the daemon is stopped.
 func (daemon *Daemon) StartAndBlock() error {
 	defer func() {
@@ -190,9 +246,13 @@ func (daemon *Daemon) StartAndBlock() error {
 			time.Sleep(time.Duration(intervalSecBetweenReports) * time.Second)
 			srv := daemon.MessageProcessorServers[i]
 			var reportResponseJSON []byte
+			reportCmd, reportNonce, err := daemon.getReportCmd(srv, srv.DNSDomainName != "")
+			if err != nil {
+				daemon.logger.Warning("StartAndBlock", srv.HostName, err, "failed to seal the report")
+				continue
+			}
 			if srv.DNSDomainName != "" {
 				// Send the latest report via DNS name query
-				reportCmd := daemon.getTwoFACode(srv) + toolbox.StoreAndForwardMessageProcessorTrigger + daemon.getReportForServer(srv.HostName, true)
 				queryResponse, err := net.LookupTXT(GetDNSQuery(reportCmd, srv.DNSDomainName))
 				if err != nil {
 					daemon.logger.Warning("StartAndBlock", srv.DNSDomainName, err, "failed to send DNS request")
@@ -201,7 +261,6 @@ func (daemon *Daemon) StartAndBlock() error {
 				reportResponseJSON = []byte(strings.Join(queryResponse, ""))
 			} else if srv.HTTPEndpointURL != "" {
 				// Send the latest report via HTTP client
-				reportCmd := daemon.getTwoFACode(srv) + toolbox.StoreAndForwardMessageProcessorTrigger + daemon.getReportForServer(srv.HostName, false)
 				resp, err := inet.DoHTTP(inet.HTTPRequest{
 					TimeoutSec: 15,
 					MaxBytes:   16 * 1024,
@@ -214,6 +273,13 @@ func (daemon *Daemon) StartAndBlock() error {
 				}
 				reportResponseJSON = resp.Body
 			}
+			if srv.reportKey != nil {
+				// Only trust the response that is sealed by the same key
+				if reportResponseJSON, err = srv.reportKey.OpenResponse(string(reportResponseJSON), reportNonce); err != nil {
+					daemon.logger.Warning("StartAndBlock", srv.HostName, err, "failed to open the sealed report response")
+					continue
+				}
+			}
 			// Deserialise the server JSON response and pass it to local message processor to process the command request
 			var reportResponse toolbox.SubjectReportResponse
 			if err := json.Unmarshal(reportResponseJSON, &reportResponse); err != nil {
@@ -251,7 +317,7 @@ func TestServer(server *Daemon, t testingstub.T) {
 			if muxNumRequests == 0 {
 				// The first request is expected to be a regular report
 				reqCmd := r.FormValue("cmd")
-				result := muxMessageProcessor.Execute(toolbox.Command{
+				result := muxMessageProcessor.Execute(r.Context(), toolbox.Command{
 					Content:    reqCmd[strings.Index(reqCmd, ".0m")+3:],
 					TimeoutSec: 2,
 					ClientID:   r.RemoteAddr,
@@ -292,7 +358,7 @@ func TestServer(server *Daemon, t testingstub.T) {
 			} else if muxNumRequests == 1 {
 				// The second request is a report that carries the app execution result from the app command.
 				reqCmd := r.FormValue("cmd")
-				result := muxMessageProcessor.Execute(toolbox.Command{
+				result := muxMessageProcessor.Execute(r.Context(), toolbox.Command{
 					Content:    reqCmd[strings.Index(reqCmd, ".0m")+3:],
 					TimeoutSec: 2,
 					ClientID:   r.RemoteAddr,
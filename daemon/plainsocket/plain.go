@@ -1,18 +1,22 @@
 /*
 plainsocket implements a Telnet-comaptible network service to provide unencrypted, plain-text access to all toolbox features.
 Due to the unencrypted nature of this communication, users are strongly advised to utilise this service only as a last resort.
-The implementation supports UDP as carrier of conversation in addition to TCP.
+The implementation supports UDP as carrier of conversation in addition to TCP, and optionally serves the same conversation
+over TLS on a separate TCP port.
 */
 package plainsocket
 
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/textproto"
+	"os"
 	"strconv"
 	"time"
 
@@ -24,22 +28,59 @@ import (
 	"github.com/HouzuoGuo/laitos/misc"
 )
 
+var (
+	// statsTCP times the TCP, TLS, and Unix domain socket conversations.
+	statsTCP = misc.GetStats("plainsocket.TCP")
+	// statsUDP times the UDP conversations.
+	statsUDP = misc.GetStats("plainsocket.UDP")
+)
+
 const (
 	IOTimeoutSec         = 60               // If a conversation goes silent for this many seconds, the connection is terminated.
 	CommandTimeoutSec    = IOTimeoutSec - 1 // Command execution times out after this manys econds
 	RateLimitIntervalSec = 1                // Rate limit is calculated at 1 second interval
+
+	DefaultSessionIdleTimeoutSec = 10 * 60 // DefaultSessionIdleTimeoutSec is the default idle timeout of interactive sessions.
+	DefaultSessionPageLines      = 20      // DefaultSessionPageLines is the default number of output lines delivered at a time in interactive sessions.
 )
 
 // Daemon implements a Telnet-compatible service to provide unencrypted, plain-text access to all toolbox features, via both TCP and UDP.
 type Daemon struct {
-	Address    string                    `json:"Address"`    // Network address for both TCP and UDP to listen to, e.g. 0.0.0.0 for all network interfaces.
-	TCPPort    int                       `json:"TCPPort"`    // TCP port to listen on
-	UDPPort    int                       `json:"UDPPort"`    // UDP port to listen on
-	PerIPLimit int                       `json:"PerIPLimit"` // PerIPLimit is approximately how many concurrent users are expected to be using the server from same IP address
-	Processor  *toolbox.CommandProcessor `json:"-"`          // Feature command processor
+	Address     string                    `json:"Address"`     // Network address for both TCP and UDP to listen to, e.g. 0.0.0.0 for all network interfaces.
+	TCPPort     int                       `json:"TCPPort"`     // TCP port to listen on
+	UDPPort     int                       `json:"UDPPort"`     // UDP port to listen on
+	PerIPLimit  int                       `json:"PerIPLimit"`  // PerIPLimit is approximately how many concurrent users are expected to be using the server from same IP address
+	GlobalLimit int                       `json:"GlobalLimit"` // GlobalLimit is the maximum number of conversations acceptable from all clients combined per second, 0 means unlimited.
+	Processor   *toolbox.CommandProcessor `json:"-"`           // Feature command processor
+
+	TLSPort     int    `json:"TLSPort"`     // TLSPort is the TCP port to listen on for conversations over TLS.
+	TLSCertPath string `json:"TLSCertPath"` // TLSCertPath is the path to PEM-encoded TLS certificate of the TLS listener.
+	TLSKeyPath  string `json:"TLSKeyPath"`  // TLSKeyPath is the path to PEM-encoded TLS certificate key of the TLS listener.
+	/*
+		TLSClientCAPath is the path to PEM-encoded certificates of the certificate authorities that issue client certificates.
+		If it is set, the TLS listener only converses with the clients that present a certificate issued by these authorities.
+	*/
+	TLSClientCAPath string `json:"TLSClientCAPath"`
 
-	tcpServer *common.TCPServer
-	udpServer *common.UDPServer
+	// UnixSocketPath is the path of a Unix domain socket to listen on for conversations with local programs.
+	UnixSocketPath string `json:"UnixSocketPath"`
+	// UnixSocketPerm is the octal file permission of the Unix domain socket, e.g. "0660" (default to "0600").
+	UnixSocketPerm string `json:"UnixSocketPerm"`
+
+	/*
+		SessionMode turns TCP and TLS conversations into interactive sessions. The client logs in with the password PIN
+		once, and then types app commands without the PIN, recalls earlier commands, and reads long outputs page by page.
+		UDP conversations are not affected.
+	*/
+	SessionMode           bool `json:"SessionMode"`
+	SessionIdleTimeoutSec int  `json:"SessionIdleTimeoutSec"` // SessionIdleTimeoutSec disconnects an interactive session that goes silent for this many seconds.
+	SessionPageLines      int  `json:"SessionPageLines"`      // SessionPageLines is the number of output lines delivered at a time in interactive sessions.
+
+	tcpServer  *common.TCPServer
+	udpServer  *common.UDPServer
+	tlsServer  *common.TCPServer
+	tlsConfig  *tls.Config
+	certLoader *common.CertificateLoader // certLoader serves the TLS certificate and reloads it after renewal.
 }
 
 // Initialise validates configuration and initialises internal states.
@@ -56,28 +97,72 @@ func (daemon *Daemon) Initialise() error {
 	if daemon.PerIPLimit < 1 {
 		daemon.PerIPLimit = 3 // reasonable for personal use
 	}
-	if daemon.UDPPort < 1 && daemon.TCPPort < 1 {
-		// No reasonable defaults for these two, sorry.
-		return errors.New("plainsocket.Initialise: either or both TCP and UDP ports must be specified and be greater than 0")
+	if daemon.UDPPort < 1 && daemon.TCPPort < 1 && daemon.TLSPort < 1 && daemon.UnixSocketPath == "" {
+		// No reasonable defaults for these ports, sorry.
+		return errors.New("plainsocket.Initialise: either or both TCP and UDP ports, the TLS port, or the Unix socket path must be specified")
+	}
+	if daemon.UnixSocketPerm == "" {
+		daemon.UnixSocketPerm = "0600"
+	}
+	unixSocketPerm, err := strconv.ParseUint(daemon.UnixSocketPerm, 8, 32)
+	if err != nil || unixSocketPerm > 0777 {
+		return fmt.Errorf("plainsocket.Initialise: UnixSocketPerm \"%s\" must be an octal file permission such as 0660", daemon.UnixSocketPerm)
+	}
+	if daemon.SessionIdleTimeoutSec < 1 {
+		daemon.SessionIdleTimeoutSec = DefaultSessionIdleTimeoutSec
+	}
+	if daemon.SessionPageLines < 1 {
+		daemon.SessionPageLines = DefaultSessionPageLines
+	}
+	daemon.tlsConfig = nil
+	if daemon.TLSPort > 0 {
+		if err := daemon.initialiseTLS(); err != nil {
+			return err
+		}
+	}
+	daemon.tcpServer = common.NewTCPServer(daemon.Address, daemon.TCPPort, "plainsocket", daemon, daemon.PerIPLimit, daemon.GlobalLimit)
+	daemon.tcpServer.UnixSocketPath = daemon.UnixSocketPath
+	daemon.tcpServer.UnixSocketPerm = os.FileMode(unixSocketPerm)
+	daemon.udpServer = common.NewUDPServer(daemon.Address, daemon.UDPPort, "plainsocket", daemon, daemon.PerIPLimit, daemon.GlobalLimit)
+	daemon.tlsServer = common.NewTLSServer(daemon.Address, daemon.TLSPort, "plainsocket-tls", daemon, daemon.tlsConfig, daemon.PerIPLimit, daemon.GlobalLimit)
+	return nil
+}
+
+// initialiseTLS loads the TLS certificate, and the client certificate authorities if client certificates are to be verified.
+func (daemon *Daemon) initialiseTLS() (err error) {
+	if daemon.TLSCertPath == "" || daemon.TLSKeyPath == "" {
+		return errors.New("plainsocket.Initialise: TLSCertPath and TLSKeyPath must be specified to use TLSPort")
+	}
+	// The loader re-reads the certificate and key files after their modification time changes, and keeps the old certificate if the new files are unusable.
+	daemon.tlsConfig, daemon.certLoader, err = common.NewServerTLSConfig(daemon.TLSCertPath, daemon.TLSKeyPath, daemon.TLSClientCAPath)
+	if err != nil {
+		return fmt.Errorf("plainsocket.Initialise: %v", err)
 	}
-	daemon.tcpServer = common.NewTCPServer(daemon.Address, daemon.TCPPort, "plainsocket", daemon, daemon.PerIPLimit)
-	daemon.udpServer = common.NewUDPServer(daemon.Address, daemon.UDPPort, "plainsocket", daemon, daemon.PerIPLimit)
 	return nil
 }
 
 // GetTCPStatsCollector returns stats collector for the TCP server of this daemon.
 func (daemon *Daemon) GetTCPStatsCollector() *misc.Stats {
-	return misc.PlainSocketStatsTCP
+	return statsTCP
 }
 
 // HandleConnection converses with a TCP client.
 func (daemon *Daemon) HandleTCPConnection(logger lalog.Logger, ip string, conn *net.TCPConn) {
+	daemon.converse(logger, ip, conn, daemon.tcpServer)
+}
+
+// converse reads app commands line by line from a TCP or TLS client, and writes the execution results back to the client.
+func (daemon *Daemon) converse(logger lalog.Logger, ip string, conn net.Conn, srv *common.TCPServer) {
+	if daemon.SessionMode {
+		daemon.converseSession(logger, ip, conn, srv)
+		return
+	}
 	daemon.Processor.SetLogger(logger)
 	// Allow up to 1MB of commands to be received per connection
 	reader := textproto.NewReader(bufio.NewReader(io.LimitReader(conn, 1*1048576)))
 	for {
 		if misc.EmergencyLockDown {
-			logger.Warning("HandleTCPConnection", "", misc.ErrEmergencyLockDown, "")
+			logger.Warning("converse", "", misc.ErrEmergencyLockDown, "")
 			return
 		}
 		// Read one line of command that may be at most 1MB long
@@ -87,12 +172,12 @@ func (daemon *Daemon) HandleTCPConnection(logger lalog.Logger, ip string, conn *
 		line, err := reader.ReadLine()
 		if err != nil {
 			if err != io.EOF {
-				logger.Warning("HandleTCPConnection", ip, err, "failed to read from client")
+				logger.Warning("converse", ip, err, "failed to read from client")
 			}
 			return
 		}
 		// Check against conversation rate limit
-		if !daemon.tcpServer.AddAndCheckRateLimit(ip) {
+		if !srv.AddAndCheckRateLimit(ip) {
 			return
 		}
 		// Trim and ignore empty line
@@ -101,7 +186,7 @@ func (daemon *Daemon) HandleTCPConnection(logger lalog.Logger, ip string, conn *
 			continue
 		}
 		// Process line of command and respond
-		result := daemon.Processor.Process(toolbox.Command{
+		result := daemon.Processor.Process(context.Background(), toolbox.Command{
 			DaemonName: "plainsocket",
 			ClientID:   ip,
 			Content:    string(line),
@@ -117,9 +202,19 @@ func (daemon *Daemon) HandleTCPConnection(logger lalog.Logger, ip string, conn *
 	}
 }
 
+// HandleUnixConnection converses with a Unix domain socket client.
+func (daemon *Daemon) HandleUnixConnection(logger lalog.Logger, clientID string, conn *net.UnixConn) {
+	daemon.converse(logger, clientID, conn, daemon.tcpServer)
+}
+
+// HandleTLSConnection converses with a TLS client.
+func (daemon *Daemon) HandleTLSConnection(logger lalog.Logger, ip string, conn *tls.Conn) {
+	daemon.converse(logger, ip, conn, daemon.tlsServer)
+}
+
 // GetUDPStatsCollector returns stats collector for the UDP server of this daemon.
 func (daemon *Daemon) GetUDPStatsCollector() *misc.Stats {
-	return misc.PlainSocketStatsUDP
+	return statsUDP
 }
 
 // Read a feature command from each input line, then invoke the requested feature and write the execution result back to client.
@@ -149,7 +244,7 @@ func (daemon *Daemon) HandleUDPClient(logger lalog.Logger, ip string, client *ne
 			continue
 		}
 		// Process line of command and respond
-		result := daemon.Processor.Process(toolbox.Command{
+		result := daemon.Processor.Process(context.Background(), toolbox.Command{
 			DaemonName: "plainsocket",
 			ClientID:   ip,
 			Content:    string(line),
@@ -168,8 +263,15 @@ func (daemon *Daemon) HandleUDPClient(logger lalog.Logger, ip string, client *ne
 // StartAndBLock starts both TCP and UDP listeners. You may call this function only after having called Initialise().
 func (daemon *Daemon) StartAndBlock() error {
 	numListeners := 0
-	errChan := make(chan error, 2)
-	if daemon.TCPPort != 0 {
+	errChan := make(chan error, 3)
+	if daemon.TLSPort != 0 {
+		numListeners++
+		go func() {
+			err := daemon.tlsServer.StartAndBlock()
+			errChan <- err
+		}()
+	}
+	if daemon.TCPPort != 0 || daemon.UnixSocketPath != "" {
 		numListeners++
 		go func() {
 			err := daemon.tcpServer.StartAndBlock()
@@ -196,6 +298,7 @@ func (daemon *Daemon) StartAndBlock() error {
 func (daemon *Daemon) Stop() {
 	daemon.tcpServer.Stop()
 	daemon.udpServer.Stop()
+	daemon.tlsServer.Stop()
 }
 
 // TestServer contains the comprehensive test case for both TCP and UDP servers.
@@ -278,6 +381,10 @@ func TestServer(server *Daemon, t testingstub.T) {
 		t.Fatal(string(goodPINResp))
 	}
 
+	if server.TLSPort != 0 {
+		testTLS(server, t)
+	}
+
 	// Daemon should stop within a second
 	server.Stop()
 	time.Sleep(1 * time.Second)
@@ -288,3 +395,43 @@ func TestServer(server *Daemon, t testingstub.T) {
 	server.Stop()
 	server.Stop()
 }
+
+/*
+testTLS converses with the TLS listener. The test certificate of the daemon is self-signed, it doubles as the client
+certificate and the authority of client certificates.
+*/
+func testTLS(server *Daemon, t testingstub.T) {
+	cert, err := tls.LoadX509KeyPair(server.TLSCertPath, server.TLSKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without a client certificate, the conversation must not take place.
+	tlsClient, err := tls.Dial("tcp", "127.0.0.1:"+strconv.Itoa(server.TLSPort), &tls.Config{InsecureSkipVerify: true})
+	if err == nil {
+		_, _ = tlsClient.Write([]byte("verysecret .s echo hi\r\n"))
+		if resp, _, err := bufio.NewReader(tlsClient).ReadLine(); err == nil {
+			t.Fatal("should not have conversed without client certificate", string(resp))
+		}
+		_ = tlsClient.Close()
+	}
+	tlsClient, err = tls.Dial("tcp", "127.0.0.1:"+strconv.Itoa(server.TLSPort), &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = tlsClient.Close()
+	}()
+	reader := bufio.NewReader(tlsClient)
+	if _, err := tlsClient.Write([]byte("pin mismatch\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if badPINResp, _, err := reader.ReadLine(); err != nil || string(badPINResp) != toolbox.ErrPINAndShortcutNotFound.Error() {
+		t.Fatal(err, string(badPINResp))
+	}
+	if _, err := tlsClient.Write([]byte("verysecret .s echo hi\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if goodPINResp, _, err := reader.ReadLine(); err != nil || string(goodPINResp) != "hi" {
+		t.Fatal(err, string(goodPINResp))
+	}
+}
@@ -1,9 +1,16 @@
 package plainsocket
 
 import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/HouzuoGuo/laitos/daemon/common"
 	"github.com/HouzuoGuo/laitos/toolbox"
 )
 
@@ -27,6 +34,26 @@ func TestPlainTextDaemon(t *testing.T) {
 	if err := daemon.Initialise(); err != nil || daemon.PerIPLimit != 3 {
 		t.Fatalf("%+v %+v\n", err, daemon)
 	}
+	// TLS requires certificate and key
+	daemon.TLSPort = 32790
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "TLSCertPath") {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "laitos-TestPlainTextDaemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	daemon.TLSCertPath = filepath.Join(dir, "cert.pem")
+	daemon.TLSKeyPath = filepath.Join(dir, "key.pem")
+	if err := common.WriteTestCertificate(daemon.TLSCertPath, daemon.TLSKeyPath, "laitos-test"); err != nil {
+		t.Fatal(err)
+	}
+	daemon.TLSClientCAPath = daemon.TLSKeyPath
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "does not contain PEM-encoded certificates") {
+		t.Fatal(err)
+	}
+	daemon.TLSClientCAPath = daemon.TLSCertPath
 	// Prepare settings for test
 	daemon.Address = "127.0.0.1"
 	daemon.PerIPLimit = 5 // limit must be high enough to tolerate consecutive command tests
@@ -34,4 +61,58 @@ func TestPlainTextDaemon(t *testing.T) {
 		t.Fatal(err)
 	}
 	TestServer(&daemon, t)
+
+	// Interactive sessions on the TCP listener
+	sessionDaemon := Daemon{
+		Address:               "127.0.0.1",
+		TCPPort:               32791,
+		PerIPLimit:            20,
+		Processor:             toolbox.GetTestCommandProcessor(),
+		SessionMode:           true,
+		SessionIdleTimeoutSec: 2,
+		SessionPageLines:      2,
+	}
+	if err := sessionDaemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	TestSession(&sessionDaemon, t)
+
+	// Conversations with local programs over a Unix domain socket
+	unixDaemon := Daemon{
+		UnixSocketPath: filepath.Join(dir, "plainsocket.sock"),
+		UnixSocketPerm: "999",
+		Processor:      toolbox.GetTestCommandProcessor(),
+	}
+	if err := unixDaemon.Initialise(); err == nil || !strings.Contains(err.Error(), "UnixSocketPerm") {
+		t.Fatal(err)
+	}
+	unixDaemon.UnixSocketPerm = "0660"
+	if err := unixDaemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if err := unixDaemon.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	time.Sleep(1 * time.Second)
+	if info, err := os.Stat(unixDaemon.UnixSocketPath); err != nil || info.Mode().Perm() != 0660 {
+		t.Fatal(err, info)
+	}
+	unixClient, err := net.Dial("unix", unixDaemon.UnixSocketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := unixClient.Write([]byte(toolbox.TestCommandProcessorPIN + ".s echo hi\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := bufio.NewReader(unixClient).ReadString('\n'); err != nil || resp != "hi\r\n" {
+		t.Fatal(err, resp)
+	}
+	_ = unixClient.Close()
+	// The socket file is removed after the daemon stops
+	unixDaemon.Stop()
+	if _, err := os.Stat(unixDaemon.UnixSocketPath); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
 }
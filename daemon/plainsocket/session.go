@@ -0,0 +1,348 @@
+package plainsocket
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/testingstub"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+const (
+	MaxLoginAttempts     = 3  // MaxLoginAttempts is the number of wrong passwords a session tolerates before disconnecting the client.
+	MaxSessionHistoryLen = 20 // MaxSessionHistoryLen is the number of latest app commands memorised by a session.
+
+	SessionCmdMore    = "more"    // SessionCmdMore continues the output of the previous app command with its next page.
+	SessionCmdHistory = "history" // SessionCmdHistory lists the app commands memorised by the session.
+	SessionCmdRepeat  = "!"       // SessionCmdRepeat followed by a history number runs the app command again, "!!" runs the latest one.
+	SessionCmdExit    = "exit"    // SessionCmdExit ends the session.
+
+	SessionPrompt = "> "
+)
+
+/*
+session is the state of an interactive conversation on the TCP or TLS listener. The client logs in with the password
+PIN once, after which app commands no longer need the PIN. Long outputs are delivered page by page.
+*/
+type session struct {
+	daemon        *Daemon
+	logger        lalog.Logger
+	ip            string
+	conn          net.Conn
+	reader        *textproto.Reader
+	history       []string // history are the latest app commands, without password PIN.
+	remainingPage []string // remainingPage are the lines of the previous output that have not yet been delivered.
+}
+
+// getPINFilter returns the password PIN and shortcuts filter of the command processor.
+func (daemon *Daemon) getPINFilter() *toolbox.PINAndShortcuts {
+	for _, filter := range daemon.Processor.CommandFilters {
+		if pinFilter, ok := filter.(*toolbox.PINAndShortcuts); ok {
+			return pinFilter
+		}
+	}
+	return &toolbox.PINAndShortcuts{}
+}
+
+// write writes the text to client, and returns false if the client has gone away.
+func (sess *session) write(text string) bool {
+	if err := sess.conn.SetWriteDeadline(time.Now().Add(IOTimeoutSec * time.Second)); err != nil {
+		return false
+	}
+	_, err := sess.conn.Write([]byte(text))
+	return err == nil
+}
+
+// readLine reads a line of input, the client is disconnected if it goes silent for longer than the session idle timeout.
+func (sess *session) readLine() (string, bool) {
+	if err := sess.conn.SetReadDeadline(time.Now().Add(time.Duration(sess.daemon.SessionIdleTimeoutSec) * time.Second)); err != nil {
+		return "", false
+	}
+	line, err := sess.reader.ReadLine()
+	if err != nil {
+		if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+			sess.logger.Info("readLine", sess.ip, nil, "session has been idle for more than %d seconds", sess.daemon.SessionIdleTimeoutSec)
+			sess.write("\r\nSession idle timeout, goodbye.\r\n")
+		} else if err != io.EOF {
+			sess.logger.Warning("readLine", sess.ip, err, "failed to read from client")
+		}
+		return "", false
+	}
+	return textproto.TrimString(line), true
+}
+
+// login asks the client for the password PIN, and returns true only if the client has entered it correctly.
+func (sess *session) login() bool {
+	pin := sess.daemon.getPINFilter().PIN
+	for attempt := 0; attempt < MaxLoginAttempts; attempt++ {
+		if !sess.write("Password: ") {
+			return false
+		}
+		line, ok := sess.readLine()
+		if !ok {
+			return false
+		}
+		if pin != "" && subtle.ConstantTimeCompare([]byte(line), []byte(pin)) == 1 {
+			sess.logger.Info("login", sess.ip, nil, "session has logged in")
+			return sess.write(fmt.Sprintf("Welcome. Type \"%s\" to continue a long output, \"%s\" to list earlier commands, \"%s\" to log out.\r\n",
+				SessionCmdMore, SessionCmdHistory, SessionCmdExit))
+		}
+		sess.logger.Warning("login", sess.ip, nil, "incorrect password")
+		if !sess.write(toolbox.ErrPINAndShortcutNotFound.Error() + "\r\n") {
+			return false
+		}
+	}
+	return false
+}
+
+// memorise adds the app command to the history of the session.
+func (sess *session) memorise(line string) {
+	sess.history = append(sess.history, line)
+	if len(sess.history) > MaxSessionHistoryLen {
+		sess.history = sess.history[len(sess.history)-MaxSessionHistoryLen:]
+	}
+}
+
+// getHistory returns the memorised app commands, one per line, each prefixed by its history number.
+func (sess *session) getHistory() string {
+	if len(sess.history) == 0 {
+		return "(history is empty)"
+	}
+	var lines []string
+	for i, line := range sess.history {
+		lines = append(lines, fmt.Sprintf("%d %s", i+1, line))
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// recall returns the app command memorised under the history number ("!N"), or the latest one ("!!").
+func (sess *session) recall(line string) (string, error) {
+	if len(sess.history) == 0 {
+		return "", errors.New("history is empty")
+	}
+	numStr := strings.TrimPrefix(line, SessionCmdRepeat)
+	if numStr == SessionCmdRepeat {
+		return sess.history[len(sess.history)-1], nil
+	}
+	num, err := strconv.Atoi(numStr)
+	if err != nil || num < 1 || num > len(sess.history) {
+		return "", fmt.Errorf("history number must be between 1 and %d", len(sess.history))
+	}
+	return sess.history[num-1], nil
+}
+
+// runAppCommand runs the app command on behalf of the logged-in client, and returns the combined output.
+func (sess *session) runAppCommand(line string) string {
+	content := line
+	// The client has logged in already, hence the password PIN is not needed, unless the line is a shortcut.
+	pinFilter := sess.daemon.getPINFilter()
+	if _, isShortcut := pinFilter.Shortcuts[line]; !isShortcut {
+		content = pinFilter.PIN + line
+	}
+	result := sess.daemon.Processor.Process(context.Background(), toolbox.Command{
+		DaemonName: "plainsocket",
+		ClientID:   sess.ip,
+		Content:    content,
+		TimeoutSec: CommandTimeoutSec,
+	}, true)
+	return result.CombinedOutput
+}
+
+// nextPage returns the next page of the previous output, followed by a hint if there are more pages.
+func (sess *session) nextPage() string {
+	if len(sess.remainingPage) == 0 {
+		return "(no more output)"
+	}
+	pageLen := sess.daemon.SessionPageLines
+	if pageLen > len(sess.remainingPage) {
+		pageLen = len(sess.remainingPage)
+	}
+	page := strings.Join(sess.remainingPage[:pageLen], "\r\n")
+	sess.remainingPage = sess.remainingPage[pageLen:]
+	if len(sess.remainingPage) > 0 {
+		page += fmt.Sprintf("\r\n-- %d more lines, type \"%s\" to continue --", len(sess.remainingPage), SessionCmdMore)
+	}
+	return page
+}
+
+// converse reads session commands and app commands from the client line by line, until the client logs out or goes idle.
+func (sess *session) converse(srv *common.TCPServer) {
+	if !sess.login() {
+		return
+	}
+	for {
+		if misc.EmergencyLockDown {
+			sess.logger.Warning("converse", "", misc.ErrEmergencyLockDown, "")
+			return
+		}
+		if !sess.write(SessionPrompt) {
+			return
+		}
+		line, ok := sess.readLine()
+		if !ok {
+			return
+		}
+		// Check against conversation rate limit
+		if !srv.AddAndCheckRateLimit(sess.ip) {
+			return
+		}
+		var output string
+		switch {
+		case line == "":
+			continue
+		case line == SessionCmdExit:
+			sess.write("Goodbye.\r\n")
+			return
+		case line == SessionCmdMore:
+			output = sess.nextPage()
+		case line == SessionCmdHistory:
+			output = sess.getHistory()
+		case strings.HasPrefix(line, SessionCmdRepeat):
+			appCmd, err := sess.recall(line)
+			if err != nil {
+				output = err.Error()
+				break
+			}
+			line = appCmd
+			fallthrough
+		default:
+			sess.memorise(line)
+			sess.remainingPage = strings.Split(strings.Replace(sess.runAppCommand(line), "\r\n", "\n", -1), "\n")
+			output = sess.nextPage()
+		}
+		if !sess.write(output + "\r\n") {
+			return
+		}
+	}
+}
+
+// converseSession serves an interactive session on a TCP or TLS connection.
+func (daemon *Daemon) converseSession(logger lalog.Logger, ip string, conn net.Conn, srv *common.TCPServer) {
+	daemon.Processor.SetLogger(logger)
+	sess := &session{
+		daemon: daemon,
+		logger: logger,
+		ip:     ip,
+		conn:   conn,
+		// Allow up to 1MB of commands to be received per connection
+		reader: textproto.NewReader(bufio.NewReader(io.LimitReader(conn, 1*1048576))),
+	}
+	sess.converse(srv)
+}
+
+// TestSession conducts an interactive session with the TCP listener of a daemon configured to use SessionMode.
+func TestSession(server *Daemon, t testingstub.T) {
+	var stoppedNormally bool
+	go func() {
+		if err := server.StartAndBlock(); err != nil {
+			t.Fatal(err)
+		}
+		stoppedNormally = true
+	}()
+	time.Sleep(2 * time.Second)
+
+	client, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(server.TCPPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+	reader := bufio.NewReader(client)
+	// converse sends the input and reads the response up to and including the next prompt
+	converse := func(input, prompt string) string {
+		if input != "" {
+			if _, err := client.Write([]byte(input + "\r\n")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		var resp string
+		for !strings.HasSuffix(resp, prompt) {
+			b, err := reader.ReadByte()
+			if err != nil {
+				t.Fatal(err, resp)
+			}
+			resp += string(b)
+		}
+		return strings.TrimSuffix(resp, prompt)
+	}
+	// Log in with a wrong password and then the correct one
+	if resp := converse("", "Password: "); resp != "" {
+		t.Fatal(resp)
+	}
+	if resp := converse("pin mismatch", "Password: "); resp != toolbox.ErrPINAndShortcutNotFound.Error()+"\r\n" {
+		t.Fatal(resp)
+	}
+	if resp := converse(server.getPINFilter().PIN, SessionPrompt); !strings.HasPrefix(resp, "Welcome") {
+		t.Fatal(resp)
+	}
+	// App commands do not need the password PIN any more
+	if resp := converse(".s echo hi", SessionPrompt); resp != "hi\r\n" {
+		t.Fatal(resp)
+	}
+	// Long output is delivered page by page
+	if resp := converse(".s printf 'a\\nb\\nc\\nd\\ne'", SessionPrompt); resp != "a\r\nb\r\n-- 3 more lines, type \"more\" to continue --\r\n" {
+		t.Fatal(resp)
+	}
+	if resp := converse(SessionCmdMore, SessionPrompt); resp != "c\r\nd\r\n-- 1 more lines, type \"more\" to continue --\r\n" {
+		t.Fatal(resp)
+	}
+	if resp := converse(SessionCmdMore, SessionPrompt); resp != "e\r\n" {
+		t.Fatal(resp)
+	}
+	if resp := converse(SessionCmdMore, SessionPrompt); resp != "(no more output)\r\n" {
+		t.Fatal(resp)
+	}
+	// Command history
+	if resp := converse(SessionCmdHistory, SessionPrompt); resp != "1 .s echo hi\r\n2 .s printf 'a\\nb\\nc\\nd\\ne'\r\n" {
+		t.Fatal(resp)
+	}
+	if resp := converse("!1", SessionPrompt); resp != "hi\r\n" {
+		t.Fatal(resp)
+	}
+	if resp := converse("!!", SessionPrompt); resp != "hi\r\n" {
+		t.Fatal(resp)
+	}
+	if resp := converse("!9", SessionPrompt); !strings.Contains(resp, "between 1 and 4") {
+		t.Fatal(resp)
+	}
+	// Log out
+	if _, err := client.Write([]byte(SessionCmdExit + "\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := ioutil.ReadAll(reader); err != nil || string(resp) != "Goodbye.\r\n" {
+		t.Fatal(err, string(resp))
+	}
+
+	// An idle session is disconnected
+	idleClient, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(server.TCPPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = idleClient.Close()
+	}()
+	if resp, err := ioutil.ReadAll(idleClient); err != nil || !strings.Contains(string(resp), "Session idle timeout") {
+		t.Fatal(err, string(resp))
+	}
+
+	// Daemon should stop within a second
+	server.Stop()
+	time.Sleep(1 * time.Second)
+	if !stoppedNormally {
+		t.Fatal("did not stop")
+	}
+}
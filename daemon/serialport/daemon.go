@@ -1,6 +1,7 @@
 package serialport
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -17,6 +18,9 @@ import (
 	"github.com/HouzuoGuo/laitos/toolbox"
 )
 
+// conversationStats times the conversations with serial devices.
+var conversationStats = misc.GetStats("serialport.Conversations")
+
 const (
 	// MaxCommandLength is the maximum length (number of bytes) of an acceptable input toolbox command.
 	MaxCommandLength = 4096
@@ -35,6 +39,13 @@ type Daemon struct {
 		The daemon periodically scans and serves newly connected devices that match these patterns.
 	*/
 	DeviceGlobPatterns []string `json:"DeviceGlobPatterns"`
+	/*
+		ModemDevicePaths are the serial devices of cellular modems (e.g. /dev/ttyUSB2 of a USB LTE dongle) that speak AT
+		commands. The daemon runs app commands received in SMS messages and replies to the senders via SMS.
+	*/
+	ModemDevicePaths []string `json:"ModemDevicePaths"`
+	// ModemPollIntervalSec is the interval at which the daemon checks the modems for new SMS messages.
+	ModemPollIntervalSec int `json:"ModemPollIntervalSec"`
 
 	// PerDeviceLimit is the approximate number of requests allowed from a serial device within a designated interval.
 	PerDeviceLimit int `json:"PerDeviceLimit"`
@@ -60,6 +71,9 @@ func (daemon *Daemon) Initialise() error {
 	if daemon.PerDeviceLimit < 1 {
 		daemon.PerDeviceLimit = 3 // reasonable for interactive usage
 	}
+	if daemon.ModemPollIntervalSec < 1 {
+		daemon.ModemPollIntervalSec = DefaultModemPollIntervalSec
+	}
 
 	// Validate all patterns
 	for _, pattern := range daemon.DeviceGlobPatterns {
@@ -95,7 +109,7 @@ func (daemon *Daemon) StartAndBlock() error {
 		daemon.loopIsRunning = false
 	}()
 	daemon.loopIsRunning = true
-	daemon.logger.Info("StartAndBlock", "", nil, "looking for devices: %s", strings.Join(daemon.DeviceGlobPatterns, " "))
+	daemon.logger.Info("StartAndBlock", "", nil, "looking for devices: %s, modems: %s", strings.Join(daemon.DeviceGlobPatterns, " "), strings.Join(daemon.ModemDevicePaths, " "))
 	for {
 		if misc.EmergencyLockDown {
 			daemon.logger.Warning("StartAndBlock", "", misc.ErrEmergencyLockDown, "")
@@ -110,6 +124,8 @@ func (daemon *Daemon) StartAndBlock() error {
 			}
 			daemon.connectToDevices(matches)
 		}
+		// Modems are connected to in the same way as the other serial devices, except that they converse in AT commands.
+		daemon.connectToModems()
 		// Sleep for the interval and continue scanning
 		select {
 		case <-daemon.stop:
@@ -147,7 +163,7 @@ func (daemon *Daemon) converseWithDevice(devPath string, stopChan chan bool) {
 		delete(daemon.connectedDevices, devPath)
 		daemon.connectedDevicesMutex.Unlock()
 		daemon.logger.Info("converseWithDevice", devPath, nil, "conversation terminated")
-		misc.SerialDevicesStats.Trigger(float64(time.Now().UnixNano() - beginTimeNano))
+		conversationStats.Trigger(float64(time.Now().UnixNano() - beginTimeNano))
 	}()
 	// Converse with the serial device as if it is an ordinary file. This approach works on both Windows and Linux.
 	devFile, err := os.OpenFile(devPath, os.O_RDWR, 0600)
@@ -186,7 +202,7 @@ func (daemon *Daemon) converseWithDevice(devPath string, stopChan chan bool) {
 			}
 			// Execute the toolbox comamnd
 			daemon.logger.Info("converseWithDevice", devPath, nil, "received %d characters", len(cmd))
-			result := daemon.Processor.Process(toolbox.Command{
+			result := daemon.Processor.Process(context.Background(), toolbox.Command{
 				DaemonName: "serialport",
 				ClientID:   devPath,
 				Content:    cmd,
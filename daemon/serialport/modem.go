@@ -0,0 +1,355 @@
+package serialport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+const (
+	// ATCommandTimeoutSec is the maximum number of seconds to wait for a modem to respond to an AT command.
+	ATCommandTimeoutSec = 30
+	// DefaultModemPollIntervalSec is the default interval at which the daemon checks modems for new SMS messages.
+	DefaultModemPollIntervalSec = 10
+	// MaxSMSLength is the maximum number of characters in an SMS reply, longer replies are truncated.
+	MaxSMSLength = 160
+)
+
+/*
+atModem converses with a cellular modem (e.g. a USB 3G/LTE dongle) using AT commands. It receives app commands from
+SMS messages in text mode, and replies to the senders with the app command results.
+*/
+type atModem struct {
+	dev io.ReadWriter
+	// lines are the responses from the modem, each line keeps its line delimiter so that SMS text is read verbatim.
+	lines chan string
+}
+
+/*
+splitATResponse splits modem output into lines that keep their line delimiters (CR LF, or either of them alone), and makes
+the SMS text input prompt ("> ") a line of its own. The lines put together are identical to the modem output.
+*/
+func splitATResponse(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if len(data) == 0 {
+		return 0, nil, nil
+	}
+	if data[0] == '>' {
+		// The prompt is not followed by a line delimiter
+		end := 1
+		if end < len(data) && data[end] == ' ' {
+			end++
+		}
+		return end, data[:end], nil
+	}
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		end := i + 1
+		if data[i] == '\r' {
+			if end < len(data) && data[end] == '\n' {
+				end++
+			} else if end == len(data) && !atEOF {
+				// Request more data to find out whether LF follows CR
+				return 0, nil, nil
+			}
+		}
+		return end, data[:end], nil
+	}
+	if atEOF {
+		return len(data), data, nil
+	}
+	// Request more data
+	return 0, nil, nil
+}
+
+// newATModem starts reading the responses of the modem in the background, until the modem IO fails.
+func newATModem(dev io.ReadWriter) *atModem {
+	modem := &atModem{dev: dev, lines: make(chan string, 64)}
+	go func() {
+		scanner := bufio.NewScanner(dev)
+		scanner.Split(splitATResponse)
+		for scanner.Scan() {
+			modem.lines <- scanner.Text()
+		}
+		close(modem.lines)
+	}()
+	return modem
+}
+
+// nextLine returns the next line of modem response, including its line delimiter.
+func (modem *atModem) nextLine(timeout <-chan time.Time) (string, error) {
+	select {
+	case line, ok := <-modem.lines:
+		if !ok {
+			return "", errors.New("the modem has been disconnected")
+		}
+		return line, nil
+	case <-timeout:
+		return "", fmt.Errorf("the modem did not respond in %d seconds", ATCommandTimeoutSec)
+	}
+}
+
+// isErrorResult returns true if the (trimmed) response line is a final result code of failure.
+func isErrorResult(line string) bool {
+	return line == "ERROR" || strings.HasPrefix(line, "+CMS ERROR") || strings.HasPrefix(line, "+CME ERROR")
+}
+
+// waitFor collects modem response lines until the final result code, or the expected line is seen.
+func (modem *atModem) waitFor(expectLine string) (ret []string, err error) {
+	timeout := time.After(ATCommandTimeoutSec * time.Second)
+	for {
+		line, err := modem.nextLine(timeout)
+		if err != nil {
+			return ret, err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || line == "RING" || strings.HasPrefix(line, "+CMTI:"):
+			// Unsolicited notifications of incoming calls and messages are not part of the response
+			continue
+		case line == expectLine:
+			return ret, nil
+		case isErrorResult(line):
+			return ret, fmt.Errorf("the modem responded with %s", line)
+		}
+		ret = append(ret, line)
+	}
+}
+
+// command sends an AT command to the modem and returns its response lines, excluding the echo and the final "OK".
+func (modem *atModem) command(cmd string) ([]string, error) {
+	if _, err := modem.dev.Write([]byte(cmd + "\r")); err != nil {
+		return nil, err
+	}
+	lines, err := modem.waitFor("OK")
+	// Discard the command echo if the modem still has echo turned on
+	if len(lines) > 0 && lines[0] == cmd {
+		lines = lines[1:]
+	}
+	return lines, err
+}
+
+/*
+initialise turns off command echo and turns on SMS text mode, in which the header of each received message also tells
+the length of its text.
+*/
+func (modem *atModem) initialise() error {
+	for _, cmd := range []string{"AT", "ATE0", "AT+CMGF=1", "AT+CSDH=1"} {
+		if _, err := modem.command(cmd); err != nil {
+			return fmt.Errorf("%s: %v", cmd, err)
+		}
+	}
+	return nil
+}
+
+// modemSMS is an SMS message stored in the modem.
+type modemSMS struct {
+	Index  string // Index is the storage location of the message in the modem.
+	Sender string // Sender is the phone number of the sender.
+	Text   string // Text is the content of the message.
+}
+
+/*
+parseCMGLHeader parses the header line of a message listed by AT+CMGL in text mode. The text length is the last field of
+the header, or -1 if the modem does not tell the length.
+*/
+func parseCMGLHeader(line string) (sms modemSMS, textLength int, ok bool) {
+	// +CMGL: 1,"REC UNREAD","+15551234567",,"21/01/01,12:00:00+00",145,5
+	reader := csv.NewReader(strings.NewReader(strings.TrimSpace(strings.TrimPrefix(line, "+CMGL:"))))
+	reader.LazyQuotes = true
+	fields, err := reader.Read()
+	if err != nil || len(fields) < 3 {
+		return modemSMS{}, 0, false
+	}
+	textLength = -1
+	if len(fields) >= 6 {
+		if length, err := strconv.Atoi(strings.TrimSpace(fields[len(fields)-1])); err == nil && length >= 0 {
+			textLength = length
+		}
+	}
+	return modemSMS{Index: strings.TrimSpace(fields[0]), Sender: strings.TrimSpace(fields[2])}, textLength, true
+}
+
+/*
+readText reads the message text that follows a "+CMGL:" header line. The text may span multiple lines and contain
+anything (even "OK"), hence it is read verbatim up to the length told by the header. Without the length, the text ends
+at the first line delimiter.
+*/
+func (modem *atModem) readText(length int, timeout <-chan time.Time) (string, error) {
+	var text string
+	for {
+		line, err := modem.nextLine(timeout)
+		if err != nil {
+			return "", err
+		}
+		if length < 0 {
+			return strings.TrimRight(line, "\r\n"), nil
+		}
+		text += line
+		if runes := []rune(text); len(runes) >= length {
+			// The line delimiter after the text is not part of it
+			return string(runes[:length]), nil
+		}
+	}
+}
+
+// listUnreadSMS lists the unread SMS messages in text mode, each message is a "+CMGL:" header line followed by its text.
+func (modem *atModem) listUnreadSMS() (ret []modemSMS, err error) {
+	if _, err := modem.dev.Write([]byte("AT+CMGL=\"REC UNREAD\"\r")); err != nil {
+		return nil, err
+	}
+	ret = make([]modemSMS, 0)
+	timeout := time.After(ATCommandTimeoutSec * time.Second)
+	for {
+		line, err := modem.nextLine(timeout)
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "+CMGL:"):
+			sms, length, ok := parseCMGLHeader(line)
+			text, err := modem.readText(length, timeout)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				sms.Text = text
+				ret = append(ret, sms)
+			}
+		case line == "OK":
+			return ret, nil
+		case isErrorResult(line):
+			return nil, fmt.Errorf("the modem responded with %s", line)
+		}
+		// Ignore the command echo and unsolicited notifications
+	}
+}
+
+// readNewSMS returns the unread SMS messages and deletes them from the modem.
+func (modem *atModem) readNewSMS() ([]modemSMS, error) {
+	messages, err := modem.listUnreadSMS()
+	if err != nil {
+		return nil, err
+	}
+	for _, sms := range messages {
+		if _, err := modem.command("AT+CMGD=" + sms.Index); err != nil {
+			return nil, err
+		}
+	}
+	return messages, nil
+}
+
+// sendSMS sends a text message to the phone number.
+func (modem *atModem) sendSMS(phoneNumber, text string) error {
+	if _, err := modem.dev.Write([]byte(fmt.Sprintf("AT+CMGS=\"%s\"\r", phoneNumber))); err != nil {
+		return err
+	}
+	if _, err := modem.waitFor(">"); err != nil {
+		return err
+	}
+	// Ctrl-Z ends the message text and ESC cancels the message, neither may appear in the text itself.
+	text = strings.Replace(strings.Replace(text, "\x1a", "", -1), "\x1b", "", -1)
+	if runes := []rune(text); len(runes) > MaxSMSLength {
+		text = string(runes[:MaxSMSLength])
+	}
+	if _, err := modem.dev.Write([]byte(text + "\x1a")); err != nil {
+		return err
+	}
+	_, err := modem.waitFor("OK")
+	return err
+}
+
+// connectToModems starts a processing loop dedicated to each modem that is present but not yet connected.
+func (daemon *Daemon) connectToModems() {
+	daemon.connectedDevicesMutex.Lock()
+	defer daemon.connectedDevicesMutex.Unlock()
+	for _, dev := range daemon.ModemDevicePaths {
+		if _, exists := daemon.connectedDevices[dev]; exists {
+			continue
+		}
+		if _, err := os.Stat(dev); err != nil {
+			continue
+		}
+		stopChan := make(chan bool, 2)
+		daemon.connectedDevices[dev] = stopChan
+		go daemon.converseWithModem(dev, stopChan)
+	}
+}
+
+// converseWithModem opens the modem device and serves the app commands it receives via SMS, until the daemon stops or the IO fails.
+func (daemon *Daemon) converseWithModem(devPath string, stopChan chan bool) {
+	beginTimeNano := time.Now().UnixNano()
+	daemon.logger.Info("converseWithModem", devPath, nil, "beginning conversation")
+	defer func() {
+		daemon.connectedDevicesMutex.Lock()
+		delete(daemon.connectedDevices, devPath)
+		daemon.connectedDevicesMutex.Unlock()
+		daemon.logger.Info("converseWithModem", devPath, nil, "conversation terminated")
+		conversationStats.Trigger(float64(time.Now().UnixNano() - beginTimeNano))
+	}()
+	devFile, err := os.OpenFile(devPath, os.O_RDWR, 0600)
+	if err != nil {
+		daemon.logger.Warning("converseWithModem", devPath, err, "failed to open device file handle")
+		return
+	}
+	defer func() {
+		daemon.logger.MaybeMinorError(devFile.Close())
+	}()
+	daemon.serveModem(devPath, devFile, stopChan)
+}
+
+// serveModem initialises the modem, and then periodically processes its new SMS messages until stopChan is signalled or the IO fails.
+func (daemon *Daemon) serveModem(devPath string, dev io.ReadWriter, stopChan chan bool) {
+	modem := newATModem(dev)
+	if err := modem.initialise(); err != nil {
+		daemon.logger.Warning("serveModem", devPath, err, "failed to initialise modem")
+		return
+	}
+	for {
+		if misc.EmergencyLockDown {
+			daemon.logger.Warning("serveModem", "", misc.ErrEmergencyLockDown, "")
+			return
+		}
+		messages, err := modem.readNewSMS()
+		if err != nil {
+			daemon.logger.Warning("serveModem", devPath, err, "failed to read SMS messages")
+			return
+		}
+		for _, sms := range messages {
+			// Check against rate limit
+			if !daemon.rateLimit.Add(sms.Sender, true) {
+				continue
+			}
+			cmd := strings.TrimSpace(sms.Text)
+			if len(cmd) == 0 {
+				continue
+			}
+			daemon.logger.Info("serveModem", sms.Sender, nil, "received %d characters", len(cmd))
+			result := daemon.Processor.Process(context.Background(), toolbox.Command{
+				DaemonName: "serialport",
+				ClientID:   sms.Sender,
+				Content:    cmd,
+				TimeoutSec: CommandTimeoutSec,
+			}, true)
+			if err := modem.sendSMS(sms.Sender, result.CombinedOutput); err != nil {
+				daemon.logger.Warning("serveModem", sms.Sender, err, "failed to send SMS reply")
+				return
+			}
+		}
+		select {
+		case <-stopChan:
+			return
+		case <-time.After(time.Duration(daemon.ModemPollIntervalSec) * time.Second):
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package serialport
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+func TestSplitATResponse(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("\r\nOK\r\n> text\rline\n\r\nlast"))
+	scanner.Split(splitATResponse)
+	var lines []string
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if !reflect.DeepEqual(lines, []string{"\r\n", "OK\r\n", "> ", "text\r", "line\n", "\r\n", "last"}) {
+		t.Fatalf("%q", lines)
+	}
+}
+
+func TestParseCMGLHeader(t *testing.T) {
+	sms, length, ok := parseCMGLHeader(`+CMGL: 1,"REC UNREAD","+15551234567",,"21/01/01,12:00:00+00",145,12`)
+	if !ok || length != 12 || !reflect.DeepEqual(sms, modemSMS{Index: "1", Sender: "+15551234567"}) {
+		t.Fatal(sms, length, ok)
+	}
+	// Without AT+CSDH=1 the header does not tell the text length
+	sms, length, ok = parseCMGLHeader(`+CMGL: 3,"REC UNREAD","+15557654321",,"21/01/01,12:01:00+00"`)
+	if !ok || length != -1 || !reflect.DeepEqual(sms, modemSMS{Index: "3", Sender: "+15557654321"}) {
+		t.Fatal(sms, length, ok)
+	}
+	if _, _, ok := parseCMGLHeader(`+CMGL: 1`); ok {
+		t.Fatal("should have failed")
+	}
+}
+
+func TestListUnreadSMS(t *testing.T) {
+	daemonConn, modemConn := net.Pipe()
+	defer daemonConn.Close()
+	defer modemConn.Close()
+	go func() {
+		_, _ = bufio.NewReader(modemConn).ReadString('\r')
+		// The text of a message may look like result codes and headers, and the text length tells where the text ends.
+		_, _ = modemConn.Write([]byte("\r\n+CMGL: 1,\"REC UNREAD\",\"+15551234567\",,\"21/01/01,12:00:00+00\",145,16\r\n" +
+			"first\r\nOK\r\nERROR\r\n" +
+			"+CMGL: 3,\"REC UNREAD\",\"+15557654321\",,\"21/01/01,12:01:00+00\",145,10\r\n" +
+			"+CMGL: 4,,\r\n" +
+			"+CMGL: 5,\"REC UNREAD\",\"+15550000000\",,\"21/01/01,12:02:00+00\",145,7\r\n" +
+			"h\u00e9llo \u263a\r\n\r\nOK\r\n"))
+	}()
+	messages, err := newATModem(daemonConn).listUnreadSMS()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(messages, []modemSMS{
+		{Index: "1", Sender: "+15551234567", Text: "first\r\nOK\r\nERROR"},
+		{Index: "3", Sender: "+15557654321", Text: "+CMGL: 4,,"},
+		{Index: "5", Sender: "+15550000000", Text: "h\u00e9llo \u263a"},
+	}) {
+		t.Fatalf("%+v", messages)
+	}
+}
+
+func TestSendSMS(t *testing.T) {
+	daemonConn, modemConn := net.Pipe()
+	defer daemonConn.Close()
+	defer modemConn.Close()
+	sent := make(chan string, 1)
+	go func() {
+		reader := bufio.NewReader(modemConn)
+		_, _ = reader.ReadString('\r')
+		_, _ = modemConn.Write([]byte("\r\n> "))
+		text, _ := reader.ReadString('\x1a')
+		sent <- text
+		_, _ = modemConn.Write([]byte("\r\n+CMGS: 7\r\n\r\nOK\r\n"))
+	}()
+	// Ctrl-Z must not end the text prematurely, and the text is truncated without splitting a character.
+	if err := newATModem(daemonConn).sendSMS("+15551234567", "a\x1ab"+strings.Repeat("\u263a", MaxSMSLength)); err != nil {
+		t.Fatal(err)
+	}
+	if text := <-sent; text != "ab"+strings.Repeat("\u263a", MaxSMSLength-2)+"\x1a" {
+		t.Fatalf("%q", text)
+	}
+}
+
+// fakeModem emulates a modem in text mode that stores one unread SMS message, and memorises the SMS messages sent.
+type fakeModem struct {
+	conn     net.Conn
+	mutex    *sync.Mutex
+	commands []string
+	sent     []string
+}
+
+func (modem *fakeModem) respond(text string) {
+	_, _ = modem.conn.Write([]byte(text))
+}
+
+func (modem *fakeModem) serve() {
+	reader := bufio.NewReader(modem.conn)
+	unread := true
+	for {
+		cmd, err := reader.ReadString('\r')
+		if err != nil {
+			return
+		}
+		cmd = strings.TrimSpace(cmd)
+		modem.mutex.Lock()
+		modem.commands = append(modem.commands, cmd)
+		modem.mutex.Unlock()
+		switch {
+		case cmd == "AT":
+			// The modem echoes commands until ATE0
+			modem.respond("AT\r\r\nOK\r\n")
+		case cmd == `AT+CMGL="REC UNREAD"`:
+			if unread {
+				text := toolbox.TestCommandProcessorPIN + ".s echo modem"
+				modem.respond(fmt.Sprintf("\r\n+CMGL: 2,\"REC UNREAD\",\"+15551234567\",,\"21/01/01,12:00:00+00\",145,%d\r\n%s\r\n\r\nOK\r\n", len(text), text))
+				unread = false
+			} else {
+				modem.respond("\r\nRING\r\n\r\nOK\r\n")
+			}
+		case strings.HasPrefix(cmd, "AT+CMGS="):
+			modem.respond("\r\n> ")
+			text, err := reader.ReadString('\x1a')
+			if err != nil {
+				return
+			}
+			modem.mutex.Lock()
+			modem.sent = append(modem.sent, cmd+" "+strings.TrimSuffix(text, "\x1a"))
+			modem.mutex.Unlock()
+			modem.respond("\r\n+CMGS: 7\r\n\r\nOK\r\n")
+		case cmd == "AT+CMGD=9":
+			modem.respond("\r\n+CMS ERROR: 321\r\n")
+		default:
+			modem.respond("\r\nOK\r\n")
+		}
+	}
+}
+
+func TestServeModem(t *testing.T) {
+	daemon := Daemon{Processor: toolbox.GetTestCommandProcessor(), ModemPollIntervalSec: 1}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	daemonConn, modemConn := net.Pipe()
+	defer daemonConn.Close()
+	defer modemConn.Close()
+	modem := &fakeModem{conn: modemConn, mutex: new(sync.Mutex)}
+	go modem.serve()
+
+	stopChan := make(chan bool, 2)
+	served := make(chan struct{})
+	go func() {
+		daemon.serveModem("fake-modem", daemonConn, stopChan)
+		close(served)
+	}()
+	time.Sleep(2 * time.Second)
+	stopChan <- true
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not stop")
+	}
+
+	modem.mutex.Lock()
+	defer modem.mutex.Unlock()
+	if !reflect.DeepEqual(modem.commands[:7], []string{"AT", "ATE0", "AT+CMGF=1", "AT+CSDH=1", `AT+CMGL="REC UNREAD"`, "AT+CMGD=2", `AT+CMGS="+15551234567"`}) {
+		t.Fatalf("%+v", modem.commands)
+	}
+	if !reflect.DeepEqual(modem.sent, []string{`AT+CMGS="+15551234567" modem`}) {
+		t.Fatalf("%+v", modem.sent)
+	}
+
+	// The modem responds with an error
+	errDaemonConn, errModemConn := net.Pipe()
+	defer errDaemonConn.Close()
+	defer errModemConn.Close()
+	go (&fakeModem{conn: errModemConn, mutex: new(sync.Mutex)}).serve()
+	if _, err := newATModem(errDaemonConn).command("AT+CMGD=9"); err == nil || !strings.Contains(err.Error(), "+CMS ERROR: 321") {
+		t.Fatal(err)
+	}
+}
@@ -8,6 +8,13 @@ import (
 	"github.com/HouzuoGuo/laitos/misc"
 )
 
+var (
+	// statsTCP times the TCP conversations of simple IP services.
+	statsTCP = misc.GetStats("simpleipsvcd.TCP")
+	// statsUDP times the UDP conversations of simple IP services.
+	statsUDP = misc.GetStats("simpleipsvcd.UDP")
+)
+
 // TCPService implements common.TCPApp interface for a simple IP service.
 type TCPService struct {
 	// ResponseFun is a function returning a string as the entire response to a simple IP service request.
@@ -16,7 +23,7 @@ type TCPService struct {
 
 // GetTCPStatsCollector returns the stats collector that counts and times client connections for the TCP application.
 func (svc *TCPService) GetTCPStatsCollector() *misc.Stats {
-	return misc.SimpleIPStatsTCP
+	return statsTCP
 }
 
 // HandleTCPConnection
@@ -34,7 +41,7 @@ type UDPService struct {
 
 // GetUDPStatsCollector returns the stats collector that counts and times client connections for the TCP application.
 func (svc *UDPService) GetUDPStatsCollector() *misc.Stats {
-	return misc.SimpleIPStatsUDP
+	return statsUDP
 }
 
 // HandleTCPConnection
@@ -0,0 +1,151 @@
+package smtpd
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/inet"
+)
+
+/*
+MailRoute decides what to do with the mails addressed to a set of recipients. Each mail recipient is handled by the first
+route that matches the recipient; recipients that do not match any route are handled by the daemon's ForwardTo addresses,
+Maildir, and toolbox command runner.
+*/
+type MailRoute struct {
+	/*
+		Recipients are the address patterns that the route applies to, e.g. "howard@example.com", "*@example.com",
+		"support-*@example.com". An asterisk matches any sequence of characters, and the comparison is case-insensitive.
+	*/
+	Recipients []string `json:"Recipients"`
+	// ForwardTo are the addresses to forward the mails to.
+	ForwardTo []string `json:"ForwardTo"`
+	// RunCommands runs the toolbox commands found in the mails via the mail command runner.
+	RunCommands bool `json:"RunCommands"`
+	// Maildir is the path to a local maildir to store the mails in.
+	Maildir string `json:"Maildir"`
+}
+
+// Matches returns true only if the recipient address matches any of the route's address patterns.
+func (route MailRoute) Matches(recipient string) bool {
+	recipient = strings.ToLower(strings.TrimSpace(recipient))
+	for _, pattern := range route.Recipients {
+		if matched, _ := path.Match(strings.ToLower(pattern), recipient); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Initialise validates the route configuration and prepares the maildir.
+func (route MailRoute) Initialise(myDomains map[string]struct{}) error {
+	if len(route.Recipients) == 0 {
+		return errors.New("recipient patterns must be configured")
+	}
+	for _, pattern := range route.Recipients {
+		if _, err := path.Match(pattern, ""); err != nil || strings.TrimSpace(pattern) == "" {
+			return fmt.Errorf("recipient pattern \"%s\" is malformed", pattern)
+		}
+	}
+	if len(route.ForwardTo) == 0 && !route.RunCommands && route.Maildir == "" {
+		return errors.New("at least one of ForwardTo, RunCommands, and Maildir must be configured")
+	}
+	if err := checkForwardAddresses(route.ForwardTo, myDomains); err != nil {
+		return err
+	}
+	if route.Maildir != "" {
+		if err := (inet.Maildir{Dir: route.Maildir}).Initialise(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkForwardAddresses returns an error if any of the forward addresses is malformed or loops back to my domains.
+func checkForwardAddresses(addrs []string, myDomains map[string]struct{}) error {
+	for _, fwd := range addrs {
+		atSign := strings.IndexRune(fwd, '@')
+		if atSign == -1 {
+			return fmt.Errorf("forward address \"%s\" must have an at sign", fwd)
+		}
+		if _, exists := myDomains[fwd[atSign+1:]]; exists {
+			return fmt.Errorf("forward address \"%s\" must not loop back to this mail server's domain", fwd)
+		}
+	}
+	return nil
+}
+
+// mailActions are the combined actions of the routes that handle all recipients of a mail.
+type mailActions struct {
+	forwardTo   []string
+	runCommands bool
+	maildirs    []string
+	// unrouted are the recipients that are handled by neither a route nor the default ForwardTo addresses and Maildir.
+	unrouted []string
+}
+
+/*
+isRecipientHandled returns true only if the recipient is matched by a route, or handled by the default forward
+addresses or maildir.
+*/
+func (daemon *Daemon) isRecipientHandled(toAddr string) bool {
+	if len(daemon.ForwardTo) > 0 || daemon.Maildir != "" {
+		return true
+	}
+	for _, route := range daemon.Routes {
+		if route.Matches(toAddr) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+getMailActions determines the actions to take for a mail addressed to the recipients. The actions of all matching routes
+are combined, so that a mail addressed to multiple recipients is forwarded and stored once.
+*/
+func (daemon *Daemon) getMailActions(toAddrs []string) (ret mailActions) {
+	forwardTo := make(map[string]struct{})
+	maildirs := make(map[string]struct{})
+	for _, toAddr := range toAddrs {
+		var matched bool
+		for _, route := range daemon.Routes {
+			if route.Matches(toAddr) {
+				matched = true
+				for _, addr := range route.ForwardTo {
+					forwardTo[addr] = struct{}{}
+				}
+				if route.Maildir != "" {
+					maildirs[route.Maildir] = struct{}{}
+				}
+				ret.runCommands = ret.runCommands || route.RunCommands
+				break
+			}
+		}
+		if !matched {
+			// Use the default forward addresses, maildir, and command runner
+			if len(daemon.ForwardTo) == 0 && daemon.Maildir == "" {
+				ret.unrouted = append(ret.unrouted, toAddr)
+			}
+			for _, addr := range daemon.ForwardTo {
+				forwardTo[addr] = struct{}{}
+			}
+			if daemon.Maildir != "" {
+				maildirs[daemon.Maildir] = struct{}{}
+			}
+			ret.runCommands = true
+		}
+	}
+	for addr := range forwardTo {
+		ret.forwardTo = append(ret.forwardTo, addr)
+	}
+	for dir := range maildirs {
+		ret.maildirs = append(ret.maildirs, dir)
+	}
+	sort.Strings(ret.forwardTo)
+	sort.Strings(ret.maildirs)
+	return
+}
@@ -0,0 +1,82 @@
+package smtpd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMailRoute(t *testing.T) {
+	myDomains := map[string]struct{}{"example.com": {}}
+	dir, err := ioutil.TempDir("", "laitos-TestMailRoute")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, test := range []struct {
+		route MailRoute
+		err   string
+	}{
+		{MailRoute{ForwardTo: []string{"a@example.net"}}, "recipient patterns"},
+		{MailRoute{Recipients: []string{"[a@example.com"}, ForwardTo: []string{"a@example.net"}}, "malformed"},
+		{MailRoute{Recipients: []string{"a@example.com"}}, "at least one"},
+		{MailRoute{Recipients: []string{"a@example.com"}, ForwardTo: []string{"b@example.com"}}, "loop back"},
+		{MailRoute{Recipients: []string{"a@example.com"}, ForwardTo: []string{"b"}}, "at sign"},
+		{MailRoute{Recipients: []string{"a@example.com"}, Maildir: filepath.Join(dir, "mail")}, ""},
+	} {
+		err := test.route.Initialise(myDomains)
+		if test.err == "" && err != nil || test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+			t.Fatal(test.route, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "mail", "new")); err != nil {
+		t.Fatal(err)
+	}
+
+	route := MailRoute{Recipients: []string{"support-*@example.com", "Howard@Example.com"}}
+	for addr, match := range map[string]bool{
+		"support-1@example.com": true,
+		"SUPPORT-@EXAMPLE.COM":  true,
+		"howard@example.com":    true,
+		"support@example.com":   false,
+		"howard@example.org":    false,
+	} {
+		if route.Matches(addr) != match {
+			t.Fatal(addr)
+		}
+	}
+}
+
+func TestDaemon_GetMailActions(t *testing.T) {
+	daemon := Daemon{
+		ForwardTo: []string{"default@example.net"},
+		Routes: []MailRoute{
+			{Recipients: []string{"howard@example.com"}, ForwardTo: []string{"howard@example.net"}, Maildir: "/tmp/howard"},
+			{Recipients: []string{"*@example.com"}, Maildir: "/tmp/all"},
+			{Recipients: []string{"cmd@example.org"}, RunCommands: true, ForwardTo: []string{"howard@example.net"}},
+		},
+	}
+	if actions := daemon.getMailActions([]string{"howard@example.com"}); !reflect.DeepEqual(actions, mailActions{forwardTo: []string{"howard@example.net"}, maildirs: []string{"/tmp/howard"}}) {
+		t.Fatalf("%+v", actions)
+	}
+	if actions := daemon.getMailActions([]string{"other@example.com", "a@example.com"}); !reflect.DeepEqual(actions, mailActions{maildirs: []string{"/tmp/all"}}) {
+		t.Fatalf("%+v", actions)
+	}
+	actions := daemon.getMailActions([]string{"cmd@example.org", "howard@example.com", "x@example.org"})
+	if !reflect.DeepEqual(actions, mailActions{forwardTo: []string{"default@example.net", "howard@example.net"}, runCommands: true, maildirs: []string{"/tmp/howard"}}) {
+		t.Fatalf("%+v", actions)
+	}
+	// Without default forward addresses, the recipients matched by no route are not forwarded anywhere
+	daemon.ForwardTo = nil
+	if actions := daemon.getMailActions([]string{"x@example.org"}); !reflect.DeepEqual(actions, mailActions{runCommands: true, unrouted: []string{"x@example.org"}}) {
+		t.Fatalf("%+v", actions)
+	}
+	// The default maildir stores the mails matched by no route
+	daemon.Maildir = "/tmp/default"
+	if actions := daemon.getMailActions([]string{"x@example.org", "other@example.com"}); !reflect.DeepEqual(actions, mailActions{runCommands: true, maildirs: []string{"/tmp/all", "/tmp/default"}}) {
+		t.Fatalf("%+v", actions)
+	}
+}
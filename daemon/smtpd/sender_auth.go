@@ -0,0 +1,502 @@
+package smtpd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/inet"
+	"golang.org/x/net/publicsuffix"
+)
+
+const (
+	// SPFMaxDNSLookups is the maximum number of DNS-querying mechanisms and modifiers evaluated for an SPF check (RFC 7208 section 4.6.4).
+	SPFMaxDNSLookups = 10
+
+	SPFNone      = "none"
+	SPFNeutral   = "neutral"
+	SPFPass      = "pass"
+	SPFFail      = "fail"
+	SPFSoftFail  = "softfail"
+	SPFTempError = "temperror"
+	SPFPermError = "permerror"
+
+	DMARCNone = "none"
+	DMARCPass = "pass"
+	DMARCFail = "fail"
+
+	// AuthResultsHeader is the name of the mail header that carries the sender authentication results (RFC 8601).
+	AuthResultsHeader = "Authentication-Results"
+)
+
+// errSPFPermanent is a permanent error of evaluating an SPF record, such as a syntax error or too many DNS lookups.
+var errSPFPermanent = errors.New("permanent SPF error")
+
+/*
+Resolver looks up DNS records for sender authentication. The functions are usually the ones from net package, they are
+substituted by test cases.
+*/
+type Resolver struct {
+	LookupTXT func(string) ([]string, error)
+	LookupIP  func(string) ([]net.IP, error)
+	LookupMX  func(string) ([]*net.MX, error)
+}
+
+// DefaultResolver looks up DNS records using the system resolver.
+var DefaultResolver = Resolver{LookupTXT: net.LookupTXT, LookupIP: net.LookupIP, LookupMX: net.LookupMX}
+
+// isDNSNotFound returns true if the DNS lookup error means the record does not exist, as opposed to a temporary failure.
+func isDNSNotFound(err error) bool {
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		return dnsErr.IsNotFound || !dnsErr.IsTemporary && !dnsErr.IsTimeout
+	}
+	return false
+}
+
+// spfCheck evaluates the SPF record of a domain for a client IP, as described by RFC 7208.
+type spfCheck struct {
+	resolver   Resolver
+	clientIP   net.IP
+	sender     string // sender is the envelope sender address, or "postmaster@" followed by HELO name.
+	heloName   string
+	numLookups int
+}
+
+// countLookup counts a DNS-querying mechanism or modifier towards the limit.
+func (check *spfCheck) countLookup() error {
+	check.numLookups++
+	if check.numLookups > SPFMaxDNSLookups {
+		return errSPFPermanent
+	}
+	return nil
+}
+
+// expandMacros expands the commonly used macros (RFC 7208 section 7) of a domain specification.
+func (check *spfCheck) expandMacros(spec, domain string) (string, error) {
+	if !strings.Contains(spec, "%") {
+		return spec, nil
+	}
+	localPart, senderDomain := GetMailAddressComponents(check.sender)
+	var ret strings.Builder
+	for i := 0; i < len(spec); i++ {
+		if spec[i] != '%' {
+			ret.WriteByte(spec[i])
+			continue
+		}
+		if i+1 >= len(spec) {
+			return "", errSPFPermanent
+		}
+		i++
+		switch spec[i] {
+		case '%':
+			ret.WriteByte('%')
+		case '_':
+			ret.WriteByte(' ')
+		case '-':
+			ret.WriteString("%20")
+		case '{':
+			end := strings.IndexByte(spec[i:], '}')
+			if end != 2 {
+				// Macro transformers and delimiters are not supported
+				return "", errSPFPermanent
+			}
+			switch strings.ToLower(spec[i+1 : i+2]) {
+			case "s":
+				ret.WriteString(check.sender)
+			case "l":
+				ret.WriteString(localPart)
+			case "o":
+				ret.WriteString(senderDomain)
+			case "d":
+				ret.WriteString(domain)
+			case "i":
+				ret.WriteString(check.clientIP.String())
+			case "h":
+				ret.WriteString(check.heloName)
+			case "v":
+				if check.clientIP.To4() != nil {
+					ret.WriteString("in-addr")
+				} else {
+					ret.WriteString("ip6")
+				}
+			default:
+				return "", errSPFPermanent
+			}
+			i += end
+		default:
+			return "", errSPFPermanent
+		}
+	}
+	return ret.String(), nil
+}
+
+// matchIPs returns true if the client IP is within any of the addresses masked by the CIDR prefix lengths.
+func (check *spfCheck) matchIPs(ips []net.IP, prefix4, prefix6 int) bool {
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && check.clientIP.To4() != nil {
+			if ip4.Mask(net.CIDRMask(prefix4, 32)).Equal(check.clientIP.To4().Mask(net.CIDRMask(prefix4, 32))) {
+				return true
+			}
+		} else if ip.To4() == nil && check.clientIP.To4() == nil {
+			if ip.Mask(net.CIDRMask(prefix6, 128)).Equal(check.clientIP.Mask(net.CIDRMask(prefix6, 128))) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// splitDualCIDR splits a mechanism argument such as "example.com/24//64" into the domain and the prefix lengths.
+func splitDualCIDR(arg string) (domain string, prefix4, prefix6 int, err error) {
+	prefix4, prefix6 = 32, 128
+	domain = arg
+	if slashes := strings.Index(domain, "//"); slashes != -1 {
+		if prefix6, err = strconv.Atoi(domain[slashes+2:]); err != nil || prefix6 < 0 || prefix6 > 128 {
+			return "", 0, 0, errSPFPermanent
+		}
+		domain = domain[:slashes]
+	}
+	if slash := strings.IndexByte(domain, '/'); slash != -1 {
+		if prefix4, err = strconv.Atoi(domain[slash+1:]); err != nil || prefix4 < 0 || prefix4 > 32 {
+			return "", 0, 0, errSPFPermanent
+		}
+		domain = domain[:slash]
+	}
+	return
+}
+
+// getSPFRecord retrieves the SPF record of a domain, it returns an empty string if there is not a record.
+func (check *spfCheck) getSPFRecord(domain string) (string, error) {
+	txts, err := check.resolver.LookupTXT(domain)
+	if err != nil {
+		if isDNSNotFound(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	var record string
+	for _, txt := range txts {
+		if lower := strings.ToLower(txt); lower == "v=spf1" || strings.HasPrefix(lower, "v=spf1 ") {
+			if record != "" {
+				// A domain must not have multiple SPF records
+				return "", errSPFPermanent
+			}
+			record = txt
+		}
+	}
+	return record, nil
+}
+
+// checkHost evaluates the SPF record of the domain and returns the result, as described by RFC 7208 section 4.
+func (check *spfCheck) checkHost(domain string) string {
+	record, err := check.getSPFRecord(domain)
+	if err == errSPFPermanent {
+		return SPFPermError
+	} else if err != nil {
+		return SPFTempError
+	} else if record == "" {
+		return SPFNone
+	}
+	var redirect string
+	for _, term := range strings.Fields(record)[1:] {
+		// Modifiers
+		if equal := strings.IndexByte(term, '='); equal != -1 && !strings.ContainsAny(term[:equal], ":/") {
+			if strings.EqualFold(term[:equal], "redirect") {
+				redirect = term[equal+1:]
+			}
+			continue
+		}
+		// Mechanisms
+		qualifier := SPFPass
+		switch term[0] {
+		case '+':
+			term = term[1:]
+		case '-':
+			qualifier, term = SPFFail, term[1:]
+		case '~':
+			qualifier, term = SPFSoftFail, term[1:]
+		case '?':
+			qualifier, term = SPFNeutral, term[1:]
+		}
+		name, arg := strings.ToLower(term), ""
+		if sep := strings.IndexAny(term, ":/"); sep != -1 {
+			name, arg = strings.ToLower(term[:sep]), term[sep:]
+			arg = strings.TrimPrefix(arg, ":")
+		}
+		matched, result := false, ""
+		switch name {
+		case "all":
+			matched = true
+		case "ip4", "ip6":
+			if !strings.Contains(arg, "/") {
+				if name == "ip4" {
+					arg += "/32"
+				} else {
+					arg += "/128"
+				}
+			}
+			_, network, err := net.ParseCIDR(arg)
+			if err != nil {
+				return SPFPermError
+			}
+			matched = network.Contains(check.clientIP)
+		case "a", "mx":
+			if err := check.countLookup(); err != nil {
+				return SPFPermError
+			}
+			target, prefix4, prefix6, err := splitDualCIDR(arg)
+			if err != nil {
+				return SPFPermError
+			}
+			if target == "" {
+				target = domain
+			} else if target, err = check.expandMacros(target, domain); err != nil {
+				return SPFPermError
+			}
+			var hosts []string
+			if name == "a" {
+				hosts = []string{target}
+			} else {
+				mxs, err := check.resolver.LookupMX(target)
+				if err != nil && !isDNSNotFound(err) {
+					return SPFTempError
+				}
+				for i, mx := range mxs {
+					if i >= SPFMaxDNSLookups {
+						return SPFPermError
+					}
+					hosts = append(hosts, mx.Host)
+				}
+			}
+			for _, host := range hosts {
+				ips, err := check.resolver.LookupIP(host)
+				if err != nil && !isDNSNotFound(err) {
+					return SPFTempError
+				}
+				if check.matchIPs(ips, prefix4, prefix6) {
+					matched = true
+					break
+				}
+			}
+		case "include":
+			if err := check.countLookup(); err != nil {
+				return SPFPermError
+			}
+			target, err := check.expandMacros(arg, domain)
+			if err != nil || target == "" {
+				return SPFPermError
+			}
+			switch result = check.checkHost(target); result {
+			case SPFPass:
+				matched = true
+			case SPFTempError:
+				return SPFTempError
+			case SPFPermError, SPFNone:
+				return SPFPermError
+			}
+		case "exists":
+			if err := check.countLookup(); err != nil {
+				return SPFPermError
+			}
+			target, err := check.expandMacros(arg, domain)
+			if err != nil || target == "" {
+				return SPFPermError
+			}
+			ips, err := check.resolver.LookupIP(target)
+			if err != nil && !isDNSNotFound(err) {
+				return SPFTempError
+			}
+			matched = len(ips) > 0
+		case "ptr":
+			// The mechanism is deprecated, it counts towards the lookup limit but never matches.
+			if err := check.countLookup(); err != nil {
+				return SPFPermError
+			}
+		default:
+			return SPFPermError
+		}
+		if matched {
+			return qualifier
+		}
+	}
+	if redirect != "" {
+		if err := check.countLookup(); err != nil {
+			return SPFPermError
+		}
+		target, err := check.expandMacros(redirect, domain)
+		if err != nil {
+			return SPFPermError
+		}
+		if result := check.checkHost(target); result != SPFNone {
+			return result
+		}
+		return SPFPermError
+	}
+	return SPFNeutral
+}
+
+/*
+CheckSPF returns the SPF verification result of the client IP sending mails on behalf of the envelope sender address.
+If the envelope sender is empty (e.g. a bounce message), the HELO name is checked instead.
+*/
+func CheckSPF(resolver Resolver, clientIP, sender, heloName string) (result, domain string) {
+	_, domain = GetMailAddressComponents(sender)
+	if domain == "" {
+		domain = heloName
+		sender = "postmaster@" + heloName
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil || domain == "" {
+		return SPFNone, domain
+	}
+	check := &spfCheck{resolver: resolver, clientIP: ip, sender: sender, heloName: heloName}
+	return check.checkHost(strings.ToLower(domain)), strings.ToLower(domain)
+}
+
+/*
+GetOrganisationalDomain returns the organisational domain (RFC 7489 section 3.2) of a domain name, that is the domain
+name registered under a public suffix, e.g. "example.co.uk" for "mail.example.co.uk". If the domain name is a public
+suffix itself, the domain name is returned as-is.
+*/
+func GetOrganisationalDomain(domain string) string {
+	domain = strings.Trim(strings.ToLower(domain), ".")
+	orgDomain, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return orgDomain
+}
+
+// DMARCRecord is the DMARC policy of a domain.
+type DMARCRecord struct {
+	Policy          string // Policy is one of "none", "quarantine", or "reject".
+	SubdomainPolicy string // SubdomainPolicy applies to sub-domains of the organisational domain, it defaults to Policy.
+	StrictSPF       bool   // StrictSPF requires the SPF domain to be identical to From domain, rather than sharing the organisational domain.
+	StrictDKIM      bool   // StrictDKIM requires the DKIM signing domain to be identical to From domain.
+}
+
+// GetDMARCRecord retrieves the DMARC policy of a domain, it returns nil if the domain does not publish a policy.
+func GetDMARCRecord(resolver Resolver, domain string) (*DMARCRecord, error) {
+	txts, err := resolver.LookupTXT("_dmarc." + domain)
+	if err != nil {
+		if isDNSNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	for _, txt := range txts {
+		tags := make(map[string]string)
+		for _, tag := range strings.Split(txt, ";") {
+			if equal := strings.IndexByte(tag, '='); equal != -1 {
+				tags[strings.ToLower(strings.TrimSpace(tag[:equal]))] = strings.ToLower(strings.TrimSpace(tag[equal+1:]))
+			}
+		}
+		if tags["v"] != "dmarc1" {
+			continue
+		}
+		record := &DMARCRecord{Policy: tags["p"], SubdomainPolicy: tags["sp"], StrictSPF: tags["aspf"] == "s", StrictDKIM: tags["adkim"] == "s"}
+		if record.Policy != "quarantine" && record.Policy != "reject" {
+			record.Policy = "none"
+		}
+		if record.SubdomainPolicy != "none" && record.SubdomainPolicy != "quarantine" && record.SubdomainPolicy != "reject" {
+			record.SubdomainPolicy = record.Policy
+		}
+		return record, nil
+	}
+	return nil, nil
+}
+
+// SenderAuthResult is the outcome of SPF, DKIM, and DMARC verification of a received mail.
+type SenderAuthResult struct {
+	ServerName  string            // ServerName identifies this mail server in the annotation.
+	SPF         string            // SPF is the SPF verification result.
+	SPFDomain   string            // SPFDomain is the domain of envelope sender (or HELO name) checked by SPF.
+	DKIM        []inet.DKIMResult // DKIM are the verification results of DKIM signatures.
+	FromDomain  string            // FromDomain is the domain of mail's From header.
+	DMARC       string            // DMARC is the DMARC verification result.
+	DMARCPolicy string            // DMARCPolicy is the policy requested by the From domain for a failed verification.
+}
+
+/*
+IsHardFailure returns true if the mail should be rejected: the DMARC verification has failed and the From domain asks
+for rejection, or the From domain does not publish a DMARC policy and the SPF verification has failed.
+*/
+func (result SenderAuthResult) IsHardFailure() bool {
+	return result.DMARC == DMARCFail && result.DMARCPolicy == "reject" || result.DMARC == DMARCNone && result.SPF == SPFFail
+}
+
+// String returns the value of Authentication-Results header that annotates the verification results.
+func (result SenderAuthResult) String() string {
+	ret := fmt.Sprintf("%s; spf=%s smtp.mailfrom=%s", result.ServerName, result.SPF, result.SPFDomain)
+	if len(result.DKIM) == 0 {
+		ret += "; dkim=none"
+	}
+	for _, dkim := range result.DKIM {
+		if dkim.Pass {
+			ret += fmt.Sprintf("; dkim=pass header.d=%s", dkim.Domain)
+		} else {
+			ret += fmt.Sprintf("; dkim=fail (%s) header.d=%s", strings.Replace(dkim.Reason, ";", ",", -1), dkim.Domain)
+		}
+	}
+	ret += fmt.Sprintf("; dmarc=%s", result.DMARC)
+	if result.DMARC != DMARCNone {
+		ret += fmt.Sprintf(" (p=%s)", result.DMARCPolicy)
+	}
+	return ret + " header.from=" + result.FromDomain
+}
+
+// isAligned returns true if the authenticated domain is aligned with the From domain.
+func isAligned(authDomain, fromDomain string, strict bool) bool {
+	if strict {
+		return strings.EqualFold(authDomain, fromDomain)
+	}
+	return authDomain != "" && GetOrganisationalDomain(authDomain) == GetOrganisationalDomain(fromDomain)
+}
+
+/*
+AuthenticateSender verifies SPF of the envelope sender, DKIM signatures, and DMARC alignment of the From header domain
+of a received mail.
+*/
+func AuthenticateSender(resolver Resolver, serverName, clientIP, heloName, envelopeFrom string, mailBody []byte) (result SenderAuthResult) {
+	result.ServerName = serverName
+	result.SPF, result.SPFDomain = CheckSPF(resolver, clientIP, envelopeFrom, heloName)
+	result.DKIM = inet.VerifyDKIM(mailBody, resolver.LookupTXT)
+	result.DMARC = DMARCNone
+	if msg, err := mail.ReadMessage(strings.NewReader(string(mailBody))); err == nil {
+		if addr, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+			_, result.FromDomain = GetMailAddressComponents(strings.ToLower(addr.Address))
+		}
+	}
+	if result.FromDomain == "" {
+		return
+	}
+	// Look for the policy of From domain, and then the policy of its organisational domain.
+	record, err := GetDMARCRecord(resolver, result.FromDomain)
+	isSubdomain := false
+	if err == nil && record == nil {
+		if orgDomain := GetOrganisationalDomain(result.FromDomain); orgDomain != result.FromDomain {
+			record, err = GetDMARCRecord(resolver, orgDomain)
+			isSubdomain = true
+		}
+	}
+	if err != nil || record == nil {
+		return
+	}
+	result.DMARCPolicy = record.Policy
+	if isSubdomain {
+		result.DMARCPolicy = record.SubdomainPolicy
+	}
+	result.DMARC = DMARCFail
+	if result.SPF == SPFPass && isAligned(result.SPFDomain, result.FromDomain, record.StrictSPF) {
+		result.DMARC = DMARCPass
+	}
+	for _, dkim := range result.DKIM {
+		if dkim.Pass && isAligned(dkim.Domain, result.FromDomain, record.StrictDKIM) {
+			result.DMARC = DMARCPass
+		}
+	}
+	return
+}
@@ -0,0 +1,155 @@
+package smtpd
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// getTestResolver returns a resolver that answers DNS queries from the maps of records.
+func getTestResolver(txts map[string][]string, ips map[string][]net.IP, mxs map[string][]*net.MX) Resolver {
+	notFound := func(name string) error {
+		return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return Resolver{
+		LookupTXT: func(name string) ([]string, error) {
+			if records, exists := txts[name]; exists {
+				return records, nil
+			}
+			return nil, notFound(name)
+		},
+		LookupIP: func(name string) ([]net.IP, error) {
+			if records, exists := ips[name]; exists {
+				return records, nil
+			}
+			return nil, notFound(name)
+		},
+		LookupMX: func(name string) ([]*net.MX, error) {
+			if records, exists := mxs[name]; exists {
+				return records, nil
+			}
+			return nil, notFound(name)
+		},
+	}
+}
+
+func TestCheckSPF(t *testing.T) {
+	resolver := getTestResolver(map[string][]string{
+		"example.com":          {"some other record", "v=spf1 ip4:192.0.2.0/24 ip6:2001:db8::/32 a mx:mail.example.com/30 include:_spf.example.net -all"},
+		"_spf.example.net":     {"v=spf1 ip4:198.51.100.1 ~all"},
+		"redirect.example":     {"v=spf1 redirect=example.com"},
+		"macro.example":        {"v=spf1 exists:%{i}._spf.%{d} ?all"},
+		"bad.example":          {"v=spf1 ip4:not-an-ip -all"},
+		"twice.example":        {"v=spf1 -all", "v=spf1 +all"},
+		"loop.example":         {"v=spf1 include:loop.example -all"},
+		"helo.example.org":     {"v=spf1 a:helo.example.org -all"},
+		"neutral.example":      {"v=spf1"},
+		"include-none.example": {"v=spf1 include:nothing.example -all"},
+	}, map[string][]net.IP{
+		"example.com":                     {net.ParseIP("203.0.113.10")},
+		"mx1.example.com":                 {net.ParseIP("203.0.113.20")},
+		"helo.example.org":                {net.ParseIP("203.0.113.30")},
+		"203.0.113.99._spf.macro.example": {net.ParseIP("127.0.0.2")},
+	}, map[string][]*net.MX{
+		"mail.example.com": {{Host: "mx1.example.com", Pref: 10}},
+	})
+	for _, test := range []struct {
+		clientIP, sender, helo, result string
+	}{
+		{"192.0.2.55", "a@example.com", "", SPFPass},
+		{"2001:db8::1", "a@example.com", "", SPFPass},
+		{"203.0.113.10", "a@example.com", "", SPFPass},
+		{"203.0.113.22", "a@example.com", "", SPFPass},
+		{"203.0.113.24", "a@example.com", "", SPFFail},
+		{"198.51.100.1", "a@example.com", "", SPFPass},
+		{"198.51.100.2", "a@example.com", "", SPFFail},
+		{"198.51.100.2", "a@redirect.example", "", SPFFail},
+		{"192.0.2.1", "a@redirect.example", "", SPFPass},
+		{"203.0.113.99", "a@macro.example", "", SPFPass},
+		{"203.0.113.98", "a@macro.example", "", SPFNeutral},
+		{"192.0.2.1", "a@bad.example", "", SPFPermError},
+		{"192.0.2.1", "a@twice.example", "", SPFPermError},
+		{"192.0.2.1", "a@loop.example", "", SPFPermError},
+		{"192.0.2.1", "a@include-none.example", "", SPFPermError},
+		{"192.0.2.1", "a@neutral.example", "", SPFNeutral},
+		{"192.0.2.1", "a@does-not-exist.example", "", SPFNone},
+		{"203.0.113.30", "", "helo.example.org", SPFPass},
+		{"203.0.113.31", "", "helo.example.org", SPFFail},
+		{"not an IP", "a@example.com", "", SPFNone},
+	} {
+		if result, _ := CheckSPF(resolver, test.clientIP, test.sender, test.helo); result != test.result {
+			t.Fatal(test, result)
+		}
+	}
+	if _, domain := CheckSPF(resolver, "192.0.2.1", "", "helo.example.org"); domain != "helo.example.org" {
+		t.Fatal(domain)
+	}
+}
+
+func TestGetOrganisationalDomain(t *testing.T) {
+	for domain, orgDomain := range map[string]string{
+		"example.com":            "example.com",
+		"mail.example.com":       "example.com",
+		"a.b.mail.example.com.":  "example.com",
+		"mail.example.co.uk":     "example.co.uk",
+		"localhost":              "localhost",
+		"sub.example.technology": "example.technology",
+		"mail.abc.de":            "abc.de",
+		"mail.example.com.au":    "example.com.au",
+		"a.example.blogspot.com": "example.blogspot.com",
+		"co.uk":                  "co.uk",
+	} {
+		if got := GetOrganisationalDomain(domain); got != orgDomain {
+			t.Fatal(domain, got)
+		}
+	}
+}
+
+func TestAuthenticateSender(t *testing.T) {
+	resolver := getTestResolver(map[string][]string{
+		"example.com":        {"v=spf1 ip4:192.0.2.0/24 -all"},
+		"_dmarc.example.com": {"v=DMARC1; p=reject; sp=quarantine"},
+		"bounce.example.net": {"v=spf1 ip4:198.51.100.0/24 -all"},
+		"_dmarc.example.org": {"v=DMARC1; p=none; aspf=s"},
+		"example.org":        {"v=spf1 ip4:192.0.2.0/24 -all"},
+		"nodmarc.example":    {"v=spf1 -all"},
+	}, nil, nil)
+	mail := func(from string) []byte {
+		return []byte("From: Someone <" + from + ">\nSubject: hi\n\nbody\n")
+	}
+	// Aligned SPF passes DMARC
+	result := AuthenticateSender(resolver, "laitos.example", "192.0.2.1", "helo", "bounce@example.com", mail("a@example.com"))
+	if result.SPF != SPFPass || result.DMARC != DMARCPass || result.DMARCPolicy != "reject" || result.IsHardFailure() {
+		t.Fatalf("%+v", result)
+	}
+	if str := result.String(); str != "laitos.example; spf=pass smtp.mailfrom=example.com; dkim=none; dmarc=pass (p=reject) header.from=example.com" {
+		t.Fatal(str)
+	}
+	// Unaligned SPF fails DMARC
+	result = AuthenticateSender(resolver, "laitos.example", "198.51.100.1", "helo", "bounce@bounce.example.net", mail("a@example.com"))
+	if result.SPF != SPFPass || result.DMARC != DMARCFail || !result.IsHardFailure() {
+		t.Fatalf("%+v", result)
+	}
+	// Sub-domain uses the sub-domain policy of its organisational domain, relaxed alignment accepts sub-domains.
+	result = AuthenticateSender(resolver, "laitos.example", "192.0.2.1", "helo", "bounce@example.com", mail("a@news.example.com"))
+	if result.DMARC != DMARCPass || result.DMARCPolicy != "quarantine" {
+		t.Fatalf("%+v", result)
+	}
+	result = AuthenticateSender(resolver, "laitos.example", "198.51.100.1", "helo", "bounce@example.com", mail("a@news.example.com"))
+	if result.SPF != SPFFail || result.DMARC != DMARCFail || result.DMARCPolicy != "quarantine" || result.IsHardFailure() {
+		t.Fatalf("%+v", result)
+	}
+	// Strict alignment does not accept sub-domains
+	result = AuthenticateSender(resolver, "laitos.example", "192.0.2.1", "helo", "bounce@example.org", mail("a@sub.example.org"))
+	if result.SPF != SPFPass || result.DMARC != DMARCFail || result.DMARCPolicy != "none" || result.IsHardFailure() {
+		t.Fatalf("%+v", result)
+	}
+	// Without DMARC policy, SPF failure is a hard failure.
+	result = AuthenticateSender(resolver, "laitos.example", "192.0.2.1", "helo", "a@nodmarc.example", mail("a@nodmarc.example"))
+	if result.SPF != SPFFail || result.DMARC != DMARCNone || !result.IsHardFailure() {
+		t.Fatalf("%+v", result)
+	}
+	if str := result.String(); !strings.HasSuffix(str, "; dmarc=none header.from=nodmarc.example") {
+		t.Fatal(str)
+	}
+}
@@ -20,6 +20,9 @@ import (
 	"github.com/HouzuoGuo/laitos/testingstub"
 )
 
+// conversationStats times the SMTP conversations.
+var conversationStats = misc.GetStats("smtpd.Conversations")
+
 const (
 	IOTimeoutSec          = 60  // IO timeout for both read and write operations
 	MaxConversationLength = 256 // Only converse up to this number of exchanges in an SMTP connection
@@ -32,18 +35,42 @@ type Daemon struct {
 	Port        int    `json:"Port"`        // Port number to listen on.
 	TLSCertPath string `json:"TLSCertPath"` // TLSCertPath is the path to server's TLS certificate for StartTLS operation. This is optional.
 	TLSKeyPath  string `json:"TLSKeyPath"`  // TLSCertPath is the path to server's TLS certificate key for StartTLS operation. This is optional.
-	PerIPLimit  int    `json:"PerIPLimit"`  // PerIPLimit is the maximum number of approximately how many concurrent users are expected to be using the server from same IP address
+	/*
+		ShareHTTPDCertificate uses the TLS certificate and key of the web server (HTTPDaemon) for StartTLS operation, if
+		TLSCertPath and TLSKeyPath are not specified. This is optional.
+	*/
+	ShareHTTPDCertificate bool `json:"ShareHTTPDCertificate"`
+	PerIPLimit            int  `json:"PerIPLimit"` // PerIPLimit is the maximum number of approximately how many concurrent users are expected to be using the server from same IP address
 	// MyDomains is an array of domain names that this SMTP server receives mails for. Mails addressed to domain names other than these will be rejected.
 	MyDomains []string `json:"MyDomains"`
 	// ForwardTo are the recipients (email addresses) to receive emails that are delivered to this SMTP server.
 	ForwardTo []string `json:"ForwardTo"`
+	// Maildir is the path to a local maildir to store the received mails in, in addition to forwarding them. This is optional.
+	Maildir string `json:"Maildir"`
+	/*
+		Routes handle the mails addressed to specific recipients, by forwarding them to different addresses, running
+		toolbox commands found in them, or storing them in local maildirs. Recipients that are not matched by any route are
+		handled by ForwardTo, Maildir, and the mail command runner.
+	*/
+	Routes []MailRoute `json:"Routes"`
+	/*
+		VerifySPFAndDMARC verifies SPF, DKIM, and DMARC alignment of received mails, and annotates the results in an
+		Authentication-Results header of the forwarded copies.
+	*/
+	VerifySPFAndDMARC bool `json:"VerifySPFAndDMARC"`
+	/*
+		RejectSPFAndDMARCFailure rejects the mails that fail DMARC verification when their From domain asks for rejection,
+		or fail SPF verification when their From domain does not publish a DMARC policy. It requires VerifySPFAndDMARC.
+	*/
+	RejectSPFAndDMARCFailure bool `json:"RejectSPFAndDMARCFailure"`
 
 	CommandRunner     *mailcmd.CommandRunner `json:"-"` // Process feature commands from incoming mails
 	ForwardMailClient inet.MailClient        `json:"-"` // ForwardMailClient is used to forward arriving emails.
 
 	myDomainsHash map[string]struct{} // myDomainHash has "MyDomains" in map keys
+	resolver      Resolver            // resolver looks up DNS records for sender authentication.
 	smtpConfig    smtp.Config
-	tlsCert       tls.Certificate
+	certLoader    *common.CertificateLoader // certLoader serves the TLS certificate and reloads it after renewal.
 	tcpServer     *common.TCPServer
 	logger        lalog.Logger
 
@@ -66,24 +93,32 @@ func (daemon *Daemon) Initialise() error {
 		ComponentName: "smtpd",
 		ComponentID:   []lalog.LoggerIDField{{Key: "Port", Value: daemon.Port}},
 	}
-	if daemon.ForwardTo == nil || len(daemon.ForwardTo) == 0 || !daemon.ForwardMailClient.IsConfigured() {
-		return errors.New("smtpd.Initialise: forward address and forward mail client must be configured")
+	if len(daemon.ForwardTo) == 0 && daemon.Maildir == "" && len(daemon.Routes) == 0 {
+		return errors.New("smtpd.Initialise: forward address, maildir, or mail routes must be configured")
+	}
+	needMailClient := len(daemon.ForwardTo) > 0
+	for _, route := range daemon.Routes {
+		needMailClient = needMailClient || len(route.ForwardTo) > 0
+	}
+	if needMailClient && !daemon.ForwardMailClient.IsConfigured() {
+		return errors.New("smtpd.Initialise: forward mail client must be configured")
 	}
 	if daemon.MyDomains == nil || len(daemon.MyDomains) == 0 {
 		return errors.New("smtpd.Initialise: my domain names must be configured")
 	}
+	if daemon.RejectSPFAndDMARCFailure && !daemon.VerifySPFAndDMARC {
+		return errors.New("smtpd.Initialise: VerifySPFAndDMARC must be enabled to reject SPF and DMARC failures")
+	}
+	if daemon.resolver.LookupTXT == nil {
+		daemon.resolver = DefaultResolver
+	}
 	if daemon.TLSCertPath != "" || daemon.TLSKeyPath != "" {
 		if daemon.TLSCertPath == "" || daemon.TLSKeyPath == "" {
 			return errors.New("smtpd.Initialise: TLS certificate or key path is missing")
 		}
-		var err error
-		contents, _, err := misc.DecryptIfNecessary(misc.ProgramDataDecryptionPassword, daemon.TLSCertPath, daemon.TLSKeyPath)
-		if err != nil {
-			return err
-		}
-		daemon.tlsCert, err = tls.X509KeyPair(contents[0], contents[1])
-		if err != nil {
-			return fmt.Errorf("smtpd.Initialise: failed to load certificate or key - %v", err)
+		daemon.certLoader = &common.CertificateLoader{CertPath: daemon.TLSCertPath, KeyPath: daemon.TLSKeyPath}
+		if err := daemon.certLoader.Load(); err != nil {
+			return fmt.Errorf("smtpd.Initialise: %v", err)
 		}
 	}
 	daemon.smtpConfig = smtp.Config{
@@ -94,8 +129,9 @@ func (daemon *Daemon) Initialise() error {
 		ServerName: strings.Join(daemon.MyDomains, " "),
 	}
 	if daemon.TLSCertPath != "" {
+		// The loader checks the certificate files for changes at most once a minute, and serves the new certificate to later STARTTLS handshakes.
 		daemon.smtpConfig.TLSConfig = &tls.Config{
-			Certificates: []tls.Certificate{daemon.tlsCert},
+			GetCertificate: daemon.certLoader.GetCertificate,
 		}
 	}
 
@@ -114,13 +150,17 @@ func (daemon *Daemon) Initialise() error {
 		daemon.myDomainsHash[recv] = struct{}{}
 	}
 	// Make sure that none of the forward addresses carries the domain name of MyDomains
-	for _, fwd := range daemon.ForwardTo {
-		atSign := strings.IndexRune(fwd, '@')
-		if atSign == -1 {
-			return fmt.Errorf("smtpd.Initialise: forward address \"%s\" must have an at sign", fwd)
+	if err := checkForwardAddresses(daemon.ForwardTo, daemon.myDomainsHash); err != nil {
+		return fmt.Errorf("smtpd.Initialise: %v", err)
+	}
+	if daemon.Maildir != "" {
+		if err := (inet.Maildir{Dir: daemon.Maildir}).Initialise(); err != nil {
+			return fmt.Errorf("smtpd.Initialise: %v", err)
 		}
-		if _, exists := daemon.myDomainsHash[fwd[atSign+1:]]; exists {
-			return fmt.Errorf("smtpd.Initialise: forward address \"%s\" must not loop back to this mail server's domain", fwd)
+	}
+	for i, route := range daemon.Routes {
+		if err := route.Initialise(daemon.myDomainsHash); err != nil {
+			return fmt.Errorf("smtpd.Initialise: Routes[%d]: %v", i, err)
 		}
 	}
 	// Initialise the optional toolbox command runner
@@ -153,8 +193,15 @@ func (daemon *Daemon) Initialise() error {
 	return nil
 }
 
-// Unconditionally forward the mail to forward addresses, then process feature commands if they are found.
-func (daemon *Daemon) ProcessMail(clientIP, fromAddr, mailBody string) {
+/*
+ProcessMail forwards the mail to the forward addresses and stores it in the maildirs of the routes matching its
+recipients, then processes feature commands if they are found.
+*/
+func (daemon *Daemon) ProcessMail(clientIP, fromAddr string, toAddrs []string, mailBody string) {
+	actions := daemon.getMailActions(toAddrs)
+	if len(actions.unrouted) > 0 {
+		daemon.logger.Warning("ProcessMail", fromAddr, nil, "no route forwards or stores the mail addressed to %v", actions.unrouted)
+	}
 	bodyBytes := []byte(mailBody)
 	// Determine whether the sender enforces DMARC policy
 	fromAddrWithoutDmarc := GetFromAddressWithDmarcWorkaround(fromAddr, rand.Intn(100000))
@@ -166,17 +213,27 @@ func (daemon *Daemon) ProcessMail(clientIP, fromAddr, mailBody string) {
 		bodyBytes = WithHeaderFromAddr(bodyBytes, fromAddrWithoutDmarc)
 	}
 	// Forward the mail to all recipients
-	if err := daemon.ForwardMailClient.SendRaw(daemon.ForwardMailClient.MailFrom, bodyBytes, daemon.ForwardTo...); err == nil {
-		daemon.logger.Info("ProcessMail", fromAddr, nil, "successfully forwarded mail to %v", daemon.ForwardTo)
-	} else {
-		daemon.logger.Warning("ProcessMail", fromAddr, err, "failed to forward email")
+	if len(actions.forwardTo) > 0 {
+		if err := daemon.ForwardMailClient.SendRaw(daemon.ForwardMailClient.MailFrom, bodyBytes, actions.forwardTo...); err == nil {
+			daemon.logger.Info("ProcessMail", fromAddr, nil, "successfully forwarded mail to %v", actions.forwardTo)
+		} else {
+			daemon.logger.Warning("ProcessMail", fromAddr, err, "failed to forward email")
+		}
+	}
+	// Store the mail in local maildirs
+	for _, dir := range actions.maildirs {
+		if name, err := (inet.Maildir{Dir: dir}).Deliver(bodyBytes); err == nil {
+			daemon.logger.Info("ProcessMail", fromAddr, nil, "stored mail as %s in maildir %s", name, dir)
+		} else {
+			daemon.logger.Warning("ProcessMail", fromAddr, err, "failed to store mail in maildir %s", dir)
+		}
 	}
 	// Offer the processed mail to test case
 	if daemon.processMailTestCaseFunc != nil {
 		daemon.processMailTestCaseFunc(fromAddr, string(bodyBytes))
 	}
 	// Run feature command from mail body
-	if daemon.CommandRunner != nil && daemon.CommandRunner.Processor != nil && !daemon.CommandRunner.Processor.IsEmpty() {
+	if actions.runCommands && daemon.CommandRunner != nil && daemon.CommandRunner.Processor != nil && !daemon.CommandRunner.Processor.IsEmpty() {
 		if err := daemon.CommandRunner.Process(clientIP, bodyBytes); err != nil {
 			daemon.logger.Warning("ProcessMail", fromAddr, err, "failed to process toolbox command from mail body")
 		}
@@ -185,7 +242,7 @@ func (daemon *Daemon) ProcessMail(clientIP, fromAddr, mailBody string) {
 
 // GetTCPStatsCollector returns the stats collector that counts and times client connections for the TCP application.
 func (daemon *Daemon) GetTCPStatsCollector() *misc.Stats {
-	return misc.SMTPDStats
+	return conversationStats
 }
 
 // HandleTCPConnection converses with the SMTP client. The client connection is closed by server upon returning from the implementation.
@@ -195,8 +252,9 @@ func (daemon *Daemon) HandleTCPConnection(logger lalog.Logger, ip string, client
 	var completionStatus string
 	// memorise latest conversations for logging purpose
 	latestConv := lalog.NewRingBuffer(4)
-	// fromAddr, mailBody, and toAddrs will be filled as SMTP conversation goes on
-	var fromAddr, mailBody string
+	// heloName, fromAddr, mailBody, and toAddrs will be filled as SMTP conversation goes on
+	var heloName, fromAddr, mailBody string
+	var rejected bool
 	toAddrs := make([]string, 0, 4)
 
 	smtpConn := smtp.NewConnection(client, daemon.smtpConfig, nil)
@@ -228,13 +286,20 @@ func (daemon *Daemon) HandleTCPConnection(logger lalog.Logger, ip string, client
 			goto done
 		case smtp.ConvReceivedCommand:
 			switch ev.Verb {
+			case smtp.VerbHELO, smtp.VerbEHLO:
+				heloName = ev.Parameter
 			case smtp.VerbMAILFROM:
 				fromAddr = ev.Parameter
+				rejected = false
 			case smtp.VerbRCPTTO:
 				atSign := strings.IndexRune(ev.Parameter, '@')
 				if atSign > 0 {
 					if domain, exists := daemon.myDomainsHash[ev.Parameter[atSign+1:]]; exists {
-						if len(toAddrs) < MaxNumRecipients {
+						if !daemon.isRecipientHandled(ev.Parameter) {
+							// Reject the recipient alone, the client may carry on with other recipients.
+							daemon.logger.Info("HandleTCPConnection", ip, nil, "rejected recipient \"%s\" that is not handled by any route", ev.Parameter)
+							smtpConn.AnswerNegative()
+						} else if len(toAddrs) < MaxNumRecipients {
 							toAddrs = append(toAddrs, ev.Parameter)
 						}
 					} else {
@@ -246,14 +311,26 @@ func (daemon *Daemon) HandleTCPConnection(logger lalog.Logger, ip string, client
 			}
 		case smtp.ConvReceivedData:
 			mailBody = ev.Parameter
+			if daemon.VerifySPFAndDMARC {
+				authResult := AuthenticateSender(daemon.resolver, daemon.MyDomains[0], ip, heloName, fromAddr, []byte(mailBody))
+				daemon.logger.Info("HandleTCPConnection", ip, nil, "sender authentication of mail from \"%s\": %s", fromAddr, authResult.String())
+				if daemon.RejectSPFAndDMARCFailure && authResult.IsHardFailure() {
+					daemon.logger.Warning("HandleTCPConnection", ip, nil, "rejected mail from \"%s\" that failed SPF or DMARC verification", fromAddr)
+					smtpConn.AnswerNegative()
+					rejected = true
+					mailBody = ""
+				} else {
+					mailBody = AuthResultsHeader + ": " + authResult.String() + "\r\n" + mailBody
+				}
+			}
 		}
 	}
 done:
 	if fromAddr != "" && len(toAddrs) > 0 && mailBody != "" {
 		daemon.logger.Info("HandleTCPConnection", ip, nil, "received mail from \"%s\" addressed to %s", fromAddr, strings.Join(toAddrs, ", "))
-		// Forward the mail to forward-recipients, hence the original To-Addresses are not relevant.
-		daemon.ProcessMail(ip, fromAddr, mailBody)
-	} else {
+		// The recipients decide which routes handle the mail
+		daemon.ProcessMail(ip, fromAddr, toAddrs, mailBody)
+	} else if !rejected {
 		smtpConn.AnswerNegative()
 		completionStatus += " & rejected mail due to missing parameters"
 	}
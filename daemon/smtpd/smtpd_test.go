@@ -1,8 +1,12 @@
 package smtpd
 
 import (
+	"io/ioutil"
+	netsmtp "net/smtp"
+	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/HouzuoGuo/laitos/daemon/smtpd/mailcmd"
 	"github.com/HouzuoGuo/laitos/inet"
@@ -120,3 +124,51 @@ func TestSMTPD_StartAndBlock(t *testing.T) {
 
 	TestSMTPD(&daemon, t)
 }
+
+func TestSMTPD_RejectUnhandledRecipient(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-TestSMTPD_RejectUnhandledRecipient")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// Without default forward addresses and maildir, only the recipients matched by routes are accepted
+	daemon := Daemon{
+		Address:   "127.0.0.1",
+		Port:      61359,
+		MyDomains: []string{"example.com"},
+		Routes:    []MailRoute{{Recipients: []string{"howard@example.com"}, Maildir: dir}},
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if err := daemon.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer daemon.Stop()
+	var client *netsmtp.Client
+	for i := 0; i < 30; i++ {
+		if client, err = netsmtp.Dial("127.0.0.1:61359"); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Mail("sender@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Rcpt("nobody@example.com"); err == nil || !strings.HasPrefix(err.Error(), "550") {
+		t.Fatal(err)
+	}
+	// The conversation carries on with the other recipients
+	if err := client.Rcpt("howard@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Quit(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,127 @@
+package snmp
+
+import (
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+const (
+	TagInteger     = 0x02 // TagInteger is the BER tag of a primitive integer.
+	TagOctetString = 0x04 // TagOctetString is the BER tag of a primitive octet string.
+	TagNull        = 0x05 // TagNull is the BER tag of a null value.
+	TagOID         = 0x06 // TagOID is the BER tag of an object identifier.
+	TagCounter32   = 0x41 // TagCounter32 is the BER tag of an SNMP application-specific 32-bit counter.
+)
+
+// Counter32 is an SNMP counter value, it is encoded differently from an integer.
+type Counter32 uint32
+
+/*
+TLV is a BER encoded tag-length-value read from input. Unlike encoding/asn1, the decoder tolerates lengths that are not
+minimally encoded, which are commonly produced by SNMP clients.
+*/
+type TLV struct {
+	Tag       byte
+	Value     []byte
+	HeaderLen int // HeaderLen is the number of bytes taken by the tag and length.
+}
+
+// ReadTLV reads a tag-length-value from the beginning of input, and returns the remainder of input.
+func ReadTLV(in []byte) (tlv TLV, rest []byte, err error) {
+	if len(in) < 2 {
+		return TLV{}, nil, errors.New("premature end of BER value")
+	}
+	tlv.Tag = in[0]
+	length := int(in[1])
+	tlv.HeaderLen = 2
+	if length&0x80 != 0 {
+		numLenBytes := length & 0x7f
+		if numLenBytes == 0 || numLenBytes > 4 || len(in) < 2+numLenBytes {
+			return TLV{}, nil, fmt.Errorf("malformed BER length of tag %d", tlv.Tag)
+		}
+		length = 0
+		for _, b := range in[2 : 2+numLenBytes] {
+			length = length<<8 | int(b)
+		}
+		tlv.HeaderLen += numLenBytes
+	}
+	// Compare without adding up the header and value lengths, as the sum may overflow on 32-bit platforms.
+	if length < 0 || length > len(in)-tlv.HeaderLen {
+		return TLV{}, nil, fmt.Errorf("premature end of BER value of tag %d", tlv.Tag)
+	}
+	tlv.Value = in[tlv.HeaderLen : tlv.HeaderLen+length]
+	return tlv, in[tlv.HeaderLen+length:], nil
+}
+
+// ReadExpectedTLV reads a tag-length-value of the tag from the beginning of input, and returns the remainder of input.
+func ReadExpectedTLV(in []byte, tag byte) (value []byte, rest []byte, err error) {
+	tlv, rest, err := ReadTLV(in)
+	if err != nil {
+		return nil, nil, err
+	}
+	if tlv.Tag != tag {
+		return nil, nil, MissedExpectation("tag", tag, tlv.Tag)
+	}
+	return tlv.Value, rest, nil
+}
+
+// ReadInteger reads a primitive integer from the beginning of input, and returns the remainder of input.
+func ReadInteger(in []byte) (i int64, rest []byte, err error) {
+	value, rest, err := ReadExpectedTLV(in, TagInteger)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(value) == 0 || len(value) > 8 {
+		return 0, nil, fmt.Errorf("unexpected integer size (%d)", len(value))
+	}
+	// Two's complement, big endian
+	if value[0]&0x80 != 0 {
+		i = -1
+	}
+	for _, b := range value {
+		i = i<<8 | int64(b)
+	}
+	return i, rest, nil
+}
+
+// EncodeTLV encodes the tag and value along with the value's length.
+func EncodeTLV(tag byte, value []byte) []byte {
+	var header []byte
+	switch length := len(value); {
+	case length < 0x80:
+		header = []byte{tag, byte(length)}
+	case length <= 0xff:
+		header = []byte{tag, 0x81, byte(length)}
+	case length <= 0xffff:
+		header = []byte{tag, 0x82, byte(length >> 8), byte(length)}
+	default:
+		header = []byte{tag, 0x84, byte(length >> 24), byte(length >> 16), byte(length >> 8), byte(length)}
+	}
+	return append(header, value...)
+}
+
+// EncodeInteger encodes a primitive integer.
+func EncodeInteger(i int64) []byte {
+	// Marshalling an integer never fails
+	ret, _ := asn1.Marshal(i)
+	return ret
+}
+
+// EncodeValue encodes the value of an OID node or variable binding.
+func EncodeValue(value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case nil:
+		return []byte{TagNull, 0x00}, nil
+	case Counter32:
+		// Counter is an unsigned integer encoded under a different tag
+		intBytes := EncodeInteger(int64(v))
+		intBytes[0] = TagCounter32
+		return intBytes, nil
+	case []byte:
+		return EncodeTLV(TagOctetString, v), nil
+	case string:
+		return EncodeTLV(TagOctetString, []byte(v)), nil
+	}
+	return asn1.Marshal(value)
+}
@@ -0,0 +1,43 @@
+package snmp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadTLV(t *testing.T) {
+	tests := []struct {
+		in        []byte
+		tag       byte
+		value     []byte
+		rest      []byte
+		headerLen int
+		wantErr   bool
+	}{
+		{in: []byte{TagNull, 0}, tag: TagNull, value: []byte{}, rest: []byte{}, headerLen: 2},
+		{in: []byte{TagInteger, 1, 5, 9}, tag: TagInteger, value: []byte{5}, rest: []byte{9}, headerLen: 2},
+		// Long form length that is not minimally encoded
+		{in: []byte{TagOctetString, 0x82, 0, 2, 'a', 'b'}, tag: TagOctetString, value: []byte("ab"), rest: []byte{}, headerLen: 4},
+		{in: []byte{TagInteger}, wantErr: true},
+		{in: []byte{TagInteger, 2, 5}, wantErr: true},
+		{in: []byte{TagInteger, 0x80, 5}, wantErr: true},
+		{in: []byte{TagInteger, 0x85, 0, 0, 0, 0, 1, 5}, wantErr: true},
+		{in: []byte{TagInteger, 0x82, 0}, wantErr: true},
+		// Huge lengths must not overflow the bounds check
+		{in: []byte{TagOctetString, 0x84, 0x7f, 0xff, 0xff, 0xff, 'a'}, wantErr: true},
+		{in: []byte{TagOctetString, 0x84, 0xff, 0xff, 0xff, 0xff, 'a'}, wantErr: true},
+		{in: []byte{TagOctetString, 0x84, 0x7f, 0xff, 0xff, 0xfc, 'a'}, wantErr: true},
+	}
+	for i, test := range tests {
+		tlv, rest, err := ReadTLV(test.in)
+		if test.wantErr {
+			if err == nil {
+				t.Fatalf("test %d: should have failed, got %+v", i, tlv)
+			}
+			continue
+		}
+		if err != nil || tlv.Tag != test.tag || !bytes.Equal(tlv.Value, test.value) || !bytes.Equal(rest, test.rest) || tlv.HeaderLen != test.headerLen {
+			t.Fatalf("test %d: %+v %v %v", i, tlv, rest, err)
+		}
+	}
+}
@@ -7,15 +7,16 @@ import (
 	"time"
 
 	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/misc"
 )
 
 /*
-	ParentOID is the very top of OID hierarchy used in laitos SNMP server.
-	It contains a private enterprise number registered by Houzuo (Howard) Guo, 52535:
-	{iso(1) identified-organization(3) dod(6) internet(1) private(4) enterprise(1) 52535}
+ParentOID is the very top of OID hierarchy used in laitos SNMP server.
+It contains a private enterprise number registered by Houzuo (Howard) Guo, 52535:
+{iso(1) identified-organization(3) dod(6) internet(1) private(4) enterprise(1) 52535}
 
-	And laitos occupies number 121 underneath it.
+And laitos occupies number 121 underneath it.
 */
 var ParentOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 52535, 121}
 
@@ -51,25 +52,73 @@ var (
 		105: func() interface{} {
 			return int64(runtime.NumGoroutine())
 		},
+		// 1.3.6.1.4.1.52535.121.106 Integer - heap memory in use in bytes
+		106: func() interface{} {
+			var memStats runtime.MemStats
+			runtime.ReadMemStats(&memStats)
+			return int64(memStats.HeapAlloc)
+		},
+		// 1.3.6.1.4.1.52535.121.107 Integer - memory obtained from OS in bytes
+		107: func() interface{} {
+			var memStats runtime.MemStats
+			runtime.ReadMemStats(&memStats)
+			return int64(memStats.Sys)
+		},
 		/// 1.3.6.1.4.1.52535.121.110 Integer - number of command execution attempts
 		110: func() interface{} {
-			return int64(misc.CommandStats.Count())
+			return int64(misc.GetStats("toolbox.Commands").Count())
 		},
 		// 1.3.6.1.4.1.52535.121.111 Integer - number of web server requests processed
 		111: func() interface{} {
-			return int64(misc.HTTPDStats.Count())
+			return int64(misc.GetStats("httpd.Requests").Count())
 		},
 		// 1.3.6.1.4.1.52535.121.112 Integer - number of SMTP conversations
 		112: func() interface{} {
-			return int64(misc.SMTPDStats.Count())
+			return int64(misc.GetStats("smtpd.Conversations").Count())
 		},
-		// 1.3.6.1.4.1.52535.121.114 Integer - number of SMTP conversations
+		// 1.3.6.1.4.1.52535.121.114 Integer - number of auto-unlock events
 		114: func() interface{} {
-			return int64(misc.AutoUnlockStats.Count())
+			return int64(misc.GetStats("autounlock.Unlocks").Count())
 		},
 		// 1.3.6.1.4.1.52535.121.115 Integer - size of outstanding mails to deliver in bytes
 		115: func() interface{} {
-			return int64(misc.OutstandingMailBytes)
+			return misc.OutstandingMailBytes.Value()
+		},
+		// 1.3.6.1.4.1.52535.121.120 - 131 Integer - number of requests/conversations processed by each daemon
+		120: statsCountNode("dnsd.TCP"),
+		121: statsCountNode("dnsd.UDP"),
+		122: statsCountNode("plainsocket.TCP"),
+		123: statsCountNode("plainsocket.UDP"),
+		124: statsCountNode("serialport.Conversations"),
+		125: statsCountNode("simpleipsvcd.TCP"),
+		126: statsCountNode("simpleipsvcd.UDP"),
+		127: statsCountNode("snmpd.Requests"),
+		128: statsCountNode("sockd.TCP"),
+		129: statsCountNode("sockd.UDP"),
+		130: statsCountNode("telegrambot.Commands"),
+		131: statsCountNode("sshd.Sessions"),
+		// 1.3.6.1.4.1.52535.121.140 - 149 Integer - number of warnings (errors) logged by each daemon
+		140: warningCountNode("dnsd"),
+		141: warningCountNode("httpd"),
+		142: warningCountNode("smtpd"),
+		143: warningCountNode("plainsocket"),
+		144: warningCountNode("sockd"),
+		145: warningCountNode("telegrambot"),
+		146: warningCountNode("sshd"),
+		147: warningCountNode("snmpd"),
+		148: warningCountNode("simpleipsvcd"),
+		149: warningCountNode("serialport"),
+		// 1.3.6.1.4.1.52535.121.150 Integer - number of domain names and IPs on DNS blacklist
+		150: func() interface{} {
+			return misc.DNSDBlackListSize.Value()
+		},
+		// 1.3.6.1.4.1.52535.121.151 Integer - amount of data relayed by sock daemon TCP in bytes
+		151: func() interface{} {
+			return misc.SOCKDTCPTrafficBytes.Value()
+		},
+		// 1.3.6.1.4.1.52535.121.152 Integer - amount of data relayed by sock daemon UDP in bytes
+		152: func() interface{} {
+			return misc.SOCKDUDPTrafficBytes.Value()
 		},
 	}
 	/*
@@ -79,6 +128,22 @@ var (
 	OIDSuffixList []int
 )
 
+// statsCountNode returns a node function that retrieves the number of triggers counted by the stats registered under the name.
+func statsCountNode(name string) OIDNodeFunc {
+	stats := misc.GetStats(name)
+	return func() interface{} {
+		return int64(stats.Count())
+	}
+}
+
+// warningCountNode returns a node function that retrieves the number of warnings logged by the component.
+func warningCountNode(componentName string) OIDNodeFunc {
+	counter := lalog.GetCounter(componentName + ".Warnings")
+	return func() interface{} {
+		return counter.Value()
+	}
+}
+
 func init() {
 	// Place all of the supported OID suffix numbers into a sorted list
 	OIDSuffixList = make([]int, 0, len(OIDNodes))
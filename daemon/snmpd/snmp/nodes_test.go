@@ -3,6 +3,9 @@ package snmp
 import (
 	"encoding/asn1"
 	"testing"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
 )
 
 func TestGetNode(t *testing.T) {
@@ -53,6 +56,24 @@ func TestAllOIDNodes(t *testing.T) {
 	}
 }
 
+func TestDaemonNodes(t *testing.T) {
+	warnings, _ := GetNode(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 52535, 121, 140})
+	before := warnings().(int64)
+	logger := lalog.Logger{ComponentName: "dnsd"}
+	logger.Warning("TestDaemonNodes", "", nil, "test warning")
+	logger.Info("TestDaemonNodes", "", nil, "not a warning")
+	if after := warnings().(int64); after != before+1 {
+		t.Fatal(before, after)
+	}
+	misc.DNSDBlackListSize.Set(123)
+	if blacklist, _ := GetNode(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 52535, 121, 150}); blacklist().(int64) != 123 {
+		t.Fatal(blacklist())
+	}
+	if heap, _ := GetNode(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 52535, 121, 106}); heap().(int64) < 1 {
+		t.Fatal(heap())
+	}
+}
+
 func TestGetNextNode(t *testing.T) {
 	oid, endOfView := GetNextNode(asn1.ObjectIdentifier{9})
 	if !oid.Equal(FirstOID) || endOfView {
@@ -79,11 +100,15 @@ func TestGetNextNode(t *testing.T) {
 		t.Fatal(oid, endOfView)
 	}
 	oid, endOfView = GetNextNode(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 52535, 121, 115})
-	if !oid.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 52535, 121, 115}) || !endOfView {
+	if !oid.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 52535, 121, 120}) || endOfView {
+		t.Fatal(oid, endOfView)
+	}
+	oid, endOfView = GetNextNode(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 52535, 121, 152})
+	if !oid.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 52535, 121, 152}) || !endOfView {
 		t.Fatal(oid, endOfView)
 	}
 	// Not entirely sure if this one conforms to SNMP standard:
-	oid, endOfView = GetNextNode(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 52535, 121, 116})
+	oid, endOfView = GetNextNode(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 52535, 121, 153})
 	if !oid.Equal(FirstOID) || endOfView {
 		t.Fatal(oid, endOfView)
 	}
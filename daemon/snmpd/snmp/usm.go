@@ -0,0 +1,163 @@
+package snmp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+const (
+	AuthMD5    = "MD5"    // AuthMD5 is the HMAC-MD5-96 authentication protocol described in RFC 3414.
+	AuthSHA    = "SHA"    // AuthSHA is the HMAC-SHA-96 authentication protocol described in RFC 3414.
+	AuthSHA256 = "SHA256" // AuthSHA256 is the HMAC-SHA-256-192 authentication protocol described in RFC 7860.
+	PrivAES    = "AES"    // PrivAES is the AES-128 CFB privacy protocol described in RFC 3826.
+
+	// MinUSMPasswordLength is the minimum length of authentication and privacy passwords mandated by RFC 3414.
+	MinUSMPasswordLength = 8
+	// passwordToKeyLength is the number of bytes digested to derive a key from a password, as specified by RFC 3414.
+	passwordToKeyLength = 1048576
+)
+
+/*
+USMUser is an SNMPv3 user of the user-based security model. Messages of the user are authenticated by a key derived
+from AuthPassword, and optionally encrypted by a key derived from PrivPassword.
+*/
+type USMUser struct {
+	Name         string `json:"Name"`         // Name is the security name of the user.
+	AuthProtocol string `json:"AuthProtocol"` // AuthProtocol is one of "MD5", "SHA", or "SHA256".
+	AuthPassword string `json:"AuthPassword"` // AuthPassword derives the authentication key.
+	PrivProtocol string `json:"PrivProtocol"` // PrivProtocol is "AES" to encrypt messages, or empty to transmit them in plain text.
+	PrivPassword string `json:"PrivPassword"` // PrivPassword derives the privacy key.
+
+	authKey []byte // authKey is the authentication key localised to an engine ID.
+	privKey []byte // privKey is the privacy key localised to an engine ID.
+}
+
+// Validate returns an error if the user's protocols or passwords are not acceptable.
+func (user *USMUser) Validate() error {
+	if user.Name == "" {
+		return errors.New("user name must not be empty")
+	}
+	user.AuthProtocol = strings.ToUpper(user.AuthProtocol)
+	user.PrivProtocol = strings.ToUpper(user.PrivProtocol)
+	if user.newHash() == nil {
+		return fmt.Errorf("user %s has unsupported authentication protocol \"%s\"", user.Name, user.AuthProtocol)
+	}
+	if len(user.AuthPassword) < MinUSMPasswordLength {
+		return fmt.Errorf("user %s must have an authentication password of at least %d characters", user.Name, MinUSMPasswordLength)
+	}
+	switch user.PrivProtocol {
+	case "":
+	case PrivAES:
+		if len(user.PrivPassword) < MinUSMPasswordLength {
+			return fmt.Errorf("user %s must have a privacy password of at least %d characters", user.Name, MinUSMPasswordLength)
+		}
+	default:
+		return fmt.Errorf("user %s has unsupported privacy protocol \"%s\"", user.Name, user.PrivProtocol)
+	}
+	return nil
+}
+
+// HasPrivacy returns true only if the user's messages must be encrypted.
+func (user *USMUser) HasPrivacy() bool {
+	return user.PrivProtocol != ""
+}
+
+// newHash returns a new hash function of the authentication protocol, or nil if the protocol is not supported.
+func (user *USMUser) newHash() func() hash.Hash {
+	switch user.AuthProtocol {
+	case AuthMD5:
+		return md5.New
+	case AuthSHA:
+		return sha1.New
+	case AuthSHA256:
+		return sha256.New
+	}
+	return nil
+}
+
+// AuthParamsLength returns the length of the truncated HMAC that authenticates a message.
+func (user *USMUser) AuthParamsLength() int {
+	if user.AuthProtocol == AuthSHA256 {
+		return 24
+	}
+	return 12
+}
+
+// Localise derives the user's authentication and privacy keys for the engine ID. Call it after Validate.
+func (user *USMUser) Localise(engineID []byte) {
+	user.authKey = LocaliseKey(user.newHash(), user.AuthPassword, engineID)
+	if user.HasPrivacy() {
+		user.privKey = LocaliseKey(user.newHash(), user.PrivPassword, engineID)[:aes.BlockSize]
+	}
+}
+
+// LocaliseKey derives a key from the password and localises it to the engine ID, as specified by RFC 3414 A.2.
+func LocaliseKey(newHash func() hash.Hash, password string, engineID []byte) []byte {
+	digest := newHash()
+	// Digest the password repeated over one megabyte
+	pwBytes := []byte(password)
+	buf := make([]byte, 64)
+	for count := 0; count < passwordToKeyLength; count += len(buf) {
+		for i := range buf {
+			buf[i] = pwBytes[(count+i)%len(pwBytes)]
+		}
+		digest.Write(buf)
+	}
+	key := digest.Sum(nil)
+	// Localised key is the digest of key + engine ID + key
+	digest.Reset()
+	digest.Write(key)
+	digest.Write(engineID)
+	digest.Write(key)
+	return digest.Sum(nil)
+}
+
+// sign calculates the truncated HMAC of a whole message, which must carry zeros in place of authentication parameters.
+func (user *USMUser) sign(msg []byte) []byte {
+	mac := hmac.New(user.newHash(), user.authKey)
+	mac.Write(msg)
+	return mac.Sum(nil)[:user.AuthParamsLength()]
+}
+
+// verify returns true only if the authentication parameters located at the offset of the message are correct.
+func (user *USMUser) verify(msg []byte, authOffset int) bool {
+	authLen := user.AuthParamsLength()
+	if authOffset < 0 || authOffset+authLen > len(msg) {
+		return false
+	}
+	zeroed := make([]byte, len(msg))
+	copy(zeroed, msg)
+	for i := authOffset; i < authOffset+authLen; i++ {
+		zeroed[i] = 0
+	}
+	return subtle.ConstantTimeCompare(user.sign(zeroed), msg[authOffset:authOffset+authLen]) == 1
+}
+
+// cfbStream returns the AES CFB stream keyed by the user's privacy key, as specified by RFC 3826 section 3.1.2.1.
+func (user *USMUser) cfbStream(engineBoots, engineTime int64, salt []byte, encrypt bool) (cipher.Stream, error) {
+	if len(salt) != 8 {
+		return nil, fmt.Errorf("unexpected privacy parameters size (%d)", len(salt))
+	}
+	block, err := aes.NewCipher(user.privKey)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint32(iv[0:4], uint32(engineBoots))
+	binary.BigEndian.PutUint32(iv[4:8], uint32(engineTime))
+	copy(iv[8:], salt)
+	if encrypt {
+		return cipher.NewCFBEncrypter(block, iv), nil
+	}
+	return cipher.NewCFBDecrypter(block, iv), nil
+}
@@ -0,0 +1,109 @@
+package snmp
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestLocaliseKey(t *testing.T) {
+	// Test vectors are from RFC 3414 A.3
+	engineID := []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 2}
+	if key := hex.EncodeToString(LocaliseKey(md5.New, "maplesyrup", engineID)); key != "526f5eed9fcce26f8964c2930787d82b" {
+		t.Fatal(key)
+	}
+	if key := hex.EncodeToString(LocaliseKey(sha1.New, "maplesyrup", engineID)); key != "6695febc9288e36282235fc7151f128497b38f3f" {
+		t.Fatal(key)
+	}
+}
+
+func TestUSMUser_Validate(t *testing.T) {
+	for _, user := range []USMUser{
+		{},
+		{Name: "a", AuthProtocol: "sha", AuthPassword: "short"},
+		{Name: "a", AuthProtocol: "wrong", AuthPassword: "12345678"},
+		{Name: "a", AuthProtocol: "sha", AuthPassword: "12345678", PrivProtocol: "des", PrivPassword: "12345678"},
+		{Name: "a", AuthProtocol: "sha", AuthPassword: "12345678", PrivProtocol: "aes", PrivPassword: "short"},
+	} {
+		if err := user.Validate(); err == nil {
+			t.Fatalf("should have failed: %+v", user)
+		}
+	}
+	user := USMUser{Name: "a", AuthProtocol: "sha256", AuthPassword: "12345678", PrivProtocol: "aes", PrivPassword: "87654321"}
+	if err := user.Validate(); err != nil || user.AuthProtocol != AuthSHA256 || user.PrivProtocol != PrivAES || !user.HasPrivacy() {
+		t.Fatal(err, user)
+	}
+}
+
+func TestV3Message(t *testing.T) {
+	engineID := []byte{0x80, 0x00, 0xcd, 0x37, 0x05, 1, 2, 3, 4, 5, 6, 7, 8}
+	oid := asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 52535, 121, 100}
+	for _, authProtocol := range []string{AuthMD5, AuthSHA, AuthSHA256} {
+		for _, privProtocol := range []string{"", PrivAES} {
+			user := USMUser{Name: "laitos", AuthProtocol: authProtocol, AuthPassword: "authpassword", PrivProtocol: privProtocol, PrivPassword: "privpassword"}
+			if err := user.Validate(); err != nil {
+				t.Fatal(err)
+			}
+			user.Localise(engineID)
+			flags := byte(FlagAuth | FlagReportable)
+			if user.HasPrivacy() {
+				flags |= FlagPriv
+			}
+			msg := V3Message{
+				MsgID:       123,
+				Flags:       flags,
+				EngineID:    engineID,
+				EngineBoots: 1,
+				EngineTime:  456,
+				UserName:    user.Name,
+				ScopedPDU: ScopedPDU{
+					ContextEngineID: engineID,
+					ContextName:     []byte{},
+					PDU:             PDUGetResponse,
+					RequestID:       789,
+					// Make the message long enough to use multi-byte lengths
+					VarBinds: []VarBind{
+						{OID: oid, Value: bytes.Repeat([]byte{'a'}, 300)},
+						{OID: oid, Value: int64(-1)},
+						{OID: oid, Value: Counter32(4000000000)},
+						{OID: oid, Value: NoSuchInstance{}},
+						{OID: oid, Value: EndOfMIBView{}},
+					},
+				},
+			}
+			packet, err := msg.Encode(&user)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !IsV3(packet) {
+				t.Fatal("not v3")
+			}
+			decoded, err := DecodeV3(packet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := decoded.Authenticate(&user); err != nil {
+				t.Fatal(authProtocol, privProtocol, err)
+			}
+			if err := decoded.Decrypt(&user); err != nil {
+				t.Fatal(err)
+			}
+			if decoded.MsgID != 123 || decoded.Flags != flags || decoded.EngineBoots != 1 || decoded.EngineTime != 456 ||
+				decoded.UserName != user.Name || !bytes.Equal(decoded.EngineID, engineID) {
+				t.Fatalf("%+v", decoded)
+			}
+			if !reflect.DeepEqual(decoded.ScopedPDU, msg.ScopedPDU) {
+				t.Fatalf("\n%+v\n%+v", decoded.ScopedPDU, msg.ScopedPDU)
+			}
+			// Tampered message must fail authentication
+			packet[len(packet)-1]++
+			if decoded, err := DecodeV3(packet); err == nil && decoded.Authenticate(&user) == nil {
+				t.Fatal("should have failed authentication")
+			}
+		}
+	}
+}
@@ -0,0 +1,394 @@
+package snmp
+
+import (
+	"crypto/rand"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+const (
+	// ProtocolV3 is the protocol version magic corresponding to SNMP version 3.
+	ProtocolV3 = 0x03
+	// SecurityModelUSM is the security model magic corresponding to the user-based security model.
+	SecurityModelUSM = 3
+	// PDUReport tells an SNMPv3 client about an error that occurred while processing its request.
+	PDUReport = 0xa8
+
+	FlagAuth       = 0x01 // FlagAuth indicates that the message is authenticated.
+	FlagPriv       = 0x02 // FlagPriv indicates that the scoped PDU of the message is encrypted.
+	FlagReportable = 0x04 // FlagReportable indicates that the sender of the message expects a report in case of error.
+)
+
+// The USM statistics OIDs are carried by report PDUs to tell an SNMPv3 client about the error with its request.
+var (
+	OIDUSMStatsUnsupportedSecLevels = asn1.ObjectIdentifier{1, 3, 6, 1, 6, 3, 15, 1, 1, 1, 0}
+	OIDUSMStatsNotInTimeWindows     = asn1.ObjectIdentifier{1, 3, 6, 1, 6, 3, 15, 1, 1, 2, 0}
+	OIDUSMStatsUnknownUserNames     = asn1.ObjectIdentifier{1, 3, 6, 1, 6, 3, 15, 1, 1, 3, 0}
+	OIDUSMStatsUnknownEngineIDs     = asn1.ObjectIdentifier{1, 3, 6, 1, 6, 3, 15, 1, 1, 4, 0}
+	OIDUSMStatsWrongDigests         = asn1.ObjectIdentifier{1, 3, 6, 1, 6, 3, 15, 1, 1, 5, 0}
+	OIDUSMStatsDecryptionErrors     = asn1.ObjectIdentifier{1, 3, 6, 1, 6, 3, 15, 1, 1, 6, 0}
+)
+
+// NoSuchInstance is the value of a variable binding that answers a Get request toward a non-existing OID.
+type NoSuchInstance struct{}
+
+// EndOfMIBView is the value of a variable binding that answers a GetNext request toward the last OID in hierarchy.
+type EndOfMIBView struct{}
+
+// VarBind is a pair of OID and its value carried by a PDU.
+type VarBind struct {
+	OID   asn1.ObjectIdentifier
+	Value interface{} // Value is nil in a request, or one of int64, []byte, Counter32, NoSuchInstance, EndOfMIBView.
+}
+
+// ScopedPDU is the PDU of an SNMPv3 message, along with the context it operates in.
+type ScopedPDU struct {
+	ContextEngineID []byte
+	ContextName     []byte
+	PDU             byte  // PDU determines the type of SNMP request or response.
+	RequestID       int64 // RequestID is an integer shared by pairs of request and response.
+	ErrorStatus     int64
+	ErrorIndex      int64
+	VarBinds        []VarBind
+}
+
+// V3Message is an SNMPv3 message secured by the user-based security model, no matter it is a request or a response.
+type V3Message struct {
+	MsgID       int64 // MsgID is an integer shared by pairs of request and response messages.
+	MaxSize     int64 // MaxSize is the maximum message size the sender can accept.
+	Flags       byte  // Flags is a combination of FlagAuth, FlagPriv, and FlagReportable.
+	EngineID    []byte
+	EngineBoots int64
+	EngineTime  int64
+	UserName    string
+	AuthParams  []byte // AuthParams is the truncated HMAC of the message.
+	PrivParams  []byte // PrivParams is the salt of the encrypted scoped PDU.
+
+	// ScopedPDU is the decoded scoped PDU, it is available only after decryption if the message is encrypted.
+	ScopedPDU ScopedPDU
+
+	raw          []byte // raw is the message as read from input.
+	authOffset   int    // authOffset is the position of authentication parameters in the raw message.
+	encryptedPDU []byte // encryptedPDU is the scoped PDU waiting to be decrypted.
+}
+
+// IsV3 returns true only if the packet appears to be an SNMPv3 message.
+func IsV3(packet []byte) bool {
+	content, _, err := ReadExpectedTLV(packet, TagASN1)
+	if err != nil {
+		return false
+	}
+	version, _, err := ReadInteger(content)
+	return err == nil && version == ProtocolV3
+}
+
+// DecodeV3 deserialises an SNMPv3 message. If the scoped PDU is encrypted, call Decrypt to decode it.
+func DecodeV3(packet []byte) (msg *V3Message, err error) {
+	msg = &V3Message{}
+	top, _, err := ReadTLV(packet)
+	if err != nil {
+		return nil, err
+	}
+	if top.Tag != TagASN1 {
+		return nil, fmt.Errorf("unexpected top level tag (%d)", top.Tag)
+	}
+	msg.raw = packet[:top.HeaderLen+len(top.Value)]
+	// Version
+	version, rest, err := ReadInteger(top.Value)
+	if err != nil {
+		return nil, err
+	}
+	if version != ProtocolV3 {
+		return nil, fmt.Errorf("unexpected version number (%d)", version)
+	}
+	// Global data - message ID, max size, flags, security model
+	globalData, rest, err := ReadExpectedTLV(rest, TagASN1)
+	if err != nil {
+		return nil, err
+	}
+	if msg.MsgID, globalData, err = ReadInteger(globalData); err != nil {
+		return nil, err
+	}
+	if msg.MaxSize, globalData, err = ReadInteger(globalData); err != nil {
+		return nil, err
+	}
+	flags, globalData, err := ReadExpectedTLV(globalData, TagOctetString)
+	if err != nil {
+		return nil, err
+	}
+	if len(flags) != 1 {
+		return nil, fmt.Errorf("unexpected message flags size (%d)", len(flags))
+	}
+	msg.Flags = flags[0]
+	if msg.Flags&FlagPriv != 0 && msg.Flags&FlagAuth == 0 {
+		return nil, errors.New("message flags ask for privacy without authentication")
+	}
+	securityModel, _, err := ReadInteger(globalData)
+	if err != nil {
+		return nil, err
+	}
+	if securityModel != SecurityModelUSM {
+		return nil, fmt.Errorf("unexpected security model (%d)", securityModel)
+	}
+	// Security parameters are an octet string that wraps a sequence
+	secParamsOffset := len(msg.raw) - len(rest)
+	secParamsTLV, rest, err := ReadTLV(rest)
+	if err != nil {
+		return nil, err
+	}
+	if secParamsTLV.Tag != TagOctetString {
+		return nil, MissedExpectation("tag", TagOctetString, secParamsTLV.Tag)
+	}
+	secParamsOffset += secParamsTLV.HeaderLen
+	secParamsSeq, _, err := ReadTLV(secParamsTLV.Value)
+	if err != nil {
+		return nil, err
+	}
+	if secParamsSeq.Tag != TagASN1 {
+		return nil, MissedExpectation("tag", TagASN1, secParamsSeq.Tag)
+	}
+	secParams := secParamsSeq.Value
+	if msg.EngineID, secParams, err = ReadExpectedTLV(secParams, TagOctetString); err != nil {
+		return nil, err
+	}
+	if msg.EngineBoots, secParams, err = ReadInteger(secParams); err != nil {
+		return nil, err
+	}
+	if msg.EngineTime, secParams, err = ReadInteger(secParams); err != nil {
+		return nil, err
+	}
+	userName, secParams, err := ReadExpectedTLV(secParams, TagOctetString)
+	if err != nil {
+		return nil, err
+	}
+	msg.UserName = string(userName)
+	authOffset := secParamsOffset + len(secParamsTLV.Value) - len(secParams)
+	authTLV, secParams, err := ReadTLV(secParams)
+	if err != nil {
+		return nil, err
+	}
+	if authTLV.Tag != TagOctetString {
+		return nil, MissedExpectation("tag", TagOctetString, authTLV.Tag)
+	}
+	msg.AuthParams = authTLV.Value
+	msg.authOffset = authOffset + authTLV.HeaderLen
+	if msg.PrivParams, _, err = ReadExpectedTLV(secParams, TagOctetString); err != nil {
+		return nil, err
+	}
+	// The scoped PDU is either in plain or encrypted
+	if msg.Flags&FlagPriv != 0 {
+		msg.encryptedPDU, _, err = ReadExpectedTLV(rest, TagOctetString)
+		return msg, err
+	}
+	msg.ScopedPDU, err = decodeScopedPDU(rest)
+	return msg, err
+}
+
+// Authenticate returns an error if the message is not authenticated by the user's key.
+func (msg *V3Message) Authenticate(user *USMUser) error {
+	if len(msg.AuthParams) != user.AuthParamsLength() || !user.verify(msg.raw, msg.authOffset) {
+		return errors.New("message digest mismatch")
+	}
+	return nil
+}
+
+// Decrypt decrypts and decodes the scoped PDU using the user's key. Call it only after having authenticated the message.
+func (msg *V3Message) Decrypt(user *USMUser) error {
+	if msg.Flags&FlagPriv == 0 {
+		return nil
+	}
+	if !user.HasPrivacy() {
+		return fmt.Errorf("user %s does not use privacy", user.Name)
+	}
+	stream, err := user.cfbStream(msg.EngineBoots, msg.EngineTime, msg.PrivParams, false)
+	if err != nil {
+		return err
+	}
+	plain := make([]byte, len(msg.encryptedPDU))
+	stream.XORKeyStream(plain, msg.encryptedPDU)
+	msg.ScopedPDU, err = decodeScopedPDU(plain)
+	return err
+}
+
+// decodeScopedPDU deserialises a scoped PDU from input.
+func decodeScopedPDU(in []byte) (scoped ScopedPDU, err error) {
+	content, _, err := ReadExpectedTLV(in, TagASN1)
+	if err != nil {
+		return
+	}
+	if scoped.ContextEngineID, content, err = ReadExpectedTLV(content, TagOctetString); err != nil {
+		return
+	}
+	if scoped.ContextName, content, err = ReadExpectedTLV(content, TagOctetString); err != nil {
+		return
+	}
+	pduTLV, _, err := ReadTLV(content)
+	if err != nil {
+		return
+	}
+	scoped.PDU = pduTLV.Tag
+	pdu := pduTLV.Value
+	if scoped.RequestID, pdu, err = ReadInteger(pdu); err != nil {
+		return
+	}
+	if scoped.ErrorStatus, pdu, err = ReadInteger(pdu); err != nil {
+		return
+	}
+	if scoped.ErrorIndex, pdu, err = ReadInteger(pdu); err != nil {
+		return
+	}
+	varBinds, _, err := ReadExpectedTLV(pdu, TagASN1)
+	if err != nil {
+		return
+	}
+	for len(varBinds) > 0 {
+		var varBind []byte
+		if varBind, varBinds, err = ReadExpectedTLV(varBinds, TagASN1); err != nil {
+			return
+		}
+		oidTLV, valueBytes, err := ReadTLV(varBind)
+		if err != nil {
+			return scoped, err
+		}
+		if oidTLV.Tag != TagOID {
+			return scoped, MissedExpectation("tag", TagOID, oidTLV.Tag)
+		}
+		var oid asn1.ObjectIdentifier
+		if _, err := asn1.Unmarshal(varBind[:oidTLV.HeaderLen+len(oidTLV.Value)], &oid); err != nil {
+			return scoped, err
+		}
+		scoped.VarBinds = append(scoped.VarBinds, VarBind{OID: oid, Value: decodeVarBindValue(valueBytes)})
+	}
+	return
+}
+
+// decodeVarBindValue returns the value of a variable binding, or nil if the value is not understood.
+func decodeVarBindValue(in []byte) interface{} {
+	tlv, _, err := ReadTLV(in)
+	if err != nil {
+		return nil
+	}
+	switch tlv.Tag {
+	case TagInteger:
+		i, _, _ := ReadInteger(in)
+		return i
+	case TagOctetString:
+		return tlv.Value
+	case TagCounter32:
+		var c uint32
+		for _, b := range tlv.Value {
+			c = c<<8 | uint32(b)
+		}
+		return Counter32(c)
+	case TagNoSuchInstance:
+		return NoSuchInstance{}
+	case TagEndOfMIBView:
+		return EndOfMIBView{}
+	}
+	return nil
+}
+
+// encode serialises the scoped PDU.
+func (scoped ScopedPDU) encode() ([]byte, error) {
+	var varBinds []byte
+	for _, varBind := range scoped.VarBinds {
+		oidBytes, err := asn1.Marshal(varBind.OID)
+		if err != nil {
+			return nil, err
+		}
+		var valueBytes []byte
+		switch varBind.Value.(type) {
+		case NoSuchInstance:
+			valueBytes = []byte{TagNoSuchInstance, 0x00}
+		case EndOfMIBView:
+			valueBytes = []byte{TagEndOfMIBView, 0x00}
+		default:
+			if valueBytes, err = EncodeValue(varBind.Value); err != nil {
+				return nil, err
+			}
+		}
+		varBinds = append(varBinds, EncodeTLV(TagASN1, append(oidBytes, valueBytes...))...)
+	}
+	pdu := EncodeInteger(scoped.RequestID)
+	pdu = append(pdu, EncodeInteger(scoped.ErrorStatus)...)
+	pdu = append(pdu, EncodeInteger(scoped.ErrorIndex)...)
+	pdu = append(pdu, EncodeTLV(TagASN1, varBinds)...)
+
+	content := EncodeTLV(TagOctetString, scoped.ContextEngineID)
+	content = append(content, EncodeTLV(TagOctetString, scoped.ContextName)...)
+	content = append(content, EncodeTLV(scoped.PDU, pdu)...)
+	return EncodeTLV(TagASN1, content), nil
+}
+
+/*
+Encode serialises the message. If the message flags ask for authentication or privacy, the message is authenticated
+and encrypted using the user's keys, which are ignored otherwise.
+*/
+func (msg *V3Message) Encode(user *USMUser) ([]byte, error) {
+	if msg.Flags&(FlagAuth|FlagPriv) != 0 && user == nil {
+		return nil, errors.New("authentication and privacy require a user")
+	}
+	scopedPDU, err := msg.ScopedPDU.encode()
+	if err != nil {
+		return nil, err
+	}
+	var msgData []byte
+	msg.PrivParams = []byte{}
+	if msg.Flags&FlagPriv != 0 {
+		msg.PrivParams = make([]byte, 8)
+		if _, err := rand.Read(msg.PrivParams); err != nil {
+			return nil, err
+		}
+		stream, err := user.cfbStream(msg.EngineBoots, msg.EngineTime, msg.PrivParams, true)
+		if err != nil {
+			return nil, err
+		}
+		encrypted := make([]byte, len(scopedPDU))
+		stream.XORKeyStream(encrypted, scopedPDU)
+		msgData = EncodeTLV(TagOctetString, encrypted)
+	} else {
+		msgData = scopedPDU
+	}
+	// Authentication parameters are zeros until the whole message is signed
+	msg.AuthParams = []byte{}
+	if msg.Flags&FlagAuth != 0 {
+		msg.AuthParams = make([]byte, user.AuthParamsLength())
+	}
+
+	maxSize := msg.MaxSize
+	if maxSize == 0 {
+		maxSize = 65507
+	}
+	globalData := EncodeInteger(msg.MsgID)
+	globalData = append(globalData, EncodeInteger(maxSize)...)
+	globalData = append(globalData, EncodeTLV(TagOctetString, []byte{msg.Flags})...)
+	globalData = append(globalData, EncodeInteger(SecurityModelUSM)...)
+
+	secParams := EncodeTLV(TagOctetString, msg.EngineID)
+	secParams = append(secParams, EncodeInteger(msg.EngineBoots)...)
+	secParams = append(secParams, EncodeInteger(msg.EngineTime)...)
+	secParams = append(secParams, EncodeTLV(TagOctetString, []byte(msg.UserName))...)
+	authOffsetInSecParams := len(secParams)
+	secParams = append(secParams, EncodeTLV(TagOctetString, msg.AuthParams)...)
+	secParams = append(secParams, EncodeTLV(TagOctetString, msg.PrivParams)...)
+	secParamsSeq := EncodeTLV(TagASN1, secParams)
+	authOffsetInSecParams += len(secParamsSeq) - len(secParams)
+	secParamsOctets := EncodeTLV(TagOctetString, secParamsSeq)
+	authOffsetInSecParams += len(secParamsOctets) - len(secParamsSeq)
+
+	content := EncodeInteger(ProtocolV3)
+	content = append(content, EncodeTLV(TagASN1, globalData)...)
+	authOffset := len(content) + authOffsetInSecParams
+	content = append(content, secParamsOctets...)
+	content = append(content, msgData...)
+	ret := EncodeTLV(TagASN1, content)
+	authOffset += len(ret) - len(content)
+
+	if msg.Flags&FlagAuth != 0 {
+		// The authentication parameters octet string is 2 bytes long (tag and size) before the zeros
+		copy(ret[authOffset+2:], user.sign(ret))
+		copy(msg.AuthParams, ret[authOffset+2:])
+	}
+	return ret, nil
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/subtle"
+	"encoding/asn1"
 	"fmt"
 	"net"
 	"strconv"
@@ -17,6 +18,9 @@ import (
 	"github.com/HouzuoGuo/laitos/testingstub"
 )
 
+// requestStats times the SNMP requests.
+var requestStats = misc.GetStats("snmpd.Requests")
+
 const (
 	IOTimeoutSec         = 60   // IOTimeoutSec is the number of seconds to tolerate for network IO operations.
 	RateLimitIntervalSec = 1    // RateLimitIntervalSec is the interval for rate limit calculation.
@@ -29,12 +33,17 @@ type Daemon struct {
 	PerIPLimit int    `json:"PerIPLimit"` // PerIPLimit is approximately how many requests are allowed from an IP within a designated interval.
 
 	/*
-		CommunityName is a password-like string that grants access to all SNMP nodes. Be aware that it is transmitted in
-		plain text due to protocol limitation.
+		CommunityName is a password-like string that grants access to all SNMP nodes via SNMPv2c. Be aware that it is
+		transmitted in plain text due to protocol limitation. Leave it empty to serve SNMPv3 users only.
 	*/
 	CommunityName string `json:"CommunityName"`
+	// Users are the SNMPv3 users who access all SNMP nodes with authentication and optionally privacy.
+	Users []snmp.USMUser `json:"Users"`
 
-	udpServer *common.UDPServer
+	engineID        []byte    // engineID is the SNMPv3 authoritative engine ID of this daemon.
+	engineStartTime time.Time // engineStartTime is the moment SNMPv3 engine time counts from.
+	usmStats        *usmStats // usmStats counts SNMPv3 errors reported to clients.
+	udpServer       *common.UDPServer
 }
 
 // Initialise validates configuration and initialises internal states.
@@ -52,9 +61,15 @@ func (daemon *Daemon) Initialise() error {
 		*/
 		daemon.PerIPLimit = 3 * len(snmp.OIDSuffixList)
 	}
-	if len(daemon.CommunityName) < 6 {
+	if daemon.CommunityName == "" && len(daemon.Users) == 0 {
+		return fmt.Errorf("snmpd.Initialise: either CommunityName or Users must be specified")
+	}
+	if daemon.CommunityName != "" && len(daemon.CommunityName) < 6 {
 		return fmt.Errorf("snmpd.Initialise: CommunityName must be at least 6 characters long")
 	}
+	if err := daemon.initialiseUSM(); err != nil {
+		return fmt.Errorf("snmpd.Initialise: %v", err)
+	}
 	daemon.udpServer = &common.UDPServer{
 		ListenAddr:  daemon.Address,
 		ListenPort:  daemon.Port,
@@ -73,11 +88,19 @@ func (daemon *Daemon) StartAndBlock() error {
 
 // GetUDPStatsCollector returns the stats collector that counts and times UDP conversations.
 func (daemon *Daemon) GetUDPStatsCollector() *misc.Stats {
-	return misc.SNMPStats
+	return requestStats
 }
 
 // HandleUDPClient converses
 func (daemon *Daemon) HandleUDPClient(logger lalog.Logger, clientIP string, client *net.UDPAddr, reqPacket []byte, srv *net.UDPConn) {
+	if snmp.IsV3(reqPacket) {
+		daemon.handleV3(logger, clientIP, client, reqPacket, srv)
+		return
+	}
+	if daemon.CommunityName == "" {
+		logger.Info("HandleUDPClient", clientIP, nil, "SNMPv2c is disabled as CommunityName is not configured")
+		return
+	}
 	reader := bufio.NewReader(bytes.NewReader(reqPacket))
 	// Parse the input packet
 	packet := snmp.Packet{}
@@ -149,11 +172,16 @@ func (daemon *Daemon) HandleUDPClient(logger lalog.Logger, clientIP string, clie
 		logger.Warning("HandleUDPClient", clientIP, err, "failed to encode response")
 		return
 	}
+	writeResponse(logger, clientIP, client, resp, srv)
+}
+
+// writeResponse sends the response packet to the client.
+func writeResponse(logger lalog.Logger, clientIP string, client *net.UDPAddr, resp []byte, srv *net.UDPConn) {
 	if err := srv.SetWriteDeadline(time.Now().Add(IOTimeoutSec * time.Second)); err != nil {
 		logger.Warning("HandleUDPClient", clientIP, err, "failed to answer to client")
 		return
 	}
-	if _, err = srv.WriteTo(resp, client); err != nil {
+	if _, err := srv.WriteTo(resp, client); err != nil {
 		logger.Warning("HandleUDPClient", clientIP, err, "failed to answer to client")
 		return
 	}
@@ -263,7 +291,7 @@ func TestSNMPD(daemon *Daemon, t testingstub.T) {
 		t.Fatalf("%s\n%#v", string(packetBuf), packetBuf)
 	}
 
-	// Send a GetNextRequest on the very last of supported OID, 1.3.6.1.4.1.52535.121.115
+	// Send a GetNextRequest on the very last of supported OID, 1.3.6.1.4.1.52535.121.152
 	lastValidOIDTest := func() []byte {
 		// Re-dial because this function is used going to be used for rate limit test
 		clientConn, err := net.DialUDP("udp", nil, serverAddr)
@@ -273,13 +301,13 @@ func TestSNMPD(daemon *Daemon, t testingstub.T) {
 		defer clientConn.Close()
 		getNextRequest = []byte{
 			//ASN1  SZ   INT    SZ
-			0x30, 0x2a, 0x02, 0x01,
+			0x30, 0x2b, 0x02, 0x01,
 			//v2  OSTR    SZ     p     u    b      l     i     c APDU1    SZ   INT    SZ  REQID460219274...
-			0x01, 0x04, 0x06, 0x70, 0x75, 0x62, 0x6c, 0x69, 0x63, 0xa1, 0x1d, 0x02, 0x04, 0x1b, 0x6e, 0x63,
+			0x01, 0x04, 0x06, 0x70, 0x75, 0x62, 0x6c, 0x69, 0x63, 0xa1, 0x1e, 0x02, 0x04, 0x1b, 0x6e, 0x63,
 			//..   INT   SZ   NoErr  INT   SZ  EIDX0  ASN1    SZ  ASN1    SZ   OID    SZ   1.3    .6    .1
-			0x8a, 0x02, 0x01, 0x00, 0x02, 0x01, 0x00, 0x30, 0x0f, 0x30, 0x0d, 0x06, 0x0a, 0x2b, 0x06, 0x01,
-			//.4  .1  .52535..........  .121  .115   NUL    SZ
-			0x4, 0x1, 0x83, 0x9a, 0x37, 0x79, 0x73, 0x05, 0x00,
+			0x8a, 0x02, 0x01, 0x00, 0x02, 0x01, 0x00, 0x30, 0x10, 0x30, 0x0e, 0x06, 0x0b, 0x2b, 0x06, 0x01,
+			//.4  .1  .52535..........  .121  .152.......   NUL    SZ
+			0x4, 0x1, 0x83, 0x9a, 0x37, 0x79, 0x81, 0x18, 0x05, 0x00,
 		}
 		if _, err := clientConn.Write(getNextRequest); err != nil {
 			t.Fatal(err)
@@ -299,6 +327,10 @@ func TestSNMPD(daemon *Daemon, t testingstub.T) {
 		t.Fatalf("%s\n%#v", string(packetBuf), packetBuf)
 	}
 
+	if len(daemon.Users) > 0 {
+		testV3(daemon, t, clientConn)
+	}
+
 	// Daemon must stop in a second
 	daemon.Stop()
 	time.Sleep(1 * time.Second)
@@ -309,3 +341,122 @@ func TestSNMPD(daemon *Daemon, t testingstub.T) {
 	daemon.Stop()
 	daemon.Stop()
 }
+
+// testV3 conducts SNMPv3 engine discovery and queries using the first of the daemon's SNMPv3 users.
+func testV3(daemon *Daemon, t testingstub.T, clientConn *net.UDPConn) {
+	exchange := func(req *snmp.V3Message, user *snmp.USMUser) *snmp.V3Message {
+		reqPacket, err := req.Encode(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := clientConn.Write(reqPacket); err != nil {
+			t.Fatal(err)
+		}
+		respBuf := make([]byte, MaxPacketSize)
+		_ = clientConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		n, err := clientConn.Read(respBuf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := snmp.DecodeV3(respBuf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.MsgID != req.MsgID {
+			t.Fatalf("%+v", resp)
+		}
+		return resp
+	}
+	// Discover engine ID
+	discovery := exchange(&snmp.V3Message{
+		MsgID: 1,
+		Flags: snmp.FlagReportable,
+		ScopedPDU: snmp.ScopedPDU{
+			PDU:       snmp.PDUGetRequest,
+			RequestID: 11,
+		},
+	}, nil)
+	if discovery.ScopedPDU.PDU != snmp.PDUReport || !bytes.Equal(discovery.EngineID, daemon.engineID) ||
+		discovery.EngineBoots != EngineBoots || len(discovery.ScopedPDU.VarBinds) != 1 ||
+		!discovery.ScopedPDU.VarBinds[0].OID.Equal(snmp.OIDUSMStatsUnknownEngineIDs) {
+		t.Fatalf("%+v", discovery)
+	}
+
+	// The client localises the user's keys to the engine ID
+	user := daemon.Users[0]
+	user.Localise(discovery.EngineID)
+	flags := byte(snmp.FlagAuth | snmp.FlagReportable)
+	if user.HasPrivacy() {
+		flags |= snmp.FlagPriv
+	}
+	newRequest := func(msgID int64, pdu byte, oid asn1.ObjectIdentifier) *snmp.V3Message {
+		return &snmp.V3Message{
+			MsgID:       msgID,
+			Flags:       flags,
+			EngineID:    discovery.EngineID,
+			EngineBoots: discovery.EngineBoots,
+			EngineTime:  discovery.EngineTime,
+			UserName:    user.Name,
+			ScopedPDU: snmp.ScopedPDU{
+				ContextEngineID: discovery.EngineID,
+				PDU:             pdu,
+				RequestID:       msgID * 10,
+				VarBinds:        []snmp.VarBind{{OID: oid}},
+			},
+		}
+	}
+	// GetNext from the public IP OID should answer the system clock
+	resp := exchange(newRequest(2, snmp.PDUGetNextRequest, snmp.FirstOID), &user)
+	if err := resp.Authenticate(&user); err != nil {
+		t.Fatal(err)
+	}
+	if err := resp.Decrypt(&user); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ScopedPDU.PDU != snmp.PDUGetResponse || resp.ScopedPDU.RequestID != 20 || len(resp.ScopedPDU.VarBinds) != 1 ||
+		!resp.ScopedPDU.VarBinds[0].OID.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 52535, 121, 101}) {
+		t.Fatalf("%+v", resp)
+	}
+	if clock, ok := resp.ScopedPDU.VarBinds[0].Value.(int64); !ok || clock < time.Now().Unix()-10 {
+		t.Fatalf("%+v", resp)
+	}
+	// Get a non-existing OID
+	resp = exchange(newRequest(3, snmp.PDUGetRequest, asn1.ObjectIdentifier{1, 3, 6, 1, 2, 1, 1, 1, 1, 0}), &user)
+	if err := resp.Authenticate(&user); err != nil {
+		t.Fatal(err)
+	}
+	if err := resp.Decrypt(&user); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.ScopedPDU.VarBinds) != 1 || resp.ScopedPDU.VarBinds[0].Value != (snmp.NoSuchInstance{}) {
+		t.Fatalf("%+v", resp)
+	}
+
+	// A request outside of the time window should receive an authenticated report
+	outdated := newRequest(4, snmp.PDUGetRequest, snmp.FirstOID)
+	outdated.EngineTime += 2 * TimeWindowSec
+	resp = exchange(outdated, &user)
+	if err := resp.Authenticate(&user); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ScopedPDU.PDU != snmp.PDUReport || !resp.ScopedPDU.VarBinds[0].OID.Equal(snmp.OIDUSMStatsNotInTimeWindows) {
+		t.Fatalf("%+v", resp)
+	}
+
+	// A request authenticated by an incorrect password should receive a report
+	wrongUser := user
+	wrongUser.AuthPassword += "wrong"
+	wrongUser.Localise(discovery.EngineID)
+	resp = exchange(newRequest(5, snmp.PDUGetRequest, snmp.FirstOID), &wrongUser)
+	if resp.ScopedPDU.PDU != snmp.PDUReport || !resp.ScopedPDU.VarBinds[0].OID.Equal(snmp.OIDUSMStatsWrongDigests) {
+		t.Fatalf("%+v", resp)
+	}
+
+	// A request from an unknown user should receive a report
+	unknown := newRequest(6, snmp.PDUGetRequest, snmp.FirstOID)
+	unknown.UserName = "does-not-exist"
+	resp = exchange(unknown, &user)
+	if resp.ScopedPDU.PDU != snmp.PDUReport || !resp.ScopedPDU.VarBinds[0].OID.Equal(snmp.OIDUSMStatsUnknownUserNames) {
+		t.Fatalf("%+v", resp)
+	}
+}
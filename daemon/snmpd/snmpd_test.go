@@ -13,6 +13,20 @@ func TestDaemon(t *testing.T) {
 	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "CommunityName") {
 		t.Fatalf("%+v %+v\n", err, daemon)
 	}
+	daemon.CommunityName = "short"
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "CommunityName") {
+		t.Fatalf("%+v %+v\n", err, daemon)
+	}
+	daemon.CommunityName = ""
+	daemon.Users = []snmp.USMUser{{Name: "laitos", AuthProtocol: "SHA", AuthPassword: "short"}}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "password") {
+		t.Fatalf("%+v %+v\n", err, daemon)
+	}
+	// Serve SNMPv3 user alone
+	daemon.Users = []snmp.USMUser{{Name: "laitos", AuthProtocol: "SHA", AuthPassword: "authpassword", PrivProtocol: "AES", PrivPassword: "privpassword"}}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatalf("%+v %+v\n", err, daemon)
+	}
 	// Initialise with default values
 	daemon.CommunityName = "public"
 	if err := daemon.Initialise(); err != nil || daemon.Address != "0.0.0.0" || daemon.Port != 161 || daemon.PerIPLimit != 3*len(snmp.OIDSuffixList) {
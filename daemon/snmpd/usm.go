@@ -0,0 +1,201 @@
+package snmpd
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/snmpd/snmp"
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+const (
+	// EngineBoots is the number of times the SNMPv3 engine has (re)started. The engine ID is new upon every start.
+	EngineBoots = 1
+	// TimeWindowSec is the maximum difference between engine time of a request and the actual engine time, as specified by RFC 3414.
+	TimeWindowSec = 150
+)
+
+// usmStats counts the SNMPv3 errors reported to clients, each counter is identified by its USM statistics OID.
+type usmStats struct {
+	counters map[string]snmp.Counter32
+	mutex    sync.Mutex
+}
+
+// increase increments the counter of the OID and returns the latest count.
+func (stats *usmStats) increase(oid string) snmp.Counter32 {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.counters[oid]++
+	return stats.counters[oid]
+}
+
+/*
+initialiseUSM validates SNMPv3 users and localises their keys to a newly generated engine ID. The engine ID comprises
+the private enterprise number of laitos and random octets, as specified by RFC 3411.
+*/
+func (daemon *Daemon) initialiseUSM() error {
+	daemon.engineID = []byte{0x80, 0x00, 0xcd, 0x37, 0x05, 0, 0, 0, 0, 0, 0, 0, 0}
+	if _, err := rand.Read(daemon.engineID[5:]); err != nil {
+		return err
+	}
+	daemon.engineStartTime = time.Now()
+	daemon.usmStats = &usmStats{counters: make(map[string]snmp.Counter32)}
+	names := make(map[string]bool)
+	for i := range daemon.Users {
+		user := &daemon.Users[i]
+		if err := user.Validate(); err != nil {
+			return err
+		}
+		if names[user.Name] {
+			return fmt.Errorf("user %s is defined more than once", user.Name)
+		}
+		names[user.Name] = true
+		user.Localise(daemon.engineID)
+	}
+	return nil
+}
+
+// getUser returns the SNMPv3 user of the name, or nil if the user does not exist.
+func (daemon *Daemon) getUser(name string) *snmp.USMUser {
+	for i := range daemon.Users {
+		if daemon.Users[i].Name == name {
+			return &daemon.Users[i]
+		}
+	}
+	return nil
+}
+
+// engineTime returns the number of seconds since the SNMPv3 engine started.
+func (daemon *Daemon) engineTime() int64 {
+	return int64(time.Since(daemon.engineStartTime).Seconds())
+}
+
+// handleV3 authenticates and answers an SNMPv3 request, or sends a report to tell the client about an error.
+func (daemon *Daemon) handleV3(logger lalog.Logger, clientIP string, client *net.UDPAddr, reqPacket []byte, srv *net.UDPConn) {
+	req, err := snmp.DecodeV3(reqPacket)
+	if err != nil {
+		logger.Warning("handleV3", clientIP, err, "failed to parse request message")
+		return
+	}
+	// Clients discover the engine ID by sending an unauthenticated request without engine ID
+	if !bytes.Equal(req.EngineID, daemon.engineID) {
+		if len(req.EngineID) > 0 {
+			logger.Info("handleV3", clientIP, nil, "request carries an unknown engine ID")
+		}
+		daemon.report(logger, clientIP, client, srv, req, nil, snmp.OIDUSMStatsUnknownEngineIDs)
+		return
+	}
+	user := daemon.getUser(req.UserName)
+	if user == nil {
+		logger.Info("handleV3", clientIP, nil, "unknown user \"%s\"", req.UserName)
+		daemon.report(logger, clientIP, client, srv, req, nil, snmp.OIDUSMStatsUnknownUserNames)
+		return
+	}
+	// Authentication is mandatory, and so is privacy for the users who use it.
+	if req.Flags&snmp.FlagAuth == 0 || (req.Flags&snmp.FlagPriv == 0) == user.HasPrivacy() {
+		logger.Info("handleV3", clientIP, nil, "user \"%s\" uses unsupported security level", req.UserName)
+		daemon.report(logger, clientIP, client, srv, req, nil, snmp.OIDUSMStatsUnsupportedSecLevels)
+		return
+	}
+	if err := req.Authenticate(user); err != nil {
+		logger.Info("handleV3", clientIP, err, "failed to authenticate user \"%s\"", req.UserName)
+		daemon.report(logger, clientIP, client, srv, req, nil, snmp.OIDUSMStatsWrongDigests)
+		return
+	}
+	if timeDiff := req.EngineTime - daemon.engineTime(); req.EngineBoots != EngineBoots || timeDiff > TimeWindowSec || timeDiff < -TimeWindowSec {
+		logger.Info("handleV3", clientIP, nil, "request of user \"%s\" is not in time window", req.UserName)
+		daemon.report(logger, clientIP, client, srv, req, user, snmp.OIDUSMStatsNotInTimeWindows)
+		return
+	}
+	if err := req.Decrypt(user); err != nil {
+		logger.Info("handleV3", clientIP, err, "failed to decrypt request of user \"%s\"", req.UserName)
+		daemon.report(logger, clientIP, client, srv, req, nil, snmp.OIDUSMStatsDecryptionErrors)
+		return
+	}
+	// Process the request
+	var varBinds []snmp.VarBind
+	switch req.ScopedPDU.PDU {
+	case snmp.PDUGetNextRequest:
+		for _, varBind := range req.ScopedPDU.VarBinds {
+			nextOID, endOfMibView := snmp.GetNextNode(varBind.OID)
+			nextNodeFun, exists := snmp.GetNode(nextOID)
+			if !exists {
+				logger.Warning("handleV3", clientIP, nil, "failed to retrieve OID %v, this is a programming error.", nextOID)
+				return
+			}
+			if endOfMibView {
+				varBinds = append(varBinds, snmp.VarBind{OID: nextOID, Value: snmp.EndOfMIBView{}})
+			} else {
+				varBinds = append(varBinds, snmp.VarBind{OID: nextOID, Value: nextNodeFun()})
+			}
+			logger.Info("handleV3", clientIP, nil, "user \"%s\" GetNext OID %v = (%v)", req.UserName, varBind.OID, nextOID)
+		}
+	case snmp.PDUGetRequest:
+		for _, varBind := range req.ScopedPDU.VarBinds {
+			if nodeFun, exists := snmp.GetNode(varBind.OID); exists {
+				varBinds = append(varBinds, snmp.VarBind{OID: varBind.OID, Value: nodeFun()})
+			} else {
+				varBinds = append(varBinds, snmp.VarBind{OID: varBind.OID, Value: snmp.NoSuchInstance{}})
+			}
+			logger.Info("handleV3", clientIP, nil, "user \"%s\" Get OID %v", req.UserName, varBind.OID)
+		}
+	default:
+		logger.Info("handleV3", clientIP, nil, "unknown PDU %d", req.ScopedPDU.PDU)
+		return
+	}
+	resp := daemon.newResponse(req, req.Flags&(snmp.FlagAuth|snmp.FlagPriv))
+	resp.ScopedPDU.ContextName = req.ScopedPDU.ContextName
+	resp.ScopedPDU.PDU = snmp.PDUGetResponse
+	resp.ScopedPDU.RequestID = req.ScopedPDU.RequestID
+	resp.ScopedPDU.VarBinds = varBinds
+	respPacket, err := resp.Encode(user)
+	if err != nil {
+		logger.Warning("handleV3", clientIP, err, "failed to encode response")
+		return
+	}
+	writeResponse(logger, clientIP, client, respPacket, srv)
+}
+
+// newResponse returns a message that answers the request, with this daemon as the authoritative engine.
+func (daemon *Daemon) newResponse(req *snmp.V3Message, flags byte) *snmp.V3Message {
+	return &snmp.V3Message{
+		MsgID:       req.MsgID,
+		Flags:       flags,
+		EngineID:    daemon.engineID,
+		EngineBoots: EngineBoots,
+		EngineTime:  daemon.engineTime(),
+		UserName:    req.UserName,
+		ScopedPDU:   snmp.ScopedPDU{ContextEngineID: daemon.engineID},
+	}
+}
+
+/*
+report sends a report PDU carrying the USM statistics counter of the error, if the request asks for it. The report is
+authenticated by the user's key if the user is not nil.
+*/
+func (daemon *Daemon) report(logger lalog.Logger, clientIP string, client *net.UDPAddr, srv *net.UDPConn, req *snmp.V3Message, user *snmp.USMUser, oid asn1.ObjectIdentifier) {
+	count := daemon.usmStats.increase(oid.String())
+	if req.Flags&snmp.FlagReportable == 0 {
+		return
+	}
+	var flags byte
+	if user != nil {
+		flags = snmp.FlagAuth
+	}
+	resp := daemon.newResponse(req, flags)
+	resp.ScopedPDU.PDU = snmp.PDUReport
+	// The request ID is unavailable if the scoped PDU remains encrypted
+	resp.ScopedPDU.RequestID = req.ScopedPDU.RequestID
+	resp.ScopedPDU.VarBinds = []snmp.VarBind{{OID: oid, Value: count}}
+	respPacket, err := resp.Encode(user)
+	if err != nil {
+		logger.Warning("report", clientIP, err, "failed to encode report")
+		return
+	}
+	writeResponse(logger, clientIP, client, respPacket, srv)
+}
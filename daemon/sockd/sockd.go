@@ -7,15 +7,25 @@ import (
 	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
 	"strconv"
 	"sync"
 	"time"
 
 	"github.com/HouzuoGuo/laitos/daemon/dnsd"
+	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
 	"github.com/HouzuoGuo/laitos/testingstub"
 )
 
+var (
+	// statsTCP times the TCP connections relayed by sock daemon.
+	statsTCP = misc.GetStats("sockd.TCP")
+	// statsUDP times the UDP packets relayed by sock daemon.
+	statsUDP = misc.GetStats("sockd.UDP")
+)
+
 const (
 	MD5SumLength  = 16
 	IOTimeoutSec  = 900
@@ -97,6 +107,22 @@ func TestSockd(sockd *Daemon, t testingstub.T) {
 			t.Fatal(err, resp)
 		}
 	}
+	// Make an HTTP request via the TCP port, the destination is a local HTTP server reached by its host name.
+	httpListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpListener.Close()
+	go func() {
+		_ = http.Serve(httpListener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("hello from " + r.Host))
+		}))
+	}()
+	httpPort := httpListener.Addr().(*net.TCPAddr).Port
+	proxyURL := fmt.Sprintf("sockd://%s@%s:%d", sockd.Password, sockd.Address, sockd.TCPPorts[0])
+	if resp, err := inet.DoHTTP(inet.HTTPRequest{ProxyURL: proxyURL}, "http://localhost:%s", httpPort); err != nil || string(resp.Body) != fmt.Sprintf("hello from localhost:%d", httpPort) {
+		t.Fatal(err, string(resp.Body))
+	}
 	for _, port := range sockd.UDPPorts {
 		fmt.Println("knocking on port", port)
 		resp := make([]byte, 100)
@@ -121,11 +147,13 @@ func TestSockd(sockd *Daemon, t testingstub.T) {
 
 // Daemon is intentionally undocumented magic ^____^
 type Daemon struct {
-	Address    string `json:"Address"`
-	Password   string `json:"Password"`
-	PerIPLimit int    `json:"PerIPLimit"`
-	TCPPorts   []int  `json:"TCPPorts"`
-	UDPPorts   []int  `json:"UDPPorts"`
+	Address       string `json:"Address"`
+	Password      string `json:"Password"`
+	PerIPLimit    int    `json:"PerIPLimit"`
+	MaxConnsPerIP int    `json:"MaxConnsPerIP"`
+	TCPPorts      []int  `json:"TCPPorts"`
+	UDPPorts      []int  `json:"UDPPorts"`
+	UDPReceivers  int    `json:"UDPReceivers"`
 
 	DNSDaemon *dnsd.Daemon `json:"-"` // it is assumed to be already initialised
 
@@ -142,6 +170,9 @@ func (daemon *Daemon) Initialise() error {
 	if daemon.PerIPLimit < 1 {
 		daemon.PerIPLimit = 96
 	}
+	if daemon.MaxConnsPerIP < 1 {
+		daemon.MaxConnsPerIP = 256
+	}
 	daemon.logger = lalog.Logger{
 		ComponentName: "sockd",
 		ComponentID:   []lalog.LoggerIDField{{Key: "Addr", Value: daemon.Address}},
@@ -166,11 +197,12 @@ func (daemon *Daemon) StartAndBlock() error {
 	if daemon.TCPPorts != nil {
 		for _, tcpPort := range daemon.TCPPorts {
 			tcpDaemon := &TCPDaemon{
-				Address:    daemon.Address,
-				Password:   daemon.Password,
-				PerIPLimit: daemon.PerIPLimit,
-				TCPPort:    tcpPort,
-				DNSDaemon:  daemon.DNSDaemon,
+				Address:       daemon.Address,
+				Password:      daemon.Password,
+				PerIPLimit:    daemon.PerIPLimit,
+				MaxConnsPerIP: daemon.MaxConnsPerIP,
+				TCPPort:       tcpPort,
+				DNSDaemon:     daemon.DNSDaemon,
 			}
 			if err := tcpDaemon.Initialise(); err != nil {
 				daemon.Stop()
@@ -190,11 +222,12 @@ func (daemon *Daemon) StartAndBlock() error {
 	if daemon.UDPPorts != nil {
 		for _, udpPort := range daemon.UDPPorts {
 			udpDaemon := &UDPDaemon{
-				Address:    daemon.Address,
-				Password:   daemon.Password,
-				PerIPLimit: daemon.PerIPLimit,
-				UDPPort:    udpPort,
-				DNSDaemon:  daemon.DNSDaemon,
+				Address:      daemon.Address,
+				Password:     daemon.Password,
+				PerIPLimit:   daemon.PerIPLimit,
+				UDPPort:      udpPort,
+				UDPReceivers: daemon.UDPReceivers,
+				DNSDaemon:    daemon.DNSDaemon,
 			}
 			if err := udpDaemon.Initialise(); err != nil {
 				daemon.Stop()
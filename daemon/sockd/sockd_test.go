@@ -26,6 +26,10 @@ func TestSockd_StartAndBlock(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// The DNS daemon checks the destinations against its black list
+	if err := daemon.DNSDaemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
 	daemon.Address = "127.0.0.1"
 	daemon.TCPPorts = []int{27101, 23990}
 	daemon.UDPPorts = []int{13781, 38191}
@@ -50,6 +50,7 @@ func PipeTCPConnection(fromConn, toConn net.Conn, doWriteRand bool) {
 			} else if _, err := toConn.Write(buf[:length]); err != nil {
 				return
 			}
+			misc.SOCKDTCPTrafficBytes.Add(int64(length))
 		}
 		if err != nil {
 			if doWriteRand {
@@ -61,10 +62,11 @@ func PipeTCPConnection(fromConn, toConn net.Conn, doWriteRand bool) {
 }
 
 type TCPDaemon struct {
-	Address    string `json:"Address"`
-	Password   string `json:"Password"`
-	PerIPLimit int    `json:"PerIPLimit"`
-	TCPPort    int    `json:"TCPPort"`
+	Address       string `json:"Address"`
+	Password      string `json:"Password"`
+	PerIPLimit    int    `json:"PerIPLimit"`
+	MaxConnsPerIP int    `json:"MaxConnsPerIP"`
+	TCPPort       int    `json:"TCPPort"`
 
 	DNSDaemon *dnsd.Daemon `json:"-"` // it is assumed to be already initialised
 
@@ -76,18 +78,19 @@ func (daemon *TCPDaemon) Initialise() error {
 	daemon.cipher = &Cipher{}
 	daemon.cipher.Initialise(daemon.Password)
 	daemon.tcpServer = &common.TCPServer{
-		ListenAddr:  daemon.Address,
-		ListenPort:  daemon.TCPPort,
-		AppName:     "sockd",
-		App:         daemon,
-		LimitPerSec: daemon.PerIPLimit,
+		ListenAddr:    daemon.Address,
+		ListenPort:    daemon.TCPPort,
+		AppName:       "sockd",
+		App:           daemon,
+		LimitPerSec:   daemon.PerIPLimit,
+		MaxConnsPerIP: daemon.MaxConnsPerIP,
 	}
 	daemon.tcpServer.Initialise()
 	return nil
 }
 
 func (daemon *TCPDaemon) GetTCPStatsCollector() *misc.Stats {
-	return misc.SOCKDStatsTCP
+	return statsTCP
 }
 
 func (daemon *TCPDaemon) HandleTCPConnection(logger lalog.Logger, ip string, client *net.TCPConn) {
@@ -52,10 +52,11 @@ func MakeUDPRequestHeader(addr net.Addr) ([]byte, int) {
 }
 
 type UDPDaemon struct {
-	Address    string
-	Password   string
-	PerIPLimit int
-	UDPPort    int
+	Address      string
+	Password     string
+	PerIPLimit   int
+	UDPPort      int
+	UDPReceivers int
 
 	DNSDaemon *dnsd.Daemon
 
@@ -70,11 +71,12 @@ func (daemon *UDPDaemon) Initialise() error {
 	daemon.cipher = &Cipher{}
 	daemon.cipher.Initialise(daemon.Password)
 	daemon.udpServer = &common.UDPServer{
-		ListenAddr:  daemon.Address,
-		ListenPort:  daemon.UDPPort,
-		AppName:     "sockd",
-		App:         daemon,
-		LimitPerSec: daemon.PerIPLimit,
+		ListenAddr:   daemon.Address,
+		ListenPort:   daemon.UDPPort,
+		AppName:      "sockd",
+		App:          daemon,
+		LimitPerSec:  daemon.PerIPLimit,
+		NumReceivers: daemon.UDPReceivers,
 	}
 	daemon.udpServer.Initialise()
 	daemon.logger = lalog.Logger{
@@ -85,7 +87,7 @@ func (daemon *UDPDaemon) Initialise() error {
 }
 
 func (daemon *UDPDaemon) GetUDPStatsCollector() *misc.Stats {
-	return misc.SOCKDStatsUDP
+	return statsUDP
 }
 
 func (daemon *UDPDaemon) HandleUDPClient(logger lalog.Logger, ip string, client *net.UDPAddr, packet []byte, srv *net.UDPConn) {
@@ -254,7 +256,7 @@ func (conn *UDPCipherConnection) WriteRand(dest net.Addr) {
 func (daemon *UDPDaemon) HandleUDPConnection(logger lalog.Logger, server *UDPCipherConnection, n int, clientAddr *net.UDPAddr, packet []byte) {
 	beginTimeNano := time.Now().UnixNano()
 	defer func() {
-		misc.SOCKDStatsUDP.Trigger(float64(time.Now().UnixNano() - beginTimeNano))
+		statsUDP.Trigger(float64(time.Now().UnixNano() - beginTimeNano))
 	}()
 
 	if len(packet) < 3 {
@@ -358,7 +360,9 @@ func (daemon *UDPDaemon) HandleUDPConnection(logger lalog.Logger, server *UDPCip
 		if conn := daemon.udpTable.Delete(clientAddr.String()); conn != nil {
 			conn.Close()
 		}
+		return
 	}
+	misc.SOCKDUDPTrafficBytes.Add(int64(n - packetLen))
 }
 
 func (daemon *UDPDaemon) PipeUDPConnection(server net.PacketConn, clientAddr *net.UDPAddr, client net.PacketConn) {
@@ -390,5 +394,6 @@ func (daemon *UDPDaemon) PipeUDPConnection(server net.PacketConn, clientAddr *ne
 				return
 			}
 		}
+		misc.SOCKDUDPTrafficBytes.Add(int64(length))
 	}
 }
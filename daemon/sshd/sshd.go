@@ -0,0 +1,480 @@
+/*
+sshd implements an SSH server that feeds each line of an interactive session (or the command of an "exec" request) into
+the toolbox command processor, and sends the command results back to the SSH client.
+*/
+package sshd
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/testingstub"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"golang.org/x/crypto/ssh"
+)
+
+// sessionStats times the SSH sessions.
+var sessionStats = misc.GetStats("sshd.Sessions")
+
+const (
+	IOTimeoutSec      = 10 * 60          // If a conversation goes silent for this many seconds, the connection is terminated.
+	CommandTimeoutSec = 60               // Command execution times out after this many seconds
+	MaxLineLength     = 1048576          // MaxLineLength is the maximum length of a line of command typed in an interactive session.
+	ServerVersion     = "SSH-2.0-laitos" // ServerVersion is the identification string presented to SSH clients.
+
+	// PermitAppCommands is the permission extension of users who may run app commands in sessions.
+	PermitAppCommands = "laitos-app-commands"
+	// PermitTunnel is the permission extension of tunnel agents who may ask the server to listen on tunnel ports.
+	PermitTunnel = "laitos-tunnel"
+)
+
+// Daemon implements an SSH server that offers access to all toolbox features via interactive sessions and exec requests.
+type Daemon struct {
+	Address string `json:"Address"` // Network address to listen to, e.g. 0.0.0.0 for all network interfaces.
+	Port    int    `json:"Port"`    // TCP port to listen on
+	/*
+		HostKeyPath is the path to the host private key in PEM format. If the file does not exist yet, a new ed25519 host
+		key is generated and saved to the path.
+	*/
+	HostKeyPath string `json:"HostKeyPath"`
+	// Password authorises SSH clients to log in using password. Password authentication is disabled if it is empty.
+	Password string `json:"Password"`
+	// AuthorizedKeys are public keys in the format of OpenSSH authorized_keys file, they authorise SSH clients to log in.
+	AuthorizedKeys []string `json:"AuthorizedKeys"`
+	/*
+		TunnelAgentKeys are public keys of tunnel agents (in the format of OpenSSH authorized_keys file), which expose
+		their local ports on TunnelPorts of this server. They may not run app commands unless they are in AuthorizedKeys.
+	*/
+	TunnelAgentKeys []string `json:"TunnelAgentKeys"`
+	// TunnelPorts are the TCP ports that tunnel agents may ask this server to listen on.
+	TunnelPorts []int `json:"TunnelPorts"`
+	// TunnelListenAddress is the network address tunnel ports listen on, e.g. 0.0.0.0 for all network interfaces.
+	TunnelListenAddress string                    `json:"TunnelListenAddress"`
+	PerIPLimit          int                       `json:"PerIPLimit"`  // PerIPLimit is approximately how many concurrent users are expected to be using the server from same IP address
+	GlobalLimit         int                       `json:"GlobalLimit"` // GlobalLimit is the maximum number of connections acceptable from all clients combined per second, 0 means unlimited.
+	Processor           *toolbox.CommandProcessor `json:"-"`           // Feature command processor
+
+	serverConfig    *ssh.ServerConfig
+	authorizedKeys  map[string]struct{}
+	tunnelAgentKeys map[string]struct{}
+	tunnels         *tunnels
+	tcpServer       *common.TCPServer
+}
+
+// loadHostKey reads the host key from HostKeyPath, or generates and saves a new host key if the file does not exist.
+func (daemon *Daemon) loadHostKey() (ssh.Signer, error) {
+	return LoadOrGenerateKey(daemon.HostKeyPath)
+}
+
+// LoadOrGenerateKey reads the private key in PEM format from the file, or generates and saves a new ed25519 key if the file does not exist.
+func LoadOrGenerateKey(keyPath string) (ssh.Signer, error) {
+	keyPEM, err := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		_, privKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		privKeyDER, err := x509.MarshalPKCS8PrivateKey(privKey)
+		if err != nil {
+			return nil, err
+		}
+		keyPEM = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privKeyDER})
+		if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(keyPEM)
+}
+
+// Initialise validates configuration and initialises internal states.
+func (daemon *Daemon) Initialise() error {
+	if daemon.Processor == nil || daemon.Processor.IsEmpty() {
+		return fmt.Errorf("sshd.Initialise: command processor and its filters must be configured")
+	}
+	if errs := daemon.Processor.IsSaneForInternet(); len(errs) > 0 {
+		return fmt.Errorf("sshd.Initialise: %+v", errs)
+	}
+	if daemon.Address == "" {
+		daemon.Address = "0.0.0.0"
+	}
+	if daemon.Port < 1 {
+		daemon.Port = 22
+	}
+	if daemon.PerIPLimit < 1 {
+		daemon.PerIPLimit = 3 // reasonable for personal use
+	}
+	if daemon.HostKeyPath == "" {
+		return errors.New("sshd.Initialise: HostKeyPath must be specified")
+	}
+	if daemon.Password == "" && len(daemon.AuthorizedKeys) == 0 && len(daemon.TunnelAgentKeys) == 0 {
+		return errors.New("sshd.Initialise: either or both Password and AuthorizedKeys, or TunnelAgentKeys, must be specified")
+	}
+	if daemon.Password != "" && len(daemon.Password) < 7 {
+		return errors.New("sshd.Initialise: Password must be at least 7 characters long")
+	}
+	daemon.authorizedKeys = make(map[string]struct{})
+	for _, line := range daemon.AuthorizedKeys {
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return fmt.Errorf("sshd.Initialise: failed to parse authorized key \"%s\" - %v", line, err)
+		}
+		daemon.authorizedKeys[string(pubKey.Marshal())] = struct{}{}
+	}
+	if err := daemon.initialiseTunnels(); err != nil {
+		return fmt.Errorf("sshd.Initialise: %v", err)
+	}
+	hostKey, err := daemon.loadHostKey()
+	if err != nil {
+		return fmt.Errorf("sshd.Initialise: failed to load host key from \"%s\" - %v", daemon.HostKeyPath, err)
+	}
+	daemon.serverConfig = &ssh.ServerConfig{ServerVersion: ServerVersion, MaxAuthTries: 3}
+	if daemon.Password != "" {
+		daemon.serverConfig.PasswordCallback = daemon.checkPassword
+	}
+	if len(daemon.authorizedKeys) > 0 || len(daemon.tunnelAgentKeys) > 0 {
+		daemon.serverConfig.PublicKeyCallback = daemon.checkPublicKey
+	}
+	daemon.serverConfig.AddHostKey(hostKey)
+	daemon.tcpServer = common.NewTCPServer(daemon.Address, daemon.Port, "sshd", daemon, daemon.PerIPLimit, daemon.GlobalLimit)
+	return nil
+}
+
+// checkPassword is the SSH password authentication callback.
+func (daemon *Daemon) checkPassword(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+	if subtle.ConstantTimeCompare(password, []byte(daemon.Password)) != 1 {
+		return nil, errors.New("incorrect password")
+	}
+	return &ssh.Permissions{Extensions: map[string]string{PermitAppCommands: ""}}, nil
+}
+
+// checkPublicKey is the SSH public key authentication callback.
+func (daemon *Daemon) checkPublicKey(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	perms := &ssh.Permissions{Extensions: map[string]string{}}
+	if _, found := daemon.authorizedKeys[string(key.Marshal())]; found {
+		perms.Extensions[PermitAppCommands] = ""
+	}
+	if _, found := daemon.tunnelAgentKeys[string(key.Marshal())]; found {
+		perms.Extensions[PermitTunnel] = ""
+	}
+	if len(perms.Extensions) == 0 {
+		return nil, errors.New("public key is not authorised")
+	}
+	return perms, nil
+}
+
+// GetTCPStatsCollector returns stats collector for the TCP server of this daemon.
+func (daemon *Daemon) GetTCPStatsCollector() *misc.Stats {
+	return sessionStats
+}
+
+// idleTimeoutConn extends the IO deadline of the connection each time it reads or writes.
+type idleTimeoutConn struct {
+	net.Conn
+}
+
+func (conn idleTimeoutConn) Read(b []byte) (int, error) {
+	if err := conn.Conn.SetDeadline(time.Now().Add(IOTimeoutSec * time.Second)); err != nil {
+		return 0, err
+	}
+	return conn.Conn.Read(b)
+}
+
+func (conn idleTimeoutConn) Write(b []byte) (int, error) {
+	if err := conn.Conn.SetDeadline(time.Now().Add(IOTimeoutSec * time.Second)); err != nil {
+		return 0, err
+	}
+	return conn.Conn.Write(b)
+}
+
+// HandleTCPConnection completes SSH handshake with the client and then serves its sessions.
+func (daemon *Daemon) HandleTCPConnection(logger lalog.Logger, ip string, conn *net.TCPConn) {
+	daemon.Processor.SetLogger(logger)
+	sshConn, channels, requests, err := ssh.NewServerConn(idleTimeoutConn{conn}, daemon.serverConfig)
+	if err != nil {
+		logger.Warning("HandleTCPConnection", ip, err, "failed to complete handshake")
+		return
+	}
+	defer func() {
+		logger.MaybeMinorError(sshConn.Close())
+	}()
+	logger.Info("HandleTCPConnection", ip, nil, "user \"%s\" has logged in", sshConn.User())
+	_, permitAppCommands := sshConn.Permissions.Extensions[PermitAppCommands]
+	if _, permitTunnel := sshConn.Permissions.Extensions[PermitTunnel]; permitTunnel {
+		// Tunnel agents ask the server to listen on tunnel ports via global requests
+		go daemon.serveTunnelAgent(logger, ip, sshConn, requests)
+	} else {
+		// The server does not offer port forwarding or any other global request
+		go ssh.DiscardRequests(requests)
+	}
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			logger.MaybeMinorError(newChannel.Reject(ssh.UnknownChannelType, "only session channel is supported"))
+			continue
+		}
+		if !permitAppCommands {
+			logger.MaybeMinorError(newChannel.Reject(ssh.Prohibited, "the user may not run app commands"))
+			continue
+		}
+		channel, chanRequests, err := newChannel.Accept()
+		if err != nil {
+			logger.Warning("HandleTCPConnection", ip, err, "failed to accept session channel")
+			return
+		}
+		go daemon.handleSession(logger, ip, channel, chanRequests)
+	}
+}
+
+// handleSession waits for a shell or exec request on the session channel and then serves the request.
+func (daemon *Daemon) handleSession(logger lalog.Logger, ip string, channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer func() {
+		logger.MaybeMinorError(channel.Close())
+	}()
+	var withPTY bool
+	for req := range requests {
+		switch req.Type {
+		case "pty-req":
+			// The client will not echo the keys typed in the terminal, the session will echo them instead.
+			withPTY = true
+			logger.MaybeMinorError(req.Reply(true, nil))
+		case "env", "window-change":
+			logger.MaybeMinorError(req.Reply(true, nil))
+		case "shell":
+			logger.MaybeMinorError(req.Reply(true, nil))
+			go ssh.DiscardRequests(requests)
+			daemon.serveShell(logger, ip, channel, withPTY)
+			_, err := channel.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+			logger.MaybeMinorError(err)
+			return
+		case "exec":
+			// The payload of exec request is a string prefixed by its length
+			if len(req.Payload) < 4 || int(binary.BigEndian.Uint32(req.Payload))+4 != len(req.Payload) {
+				logger.MaybeMinorError(req.Reply(false, nil))
+				return
+			}
+			// Like each line of an interactive session, the command counts towards the rate limit of the client IP
+			if !daemon.tcpServer.AddAndCheckRateLimit(ip) {
+				logger.MaybeMinorError(req.Reply(false, nil))
+				return
+			}
+			logger.MaybeMinorError(req.Reply(true, nil))
+			go ssh.DiscardRequests(requests)
+			output := daemon.processCommand(ip, string(req.Payload[4:]))
+			if _, err := channel.Write([]byte(output + "\n")); err != nil {
+				return
+			}
+			_, err := channel.SendRequest("exit-status", false, []byte{0, 0, 0, 0})
+			logger.MaybeMinorError(err)
+			return
+		default:
+			logger.MaybeMinorError(req.Reply(false, nil))
+		}
+	}
+}
+
+// processCommand runs the toolbox command and returns its combined output.
+func (daemon *Daemon) processCommand(ip, line string) string {
+	return daemon.Processor.Process(context.Background(), toolbox.Command{
+		DaemonName: "sshd",
+		ClientID:   ip,
+		Content:    line,
+		TimeoutSec: CommandTimeoutSec,
+		Encrypted:  true,
+	}, true).CombinedOutput
+}
+
+/*
+serveShell reads lines of command from the interactive session, and writes their results back. If the session has a
+pseudo terminal, the keys typed are echoed back and backspace erases the last character.
+*/
+func (daemon *Daemon) serveShell(logger lalog.Logger, ip string, channel ssh.Channel, withPTY bool) {
+	newLine := "\n"
+	if withPTY {
+		newLine = "\r\n"
+	}
+	var line bytes.Buffer
+	buf := make([]byte, 1024)
+	for {
+		if misc.EmergencyLockDown {
+			logger.Warning("serveShell", "", misc.ErrEmergencyLockDown, "")
+			return
+		}
+		n, err := channel.Read(buf)
+		if err != nil {
+			if err != io.EOF {
+				logger.Warning("serveShell", ip, err, "failed to read from client")
+			}
+			return
+		}
+		var echo bytes.Buffer
+		for _, b := range buf[:n] {
+			switch b {
+			case 3, 4: // Ctrl-C and Ctrl-D end the session
+				if withPTY {
+					_, _ = channel.Write([]byte(newLine))
+					return
+				}
+				line.WriteByte(b)
+			case 8, 127: // Backspace
+				if line.Len() > 0 {
+					line.Truncate(line.Len() - 1)
+					echo.WriteString("\b \b")
+				}
+			case '\r', '\n':
+				if b == '\n' && withPTY {
+					continue
+				}
+				if withPTY {
+					echo.WriteString(newLine)
+					if _, err := channel.Write(echo.Bytes()); err != nil {
+						return
+					}
+				}
+				echo.Reset()
+				cmd := strings.TrimSpace(line.String())
+				line.Reset()
+				if cmd == "" {
+					continue
+				}
+				if !daemon.tcpServer.AddAndCheckRateLimit(ip) {
+					return
+				}
+				output := strings.Replace(daemon.processCommand(ip, cmd), "\n", newLine, -1)
+				if _, err := channel.Write([]byte(output + newLine)); err != nil {
+					return
+				}
+			default:
+				if line.Len() >= MaxLineLength {
+					logger.Warning("serveShell", ip, nil, "command line is too long")
+					return
+				}
+				line.WriteByte(b)
+				echo.WriteByte(b)
+			}
+		}
+		if withPTY && echo.Len() > 0 {
+			if _, err := channel.Write(echo.Bytes()); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// StartAndBlock starts the SSH server. You may call this function only after having called Initialise().
+func (daemon *Daemon) StartAndBlock() error {
+	return daemon.tcpServer.StartAndBlock()
+}
+
+// Stop closes the listener so that the server ceases accepting new connections, and closes the tunnel ports. Ongoing sessions continue nonetheless.
+func (daemon *Daemon) Stop() {
+	daemon.tcpServer.Stop()
+	daemon.tunnels.closeAll()
+}
+
+// TestSSHD contains the comprehensive test case of the SSH server. The daemon must be configured with a password.
+func TestSSHD(daemon *Daemon, t testingstub.T) {
+	var stoppedNormally bool
+	go func() {
+		if err := daemon.StartAndBlock(); err != nil {
+			t.Fatal(err)
+		}
+		stoppedNormally = true
+	}()
+	time.Sleep(2 * time.Second)
+
+	// Wrong password must not log in
+	clientConfig := &ssh.ClientConfig{
+		User:            "laitos",
+		Auth:            []ssh.AuthMethod{ssh.Password("wrong password")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         IOTimeoutSec * time.Second,
+	}
+	serverAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(daemon.Port))
+	if client, err := ssh.Dial("tcp", serverAddr, clientConfig); err == nil {
+		_ = client.Close()
+		t.Fatal("should not have logged in")
+	}
+	clientConfig.Auth = []ssh.AuthMethod{ssh.Password(daemon.Password)}
+	client, err := ssh.Dial("tcp", serverAddr, clientConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = client.Close()
+	}()
+	// Run a command via exec request
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output, err := session.Output(toolbox.TestCommandProcessorPIN + ".s echo hi"); err != nil || string(output) != "hi\n" {
+		t.Fatal(string(output), err)
+	}
+	// Run commands in an interactive session
+	session, err = client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stdout bytes.Buffer
+	session.Stdout = &stdout
+	if err := session.Shell(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stdin.Write([]byte("pin mismatch\n" + toolbox.TestCommandProcessorPIN + ".s echo hi\n")); err != nil {
+		t.Fatal(err)
+	}
+	_ = stdin.Close()
+	if err := session.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != toolbox.ErrPINAndShortcutNotFound.Error()+"\nhi\n" {
+		t.Fatal(stdout.String())
+	}
+	// Exec requests are subject to the rate limit too
+	var rateLimited bool
+	for i := 0; i < 100 && !rateLimited; i++ {
+		session, err = client.NewSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = session.Output("pin mismatch")
+		rateLimited = err != nil
+		_ = session.Close()
+	}
+	if !rateLimited {
+		t.Fatal("exec requests did not hit the rate limit")
+	}
+
+	// Daemon should stop within a second
+	daemon.Stop()
+	time.Sleep(1 * time.Second)
+	if !stoppedNormally {
+		t.Fatal("did not stop")
+	}
+	// Repeatedly stopping the daemon should have no negative consequence
+	daemon.Stop()
+	daemon.Stop()
+}
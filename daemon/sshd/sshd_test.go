@@ -0,0 +1,113 @@
+package sshd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHDaemon(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "laitos-TestSSHDaemon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	daemon := Daemon{}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "filters must be configured") {
+		t.Fatal(err)
+	}
+	daemon.Processor = toolbox.GetInsaneCommandProcessor()
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), toolbox.ErrBadProcessorConfig) {
+		t.Fatal(err)
+	}
+	daemon.Processor = toolbox.GetTestCommandProcessor()
+	// Test missing mandatory settings
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "HostKeyPath") {
+		t.Fatal(err)
+	}
+	daemon.HostKeyPath = filepath.Join(tmpDir, "host_key")
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "Password and AuthorizedKeys") {
+		t.Fatal(err)
+	}
+	daemon.AuthorizedKeys = []string{"ssh-ed25519 bad-key"}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "authorized key") {
+		t.Fatal(err)
+	}
+	daemon.AuthorizedKeys = nil
+	// Test default settings
+	daemon.Password = "sshdpassword"
+	if err := daemon.Initialise(); err != nil || daemon.Port != 22 || daemon.PerIPLimit != 3 {
+		t.Fatalf("%+v %+v\n", err, daemon)
+	}
+	// The host key is generated and then reused
+	hostKey, err := daemon.loadHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if reloaded, err := daemon.loadHostKey(); err != nil || string(reloaded.PublicKey().Marshal()) != string(hostKey.PublicKey().Marshal()) {
+		t.Fatal("host key should have been reused", err)
+	}
+	// Authorised public key
+	clientKey, err := daemon.loadHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon.AuthorizedKeys = []string{string(ssh.MarshalAuthorizedKey(clientKey.PublicKey()))}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := daemon.checkPublicKey(nil, clientKey.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := daemon.checkPassword(nil, []byte("wrong")); err == nil {
+		t.Fatal("should not have accepted wrong password")
+	}
+	// Tunnel agent key
+	agentKey, err := LoadOrGenerateKey(filepath.Join(tmpDir, "agent_key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon.TunnelAgentKeys = []string{string(ssh.MarshalAuthorizedKey(agentKey.PublicKey()))}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "TunnelPorts") {
+		t.Fatal(err)
+	}
+	daemon.TunnelPorts = []int{daemon.Port}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "tunnel port") {
+		t.Fatal(err)
+	}
+	daemon.TunnelPorts = []int{32793}
+	if err := daemon.Initialise(); err != nil || daemon.TunnelListenAddress != "0.0.0.0" || !daemon.isTunnelPort(32793) || daemon.isTunnelPort(32794) {
+		t.Fatal(err)
+	}
+	if perm, err := daemon.checkPublicKey(nil, agentKey.PublicKey()); err != nil {
+		t.Fatal(err)
+	} else if _, ok := perm.Extensions[PermitTunnel]; !ok {
+		t.Fatalf("%+v", perm)
+	} else if _, ok := perm.Extensions[PermitAppCommands]; ok {
+		t.Fatalf("tunnel agent must not run app commands: %+v", perm)
+	}
+	if perm, err := daemon.checkPublicKey(nil, clientKey.PublicKey()); err != nil {
+		t.Fatal(err)
+	} else if _, ok := perm.Extensions[PermitTunnel]; ok {
+		t.Fatalf("%+v", perm)
+	}
+	daemon.TunnelAgentKeys = nil
+	daemon.TunnelPorts = nil
+	// Prepare settings for test
+	daemon.Address = "127.0.0.1"
+	daemon.Port = 32792
+	daemon.PerIPLimit = 10 // limit must be high enough to tolerate consecutive command tests
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	TestSSHD(&daemon, t)
+}
@@ -0,0 +1,218 @@
+package sshd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"golang.org/x/crypto/ssh"
+)
+
+// tunnelForwardRequest is the payload of "tcpip-forward" and "cancel-tcpip-forward" global requests (RFC 4254 7.1).
+type tunnelForwardRequest struct {
+	Addr string
+	Port uint32
+}
+
+// tunnelChannelPayload is the extra data of "forwarded-tcpip" channel opened for each connection to a tunnel port (RFC 4254 7.2).
+type tunnelChannelPayload struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// tunnels keeps track of the tunnel ports that tunnel agents have asked the server to listen on.
+type tunnels struct {
+	mutex     *sync.Mutex
+	listeners map[int]net.Listener // listeners are the tunnel port listeners, keyed by port number.
+	agents    map[int]string       // agents are the IP addresses of the tunnel agents, keyed by port number.
+}
+
+// initialiseTunnels validates the tunnel configuration and initialises internal states.
+func (daemon *Daemon) initialiseTunnels() error {
+	if daemon.TunnelListenAddress == "" {
+		daemon.TunnelListenAddress = "0.0.0.0"
+	}
+	daemon.tunnelAgentKeys = make(map[string]struct{})
+	for _, line := range daemon.TunnelAgentKeys {
+		pubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return fmt.Errorf("failed to parse tunnel agent key \"%s\" - %v", line, err)
+		}
+		daemon.tunnelAgentKeys[string(pubKey.Marshal())] = struct{}{}
+	}
+	if len(daemon.tunnelAgentKeys) > 0 && len(daemon.TunnelPorts) == 0 {
+		return errors.New("TunnelPorts must be specified for tunnel agents")
+	}
+	for _, port := range daemon.TunnelPorts {
+		if port < 1 || port > 65535 || port == daemon.Port {
+			return fmt.Errorf("tunnel port %d must be between 1 and 65535 and differ from the SSH server port", port)
+		}
+	}
+	if daemon.tunnels != nil {
+		daemon.tunnels.closeAll()
+	}
+	daemon.tunnels = &tunnels{mutex: new(sync.Mutex), listeners: make(map[int]net.Listener), agents: make(map[int]string)}
+	return nil
+}
+
+// isTunnelPort returns true only if tunnel agents may ask the server to listen on the port.
+func (daemon *Daemon) isTunnelPort(port int) bool {
+	for _, tunnelPort := range daemon.TunnelPorts {
+		if tunnelPort == port {
+			return true
+		}
+	}
+	return false
+}
+
+// add listens on the tunnel port on behalf of the agent.
+func (tun *tunnels) add(listenAddr string, port int, agentIP string) (net.Listener, error) {
+	tun.mutex.Lock()
+	defer tun.mutex.Unlock()
+	if agent, exists := tun.agents[port]; exists {
+		return nil, fmt.Errorf("tunnel port %d is already used by agent %s", port, agent)
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(listenAddr, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	tun.listeners[port] = listener
+	tun.agents[port] = agentIP
+	return listener, nil
+}
+
+// remove closes the listener of the tunnel port if it belongs to the listener.
+func (tun *tunnels) remove(port int, listener net.Listener) {
+	tun.mutex.Lock()
+	defer tun.mutex.Unlock()
+	if existing, exists := tun.listeners[port]; exists && existing == listener {
+		_ = listener.Close()
+		delete(tun.listeners, port)
+		delete(tun.agents, port)
+	}
+}
+
+// closeAll closes all tunnel port listeners.
+func (tun *tunnels) closeAll() {
+	tun.mutex.Lock()
+	defer tun.mutex.Unlock()
+	for port, listener := range tun.listeners {
+		_ = listener.Close()
+		delete(tun.listeners, port)
+		delete(tun.agents, port)
+	}
+}
+
+/*
+serveTunnelAgent serves the global requests of a tunnel agent. For each tunnel port the agent asks for, the server
+listens on the port and relays each connection to the agent via a "forwarded-tcpip" channel. The tunnel ports are
+closed when the agent disconnects.
+*/
+func (daemon *Daemon) serveTunnelAgent(logger lalog.Logger, ip string, sshConn *ssh.ServerConn, requests <-chan *ssh.Request) {
+	tunnels := daemon.tunnels
+	agentListeners := make(map[int]net.Listener)
+	defer func() {
+		for port, listener := range agentListeners {
+			tunnels.remove(port, listener)
+		}
+	}()
+	for req := range requests {
+		switch req.Type {
+		case "tcpip-forward", "cancel-tcpip-forward":
+			var fwd tunnelForwardRequest
+			if err := ssh.Unmarshal(req.Payload, &fwd); err != nil || !daemon.isTunnelPort(int(fwd.Port)) {
+				logger.Warning("serveTunnelAgent", ip, err, "rejected %s request of port %d", req.Type, fwd.Port)
+				logger.MaybeMinorError(req.Reply(false, nil))
+				continue
+			}
+			port := int(fwd.Port)
+			if req.Type == "cancel-tcpip-forward" {
+				if listener, exists := agentListeners[port]; exists {
+					tunnels.remove(port, listener)
+					delete(agentListeners, port)
+				}
+				logger.MaybeMinorError(req.Reply(true, nil))
+				continue
+			}
+			listener, err := tunnels.add(daemon.TunnelListenAddress, port, ip)
+			if err != nil {
+				logger.Warning("serveTunnelAgent", ip, err, "failed to listen on tunnel port %d", port)
+				logger.MaybeMinorError(req.Reply(false, nil))
+				continue
+			}
+			agentListeners[port] = listener
+			logger.Info("serveTunnelAgent", ip, nil, "listening on tunnel port %d", port)
+			// The reply carries the port number in case the agent asked for port 0 (RFC 4254 7.1)
+			logger.MaybeMinorError(req.Reply(true, ssh.Marshal(struct{ Port uint32 }{fwd.Port})))
+			go daemon.acceptTunnelConnections(logger, sshConn, listener, fwd)
+		case "keepalive@openssh.com":
+			logger.MaybeMinorError(req.Reply(true, nil))
+		default:
+			logger.MaybeMinorError(req.Reply(false, nil))
+		}
+	}
+}
+
+// acceptTunnelConnections relays each connection made to the tunnel port to the tunnel agent.
+func (daemon *Daemon) acceptTunnelConnections(logger lalog.Logger, sshConn *ssh.ServerConn, listener net.Listener, fwd tunnelForwardRequest) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		originIP, originPortStr, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		if !daemon.tcpServer.AddAndCheckRateLimit(originIP) {
+			_ = conn.Close()
+			continue
+		}
+		originPort, _ := strconv.Atoi(originPortStr)
+		go func() {
+			defer func() {
+				_ = conn.Close()
+			}()
+			// The agent identifies the tunnel by the address and port it asked for
+			channel, chanRequests, err := sshConn.OpenChannel("forwarded-tcpip", ssh.Marshal(tunnelChannelPayload{
+				Addr:       fwd.Addr,
+				Port:       fwd.Port,
+				OriginAddr: originIP,
+				OriginPort: uint32(originPort),
+			}))
+			if err != nil {
+				logger.Warning("acceptTunnelConnections", originIP, err, "failed to open tunnel to agent for port %d", fwd.Port)
+				return
+			}
+			go ssh.DiscardRequests(chanRequests)
+			PipeTunnel(conn, channel)
+		}()
+	}
+}
+
+/*
+PipeTunnel copies data between the two connections (e.g. a TCP connection and an SSH channel) in both directions, until
+both directions have finished, and then closes both connections.
+*/
+func PipeTunnel(conn1, conn2 io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	copyAndCloseWrite := func(to, from io.ReadWriteCloser) {
+		_, _ = io.Copy(to, from)
+		// Let the other end know that there is no more data, while the other direction carries on.
+		if halfCloser, ok := to.(interface{ CloseWrite() error }); ok {
+			_ = halfCloser.CloseWrite()
+		} else {
+			_ = to.Close()
+		}
+		done <- struct{}{}
+	}
+	go copyAndCloseWrite(conn1, conn2)
+	go copyAndCloseWrite(conn2, conn1)
+	<-done
+	<-done
+	_ = conn1.Close()
+	_ = conn2.Close()
+}
@@ -1,6 +1,7 @@
 package telegrambot
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -19,10 +20,15 @@ import (
 	"github.com/HouzuoGuo/laitos/toolbox"
 )
 
+// commandStats times the processing of app commands received from chats.
+var commandStats = misc.GetStats("telegrambot.Commands")
+
 const (
-	ChatTypePrivate   = "private" // Name of the private chat type
-	APICallTimeoutSec = 30        // Outgoing API calls are constrained by this timeout
-	CommandTimeoutSec = 30        // Command execution is constrained by this timeout
+	ChatTypePrivate    = "private"    // Name of the private chat type
+	ChatTypeGroup      = "group"      // Name of the group chat type
+	ChatTypeSupergroup = "supergroup" // Name of the supergroup chat type
+	APICallTimeoutSec  = 30           // Outgoing API calls are constrained by this timeout
+	CommandTimeoutSec  = 30           // Command execution is constrained by this timeout
 
 	/*
 		PollIntervalSecMin and PollIntervalSecMax together determine the range of random number of seconds to wait between
@@ -52,17 +58,21 @@ type APIChat struct {
 
 // Telegram API entity - message
 type APIMessage struct {
-	ID        int64   `json:"message_id"`
-	From      APIUser `json:"from"`
-	Chat      APIChat `json:"chat"`
-	Timestamp int64   `json:"date"`
-	Text      string  `json:"text"`
+	ID        int64          `json:"message_id"`
+	From      APIUser        `json:"from"`
+	Chat      APIChat        `json:"chat"`
+	Timestamp int64          `json:"date"`
+	Text      string         `json:"text"`
+	Caption   string         `json:"caption"`
+	Document  APIDocument    `json:"document"`
+	Photo     []APIPhotoSize `json:"photo"`
 }
 
 // Telegram API entity - one bot update
 type APIUpdate struct {
-	ID      int64      `json:"update_id"`
-	Message APIMessage `json:"message"`
+	ID            int64            `json:"update_id"`
+	Message       APIMessage       `json:"message"`
+	CallbackQuery APICallbackQuery `json:"callback_query"`
 }
 
 // Telegram API entity - getUpdates response
@@ -73,10 +83,24 @@ type APIUpdates struct {
 
 // Process feature commands from incoming telegram messages, reply to the chats with command results.
 type Daemon struct {
-	AuthorizationToken string                    `json:"AuthorizationToken"` // Telegram bot API auth token
-	PerUserLimit       int                       `json:"PerUserLimit"`       // PerUserLimit determines how many messages may be processed per chat at regular interval
-	Processor          *toolbox.CommandProcessor `json:"-"`                  // Feature command processor
+	AuthorizationToken string `json:"AuthorizationToken"` // Telegram bot API auth token
+	PerUserLimit       int    `json:"PerUserLimit"`       // PerUserLimit determines how many messages may be processed per chat at regular interval
+	/*
+		ConfirmAppTriggers are the app triggers (e.g. ".s") of the commands that the bot asks user to confirm via a button
+		before running them.
+	*/
+	ConfirmAppTriggers []string `json:"ConfirmAppTriggers"`
+	// UploadDirectory is the directory to store the documents and photos sent to the bot. Uploads are disabled if it is empty.
+	UploadDirectory string `json:"UploadDirectory"`
+	// MaxFileSizeMB is the maximum size of a file uploaded to the bot or sent from the bot.
+	MaxFileSizeMB int `json:"MaxFileSizeMB"`
+	// GroupChats are the group chats that the bot operates in. Messages from other group chats are ignored.
+	GroupChats []GroupChat               `json:"GroupChats"`
+	Processor  *toolbox.CommandProcessor `json:"-"` // Feature command processor
 
+	userName      string          // userName is the user name of this bot, it is retrieved from API upon startup.
+	adminsCache   chatAdminsCache // adminsCache remembers the administrators of group chats
+	pending       pendingActions  // pending are the commands awaiting for user to press their buttons
 	messageOffset int64           // Process chat messages arrived after this point
 	userRateLimit *misc.RateLimit // Prevent user from flooding bot with new messages
 	loopIsRunning int32           // Value is 1 only when message loop is running
@@ -88,6 +112,9 @@ func (bot *Daemon) Initialise() error {
 	if bot.PerUserLimit < 1 {
 		bot.PerUserLimit = 2 // reasonable for personal use
 	}
+	if bot.MaxFileSizeMB < 1 || bot.MaxFileSizeMB > MaxFileSizeMBLimit {
+		bot.MaxFileSizeMB = MaxFileSizeMBLimit
+	}
 	bot.logger = lalog.Logger{ComponentName: "telegrambot", ComponentID: []lalog.LoggerIDField{{Key: "PerUserLimit", Value: bot.PerUserLimit}}}
 	if bot.Processor == nil || bot.Processor.IsEmpty() {
 		return fmt.Errorf("telegrambot.Initialise: command processor and its filters must be configured")
@@ -99,6 +126,8 @@ func (bot *Daemon) Initialise() error {
 	if bot.AuthorizationToken == "" {
 		return errors.New("telegrambot.Initialise: AuthorizationToken must not be empty")
 	}
+	// The URL of API calls carries the authorization token, keep it out of the log messages.
+	lalog.RegisterRedaction(bot.AuthorizationToken)
 	// Configure rate limit
 	bot.userRateLimit = &misc.RateLimit{
 		UnitSecs: PollIntervalSecMax,
@@ -121,11 +150,19 @@ func (bot *Daemon) ReplyTo(chatID int64, text string) error {
 		}.Encode()),
 	}, "https://api.telegram.org/bot%s/sendMessage", bot.AuthorizationToken)
 	if err != nil || resp.StatusCode/200 != 1 {
-		return fmt.Errorf("telegrambot.ReplyTo: failed to reply to %d - HTTP %d - %v %s", chatID, resp.StatusCode, err, string(resp.Body))
+		return bot.redactToken(fmt.Errorf("telegrambot.ReplyTo: failed to reply to %d - HTTP %d - %v %s", chatID, resp.StatusCode, err, string(resp.Body)))
 	}
 	return nil
 }
 
+// redactToken removes the authorization token from the error of an API call, which may carry the API URL.
+func (bot *Daemon) redactToken(err error) error {
+	if err == nil || bot.AuthorizationToken == "" || !strings.Contains(err.Error(), bot.AuthorizationToken) {
+		return err
+	}
+	return errors.New(strings.Replace(err.Error(), bot.AuthorizationToken, lalog.RedactedLabel, -1))
+}
+
 // Process incoming chat messages and reply command results to chat initiators.
 func (bot *Daemon) ProcessMessages(updates APIUpdates) {
 	for _, ding := range updates.Updates {
@@ -134,45 +171,114 @@ func (bot *Daemon) ProcessMessages(updates APIUpdates) {
 		if bot.messageOffset <= ding.ID {
 			bot.messageOffset = ding.ID + 1
 		}
+		// Ordinary conversations in group chats do not concern the bot, only the messages mentioning the bot are processed.
+		isGroup := IsGroupChatType(ding.Message.Chat.Type)
+		if ding.CallbackQuery.ID == "" && isGroup {
+			var mentioned bool
+			if ding.Message, mentioned = bot.removeGroupMention(ding.Message); !mentioned {
+				continue
+			}
+		}
 		// Apply rate limit to the user
 		origin := ding.Message.From.UserName
 		if origin == "" {
 			origin = ding.Message.Chat.UserName
 		}
+		if ding.CallbackQuery.ID != "" {
+			origin = ding.CallbackQuery.From.UserName
+		}
 		if !bot.userRateLimit.Add(origin, true) {
-			if err := bot.ReplyTo(ding.Message.Chat.ID, "rate limited"); err != nil {
+			chatID := ding.Message.Chat.ID
+			if ding.CallbackQuery.ID != "" {
+				chatID = ding.CallbackQuery.Message.Chat.ID
+			}
+			if err := bot.ReplyTo(chatID, "rate limited"); err != nil {
 				bot.logger.Warning("ProcessMessages", origin, err, "failed to reply rate limited response")
 			}
 			continue
 		}
+		// A button of inline keyboard has been pressed
+		if ding.CallbackQuery.ID != "" {
+			if chat := ding.CallbackQuery.Message.Chat; IsGroupChatType(chat.Type) {
+				if !bot.isGroupUserAllowed(chat.ID, ding.CallbackQuery.From) {
+					continue
+				}
+			} else if chat.Type != ChatTypePrivate {
+				bot.logger.Warning("ProcessMessages", origin, nil, "ignore button press from non-private chat %d", chat.ID)
+				continue
+			}
+			go bot.handleCallback(ding.CallbackQuery, beginTimeNano)
+			continue
+		}
 		// Do not process messages that arrived prior to server startup
 		if ding.Message.Timestamp < misc.StartupTime.Unix() {
 			bot.logger.Warning("ProcessMessages", origin, nil, "ignore message from \"%s\" that arrived before server started up", ding.Message.Chat.UserName)
 			continue
 		}
-		// Do not process non-private chats
-		if ding.Message.Chat.Type != ChatTypePrivate {
+		// Do not process channels and group chats that are not allowed
+		if isGroup {
+			if !bot.isGroupUserAllowed(ding.Message.Chat.ID, ding.Message.From) {
+				continue
+			}
+		} else if ding.Message.Chat.Type != ChatTypePrivate {
 			bot.logger.Warning("ProcessMessages", origin, nil, "ignore non-private chat %d", ding.Message.Chat.ID)
 			continue
 		}
+		// Store the uploaded document or photo
+		if ding.Message.Document.FileID != "" || len(ding.Message.Photo) > 0 {
+			go bot.handleUpload(ding.Message)
+			continue
+		}
 		// /start is not a command
 		if ding.Message.Text == "/start" {
-			bot.logger.Info("ProcessMessages", origin, nil, "chat %d is started by %s", ding.Message.Chat.ID, ding.Message.Chat.UserName)
+			bot.logger.Info("ProcessMessages", origin, nil, "chat %d is started by %s", ding.Message.Chat.ID, origin)
+			continue
+		}
+		// Ask user to confirm the command via buttons before running it
+		if appCmd, confirm := bot.needsConfirmation(ding.Message.Text); confirm {
+			go func(ding APIUpdate, origin string) {
+				keyboard := bot.getConfirmationKeyboard(ding.Message.Chat.ID, ding.Message.From.ID, ding.Message.Text)
+				if err := bot.ReplyWithKeyboard(ding.Message.Chat.ID, "Run "+appCmd+" ?", keyboard); err != nil {
+					bot.logger.Warning("ProcessMessages", origin, err, "failed to ask for confirmation")
+				}
+			}(ding, origin)
 			continue
 		}
 		// Find and run command in background
-		go func(ding APIUpdate, beginTimeNano int64) {
-			result := bot.Processor.Process(toolbox.Command{
-				DaemonName: "telegrambot",
-				ClientID:   ding.Message.Chat.UserName,
-				TimeoutSec: CommandTimeoutSec,
-				Content:    ding.Message.Text,
-			}, true)
-			if err := bot.ReplyTo(ding.Message.Chat.ID, result.CombinedOutput); err != nil {
-				bot.logger.Warning("ProcessMessages", ding.Message.Chat.UserName, err, "failed to send message reply")
-			}
-			misc.TelegramBotStats.Trigger(float64(time.Now().UnixNano() - beginTimeNano))
-		}(ding, beginTimeNano)
+		go bot.runCommand(ding.Message.Chat.ID, ding.Message.From.ID, origin, ding.Message.Text, beginTimeNano)
+	}
+}
+
+// runCommand runs the app command and replies the result to the chat, along with the buttons of follow-up choices if any.
+func (bot *Daemon) runCommand(chatID, userID int64, userName, text string, beginTimeNano int64) {
+	defer func() {
+		commandStats.Trigger(float64(time.Now().UnixNano() - beginTimeNano))
+	}()
+	result := bot.Processor.Process(context.Background(), toolbox.Command{
+		DaemonName: "telegrambot",
+		ClientID:   userName,
+		TimeoutSec: CommandTimeoutSec,
+		Content:    text,
+	}, true)
+	var err error
+	if result.Attachment != nil && result.Error == nil {
+		// Send the file attached by the app (e.g. send file) instead of the text output
+		if len(result.Attachment.Content) > bot.MaxFileSizeMB*1048576 {
+			err = bot.ReplyTo(chatID, fmt.Sprintf("file size exceeds the limit of %d MB", bot.MaxFileSizeMB))
+		} else if err = bot.SendFile(chatID, result.Attachment.Name, result.Attachment.Content); err != nil {
+			bot.logger.Warning("runCommand", userName, err, "failed to send file %s", result.Attachment.Name)
+			err = bot.ReplyTo(chatID, "failed to send file")
+		}
+	} else if len(result.CombinedOutput) > MaxMessageLength {
+		// Send the lengthy output as a document
+		err = bot.SendFile(chatID, OutputDocumentName, []byte(result.CombinedOutput))
+	} else if len(result.Choices) > 0 {
+		err = bot.ReplyWithKeyboard(chatID, result.CombinedOutput, bot.getChoicesKeyboard(chatID, userID, result.Choices))
+	} else {
+		err = bot.ReplyTo(chatID, result.CombinedOutput)
+	}
+	if err != nil {
+		bot.logger.Warning("runCommand", userName, err, "failed to send message reply")
 	}
 }
 
@@ -188,6 +294,13 @@ func (bot *Daemon) StartAndBlock() error {
 	if testErr == nil && testResp.StatusCode == http.StatusNotFound {
 		return errors.New("telegrambot.StartAndBlock: test call failed due to HTTP 404, is the AuthorizationToken correct?")
 	}
+	// Group chat messages address the bot by its user name
+	var me APIGetMe
+	if testErr == nil && json.Unmarshal(testResp.Body, &me) == nil && me.OK {
+		bot.userName = me.User.UserName
+	} else if len(bot.GroupChats) > 0 {
+		bot.logger.Warning("StartAndBlock", "", testErr, "failed to retrieve bot user name, group chat messages will be ignored")
+	}
 	bot.logger.Info("StartAndBlock", "", nil, "going to poll for messages")
 	lastIdle := time.Now().Unix()
 	for {
@@ -0,0 +1,196 @@
+package telegrambot
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+const (
+	// MaxMessageLength is the maximum length of a text message, longer command output is sent as a document.
+	MaxMessageLength = 4096
+	// OutputDocumentName is the name of the document carrying command output that is too long for a text message.
+	OutputDocumentName = "output.txt"
+	// MaxFileSizeMBLimit is the limit of file size imposed by telegram bot API on downloading files from chats.
+	MaxFileSizeMBLimit = 20
+)
+
+// Telegram API entity - a file sent as document
+type APIDocument struct {
+	FileID   string `json:"file_id"`
+	FileName string `json:"file_name"`
+	FileSize int64  `json:"file_size"`
+}
+
+// Telegram API entity - one size of a photo
+type APIPhotoSize struct {
+	FileID   string `json:"file_id"`
+	FileSize int64  `json:"file_size"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+}
+
+// Telegram API entity - getFile response
+type APIFile struct {
+	OK   bool `json:"ok"`
+	File struct {
+		FilePath string `json:"file_path"`
+		FileSize int64  `json:"file_size"`
+	} `json:"result"`
+}
+
+/*
+checkUploadCaption returns true only if the caption of an uploaded file begins with the password PIN. The text following
+the PIN, if any, is returned as the name to save the file as.
+*/
+func (bot *Daemon) checkUploadCaption(caption string) (string, bool) {
+	caption = strings.TrimSpace(caption)
+	pin := bot.getPIN()
+	if pin == "" || len(caption) < len(pin) || subtle.ConstantTimeCompare([]byte(caption[:len(pin)]), []byte(pin)) != 1 {
+		return "", false
+	}
+	return strings.TrimSpace(caption[len(pin):]), true
+}
+
+// getUploadFileName returns a name for the uploaded file that does not conflict with existing files in upload directory.
+func (bot *Daemon) getUploadFileName(name string) string {
+	name = filepath.Base(strings.TrimSpace(name))
+	if name == "." || name == ".." || name == string(filepath.Separator) || name == "" {
+		name = "upload"
+	}
+	if _, err := os.Stat(filepath.Join(bot.UploadDirectory, name)); err == nil {
+		name = fmt.Sprintf("%d-%s", time.Now().UnixNano(), name)
+	}
+	return name
+}
+
+// downloadFile retrieves the content of the chat file.
+func (bot *Daemon) downloadFile(fileID string) ([]byte, error) {
+	maxBytes := bot.MaxFileSizeMB * 1048576
+	resp, err := inet.DoHTTP(inet.HTTPRequest{TimeoutSec: APICallTimeoutSec},
+		"https://api.telegram.org/bot%s/getFile?file_id=%s", bot.AuthorizationToken, fileID)
+	if err == nil {
+		err = resp.Non2xxToError()
+	}
+	if err != nil {
+		return nil, bot.redactToken(err)
+	}
+	var file APIFile
+	if err := json.Unmarshal(resp.Body, &file); err != nil {
+		return nil, err
+	}
+	if !file.OK || file.File.FilePath == "" {
+		return nil, fmt.Errorf("file %s is not available for download", fileID)
+	}
+	if file.File.FileSize > int64(maxBytes) {
+		return nil, fmt.Errorf("file size exceeds the limit of %d MB", bot.MaxFileSizeMB)
+	}
+	// The file path is already URL-safe and must not be escaped
+	resp, err = inet.DoHTTP(inet.HTTPRequest{TimeoutSec: APICallTimeoutSec * 2, MaxBytes: maxBytes + 1},
+		"https://api.telegram.org/file/bot%s/"+file.File.FilePath, bot.AuthorizationToken)
+	if err == nil {
+		err = resp.Non2xxToError()
+	}
+	if err != nil {
+		return nil, bot.redactToken(err)
+	}
+	if len(resp.Body) > maxBytes {
+		return nil, fmt.Errorf("file size exceeds the limit of %d MB", bot.MaxFileSizeMB)
+	}
+	return resp.Body, nil
+}
+
+// handleUpload stores the document or photo of the chat message in upload directory. The caption must carry password PIN.
+func (bot *Daemon) handleUpload(msg APIMessage) {
+	var reply string
+	defer func() {
+		if err := bot.ReplyTo(msg.Chat.ID, reply); err != nil {
+			bot.logger.Warning("handleUpload", msg.Chat.UserName, err, "failed to send message reply")
+		}
+	}()
+	if bot.UploadDirectory == "" {
+		reply = "file upload is not enabled"
+		return
+	}
+	saveAs, authorised := bot.checkUploadCaption(msg.Caption)
+	if !authorised {
+		reply = toolbox.ErrPINAndShortcutNotFound.Error()
+		return
+	}
+	fileID, fileName, fileSize := msg.Document.FileID, msg.Document.FileName, msg.Document.FileSize
+	if fileID == "" {
+		// Telegram offers a photo in several sizes, the last one is the largest.
+		photo := msg.Photo[len(msg.Photo)-1]
+		fileID, fileName, fileSize = photo.FileID, fmt.Sprintf("photo-%d.jpg", msg.Timestamp), photo.FileSize
+	}
+	if saveAs != "" {
+		fileName = saveAs
+	}
+	if fileSize > int64(bot.MaxFileSizeMB*1048576) {
+		reply = fmt.Sprintf("file size exceeds the limit of %d MB", bot.MaxFileSizeMB)
+		return
+	}
+	content, err := bot.downloadFile(fileID)
+	if err != nil {
+		bot.logger.Warning("handleUpload", msg.Chat.UserName, err, "failed to download file %s", fileName)
+		reply = "failed to download file"
+		return
+	}
+	if err := os.MkdirAll(bot.UploadDirectory, 0700); err != nil {
+		reply = "failed to create upload directory - " + err.Error()
+		return
+	}
+	fileName = bot.getUploadFileName(fileName)
+	if err := ioutil.WriteFile(filepath.Join(bot.UploadDirectory, fileName), content, 0600); err != nil {
+		reply = "failed to save file - " + err.Error()
+		return
+	}
+	bot.logger.Info("handleUpload", msg.Chat.UserName, nil, "saved uploaded file %s (%d bytes)", fileName, len(content))
+	reply = fmt.Sprintf("saved %s (%d bytes)", fileName, len(content))
+}
+
+// SendFile sends the file content to the chat, as a photo if the file name looks like a picture, or as a document otherwise.
+func (bot *Daemon) SendFile(chatID int64, fileName string, content []byte) error {
+	method, field := "sendDocument", "document"
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".jpg", ".jpeg", ".png":
+		method, field = "sendPhoto", "photo"
+	}
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	if err := writer.WriteField("chat_id", strconv.FormatInt(chatID, 10)); err != nil {
+		return err
+	}
+	part, err := writer.CreateFormFile(field, filepath.Base(fileName))
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(content); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	resp, err := inet.DoHTTP(inet.HTTPRequest{
+		Method:      http.MethodPost,
+		TimeoutSec:  APICallTimeoutSec * 2,
+		ContentType: writer.FormDataContentType(),
+		Body:        bytes.NewReader(body.Bytes()),
+	}, "https://api.telegram.org/bot%s/"+method, bot.AuthorizationToken)
+	if err != nil || resp.StatusCode/200 != 1 {
+		return bot.redactToken(fmt.Errorf("telegrambot.SendFile: failed to send %s to %d - HTTP %d - %v %s", fileName, chatID, resp.StatusCode, err, string(resp.Body)))
+	}
+	return nil
+}
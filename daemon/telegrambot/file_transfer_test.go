@@ -0,0 +1,70 @@
+package telegrambot
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+func TestDaemon_FileTransfer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-TestDaemon_FileTransfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	bot := Daemon{
+		AuthorizationToken: "dummy",
+		UploadDirectory:    dir,
+		MaxFileSizeMB:      100,
+		Processor:          toolbox.GetTestCommandProcessor(),
+	}
+	if err := bot.Initialise(); err != nil || bot.MaxFileSizeMB != MaxFileSizeMBLimit {
+		t.Fatal(err, bot.MaxFileSizeMB)
+	}
+	// Uploads must carry password PIN
+	for caption, saveAs := range map[string]string{
+		"":                                     "-",
+		"wrong pin":                            "-",
+		"verysecre":                            "-",
+		toolbox.TestCommandProcessorPIN:        "",
+		toolbox.TestCommandProcessorPIN + " a": "a",
+	} {
+		name, authorised := bot.checkUploadCaption(caption)
+		if saveAs == "-" && authorised || saveAs != "-" && (!authorised || name != saveAs) {
+			t.Fatal(caption, name, authorised)
+		}
+	}
+	// Uploaded file names must not escape the upload directory or overwrite existing files
+	for input, expected := range map[string]string{
+		"a.txt":          "a.txt",
+		"../../etc/x":    "x",
+		"..":             "upload",
+		"":               "upload",
+		"/":              "upload",
+		" dir/photo.jpg": "photo.jpg",
+	} {
+		if name := bot.getUploadFileName(input); name != expected {
+			t.Fatal(input, name)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if name := bot.getUploadFileName("a.txt"); name == "a.txt" || !strings.HasSuffix(name, "-a.txt") {
+		t.Fatal(name)
+	}
+	// Errors of API calls must not reveal the authorization token
+	apiErr := errors.New("Post \"https://api.telegram.org/botdummy/sendDocument\": timeout")
+	if err := bot.redactToken(apiErr); err == nil || strings.Contains(err.Error(), "dummy") || !strings.Contains(err.Error(), lalog.RedactedLabel) {
+		t.Fatal(err)
+	}
+	if err := bot.redactToken(nil); err != nil {
+		t.Fatal(err)
+	}
+}
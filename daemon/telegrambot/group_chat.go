@@ -0,0 +1,179 @@
+package telegrambot
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/inet"
+)
+
+// ChatAdminsCacheSec is the number of seconds to remember the administrators of a group chat before asking telegram again.
+const ChatAdminsCacheSec = 600
+
+/*
+GroupChat is a telegram group chat that the bot operates in. In a group chat, the bot only processes the messages that
+begin with a mention of the bot (e.g. "@my_laitos_bot PIN.s date"), and the app commands still require password PIN.
+*/
+type GroupChat struct {
+	ID int64 `json:"ID"` // ID is the numeric chat ID of the group chat, it is a negative number.
+	/*
+		UserIDs are the numeric telegram user IDs allowed to run app commands in the group chat. All members are allowed
+		if it is empty. Unlike user names, the IDs cannot be changed or taken over by another user.
+	*/
+	UserIDs []int64 `json:"UserIDs"`
+	// AdminOnly allows only the administrators of the group chat to run app commands.
+	AdminOnly bool `json:"AdminOnly"`
+}
+
+// IsUserAllowed returns true only if the user is among the allowed users of the group chat.
+func (chat GroupChat) IsUserAllowed(userID int64) bool {
+	if len(chat.UserIDs) == 0 {
+		return true
+	}
+	for _, allowed := range chat.UserIDs {
+		if allowed == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// Telegram API entity - getMe response
+type APIGetMe struct {
+	OK   bool    `json:"ok"`
+	User APIUser `json:"result"`
+}
+
+// Telegram API entity - getChatAdministrators response
+type APIChatAdministrators struct {
+	OK      bool `json:"ok"`
+	Members []struct {
+		User   APIUser `json:"user"`
+		Status string  `json:"status"`
+	} `json:"result"`
+}
+
+// chatAdmins are the user IDs of group chat administrators, retrieved at the time of lastUpdate.
+type chatAdmins struct {
+	userIDs    map[int64]bool
+	lastUpdate time.Time
+}
+
+// chatAdminsCache remembers the administrators of group chats.
+type chatAdminsCache struct {
+	admins map[int64]chatAdmins
+	mutex  sync.Mutex
+}
+
+// getChatAdmins retrieves the user IDs of the administrators of the group chat.
+func (bot *Daemon) getChatAdmins(chatID int64) (map[int64]bool, error) {
+	resp, err := inet.DoHTTP(inet.HTTPRequest{TimeoutSec: APICallTimeoutSec},
+		"https://api.telegram.org/bot%s/getChatAdministrators?chat_id=%s", bot.AuthorizationToken, chatID)
+	if err == nil {
+		err = resp.Non2xxToError()
+	}
+	if err != nil {
+		return nil, bot.redactToken(err)
+	}
+	var admins APIChatAdministrators
+	if err := json.Unmarshal(resp.Body, &admins); err != nil {
+		return nil, err
+	}
+	if !admins.OK {
+		return nil, fmt.Errorf("API response is not OK - %s", string(resp.Body))
+	}
+	ret := make(map[int64]bool)
+	for _, member := range admins.Members {
+		ret[member.User.ID] = true
+	}
+	return ret, nil
+}
+
+// isChatAdmin returns true only if the user is an administrator of the group chat.
+func (bot *Daemon) isChatAdmin(chatID, userID int64) bool {
+	bot.adminsCache.mutex.Lock()
+	defer bot.adminsCache.mutex.Unlock()
+	if bot.adminsCache.admins == nil {
+		bot.adminsCache.admins = make(map[int64]chatAdmins)
+	}
+	cached, exists := bot.adminsCache.admins[chatID]
+	if !exists || time.Since(cached.lastUpdate) > ChatAdminsCacheSec*time.Second {
+		userIDs, err := bot.getChatAdmins(chatID)
+		if err != nil {
+			bot.logger.Warning("isChatAdmin", "", err, "failed to retrieve administrators of chat %d", chatID)
+			// Continue to use the cached administrators if they are available
+			return cached.userIDs[userID]
+		}
+		cached = chatAdmins{userIDs: userIDs, lastUpdate: time.Now()}
+		bot.adminsCache.admins[chatID] = cached
+	}
+	return cached.userIDs[userID]
+}
+
+// getGroupChat returns the configuration of the group chat.
+func (bot *Daemon) getGroupChat(chatID int64) (GroupChat, bool) {
+	for _, chat := range bot.GroupChats {
+		if chat.ID == chatID {
+			return chat, true
+		}
+	}
+	return GroupChat{}, false
+}
+
+// removeMention returns the text with the leading mention of this bot removed, and true only if the mention is found.
+func (bot *Daemon) removeMention(text string) (string, bool) {
+	if bot.userName == "" {
+		return "", false
+	}
+	text = strings.TrimSpace(text)
+	mention := "@" + bot.userName
+	if len(text) < len(mention) || !strings.EqualFold(text[:len(mention)], mention) {
+		return "", false
+	}
+	rest := text[len(mention):]
+	// The mention must not be a prefix of another user name
+	if rest != "" && !strings.ContainsAny(rest[:1], " \t\r\n:,") {
+		return "", false
+	}
+	return strings.TrimLeft(rest, " \t\r\n:,"), true
+}
+
+/*
+isGroupUserAllowed returns true only if the group chat is configured, and the user is allowed to use the bot in the
+group chat.
+*/
+func (bot *Daemon) isGroupUserAllowed(chatID int64, user APIUser) bool {
+	chat, exists := bot.getGroupChat(chatID)
+	if !exists {
+		bot.logger.Warning("isGroupUserAllowed", user.UserName, nil, "ignore group chat %d that is not configured", chatID)
+		return false
+	}
+	if !chat.IsUserAllowed(user.ID) {
+		bot.logger.Warning("isGroupUserAllowed", user.UserName, nil, "user ID %d is not allowed in group chat %d", user.ID, chatID)
+		return false
+	}
+	if chat.AdminOnly && !bot.isChatAdmin(chatID, user.ID) {
+		bot.logger.Warning("isGroupUserAllowed", user.UserName, nil, "user is not an administrator of group chat %d", chatID)
+		return false
+	}
+	return true
+}
+
+// removeGroupMention removes the leading mention of this bot from the text or caption of the group chat message.
+func (bot *Daemon) removeGroupMention(msg APIMessage) (APIMessage, bool) {
+	var mentioned bool
+	if msg.Document.FileID != "" || len(msg.Photo) > 0 {
+		msg.Caption, mentioned = bot.removeMention(msg.Caption)
+	} else {
+		msg.Text, mentioned = bot.removeMention(msg.Text)
+	}
+	return msg, mentioned
+}
+
+// IsGroupChatType returns true only if the chat type is a group or supergroup.
+func IsGroupChatType(chatType string) bool {
+	return chatType == ChatTypeGroup || chatType == ChatTypeSupergroup
+}
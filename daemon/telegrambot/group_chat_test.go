@@ -0,0 +1,67 @@
+package telegrambot
+
+import (
+	"testing"
+	"time"
+)
+
+func TestGroupChat_IsUserAllowed(t *testing.T) {
+	if !(GroupChat{}).IsUserAllowed(123) {
+		t.Fatal("empty user list should allow everyone")
+	}
+	chat := GroupChat{UserIDs: []int64{1, 2}}
+	if !chat.IsUserAllowed(1) || !chat.IsUserAllowed(2) || chat.IsUserAllowed(3) || chat.IsUserAllowed(0) {
+		t.Fatal("wrong user authorisation")
+	}
+}
+
+func TestRemoveGroupMention(t *testing.T) {
+	bot := Daemon{}
+	if _, mentioned := bot.removeMention("@ whatever"); mentioned {
+		t.Fatal("should not match without bot user name")
+	}
+	bot.userName = "laitos_bot"
+	for text, expected := range map[string]string{
+		"@laitos_bot PIN.s date":   "PIN.s date",
+		" @LAITOS_BOT: PIN.s date": "PIN.s date",
+		"@laitos_bot":              "",
+	} {
+		if stripped, mentioned := bot.removeMention(text); !mentioned || stripped != expected {
+			t.Fatalf("%q: got %q %v", text, stripped, mentioned)
+		}
+	}
+	for _, text := range []string{"", "hello", "PIN.s date @laitos_bot", "@laitos_bot2 PIN.s date", "@laitos"} {
+		if _, mentioned := bot.removeMention(text); mentioned {
+			t.Fatalf("%q should not mention the bot", text)
+		}
+	}
+	msg, mentioned := bot.removeGroupMention(APIMessage{Caption: "@laitos_bot PIN a.txt", Photo: []APIPhotoSize{{FileID: "a"}}})
+	if !mentioned || msg.Caption != "PIN a.txt" {
+		t.Fatal(msg, mentioned)
+	}
+	if !IsGroupChatType(ChatTypeGroup) || !IsGroupChatType(ChatTypeSupergroup) || IsGroupChatType(ChatTypePrivate) || IsGroupChatType("channel") {
+		t.Fatal("wrong chat type")
+	}
+}
+
+func TestIsGroupUserAllowed(t *testing.T) {
+	bot := Daemon{GroupChats: []GroupChat{
+		{ID: -1, UserIDs: []int64{1, 2}},
+		{ID: -2, AdminOnly: true},
+	}}
+	// Avoid making API calls by presenting the administrators in cache
+	bot.adminsCache.admins = map[int64]chatAdmins{-2: {userIDs: map[int64]bool{2: true}, lastUpdate: time.Now()}}
+	if bot.isGroupUserAllowed(-3, APIUser{ID: 1, UserName: "alice"}) {
+		t.Fatal("should not allow unknown group")
+	}
+	if !bot.isGroupUserAllowed(-1, APIUser{ID: 1, UserName: "alice"}) || bot.isGroupUserAllowed(-1, APIUser{ID: 3, UserName: "eve"}) {
+		t.Fatal("wrong user authorisation")
+	}
+	// A user who takes the user name of an allowed user is not allowed
+	if bot.isGroupUserAllowed(-1, APIUser{ID: 3, UserName: "alice"}) {
+		t.Fatal("wrong user authorisation")
+	}
+	if !bot.isGroupUserAllowed(-2, APIUser{ID: 2, UserName: "bob"}) || bot.isGroupUserAllowed(-2, APIUser{ID: 1, UserName: "alice"}) {
+		t.Fatal("wrong admin authorisation")
+	}
+}
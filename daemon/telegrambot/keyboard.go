@@ -0,0 +1,248 @@
+package telegrambot
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+const (
+	// PendingActionExpirySec is the number of seconds a confirmation or choice button remains usable after it is presented.
+	PendingActionExpirySec = 300
+	// MaxChoiceButtons is the maximum number of choice buttons presented along with a command result.
+	MaxChoiceButtons = 10
+	// MaxButtonLabelLength is the maximum number of characters in the label of a button.
+	MaxButtonLabelLength = 40
+
+	CallbackRun    = "run"    // CallbackRun is the callback data prefix of a button that runs the pending command.
+	CallbackCancel = "cancel" // CallbackCancel is the callback data prefix of a button that discards the pending command.
+)
+
+// Telegram API entity - a button of inline keyboard
+type APIInlineButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data"`
+}
+
+// Telegram API entity - inline keyboard attached to a message
+type APIInlineKeyboard struct {
+	Buttons [][]APIInlineButton `json:"inline_keyboard"`
+}
+
+// Telegram API entity - callback query made by pressing an inline keyboard button
+type APICallbackQuery struct {
+	ID      string     `json:"id"`
+	From    APIUser    `json:"from"`
+	Message APIMessage `json:"message"`
+	Data    string     `json:"data"`
+}
+
+// pendingAction is a command that runs when the user presses its button.
+type pendingAction struct {
+	chatID  int64
+	userID  int64  // userID is the user who may press the button, other members of a group chat may not.
+	command string // command is the complete command text including password PIN
+	expiry  time.Time
+}
+
+// pendingActions keeps track of the commands awaiting for user to press their buttons.
+type pendingActions struct {
+	actions map[string]pendingAction
+	mutex   sync.Mutex
+}
+
+// add remembers the command of the user and returns the ID to be used in its button's callback data.
+func (pending *pendingActions) add(chatID, userID int64, command string) string {
+	pending.mutex.Lock()
+	defer pending.mutex.Unlock()
+	if pending.actions == nil {
+		pending.actions = make(map[string]pendingAction)
+	}
+	// Forget about the expired actions
+	now := time.Now()
+	for id, action := range pending.actions {
+		if now.After(action.expiry) {
+			delete(pending.actions, id)
+		}
+	}
+	idBytes := make([]byte, 8)
+	_, _ = rand.Read(idBytes)
+	id := hex.EncodeToString(idBytes)
+	pending.actions[id] = pendingAction{chatID: chatID, userID: userID, command: command, expiry: now.Add(PendingActionExpirySec * time.Second)}
+	return id
+}
+
+/*
+take removes and returns the pending command of the ID, only if it belongs to the chat and the user, and has not
+expired.
+*/
+func (pending *pendingActions) take(chatID, userID int64, id string) (string, bool) {
+	pending.mutex.Lock()
+	defer pending.mutex.Unlock()
+	action, exists := pending.actions[id]
+	if !exists || action.chatID != chatID || action.userID != userID {
+		return "", false
+	}
+	delete(pending.actions, id)
+	if time.Now().After(action.expiry) {
+		return "", false
+	}
+	return action.command, true
+}
+
+// getButtonLabel shortens the text to make it fit into a button.
+func getButtonLabel(text string) string {
+	text = strings.TrimSpace(text)
+	if runes := []rune(text); len(runes) > MaxButtonLabelLength {
+		return string(runes[:MaxButtonLabelLength-3]) + "..."
+	}
+	return text
+}
+
+/*
+getAppCommand returns the app command (excluding password PIN and PLT prefix) from the message text by walking it through
+command filters. If the message text is not authorised, the function returns an empty string.
+*/
+func (bot *Daemon) getAppCommand(text string) string {
+	cmd := toolbox.Command{DaemonName: "telegrambot", TimeoutSec: CommandTimeoutSec, Content: text}
+	var err error
+	for _, filter := range bot.Processor.CommandFilters {
+		if cmd, err = filter.Transform(cmd); err != nil {
+			return ""
+		}
+	}
+	content := strings.TrimSpace(cmd.Content)
+	if strings.HasPrefix(content, toolbox.PrefixCommandPLT) {
+		if params := toolbox.RegexCommandWithPLT.FindStringSubmatch(strings.TrimPrefix(content, toolbox.PrefixCommandPLT)); len(params) == 5 {
+			content = strings.TrimSpace(params[4])
+		}
+	}
+	return content
+}
+
+// needsConfirmation returns the app command and true if the message text invokes an app that requires confirmation.
+func (bot *Daemon) needsConfirmation(text string) (string, bool) {
+	if len(bot.ConfirmAppTriggers) == 0 {
+		return "", false
+	}
+	appCmd := bot.getAppCommand(text)
+	if appCmd == "" {
+		return "", false
+	}
+	for _, trigger := range bot.ConfirmAppTriggers {
+		if strings.HasPrefix(appCmd, trigger) {
+			return appCmd, true
+		}
+	}
+	return "", false
+}
+
+// getPIN returns the password PIN of the command processor.
+func (bot *Daemon) getPIN() string {
+	for _, filter := range bot.Processor.CommandFilters {
+		if pinFilter, ok := filter.(*toolbox.PINAndShortcuts); ok {
+			return pinFilter.PIN
+		}
+	}
+	return ""
+}
+
+/*
+getChoicesKeyboard returns an inline keyboard that offers the result's follow-up choices as buttons, one per row. Only
+the user who ran the command may press the buttons.
+*/
+func (bot *Daemon) getChoicesKeyboard(chatID, userID int64, choices []toolbox.Choice) (ret APIInlineKeyboard) {
+	pin := bot.getPIN()
+	for i, choice := range choices {
+		if i == MaxChoiceButtons {
+			break
+		}
+		id := bot.pending.add(chatID, userID, pin+choice.Command)
+		ret.Buttons = append(ret.Buttons, []APIInlineButton{{Text: getButtonLabel(choice.Label), CallbackData: CallbackRun + ":" + id}})
+	}
+	return
+}
+
+// getConfirmationKeyboard returns an inline keyboard that lets the user who sent the command run or discard it.
+func (bot *Daemon) getConfirmationKeyboard(chatID, userID int64, command string) APIInlineKeyboard {
+	id := bot.pending.add(chatID, userID, command)
+	return APIInlineKeyboard{Buttons: [][]APIInlineButton{{
+		{Text: "Run", CallbackData: CallbackRun + ":" + id},
+		{Text: "Cancel", CallbackData: CallbackCancel + ":" + id},
+	}}}
+}
+
+// ReplyWithKeyboard sends a text reply along with an inline keyboard to the telegram chat.
+func (bot *Daemon) ReplyWithKeyboard(chatID int64, text string, keyboard APIInlineKeyboard) error {
+	keyboardJSON, err := json.Marshal(keyboard)
+	if err != nil {
+		return err
+	}
+	resp, err := inet.DoHTTP(inet.HTTPRequest{
+		Method:     http.MethodPost,
+		TimeoutSec: APICallTimeoutSec,
+		Body: strings.NewReader(url.Values{
+			"chat_id":      []string{strconv.FormatInt(chatID, 10)},
+			"text":         []string{text},
+			"reply_markup": []string{string(keyboardJSON)},
+		}.Encode()),
+	}, "https://api.telegram.org/bot%s/sendMessage", bot.AuthorizationToken)
+	if err != nil || resp.StatusCode/200 != 1 {
+		return bot.redactToken(fmt.Errorf("telegrambot.ReplyWithKeyboard: failed to reply to %d - HTTP %d - %v %s", chatID, resp.StatusCode, err, string(resp.Body)))
+	}
+	return nil
+}
+
+// answerCallback acknowledges the button press, so that telegram client stops showing progress on the button.
+func (bot *Daemon) answerCallback(queryID, text string) error {
+	resp, err := inet.DoHTTP(inet.HTTPRequest{
+		Method:     http.MethodPost,
+		TimeoutSec: APICallTimeoutSec,
+		Body: strings.NewReader(url.Values{
+			"callback_query_id": []string{queryID},
+			"text":              []string{text},
+		}.Encode()),
+	}, "https://api.telegram.org/bot%s/answerCallbackQuery", bot.AuthorizationToken)
+	if err != nil || resp.StatusCode/200 != 1 {
+		return bot.redactToken(fmt.Errorf("telegrambot.answerCallback: failed to answer %s - HTTP %d - %v %s", queryID, resp.StatusCode, err, string(resp.Body)))
+	}
+	return nil
+}
+
+// handleCallback runs or discards the pending command of the pressed button.
+func (bot *Daemon) handleCallback(query APICallbackQuery, beginTimeNano int64) {
+	chatID := query.Message.Chat.ID
+	var command string
+	var found bool
+	answer := "expired"
+	colon := strings.IndexRune(query.Data, ':')
+	if colon != -1 {
+		command, found = bot.pending.take(chatID, query.From.ID, query.Data[colon+1:])
+	}
+	if found {
+		switch query.Data[:colon] {
+		case CallbackRun:
+			answer = "running"
+		case CallbackCancel:
+			answer = "cancelled"
+			found = false
+		}
+	}
+	if err := bot.answerCallback(query.ID, answer); err != nil {
+		bot.logger.Warning("handleCallback", query.From.UserName, err, "failed to answer callback")
+	}
+	if !found {
+		return
+	}
+	bot.runCommand(chatID, query.From.ID, query.From.UserName, command, beginTimeNano)
+}
@@ -0,0 +1,87 @@
+package telegrambot
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/toolbox"
+)
+
+func TestPendingActions(t *testing.T) {
+	pending := pendingActions{}
+	id := pending.add(1, 10, "command 1")
+	if _, found := pending.take(2, 10, id); found {
+		t.Fatal("must not take action of another chat")
+	}
+	if _, found := pending.take(1, 20, id); found {
+		t.Fatal("must not take action of another user")
+	}
+	if cmd, found := pending.take(1, 10, id); !found || cmd != "command 1" {
+		t.Fatal(cmd, found)
+	}
+	if _, found := pending.take(1, 10, id); found {
+		t.Fatal("must not take action twice")
+	}
+	// Expired actions are not taken, and are forgotten when new actions are added
+	id = pending.add(1, 10, "command 2")
+	action := pending.actions[id]
+	action.expiry = time.Now().Add(-time.Second)
+	pending.actions[id] = action
+	if _, found := pending.take(1, 10, id); found {
+		t.Fatal("must not take expired action")
+	}
+	id = pending.add(1, 10, "command 3")
+	action = pending.actions[id]
+	action.expiry = time.Now().Add(-time.Second)
+	pending.actions[id] = action
+	pending.add(1, 10, "command 4")
+	if len(pending.actions) != 1 {
+		t.Fatal(pending.actions)
+	}
+}
+
+func TestDaemon_Keyboards(t *testing.T) {
+	bot := Daemon{
+		AuthorizationToken: "dummy",
+		ConfirmAppTriggers: []string{".s"},
+		Processor:          toolbox.GetTestCommandProcessor(),
+	}
+	if err := bot.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	for text, confirm := range map[string]bool{
+		toolbox.TestCommandProcessorPIN + ".s echo hi":            true,
+		toolbox.TestCommandProcessorPIN + " .plt 0 10 20 .s date": true,
+		toolbox.TestCommandProcessorPIN + ".e info":               false,
+		"wrongpin.s echo hi":                                      false,
+	} {
+		if appCmd, needed := bot.needsConfirmation(text); needed != confirm || confirm && !strings.HasPrefix(appCmd, ".s ") {
+			t.Fatal(text, appCmd, needed)
+		}
+	}
+
+	keyboard := bot.getConfirmationKeyboard(1, 10, toolbox.TestCommandProcessorPIN+".s echo hi")
+	if len(keyboard.Buttons) != 1 || len(keyboard.Buttons[0]) != 2 ||
+		!strings.HasPrefix(keyboard.Buttons[0][0].CallbackData, CallbackRun+":") ||
+		!strings.HasPrefix(keyboard.Buttons[0][1].CallbackData, CallbackCancel+":") {
+		t.Fatalf("%+v", keyboard)
+	}
+	if keyboardJSON, err := json.Marshal(keyboard); err != nil || !strings.Contains(string(keyboardJSON), `{"inline_keyboard":[[{"text":"Run","callback_data":"run:`) {
+		t.Fatal(string(keyboardJSON), err)
+	}
+
+	choices := make([]toolbox.Choice, 0)
+	for i := 0; i < MaxChoiceButtons+2; i++ {
+		choices = append(choices, toolbox.Choice{Label: strings.Repeat("a", 50), Command: ".lr box 1"})
+	}
+	keyboard = bot.getChoicesKeyboard(1, 10, choices)
+	if len(keyboard.Buttons) != MaxChoiceButtons || len(keyboard.Buttons[0]) != 1 || len([]rune(keyboard.Buttons[0][0].Text)) != MaxButtonLabelLength {
+		t.Fatalf("%+v", keyboard)
+	}
+	// Choices run with the password PIN
+	if cmd, found := bot.pending.take(1, 10, strings.TrimPrefix(keyboard.Buttons[0][0].CallbackData, CallbackRun+":")); !found || cmd != toolbox.TestCommandProcessorPIN+".lr box 1" {
+		t.Fatal(cmd, found)
+	}
+}
@@ -0,0 +1,511 @@
+package tftpd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/testingstub"
+)
+
+// transferStats times the TFTP transfers.
+var transferStats = misc.GetStats("tftpd.Transfers")
+
+// TFTP packet opcodes defined in RFC 1350 and RFC 2347.
+const (
+	OpReadRequest  = 1
+	OpWriteRequest = 2
+	OpData         = 3
+	OpAck          = 4
+	OpError        = 5
+	OpOptionAck    = 6
+)
+
+// TFTP error codes defined in RFC 1350 and RFC 2347.
+const (
+	ErrCodeNotDefined      = 0
+	ErrCodeFileNotFound    = 1
+	ErrCodeAccessViolation = 2
+	ErrCodeIllegalOp       = 4
+	ErrCodeUnknownTID      = 5
+	ErrCodeBadOption       = 8
+)
+
+const (
+	DefaultBlockSize  = 512   // DefaultBlockSize is the size of each data block unless the client negotiates the "blksize" option.
+	MinBlockSize      = 8     // MinBlockSize is the smallest block size acceptable in "blksize" option (RFC 2348).
+	MaxBlockSize      = 65464 // MaxBlockSize is the largest block size acceptable in "blksize" option (RFC 2348).
+	DefaultTimeoutSec = 3     // DefaultTimeoutSec is the number of seconds to wait for an acknowledgement before retransmitting a block.
+	MaxTimeoutSec     = 255   // MaxTimeoutSec is the largest timeout acceptable in "timeout" option (RFC 2349).
+	MaxRetransmits    = 5     // MaxRetransmits is the number of times a block is retransmitted before the transfer is abandoned.
+)
+
+// Daemon implements a read-only TFTP server that serves the files of a directory, e.g. to PXE-boot lab machines.
+type Daemon struct {
+	Address   string `json:"Address"`   // Address to listen on, e.g. 0.0.0.0 to listen on all network interfaces.
+	Port      int    `json:"Port"`      // Port to listen on, by default TFTP uses port 69.
+	Directory string `json:"Directory"` // Directory contains the files to serve, clients may not read files outside of it.
+	// AllowClientIPPrefixes are the string prefixes in IPv4 and IPv6 client addresses that are allowed to read files.
+	AllowClientIPPrefixes []string `json:"AllowClientIPPrefixes"`
+	PerIPLimit            int      `json:"PerIPLimit"`  // PerIPLimit is approximately how many transfers are allowed to start from an IP per second.
+	GlobalLimit           int      `json:"GlobalLimit"` // GlobalLimit is the maximum number of transfers allowed to start from all clients combined per second, 0 means unlimited.
+
+	udpServer *common.UDPServer
+}
+
+// Initialise validates configuration and initialises internal states.
+func (daemon *Daemon) Initialise() error {
+	if daemon.Address == "" {
+		daemon.Address = "0.0.0.0"
+	}
+	if daemon.Port < 1 {
+		daemon.Port = 69
+	}
+	if daemon.PerIPLimit < 1 {
+		// A booting machine usually reads a handful of files - boot loader, its configuration, kernel, and initrd.
+		daemon.PerIPLimit = 10
+	}
+	if daemon.Directory == "" {
+		return errors.New("tftpd.Initialise: Directory must be specified")
+	}
+	dir, err := filepath.Abs(daemon.Directory)
+	if err == nil {
+		dir, err = filepath.EvalSymlinks(dir)
+	}
+	if err != nil {
+		return fmt.Errorf("tftpd.Initialise: failed to locate Directory \"%s\" - %v", daemon.Directory, err)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return fmt.Errorf("tftpd.Initialise: Directory \"%s\" must be a directory", daemon.Directory)
+	}
+	daemon.Directory = dir
+	if daemon.AllowClientIPPrefixes == nil {
+		daemon.AllowClientIPPrefixes = []string{}
+	}
+	for _, prefix := range daemon.AllowClientIPPrefixes {
+		if prefix == "" {
+			return errors.New("tftpd.Initialise: IP address prefixes that are allowed to read files may not contain empty string")
+		}
+	}
+	daemon.udpServer = common.NewUDPServer(daemon.Address, daemon.Port, "tftpd", daemon, daemon.PerIPLimit, daemon.GlobalLimit)
+	return nil
+}
+
+// StartAndBlock starts UDP listener to serve TFTP clients. You may call this function only after having called Initialise().
+func (daemon *Daemon) StartAndBlock() error {
+	return daemon.udpServer.StartAndBlock()
+}
+
+// Stop closes server listener so that it ceases to accept new transfers. Ongoing transfers will continue nonetheless.
+func (daemon *Daemon) Stop() {
+	daemon.udpServer.Stop()
+}
+
+// GetUDPStatsCollector returns the stats collector that counts and times UDP conversations.
+func (daemon *Daemon) GetUDPStatsCollector() *misc.Stats {
+	return transferStats
+}
+
+// checkAllowClientIP returns true only if the input IP address is among the allowed addresses.
+func (daemon *Daemon) checkAllowClientIP(clientIP string) bool {
+	// Always allow localhost to read files
+	if strings.HasPrefix(clientIP, "127.") || clientIP == "::1" {
+		return true
+	}
+	for _, prefix := range daemon.AllowClientIPPrefixes {
+		if strings.HasPrefix(clientIP, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+resolvePath returns the absolute path of the requested file name. It returns an error if the file lies outside of the
+directory, including via symbolic links, or if it is not a regular file.
+*/
+func (daemon *Daemon) resolvePath(fileName string) (string, error) {
+	// PXE clients occasionally use back slashes in file names
+	fileName = strings.Replace(fileName, "\\", "/", -1)
+	filePath, err := filepath.EvalSymlinks(filepath.Join(daemon.Directory, filepath.Clean("/"+fileName)))
+	if err != nil {
+		return "", err
+	}
+	if !strings.HasPrefix(filePath, daemon.Directory+string(os.PathSeparator)) {
+		return "", os.ErrPermission
+	}
+	if info, err := os.Stat(filePath); err != nil {
+		return "", err
+	} else if !info.Mode().IsRegular() {
+		return "", os.ErrNotExist
+	}
+	return filePath, nil
+}
+
+// readRequest is a parsed read request.
+type readRequest struct {
+	FileName string
+	Mode     string
+	Options  map[string]string // Options are the lower case names and values of the options requested by the client (RFC 2347).
+}
+
+// parseRequest parses a read or write request packet, it returns the opcode and the parsed request.
+func parseRequest(packet []byte) (opcode uint16, req readRequest, err error) {
+	if len(packet) < 4 {
+		err = errors.New("packet is too short")
+		return
+	}
+	opcode = binary.BigEndian.Uint16(packet)
+	if opcode != OpReadRequest && opcode != OpWriteRequest {
+		return
+	}
+	// The request comprises null-terminated file name, mode, and optionally pairs of option name and value
+	fields := strings.Split(string(packet[2:]), "\x00")
+	if len(fields) < 3 || fields[len(fields)-1] != "" || fields[0] == "" {
+		err = errors.New("malformed request")
+		return
+	}
+	fields = fields[:len(fields)-1]
+	req.FileName = fields[0]
+	req.Mode = strings.ToLower(fields[1])
+	req.Options = make(map[string]string)
+	for i := 2; i+1 < len(fields); i += 2 {
+		req.Options[strings.ToLower(fields[i])] = fields[i+1]
+	}
+	return
+}
+
+// makeErrorPacket returns an error packet of the code and message.
+func makeErrorPacket(code uint16, message string) []byte {
+	packet := make([]byte, 4, 5+len(message))
+	binary.BigEndian.PutUint16(packet, OpError)
+	binary.BigEndian.PutUint16(packet[2:], code)
+	packet = append(packet, message...)
+	return append(packet, 0)
+}
+
+// HandleUDPClient validates a read request and then transfers the file to the client.
+func (daemon *Daemon) HandleUDPClient(logger lalog.Logger, clientIP string, client *net.UDPAddr, packet []byte, srv *net.UDPConn) {
+	// The UDP server reuses its packet buffer for the next client
+	packet = append([]byte{}, packet...)
+	if !daemon.checkAllowClientIP(clientIP) {
+		logger.Warning("HandleUDPClient", clientIP, nil, "client IP is not allowed to read files")
+		return
+	}
+	opcode, req, err := parseRequest(packet)
+	if err != nil {
+		logger.Info("HandleUDPClient", clientIP, err, "failed to parse request")
+		return
+	}
+	switch opcode {
+	case OpReadRequest:
+	case OpWriteRequest:
+		logger.Info("HandleUDPClient", clientIP, nil, "rejected write request of \"%s\"", req.FileName)
+		_, _ = srv.WriteTo(makeErrorPacket(ErrCodeAccessViolation, "the server is read-only"), client)
+		return
+	default:
+		// Stray packets such as acknowledgements of an abandoned transfer do not deserve a response
+		logger.Info("HandleUDPClient", clientIP, nil, "ignored opcode %d", opcode)
+		return
+	}
+	if req.Mode != "octet" && req.Mode != "netascii" {
+		_, _ = srv.WriteTo(makeErrorPacket(ErrCodeIllegalOp, "only octet and netascii modes are supported"), client)
+		return
+	}
+	filePath, err := daemon.resolvePath(req.FileName)
+	if err != nil {
+		logger.Info("HandleUDPClient", clientIP, err, "failed to resolve file \"%s\"", req.FileName)
+		if os.IsPermission(err) {
+			_, _ = srv.WriteTo(makeErrorPacket(ErrCodeAccessViolation, "access violation"), client)
+		} else {
+			_, _ = srv.WriteTo(makeErrorPacket(ErrCodeFileNotFound, "file not found"), client)
+		}
+		return
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		logger.Warning("HandleUDPClient", clientIP, err, "failed to open file \"%s\"", filePath)
+		_, _ = srv.WriteTo(makeErrorPacket(ErrCodeFileNotFound, "file not found"), client)
+		return
+	}
+	defer file.Close()
+	// Each transfer uses a new UDP port, which identifies the transfer to the client (RFC 1350 TID).
+	listenIP := net.ParseIP(daemon.Address)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: listenIP})
+	if err != nil {
+		logger.Warning("HandleUDPClient", clientIP, err, "failed to listen on a transfer port")
+		return
+	}
+	defer conn.Close()
+	logger.Info("HandleUDPClient", clientIP, nil, "transferring \"%s\" with options %v", req.FileName, req.Options)
+	xfer := &transfer{
+		logger:     logger,
+		clientIP:   clientIP,
+		client:     client,
+		conn:       conn,
+		file:       file,
+		blockSize:  DefaultBlockSize,
+		timeoutSec: DefaultTimeoutSec,
+	}
+	if err := xfer.run(req.Options); err != nil {
+		logger.Warning("HandleUDPClient", clientIP, err, "failed to transfer \"%s\"", req.FileName)
+		return
+	}
+	logger.Info("HandleUDPClient", clientIP, nil, "completed transfer of \"%s\"", req.FileName)
+}
+
+// transfer sends a file to a client block by block, and waits for the acknowledgement of each block.
+type transfer struct {
+	logger     lalog.Logger
+	clientIP   string
+	client     *net.UDPAddr
+	conn       *net.UDPConn
+	file       *os.File
+	blockSize  int
+	timeoutSec int
+}
+
+// negotiate applies the supported options and returns the option acknowledgement packet, or nil if there is no option to acknowledge.
+func (xfer *transfer) negotiate(options map[string]string) []byte {
+	var oack bytes.Buffer
+	appendOption := func(name, value string) {
+		if oack.Len() == 0 {
+			oack.Write([]byte{0, OpOptionAck})
+		}
+		oack.WriteString(name)
+		oack.WriteByte(0)
+		oack.WriteString(value)
+		oack.WriteByte(0)
+	}
+	if val, err := strconv.Atoi(options["blksize"]); err == nil && val >= MinBlockSize {
+		if val > MaxBlockSize {
+			val = MaxBlockSize
+		}
+		// The block and its headers must fit in a single UDP packet of the transfer
+		if val > common.MaxUDPPacketSize-4 {
+			val = common.MaxUDPPacketSize - 4
+		}
+		xfer.blockSize = val
+		appendOption("blksize", strconv.Itoa(val))
+	}
+	if val, err := strconv.Atoi(options["timeout"]); err == nil && val >= 1 && val <= MaxTimeoutSec {
+		xfer.timeoutSec = val
+		appendOption("timeout", strconv.Itoa(val))
+	}
+	if _, requested := options["tsize"]; requested {
+		if info, err := xfer.file.Stat(); err == nil {
+			appendOption("tsize", strconv.FormatInt(info.Size(), 10))
+		}
+	}
+	if oack.Len() == 0 {
+		return nil
+	}
+	return oack.Bytes()
+}
+
+/*
+sendAndWait sends the packet and waits for the acknowledgement of the block number, the packet is retransmitted if the
+acknowledgement does not arrive in time.
+*/
+func (xfer *transfer) sendAndWait(packet []byte, blockNum uint16) error {
+	ackBuf := make([]byte, common.MaxUDPPacketSize)
+	for attempt := 0; attempt <= MaxRetransmits; attempt++ {
+		if misc.EmergencyLockDown {
+			return misc.ErrEmergencyLockDown
+		}
+		if _, err := xfer.conn.WriteToUDP(packet, xfer.client); err != nil {
+			return err
+		}
+		deadline := time.Now().Add(time.Duration(xfer.timeoutSec) * time.Second)
+		for {
+			if err := xfer.conn.SetReadDeadline(deadline); err != nil {
+				return err
+			}
+			n, from, err := xfer.conn.ReadFromUDP(ackBuf)
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				break
+			} else if err != nil {
+				return err
+			}
+			if !from.IP.Equal(xfer.client.IP) || from.Port != xfer.client.Port {
+				_, _ = xfer.conn.WriteToUDP(makeErrorPacket(ErrCodeUnknownTID, "unknown transfer ID"), from)
+				continue
+			}
+			if n < 4 {
+				continue
+			}
+			switch binary.BigEndian.Uint16(ackBuf) {
+			case OpAck:
+				if binary.BigEndian.Uint16(ackBuf[2:]) == blockNum {
+					return nil
+				}
+				// Duplicated acknowledgement of an earlier block is ignored to avoid the sorcerer's apprentice syndrome
+			case OpError:
+				return fmt.Errorf("client aborted the transfer with error code %d - %s", binary.BigEndian.Uint16(ackBuf[2:]), strings.TrimRight(string(ackBuf[4:n]), "\x00"))
+			}
+		}
+	}
+	return fmt.Errorf("block %d was not acknowledged after %d retransmits", blockNum, MaxRetransmits)
+}
+
+// run negotiates options and then sends the file content to the client.
+func (xfer *transfer) run(options map[string]string) error {
+	if oack := xfer.negotiate(options); oack != nil {
+		// The client acknowledges the negotiated options with block number 0
+		if err := xfer.sendAndWait(oack, 0); err != nil {
+			return err
+		}
+	}
+	data := make([]byte, 4+xfer.blockSize)
+	binary.BigEndian.PutUint16(data, OpData)
+	// Block number starts from 1 and rolls over to 0 for files larger than 65535 blocks
+	for blockNum := uint16(1); ; blockNum++ {
+		n, err := io.ReadFull(xfer.file, data[4:])
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			_, _ = xfer.conn.WriteToUDP(makeErrorPacket(ErrCodeNotDefined, "failed to read file"), xfer.client)
+			return err
+		}
+		binary.BigEndian.PutUint16(data[2:], blockNum)
+		if err := xfer.sendAndWait(data[:4+n], blockNum); err != nil {
+			return err
+		}
+		// A block shorter than the block size concludes the transfer
+		if n < xfer.blockSize {
+			return nil
+		}
+	}
+}
+
+// readFile is a minimal TFTP client that reads a file from the server, it is used by test cases.
+func readFile(server *net.UDPAddr, fileName string, options map[string]string) ([]byte, error) {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	var req bytes.Buffer
+	req.Write([]byte{0, OpReadRequest})
+	req.WriteString(fileName + "\x00octet\x00")
+	blockSize := DefaultBlockSize
+	for name, value := range options {
+		req.WriteString(name + "\x00" + value + "\x00")
+	}
+	if _, err := conn.WriteToUDP(req.Bytes(), server); err != nil {
+		return nil, err
+	}
+	var content bytes.Buffer
+	packet := make([]byte, common.MaxUDPPacketSize)
+	for expectBlock := uint16(1); ; {
+		if err := conn.SetReadDeadline(time.Now().Add(DefaultTimeoutSec * time.Second)); err != nil {
+			return nil, err
+		}
+		n, from, err := conn.ReadFromUDP(packet)
+		if err != nil {
+			return nil, err
+		} else if n < 4 {
+			return nil, errors.New("packet is too short")
+		}
+		ack := []byte{0, OpAck, 0, 0}
+		switch binary.BigEndian.Uint16(packet) {
+		case OpError:
+			return nil, fmt.Errorf("error code %d - %s", binary.BigEndian.Uint16(packet[2:]), strings.TrimRight(string(packet[4:n]), "\x00"))
+		case OpOptionAck:
+			fields := strings.Split(string(packet[2:n]), "\x00")
+			for i := 0; i+1 < len(fields); i += 2 {
+				if fields[i] == "blksize" {
+					blockSize, _ = strconv.Atoi(fields[i+1])
+				}
+			}
+		case OpData:
+			if binary.BigEndian.Uint16(packet[2:]) != expectBlock {
+				continue
+			}
+			content.Write(packet[4:n])
+			copy(ack[2:], packet[2:4])
+			expectBlock++
+		default:
+			return nil, fmt.Errorf("unexpected opcode %d", binary.BigEndian.Uint16(packet))
+		}
+		if _, err := conn.WriteToUDP(ack, from); err != nil {
+			return nil, err
+		}
+		if binary.BigEndian.Uint16(packet) == OpData && n-4 < blockSize {
+			return content.Bytes(), nil
+		}
+	}
+}
+
+// TestTFTPD conducts unit tests on TFTP daemon, see TestTFTPD for daemon setup.
+func TestTFTPD(daemon *Daemon, t testingstub.T) {
+	// Prepare a file that spans several blocks
+	content := bytes.Repeat([]byte("laitos tftp "), 200)
+	if err := ioutil.WriteFile(filepath.Join(daemon.Directory, "boot.img"), content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Server should start within two seconds
+	var stoppedNormally bool
+	go func() {
+		if err := daemon.StartAndBlock(); err != nil {
+			t.Fatal(err)
+		}
+		stoppedNormally = true
+	}()
+	time.Sleep(2 * time.Second)
+
+	serverAddr, err := net.ResolveUDPAddr("udp", "127.0.0.1:"+strconv.Itoa(daemon.Port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Read the file with default block size
+	if received, err := readFile(serverAddr, "boot.img", nil); err != nil || !bytes.Equal(received, content) {
+		t.Fatal(err, len(received))
+	}
+	// Read the file with negotiated block size and transfer size
+	if received, err := readFile(serverAddr, "/boot.img", map[string]string{"blksize": "1428", "tsize": "0"}); err != nil || !bytes.Equal(received, content) {
+		t.Fatal(err, len(received))
+	}
+	// Read a file that does not exist
+	if _, err := readFile(serverAddr, "does-not-exist", nil); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatal(err)
+	}
+	// Read a file outside of the directory
+	if _, err := readFile(serverAddr, "../../../../../../etc/passwd", nil); err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Fatal(err)
+	}
+	// Write a file to the read-only server
+	clientConn, err := net.DialUDP("udp", nil, serverAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+	if _, err := clientConn.Write([]byte("\x00\x02new.img\x00octet\x00")); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, 512)
+	_ = clientConn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	if n, err := clientConn.Read(resp); err != nil || n < 4 || binary.BigEndian.Uint16(resp) != OpError || binary.BigEndian.Uint16(resp[2:]) != ErrCodeAccessViolation {
+		t.Fatal(err, resp[:n])
+	}
+
+	// Daemon must stop in a second
+	daemon.Stop()
+	time.Sleep(1 * time.Second)
+	if !stoppedNormally {
+		t.Fatal("did not stop")
+	}
+	// Repeatedly stopping the daemon should have no negative consequence
+	daemon.Stop()
+	daemon.Stop()
+}
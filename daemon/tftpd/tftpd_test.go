@@ -0,0 +1,83 @@
+package tftpd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDaemon_resolvePath(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-TestDaemon_resolvePath")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "pxelinux.cfg"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "pxelinux.cfg", "default"), []byte("a"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/etc", filepath.Join(dir, "etc")); err != nil {
+		t.Fatal(err)
+	}
+	daemon := Daemon{Directory: dir}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"pxelinux.cfg/default", "/pxelinux.cfg/default", "pxelinux.cfg\\default", "../pxelinux.cfg/./default"} {
+		if filePath, err := daemon.resolvePath(name); err != nil || !strings.HasSuffix(filePath, "default") {
+			t.Fatal(name, filePath, err)
+		}
+	}
+	for _, name := range []string{"pxelinux.cfg", "does-not-exist", "../../../does-not-exist"} {
+		if _, err := daemon.resolvePath(name); !os.IsNotExist(err) {
+			t.Fatal(name, err)
+		}
+	}
+	// The symbolic link leads outside of the directory
+	for _, name := range []string{"etc/passwd", "../../../etc/passwd"} {
+		if _, err := daemon.resolvePath(name); !os.IsPermission(err) {
+			t.Fatal(name, err)
+		}
+	}
+}
+
+func TestDaemon(t *testing.T) {
+	daemon := Daemon{}
+	// Initialise with missing parameter
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "Directory") {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "laitos-TestTFTPD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	daemon.Directory = dir
+	daemon.AllowClientIPPrefixes = []string{""}
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "prefixes") {
+		t.Fatal(err)
+	}
+	// Initialise with default values
+	daemon.AllowClientIPPrefixes = nil
+	if err := daemon.Initialise(); err != nil || daemon.Address != "0.0.0.0" || daemon.Port != 69 || daemon.PerIPLimit != 10 {
+		t.Fatalf("%+v %+v\n", err, daemon)
+	}
+	if !daemon.checkAllowClientIP("127.0.0.1") || daemon.checkAllowClientIP("192.168.0.1") {
+		t.Fatal("wrong ACL")
+	}
+	// Avoid binding to default privileged port for this test case
+	daemon.Address = "127.0.0.1"
+	daemon.Port = 16969
+	daemon.AllowClientIPPrefixes = []string{"192.168."}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if !daemon.checkAllowClientIP("192.168.0.1") {
+		t.Fatal("wrong ACL")
+	}
+	TestTFTPD(&daemon, t)
+}
@@ -0,0 +1,315 @@
+/*
+tunnelagent maintains an outbound SSH connection to the SSH server daemon of another laitos instance, and exposes the
+selected local ports (e.g. SSH and web UI) on the tunnel ports of that instance. It lets a machine behind CGNAT or a
+restrictive firewall be reached via a public laitos node.
+*/
+package tunnelagent
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/sshd"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/testingstub"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// IOTimeoutSec is the timeout of connecting to the server and to local ports.
+	IOTimeoutSec = 30
+	// KeepAliveIntervalSec is the interval of keep-alive requests that detect a broken connection to the server.
+	KeepAliveIntervalSec = 30
+	// MinReconnectIntervalSec is the initial waiting time before reconnecting to the server, it doubles after each failure.
+	MinReconnectIntervalSec = 5
+	// MaxReconnectIntervalSec is the maximum waiting time before reconnecting to the server.
+	MaxReconnectIntervalSec = 5 * 60
+)
+
+// Forward exposes a local port on a tunnel port of the server.
+type Forward struct {
+	RemotePort   int    `json:"RemotePort"`   // RemotePort is the tunnel port the server listens on, it must be among the TunnelPorts of the server.
+	LocalAddress string `json:"LocalAddress"` // LocalAddress is the "host:port" of the local service, e.g. 127.0.0.1:22.
+}
+
+// Daemon maintains the connection to the server and relays the connections made to the tunnel ports.
+type Daemon struct {
+	ServerAddress string `json:"ServerAddress"` // ServerAddress is the "host:port" of the SSH server daemon of the public laitos node.
+	/*
+		HostKeyFingerprint is the SHA256 fingerprint of the host key of the server, e.g. "SHA256:abcd...", as shown by
+		"ssh-keygen -lf". The agent refuses to connect to a server that presents a different host key.
+	*/
+	HostKeyFingerprint string `json:"HostKeyFingerprint"`
+	/*
+		PrivateKeyPath is the path to the private key of the agent in PEM format. If the file does not exist yet, a new
+		ed25519 key is generated and saved to the path. Its public key goes into TunnelAgentKeys of the server.
+	*/
+	PrivateKeyPath string    `json:"PrivateKeyPath"`
+	User           string    `json:"User"`     // User is the user name presented to the server, it helps to identify the agent in server log.
+	Forwards       []Forward `json:"Forwards"` // Forwards are the local ports to expose on the server.
+
+	signer        ssh.Signer
+	mutex         *sync.Mutex
+	client        *ssh.Client
+	connectedAt   time.Time
+	loopIsRunning int32
+	stop          chan bool
+	logger        lalog.Logger
+}
+
+// Initialise validates configuration and initialises internal states.
+func (daemon *Daemon) Initialise() error {
+	daemon.logger = lalog.Logger{ComponentName: "tunnelagent", ComponentID: []lalog.LoggerIDField{{Key: "Server", Value: daemon.ServerAddress}}}
+	if _, _, err := net.SplitHostPort(daemon.ServerAddress); err != nil {
+		return errors.New("tunnelagent.Initialise: ServerAddress must be in the format of host:port")
+	}
+	if daemon.HostKeyFingerprint == "" {
+		return errors.New("tunnelagent.Initialise: HostKeyFingerprint must be specified")
+	}
+	if daemon.PrivateKeyPath == "" {
+		return errors.New("tunnelagent.Initialise: PrivateKeyPath must be specified")
+	}
+	if daemon.User == "" {
+		daemon.User = "tunnelagent"
+	}
+	if len(daemon.Forwards) == 0 {
+		return errors.New("tunnelagent.Initialise: Forwards must be specified")
+	}
+	remotePorts := make(map[int]struct{})
+	for _, fwd := range daemon.Forwards {
+		if fwd.RemotePort < 1 || fwd.RemotePort > 65535 {
+			return fmt.Errorf("tunnelagent.Initialise: RemotePort %d must be between 1 and 65535", fwd.RemotePort)
+		}
+		if _, exists := remotePorts[fwd.RemotePort]; exists {
+			return fmt.Errorf("tunnelagent.Initialise: RemotePort %d is used more than once", fwd.RemotePort)
+		}
+		remotePorts[fwd.RemotePort] = struct{}{}
+		if _, _, err := net.SplitHostPort(fwd.LocalAddress); err != nil {
+			return fmt.Errorf("tunnelagent.Initialise: LocalAddress \"%s\" must be in the format of host:port", fwd.LocalAddress)
+		}
+	}
+	var err error
+	if daemon.signer, err = sshd.LoadOrGenerateKey(daemon.PrivateKeyPath); err != nil {
+		return fmt.Errorf("tunnelagent.Initialise: failed to load private key from \"%s\" - %v", daemon.PrivateKeyPath, err)
+	}
+	daemon.mutex = new(sync.Mutex)
+	daemon.stop = make(chan bool, 1)
+	return nil
+}
+
+// GetPublicKey returns the public key of the agent in the format of OpenSSH authorized_keys file.
+func (daemon *Daemon) GetPublicKey() string {
+	return string(ssh.MarshalAuthorizedKey(daemon.signer.PublicKey()))
+}
+
+// checkHostKey is the SSH host key callback that verifies the host key fingerprint of the server.
+func (daemon *Daemon) checkHostKey(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if fingerprint := ssh.FingerprintSHA256(key); fingerprint != daemon.HostKeyFingerprint {
+		return fmt.Errorf("the server presented host key %s instead of the expected %s", fingerprint, daemon.HostKeyFingerprint)
+	}
+	return nil
+}
+
+/*
+connect connects to the server and asks the server to listen on the tunnel ports. It returns the SSH client after
+all tunnel ports are ready.
+*/
+func (daemon *Daemon) connect() (*ssh.Client, error) {
+	client, err := ssh.Dial("tcp", daemon.ServerAddress, &ssh.ClientConfig{
+		User:            daemon.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(daemon.signer)},
+		HostKeyCallback: daemon.checkHostKey,
+		Timeout:         IOTimeoutSec * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, fwd := range daemon.Forwards {
+		listener, err := client.Listen("tcp", net.JoinHostPort("0.0.0.0", strconv.Itoa(fwd.RemotePort)))
+		if err != nil {
+			_ = client.Close()
+			return nil, fmt.Errorf("the server refused to listen on tunnel port %d - %v", fwd.RemotePort, err)
+		}
+		go daemon.relay(listener, fwd)
+	}
+	return client, nil
+}
+
+// relay connects each connection made to the tunnel port to the local service, until the connection to the server is closed.
+func (daemon *Daemon) relay(listener net.Listener, fwd Forward) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			localConn, err := net.DialTimeout("tcp", fwd.LocalAddress, IOTimeoutSec*time.Second)
+			if err != nil {
+				daemon.logger.Warning("relay", conn.RemoteAddr().String(), err, "failed to connect to local service %s", fwd.LocalAddress)
+				_ = conn.Close()
+				return
+			}
+			daemon.logger.Info("relay", conn.RemoteAddr().String(), nil, "relaying tunnel port %d to %s", fwd.RemotePort, fwd.LocalAddress)
+			sshd.PipeTunnel(conn, localConn)
+		}()
+	}
+}
+
+/*
+sendKeepAlive sends a keep-alive request to the server and waits for its response. If the server does not respond
+within the timeout, the connection is closed so that a half-open connection does not keep the agent waiting forever.
+*/
+func sendKeepAlive(conn ssh.Conn, timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		_ = conn.Close()
+		return fmt.Errorf("no response in %v", timeout)
+	}
+}
+
+// keepAlive sends keep-alive requests to the server, and returns when the connection is broken or the daemon is told to stop.
+func (daemon *Daemon) keepAlive(client *ssh.Client) (stopped bool) {
+	disconnected := make(chan error, 1)
+	go func() {
+		disconnected <- client.Wait()
+	}()
+	for {
+		select {
+		case <-daemon.stop:
+			return true
+		case err := <-disconnected:
+			daemon.logger.Warning("keepAlive", "", err, "disconnected from server")
+			return false
+		case <-time.After(KeepAliveIntervalSec * time.Second):
+			if misc.EmergencyLockDown {
+				return true
+			}
+			if err := sendKeepAlive(client, IOTimeoutSec*time.Second); err != nil {
+				daemon.logger.Warning("keepAlive", "", err, "server did not respond to keep-alive request")
+				return false
+			}
+		}
+	}
+}
+
+/*
+StartAndBlock connects to the server and keeps the tunnel ports open, it reconnects to the server after the connection
+breaks. The function blocks until the daemon is told to stop. You may call this function only after having called
+Initialise().
+*/
+func (daemon *Daemon) StartAndBlock() error {
+	if !atomic.CompareAndSwapInt32(&daemon.loopIsRunning, 0, 1) {
+		return errors.New("tunnelagent.StartAndBlock: the daemon must not be started a second time")
+	}
+	defer atomic.StoreInt32(&daemon.loopIsRunning, 0)
+	daemon.logger.Info("StartAndBlock", "", nil, "the public key of the agent is: %s", daemon.GetPublicKey())
+	reconnectIntervalSec := MinReconnectIntervalSec
+	for {
+		if misc.EmergencyLockDown {
+			daemon.logger.Warning("StartAndBlock", "", misc.ErrEmergencyLockDown, "")
+			return misc.ErrEmergencyLockDown
+		}
+		client, err := daemon.connect()
+		if err == nil {
+			daemon.logger.Info("StartAndBlock", "", nil, "connected to server and opened %d tunnel ports", len(daemon.Forwards))
+			daemon.mutex.Lock()
+			daemon.client = client
+			daemon.connectedAt = time.Now()
+			daemon.mutex.Unlock()
+			stopped := daemon.keepAlive(client)
+			daemon.mutex.Lock()
+			daemon.client = nil
+			daemon.mutex.Unlock()
+			_ = client.Close()
+			if stopped {
+				return nil
+			}
+			// A connection that lasted for a while resets the reconnection interval
+			if time.Since(daemon.connectedAt) > MaxReconnectIntervalSec*time.Second {
+				reconnectIntervalSec = MinReconnectIntervalSec
+			}
+		} else {
+			daemon.logger.Warning("StartAndBlock", "", err, "failed to connect to server, retrying in %d seconds", reconnectIntervalSec)
+		}
+		select {
+		case <-daemon.stop:
+			return nil
+		case <-time.After(time.Duration(reconnectIntervalSec) * time.Second):
+		}
+		if reconnectIntervalSec *= 2; reconnectIntervalSec > MaxReconnectIntervalSec {
+			reconnectIntervalSec = MaxReconnectIntervalSec
+		}
+	}
+}
+
+// IsConnected returns true only if the agent is currently connected to the server.
+func (daemon *Daemon) IsConnected() bool {
+	daemon.mutex.Lock()
+	defer daemon.mutex.Unlock()
+	return daemon.client != nil
+}
+
+// Stop disconnects from the server, which closes the tunnel ports, and then StartAndBlock returns.
+func (daemon *Daemon) Stop() {
+	if atomic.CompareAndSwapInt32(&daemon.loopIsRunning, 1, 0) {
+		daemon.stop <- true
+	}
+}
+
+/*
+TestTunnelAgent conducts unit tests on the tunnel agent, see TestDaemon for daemon setup. The server must be started
+beforehand, and the first forward must lead to a local service that echoes what it receives.
+*/
+func TestTunnelAgent(daemon *Daemon, t testingstub.T) {
+	var stoppedNormally bool
+	go func() {
+		if err := daemon.StartAndBlock(); err != nil {
+			t.Fatal(err)
+		}
+		stoppedNormally = true
+	}()
+	time.Sleep(2 * time.Second)
+	if !daemon.IsConnected() {
+		t.Fatal("did not connect")
+	}
+	// Talk to the local service via the tunnel port of the server
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(daemon.Forwards[0].RemotePort)), IOTimeoutSec*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("hello tunnel")); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(IOTimeoutSec * time.Second))
+	buf := make([]byte, 64)
+	if n, err := conn.Read(buf); err != nil || string(buf[:n]) != "hello tunnel" {
+		t.Fatal(err, string(buf[:n]))
+	}
+	_ = conn.Close()
+	// Daemon must stop in a second, and the tunnel port is closed afterwards.
+	daemon.Stop()
+	time.Sleep(1 * time.Second)
+	if !stoppedNormally {
+		t.Fatal("did not stop")
+	}
+	if conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(daemon.Forwards[0].RemotePort)), IOTimeoutSec*time.Second); err == nil {
+		_ = conn.Close()
+		t.Fatal("tunnel port should have been closed")
+	}
+	// Repeatedly stopping the daemon should have no negative consequence
+	daemon.Stop()
+	daemon.Stop()
+}
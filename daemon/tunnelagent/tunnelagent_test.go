@@ -0,0 +1,158 @@
+package tunnelagent
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/sshd"
+	"github.com/HouzuoGuo/laitos/toolbox"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestDaemon(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "laitos-TestTunnelAgent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Start a local service that echoes what it receives
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go func() {
+		for {
+			conn, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+
+	daemon := Daemon{}
+	// Initialise with missing or bad parameters
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "ServerAddress") {
+		t.Fatal(err)
+	}
+	daemon.ServerAddress = "127.0.0.1:32796"
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "HostKeyFingerprint") {
+		t.Fatal(err)
+	}
+	daemon.HostKeyFingerprint = "SHA256:does-not-match"
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "PrivateKeyPath") {
+		t.Fatal(err)
+	}
+	daemon.PrivateKeyPath = filepath.Join(tmpDir, "agent_key")
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "Forwards") {
+		t.Fatal(err)
+	}
+	for _, forwards := range [][]Forward{
+		{{RemotePort: 0, LocalAddress: echoListener.Addr().String()}},
+		{{RemotePort: 32797, LocalAddress: "no-port"}},
+		{{RemotePort: 32797, LocalAddress: echoListener.Addr().String()}, {RemotePort: 32797, LocalAddress: "127.0.0.1:22"}},
+	} {
+		daemon.Forwards = forwards
+		if err := daemon.Initialise(); err == nil {
+			t.Fatalf("should have failed: %+v", forwards)
+		}
+	}
+	// Initialise with default values and a newly generated private key
+	daemon.Forwards = []Forward{{RemotePort: 32797, LocalAddress: echoListener.Addr().String()}}
+	if err := daemon.Initialise(); err != nil || daemon.User != "tunnelagent" {
+		t.Fatalf("%+v %+v", err, daemon)
+	}
+	publicKey := daemon.GetPublicKey()
+	// The private key is kept for the next time
+	if err := daemon.Initialise(); err != nil || daemon.GetPublicKey() != publicKey {
+		t.Fatal(err, daemon.GetPublicKey(), publicKey)
+	}
+
+	// Start an SSH server that accepts the agent
+	server := sshd.Daemon{
+		Address:         "127.0.0.1",
+		Port:            32796,
+		HostKeyPath:     filepath.Join(tmpDir, "host_key"),
+		TunnelAgentKeys: []string{publicKey},
+		TunnelPorts:     []int{32797},
+		PerIPLimit:      10,
+		Processor:       toolbox.GetTestCommandProcessor(),
+	}
+	if err := server.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if err := server.StartAndBlock(); err != nil {
+			t.Error(err)
+		}
+	}()
+	defer server.Stop()
+	time.Sleep(1 * time.Second)
+
+	// The agent refuses to connect to a server with unexpected host key
+	if _, err := daemon.connect(); err == nil || !strings.Contains(err.Error(), "host key") {
+		t.Fatal(err)
+	}
+	hostKey, err := sshd.LoadOrGenerateKey(server.HostKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	daemon.HostKeyFingerprint = ssh.FingerprintSHA256(hostKey.PublicKey())
+	// The server refuses to listen on a port that is not among its tunnel ports
+	daemon.Forwards = []Forward{{RemotePort: 32798, LocalAddress: echoListener.Addr().String()}}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := daemon.connect(); err == nil || !strings.Contains(err.Error(), "32798") {
+		t.Fatal(err)
+	}
+	daemon.Forwards = []Forward{{RemotePort: 32797, LocalAddress: echoListener.Addr().String()}}
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	TestTunnelAgent(&daemon, t)
+}
+
+// unresponsiveConn is an SSH connection whose keep-alive requests never get a response until it is closed.
+type unresponsiveConn struct {
+	ssh.Conn
+	closed chan struct{}
+}
+
+func (conn *unresponsiveConn) SendRequest(string, bool, []byte) (bool, []byte, error) {
+	<-conn.closed
+	return false, nil, io.EOF
+}
+
+func (conn *unresponsiveConn) Close() error {
+	close(conn.closed)
+	return nil
+}
+
+func TestSendKeepAlive(t *testing.T) {
+	conn := &unresponsiveConn{closed: make(chan struct{})}
+	start := time.Now()
+	if err := sendKeepAlive(conn, 1*time.Second); err == nil {
+		t.Fatal("did not error")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatal("took too long", elapsed)
+	}
+	// The connection is closed after the timeout
+	select {
+	case <-conn.closed:
+	default:
+		t.Fatal("did not close the connection")
+	}
+}
@@ -0,0 +1,153 @@
+package wireguard
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+// ConnectedPeerHandshakeSec is the maximum age of the latest handshake of a peer that is considered connected.
+const ConnectedPeerHandshakeSec = 3 * 60
+
+// Peer is a VPN client, or another VPN server, that exchanges traffic with the WireGuard interface.
+type Peer struct {
+	Name      string `json:"Name"`      // Name identifies the peer in log entries, e.g. "my-phone".
+	PublicKey string `json:"PublicKey"` // PublicKey is the base64-encoded WireGuard public key of the peer.
+	// PresharedKey is an optional base64-encoded symmetric key that adds a layer of post-quantum resistance.
+	PresharedKey string `json:"PresharedKey"`
+	// Address is the IPv4 address of the peer inside the VPN, it must belong to the subnet of the interface address.
+	Address string `json:"Address"`
+	// AllowedIPs are additional subnets routed to the peer in CIDR notation, e.g. the LAN behind a site-to-site peer.
+	AllowedIPs []string `json:"AllowedIPs"`
+	// Endpoint is the optional "host:port" of a peer that accepts connections, VPN clients usually do not have one.
+	Endpoint string `json:"Endpoint"`
+	// PersistentKeepaliveSec is the interval of keep-alive packets that keep NAT mappings open, 0 disables keep-alive.
+	PersistentKeepaliveSec int `json:"PersistentKeepaliveSec"`
+}
+
+// validateKey returns an error if the key is not a base64-encoded 32-byte WireGuard key.
+func validateKey(key string) error {
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(decoded) != curve25519.PointSize {
+		return errors.New("must be a base64-encoded 32-byte WireGuard key")
+	}
+	return nil
+}
+
+// getAllowedIPs returns the comma-separated allowed IPs of the peer, beginning with its own VPN address.
+func (peer *Peer) getAllowedIPs() string {
+	return strings.Join(append([]string{peer.Address + "/32"}, peer.AllowedIPs...), ",")
+}
+
+// validate checks the peer configuration against the subnet of the interface.
+func (peer *Peer) validate(subnet *net.IPNet) error {
+	if peer.Name == "" {
+		return errors.New("peer must have a Name")
+	}
+	if err := validateKey(peer.PublicKey); err != nil {
+		return fmt.Errorf("PublicKey of peer \"%s\" %v", peer.Name, err)
+	}
+	if peer.PresharedKey != "" {
+		if err := validateKey(peer.PresharedKey); err != nil {
+			return fmt.Errorf("PresharedKey of peer \"%s\" %v", peer.Name, err)
+		}
+	}
+	if ip := net.ParseIP(peer.Address); ip == nil || ip.To4() == nil || !subnet.Contains(ip) {
+		return fmt.Errorf("Address of peer \"%s\" must be an IPv4 address in subnet %s", peer.Name, subnet.String())
+	}
+	for _, allowedIP := range peer.AllowedIPs {
+		if _, _, err := net.ParseCIDR(allowedIP); err != nil {
+			return fmt.Errorf("AllowedIPs of peer \"%s\" contains an invalid subnet \"%s\"", peer.Name, allowedIP)
+		}
+	}
+	if peer.Endpoint != "" {
+		if _, _, err := net.SplitHostPort(peer.Endpoint); err != nil {
+			return fmt.Errorf("Endpoint of peer \"%s\" must be in the format of host:port", peer.Name)
+		}
+	}
+	if peer.PersistentKeepaliveSec < 0 || peer.PersistentKeepaliveSec > 65535 {
+		return fmt.Errorf("PersistentKeepaliveSec of peer \"%s\" must be between 0 and 65535", peer.Name)
+	}
+	return nil
+}
+
+// PeerStatus is the state of a peer reported by the WireGuard interface.
+type PeerStatus struct {
+	PublicKey     string    // PublicKey is the base64-encoded WireGuard public key of the peer.
+	Endpoint      string    // Endpoint is the latest "host:port" the peer communicated from, or empty if unknown.
+	AllowedIPs    []string  // AllowedIPs are the subnets routed to the peer.
+	LastHandshake time.Time // LastHandshake is the time of the latest handshake, it is zero if there has not been one.
+	ReceivedBytes int64     // ReceivedBytes is the amount of data received from the peer.
+	SentBytes     int64     // SentBytes is the amount of data sent to the peer.
+}
+
+// IsConnected returns true only if the peer has made a handshake recently.
+func (status PeerStatus) IsConnected() bool {
+	return !status.LastHandshake.IsZero() && time.Since(status.LastHandshake) < ConnectedPeerHandshakeSec*time.Second
+}
+
+/*
+ParseDump parses the output of "wg show <interface> dump". The first line describes the interface and is skipped, each
+of the following lines describes a peer with tab-separated public key, preshared key, endpoint, allowed IPs, latest
+handshake, received bytes, sent bytes, and persistent keep-alive.
+*/
+func ParseDump(dump string) (ret []PeerStatus) {
+	ret = make([]PeerStatus, 0)
+	lines := strings.Split(strings.TrimSpace(dump), "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Split(strings.TrimRight(line, "\r"), "\t")
+		if len(fields) < 8 {
+			continue
+		}
+		status := PeerStatus{PublicKey: fields[0], AllowedIPs: []string{}}
+		if fields[2] != "(none)" {
+			status.Endpoint = fields[2]
+		}
+		if fields[3] != "(none)" {
+			status.AllowedIPs = strings.Split(fields[3], ",")
+		}
+		if handshake, _ := strconv.ParseInt(fields[4], 10, 64); handshake > 0 {
+			status.LastHandshake = time.Unix(handshake, 0)
+		}
+		status.ReceivedBytes, _ = strconv.ParseInt(fields[5], 10, 64)
+		status.SentBytes, _ = strconv.ParseInt(fields[6], 10, 64)
+		ret = append(ret, status)
+	}
+	return
+}
+
+// GenerateKeyPair returns a new pair of base64-encoded WireGuard keys, in the same way as "wg genkey | wg pubkey".
+func GenerateKeyPair() (publicKey, privateKey string, err error) {
+	priv := make([]byte, curve25519.ScalarSize)
+	if _, err = rand.Read(priv); err != nil {
+		return
+	}
+	// Clamp the private key as specified by Curve25519
+	priv[0] &= 248
+	priv[31] = (priv[31] & 127) | 64
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+	return base64.StdEncoding.EncodeToString(pub), base64.StdEncoding.EncodeToString(priv), nil
+}
+
+// getPublicKey returns the base64-encoded public key of the base64-encoded private key.
+func getPublicKey(privateKey string) (string, error) {
+	priv, err := base64.StdEncoding.DecodeString(privateKey)
+	if err != nil || len(priv) != curve25519.ScalarSize {
+		return "", errors.New("the private key must be a base64-encoded 32-byte WireGuard key")
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(pub), nil
+}
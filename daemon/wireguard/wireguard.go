@@ -0,0 +1,414 @@
+package wireguard
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/dnsd"
+	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/platform"
+	"github.com/HouzuoGuo/laitos/testingstub"
+)
+
+const (
+	// ReconcileIntervalSec is the interval at which the daemon inspects peers and restores the interface configuration.
+	ReconcileIntervalSec = 60
+	// CommandTimeoutSec is the timeout of each invocation of ip, wg, iptables, and wireguard-go.
+	CommandTimeoutSec = 30
+	// MaxInterfaceNameLength is the maximum length of a network interface name on Linux.
+	MaxInterfaceNameLength = 15
+)
+
+/*
+Daemon manages a WireGuard network interface end-to-end - it creates the interface using the kernel module or the
+userspace implementation (wireguard-go), configures the peers and their allowed IPs, optionally sets up NAT for the
+peers to reach the Internet, and lets the peers use laitos DNS server.
+*/
+type Daemon struct {
+	InterfaceName string `json:"InterfaceName"` // InterfaceName is the name of the WireGuard network interface.
+	ListenPort    int    `json:"ListenPort"`    // ListenPort is the UDP port the interface listens on.
+	// Address is the IPv4 address of the interface in CIDR notation, e.g. 10.8.0.1/24. The subnet is shared by all peers.
+	Address string `json:"Address"`
+	/*
+		PrivateKeyPath is the path to the file of base64-encoded private key of the interface, such as the one generated by
+		"wg genkey". If the file does not exist yet, a new private key is generated and saved to the path.
+	*/
+	PrivateKeyPath string `json:"PrivateKeyPath"`
+	Peers          []Peer `json:"Peers"` // Peers are the VPN clients and servers that exchange traffic with the interface.
+	// Userspace uses wireguard-go instead of the kernel module, the daemon also falls back to it if the kernel module is unavailable.
+	Userspace bool `json:"Userspace"`
+	/*
+		NATInterface is the name of the network interface (e.g. eth0) through which the peers reach the Internet. If it is
+		specified, the daemon turns on IP forwarding and masquerades the traffic from the peers using iptables.
+	*/
+	NATInterface string `json:"NATInterface"`
+
+	// DNSDaemon, if it is not nil, is told to allow the peers to query it. It is assumed to be already initialised.
+	DNSDaemon *dnsd.Daemon `json:"-"`
+
+	ip                  net.IP
+	subnet              *net.IPNet
+	publicKey           string
+	connectedPeers      map[string]bool
+	interfaceIsUp       bool
+	usedUserspace       bool
+	natIsUp             bool
+	loopIsRunning       int32
+	stop                chan bool
+	logger              lalog.Logger
+	connectedPeersGauge *lalog.Gauge
+}
+
+// Initialise validates configuration and initialises internal states.
+func (daemon *Daemon) Initialise() error {
+	if runtime.GOOS != "linux" {
+		return errors.New("wireguard.Initialise: the daemon only works on Linux")
+	}
+	if daemon.InterfaceName == "" {
+		daemon.InterfaceName = "laitos-wg"
+	}
+	if len(daemon.InterfaceName) > MaxInterfaceNameLength || strings.ContainsAny(daemon.InterfaceName, " /") {
+		return fmt.Errorf("wireguard.Initialise: InterfaceName must be at most %d characters long and may not contain space or slash", MaxInterfaceNameLength)
+	}
+	daemon.logger = lalog.Logger{ComponentName: "wireguard", ComponentID: []lalog.LoggerIDField{{Key: "Interface", Value: daemon.InterfaceName}}}
+	if daemon.ListenPort < 1 {
+		daemon.ListenPort = 51820
+	}
+	var err error
+	daemon.ip, daemon.subnet, err = net.ParseCIDR(daemon.Address)
+	if err != nil || daemon.ip.To4() == nil {
+		return errors.New("wireguard.Initialise: Address must be an IPv4 address in CIDR notation, e.g. 10.8.0.1/24")
+	}
+	if daemon.PrivateKeyPath == "" {
+		return errors.New("wireguard.Initialise: PrivateKeyPath must be specified")
+	}
+	if daemon.publicKey, err = daemon.loadPrivateKey(); err != nil {
+		return fmt.Errorf("wireguard.Initialise: failed to load private key from \"%s\" - %v", daemon.PrivateKeyPath, err)
+	}
+	names := make(map[string]struct{})
+	publicKeys := make(map[string]struct{})
+	addresses := map[string]struct{}{daemon.ip.String(): {}}
+	for i := range daemon.Peers {
+		peer := &daemon.Peers[i]
+		if err := peer.validate(daemon.subnet); err != nil {
+			return fmt.Errorf("wireguard.Initialise: %v", err)
+		}
+		if _, exists := names[peer.Name]; exists {
+			return fmt.Errorf("wireguard.Initialise: peer name \"%s\" is used more than once", peer.Name)
+		}
+		if _, exists := publicKeys[peer.PublicKey]; exists {
+			return fmt.Errorf("wireguard.Initialise: the public key of peer \"%s\" is used more than once", peer.Name)
+		}
+		if _, exists := addresses[net.ParseIP(peer.Address).String()]; exists {
+			return fmt.Errorf("wireguard.Initialise: the address of peer \"%s\" is already used by the interface or another peer", peer.Name)
+		}
+		names[peer.Name] = struct{}{}
+		publicKeys[peer.PublicKey] = struct{}{}
+		addresses[net.ParseIP(peer.Address).String()] = struct{}{}
+	}
+	daemon.connectedPeers = make(map[string]bool)
+	daemon.stop = make(chan bool)
+	daemon.connectedPeersGauge = daemon.logger.Gauge("ConnectedPeers")
+	return nil
+}
+
+// loadPrivateKey reads the private key from PrivateKeyPath, or generates and saves a new one if the file does not exist. It returns the public key.
+func (daemon *Daemon) loadPrivateKey() (string, error) {
+	content, err := ioutil.ReadFile(daemon.PrivateKeyPath)
+	if os.IsNotExist(err) {
+		var privateKey string
+		if _, privateKey, err = GenerateKeyPair(); err != nil {
+			return "", err
+		}
+		content = []byte(privateKey + "\n")
+		if err := ioutil.WriteFile(daemon.PrivateKeyPath, content, 0600); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+	return getPublicKey(strings.TrimSpace(string(content)))
+}
+
+// GetPublicKey returns the base64-encoded public key of the interface, which is given to the peers.
+func (daemon *Daemon) GetPublicKey() string {
+	return daemon.publicKey
+}
+
+// run invokes an external program and returns an error that carries the program output if the program fails.
+func run(program string, args ...string) error {
+	out, err := platform.InvokeProgram(nil, CommandTimeoutSec, program, args...)
+	if err != nil {
+		return fmt.Errorf("%s %s: %v - %s", program, strings.Join(args, " "), err, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// addPeer configures the peer on the interface.
+func (daemon *Daemon) addPeer(peer Peer) error {
+	args := []string{"set", daemon.InterfaceName, "peer", peer.PublicKey, "allowed-ips", peer.getAllowedIPs()}
+	if peer.Endpoint != "" {
+		args = append(args, "endpoint", peer.Endpoint)
+	}
+	if peer.PersistentKeepaliveSec > 0 {
+		args = append(args, "persistent-keepalive", strconv.Itoa(peer.PersistentKeepaliveSec))
+	}
+	if peer.PresharedKey != "" {
+		// wg only reads the preshared key from a file
+		keyFile, err := ioutil.TempFile("", "laitos-wg-psk")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(keyFile.Name())
+		_, err = keyFile.WriteString(peer.PresharedKey)
+		if closeErr := keyFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		args = append(args, "preshared-key", keyFile.Name())
+	}
+	return run("wg", args...)
+}
+
+// getNATRules returns the iptables arguments that forward and masquerade the traffic from the peers, without the action flag (-A/-D).
+func (daemon *Daemon) getNATRules() [][]string {
+	return [][]string{
+		{"-t", "nat", "POSTROUTING", "-s", daemon.subnet.String(), "-o", daemon.NATInterface, "-j", "MASQUERADE"},
+		{"FORWARD", "-i", daemon.InterfaceName, "-o", daemon.NATInterface, "-j", "ACCEPT"},
+		{"FORWARD", "-i", daemon.NATInterface, "-o", daemon.InterfaceName, "-m", "conntrack", "--ctstate", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+	}
+}
+
+// changeNATRules adds (-A) or deletes (-D) the NAT rules.
+func (daemon *Daemon) changeNATRules(action string) error {
+	for _, rule := range daemon.getNATRules() {
+		args := make([]string, 0, len(rule)+1)
+		// The table option comes before the chain
+		if rule[0] == "-t" {
+			args = append(args, rule[:2]...)
+			rule = rule[2:]
+		}
+		args = append(args, action)
+		args = append(args, rule...)
+		if err := run("iptables", args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setUp creates and configures the interface, its peers, NAT, and DNS.
+func (daemon *Daemon) setUp() error {
+	daemon.usedUserspace = daemon.Userspace
+	if !daemon.Userspace {
+		if err := run("ip", "link", "add", "dev", daemon.InterfaceName, "type", "wireguard"); err != nil {
+			daemon.logger.Warning("setUp", "", err, "failed to create interface using the kernel module, falling back to wireguard-go.")
+			daemon.usedUserspace = true
+		}
+	}
+	if daemon.usedUserspace {
+		// wireguard-go creates the interface and then carries on in the background
+		if err := run("wireguard-go", daemon.InterfaceName); err != nil {
+			return err
+		}
+	}
+	daemon.interfaceIsUp = true
+	if err := run("ip", "address", "add", daemon.Address, "dev", daemon.InterfaceName); err != nil {
+		return err
+	}
+	if err := run("wg", "set", daemon.InterfaceName, "listen-port", strconv.Itoa(daemon.ListenPort), "private-key", daemon.PrivateKeyPath); err != nil {
+		return err
+	}
+	for _, peer := range daemon.Peers {
+		if err := daemon.addPeer(peer); err != nil {
+			return fmt.Errorf("failed to add peer \"%s\" - %v", peer.Name, err)
+		}
+	}
+	if err := run("ip", "link", "set", "up", "dev", daemon.InterfaceName); err != nil {
+		return err
+	}
+	if daemon.NATInterface != "" {
+		if err := ioutil.WriteFile("/proc/sys/net/ipv4/ip_forward", []byte("1\n"), 0644); err != nil {
+			return fmt.Errorf("failed to turn on IP forwarding - %v", err)
+		}
+		daemon.natIsUp = true
+		if err := daemon.changeNATRules("-A"); err != nil {
+			return err
+		}
+	}
+	if daemon.DNSDaemon != nil {
+		daemon.DNSDaemon.AllowQuerySubnet(daemon.subnet)
+	}
+	daemon.logger.Info("setUp", "", nil, "interface is up on UDP port %d with %d peers, its public key is %s", daemon.ListenPort, len(daemon.Peers), daemon.publicKey)
+	return nil
+}
+
+// tearDown removes the NAT rules and the interface.
+func (daemon *Daemon) tearDown() {
+	if daemon.natIsUp {
+		if err := daemon.changeNATRules("-D"); err != nil {
+			daemon.logger.Warning("tearDown", "", err, "failed to remove NAT rules")
+		}
+		daemon.natIsUp = false
+	}
+	if daemon.interfaceIsUp {
+		// Deleting the interface also ends wireguard-go
+		if err := run("ip", "link", "delete", "dev", daemon.InterfaceName); err != nil {
+			daemon.logger.Warning("tearDown", "", err, "failed to delete interface")
+		}
+		daemon.interfaceIsUp = false
+	}
+	daemon.connectedPeers = make(map[string]bool)
+	daemon.connectedPeersGauge.Set(0)
+}
+
+/*
+reconcile inspects the peers of the interface, logs the peers that have connected or disconnected, removes the peers
+that are not in the configuration, and restores the configured peers that have gone missing.
+*/
+func (daemon *Daemon) reconcile() error {
+	dump, err := platform.InvokeProgram(nil, CommandTimeoutSec, "wg", "show", daemon.InterfaceName, "dump")
+	if err != nil {
+		return fmt.Errorf("failed to inspect interface - %v - %s", err, strings.TrimSpace(dump))
+	}
+	configured := make(map[string]Peer)
+	for _, peer := range daemon.Peers {
+		configured[peer.PublicKey] = peer
+	}
+	var numConnected int64
+	present := make(map[string]struct{})
+	for _, status := range ParseDump(dump) {
+		present[status.PublicKey] = struct{}{}
+		peer, isConfigured := configured[status.PublicKey]
+		if !isConfigured {
+			daemon.logger.Warning("reconcile", status.PublicKey, nil, "removing peer that is not in configuration")
+			if err := run("wg", "set", daemon.InterfaceName, "peer", status.PublicKey, "remove"); err != nil {
+				daemon.logger.Warning("reconcile", status.PublicKey, err, "failed to remove peer")
+			}
+			continue
+		}
+		if status.IsConnected() {
+			numConnected++
+			if !daemon.connectedPeers[peer.PublicKey] {
+				daemon.logger.Info("reconcile", peer.Name, nil, "peer has connected from %s", status.Endpoint)
+			}
+		} else if daemon.connectedPeers[peer.PublicKey] {
+			daemon.logger.Info("reconcile", peer.Name, nil, "peer has disconnected after receiving %d and sending %d bytes", status.ReceivedBytes, status.SentBytes)
+		}
+		daemon.connectedPeers[peer.PublicKey] = status.IsConnected()
+	}
+	for _, peer := range daemon.Peers {
+		if _, exists := present[peer.PublicKey]; !exists {
+			daemon.logger.Warning("reconcile", peer.Name, nil, "restoring missing peer")
+			if err := daemon.addPeer(peer); err != nil {
+				daemon.logger.Warning("reconcile", peer.Name, err, "failed to restore peer")
+			}
+		}
+	}
+	daemon.connectedPeersGauge.Set(numConnected)
+	return nil
+}
+
+/*
+StartAndBlock sets up the interface and then periodically inspects its peers, until the daemon is told to stop, at which
+point the interface is removed. You may call this function only after having called Initialise().
+*/
+func (daemon *Daemon) StartAndBlock() error {
+	if err := daemon.setUp(); err != nil {
+		daemon.tearDown()
+		return fmt.Errorf("wireguard.StartAndBlock: failed to set up interface - %v", err)
+	}
+	atomic.StoreInt32(&daemon.loopIsRunning, 1)
+	defer atomic.StoreInt32(&daemon.loopIsRunning, 0)
+	for {
+		select {
+		case <-daemon.stop:
+			daemon.tearDown()
+			return nil
+		case <-time.After(ReconcileIntervalSec * time.Second):
+			if misc.EmergencyLockDown {
+				daemon.tearDown()
+				return misc.ErrEmergencyLockDown
+			}
+			if err := daemon.reconcile(); err != nil {
+				// The interface may have been deleted by someone else
+				daemon.logger.Warning("StartAndBlock", "", err, "re-creating the interface")
+				daemon.tearDown()
+				if err := daemon.setUp(); err != nil {
+					daemon.logger.Warning("StartAndBlock", "", err, "failed to re-create the interface")
+				}
+			}
+		}
+	}
+}
+
+// Stop removes the interface and its NAT rules, and then StartAndBlock returns.
+func (daemon *Daemon) Stop() {
+	if atomic.CompareAndSwapInt32(&daemon.loopIsRunning, 1, 0) {
+		daemon.stop <- true
+	}
+}
+
+// TestWireGuard conducts unit tests on WireGuard daemon, see TestDaemon for daemon setup. The test requires root privilege.
+func TestWireGuard(daemon *Daemon, t testingstub.T) {
+	var stoppedNormally bool
+	go func() {
+		if err := daemon.StartAndBlock(); err != nil {
+			t.Fatal(err)
+		}
+		stoppedNormally = true
+	}()
+	time.Sleep(3 * time.Second)
+	if err := daemon.reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	// A peer added by someone else is removed, and a peer removed by someone else is restored.
+	strayPublicKey, _, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run("wg", "set", daemon.InterfaceName, "peer", strayPublicKey, "allowed-ips", "192.0.2.1/32"); err != nil {
+		t.Fatal(err)
+	}
+	if len(daemon.Peers) > 0 {
+		if err := run("wg", "set", daemon.InterfaceName, "peer", daemon.Peers[0].PublicKey, "remove"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := daemon.reconcile(); err != nil {
+		t.Fatal(err)
+	}
+	dump, err := platform.InvokeProgram(nil, CommandTimeoutSec, "wg", "show", daemon.InterfaceName, "dump")
+	if err != nil {
+		t.Fatal(err, dump)
+	}
+	statuses := ParseDump(dump)
+	if len(statuses) != len(daemon.Peers) {
+		t.Fatalf("%+v", statuses)
+	}
+	for _, status := range statuses {
+		if status.PublicKey == strayPublicKey {
+			t.Fatalf("%+v", statuses)
+		}
+	}
+	// Daemon must stop in a second
+	daemon.Stop()
+	time.Sleep(1 * time.Second)
+	if !stoppedNormally {
+		t.Fatal("did not stop")
+	}
+	// Repeatedly stopping the daemon should have no negative consequence
+	daemon.Stop()
+	daemon.Stop()
+}
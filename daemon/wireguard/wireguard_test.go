@@ -0,0 +1,114 @@
+package wireguard
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDump(t *testing.T) {
+	handshake := time.Now().Add(-10 * time.Second).Unix()
+	dump := fmt.Sprintf("cHJpdmF0ZQ==\tcHVibGlj\t51820\toff\n"+
+		"cGVlcjE=\t(none)\t203.0.113.1:40000\t10.8.0.2/32,192.168.5.0/24\t%d\t100\t200\t25\n"+
+		"cGVlcjI=\t(none)\t(none)\t(none)\t0\t0\t0\toff\n", handshake)
+	statuses := ParseDump(dump)
+	if len(statuses) != 2 {
+		t.Fatalf("%+v", statuses)
+	}
+	if s := statuses[0]; s.PublicKey != "cGVlcjE=" || s.Endpoint != "203.0.113.1:40000" || !reflect.DeepEqual(s.AllowedIPs, []string{"10.8.0.2/32", "192.168.5.0/24"}) ||
+		s.LastHandshake.Unix() != handshake || s.ReceivedBytes != 100 || s.SentBytes != 200 || !s.IsConnected() {
+		t.Fatalf("%+v", s)
+	}
+	if s := statuses[1]; s.PublicKey != "cGVlcjI=" || s.Endpoint != "" || len(s.AllowedIPs) != 0 || !s.LastHandshake.IsZero() || s.IsConnected() {
+		t.Fatalf("%+v", s)
+	}
+	if statuses := ParseDump(""); len(statuses) != 0 {
+		t.Fatalf("%+v", statuses)
+	}
+}
+
+func TestDaemon(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-TestWireGuard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	peerPublicKey, _, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	presharedKey, _, err := GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	daemon := Daemon{}
+	// Initialise with missing or bad parameters
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "Address") {
+		t.Fatal(err)
+	}
+	daemon.Address = "fd00::1/64"
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "Address") {
+		t.Fatal(err)
+	}
+	daemon.Address = "10.8.0.1/24"
+	if err := daemon.Initialise(); err == nil || !strings.Contains(err.Error(), "PrivateKeyPath") {
+		t.Fatal(err)
+	}
+	daemon.PrivateKeyPath = filepath.Join(dir, "private.key")
+	for _, peers := range [][]Peer{
+		{{PublicKey: peerPublicKey, Address: "10.8.0.2"}},
+		{{Name: "a", PublicKey: "bad key", Address: "10.8.0.2"}},
+		{{Name: "a", PublicKey: peerPublicKey, PresharedKey: "bad key", Address: "10.8.0.2"}},
+		{{Name: "a", PublicKey: peerPublicKey, Address: "10.9.0.2"}},
+		{{Name: "a", PublicKey: peerPublicKey, Address: "10.8.0.1"}},
+		{{Name: "a", PublicKey: peerPublicKey, Address: "10.8.0.2", AllowedIPs: []string{"192.168.5.0"}}},
+		{{Name: "a", PublicKey: peerPublicKey, Address: "10.8.0.2", Endpoint: "no-port"}},
+		{{Name: "a", PublicKey: peerPublicKey, Address: "10.8.0.2"}, {Name: "a", PublicKey: presharedKey, Address: "10.8.0.3"}},
+		{{Name: "a", PublicKey: peerPublicKey, Address: "10.8.0.2"}, {Name: "b", PublicKey: peerPublicKey, Address: "10.8.0.3"}},
+		{{Name: "a", PublicKey: peerPublicKey, Address: "10.8.0.2"}, {Name: "b", PublicKey: presharedKey, Address: "10.8.0.2"}},
+	} {
+		daemon.Peers = peers
+		if err := daemon.Initialise(); err == nil {
+			t.Fatalf("should have failed: %+v", peers)
+		}
+	}
+	// Initialise with default values and a newly generated private key
+	daemon.Peers = []Peer{{Name: "phone", PublicKey: peerPublicKey, PresharedKey: presharedKey, Address: "10.8.0.2", PersistentKeepaliveSec: 25}}
+	if err := daemon.Initialise(); err != nil || daemon.InterfaceName != "laitos-wg" || daemon.ListenPort != 51820 {
+		t.Fatalf("%+v %+v", err, daemon)
+	}
+	publicKey := daemon.GetPublicKey()
+	if err := validateKey(publicKey); err != nil {
+		t.Fatal(err)
+	}
+	// The private key is kept for the next time
+	if err := daemon.Initialise(); err != nil || daemon.GetPublicKey() != publicKey {
+		t.Fatal(err, daemon.GetPublicKey(), publicKey)
+	}
+	if allowedIPs := daemon.Peers[0].getAllowedIPs(); allowedIPs != "10.8.0.2/32" {
+		t.Fatal(allowedIPs)
+	}
+	daemon.NATInterface = "eth0"
+	if rules := daemon.getNATRules(); len(rules) != 3 || !reflect.DeepEqual(rules[0], []string{"-t", "nat", "POSTROUTING", "-s", "10.8.0.0/24", "-o", "eth0", "-j", "MASQUERADE"}) {
+		t.Fatalf("%+v", rules)
+	}
+	daemon.NATInterface = ""
+
+	// Setting up the interface requires root privilege and WireGuard tools
+	if _, err := exec.LookPath("wg"); err != nil || os.Getuid() != 0 {
+		t.Skip("wg is not installed or the test is not running as root")
+	}
+	daemon.InterfaceName = "laitos-wg-test"
+	daemon.ListenPort = 51899
+	if err := daemon.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	TestWireGuard(&daemon, t)
+}
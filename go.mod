@@ -1,3 +1,8 @@
 module github.com/HouzuoGuo/laitos
 
 go 1.14
+
+require (
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
+)
@@ -0,0 +1,163 @@
+package inet
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	CloudAWS     = "AWS"     // CloudAWS is the name of Amazon Web Service.
+	CloudGCE     = "GCE"     // CloudGCE is the name of Google compute engine.
+	CloudAzure   = "Azure"   // CloudAzure is the name of Microsoft Azure.
+	CloudAlibaba = "Alibaba" // CloudAlibaba is the name of Alibaba Cloud.
+)
+
+var (
+	// cloudInstance is the cloud instance information retrieved by GetCloudInstance.
+	cloudInstance     CloudInstance
+	cloudInstanceOnce = new(sync.Once)
+)
+
+// CloudInstance describes the public cloud virtual machine that runs this program.
+type CloudInstance struct {
+	Provider   string            // Provider is the name of public cloud (e.g. CloudAWS), it is empty if the program is not on a public cloud.
+	InstanceID string            // InstanceID is the unique ID of the virtual machine assigned by the cloud.
+	Region     string            // Region is the geographical region of the virtual machine.
+	Tags       map[string]string // Tags are the key-value tags of the virtual machine, a tag without a value has an empty value.
+}
+
+// String returns the cloud instance information in a single line of text.
+func (inst CloudInstance) String() string {
+	if inst.Provider == "" {
+		return "not on a public cloud"
+	}
+	tags := make([]string, 0, len(inst.Tags))
+	for key, val := range inst.Tags {
+		if val == "" {
+			tags = append(tags, key)
+		} else {
+			tags = append(tags, key+"="+val)
+		}
+	}
+	sort.Strings(tags)
+	return fmt.Sprintf("%s instance %s in %s, tags: %s", inst.Provider, inst.InstanceID, inst.Region, strings.Join(tags, ","))
+}
+
+// getMetadata retrieves a piece of text from cloud metadata service. It returns an empty string if the retrieval fails.
+func getMetadata(header map[string][]string, maxBytes int, url string) string {
+	resp, err := DoHTTP(HTTPRequest{
+		TimeoutSec: HTTPPublicIPTimeoutSec,
+		MaxBytes:   maxBytes,
+		Header:     header,
+	}, url)
+	if err != nil || resp.StatusCode/200 != 1 {
+		return ""
+	}
+	return strings.TrimSpace(string(resp.Body))
+}
+
+// getAWSInstance retrieves AWS instance information. Instance tags are available only if they are allowed in metadata.
+func getAWSInstance() (inst CloudInstance) {
+	inst.Provider = CloudAWS
+	inst.InstanceID = getMetadata(nil, 64, "http://169.254.169.254/latest/meta-data/instance-id")
+	inst.Region = getMetadata(nil, 64, "http://169.254.169.254/latest/meta-data/placement/region")
+	inst.Tags = make(map[string]string)
+	for _, key := range strings.Split(getMetadata(nil, 4096, "http://169.254.169.254/latest/meta-data/tags/instance"), "\n") {
+		if key = strings.TrimSpace(key); key != "" {
+			inst.Tags[key] = getMetadata(nil, 1024, "http://169.254.169.254/latest/meta-data/tags/instance/"+key)
+		}
+	}
+	return
+}
+
+// getGCEInstance retrieves GCE instance information. The tags of GCE instance are network tags and they do not have values.
+func getGCEInstance() (inst CloudInstance) {
+	header := map[string][]string{"Metadata-Flavor": {"Google"}}
+	inst.Provider = CloudGCE
+	inst.InstanceID = getMetadata(header, 64, "http://169.254.169.254/computeMetadata/v1/instance/id")
+	// The zone looks like "projects/123456/zones/us-central1-a", and the region is "us-central1".
+	zone := getMetadata(header, 256, "http://169.254.169.254/computeMetadata/v1/instance/zone")
+	zone = zone[strings.LastIndexByte(zone, '/')+1:]
+	if dash := strings.LastIndexByte(zone, '-'); dash > 0 {
+		inst.Region = zone[:dash]
+	}
+	inst.Tags = make(map[string]string)
+	var tags []string
+	if err := json.Unmarshal([]byte(getMetadata(header, 4096, "http://169.254.169.254/computeMetadata/v1/instance/tags?alt=json")), &tags); err == nil {
+		for _, tag := range tags {
+			inst.Tags[tag] = ""
+		}
+	}
+	return
+}
+
+// getAzureInstance retrieves Azure virtual machine information.
+func getAzureInstance() (inst CloudInstance) {
+	inst.Provider = CloudAzure
+	inst.Tags = make(map[string]string)
+	var compute struct {
+		VMID     string `json:"vmId"`
+		Location string `json:"location"`
+		Tags     string `json:"tags"`
+	}
+	body := getMetadata(map[string][]string{"Metadata": {"true"}}, 8192, "http://169.254.169.254/metadata/instance/compute?api-version=2018-10-01")
+	if err := json.Unmarshal([]byte(body), &compute); err != nil {
+		return
+	}
+	inst.InstanceID = compute.VMID
+	inst.Region = compute.Location
+	// The tags look like "key1:value1;key2:value2"
+	for _, tag := range strings.Split(compute.Tags, ";") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			keyValue := strings.SplitN(tag, ":", 2)
+			if len(keyValue) == 2 {
+				inst.Tags[keyValue[0]] = keyValue[1]
+			} else {
+				inst.Tags[keyValue[0]] = ""
+			}
+		}
+	}
+	return
+}
+
+// getAlibabaInstance retrieves Alibaba cloud instance information.
+func getAlibabaInstance() (inst CloudInstance) {
+	inst.Provider = CloudAlibaba
+	inst.InstanceID = getMetadata(nil, 64, "http://100.100.100.200/latest/meta-data/instance-id")
+	inst.Region = getMetadata(nil, 64, "http://100.100.100.200/latest/meta-data/region-id")
+	inst.Tags = make(map[string]string)
+	return
+}
+
+/*
+GetCloudInstance returns the ID, region, and tags of the public cloud virtual machine that runs this program. The
+information is retrieved from cloud metadata service only once, and it may take up to 10 seconds to return the first time.
+*/
+func GetCloudInstance() CloudInstance {
+	cloudInstanceOnce.Do(func() {
+		// Detect all clouds at the same time, each detection may take up to 10 seconds on a computer outside of the cloud.
+		wait := new(sync.WaitGroup)
+		wait.Add(4)
+		for _, detect := range []func() bool{IsAWS, IsGCE, IsAzure, IsAlibaba} {
+			go func(detect func() bool) {
+				detect()
+				wait.Done()
+			}(detect)
+		}
+		wait.Wait()
+		switch {
+		case IsAWS():
+			cloudInstance = getAWSInstance()
+		case IsGCE():
+			cloudInstance = getGCEInstance()
+		case IsAzure():
+			cloudInstance = getAzureInstance()
+		case IsAlibaba():
+			cloudInstance = getAlibabaInstance()
+		}
+	})
+	return cloudInstance
+}
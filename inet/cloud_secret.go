@@ -0,0 +1,310 @@
+package inet
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	CloudSecretAWSSecretsManager = "aws-secretsmanager" // CloudSecretAWSSecretsManager retrieves a secret string from AWS Secrets Manager.
+	CloudSecretAWSKMS            = "aws-kms"            // CloudSecretAWSKMS decrypts a ciphertext blob using AWS Key Management Service.
+	CloudSecretGCPSecretManager  = "gcp-secretmanager"  // CloudSecretGCPSecretManager retrieves a secret version from GCP Secret Manager.
+	CloudSecretAzureKeyVault     = "azure-keyvault"     // CloudSecretAzureKeyVault retrieves a secret from Azure Key Vault.
+
+	// CloudSecretTimeoutSec is the timeout in seconds of each request made to cloud metadata or secret service.
+	CloudSecretTimeoutSec = 10
+	// CloudSecretMaxBytes is the maximum size of a response read from cloud secret service.
+	CloudSecretMaxBytes = 64 * 1024
+	// awsSigningAlgorithm is the name of AWS request signing algorithm version 4.
+	awsSigningAlgorithm = "AWS4-HMAC-SHA256"
+)
+
+// ErrCloudSecretEmpty is returned when the cloud secret service responds with an empty secret.
+var ErrCloudSecretEmpty = errors.New("the cloud secret is empty")
+
+// awsCredentials are the temporary credentials of the IAM role attached to an EC2 instance.
+type awsCredentials struct {
+	AccessKeyID     string `json:"AccessKeyId"`
+	SecretAccessKey string `json:"SecretAccessKey"`
+	Token           string `json:"Token"`
+}
+
+// getAWSRoleCredentials retrieves the temporary credentials of the IAM role attached to this EC2 instance.
+func getAWSRoleCredentials() (cred awsCredentials, err error) {
+	header := http.Header{}
+	// Prefer instance metadata service version 2, which requires a session token. Version 1 does not.
+	resp, err := DoHTTP(HTTPRequest{
+		TimeoutSec: CloudSecretTimeoutSec,
+		Method:     http.MethodPut,
+		Header:     http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"60"}},
+		MaxBytes:   1024,
+		MaxRetry:   1,
+	}, "http://169.254.169.254/latest/api/token")
+	if err == nil && resp.StatusCode/200 == 1 {
+		header.Set("X-Aws-Ec2-Metadata-Token", strings.TrimSpace(string(resp.Body)))
+	}
+	resp, err = DoHTTP(HTTPRequest{TimeoutSec: CloudSecretTimeoutSec, Header: header, MaxBytes: 1024}, "http://169.254.169.254/latest/meta-data/iam/security-credentials/")
+	if err != nil {
+		return
+	} else if err = resp.Non2xxToError(); err != nil {
+		return
+	}
+	roleName := strings.TrimSpace(strings.SplitN(string(resp.Body), "\n", 2)[0])
+	if roleName == "" {
+		err = errors.New("getAWSRoleCredentials: the instance does not have an IAM role")
+		return
+	}
+	resp, err = DoHTTP(HTTPRequest{TimeoutSec: CloudSecretTimeoutSec, Header: header, MaxBytes: 8192}, "http://169.254.169.254/latest/meta-data/iam/security-credentials/%s", roleName)
+	if err != nil {
+		return
+	} else if err = resp.Non2xxToError(); err != nil {
+		return
+	}
+	err = json.Unmarshal(resp.Body, &cred)
+	return
+}
+
+// hmacSHA256 returns the HMAC-SHA256 digest of the data.
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	_, _ = mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+/*
+signAWSRequest returns the value of Authorization header of an AWS API request, signed using signature version 4. The
+header must include all of the headers that should be signed, including "Host" and "X-Amz-Date". The query must already
+be in its canonical form (sorted and escaped).
+*/
+func signAWSRequest(method, path, query string, header map[string]string, body []byte, region, service string, cred awsCredentials, now time.Time) string {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + region + "/" + service + "/aws4_request"
+	names := make([]string, 0, len(header))
+	values := make(map[string]string)
+	for name, value := range header {
+		name = strings.ToLower(name)
+		names = append(names, name)
+		values[name] = strings.TrimSpace(value)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + values[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	bodyDigest := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{method, path, query, canonicalHeaders.String(), signedHeaders, hex.EncodeToString(bodyDigest[:])}, "\n")
+	requestDigest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{awsSigningAlgorithm, amzDate, scope, hex.EncodeToString(requestDigest[:])}, "\n")
+	signingKey := []byte("AWS4" + cred.SecretAccessKey)
+	for _, part := range []string{amzDate[:8], region, service, "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	return fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s", awsSigningAlgorithm, cred.AccessKeyID, scope, signedHeaders, signature)
+}
+
+// callAWSJSONAPI invokes an AWS JSON API (e.g. "secretsmanager.GetSecretValue") using the instance role, and decodes the response.
+func callAWSJSONAPI(region, service, target string, input, output interface{}) error {
+	if region == "" {
+		region = GetCloudInstance().Region
+	}
+	if region == "" {
+		return errors.New("callAWSJSONAPI: unable to determine AWS region")
+	}
+	cred, err := getAWSRoleCredentials()
+	if err != nil {
+		return fmt.Errorf("callAWSJSONAPI: failed to retrieve instance role credentials - %v", err)
+	}
+	body, err := json.Marshal(input)
+	if err != nil {
+		return err
+	}
+	host := service + "." + region + ".amazonaws.com"
+	now := time.Now()
+	header := map[string]string{
+		"Content-Type": "application/x-amz-json-1.1",
+		"Host":         host,
+		"X-Amz-Date":   now.UTC().Format("20060102T150405Z"),
+		"X-Amz-Target": target,
+	}
+	if cred.Token != "" {
+		header["X-Amz-Security-Token"] = cred.Token
+	}
+	authorization := signAWSRequest(http.MethodPost, "/", "", header, body, region, service, cred, now)
+	reqHeader := http.Header{"Authorization": {authorization}}
+	for name, value := range header {
+		if name != "Host" {
+			reqHeader.Set(name, value)
+		}
+	}
+	resp, err := DoHTTP(HTTPRequest{
+		TimeoutSec: CloudSecretTimeoutSec,
+		Method:     http.MethodPost,
+		Header:     reqHeader,
+		Body:       bytes.NewReader(body),
+		MaxBytes:   CloudSecretMaxBytes,
+		// The request body cannot be replayed in a retry
+		MaxRetry: 1,
+	}, "https://"+host+"/")
+	if err != nil {
+		return err
+	} else if err = resp.Non2xxToError(); err != nil {
+		return err
+	}
+	return json.Unmarshal(resp.Body, output)
+}
+
+// getAWSSecretsManagerSecret retrieves the string value of a secret from AWS Secrets Manager.
+func getAWSSecretsManagerSecret(region, secretID string) (string, error) {
+	var output struct {
+		SecretString string `json:"SecretString"`
+	}
+	err := callAWSJSONAPI(region, "secretsmanager", "secretsmanager.GetSecretValue", map[string]string{"SecretId": secretID}, &output)
+	return output.SecretString, err
+}
+
+// decryptAWSKMSCiphertext decrypts a base64-encoded ciphertext blob using AWS Key Management Service.
+func decryptAWSKMSCiphertext(region, ciphertext string) (string, error) {
+	var output struct {
+		Plaintext string `json:"Plaintext"`
+	}
+	if err := callAWSJSONAPI(region, "kms", "TrentService.Decrypt", map[string]string{"CiphertextBlob": ciphertext}, &output); err != nil {
+		return "", err
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(output.Plaintext)
+	return string(plaintext), err
+}
+
+// getGCPSecretManagerSecret retrieves a secret version (e.g. "projects/p/secrets/s/versions/latest") from GCP Secret Manager.
+func getGCPSecretManagerSecret(versionName string) (string, error) {
+	resp, err := DoHTTP(HTTPRequest{
+		TimeoutSec: CloudSecretTimeoutSec,
+		Header:     http.Header{"Metadata-Flavor": {"Google"}},
+		MaxBytes:   8192,
+	}, "http://169.254.169.254/computeMetadata/v1/instance/service-accounts/default/token")
+	if err != nil {
+		return "", err
+	} else if err = resp.Non2xxToError(); err != nil {
+		return "", err
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(resp.Body, &token); err != nil {
+		return "", err
+	}
+	resp, err = DoHTTP(HTTPRequest{
+		TimeoutSec: CloudSecretTimeoutSec,
+		Header:     http.Header{"Authorization": {"Bearer " + token.AccessToken}},
+		MaxBytes:   CloudSecretMaxBytes,
+	}, "https://secretmanager.googleapis.com/v1/"+strings.Trim(versionName, "/")+":access")
+	if err != nil {
+		return "", err
+	} else if err = resp.Non2xxToError(); err != nil {
+		return "", err
+	}
+	var output struct {
+		Payload struct {
+			Data string `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(resp.Body, &output); err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(output.Payload.Data)
+	return string(data), err
+}
+
+// getAzureKeyVaultSecret retrieves a secret (e.g. "https://vault.vault.azure.net/secrets/name") from Azure Key Vault.
+func getAzureKeyVaultSecret(secretURL string) (string, error) {
+	resp, err := DoHTTP(HTTPRequest{
+		TimeoutSec: CloudSecretTimeoutSec,
+		Header:     http.Header{"Metadata": {"true"}},
+		MaxBytes:   CloudSecretMaxBytes,
+	}, "http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource=%s", "https://vault.azure.net")
+	if err != nil {
+		return "", err
+	} else if err = resp.Non2xxToError(); err != nil {
+		return "", err
+	}
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(resp.Body, &token); err != nil {
+		return "", err
+	}
+	secretURL = strings.TrimRight(secretURL, "/")
+	if _, err := url.Parse(secretURL); err != nil {
+		return "", err
+	}
+	resp, err = DoHTTP(HTTPRequest{
+		TimeoutSec: CloudSecretTimeoutSec,
+		Header:     http.Header{"Authorization": {"Bearer " + token.AccessToken}},
+		MaxBytes:   CloudSecretMaxBytes,
+	}, secretURL+"?api-version=7.0")
+	if err != nil {
+		return "", err
+	} else if err = resp.Non2xxToError(); err != nil {
+		return "", err
+	}
+	var output struct {
+		Value string `json:"value"`
+	}
+	err = json.Unmarshal(resp.Body, &output)
+	return output.Value, err
+}
+
+/*
+GetCloudSecret retrieves a secret from a cloud secret service using the identity (instance role or service account) of
+the virtual machine that runs this program, so that no credential needs to be stored on the computer. The source is
+one of:
+- "aws-secretsmanager:REGION:SECRET-ID"
+- "aws-kms:REGION:BASE64-CIPHERTEXT-BLOB"
+- "gcp-secretmanager:projects/PROJECT/secrets/NAME/versions/VERSION"
+- "azure-keyvault:https://VAULT.vault.azure.net/secrets/NAME"
+The AWS region may be left empty to use the region of this instance. Leading and trailing spaces of the secret are removed.
+*/
+func GetCloudSecret(source string) (secret string, err error) {
+	providerArgs := strings.SplitN(source, ":", 2)
+	if len(providerArgs) != 2 || providerArgs[1] == "" {
+		return "", fmt.Errorf("GetCloudSecret: malformed secret source \"%s\"", source)
+	}
+	switch provider, args := providerArgs[0], providerArgs[1]; provider {
+	case CloudSecretAWSSecretsManager, CloudSecretAWSKMS:
+		regionArg := strings.SplitN(args, ":", 2)
+		if len(regionArg) != 2 || regionArg[1] == "" {
+			return "", fmt.Errorf("GetCloudSecret: %s source must look like \"%s:REGION:ARGUMENT\"", provider, provider)
+		}
+		if provider == CloudSecretAWSSecretsManager {
+			secret, err = getAWSSecretsManagerSecret(regionArg[0], regionArg[1])
+		} else {
+			secret, err = decryptAWSKMSCiphertext(regionArg[0], regionArg[1])
+		}
+	case CloudSecretGCPSecretManager:
+		secret, err = getGCPSecretManagerSecret(args)
+	case CloudSecretAzureKeyVault:
+		secret, err = getAzureKeyVaultSecret(args)
+	default:
+		return "", fmt.Errorf("GetCloudSecret: unknown secret provider \"%s\"", provider)
+	}
+	if err != nil {
+		return "", err
+	}
+	secret = strings.TrimSpace(secret)
+	if secret == "" {
+		return "", ErrCloudSecretEmpty
+	}
+	return secret, nil
+}
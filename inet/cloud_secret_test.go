@@ -0,0 +1,33 @@
+package inet
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignAWSRequest(t *testing.T) {
+	// The example comes from AWS signature version 4 documentation
+	now, err := time.Parse("20060102T150405Z", "20150830T123600Z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := map[string]string{
+		"Content-Type": "application/x-www-form-urlencoded; charset=utf-8",
+		"Host":         "iam.amazonaws.com",
+		"X-Amz-Date":   "20150830T123600Z",
+	}
+	cred := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	authorization := signAWSRequest("GET", "/", "Action=ListUsers&Version=2010-05-08", header, nil, "us-east-1", "iam", cred, now)
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if authorization != expected {
+		t.Fatal(authorization)
+	}
+}
+
+func TestGetCloudSecret(t *testing.T) {
+	for _, source := range []string{"", "aws-kms", "aws-kms:", "aws-secretsmanager:us-east-1", "nosuchcloud:abc"} {
+		if _, err := GetCloudSecret(source); err == nil {
+			t.Fatal("did not error", source)
+		}
+	}
+}
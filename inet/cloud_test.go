@@ -0,0 +1,13 @@
+package inet
+
+import "testing"
+
+func TestCloudInstance_String(t *testing.T) {
+	if s := (CloudInstance{}).String(); s != "not on a public cloud" {
+		t.Fatal(s)
+	}
+	inst := CloudInstance{Provider: CloudAWS, InstanceID: "i-123", Region: "us-east-1", Tags: map[string]string{"Name": "web", "prod": ""}}
+	if s := inst.String(); s != "AWS instance i-123 in us-east-1, tags: Name=web,prod" {
+		t.Fatal(s)
+	}
+}
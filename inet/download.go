@@ -0,0 +1,253 @@
+package inet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// DownloadRequest describes a file to be downloaded by DownloadFile.
+type DownloadRequest struct {
+	/*
+		HTTPRequest configures the header, TLS, proxy, and retries of the download. Its TimeoutSec limits each download
+		attempt (default to 15 minutes), its MaxRetry is the number of attempts (default to 5), and its MaxBytes limits
+		the size of the file (default to 0, which is unlimited).
+	*/
+	HTTPRequest HTTPRequest
+	DestPath    string // DestPath is the location of the downloaded file, the file does not appear until download completes.
+	SHA256Hex   string // SHA256Hex is the hex-encoded SHA256 checksum that the downloaded file must match (default to no verification).
+	/*
+		ResumePartial continues from the partially downloaded file left behind by an earlier download of the same URL.
+		Each URL has its own partial file, so that a download never resumes from the partial file of another URL.
+		Downloads always resume from where the previous attempt left off, regardless of this option.
+	*/
+	ResumePartial bool
+	// ProgressFunc, if not nil, is called with the number of bytes received so far and the file size (-1 if unknown).
+	ProgressFunc func(received, total int64)
+}
+
+// ErrChecksumMismatch is returned by DownloadFile when the downloaded file does not match the expected checksum.
+var ErrChecksumMismatch = errors.New("the downloaded file does not match the expected checksum")
+
+// errFileTooLarge is returned by progressWriter when the file exceeds the size limit.
+var errFileTooLarge = errors.New("the file exceeds the size limit")
+
+// progressWriter writes to a file and reports the download progress after each write.
+type progressWriter struct {
+	file     *os.File
+	received int64
+	total    int64
+	maxBytes int64
+	progress func(received, total int64)
+}
+
+func (writer *progressWriter) Write(b []byte) (int, error) {
+	if writer.maxBytes > 0 && writer.received+int64(len(b)) > writer.maxBytes {
+		return 0, errFileTooLarge
+	}
+	n, err := writer.file.Write(b)
+	writer.received += int64(n)
+	if writer.progress != nil {
+		writer.progress(writer.received, writer.total)
+	}
+	return n, err
+}
+
+/*
+partialFilePath returns the path of the partial file of the download. A partial file kept for resuming is named after
+the URL too, e.g. "DestPath.0123456789abcdef.part".
+*/
+func partialFilePath(destPath, fileURL string, resumePartial bool) string {
+	if !resumePartial {
+		return destPath + ".part"
+	}
+	digest := sha256.Sum256([]byte(fileURL))
+	return destPath + "." + hex.EncodeToString(digest[:8]) + ".part"
+}
+
+/*
+DownloadFile downloads the file at the URL and saves it in the destination path. The download is saved in a partial
+file ("DestPath.part") first, and each retry attempt resumes from where the previous attempt left off using a range
+request. Upon completion the checksum is verified and the partial file is renamed to the destination path. The
+function returns the size of the downloaded file.
+*/
+func DownloadFile(dl DownloadRequest, fileURL string) (size int64, err error) {
+	if dl.DestPath == "" {
+		return 0, errors.New("DownloadFile: destination path must not be empty")
+	}
+	if dl.HTTPRequest.TimeoutSec <= 0 {
+		dl.HTTPRequest.TimeoutSec = 15 * 60
+	}
+	if dl.HTTPRequest.MaxRetry < 1 {
+		dl.HTTPRequest.MaxRetry = 5
+	}
+	maxBytes := int64(dl.HTTPRequest.MaxBytes)
+	dl.HTTPRequest.FillBlanks()
+	partPath := partialFilePath(dl.DestPath, fileURL, dl.ResumePartial)
+	if !dl.ResumePartial {
+		if err = os.Remove(partPath); err != nil && !os.IsNotExist(err) {
+			return 0, fmt.Errorf("DownloadFile: failed to remove partial file - %v", err)
+		}
+	}
+	req, err := http.NewRequest(http.MethodGet, fileURL, nil)
+	if err != nil {
+		return 0, fmt.Errorf("DownloadFile: %v", err)
+	}
+	if dl.HTTPRequest.Context != nil {
+		req = req.WithContext(dl.HTTPRequest.Context)
+	}
+	if dl.HTTPRequest.Header != nil {
+		req.Header = dl.HTTPRequest.Header.Clone()
+	}
+	if dl.HTTPRequest.RequestFunc != nil {
+		if err = dl.HTTPRequest.RequestFunc(req); err != nil {
+			return 0, fmt.Errorf("DownloadFile: %v", err)
+		}
+	}
+	client, err := dl.HTTPRequest.newClient(req.URL.Hostname())
+	if err != nil {
+		return 0, fmt.Errorf("DownloadFile: %v", err)
+	}
+	defer client.CloseIdleConnections()
+	for attempt := 0; attempt < dl.HTTPRequest.MaxRetry; attempt++ {
+		if attempt > 0 {
+			if err = dl.HTTPRequest.waitForRetry(attempt); err != nil {
+				break
+			}
+		}
+		if !dl.HTTPRequest.CircuitBreaker.Allow(req.URL.Host) {
+			if attempt == 0 {
+				err = ErrCircuitOpen
+			}
+			break
+		}
+		var retry bool
+		retry, err = dl.downloadPart(client, req, partPath, maxBytes)
+		if err == nil || !retry {
+			break
+		}
+	}
+	if err != nil {
+		if !dl.ResumePartial {
+			_ = os.Remove(partPath)
+		}
+		return 0, fmt.Errorf("DownloadFile: failed to download %s - %v", fileURL, err)
+	}
+	if size, err = dl.verifyChecksum(partPath); err != nil {
+		_ = os.Remove(partPath)
+		return 0, fmt.Errorf("DownloadFile: %v", err)
+	}
+	if err = os.Rename(partPath, dl.DestPath); err != nil {
+		return 0, fmt.Errorf("DownloadFile: failed to save file - %v", err)
+	}
+	return size, nil
+}
+
+/*
+downloadPart makes a single attempt to download the remainder of the partial file. If the attempt fails, it returns
+the error and whether another attempt is worthwhile.
+*/
+func (dl *DownloadRequest) downloadPart(client *http.Client, req *http.Request, partPath string, maxBytes int64) (retry bool, err error) {
+	file, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return false, fmt.Errorf("failed to open partial file - %v", err)
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil && closeErr != nil {
+			retry, err = false, fmt.Errorf("failed to save partial file - %v", closeErr)
+		}
+	}()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, err
+	}
+	req = req.Clone(req.Context())
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if req.Context().Err() != nil {
+			dl.HTTPRequest.CircuitBreaker.Cancel(req.URL.Host)
+			return false, err
+		}
+		dl.HTTPRequest.CircuitBreaker.Record(req.URL.Host, false)
+		return true, err
+	}
+	defer resp.Body.Close()
+	dl.HTTPRequest.CircuitBreaker.Record(req.URL.Host, resp.StatusCode/500 != 1)
+	total := int64(-1)
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		// Content-Range: bytes 1000-1999/2000
+		if start := strings.TrimPrefix(resp.Header.Get("Content-Range"), "bytes "); !strings.HasPrefix(start, strconv.FormatInt(offset, 10)+"-") {
+			// Start over if the server does not continue from the end of the partial file
+			return true, fileTruncate(file, fmt.Errorf("unexpected content range \"%s\"", resp.Header.Get("Content-Range")))
+		}
+		if slash := strings.LastIndexByte(resp.Header.Get("Content-Range"), '/'); slash != -1 {
+			if parsedTotal, err := strconv.ParseInt(resp.Header.Get("Content-Range")[slash+1:], 10, 64); err == nil {
+				total = parsedTotal
+			}
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// The partial file may have been complete already, or it belongs to a different version of the file.
+		return true, fileTruncate(file, errors.New("the server cannot resume the partial download"))
+	case resp.StatusCode/200 == 1:
+		// The server sends the entire file
+		if err := fileTruncate(file, nil); err != nil {
+			return false, err
+		}
+		offset = 0
+		if resp.ContentLength >= 0 {
+			total = resp.ContentLength
+		}
+	default:
+		return true, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	if maxBytes > 0 && total > maxBytes {
+		return false, errFileTooLarge
+	}
+	writer := &progressWriter{file: file, received: offset, total: total, maxBytes: maxBytes, progress: dl.ProgressFunc}
+	if _, err = io.Copy(writer, resp.Body); err != nil {
+		return err != errFileTooLarge, err
+	}
+	if total >= 0 && writer.received != total {
+		return true, fmt.Errorf("received %d bytes out of %d", writer.received, total)
+	}
+	return false, nil
+}
+
+// fileTruncate empties the partial file, and returns the error that caused the partial file to be discarded.
+func fileTruncate(file *os.File, cause error) error {
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return cause
+}
+
+// verifyChecksum returns the size of the downloaded file, and an error if the file does not match the expected checksum.
+func (dl *DownloadRequest) verifyChecksum(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	digest := sha256.New()
+	size, err := io.Copy(digest, file)
+	if err != nil {
+		return 0, err
+	}
+	if dl.SHA256Hex != "" && !strings.EqualFold(hex.EncodeToString(digest.Sum(nil)), strings.TrimSpace(dl.SHA256Hex)) {
+		return 0, ErrChecksumMismatch
+	}
+	return size, nil
+}
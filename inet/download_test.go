@@ -0,0 +1,102 @@
+package inet
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDownloadFile(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 100000)
+	digest := sha256.Sum256(content)
+	checksum := hex.EncodeToString(digest[:])
+	// The server aborts the first response half way, and then serves the file with support for range requests.
+	var requests, rangeRequests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Range") != "" {
+			rangeRequests++
+		}
+		if requests == 1 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			_, _ = w.Write(content[:len(content)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	defer srv.Close()
+
+	tmpDir, err := ioutil.TempDir("", "laitos-TestDownloadFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	destPath := path.Join(tmpDir, "file")
+	var lastReceived, lastTotal int64
+	size, err := DownloadFile(DownloadRequest{
+		HTTPRequest: HTTPRequest{RetryBackoffMS: 10, CircuitBreaker: &CircuitBreaker{}},
+		DestPath:    destPath,
+		SHA256Hex:   checksum,
+		ProgressFunc: func(received, total int64) {
+			lastReceived, lastTotal = received, total
+		},
+	}, srv.URL)
+	if err != nil || size != int64(len(content)) {
+		t.Fatal(err, size)
+	}
+	if requests != 2 || rangeRequests != 1 || lastReceived != int64(len(content)) || lastTotal != int64(len(content)) {
+		t.Fatal(requests, rangeRequests, lastReceived, lastTotal)
+	}
+	if downloaded, err := ioutil.ReadFile(destPath); err != nil || !bytes.Equal(downloaded, content) {
+		t.Fatal(err, len(downloaded))
+	}
+	if _, err := os.Stat(destPath + ".part"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+
+	// Resume from a partial file left behind by an earlier download
+	if err := ioutil.WriteFile(partialFilePath(destPath, srv.URL, true), content[:1000], 0600); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := DownloadFile(DownloadRequest{DestPath: destPath, ResumePartial: true, SHA256Hex: checksum}, srv.URL); err != nil || size != int64(len(content)) || rangeRequests != 2 {
+		t.Fatal(err, size, rangeRequests)
+	}
+	// The partial file left behind by the download of another URL is not resumed
+	otherURL := srv.URL + "/other"
+	if partialFilePath(destPath, otherURL, true) == partialFilePath(destPath, srv.URL, true) {
+		t.Fatal("partial files of different URLs must not share the same path")
+	}
+	if err := ioutil.WriteFile(partialFilePath(destPath, otherURL, true), []byte("garbage"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if size, err := DownloadFile(DownloadRequest{DestPath: destPath, ResumePartial: true}, srv.URL); err != nil || size != int64(len(content)) || rangeRequests != 2 {
+		t.Fatal(err, size, rangeRequests)
+	}
+	if downloaded, err := ioutil.ReadFile(destPath); err != nil || !bytes.Equal(downloaded, content) {
+		t.Fatal(err, len(downloaded))
+	}
+
+	// Checksum mismatch and size limit
+	if _, err := DownloadFile(DownloadRequest{DestPath: destPath + "2", SHA256Hex: strings.Repeat("0", 64)}, srv.URL); err == nil || !strings.Contains(err.Error(), ErrChecksumMismatch.Error()) {
+		t.Fatal(err)
+	}
+	if _, err := DownloadFile(DownloadRequest{HTTPRequest: HTTPRequest{MaxBytes: 1000}, DestPath: destPath + "2"}, srv.URL); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := os.Stat(destPath + "2"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(destPath + "2.part"); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,96 @@
+package inet
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned by DoHTTP without making the request, when the destination host has failed too many times in a row.
+var ErrCircuitOpen = errors.New("the destination host failed too many times in a row, it will be tried again later")
+
+/*
+CircuitBreaker tracks consecutive failures (IO errors and 5xx responses) of each destination host. After the number of
+consecutive failures reaches the threshold, the host's circuit opens and requests to the host are rejected until the
+open duration elapses. Afterwards a single probe request is let through, its success closes the circuit, and its
+failure opens the circuit once again.
+*/
+type CircuitBreaker struct {
+	FailureThreshold int           // FailureThreshold is the number of consecutive failures that opens the circuit of a host, 0 disables the breaker.
+	OpenDuration     time.Duration // OpenDuration is how long requests to the host are rejected after its circuit opens.
+
+	mutex sync.Mutex
+	hosts map[string]*hostCircuit
+}
+
+// hostCircuit is the circuit state of a single destination host.
+type hostCircuit struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+/*
+DefaultCircuitBreaker is used by HTTP requests that do not specify their own CircuitBreaker. It opens the circuit of a
+host after 10 consecutive failures, and lets a probe request through a minute later.
+*/
+var DefaultCircuitBreaker = &CircuitBreaker{FailureThreshold: 10, OpenDuration: 60 * time.Second}
+
+// Allow returns true if a request may be made to the host, which is the case unless the host's circuit is open.
+func (breaker *CircuitBreaker) Allow(host string) bool {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	circuit, exists := breaker.hosts[host]
+	if !exists || breaker.FailureThreshold < 1 || circuit.failures < breaker.FailureThreshold {
+		return true
+	}
+	if circuit.probing || time.Now().Before(circuit.openUntil) {
+		return false
+	}
+	// The open duration has elapsed, let a single request through to probe the host.
+	circuit.probing = true
+	return true
+}
+
+// Record memorises the outcome of a request made to the host.
+func (breaker *CircuitBreaker) Record(host string, success bool) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	if success || breaker.FailureThreshold < 1 {
+		delete(breaker.hosts, host)
+		return
+	}
+	if breaker.hosts == nil {
+		breaker.hosts = make(map[string]*hostCircuit)
+	}
+	circuit, exists := breaker.hosts[host]
+	if !exists {
+		circuit = &hostCircuit{}
+		breaker.hosts[host] = circuit
+	}
+	circuit.failures++
+	circuit.probing = false
+	if circuit.failures >= breaker.FailureThreshold {
+		circuit.openUntil = time.Now().Add(breaker.OpenDuration)
+	}
+}
+
+/*
+Cancel memorises that a request made to the host was abandoned by its caller before the outcome is known, which says
+nothing about the health of the host. If the request was a probe, the next request is let through as the probe instead.
+*/
+func (breaker *CircuitBreaker) Cancel(host string) {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	if circuit, exists := breaker.hosts[host]; exists {
+		circuit.probing = false
+	}
+}
+
+// IsOpen returns true if requests to the host are currently rejected.
+func (breaker *CircuitBreaker) IsOpen(host string) bool {
+	breaker.mutex.Lock()
+	defer breaker.mutex.Unlock()
+	circuit, exists := breaker.hosts[host]
+	return exists && breaker.FailureThreshold > 0 && circuit.failures >= breaker.FailureThreshold && (circuit.probing || time.Now().Before(circuit.openUntil))
+}
@@ -0,0 +1,147 @@
+package inet
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := &CircuitBreaker{FailureThreshold: 2, OpenDuration: 500 * time.Millisecond}
+	if !breaker.Allow("host") || breaker.IsOpen("host") {
+		t.Fatal("should allow")
+	}
+	// The circuit opens after two consecutive failures
+	breaker.Record("host", false)
+	if !breaker.Allow("host") {
+		t.Fatal("should allow")
+	}
+	breaker.Record("host", false)
+	if breaker.Allow("host") || !breaker.IsOpen("host") || !breaker.Allow("other-host") {
+		t.Fatal("should not allow")
+	}
+	// After the open duration, a single probe is let through, and its failure opens the circuit again.
+	time.Sleep(600 * time.Millisecond)
+	if !breaker.Allow("host") || breaker.Allow("host") {
+		t.Fatal("should allow exactly one probe")
+	}
+	breaker.Record("host", false)
+	if breaker.Allow("host") {
+		t.Fatal("should not allow")
+	}
+	// A successful probe closes the circuit
+	time.Sleep(600 * time.Millisecond)
+	if !breaker.Allow("host") {
+		t.Fatal("should allow")
+	}
+	breaker.Record("host", true)
+	if !breaker.Allow("host") || !breaker.Allow("host") || breaker.IsOpen("host") {
+		t.Fatal("should allow")
+	}
+	// A cancelled probe lets the next request through as the probe
+	breaker.Record("host", false)
+	breaker.Record("host", false)
+	time.Sleep(600 * time.Millisecond)
+	if !breaker.Allow("host") || breaker.Allow("host") {
+		t.Fatal("should allow exactly one probe")
+	}
+	breaker.Cancel("host")
+	breaker.Cancel("other-host")
+	if !breaker.Allow("host") || breaker.Allow("host") {
+		t.Fatal("should allow exactly one probe")
+	}
+	// Zero threshold disables the breaker
+	disabled := &CircuitBreaker{}
+	for i := 0; i < 10; i++ {
+		disabled.Record("host", false)
+	}
+	if !disabled.Allow("host") || disabled.IsOpen("host") {
+		t.Fatal("should allow")
+	}
+}
+
+func TestGetRetryBackoff(t *testing.T) {
+	req := HTTPRequest{RetryBackoffMS: 100, MaxRetryBackoffMS: 350}
+	req.FillBlanks()
+	for attempt, maxDelay := range []time.Duration{0, 100, 200, 350, 350} {
+		if attempt == 0 {
+			continue
+		}
+		delay := req.getRetryBackoff(attempt)
+		if delay > maxDelay*time.Millisecond || delay < maxDelay*time.Millisecond/2 {
+			t.Fatal(attempt, delay)
+		}
+	}
+	req = HTTPRequest{RetryBackoffMS: 50000}
+	req.FillBlanks()
+	if req.MaxRetryBackoffMS != 50000 {
+		t.Fatal(req.MaxRetryBackoffMS)
+	}
+}
+
+func TestDoHTTPCircuitBreaker(t *testing.T) {
+	// Create a test server that always responds with HTTP 503
+	requestsServed := 0
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requestsServed++
+			http.Error(w, "unavailable", 503)
+		}))
+	}()
+	serverURL := fmt.Sprintf("http://localhost:%d/endpoint", listener.Addr().(*net.TCPAddr).Port)
+	breaker := &CircuitBreaker{FailureThreshold: 4, OpenDuration: time.Minute}
+	req := HTTPRequest{RetryBackoffMS: 10, CircuitBreaker: breaker}
+	// The first request fails in all three attempts
+	resp, err := DoHTTP(req, serverURL)
+	if err != nil || resp.StatusCode != 503 || requestsServed != 3 {
+		t.Fatal(err, resp.StatusCode, requestsServed)
+	}
+	// The second request opens the circuit after its first attempt, and returns the outcome of the attempt.
+	resp, err = DoHTTP(req, serverURL)
+	if err != nil || resp.StatusCode != 503 || requestsServed != 4 {
+		t.Fatal(err, resp.StatusCode, requestsServed)
+	}
+	// Further requests do not reach the server
+	if _, err = DoHTTP(req, serverURL); err != ErrCircuitOpen || requestsServed != 4 {
+		t.Fatal(err, requestsServed)
+	}
+}
+
+func TestDoHTTPCircuitBreakerCancelledProbe(t *testing.T) {
+	// Create a test server that does not respond until the client gives up
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		_ = http.Serve(listener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+		}))
+	}()
+	host := fmt.Sprintf("localhost:%d", listener.Addr().(*net.TCPAddr).Port)
+	breaker := &CircuitBreaker{FailureThreshold: 1, OpenDuration: 100 * time.Millisecond}
+	breaker.Record(host, false)
+	time.Sleep(200 * time.Millisecond)
+	// The probe request is cancelled by its caller
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := DoHTTP(HTTPRequest{Context: ctx, CircuitBreaker: breaker}, "http://"+host+"/endpoint"); err == nil {
+		t.Fatal("should have failed")
+	}
+	// The circuit must not stay half-open forever, the next request probes the host again.
+	if breaker.IsOpen(host) || !breaker.Allow(host) {
+		t.Fatal("should allow another probe")
+	}
+}
@@ -0,0 +1,262 @@
+package inet
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+/*
+DefaultProxyURL is the proxy used by HTTP requests that do not specify their own ProxyURL, it is empty by default which
+means HTTP requests connect to their destination directly. See HTTPRequest.ProxyURL for the supported proxy types.
+*/
+var DefaultProxyURL string
+
+// ProxyDialTimeoutSec is the timeout of connecting to a SOCKS5 or sockd proxy and completing its handshake.
+const ProxyDialTimeoutSec = 30
+
+// setProxy configures the HTTP transport to make its connections via the proxy.
+func setProxy(transport *http.Transport, proxyURL string) error {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return fmt.Errorf("setProxy: failed to parse proxy URL - %v", err)
+	}
+	if u.Hostname() == "" || u.Port() == "" {
+		return fmt.Errorf("setProxy: proxy URL must contain both host and port")
+	}
+	password, _ := u.User.Password()
+	switch u.Scheme {
+	case "http", "https":
+		// The transport converses with HTTP proxies on its own, and uses CONNECT method for HTTPS destinations.
+		transport.Proxy = http.ProxyURL(u)
+	case "socks5":
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialSOCKS5(ctx, u.Host, u.User.Username(), password, addr)
+		}
+	case "sockd":
+		if password == "" {
+			// Allow the password to be written in the place of user name, e.g. sockd://password@host:port
+			password = u.User.Username()
+		}
+		transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialSockd(ctx, u.Host, password, addr)
+		}
+	default:
+		return fmt.Errorf("setProxy: unsupported proxy scheme \"%s\", it must be http, https, socks5, or sockd", u.Scheme)
+	}
+	return nil
+}
+
+// dialProxy connects to the proxy server, and sets the deadline of the proxy handshake.
+func dialProxy(ctx context.Context, proxyAddr string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: ProxyDialTimeoutSec * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(ProxyDialTimeoutSec * time.Second)); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// encodeAddress encodes the destination "host:port" in the format used by both SOCKS5 (RFC 1928 section 5) and sockd.
+func encodeAddress(addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("invalid port number in %s", addr)
+	}
+	var ret []byte
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		ret = append([]byte{1}, ip.To4()...)
+	} else if ip != nil {
+		ret = append([]byte{4}, ip.To16()...)
+	} else if len(host) > 255 {
+		return nil, fmt.Errorf("host name is too long in %s", addr)
+	} else {
+		ret = append([]byte{3, byte(len(host))}, host...)
+	}
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, uint16(port))
+	return append(ret, portBytes...), nil
+}
+
+// dialSOCKS5 connects to the destination via a SOCKS5 proxy, optionally authenticating with user name and password (RFC 1929).
+func dialSOCKS5(ctx context.Context, proxyAddr, user, password, addr string) (net.Conn, error) {
+	destAddr, err := encodeAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialProxy(ctx, proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	err = func() error {
+		// Offer "no authentication" or "user name and password" authentication
+		method := byte(0)
+		if user != "" {
+			method = 2
+		}
+		if _, err := conn.Write([]byte{5, 1, method}); err != nil {
+			return err
+		}
+		resp := make([]byte, 2)
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return err
+		}
+		if resp[0] != 5 || resp[1] != method {
+			return errors.New("the SOCKS5 proxy did not accept the authentication method")
+		}
+		if method == 2 {
+			if len(user) > 255 || len(password) > 255 {
+				return errors.New("the SOCKS5 user name and password must not exceed 255 characters")
+			}
+			auth := append([]byte{1, byte(len(user))}, user...)
+			auth = append(append(auth, byte(len(password))), password...)
+			if _, err := conn.Write(auth); err != nil {
+				return err
+			}
+			if _, err := io.ReadFull(conn, resp); err != nil {
+				return err
+			}
+			if resp[1] != 0 {
+				return errors.New("the SOCKS5 proxy rejected the user name and password")
+			}
+		}
+		// Ask the proxy to connect to the destination
+		if _, err := conn.Write(append([]byte{5, 1, 0}, destAddr...)); err != nil {
+			return err
+		}
+		reply := make([]byte, 4)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return fmt.Errorf("the SOCKS5 proxy failed to connect to %s (reply code %d)", addr, reply[1])
+		}
+		// Discard the bound address and port
+		var boundAddrLen int
+		switch reply[3] {
+		case 1:
+			boundAddrLen = net.IPv4len
+		case 4:
+			boundAddrLen = net.IPv6len
+		case 3:
+			lenByte := make([]byte, 1)
+			if _, err := io.ReadFull(conn, lenByte); err != nil {
+				return err
+			}
+			boundAddrLen = int(lenByte[0])
+		default:
+			return fmt.Errorf("the SOCKS5 proxy replied with unknown address type %d", reply[3])
+		}
+		_, err := io.ReadFull(conn, make([]byte, boundAddrLen+2))
+		return err
+	}()
+	if err == nil {
+		// The proxy handshake is complete, the HTTP client takes care of the timeouts from now on.
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("dialSOCKS5: %v", err)
+	}
+	return conn, nil
+}
+
+// sockdConn encrypts and decrypts the conversation with a laitos sockd proxy.
+type sockdConn struct {
+	net.Conn
+	key       []byte
+	encrypter cipher.Stream
+	decrypter cipher.Stream
+}
+
+// getSockdKey derives the 32-byte encryption key from the sockd password, in the same way as sockd does.
+func getSockdKey(password string) []byte {
+	// MD5-based key derivation is what sockd clients and server have in common, it is not meant to be strong.
+	first := md5.Sum([]byte(password))
+	second := md5.Sum(append(first[:], password...))
+	return append(first[:], second[:]...)
+}
+
+// Write encrypts the data, the first write also sends the random initialisation vector.
+func (conn *sockdConn) Write(b []byte) (int, error) {
+	var buf []byte
+	if conn.encrypter == nil {
+		iv := make([]byte, aes.BlockSize)
+		if _, err := rand.Read(iv); err != nil {
+			return 0, err
+		}
+		block, err := aes.NewCipher(conn.key)
+		if err != nil {
+			return 0, err
+		}
+		conn.encrypter = cipher.NewCTR(block, iv)
+		buf = iv
+	}
+	encrypted := make([]byte, len(b))
+	conn.encrypter.XORKeyStream(encrypted, b)
+	if _, err := conn.Conn.Write(append(buf, encrypted...)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Read decrypts the data, the first read also receives the initialisation vector of the proxy.
+func (conn *sockdConn) Read(b []byte) (int, error) {
+	if conn.decrypter == nil {
+		iv := make([]byte, aes.BlockSize)
+		if _, err := io.ReadFull(conn.Conn, iv); err != nil {
+			return 0, err
+		}
+		block, err := aes.NewCipher(conn.key)
+		if err != nil {
+			return 0, err
+		}
+		conn.decrypter = cipher.NewCTR(block, iv)
+	}
+	n, err := conn.Conn.Read(b)
+	if n > 0 {
+		conn.decrypter.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+// dialSockd connects to the destination via the TCP port of a laitos sockd proxy.
+func dialSockd(ctx context.Context, proxyAddr, password, addr string) (net.Conn, error) {
+	destAddr, err := encodeAddress(addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := dialProxy(ctx, proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	ret := &sockdConn{Conn: conn, key: getSockdKey(password)}
+	// The destination address comes first, there is no response from sockd until the destination responds.
+	if _, err = ret.Write(destAddr); err == nil {
+		err = conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("dialSockd: %v", err)
+	}
+	return ret, nil
+}
@@ -0,0 +1,129 @@
+package inet
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// ErrPinMismatch is returned when the server certificate does not match any of the pinned public keys.
+var ErrPinMismatch = errors.New("the server certificate does not match any of the pinned public keys")
+
+/*
+DefaultTLSTrust is the certificate trust used by HTTPS requests that specify neither TLSConfig nor InsecureTLS. It is
+nil by default, which means the requests trust the system certificate authorities only.
+*/
+var DefaultTLSTrust *TLSTrust
+
+/*
+TLSTrust customises the certificate verification of outbound HTTPS requests, by trusting additional certificate
+authorities, and by pinning the public keys of specific hosts.
+*/
+type TLSTrust struct {
+	// CABundlePaths are the PEM files of certificate authorities to trust in addition to the system ones.
+	CABundlePaths []string `json:"CABundlePaths"`
+	/*
+		PinnedPublicKeys map host names to the base64-encoded SHA256 digests of the SubjectPublicKeyInfo of certificates
+		trusted to identify the host. In addition to passing the usual verification by certificate authorities, the
+		certificate chain of a pinned host must include a certificate of a pinned public key. To pin a self-signed
+		certificate, trust it via CABundlePaths too.
+	*/
+	PinnedPublicKeys map[string][]string `json:"PinnedPublicKeys"`
+
+	rootCAs *x509.CertPool
+	pins    map[string]map[string]bool
+}
+
+// Initialise loads the certificate authority bundles and decodes the pinned public keys.
+func (trust *TLSTrust) Initialise() error {
+	trust.rootCAs = nil
+	if len(trust.CABundlePaths) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		for _, path := range trust.CABundlePaths {
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return fmt.Errorf("TLSTrust.Initialise: failed to read CA bundle - %v", err)
+			}
+			if !pool.AppendCertsFromPEM(content) {
+				return fmt.Errorf("TLSTrust.Initialise: CA bundle \"%s\" does not contain a PEM certificate", path)
+			}
+		}
+		trust.rootCAs = pool
+	}
+	trust.pins = make(map[string]map[string]bool)
+	for host, hostPins := range trust.PinnedPublicKeys {
+		pins, err := ParsePublicKeyPins(hostPins)
+		if err != nil {
+			return fmt.Errorf("TLSTrust.Initialise: %v", err)
+		}
+		trust.pins[strings.ToLower(host)] = pins
+	}
+	return nil
+}
+
+/*
+GetTLSConfig returns the TLS client configuration for connecting to the host. The server certificate is always verified
+by the certificate authorities, and the verified chain of a pinned host must also include a pinned public key.
+*/
+func (trust *TLSTrust) GetTLSConfig(host string) *tls.Config {
+	config := &tls.Config{RootCAs: trust.rootCAs}
+	if pins, exists := trust.pins[strings.ToLower(host)]; exists && len(pins) > 0 {
+		config.VerifyPeerCertificate = func(_ [][]byte, verifiedChains [][]*x509.Certificate) error {
+			for _, chain := range verifiedChains {
+				for _, cert := range chain {
+					if digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo); pins[string(digest[:])] {
+						return nil
+					}
+				}
+			}
+			return ErrPinMismatch
+		}
+	}
+	return config
+}
+
+// ParsePublicKeyPins decodes the base64-encoded SHA256 digests of public keys into a set of digests.
+func ParsePublicKeyPins(pins []string) (map[string]bool, error) {
+	ret := make(map[string]bool)
+	for _, pin := range pins {
+		digest, err := base64.StdEncoding.DecodeString(strings.TrimSpace(pin))
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("pinned public key \"%s\" must be a base64-encoded SHA256 digest", pin)
+		}
+		ret[string(digest)] = true
+	}
+	return ret, nil
+}
+
+/*
+GetPinnedTLSConfig returns a TLS client configuration that only trusts a server whose leaf certificate carries a pinned
+public key, regardless of the certificate authority. Only the leaf certificate is considered, because the server
+proves the possession of its key alone - the other certificates of the chain are public and anyone may present them.
+*/
+func GetPinnedTLSConfig(pins map[string]bool) *tls.Config {
+	return &tls.Config{
+		// The pinned public keys establish the server identity, which makes self-signed certificates acceptable too.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return ErrPinMismatch
+			}
+			leaf, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			if digest := sha256.Sum256(leaf.RawSubjectPublicKeyInfo); !pins[string(digest[:])] {
+				return ErrPinMismatch
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,163 @@
+package inet
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// makeTestCertificate returns a self-signed certificate of 127.0.0.1 along with its key.
+func makeTestCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}
+}
+
+// dialTLS makes a TLS handshake with a server that presents the certificate chain, and returns the handshake error.
+func dialTLS(t *testing.T, serverCert tls.Certificate, clientConfig *tls.Config) error {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{serverCert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_ = conn.(*tls.Conn).Handshake()
+		_ = conn.Close()
+	}()
+	conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func TestGetPinnedTLSConfig(t *testing.T) {
+	pinned := makeTestCertificate(t)
+	foreign := makeTestCertificate(t)
+	digest := sha256.Sum256(pinned.Leaf.RawSubjectPublicKeyInfo)
+	pins := map[string]bool{string(digest[:]): true}
+	if err := dialTLS(t, pinned, GetPinnedTLSConfig(pins)); err != nil {
+		t.Fatal(err)
+	}
+	if err := dialTLS(t, foreign, GetPinnedTLSConfig(pins)); err == nil || !strings.Contains(err.Error(), ErrPinMismatch.Error()) {
+		t.Fatal(err)
+	}
+	// A foreign leaf followed by the pinned certificate, which is public, must not be trusted.
+	impostor := tls.Certificate{Certificate: [][]byte{foreign.Certificate[0], pinned.Certificate[0]}, PrivateKey: foreign.PrivateKey}
+	if err := dialTLS(t, impostor, GetPinnedTLSConfig(pins)); err == nil || !strings.Contains(err.Error(), ErrPinMismatch.Error()) {
+		t.Fatal(err)
+	}
+}
+
+func TestTLSTrust(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("trusted"))
+	}))
+	defer srv.Close()
+	defer func() {
+		DefaultTLSTrust = nil
+	}()
+	cert := srv.Certificate()
+	digest := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	goodPin := base64.StdEncoding.EncodeToString(digest[:])
+	badPin := base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+
+	// The test server certificate is not trusted by default
+	req := HTTPRequest{MaxRetry: 1, CircuitBreaker: &CircuitBreaker{}}
+	if _, err := DoHTTP(req, srv.URL); err == nil {
+		t.Fatal("did not error")
+	}
+
+	// Trust the test server via a CA bundle
+	bundle, err := ioutil.TempFile("", "laitos-TestTLSTrust")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(bundle.Name())
+	if err := pem.Encode(bundle, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+		t.Fatal(err)
+	}
+	_ = bundle.Close()
+	DefaultTLSTrust = &TLSTrust{CABundlePaths: []string{bundle.Name()}}
+	if err := DefaultTLSTrust.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := DoHTTP(req, srv.URL); err != nil || string(resp.Body) != "trusted" {
+		t.Fatal(err, string(resp.Body))
+	}
+
+	// A pinned host must pass the verification by certificate authorities too
+	DefaultTLSTrust = &TLSTrust{PinnedPublicKeys: map[string][]string{"127.0.0.1": {goodPin}}}
+	if err := DefaultTLSTrust.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DoHTTP(req, srv.URL); err == nil || strings.Contains(err.Error(), ErrPinMismatch.Error()) {
+		t.Fatal(err)
+	}
+	// Pin the public key of the test server
+	DefaultTLSTrust = &TLSTrust{CABundlePaths: []string{bundle.Name()}, PinnedPublicKeys: map[string][]string{"127.0.0.1": {badPin}}}
+	if err := DefaultTLSTrust.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DoHTTP(req, srv.URL); err == nil || !strings.Contains(err.Error(), ErrPinMismatch.Error()) {
+		t.Fatal(err)
+	}
+	DefaultTLSTrust = &TLSTrust{CABundlePaths: []string{bundle.Name()}, PinnedPublicKeys: map[string][]string{"127.0.0.1": {badPin, goodPin}}}
+	if err := DefaultTLSTrust.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if resp, err := DoHTTP(req, srv.URL); err != nil || string(resp.Body) != "trusted" {
+		t.Fatal(err, string(resp.Body))
+	}
+
+	// Bad configuration
+	for _, trust := range []TLSTrust{
+		{CABundlePaths: []string{"/this/file/does/not/exist"}},
+		{CABundlePaths: []string{"/dev/null"}},
+		{PinnedPublicKeys: map[string][]string{"example.com": {"bad"}}},
+	} {
+		if err := trust.Initialise(); err == nil {
+			t.Fatalf("%+v", trust)
+		}
+	}
+}
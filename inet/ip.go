@@ -1,13 +1,20 @@
 package inet
 
 import (
+	"net"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/HouzuoGuo/laitos/lalog"
 )
 
-// HTTPPublicIPTimeoutSec is the timeout in seconds used when determining public IP and cloud detection.
-const HTTPPublicIPTimeoutSec = 10
+const (
+	// HTTPPublicIPTimeoutSec is the timeout in seconds used when determining public IP and cloud detection.
+	HTTPPublicIPTimeoutSec = 10
+	// PublicIPCacheTTLSec is the duration in seconds for which a discovered public IP address is reused.
+	PublicIPCacheTTLSec = 3 * 60
+)
 
 var (
 	// isAWS is true only if IsAWS function has determined that the program is running on Amazon Web Service.
@@ -26,12 +33,12 @@ var (
 	isAlibaba     bool
 	isAlibabaOnce = new(sync.Once)
 
-	// lastIP is the latest public IP retrieved recently.
-	lastPublicIP string
-	//lastIPMutex protects last public IP from concurrent modifcation.
-	lastPublicIPMutex = new(sync.Mutex)
-	// lastIPTimeStamp is the time at which the last public IP was determined.
-	lastPublicIPTimeStamp time.Time
+	// publicIPv4 and publicIPv6 memorise the public IP addresses discovered recently.
+	publicIPv4 = &publicIPCache{mutex: new(sync.Mutex)}
+	publicIPv6 = &publicIPCache{mutex: new(sync.Mutex), ipv6: true}
+
+	// publicIPLogger logs the disagreements among public IP providers.
+	publicIPLogger = lalog.Logger{ComponentName: "inet", ComponentID: []lalog.LoggerIDField{{Key: "Common", Value: "PublicIP"}}}
 )
 
 // IsAWS returns true only if the program is running on Amazon Web Service.
@@ -103,114 +110,184 @@ func IsAlibaba() bool {
 	return isAlibaba
 }
 
+// publicIPProvider retrieves the public IP address of this computer from a single source.
+type publicIPProvider struct {
+	name string
+	// get returns the public IP address, or an empty string if the address cannot be determined.
+	get func() string
+}
+
+// getHTTPText retrieves a short piece of text from the URL, it returns an empty string on failure.
+func getHTTPText(header map[string][]string, url string) string {
+	resp, err := DoHTTP(HTTPRequest{
+		TimeoutSec: HTTPPublicIPTimeoutSec,
+		MaxBytes:   64,
+		Header:     header,
+	}, url)
+	if err != nil || resp.StatusCode/200 != 1 {
+		return ""
+	}
+	return strings.TrimSpace(string(resp.Body))
+}
+
+// getSTUNText asks the STUN server for the public IP address, it returns an empty string on failure.
+func getSTUNText(network, serverAddr string) string {
+	ip, _ := GetPublicIPViaSTUN(network, serverAddr, HTTPPublicIPTimeoutSec)
+	return ip
+}
+
 /*
-getPublicIP is an internal function that determines the public IP address of this computer. If the IP address cannot be
-determined, it will return "0.0.0.0". It may take up to 10 seconds to return.
+getPublicIPProviders returns the sources of public IP address. Cloud metadata endpoints are usually the fastest and
+slightly more reliable, though they are only contacted if the host is actually on public cloud. Otherwise, the
+connection will remain half open for quite a while until OS or router cleans it up.
 */
-func getPublicIP() string {
-	/*
-		Kick off multiple routines to determine public IP at the same time. Each routine uses a different approach, the
-		fastest valid response will be returned to caller. Usually the cloud metadata endpoints are the fastest and slightly
-		more reliable.
-		Avoid contacting cloud metadata endpoints unless the host is actually on public cloud. Otherwise, the connection will
-		remain half open for quite a while until OS or router cleans it up.
-	*/
-	ip := make(chan string, 5)
-	// GCE internal
-	go func() {
-		if IsGCE() {
-			resp, err := DoHTTP(HTTPRequest{
-				TimeoutSec: HTTPPublicIPTimeoutSec,
-				MaxBytes:   64,
-				Header:     map[string][]string{"Metadata-Flavor": {"Google"}},
-			}, "http://169.254.169.254/computeMetadata/v1/instance/network-interfaces/0/access-configs/0/external-ip")
-			if err == nil && resp.StatusCode/200 == 1 {
-				if respBody := strings.TrimSpace(string(resp.Body)); respBody != "" {
-					ip <- respBody
-				}
-			}
+func getPublicIPProviders(ipv6 bool) []publicIPProvider {
+	if ipv6 {
+		return []publicIPProvider{
+			{name: "ipify", get: func() string { return getHTTPText(nil, "https://api6.ipify.org") }},
+			{name: "icanhazip", get: func() string { return getHTTPText(nil, "https://ipv6.icanhazip.com") }},
+			{name: "stun-google", get: func() string { return getSTUNText("udp6", "stun.l.google.com:19302") }},
+			{name: "stun-cloudflare", get: func() string { return getSTUNText("udp6", "stun.cloudflare.com:3478") }},
 		}
-	}()
-	// AWS internal
-	go func() {
-		if IsAWS() {
-			resp, err := DoHTTP(HTTPRequest{
-				TimeoutSec: HTTPPublicIPTimeoutSec,
-				MaxBytes:   64,
-			}, "http://169.254.169.254/2018-03-28/meta-data/public-ipv4")
-			if err == nil && resp.StatusCode/200 == 1 {
-				if respBody := strings.TrimSpace(string(resp.Body)); respBody != "" {
-					ip <- respBody
-				}
+	}
+	return []publicIPProvider{
+		{name: "gce-metadata", get: func() string {
+			if !IsGCE() {
+				return ""
 			}
-		}
-	}()
-	// Azure internal
-	go func() {
-		if IsAzure() {
-			resp, err := DoHTTP(HTTPRequest{
-				TimeoutSec: HTTPPublicIPTimeoutSec,
-				MaxBytes:   64,
-				Header:     map[string][]string{"Metadata": {"true"}},
-			}, "http://169.254.169.254/metadata/instance/network/interface/0/ipv4/ipAddress/0/publicIpAddress?api-version=2017-12-01&format=text")
-			if err == nil && resp.StatusCode/200 == 1 {
-				if respBody := strings.TrimSpace(string(resp.Body)); respBody != "" {
-					ip <- respBody
-				}
+			return getHTTPText(map[string][]string{"Metadata-Flavor": {"Google"}}, "http://169.254.169.254/computeMetadata/v1/instance/network-interfaces/0/access-configs/0/external-ip")
+		}},
+		{name: "aws-metadata", get: func() string {
+			if !IsAWS() {
+				return ""
 			}
-		}
-	}()
-	// AWS public
-	go func() {
-		resp, err := DoHTTP(HTTPRequest{
-			TimeoutSec: HTTPPublicIPTimeoutSec,
-			MaxBytes:   64,
-		}, "http://checkip.amazonaws.com")
-		if err == nil && resp.StatusCode/200 == 1 {
-			if respBody := strings.TrimSpace(string(resp.Body)); respBody != "" {
-				ip <- respBody
+			return getHTTPText(nil, "http://169.254.169.254/2018-03-28/meta-data/public-ipv4")
+		}},
+		{name: "azure-metadata", get: func() string {
+			if !IsAzure() {
+				return ""
 			}
+			return getHTTPText(map[string][]string{"Metadata": {"true"}}, "http://169.254.169.254/metadata/instance/network/interface/0/ipv4/ipAddress/0/publicIpAddress?api-version=2017-12-01&format=text")
+		}},
+		{name: "checkip-aws", get: func() string { return getHTTPText(nil, "https://checkip.amazonaws.com") }},
+		{name: "ipify", get: func() string { return getHTTPText(nil, "https://api.ipify.org") }},
+		{name: "icanhazip", get: func() string { return getHTTPText(nil, "https://ipv4.icanhazip.com") }},
+		{name: "stun-google", get: func() string { return getSTUNText("udp4", "stun.l.google.com:19302") }},
+		{name: "stun-cloudflare", get: func() string { return getSTUNText("udp4", "stun.cloudflare.com:3478") }},
+	}
+}
+
+// isValidPublicIP returns true only if the input is a global unicast address of the desired IP version.
+func isValidPublicIP(ip string, ipv6 bool) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil || !parsed.IsGlobalUnicast() {
+		return false
+	}
+	return (parsed.To4() == nil) == ipv6
+}
+
+/*
+discoverPublicIP races all providers to determine the public IP address of this computer, the fastest valid answer is
+returned to the caller. The slower answers are collected in the background, and a disagreement among the providers is
+logged as a warning because it often indicates a misbehaving provider or a multi-homed network. If the IP address
+cannot be determined, it will return an empty string. It may take up to 10 seconds to return.
+*/
+func discoverPublicIP(providers []publicIPProvider, ipv6 bool) string {
+	type answer struct {
+		provider, ip string
+	}
+	answers := make(chan answer, len(providers))
+	for _, provider := range providers {
+		go func(provider publicIPProvider) {
+			ip := provider.get()
+			if !isValidPublicIP(ip, ipv6) {
+				ip = ""
+			}
+			answers <- answer{provider: provider.name, ip: ip}
+		}(provider)
+	}
+	timeout := time.After(HTTPPublicIPTimeoutSec * time.Second)
+	var first answer
+	numAnswers := 0
+	for first.ip == "" && numAnswers < len(providers) {
+		select {
+		case ans := <-answers:
+			numAnswers++
+			first = ans
+		case <-timeout:
+			return ""
 		}
-	}()
-	// ipfy.org
-	go func() {
-		resp, err := DoHTTP(HTTPRequest{
-			TimeoutSec: HTTPPublicIPTimeoutSec,
-			MaxBytes:   64,
-		}, "https://api.ipify.org")
-		if err == nil && resp.StatusCode/200 == 1 {
-			if respBody := strings.TrimSpace(string(resp.Body)); respBody != "" {
-				ip <- respBody
+	}
+	if first.ip == "" {
+		return ""
+	}
+	// Compare the remaining answers against the fastest one
+	go func(numAnswers int) {
+		agreed := []string{first.provider}
+		var disagreed []string
+		for ; numAnswers < len(providers); numAnswers++ {
+			select {
+			case ans := <-answers:
+				if ans.ip == first.ip {
+					agreed = append(agreed, ans.provider)
+				} else if ans.ip != "" {
+					disagreed = append(disagreed, ans.provider+"="+ans.ip)
+				}
+			case <-timeout:
+				numAnswers = len(providers)
 			}
 		}
-	}()
-	select {
-	case s := <-ip:
-		return s
-	case <-time.After(HTTPPublicIPTimeoutSec * time.Second):
-		return "0.0.0.0"
+		if len(disagreed) > 0 {
+			publicIPLogger.Counter("PublicIPDisagreements").Increment()
+			publicIPLogger.Warning("discoverPublicIP", "", nil, "using public IP %s determined by %s, though the providers disagree: %s",
+				first.ip, strings.Join(agreed, ","), strings.Join(disagreed, ", "))
+		}
+	}(numAnswers)
+	return first.ip
+}
+
+// publicIPCache memorises the public IP address discovered recently.
+type publicIPCache struct {
+	ip        string
+	timestamp time.Time
+	mutex     *sync.Mutex
+	ipv6      bool
+}
+
+/*
+get returns the cached public IP address, or discovers the latest public IP address if the cache is older than
+PublicIPCacheTTLSec.
+Normally it is quite harmless to retrieve public IP address in short succession, however when laitos host's network
+fails to reach some of the IP address retrieval endpoints, such as when a home server tries to contact cloud metadata
+service on 169.254.169.254, the connection will remain half open for quite a while until the host or router cleans it up.
+Doing so in short succession (e.g. the "phonehome" daemon gets the latest public IP address several times a minute)
+quickly exhausts local port numbers, and the host OS will be incapable of making more outbound TCP connections.
+Therefore, the result is cached even if the discovery fails.
+*/
+func (cache *publicIPCache) get() string {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	if time.Since(cache.timestamp) > PublicIPCacheTTLSec*time.Second {
+		cache.ip = discoverPublicIP(getPublicIPProviders(cache.ipv6), cache.ipv6)
+		cache.timestamp = time.Now()
 	}
+	return cache.ip
 }
 
 /*
-GetPublicIP returns the latest public IP address of the computer. If the IP address cannot be determined, it will return
-an empty string. If the public IP has been determined recently (less than 3 minutes ago), the cached public IP will be
-returned.
+GetPublicIP returns the latest public IPv4 address of the computer. If the IP address cannot be determined, it will
+return an empty string. If the public IP has been determined recently (less than 3 minutes ago), the cached public IP
+will be returned.
 */
 func GetPublicIP() string {
-	/*
-		Normally it is quite harmless to retrieve public IP address in short succession, however when laitos host's network
-		fails to reach some of the IP address retrieval endpoints, such as when a home server tries to contact cloud metadata
-		service on 169.254.169.254, the connection will remain half open for quite a while until the host or router cleans it up.
-		Doing so in short succession (e.g. the "phonehome" daemon gets the latest public IP address several times a minute)
-		quickly exhausts local port numbers, and the host OS will be incapable of making more outbound TCP connections.
-		Therefore, cache the latest public IP address for up to three minutes.
-	*/
-	lastPublicIPMutex.Lock()
-	defer lastPublicIPMutex.Unlock()
-	if time.Now().Unix()-lastPublicIPTimeStamp.Unix() > 3*60 {
-		lastPublicIP = getPublicIP()
-		lastPublicIPTimeStamp = time.Now()
-	}
-	return lastPublicIP
+	return publicIPv4.get()
+}
+
+/*
+GetPublicIPv6 returns the latest public IPv6 address of the computer. If the computer does not have IPv6 connectivity,
+it will return an empty string. If the public IP has been determined recently (less than 3 minutes ago), the cached
+public IP will be returned.
+*/
+func GetPublicIPv6() string {
+	return publicIPv6.get()
 }
@@ -14,6 +14,30 @@ func TestGetPublicIP(t *testing.T) {
 	}
 }
 
+func TestDiscoverPublicIP(t *testing.T) {
+	fixed := func(ip string) func() string {
+		return func() string { return ip }
+	}
+	// The first valid answer wins
+	if ip := discoverPublicIP([]publicIPProvider{{"a", fixed("")}, {"b", fixed("not an IP")}, {"c", fixed("192.0.2.1")}}, false); ip != "192.0.2.1" {
+		t.Fatal(ip)
+	}
+	// Loopback addresses and addresses of the other IP version are not valid answers
+	if ip := discoverPublicIP([]publicIPProvider{{"a", fixed("127.0.0.1")}, {"b", fixed("2001:db8::1")}}, false); ip != "" {
+		t.Fatal(ip)
+	}
+	if ip := discoverPublicIP([]publicIPProvider{{"a", fixed("192.0.2.1")}, {"b", fixed("2001:db8::1")}}, true); ip != "2001:db8::1" {
+		t.Fatal(ip)
+	}
+	// Disagreement does not prevent an answer
+	if ip := discoverPublicIP([]publicIPProvider{{"a", fixed("192.0.2.1")}, {"b", fixed("192.0.2.2")}}, false); ip != "192.0.2.1" && ip != "192.0.2.2" {
+		t.Fatal(ip)
+	}
+	if ip := discoverPublicIP(nil, false); ip != "" {
+		t.Fatal(ip)
+	}
+}
+
 func TestCloudDetection(t *testing.T) {
 	// Just make sure they do not crash
 	IsAWS()
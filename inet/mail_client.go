@@ -10,7 +10,6 @@ import (
 	"net/smtp"
 	"strconv"
 	"strings"
-	"sync/atomic"
 	"time"
 
 	"github.com/HouzuoGuo/laitos/lalog"
@@ -121,6 +120,8 @@ type MailClient struct {
 	MTAPort      int    `json:"MTAPort"`      // Port number of SMTP service on mail transportation agent
 	AuthUsername string `json:"AuthUsername"` // (Optional) Username for plain authentication, if the SMTP server requires it.
 	AuthPassword string `json:"AuthPassword"` // (Optional) Password for plain authentication, if the SMTP server requires it.
+	// DKIMKeys (optional) sign outgoing mails, so that recipients' mail servers are less likely to consider them spam.
+	DKIMKeys []DKIMKey `json:"DKIMKeys"`
 }
 
 // Return true only if all mail parameters are present.
@@ -137,9 +138,9 @@ func (client *MailClient) sendMailWithRetry(from string, recipients []string, me
 	var auth smtp.Auth
 
 	// Count the size of this Email
-	atomic.AddInt64(&misc.OutstandingMailBytes, int64(len(message)))
+	misc.OutstandingMailBytes.Add(int64(len(message)))
 	defer func() {
-		atomic.AddInt64(&misc.OutstandingMailBytes, -int64(len(message)))
+		misc.OutstandingMailBytes.Add(-int64(len(message)))
 	}()
 
 	CommonMailLogger.Info("sendMailWithRetry", from, nil, "attempting to deliver mail to %v", recipients)
@@ -178,7 +179,7 @@ func (client *MailClient) sendMailWithRetry(from string, recipients []string, me
 		cancel()
 		CommonMailLogger.Warning("sendMailWithRetry", from, err, "failed to deliver mail to %v in the attempt %d (tls error? %v)", recipients, i, tlsErr)
 		// At least one attempt of mail delivery must have been made in order to consider dropping the mail
-		if atomic.LoadInt64(&misc.OutstandingMailBytes) > MaxOutstandingMailSize {
+		if misc.OutstandingMailBytes.Value() > MaxOutstandingMailSize {
 			CommonMailLogger.Warning("sendMailWithRetry", from, nil, "max outstanding mail size is reached, permanently dropping mail of size %d", len(message))
 			return
 		}
@@ -197,7 +198,7 @@ func (client *MailClient) Send(subject string, textBody string, recipients ...st
 	// Construct appropriate mail headers
 	mailBody := fmt.Sprintf("MIME-Version: 1.0\r\nContent-type: text/plain; charset=utf-8\r\nFrom: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s",
 		client.MailFrom, strings.Join(recipients, ", "), subject, textBody)
-	go client.sendMailWithRetry(client.MailFrom, recipients, []byte(mailBody))
+	go client.sendMailWithRetry(client.MailFrom, recipients, client.signDKIM([]byte(mailBody)))
 	return nil
 }
 
@@ -206,7 +207,7 @@ func (client *MailClient) SendRaw(fromAddr string, rawMailBody []byte, recipient
 	if len(recipients) == 0 {
 		return fmt.Errorf("no recipient specified for mail from \"%s\"", fromAddr)
 	}
-	go client.sendMailWithRetry(client.MailFrom, recipients, rawMailBody)
+	go client.sendMailWithRetry(client.MailFrom, recipients, client.signDKIM(rawMailBody))
 	return nil
 }
 
@@ -0,0 +1,382 @@
+package inet
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DKIMSignedHeaders are the names of mail headers covered by DKIM signature, if they are present in the mail.
+var DKIMSignedHeaders = []string{"From", "To", "Cc", "Reply-To", "Subject", "Date", "Message-ID", "MIME-Version", "Content-Type", "Content-Transfer-Encoding"}
+
+// RegexWhitespaces matches consecutive spaces and tabs.
+var RegexWhitespaces = regexp.MustCompile(`[ \t]+`)
+
+/*
+DKIMKey is the DomainKeys Identified Mail private key of a mail domain. The public key is published in DNS as a TXT
+record of "SELECTOR._domainkey.DOMAIN", e.g. "v=DKIM1; k=rsa; p=BASE64-PUBLIC-KEY".
+*/
+type DKIMKey struct {
+	Domain   string `json:"Domain"`   // Domain is the mail domain, e.g. "example.com".
+	Selector string `json:"Selector"` // Selector distinguishes the keys of the same domain, e.g. "laitos".
+	/*
+		PrivateKey is the PEM-encoded RSA (PKCS#1 or PKCS#8) or Ed25519 (PKCS#8) private key. Instead of placing the key
+		in configuration file verbatim, use a reference such as ${file:/path/to/dkim.pem}.
+	*/
+	PrivateKey string `json:"PrivateKey"`
+}
+
+// parsePrivateKey returns the private key decoded from PEM, it is either an RSA or an Ed25519 key.
+func (key DKIMKey) parsePrivateKey() (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return nil, errors.New("the private key is not PEM-encoded")
+	}
+	if rsaKey, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return rsaKey, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch privKey := parsed.(type) {
+	case *rsa.PrivateKey:
+		return privKey, nil
+	case ed25519.PrivateKey:
+		return privKey, nil
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", parsed)
+	}
+}
+
+// normaliseLineEndings converts all line endings into CRLF, just like the message is transmitted over SMTP.
+func normaliseLineEndings(message []byte) []byte {
+	return bytes.Replace(bytes.Replace(message, []byte("\r\n"), []byte("\n"), -1), []byte("\n"), []byte("\r\n"), -1)
+}
+
+// canonicaliseBodyRelaxed canonicalises the mail body using the "relaxed" algorithm of RFC 6376 section 3.4.4.
+func canonicaliseBodyRelaxed(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(RegexWhitespaces.ReplaceAllString(line, " "), " ")
+	}
+	// Remove all empty lines at the end of the body
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if len(lines) == 0 {
+		return []byte{}
+	}
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// canonicaliseHeaderRelaxed canonicalises a mail header using the "relaxed" algorithm of RFC 6376 section 3.4.2.
+func canonicaliseHeaderRelaxed(name, value string) string {
+	value = strings.Replace(value, "\r\n", "", -1)
+	value = strings.TrimSpace(RegexWhitespaces.ReplaceAllString(value, " "))
+	return strings.ToLower(strings.TrimSpace(name)) + ":" + value
+}
+
+/*
+splitMailHeaders splits the mail message (with CRLF line endings) into the raw header fields and the body. Each header
+field retains its folded continuation lines, but not the trailing CRLF.
+*/
+func splitMailHeaders(message []byte) (headers []string, body []byte) {
+	headerEnd := bytes.Index(message, []byte("\r\n\r\n"))
+	headerSection := message
+	if headerEnd == -1 {
+		body = []byte{}
+	} else {
+		headerSection = message[:headerEnd]
+		body = message[headerEnd+4:]
+	}
+	for _, line := range strings.Split(string(headerSection), "\r\n") {
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(headers) > 0 {
+			headers[len(headers)-1] += "\r\n" + line
+		} else if line != "" {
+			headers = append(headers, line)
+		}
+	}
+	return
+}
+
+// getMailDomain returns the domain name of the first mail address in a header value such as "Name <user@example.com>".
+func getMailDomain(addrValue string) string {
+	var addr string
+	if parsed, err := mail.ParseAddress(strings.TrimSpace(addrValue)); err == nil {
+		addr = parsed.Address
+	} else {
+		addr = strings.TrimSpace(addrValue)
+	}
+	if at := strings.LastIndexByte(addr, '@'); at != -1 {
+		return strings.ToLower(strings.Trim(addr[at+1:], "<> "))
+	}
+	return ""
+}
+
+/*
+SignDKIM returns the mail message with a DKIM-Signature header inserted at the top, along with line endings normalised
+to CRLF. The signature uses "relaxed/relaxed" canonicalisation and covers the body and DKIMSignedHeaders.
+*/
+func (key DKIMKey) SignDKIM(message []byte, now time.Time) ([]byte, error) {
+	signer, err := key.parsePrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("SignDKIM: failed to read private key of domain %s - %v", key.Domain, err)
+	}
+	algorithm := "rsa-sha256"
+	if _, isEd25519 := signer.(ed25519.PrivateKey); isEd25519 {
+		algorithm = "ed25519-sha256"
+	}
+	message = normaliseLineEndings(message)
+	headers, body := splitMailHeaders(message)
+	bodyHash := sha256.Sum256(canonicaliseBodyRelaxed(body))
+
+	// Pick the header fields to sign, the last instance of a header field is signed first (RFC 6376 section 5.4.2).
+	var signedNames []string
+	var canonHeaders strings.Builder
+	for _, name := range DKIMSignedHeaders {
+		for i := len(headers) - 1; i >= 0; i-- {
+			colon := strings.IndexByte(headers[i], ':')
+			if colon == -1 || !strings.EqualFold(strings.TrimSpace(headers[i][:colon]), name) {
+				continue
+			}
+			signedNames = append(signedNames, strings.ToLower(name))
+			canonHeaders.WriteString(canonicaliseHeaderRelaxed(headers[i][:colon], headers[i][colon+1:]))
+			canonHeaders.WriteString("\r\n")
+		}
+	}
+	sigValue := fmt.Sprintf("v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		algorithm, key.Domain, key.Selector, now.Unix(), strings.Join(signedNames, ":"), base64.StdEncoding.EncodeToString(bodyHash[:]))
+	// The signature header itself is signed with an empty "b=" tag and without the trailing CRLF
+	canonHeaders.WriteString(canonicaliseHeaderRelaxed("DKIM-Signature", sigValue))
+	digest := sha256.Sum256([]byte(canonHeaders.String()))
+	var signature []byte
+	if _, isEd25519 := signer.(ed25519.PrivateKey); isEd25519 {
+		// RFC 8463 signs the SHA-256 digest using PureEdDSA
+		signature, err = signer.Sign(rand.Reader, digest[:], crypto.Hash(0))
+	} else {
+		signature, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("SignDKIM: failed to sign for domain %s - %v", key.Domain, err)
+	}
+	return append([]byte("DKIM-Signature: "+sigValue+base64.StdEncoding.EncodeToString(signature)+"\r\n"), message...), nil
+}
+
+/*
+signDKIM signs the mail message using the DKIM key of the domain of the message's From header. If there is not such key,
+the key of the domain of MailFrom address is used instead, this is usually the case for mails relayed by laitos on behalf
+of other senders. If there is neither, the message is returned as-is.
+*/
+func (client *MailClient) signDKIM(message []byte) []byte {
+	if len(client.DKIMKeys) == 0 {
+		return message
+	}
+	var fromDomain string
+	headers, _ := splitMailHeaders(normaliseLineEndings(message))
+	for _, header := range headers {
+		if colon := strings.IndexByte(header, ':'); colon != -1 && strings.EqualFold(strings.TrimSpace(header[:colon]), "From") {
+			fromDomain = getMailDomain(strings.Replace(header[colon+1:], "\r\n", "", -1))
+			break
+		}
+	}
+	for _, domain := range []string{fromDomain, getMailDomain(client.MailFrom)} {
+		for _, key := range client.DKIMKeys {
+			if domain != "" && strings.EqualFold(key.Domain, domain) {
+				signed, err := key.SignDKIM(message, time.Now())
+				if err != nil {
+					CommonMailLogger.Warning("signDKIM", domain, err, "sending the mail without DKIM signature")
+					return message
+				}
+				return signed
+			}
+		}
+	}
+	return message
+}
+
+// DKIMResult is the outcome of verifying a DKIM-Signature header of a mail message.
+type DKIMResult struct {
+	Domain string // Domain is the signing domain (d= tag).
+	Pass   bool   // Pass is true only if the signature is valid.
+	Reason string // Reason explains the verification failure.
+}
+
+// RegexDKIMSignatureTag matches the signature value (b= tag) of DKIM-Signature header, the value is excluded from signature.
+var RegexDKIMSignatureTag = regexp.MustCompile(`(^|;)(\s*b\s*=)[^;]*`)
+
+// parseDKIMTags returns the tag names VS values of a DKIM-Signature header or a DKIM key record.
+func parseDKIMTags(value string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(value, ";") {
+		if equal := strings.IndexByte(tag, '='); equal != -1 {
+			tags[strings.TrimSpace(tag[:equal])] = strings.TrimSpace(tag[equal+1:])
+		}
+	}
+	return tags
+}
+
+// canonicaliseBodySimple canonicalises the mail body using the "simple" algorithm of RFC 6376 section 3.4.3.
+func canonicaliseBodySimple(body []byte) []byte {
+	for bytes.HasSuffix(body, []byte("\r\n")) {
+		body = body[:len(body)-2]
+	}
+	return append(append([]byte{}, body...), '\r', '\n')
+}
+
+// getDKIMPublicKey retrieves the public key of the selector and domain from DNS.
+func getDKIMPublicKey(selector, domain string, lookupTXT func(string) ([]string, error)) (crypto.PublicKey, error) {
+	records, err := lookupTXT(selector + "._domainkey." + domain)
+	if err != nil {
+		return nil, err
+	}
+	for _, record := range records {
+		tags := parseDKIMTags(record)
+		if v, exists := tags["v"]; exists && v != "DKIM1" {
+			continue
+		}
+		keyBytes, err := base64.StdEncoding.DecodeString(RegexWhitespaces.ReplaceAllString(tags["p"], ""))
+		if err != nil || len(keyBytes) == 0 {
+			return nil, errors.New("the public key is malformed or revoked")
+		}
+		if tags["k"] == "ed25519" {
+			if len(keyBytes) != ed25519.PublicKeySize {
+				return nil, errors.New("the ed25519 public key is malformed")
+			}
+			return ed25519.PublicKey(keyBytes), nil
+		}
+		if pubKey, err := x509.ParsePKIXPublicKey(keyBytes); err == nil {
+			return pubKey, nil
+		}
+		return x509.ParsePKCS1PublicKey(keyBytes)
+	}
+	return nil, errors.New("the public key record is not found")
+}
+
+// verifyDKIMSignature verifies a single DKIM-Signature header among the headers of the message.
+func verifyDKIMSignature(sigHeader string, headers []string, body []byte, lookupTXT func(string) ([]string, error)) (result DKIMResult) {
+	colon := strings.IndexByte(sigHeader, ':')
+	sigName, sigValue := sigHeader[:colon], sigHeader[colon+1:]
+	tags := parseDKIMTags(strings.Replace(sigValue, "\r\n", "", -1))
+	result.Domain = strings.ToLower(tags["d"])
+	if tags["v"] != "1" || tags["d"] == "" || tags["s"] == "" || tags["h"] == "" || tags["bh"] == "" || tags["b"] == "" {
+		result.Reason = "the signature is missing mandatory tags"
+		return
+	}
+	if algo := tags["a"]; algo != "rsa-sha256" && algo != "ed25519-sha256" {
+		result.Reason = "unsupported signing algorithm " + algo
+		return
+	}
+	if expiry, err := strconv.ParseInt(tags["x"], 10, 64); err == nil && time.Now().Unix() > expiry {
+		result.Reason = "the signature has expired"
+		return
+	}
+	headerCanon, bodyCanon := "simple", "simple"
+	if c := strings.Split(tags["c"], "/"); c[0] != "" {
+		headerCanon = c[0]
+		if len(c) > 1 {
+			bodyCanon = c[1]
+		}
+	}
+	// Verify body hash
+	var canonBody []byte
+	if bodyCanon == "relaxed" {
+		canonBody = canonicaliseBodyRelaxed(body)
+	} else {
+		canonBody = canonicaliseBodySimple(body)
+	}
+	if bodyLength, err := strconv.Atoi(tags["l"]); err == nil && bodyLength >= 0 && bodyLength < len(canonBody) {
+		canonBody = canonBody[:bodyLength]
+	}
+	bodyHash := sha256.Sum256(canonBody)
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != RegexWhitespaces.ReplaceAllString(strings.Replace(tags["bh"], "\r\n", "", -1), "") {
+		result.Reason = "the body hash does not match"
+		return
+	}
+	// Collect the signed header fields, from the last instance towards the first (RFC 6376 section 5.4.2).
+	canonicalise := func(name, value string) string {
+		if headerCanon == "relaxed" {
+			return canonicaliseHeaderRelaxed(name, value)
+		}
+		return name + ":" + value
+	}
+	var data strings.Builder
+	used := make(map[int]bool)
+	var signsFrom bool
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.TrimSpace(name)
+		if strings.EqualFold(name, "From") {
+			signsFrom = true
+		}
+		for i := len(headers) - 1; i >= 0; i-- {
+			headerColon := strings.IndexByte(headers[i], ':')
+			if used[i] || headerColon == -1 || !strings.EqualFold(strings.TrimSpace(headers[i][:headerColon]), name) {
+				continue
+			}
+			used[i] = true
+			data.WriteString(canonicalise(headers[i][:headerColon], headers[i][headerColon+1:]) + "\r\n")
+			break
+		}
+	}
+	if !signsFrom {
+		result.Reason = "the signature does not cover From header"
+		return
+	}
+	data.WriteString(canonicalise(sigName, RegexDKIMSignatureTag.ReplaceAllString(sigValue, "$1$2")))
+	signature, err := base64.StdEncoding.DecodeString(RegexWhitespaces.ReplaceAllString(strings.Replace(tags["b"], "\r\n", "", -1), ""))
+	if err != nil {
+		result.Reason = "the signature is malformed"
+		return
+	}
+	pubKey, err := getDKIMPublicKey(tags["s"], tags["d"], lookupTXT)
+	if err != nil {
+		result.Reason = err.Error()
+		return
+	}
+	digest := sha256.Sum256([]byte(data.String()))
+	switch key := pubKey.(type) {
+	case *rsa.PublicKey:
+		result.Pass = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) == nil
+	case ed25519.PublicKey:
+		result.Pass = ed25519.Verify(key, digest[:], signature)
+	default:
+		result.Reason = fmt.Sprintf("unsupported public key type %T", pubKey)
+		return
+	}
+	if !result.Pass {
+		result.Reason = "the signature does not match"
+	}
+	return
+}
+
+/*
+VerifyDKIM verifies the DKIM-Signature headers of a mail message and returns the outcome of each signature, using the
+lookup function (e.g. net.LookupTXT) to retrieve public keys from DNS. Only the first several signatures are verified.
+*/
+func VerifyDKIM(message []byte, lookupTXT func(string) ([]string, error)) (results []DKIMResult) {
+	headers, body := splitMailHeaders(normaliseLineEndings(message))
+	for _, header := range headers {
+		colon := strings.IndexByte(header, ':')
+		if colon == -1 || !strings.EqualFold(strings.TrimSpace(header[:colon]), "DKIM-Signature") {
+			continue
+		}
+		if len(results) >= 5 {
+			break
+		}
+		results = append(results, verifyDKIMSignature(header, headers, body, lookupTXT))
+	}
+	return
+}
@@ -0,0 +1,134 @@
+package inet
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDKIMCanonicalisation(t *testing.T) {
+	// The example from RFC 6376 section 3.4.5
+	if body := canonicaliseBodyRelaxed([]byte(" C \r\nD \t E\r\n\r\n\r\n")); string(body) != " C\r\nD E\r\n" {
+		t.Fatalf("%q", body)
+	}
+	headers, body := splitMailHeaders([]byte("A: X\r\nB : Y\t\r\n\tZ  \r\n\r\n C \r\n"))
+	if len(headers) != 2 || string(body) != " C \r\n" {
+		t.Fatalf("%q %q", headers, body)
+	}
+	if canon := canonicaliseHeaderRelaxed("A", " X"); canon != "a:X" {
+		t.Fatal(canon)
+	}
+	if canon := canonicaliseHeaderRelaxed("B ", " Y\t\r\n\tZ  "); canon != "b:Y Z" {
+		t.Fatal(canon)
+	}
+	if body := canonicaliseBodyRelaxed([]byte("\r\n\r\n")); len(body) != 0 {
+		t.Fatalf("%q", body)
+	}
+	if domain := getMailDomain(` "Howard" <Howard@Example.com>`); domain != "example.com" {
+		t.Fatal(domain)
+	}
+}
+
+func TestDKIMKey_SignDKIM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edDER, err := x509.MarshalPKCS8PrivateKey(edPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (DKIMKey{Domain: "example.com", PrivateKey: "not a key"}).SignDKIM([]byte("From: a@example.com\r\n\r\nbody"), time.Now()); err == nil {
+		t.Fatal("did not error")
+	}
+	rsaPubDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookupTXT := func(name string) ([]string, error) {
+		switch name {
+		case "rsa._domainkey.example.com":
+			return []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPubDER)}, nil
+		case "ed._domainkey.example.com":
+			return []string{"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub)}, nil
+		case "revoked._domainkey.example.com":
+			return []string{"v=DKIM1; p="}, nil
+		}
+		return nil, errors.New("no such host")
+	}
+	message := []byte("From: Howard <howard@example.com>\nTo: a@example.net\nSubject: hello\n  world\n\nline 1  \nline 2\n\n")
+	for _, test := range []struct {
+		key  DKIMKey
+		algo string
+	}{
+		{DKIMKey{Domain: "example.com", Selector: "rsa", PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))}, "rsa-sha256"},
+		{DKIMKey{Domain: "example.com", Selector: "ed", PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edDER}))}, "ed25519-sha256"},
+	} {
+		signed, err := test.key.SignDKIM(message, time.Unix(1600000000, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(string(signed), "DKIM-Signature: v=1; a="+test.algo+"; c=relaxed/relaxed; d=example.com; s="+test.key.Selector+"; t=1600000000; h=from:to:subject; bh=") {
+			t.Fatal(string(signed))
+		}
+		if results := VerifyDKIM(signed, lookupTXT); len(results) != 1 || !results[0].Pass || results[0].Domain != "example.com" {
+			t.Fatal(results)
+		}
+		// Whitespace changes do not matter to relaxed canonicalisation
+		relaxed := []byte(strings.Replace(string(signed), "line 1", "line   1", 1) + "\r\n\r\n")
+		if results := VerifyDKIM(relaxed, lookupTXT); len(results) != 1 || !results[0].Pass {
+			t.Fatal(results)
+		}
+		tampered := []byte(strings.Replace(string(signed), "line 2", "line 3", 1))
+		if results := VerifyDKIM(tampered, lookupTXT); len(results) != 1 || results[0].Pass || !strings.Contains(results[0].Reason, "body hash") {
+			t.Fatal(results)
+		}
+		tampered = []byte(strings.Replace(string(signed), "Subject: hello", "Subject: hallo", 1))
+		if results := VerifyDKIM(tampered, lookupTXT); len(results) != 1 || results[0].Pass || !strings.Contains(results[0].Reason, "does not match") {
+			t.Fatal(results)
+		}
+		tampered = []byte(strings.Replace(string(signed), "s="+test.key.Selector+";", "s=revoked;", 1))
+		if results := VerifyDKIM(tampered, lookupTXT); len(results) != 1 || results[0].Pass || !strings.Contains(results[0].Reason, "revoked") {
+			t.Fatal(results)
+		}
+	}
+	if results := VerifyDKIM(message, lookupTXT); len(results) != 0 {
+		t.Fatal(results)
+	}
+}
+
+func TestMailClient_SignDKIM(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := MailClient{MailFrom: "laitos@example.com"}
+	message := []byte("From: other@example.net\r\nSubject: hi\r\n\r\nbody")
+	if signed := client.signDKIM(message); string(signed) != string(message) {
+		t.Fatal(string(signed))
+	}
+	client.DKIMKeys = []DKIMKey{
+		{Domain: "example.com", Selector: "fallback", PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))},
+		{Domain: "example.org", Selector: "broken", PrivateKey: "broken"},
+	}
+	// Relayed mail is signed using the key of MailFrom domain
+	if signed := client.signDKIM(message); !strings.Contains(string(signed), "d=example.com; s=fallback;") {
+		t.Fatal(string(signed))
+	}
+	// The key of From domain takes precedence, an unusable key leaves the mail unsigned.
+	message = []byte("From: x@example.org\r\nSubject: hi\r\n\r\nbody")
+	if signed := client.signDKIM(message); string(signed) != string(message) {
+		t.Fatal(string(signed))
+	}
+}
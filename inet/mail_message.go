@@ -81,7 +81,12 @@ func WalkMailMessage(mailMessage []byte, fun func(BasicMail, []byte) (bool, erro
 	if err != nil {
 		return err
 	}
-	mediaType, multipartParams, err := mime.ParseMediaType(prop.ContentType)
+	contentType := prop.ContentType
+	if contentType == "" {
+		// A mail without content type is plain text by default (RFC 2045)
+		contentType = "text/plain"
+	}
+	mediaType, multipartParams, err := mime.ParseMediaType(contentType)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,148 @@
+package inet
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maildirDeliveryCounter makes the file names of mails delivered within the same second unique.
+var maildirDeliveryCounter int64
+
+/*
+Maildir stores mail messages in a directory using the maildir format, which is understood by most mail servers and mail
+readers. A newly delivered mail is first written into the "tmp" sub-directory, and then moved into the "new"
+sub-directory.
+*/
+type Maildir struct {
+	Dir string // Dir is the path to the maildir, its "tmp", "new", and "cur" sub-directories are created automatically.
+}
+
+// Initialise creates the sub-directories of the maildir.
+func (dir Maildir) Initialise() error {
+	if dir.Dir == "" {
+		return fmt.Errorf("Maildir.Initialise: directory path must not be empty")
+	}
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		if err := os.MkdirAll(filepath.Join(dir.Dir, sub), 0700); err != nil {
+			return fmt.Errorf("Maildir.Initialise: failed to create directory - %v", err)
+		}
+	}
+	return nil
+}
+
+// Deliver stores the mail message in the maildir and returns its unique file name.
+func (dir Maildir) Deliver(mailMessage []byte) (string, error) {
+	if err := dir.Initialise(); err != nil {
+		return "", err
+	}
+	hostName, _ := os.Hostname()
+	// The host name must not contain directory separator or colon, the latter separates the info part of file name.
+	hostName = strings.NewReplacer("/", `\057`, ":", `\072`).Replace(hostName)
+	now := time.Now()
+	name := fmt.Sprintf("%d.M%dP%dQ%d.%s", now.Unix(), now.Nanosecond()/1000, os.Getpid(), atomic.AddInt64(&maildirDeliveryCounter, 1), hostName)
+	tmpPath := filepath.Join(dir.Dir, "tmp", name)
+	if err := ioutil.WriteFile(tmpPath, mailMessage, 0600); err != nil {
+		return "", fmt.Errorf("Maildir.Deliver: failed to write mail - %v", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(dir.Dir, "new", name)); err != nil {
+		_ = os.Remove(tmpPath)
+		return "", fmt.Errorf("Maildir.Deliver: failed to move mail into place - %v", err)
+	}
+	return name, nil
+}
+
+// MaildirMessage is a mail message stored in a maildir.
+type MaildirMessage struct {
+	Name string // Name is the unique name of the message, without the info suffix.
+	Seen bool   // Seen is true if the message has been read.
+	path string // path is the path to the message file.
+}
+
+// List returns the messages stored in the maildir, sorted from the oldest delivery to the latest.
+func (dir Maildir) List() ([]MaildirMessage, error) {
+	ret := make([]MaildirMessage, 0, 8)
+	for _, sub := range []string{"new", "cur"} {
+		entries, err := ioutil.ReadDir(filepath.Join(dir.Dir, sub))
+		if err != nil {
+			return nil, fmt.Errorf("Maildir.List: failed to read directory - %v", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+			msg := MaildirMessage{Name: entry.Name(), path: filepath.Join(dir.Dir, sub, entry.Name())}
+			if colon := strings.IndexRune(msg.Name, ':'); colon != -1 {
+				msg.Seen = strings.Contains(msg.Name[colon:], "S")
+				msg.Name = msg.Name[:colon]
+			}
+			ret = append(ret, msg)
+		}
+	}
+	// Names begin with the delivery timestamp
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret, nil
+}
+
+// find returns the message of the unique name.
+func (dir Maildir) find(name string) (MaildirMessage, error) {
+	messages, err := dir.List()
+	if err != nil {
+		return MaildirMessage{}, err
+	}
+	for _, msg := range messages {
+		if msg.Name == name {
+			return msg, nil
+		}
+	}
+	return MaildirMessage{}, fmt.Errorf("Maildir: cannot find message \"%s\"", name)
+}
+
+// Peek returns the content of the message of the unique name without marking the message as seen.
+func (dir Maildir) Peek(name string) ([]byte, error) {
+	msg, err := dir.find(name)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(msg.path)
+	if err != nil {
+		return nil, fmt.Errorf("Maildir.Peek: failed to read message - %v", err)
+	}
+	return content, nil
+}
+
+// Read returns the content of the message of the unique name, and marks the message as seen.
+func (dir Maildir) Read(name string) ([]byte, error) {
+	msg, err := dir.find(name)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(msg.path)
+	if err != nil {
+		return nil, fmt.Errorf("Maildir.Read: failed to read message - %v", err)
+	}
+	if !msg.Seen {
+		// Mark the message as seen by moving it into "cur" with the seen flag
+		_ = os.Rename(msg.path, filepath.Join(dir.Dir, "cur", msg.Name+":2,S"))
+	}
+	return content, nil
+}
+
+// Delete removes the message of the unique name from the maildir.
+func (dir Maildir) Delete(name string) error {
+	msg, err := dir.find(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(msg.path); err != nil {
+		return fmt.Errorf("Maildir.Delete: failed to delete message - %v", err)
+	}
+	return nil
+}
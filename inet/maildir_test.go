@@ -0,0 +1,71 @@
+package inet
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMaildir(t *testing.T) {
+	if err := (Maildir{}).Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	dir, err := ioutil.TempDir("", "laitos-TestMaildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	maildir := Maildir{Dir: filepath.Join(dir, "mail")}
+	name1, err := maildir.Deliver([]byte("mail 1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	name2, err := maildir.Deliver([]byte("mail 2"))
+	if err != nil || name1 == name2 {
+		t.Fatal(err, name1, name2)
+	}
+	if content, err := ioutil.ReadFile(filepath.Join(maildir.Dir, "new", name2)); err != nil || string(content) != "mail 2" {
+		t.Fatal(err, string(content))
+	}
+	if entries, err := ioutil.ReadDir(filepath.Join(maildir.Dir, "tmp")); err != nil || len(entries) != 0 {
+		t.Fatal(err, entries)
+	}
+	if entries, err := ioutil.ReadDir(filepath.Join(maildir.Dir, "cur")); err != nil || len(entries) != 0 {
+		t.Fatal(err, entries)
+	}
+	// List messages from the oldest delivery
+	messages, err := maildir.List()
+	if err != nil || len(messages) != 2 || messages[0].Name != name1 || messages[1].Name != name2 || messages[0].Seen || messages[1].Seen {
+		t.Fatal(err, messages)
+	}
+	if content, err := maildir.Peek(name1); err != nil || string(content) != "mail 1" {
+		t.Fatal(err, string(content))
+	}
+	// Reading a message marks it seen
+	if content, err := maildir.Read(name1); err != nil || string(content) != "mail 1" {
+		t.Fatal(err, string(content))
+	}
+	if _, err := os.Stat(filepath.Join(maildir.Dir, "cur", name1+":2,S")); err != nil {
+		t.Fatal(err)
+	}
+	if messages, err := maildir.List(); err != nil || len(messages) != 2 || messages[0].Name != name1 || !messages[0].Seen || messages[1].Seen {
+		t.Fatal(err, messages)
+	}
+	if content, err := maildir.Read(name1); err != nil || string(content) != "mail 1" {
+		t.Fatal(err, string(content))
+	}
+	// Delete messages
+	if err := maildir.Delete(name1); err != nil {
+		t.Fatal(err)
+	}
+	if err := maildir.Delete(name1); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := maildir.Read(name1); err == nil {
+		t.Fatal("did not error")
+	}
+	if messages, err := maildir.List(); err != nil || len(messages) != 1 || messages[0].Name != name2 {
+		t.Fatal(err, messages)
+	}
+}
@@ -0,0 +1,85 @@
+package inet
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const (
+	/*
+		The constants PasswdServerContentLocationMagic, PasswdServerPasswordInputName, and PasswdServerTOTPInputName
+		are identical to those of the password input web server (passwdserver package), which imports this package.
+	*/
+
+	/*
+		PasswdServerContentLocationMagic is sent as Content-Location header value by a laitos password input web server
+		from its unlock URL (and only that URL). Clients look for it to find out whether the URL indeed belongs to one.
+	*/
+	PasswdServerContentLocationMagic = "vmseuijt5oj4d5x7fygfqj4398"
+	// PasswdServerPasswordInputName is the form field that accepts the password (or a secret share).
+	PasswdServerPasswordInputName = "password"
+	// PasswdServerTOTPInputName is the form field that accepts the TOTP (second factor), the page only shows it if TOTP is required.
+	PasswdServerTOTPInputName = "totp"
+)
+
+// passwdServerMessageRegex finds the message (e.g. "success") at the bottom of the password input form.
+var passwdServerMessageRegex = regexp.MustCompile(`<p>([^<]*)</p>\s*</form>`)
+
+/*
+PasswdServerClient submits the password to a laitos password input web server ("passwdserver") to unlock the program
+data of the server. It is shared by the automatic unlocking daemon and the remote unlock app.
+*/
+type PasswdServerClient struct {
+	URL string // URL is the unlock URL of the password input web server.
+	// TLSConfig, if not nil, verifies the server identity of an HTTPS URL, e.g. by pinned public keys.
+	TLSConfig *tls.Config
+}
+
+func (client PasswdServerClient) escapedURL() string {
+	return strings.Replace(client.URL, "%", "%%", -1)
+}
+
+/*
+Probe visits the URL to find out whether it belongs to a password input web server, and whether the server asks for a
+TOTP in addition to the password. If the URL is reachable but does not respond like a password input web server (e.g.
+the server has already been unlocked), the function returns false without an error. It returns an error if the URL is
+unreachable or fails the TLS verification.
+*/
+func (client PasswdServerClient) Probe() (isPasswdServer, wantsTOTP bool, err error) {
+	resp, err := DoHTTP(HTTPRequest{TimeoutSec: 10, TLSConfig: client.TLSConfig}, client.escapedURL())
+	if err != nil || resp.StatusCode/200 != 1 || resp.Header.Get("Content-Location") != PasswdServerContentLocationMagic {
+		return
+	}
+	return true, strings.Contains(string(resp.Body), `name="`+PasswdServerTOTPInputName+`"`), nil
+}
+
+/*
+Submit submits the password (or a secret share) along with the optional TOTP to the password input web server, and
+returns the message from the server, e.g. "success" or the number of secret shares collected so far.
+*/
+func (client PasswdServerClient) Submit(passwd, totp string) (string, error) {
+	form := url.Values{PasswdServerPasswordInputName: []string{passwd}}
+	if totp != "" {
+		form.Set(PasswdServerTOTPInputName, totp)
+	}
+	resp, err := DoHTTP(HTTPRequest{
+		// While unlocking is going on, the system is often freshly booted and quite busy, hence giving it plenty of time to respond.
+		TimeoutSec:  30,
+		Method:      http.MethodPost,
+		ContentType: "application/x-www-form-urlencoded",
+		Body:        strings.NewReader(form.Encode()),
+		TLSConfig:   client.TLSConfig,
+	}, client.escapedURL())
+	if err != nil {
+		return "", err
+	} else if err = resp.Non2xxToError(); err != nil {
+		return "", err
+	}
+	if match := passwdServerMessageRegex.FindSubmatch(resp.Body); match != nil {
+		return string(match[1]), nil
+	}
+	return string(resp.GetBodyUpTo(1024)), nil
+}
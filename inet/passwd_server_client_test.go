@@ -0,0 +1,54 @@
+package inet
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPasswdServerClient(t *testing.T) {
+	var submittedPasswd, submittedTOTP string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/unlock":
+			if r.Method == http.MethodGet {
+				w.Header().Set("Content-Location", PasswdServerContentLocationMagic)
+				_, _ = w.Write([]byte(`<form><input type="text" name="totp"/></form>`))
+				return
+			}
+			submittedPasswd = r.FormValue(PasswdServerPasswordInputName)
+			submittedTOTP = r.FormValue(PasswdServerTOTPInputName)
+			_, _ = w.Write([]byte("<html><form>\n<input/>\n<p>accepted the share</p>\n</form></html>"))
+		case "/plain":
+			_, _ = w.Write([]byte("plain response"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+
+	client := PasswdServerClient{URL: srv.URL + "/unlock"}
+	if isServer, wantsTOTP, err := client.Probe(); err != nil || !isServer || !wantsTOTP {
+		t.Fatal(isServer, wantsTOTP, err)
+	}
+	if msg, err := client.Submit("pass", "123456"); err != nil || msg != "accepted the share" || submittedPasswd != "pass" || submittedTOTP != "123456" {
+		t.Fatal(msg, err, submittedPasswd, submittedTOTP)
+	}
+	// Not a password input web server
+	client.URL = srv.URL + "/plain"
+	if isServer, _, err := client.Probe(); err != nil || isServer {
+		t.Fatal(isServer, err)
+	}
+	if msg, err := client.Submit("pass", ""); err != nil || msg != "plain response" {
+		t.Fatal(msg, err)
+	}
+	client.URL = srv.URL + "/does-not-exist"
+	if _, err := client.Submit("pass", ""); err == nil {
+		t.Fatal("did not error")
+	}
+	// Unreachable
+	client.URL = "http://127.0.0.1:1/unlock"
+	if _, _, err := client.Probe(); err == nil {
+		t.Fatal("did not error")
+	}
+}
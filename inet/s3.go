@@ -0,0 +1,72 @@
+package inet
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// awsURIEncode encodes the URI path in the canonical form expected by AWS signature version 4, slashes are kept as-is.
+func awsURIEncode(path string) string {
+	var ret strings.Builder
+	for _, b := range []byte(path) {
+		if b >= 'A' && b <= 'Z' || b >= 'a' && b <= 'z' || b >= '0' && b <= '9' || b == '-' || b == '_' || b == '.' || b == '~' || b == '/' {
+			ret.WriteByte(b)
+		} else {
+			ret.WriteString(fmt.Sprintf("%%%02X", b))
+		}
+	}
+	return ret.String()
+}
+
+/*
+GetS3Object downloads an object from AWS S3 bucket using the IAM role of this EC2 instance. If the region is left empty,
+the region of this instance will be used.
+*/
+func GetS3Object(region, bucket, key string, maxBytes int) ([]byte, error) {
+	if region == "" {
+		region = GetCloudInstance().Region
+	}
+	if region == "" {
+		return nil, errors.New("GetS3Object: unable to determine AWS region")
+	}
+	cred, err := getAWSRoleCredentials()
+	if err != nil {
+		return nil, fmt.Errorf("GetS3Object: failed to retrieve instance role credentials - %v", err)
+	}
+	host := bucket + ".s3." + region + ".amazonaws.com"
+	path := awsURIEncode("/" + strings.TrimPrefix(key, "/"))
+	emptyDigest := sha256.Sum256(nil)
+	now := time.Now()
+	header := map[string]string{
+		"Host":                 host,
+		"X-Amz-Content-Sha256": hex.EncodeToString(emptyDigest[:]),
+		"X-Amz-Date":           now.UTC().Format("20060102T150405Z"),
+	}
+	if cred.Token != "" {
+		header["X-Amz-Security-Token"] = cred.Token
+	}
+	authorization := signAWSRequest(http.MethodGet, path, "", header, nil, region, "s3", cred, now)
+	reqHeader := http.Header{"Authorization": {authorization}}
+	for name, value := range header {
+		if name != "Host" {
+			reqHeader.Set(name, value)
+		}
+	}
+	// The path is already escaped, hence it is not subject to further escaping by DoHTTP.
+	resp, err := DoHTTP(HTTPRequest{
+		TimeoutSec: CloudSecretTimeoutSec,
+		Header:     reqHeader,
+		MaxBytes:   maxBytes,
+	}, strings.Replace("https://"+host+path, "%", "%%", -1))
+	if err != nil {
+		return nil, err
+	} else if err = resp.Non2xxToError(); err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
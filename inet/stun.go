@@ -0,0 +1,130 @@
+package inet
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+)
+
+const (
+	stunBindingRequest        = 0x0001     // stunBindingRequest is the message type of STUN binding request.
+	stunBindingSuccess        = 0x0101     // stunBindingSuccess is the message type of a successful STUN binding response.
+	stunMagicCookie           = 0x2112A442 // stunMagicCookie is the fixed value that follows the message type and length (RFC 5389).
+	stunAttrMappedAddress     = 0x0001     // stunAttrMappedAddress carries the client address as observed by the server (RFC 3489).
+	stunAttrXORMappedAddress  = 0x0020     // stunAttrXORMappedAddress carries the client address XOR'ed with the magic cookie.
+	stunHeaderLen             = 20         // stunHeaderLen is the length of STUN message header.
+	stunMaxResponseLen        = 1500       // stunMaxResponseLen is the maximum size of a STUN response read from the server.
+	stunAddressFamilyIPv4     = 0x01       // stunAddressFamilyIPv4 is the address family value of IPv4 address attribute.
+	stunAddressFamilyIPv6     = 0x02       // stunAddressFamilyIPv6 is the address family value of IPv6 address attribute.
+	stunTransactionIDLen      = 12         // stunTransactionIDLen is the length of the random transaction ID of a request.
+	stunAddressAttrHeaderLen  = 4          // stunAddressAttrHeaderLen is the length of reserved byte, family, and port of an address attribute.
+	stunAttrHeaderLen         = 4          // stunAttrHeaderLen is the length of attribute type and attribute length.
+	stunAttrAlignment         = 4          // stunAttrAlignment is the boundary to which each attribute value is padded.
+	stunMaxAttributesToSearch = 32         // stunMaxAttributesToSearch limits the effort spent on a malformed response.
+)
+
+// ErrSTUNBadResponse is returned when the STUN server responds with a malformed response or without the client address.
+var ErrSTUNBadResponse = errors.New("bad STUN response")
+
+/*
+GetPublicIPViaSTUN asks a STUN server (e.g. stun.l.google.com:19302) for the address of this computer as observed by the
+server. The network is either "udp4" or "udp6".
+*/
+func GetPublicIPViaSTUN(network, serverAddr string, timeoutSec int) (string, error) {
+	conn, err := net.DialTimeout(network, serverAddr, time.Duration(timeoutSec)*time.Second)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(time.Duration(timeoutSec) * time.Second)); err != nil {
+		return "", err
+	}
+	req := make([]byte, stunHeaderLen)
+	binary.BigEndian.PutUint16(req[0:2], stunBindingRequest)
+	binary.BigEndian.PutUint32(req[4:8], stunMagicCookie)
+	if _, err := rand.Read(req[8:stunHeaderLen]); err != nil {
+		return "", err
+	}
+	if _, err := conn.Write(req); err != nil {
+		return "", err
+	}
+	resp := make([]byte, stunMaxResponseLen)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return "", err
+	}
+	ip, err := parseSTUNBindingResponse(resp[:n], req[8:stunHeaderLen])
+	if err != nil {
+		return "", err
+	}
+	return ip.String(), nil
+}
+
+// parseSTUNBindingResponse returns the client address carried by a successful STUN binding response.
+func parseSTUNBindingResponse(resp, transactionID []byte) (net.IP, error) {
+	if len(resp) < stunHeaderLen || binary.BigEndian.Uint16(resp[0:2]) != stunBindingSuccess ||
+		binary.BigEndian.Uint32(resp[4:8]) != stunMagicCookie || string(resp[8:stunHeaderLen]) != string(transactionID) {
+		return nil, ErrSTUNBadResponse
+	}
+	msgEnd := stunHeaderLen + int(binary.BigEndian.Uint16(resp[2:4]))
+	if msgEnd > len(resp) {
+		return nil, ErrSTUNBadResponse
+	}
+	var mappedIP net.IP
+	pos := stunHeaderLen
+	for i := 0; i < stunMaxAttributesToSearch && pos+stunAttrHeaderLen <= msgEnd; i++ {
+		attrType := binary.BigEndian.Uint16(resp[pos : pos+2])
+		attrLen := int(binary.BigEndian.Uint16(resp[pos+2 : pos+4]))
+		value := resp[pos+stunAttrHeaderLen:]
+		if attrLen > len(value) {
+			return nil, ErrSTUNBadResponse
+		}
+		value = value[:attrLen]
+		switch attrType {
+		case stunAttrXORMappedAddress:
+			// The XOR'ed address takes precedence over the plain address
+			if ip := decodeSTUNAddress(value, resp[4:stunHeaderLen]); ip != nil {
+				return ip, nil
+			}
+		case stunAttrMappedAddress:
+			mappedIP = decodeSTUNAddress(value, nil)
+		}
+		pos += stunAttrHeaderLen + (attrLen+stunAttrAlignment-1)/stunAttrAlignment*stunAttrAlignment
+	}
+	if mappedIP == nil {
+		return nil, ErrSTUNBadResponse
+	}
+	return mappedIP, nil
+}
+
+/*
+decodeSTUNAddress decodes the IP address from the value of an address attribute. If xorKey (the magic cookie followed
+by transaction ID) is given, the address is XOR'ed with the key. It returns nil if the value is malformed.
+*/
+func decodeSTUNAddress(value, xorKey []byte) net.IP {
+	if len(value) < stunAddressAttrHeaderLen {
+		return nil
+	}
+	var ipLen int
+	switch value[1] {
+	case stunAddressFamilyIPv4:
+		ipLen = net.IPv4len
+	case stunAddressFamilyIPv6:
+		ipLen = net.IPv6len
+	default:
+		return nil
+	}
+	if len(value) < stunAddressAttrHeaderLen+ipLen {
+		return nil
+	}
+	ip := make(net.IP, ipLen)
+	copy(ip, value[stunAddressAttrHeaderLen:stunAddressAttrHeaderLen+ipLen])
+	if xorKey != nil {
+		for i := range ip {
+			ip[i] ^= xorKey[i]
+		}
+	}
+	return ip
+}
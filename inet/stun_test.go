@@ -0,0 +1,35 @@
+package inet
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseSTUNBindingResponse(t *testing.T) {
+	txID := []byte("0123456789ab")
+	header := func(attrLen byte) []byte {
+		return append([]byte{0x01, 0x01, 0x00, attrLen, 0x21, 0x12, 0xA4, 0x42}, txID...)
+	}
+	// XOR-MAPPED-ADDRESS of 192.0.2.1 port 32853
+	resp := append(header(12), 0x00, 0x20, 0x00, 0x08, 0x00, 0x01, 0xa1, 0x47, 0xe1, 0x12, 0xa6, 0x43)
+	if ip, err := parseSTUNBindingResponse(resp, txID); err != nil || !ip.Equal(net.ParseIP("192.0.2.1")) {
+		t.Fatal(ip, err)
+	}
+	// MAPPED-ADDRESS of 192.0.2.2
+	resp = append(header(12), 0x00, 0x01, 0x00, 0x08, 0x00, 0x01, 0x80, 0x55, 192, 0, 2, 2)
+	if ip, err := parseSTUNBindingResponse(resp, txID); err != nil || !ip.Equal(net.ParseIP("192.0.2.2")) {
+		t.Fatal(ip, err)
+	}
+	// Transaction ID mismatch
+	if _, err := parseSTUNBindingResponse(resp, []byte("ba9876543210")); err != ErrSTUNBadResponse {
+		t.Fatal(err)
+	}
+	// Truncated attribute
+	if _, err := parseSTUNBindingResponse(resp[:len(resp)-2], txID); err != ErrSTUNBadResponse {
+		t.Fatal(err)
+	}
+	// No address attribute
+	if _, err := parseSTUNBindingResponse(header(0), txID); err != ErrSTUNBadResponse {
+		t.Fatal(err)
+	}
+}
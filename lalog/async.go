@@ -0,0 +1,104 @@
+package lalog
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// DefaultAsyncQueueLen is the default capacity of the background output queue used in asynchronous mode.
+const DefaultAsyncQueueLen = 1024
+
+/*
+asyncEntry is an item in the background output queue. It carries either a log message to print, or a channel to close
+once all of the preceding log messages have been printed.
+*/
+type asyncEntry struct {
+	msg     string
+	flushed chan struct{}
+}
+
+var (
+	// asyncQueue carries log messages to the background output routine, it is nil unless asynchronous mode is enabled.
+	asyncQueue      chan asyncEntry
+	asyncQueueMutex = new(sync.RWMutex)
+	// asyncDropped counts the log messages discarded due to the background output queue being full.
+	asyncDropped = GetCounter("lalog.AsyncDroppedMessages")
+)
+
+/*
+EnableAsyncOutput turns on asynchronous mode, in which log messages are printed to standard error by a background routine
+instead of the caller. The latest log buffers are still updated by the caller right away. When the output is slow (e.g.
+on a serial console) and the queue of capacity queueLen becomes full, further log messages are not printed but counted
+as dropped, which ensures latency-sensitive callers are never held up by the output.
+Calling the function when asynchronous mode is already on has no effect.
+*/
+func EnableAsyncOutput(queueLen int) {
+	if queueLen < 1 {
+		queueLen = DefaultAsyncQueueLen
+	}
+	asyncQueueMutex.Lock()
+	defer asyncQueueMutex.Unlock()
+	if asyncQueue != nil {
+		return
+	}
+	asyncQueue = make(chan asyncEntry, queueLen)
+	go func(queue chan asyncEntry) {
+		for entry := range queue {
+			if entry.flushed != nil {
+				close(entry.flushed)
+			} else {
+				log.Print(entry.msg)
+			}
+		}
+	}(asyncQueue)
+}
+
+/*
+FlushAsyncOutput waits up to the timeout for the background routine to print all queued log messages. It returns true
+if the background routine has acknowledged that all of the messages queued so far have been printed, or if asynchronous
+mode is not on.
+*/
+func FlushAsyncOutput(timeout time.Duration) bool {
+	asyncQueueMutex.RLock()
+	queue := asyncQueue
+	asyncQueueMutex.RUnlock()
+	if queue == nil {
+		return true
+	}
+	// The background routine acknowledges the flush after it has finished printing the messages queued ahead of it
+	flushed := make(chan struct{})
+	deadline := time.After(timeout)
+	select {
+	case queue <- asyncEntry{flushed: flushed}:
+	case <-deadline:
+		return false
+	}
+	select {
+	case <-flushed:
+		return true
+	case <-deadline:
+		return false
+	}
+}
+
+// NumAsyncDroppedMessages returns the number of log messages that were not printed due to the output queue being full.
+func NumAsyncDroppedMessages() int64 {
+	return asyncDropped.Value()
+}
+
+// printOutput prints the log message either right away, or via the background routine if asynchronous mode is on.
+func printOutput(msg string) {
+	asyncQueueMutex.RLock()
+	queue := asyncQueue
+	asyncQueueMutex.RUnlock()
+	if queue == nil {
+		log.Print(msg)
+		return
+	}
+	select {
+	case queue <- asyncEntry{msg: msg}:
+	default:
+		asyncDropped.Increment()
+	}
+}
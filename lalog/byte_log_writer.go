@@ -19,6 +19,7 @@ type ByteLogWriter struct {
 	latestPos   int        // latestPos is the location of internal buffer to write next at.
 	everFull    bool       // everFull is true only if the internal buffer has ever been filled completely.
 	currentSize int        // currentSize is the amount of meaningful data currently residing in the internal buffer.
+	totalBytes  int64      // totalBytes is the number of bytes ever written, it also serves as the mark of the next write.
 }
 
 // NewByteLogWriter initialises a new ByteLogBuffer and returns it.
@@ -94,6 +95,17 @@ func (writer *ByteLogWriter) absorb(in []byte) {
 
 // Retrieve returns a copy of the latest bytes written.
 func (writer *ByteLogWriter) Retrieve(asciiOnly bool) (ret []byte) {
+	writer.mutex.Lock()
+	ret = writer.retrieve()
+	writer.mutex.Unlock()
+	if asciiOnly {
+		ret = asciiCopy(ret)
+	}
+	return
+}
+
+// retrieve returns a copy of the latest bytes written, the caller must hold the mutex.
+func (writer *ByteLogWriter) retrieve() []byte {
 	var bufCopy []byte
 	if writer.everFull {
 		bufCopy = make([]byte, writer.currentSize)
@@ -103,28 +115,67 @@ func (writer *ByteLogWriter) Retrieve(asciiOnly bool) (ret []byte) {
 		bufCopy = make([]byte, writer.latestPos)
 		copy(bufCopy, writer.latestBytes[:writer.latestPos])
 	}
+	return bufCopy
+}
 
-	ret = bufCopy
-	if asciiOnly {
-		var out bytes.Buffer
-		for _, r := range bufCopy {
-			if r < 128 && (unicode.IsPrint(rune(r)) || unicode.IsSpace(rune(r))) {
-				out.WriteByte(r)
-			} else {
-				out.WriteRune('?')
-			}
+// asciiCopy returns a copy of the input bytes with non-printable and non-ASCII characters substituted by question marks.
+func asciiCopy(in []byte) []byte {
+	var out bytes.Buffer
+	for _, r := range in {
+		if r < 128 && (unicode.IsPrint(rune(r)) || unicode.IsSpace(rune(r))) {
+			out.WriteByte(r)
+		} else {
+			out.WriteRune('?')
 		}
-		ret = out.Bytes()
 	}
+	return out.Bytes()
+}
 
+/*
+Mark returns the total number of bytes written so far. The mark may be given to RetrieveSinceMark later on to retrieve
+only the bytes written after this moment.
+*/
+func (writer *ByteLogWriter) Mark() int64 {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+	return writer.totalBytes
+}
+
+/*
+RetrieveSinceMark returns a copy of the bytes written after the mark, as well as a new mark for retrieving the bytes that
+will be written next. If some of the bytes written after the mark have already been evicted from the internal buffer,
+then only the remaining bytes are returned.
+*/
+func (writer *ByteLogWriter) RetrieveSinceMark(mark int64, asciiOnly bool) (ret []byte, newMark int64) {
+	writer.mutex.Lock()
+	ret, newMark = writer.retrieveSinceMark(mark)
+	writer.mutex.Unlock()
+	if asciiOnly {
+		ret = asciiCopy(ret)
+	}
 	return
 }
 
+// retrieveSinceMark returns a copy of the bytes written after the mark, the caller must hold the mutex.
+func (writer *ByteLogWriter) retrieveSinceMark(mark int64) (ret []byte, newMark int64) {
+	ret = writer.retrieve()
+	// The first byte of the internal buffer was written at this mark
+	bufStartMark := writer.totalBytes - int64(len(ret))
+	if skip := mark - bufStartMark; skip > 0 {
+		if skip > int64(len(ret)) {
+			skip = int64(len(ret))
+		}
+		ret = ret[skip:]
+	}
+	return ret, writer.totalBytes
+}
+
 // Write implements io.Writer to forward the data to destination writer.
 func (writer *ByteLogWriter) Write(p []byte) (n int, err error) {
 	writer.mutex.Lock()
 	n, err = writer.destination.Write(p)
 	writer.absorb(p)
+	writer.totalBytes += int64(len(p))
 	writer.mutex.Unlock()
 	return
 }
@@ -71,3 +71,40 @@ func TestByteLogWriterSmallChunks(t *testing.T) {
 		t.Fatal(writer.Retrieve(false))
 	}
 }
+
+func TestByteLogWriterRetrieveSinceMark(t *testing.T) {
+	null := new(bytes.Buffer)
+	writer := NewByteLogWriter(null, 5)
+	if ret, mark := writer.RetrieveSinceMark(0, false); len(ret) != 0 || mark != 0 {
+		t.Fatal(ret, mark)
+	}
+	if _, err := writer.Write([]byte{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	mark := writer.Mark()
+	if mark != 2 {
+		t.Fatal(mark)
+	}
+	if _, err := writer.Write([]byte{3}); err != nil {
+		t.Fatal(err)
+	}
+	if ret, newMark := writer.RetrieveSinceMark(mark, false); !reflect.DeepEqual(ret, []byte{3}) || newMark != 3 {
+		t.Fatal(ret, newMark)
+	}
+	if ret, newMark := writer.RetrieveSinceMark(3, false); len(ret) != 0 || newMark != 3 {
+		t.Fatal(ret, newMark)
+	}
+	// Evict the earliest bytes, the mark continues to increase.
+	if _, err := writer.Write([]byte{4, 5, 6, 7}); err != nil {
+		t.Fatal(err)
+	}
+	if ret, newMark := writer.RetrieveSinceMark(mark, false); !reflect.DeepEqual(ret, []byte{3, 4, 5, 6, 7}) || newMark != 7 {
+		t.Fatal(ret, newMark)
+	}
+	if ret, _ := writer.RetrieveSinceMark(0, false); !reflect.DeepEqual(ret, []byte{3, 4, 5, 6, 7}) {
+		t.Fatal(ret)
+	}
+	if ret, _ := writer.RetrieveSinceMark(5, true); !reflect.DeepEqual(ret, []byte{63, 63}) {
+		t.Fatal(ret)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 )
@@ -18,6 +19,18 @@ const (
 	NumLatestLogEntries = 128
 	// MaxLogMessageLen is the maximum length memorised for each of the latest log entries.
 	MaxLogMessageLen = 2048
+	/*
+		DedupWindow is the period of time in which repetitions of an identical log message are counted. At the end of the
+		window, the number of suppressed repetitions (if any) is logged, and counting starts over.
+	*/
+	DedupWindow = 10 * time.Second
+	/*
+		DedupMaxRepeats is the number of times an identical log message may be printed within DedupWindow. Further
+		repetitions within the window are suppressed and collapsed into a single "last message repeated" entry, this
+		prevents a flood of identical messages (e.g. retries of a failing connection) from evicting all other entries
+		from the latest log buffers.
+	*/
+	DedupMaxRepeats = 3
 )
 
 var LatestLogs = NewRingBuffer(NumLatestLogEntries)     // Keep latest log entry of all kinds in the buffer
@@ -40,20 +53,29 @@ type Logger struct {
 
 // Format a log message and return, but do not print it.
 func (logger *Logger) Format(functionName, actorName string, err error, template string, values ...interface{}) string {
+	return logger.format(true, functionName, actorName, err, template, values...)
+}
+
+/*
+format formats a log message and returns it. If withTraceID is false, the trace ID is left out of the message, so that
+the handling of different requests that run into the same problem produce identical messages.
+*/
+func (logger *Logger) format(withTraceID bool, functionName, actorName string, err error, template string, values ...interface{}) string {
 	// Message is going to look like this:
 	// ComponentName[IDKey1-IDVal1;IDKey2-IDVal2].FunctionName(actorName): Error "no such file" - failed to start component
 	var msg bytes.Buffer
 	if logger.ComponentName != "" {
 		msg.WriteString(logger.ComponentName)
 	}
-	if logger.ComponentID != nil && len(logger.ComponentID) > 0 {
-		msg.WriteRune('[')
-		for i, field := range logger.ComponentID {
-			msg.WriteString(fmt.Sprintf("%s=%v", field.Key, field.Value))
-			if i < len(logger.ComponentID)-1 {
-				msg.WriteRune(';')
-			}
+	idFields := make([]string, 0, len(logger.ComponentID))
+	for _, field := range logger.ComponentID {
+		if withTraceID || field.Key != TraceIDKey {
+			idFields = append(idFields, fmt.Sprintf("%s=%v", field.Key, field.Value))
 		}
+	}
+	if len(idFields) > 0 {
+		msg.WriteRune('[')
+		msg.WriteString(strings.Join(idFields, ";"))
 		msg.WriteRune(']')
 	}
 	if functionName != "" {
@@ -75,35 +97,173 @@ func (logger *Logger) Format(functionName, actorName string, err error, template
 		}
 	}
 	msg.WriteString(fmt.Sprintf(template, values...))
-	return LintString(TruncateString(msg.String(), MaxLogMessageLen), MaxLogMessageLen)
+	// Remove secrets before truncation, so that a secret cut in half by truncation does not escape redaction.
+	return LintString(TruncateString(Redact(msg.String()), MaxLogMessageLen), MaxLogMessageLen)
 }
 
 // Print a log message and keep the message in warnings buffer.
 func (logger *Logger) Warning(functionName, actorName string, err error, template string, values ...interface{}) {
-	msg := logger.Format(functionName, actorName, err, template, values...)
-	msgWithTime := time.Now().Format("2006-01-02 15:04:05 ") + msg
-	LatestLogs.Push(msgWithTime)
-	LatestWarnings.Push(msgWithTime)
-	log.Print(msg)
+	logger.countWarning()
+	msg, dedupKey := logger.formatWithDedupKey(functionName, actorName, err, template, values...)
+	keepAndPrint(msg, dedupKey, true)
 }
 
 // Print a log message and keep the message in latest log buffer. If there is an error, also keep the message in warnings buffer.
 func (logger *Logger) Info(functionName, actorName string, err error, template string, values ...interface{}) {
-	msg := logger.Format(functionName, actorName, err, template, values...)
+	// If the log message comes with an error, upgrade the severity level to warning, so place it into recent warnings.
+	if err != nil {
+		logger.countWarning()
+	}
+	msg, dedupKey := logger.formatWithDedupKey(functionName, actorName, err, template, values...)
+	keepAndPrint(msg, dedupKey, err != nil)
+}
+
+/*
+formatWithDedupKey formats a log message, and additionally returns the key that identifies repetitions of the message,
+which is the message without the trace ID.
+*/
+func (logger *Logger) formatWithDedupKey(functionName, actorName string, err error, template string, values ...interface{}) (msg, dedupKey string) {
+	msg = logger.Format(functionName, actorName, err, template, values...)
+	if logger.TraceID() == "" {
+		return msg, msg
+	}
+	return msg, logger.format(false, functionName, actorName, err, template, values...)
+}
+
+// countWarning increases the counter of warnings logged by the component, e.g. "dnsd.Warnings".
+func (logger *Logger) countWarning() {
+	if logger.ComponentName != "" {
+		logger.Counter("Warnings").Increment()
+	}
+}
+
+/*
+keepAndPrint prints a formatted log message and keeps it in latest log buffer, and optionally in warnings buffer as well.
+Rapid repetitions of an identical message (identified by the dedup key) are collapsed by the package-wide deduplication
+state.
+*/
+func keepAndPrint(msg, dedupKey string, isWarning bool) {
+	admit, summary, summaryIsWarning := logDedup.admit(dedupKey, isWarning, time.Now())
+	if summary != "" {
+		keepAndPrintVerbatim(summary, summaryIsWarning)
+	}
+	if admit {
+		keepAndPrintVerbatim(msg, isWarning)
+	}
+}
+
+// keepAndPrintVerbatim stores the log message in latest log buffers and then prints it, without further consideration.
+func keepAndPrintVerbatim(msg string, isWarning bool) {
 	msgWithTime := time.Now().Format("2006-01-02 15:04:05 ") + msg
 	LatestLogs.Push(msgWithTime)
-	if err != nil {
-		// If the log message comes with an error, upgrade the severity level to warning, so place it into recent warnings.
+	if isWarning {
 		LatestWarnings.Push(msgWithTime)
 	}
-	log.Print(msg)
+	printOutput(msg)
+}
+
+// logDedup is the deduplication state shared by all loggers, as they all share the same latest log buffers and output.
+var logDedup = &messageDedup{}
+
+/*
+messageDedup keeps track of the latest log message and how many times it has been repeated in the current window, in
+order to collapse rapid repetitions of an identical message into one "last message repeated N times" entry.
+*/
+type messageDedup struct {
+	mutex           sync.Mutex
+	lastMsg         string    // lastMsg is the dedup key of the latest log message admitted or suppressed.
+	lastIsWarning   bool      // lastIsWarning is true if the latest log message was a warning.
+	windowStart     time.Time // windowStart is the time at which the current deduplication window began.
+	repeats         int       // repeats is the number of times lastMsg has been seen in the current window.
+	numSuppressed   int       // numSuppressed is the number of repetitions of lastMsg suppressed in the current window.
+	totalSuppressed int64     // totalSuppressed is the accumulated number of suppressed messages since program start.
+	// flushTimer prints the summary of suppressed repetitions at the end of window, in case no other message concludes it.
+	flushTimer *time.Timer
+}
+
+/*
+admit determines whether the log message should be printed. If the message breaks a streak of suppressed repetitions,
+or the deduplication window has passed, the function also returns a summary of the suppressed repetitions that should be
+printed before the message itself.
+*/
+func (dedup *messageDedup) admit(msg string, isWarning bool, now time.Time) (admit bool, summary string, summaryIsWarning bool) {
+	dedup.mutex.Lock()
+	defer dedup.mutex.Unlock()
+	if msg == dedup.lastMsg && now.Sub(dedup.windowStart) < DedupWindow {
+		dedup.repeats++
+		if dedup.repeats > DedupMaxRepeats {
+			dedup.numSuppressed++
+			dedup.totalSuppressed++
+			if dedup.numSuppressed == 1 {
+				dedup.flushTimer = time.AfterFunc(time.Until(dedup.windowStart.Add(DedupWindow)), dedup.flush)
+			}
+			return false, "", false
+		}
+		return true, "", false
+	}
+	// A different message or the end of window concludes the streak of repetitions
+	summary, summaryIsWarning = dedup.takeSummary()
+	dedup.lastMsg = msg
+	dedup.lastIsWarning = isWarning
+	dedup.windowStart = now
+	dedup.repeats = 1
+	return true, summary, summaryIsWarning
+}
+
+/*
+takeSummary returns the summary of suppressed repetitions of the latest message, or an empty string if there is none.
+The next repetition of the message begins a new window. The caller must hold the mutex.
+*/
+func (dedup *messageDedup) takeSummary() (summary string, isWarning bool) {
+	if dedup.flushTimer != nil {
+		dedup.flushTimer.Stop()
+		dedup.flushTimer = nil
+	}
+	if dedup.numSuppressed == 0 {
+		return "", false
+	}
+	summary = fmt.Sprintf("last message repeated %d times", dedup.numSuppressed)
+	isWarning = dedup.lastIsWarning
+	dedup.numSuppressed = 0
+	dedup.windowStart = time.Time{}
+	return
+}
+
+// flush prints the summary of suppressed repetitions of the latest message, if there is any.
+func (dedup *messageDedup) flush() {
+	dedup.mutex.Lock()
+	summary, isWarning := dedup.takeSummary()
+	dedup.mutex.Unlock()
+	if summary != "" {
+		keepAndPrintVerbatim(summary, isWarning)
+	}
+}
+
+/*
+FlushRepeatedMessages prints the summary of suppressed repetitions of the latest log message right away, instead of
+waiting for the end of deduplication window. Call it before the program exits.
+*/
+func FlushRepeatedMessages() {
+	logDedup.flush()
+}
+
+// NumSuppressedRepetitions returns the total number of repeated log messages that have been suppressed since program start.
+func NumSuppressedRepetitions() int64 {
+	logDedup.mutex.Lock()
+	defer logDedup.mutex.Unlock()
+	return logDedup.totalSuppressed
 }
 
 func (logger *Logger) Abort(functionName, actorName string, err error, template string, values ...interface{}) {
+	// Give the queued log messages a chance to be printed before the program exits
+	FlushRepeatedMessages()
+	FlushAsyncOutput(1 * time.Second)
 	log.Fatal(logger.Format(functionName, actorName, err, template, values...))
 }
 
 func (logger *Logger) Panic(functionName, actorName string, err error, template string, values ...interface{}) {
+	FlushRepeatedMessages()
+	FlushAsyncOutput(1 * time.Second)
 	log.Panic(logger.Format(functionName, actorName, err, template, values...))
 }
 
@@ -2,8 +2,12 @@ package lalog
 
 import (
 	"errors"
+	"log"
+	"os"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestLogger_Format(t *testing.T) {
@@ -124,6 +128,91 @@ func TestLogger_Warningf(t *testing.T) {
 	}
 }
 
+func TestMessageDedup(t *testing.T) {
+	dedup := &messageDedup{}
+	now := time.Now()
+	// Up to DedupMaxRepeats repetitions are admitted
+	for i := 0; i < DedupMaxRepeats; i++ {
+		if admit, summary, _ := dedup.admit("a", false, now); !admit || summary != "" {
+			t.Fatal(i, admit, summary)
+		}
+	}
+	// Further repetitions in the window are suppressed
+	for i := 0; i < 5; i++ {
+		if admit, summary, _ := dedup.admit("a", true, now.Add(time.Second)); admit || summary != "" {
+			t.Fatal(i, admit, summary)
+		}
+	}
+	// A different message concludes the streak
+	if admit, summary, isWarning := dedup.admit("b", true, now.Add(2*time.Second)); !admit || summary != "last message repeated 5 times" || isWarning {
+		t.Fatal(admit, summary, isWarning)
+	}
+	if admit, summary, _ := dedup.admit("b", true, now.Add(3*time.Second)); !admit || summary != "" {
+		t.Fatal(admit, summary)
+	}
+	// Repetitions after the window are admitted again
+	for i := 0; i < DedupMaxRepeats; i++ {
+		dedup.admit("b", true, now.Add(4*time.Second))
+	}
+	if admit, summary, isWarning := dedup.admit("b", true, now.Add(3*time.Second+DedupWindow)); !admit || summary != "last message repeated 2 times" || !isWarning {
+		t.Fatal(admit, summary, isWarning)
+	}
+	if dedup.totalSuppressed != 7 {
+		t.Fatal(dedup.totalSuppressed)
+	}
+}
+
+func TestMessageDedup_Flush(t *testing.T) {
+	dedup := &messageDedup{}
+	// The summary of suppressed repetitions is printed at the end of window even if no other message follows
+	windowStart := time.Now().Add(-DedupWindow + 100*time.Millisecond)
+	for i := 0; i < DedupMaxRepeats+2; i++ {
+		dedup.admit("TestMessageDedup_Flush timer", false, windowStart)
+	}
+	time.Sleep(500 * time.Millisecond)
+	if logs := LatestLogs.GetAll(); !strings.HasSuffix(logs[len(logs)-1], "last message repeated 2 times") {
+		t.Fatal(logs)
+	}
+	// The next repetition begins a new window
+	if admit, summary, _ := dedup.admit("TestMessageDedup_Flush timer", false, time.Now()); !admit || summary != "" {
+		t.Fatal(admit, summary)
+	}
+	// Flush the summary on demand
+	now := time.Now()
+	for i := 0; i < DedupMaxRepeats+3; i++ {
+		dedup.admit("TestMessageDedup_Flush", true, now)
+	}
+	dedup.flush()
+	if warnings := LatestWarnings.GetAll(); !strings.HasSuffix(warnings[len(warnings)-1], "last message repeated 3 times") {
+		t.Fatal(warnings)
+	}
+	dedup.mutex.Lock()
+	defer dedup.mutex.Unlock()
+	if dedup.flushTimer != nil || dedup.numSuppressed != 0 {
+		t.Fatal(dedup.flushTimer, dedup.numSuppressed)
+	}
+}
+
+func TestLogger_DedupIgnoresTraceID(t *testing.T) {
+	logger := Logger{ComponentName: "TestLogger_DedupIgnoresTraceID"}
+	before := NumSuppressedRepetitions()
+	for i := 0; i < DedupMaxRepeats+2; i++ {
+		traced := logger.WithTraceID(NewTraceID())
+		traced.Warning("", "", nil, "identical message")
+	}
+	if suppressed := NumSuppressedRepetitions() - before; suppressed != 2 {
+		t.Fatal(suppressed)
+	}
+	// The admitted messages still carry their trace IDs
+	if warnings := LatestWarnings.GetAll(); !strings.Contains(warnings[len(warnings)-1], TraceIDKey+"=") {
+		t.Fatal(warnings)
+	}
+	FlushRepeatedMessages()
+	if warnings := LatestWarnings.GetAll(); !strings.HasSuffix(warnings[len(warnings)-1], "last message repeated 2 times") {
+		t.Fatal(warnings)
+	}
+}
+
 func TestLogger_MaybeError(t *testing.T) {
 	logger := Logger{}
 	logger.MaybeMinorError(nil)
@@ -189,3 +278,89 @@ func TestLintString(t *testing.T) {
 		t.Fatalf("\n%s\n%s\n%v\n%v\n", a, match, []byte(a), []byte(match))
 	}
 }
+
+func TestAsyncOutput(t *testing.T) {
+	if !FlushAsyncOutput(time.Second) {
+		t.Fatal("flush should succeed when async output is off")
+	}
+	EnableAsyncOutput(1)
+	EnableAsyncOutput(100)
+	if cap(asyncQueue) != 1 {
+		t.Fatal(cap(asyncQueue))
+	}
+	logger := Logger{}
+	for i := 0; i < 1000; i++ {
+		logger.Info("TestAsyncOutput", "", nil, "message %d", i)
+	}
+	if !FlushAsyncOutput(5 * time.Second) {
+		t.Fatal("did not flush")
+	}
+	// The latest log buffer is updated regardless of the output queue
+	if !strings.Contains(LatestLogs.GetAll()[NumLatestLogEntries-1], "message 999") {
+		t.Fatal(LatestLogs.GetAll())
+	}
+	if NumAsyncDroppedMessages() == 0 {
+		t.Fatal("should have dropped some messages")
+	}
+	// Turn async output off for other test cases
+	asyncQueueMutex.Lock()
+	close(asyncQueue)
+	asyncQueue = nil
+	asyncQueueMutex.Unlock()
+}
+
+// slowWriter takes a while to write each log message.
+type slowWriter struct {
+	delay   time.Duration
+	mutex   sync.Mutex
+	written []string
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(w.delay)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.written = append(w.written, string(p))
+	return len(p), nil
+}
+
+func (w *slowWriter) numWritten() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return len(w.written)
+}
+
+func TestFlushAsyncOutput_WaitsForFinalWrite(t *testing.T) {
+	writer := &slowWriter{delay: 300 * time.Millisecond}
+	log.SetOutput(writer)
+	defer log.SetOutput(os.Stderr)
+	EnableAsyncOutput(10)
+	defer func() {
+		asyncQueueMutex.Lock()
+		close(asyncQueue)
+		asyncQueue = nil
+		asyncQueueMutex.Unlock()
+	}()
+	printOutput("TestFlushAsyncOutput_WaitsForFinalWrite 1")
+	printOutput("TestFlushAsyncOutput_WaitsForFinalWrite 2")
+	// The queue empties as soon as the background routine picks up the final message, which is still being written.
+	if !FlushAsyncOutput(5 * time.Second) {
+		t.Fatal("did not flush")
+	}
+	if n := writer.numWritten(); n != 2 {
+		t.Fatal(n)
+	}
+	// Give up waiting for a slow write after the timeout
+	slowerWriter := &slowWriter{delay: 2 * time.Second}
+	log.SetOutput(slowerWriter)
+	printOutput("TestFlushAsyncOutput_WaitsForFinalWrite 3")
+	if FlushAsyncOutput(100 * time.Millisecond) {
+		t.Fatal("should have timed out")
+	}
+	if !FlushAsyncOutput(5 * time.Second) {
+		t.Fatal("did not flush")
+	}
+	if n := slowerWriter.numWritten(); n != 1 {
+		t.Fatal(n)
+	}
+}
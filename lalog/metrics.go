@@ -0,0 +1,156 @@
+package lalog
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Counter is a named numeric value that only ever increases, such as the number of dropped packets.
+type Counter struct {
+	value int64
+}
+
+// Add increases the counter by delta. A negative delta is ignored.
+func (counter *Counter) Add(delta int64) {
+	if delta > 0 {
+		atomic.AddInt64(&counter.value, delta)
+	}
+}
+
+// Increment increases the counter by one.
+func (counter *Counter) Increment() {
+	atomic.AddInt64(&counter.value, 1)
+}
+
+// Value returns the current counter value.
+func (counter *Counter) Value() int64 {
+	return atomic.LoadInt64(&counter.value)
+}
+
+// Gauge is a named numeric value that may go up and down, such as the size of a queue.
+type Gauge struct {
+	value int64
+}
+
+// Add increases (or decreases if delta is negative) the gauge by delta and returns the new value.
+func (gauge *Gauge) Add(delta int64) int64 {
+	return atomic.AddInt64(&gauge.value, delta)
+}
+
+// Set overwrites the gauge value.
+func (gauge *Gauge) Set(value int64) {
+	atomic.StoreInt64(&gauge.value, value)
+}
+
+// Value returns the current gauge value.
+func (gauge *Gauge) Value() int64 {
+	return atomic.LoadInt64(&gauge.value)
+}
+
+var (
+	counters     = make(map[string]*Counter)
+	gauges       = make(map[string]*Gauge)
+	metricsMutex = new(sync.Mutex)
+)
+
+/*
+GetCounter returns the counter registered under the name, the counter is created and registered if it does not yet
+exist. Counters live for the entire lifetime of the program, callers should retrieve a counter once and keep it.
+*/
+func GetCounter(name string) *Counter {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	counter, exists := counters[name]
+	if !exists {
+		counter = new(Counter)
+		counters[name] = counter
+	}
+	return counter
+}
+
+/*
+GetGauge returns the gauge registered under the name, the gauge is created and registered if it does not yet exist.
+Gauges live for the entire lifetime of the program, callers should retrieve a gauge once and keep it.
+*/
+func GetGauge(name string) *Gauge {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	gauge, exists := gauges[name]
+	if !exists {
+		gauge = new(Gauge)
+		gauges[name] = gauge
+	}
+	return gauge
+}
+
+// Counter returns the counter named after the logger's component and the input name, e.g. "dnsd.BlackListHits".
+func (logger *Logger) Counter(name string) *Counter {
+	return GetCounter(logger.metricName(name))
+}
+
+// Gauge returns the gauge named after the logger's component and the input name, e.g. "mailp.QueueLength".
+func (logger *Logger) Gauge(name string) *Gauge {
+	return GetGauge(logger.metricName(name))
+}
+
+/*
+metricName returns the metric name made of the logger's component and the input name. A logger without a component
+name (e.g. the zero value) uses the component name of the default logger, e.g. "default.RateLimitHits".
+*/
+func (logger *Logger) metricName(name string) string {
+	componentName := logger.ComponentName
+	if componentName == "" {
+		componentName = DefaultLogger.ComponentName
+	}
+	return componentName + "." + name
+}
+
+// GetCounterValues returns the latest value of all counters, keyed by their names.
+func GetCounterValues() map[string]int64 {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	ret := make(map[string]int64, len(counters)+1)
+	for name, counter := range counters {
+		ret[name] = counter.Value()
+	}
+	ret["lalog.SuppressedRepetitions"] = NumSuppressedRepetitions()
+	return ret
+}
+
+// GetGaugeValues returns the latest value of all gauges, keyed by their names.
+func GetGaugeValues() map[string]int64 {
+	metricsMutex.Lock()
+	defer metricsMutex.Unlock()
+	ret := make(map[string]int64, len(gauges))
+	for name, gauge := range gauges {
+		ret[name] = gauge.Value()
+	}
+	return ret
+}
+
+// GetMetrics returns the latest value of all counters and gauges, keyed by their names.
+func GetMetrics() map[string]int64 {
+	ret := GetCounterValues()
+	for name, value := range GetGaugeValues() {
+		ret[name] = value
+	}
+	return ret
+}
+
+// FormatMetrics returns the latest value of all counters and gauges in a multi-line text, sorted by their names.
+func FormatMetrics() string {
+	metrics := GetMetrics()
+	names := make([]string, 0, len(metrics))
+	for name := range metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		buf.WriteString(fmt.Sprintf("%-40s %d\n", name, metrics[name]))
+	}
+	return buf.String()
+}
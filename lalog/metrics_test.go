@@ -0,0 +1,54 @@
+package lalog
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	counter := GetCounter("test.Counter")
+	if counter != GetCounter("test.Counter") {
+		t.Fatal("did not return the same counter")
+	}
+	counter.Increment()
+	counter.Add(2)
+	counter.Add(-10)
+	if v := counter.Value(); v != 3 {
+		t.Fatal(v)
+	}
+
+	logger := Logger{ComponentName: "test"}
+	gauge := logger.Gauge("Gauge")
+	if gauge != GetGauge("test.Gauge") {
+		t.Fatal("did not return the same gauge")
+	}
+	gauge.Set(10)
+	if v := gauge.Add(-4); v != 6 {
+		t.Fatal(v)
+	}
+	logger.Counter("Counter").Increment()
+
+	logger.Warning("TestMetrics", "", nil, "test warning")
+	logger.Info("TestMetrics", "", errors.New("test error"), "")
+
+	metrics := GetMetrics()
+	if metrics["test.Counter"] != 4 || metrics["test.Gauge"] != 6 || metrics["test.Warnings"] != 2 {
+		t.Fatal(metrics)
+	}
+	if _, exists := metrics["lalog.SuppressedRepetitions"]; !exists {
+		t.Fatal(metrics)
+	}
+	// A logger without a component name uses the default component name
+	zeroLogger := Logger{}
+	zeroLogger.Counter("Counter").Increment()
+	if metrics := GetMetrics(); metrics["default.Counter"] != 1 {
+		t.Fatal(metrics)
+	} else if _, exists := metrics[".Counter"]; exists {
+		t.Fatal(metrics)
+	}
+	formatted := FormatMetrics()
+	if !strings.Contains(formatted, "test.Counter") || strings.Index(formatted, "test.Counter") > strings.Index(formatted, "test.Gauge") {
+		t.Fatal(formatted)
+	}
+}
@@ -0,0 +1,64 @@
+package lalog
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const (
+	// RedactedLabel substitutes secrets found in log messages.
+	RedactedLabel = "[redacted]"
+	/*
+		MinRedactionLen is the minimum length of a secret string registered for redaction. Shorter strings are too likely
+		to appear in ordinary log messages by coincidence, redacting them would render the messages useless.
+	*/
+	MinRedactionLen = 4
+)
+
+var (
+	redactSecrets  []string         // redactSecrets are the verbatim secret strings to be removed from log messages.
+	redactPatterns []*regexp.Regexp // redactPatterns match secrets to be removed from log messages.
+	redactMutex    = new(sync.RWMutex)
+)
+
+/*
+RegisterRedaction registers a secret string (such as an access PIN, password, or API token) that will be substituted
+by RedactedLabel in all log messages formatted from now on. Secrets shorter than MinRedactionLen are ignored.
+*/
+func RegisterRedaction(secret string) {
+	if len(secret) < MinRedactionLen {
+		return
+	}
+	redactMutex.Lock()
+	defer redactMutex.Unlock()
+	for _, existing := range redactSecrets {
+		if existing == secret {
+			return
+		}
+	}
+	redactSecrets = append(redactSecrets, secret)
+}
+
+// RegisterRedactionPattern registers a regular expression, all matches of which will be substituted by RedactedLabel.
+func RegisterRedactionPattern(pattern *regexp.Regexp) {
+	if pattern == nil {
+		return
+	}
+	redactMutex.Lock()
+	defer redactMutex.Unlock()
+	redactPatterns = append(redactPatterns, pattern)
+}
+
+// Redact returns a copy of the input string with all registered secrets and pattern matches substituted by RedactedLabel.
+func Redact(in string) string {
+	redactMutex.RLock()
+	defer redactMutex.RUnlock()
+	for _, secret := range redactSecrets {
+		in = strings.Replace(in, secret, RedactedLabel, -1)
+	}
+	for _, pattern := range redactPatterns {
+		in = pattern.ReplaceAllLiteralString(in, RedactedLabel)
+	}
+	return in
+}
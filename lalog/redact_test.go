@@ -0,0 +1,24 @@
+package lalog
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	if out := Redact("nothing to hide"); out != "nothing to hide" {
+		t.Fatal(out)
+	}
+	// Too short to be redacted
+	RegisterRedaction("to")
+	RegisterRedaction("verysecretpin")
+	RegisterRedaction("verysecretpin")
+	RegisterRedactionPattern(regexp.MustCompile(`token=[0-9a-f]+`))
+	if out := Redact("verysecretpin.s echo token=abc123 to"); out != RedactedLabel+".s echo "+RedactedLabel+" to" {
+		t.Fatal(out)
+	}
+	logger := Logger{ComponentName: "comp"}
+	if msg := logger.Format("fun", "verysecretpin", nil, "%s", "verysecretpin"); msg != "comp.fun([redacted]): [redacted]" {
+		t.Fatal(msg)
+	}
+}
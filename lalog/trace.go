@@ -0,0 +1,75 @@
+package lalog
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// TraceIDKey is the key of logger's ComponentID field that carries trace ID.
+const TraceIDKey = "Trace"
+
+// traceIDContextKey is the type of context key that carries trace ID among context values.
+type traceIDContextKey struct{}
+
+/*
+NewTraceID returns a short random string that identifies the handling of a single request (HTTP request, DNS query,
+incoming SMS, etc.) among log entries. The trace ID is not meant to be secretive.
+*/
+func NewTraceID() string {
+	randBytes := make([]byte, 6)
+	if _, err := rand.Read(randBytes); err != nil {
+		return "untraceable"
+	}
+	return hex.EncodeToString(randBytes)
+}
+
+// ContextWithTraceID returns a copy of the parent context that carries the trace ID.
+func ContextWithTraceID(parent context.Context, traceID string) context.Context {
+	return context.WithValue(parent, traceIDContextKey{}, traceID)
+}
+
+// TraceIDFromContext returns the trace ID carried by the context, or an empty string if there is not one.
+func TraceIDFromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	traceID, _ := ctx.Value(traceIDContextKey{}).(string)
+	return traceID
+}
+
+/*
+WithTraceID returns a copy of the logger that includes the trace ID in all log messages it formats. If the trace ID is
+empty, the returned copy is identical to the original logger.
+*/
+func (logger *Logger) WithTraceID(traceID string) Logger {
+	ret := Logger{ComponentName: logger.ComponentName}
+	ret.ComponentID = make([]LoggerIDField, 0, len(logger.ComponentID)+1)
+	for _, field := range logger.ComponentID {
+		// A logger only carries one trace ID at a time
+		if field.Key != TraceIDKey {
+			ret.ComponentID = append(ret.ComponentID, field)
+		}
+	}
+	if traceID != "" {
+		ret.ComponentID = append(ret.ComponentID, LoggerIDField{Key: TraceIDKey, Value: traceID})
+	}
+	return ret
+}
+
+// WithContext returns a copy of the logger that includes the trace ID carried by the context in all log messages.
+func (logger *Logger) WithContext(ctx context.Context) Logger {
+	return logger.WithTraceID(TraceIDFromContext(ctx))
+}
+
+// TraceID returns the trace ID carried by the logger, or an empty string if there is not one.
+func (logger *Logger) TraceID() string {
+	for _, field := range logger.ComponentID {
+		if field.Key == TraceIDKey {
+			if traceID, ok := field.Value.(string); ok {
+				return traceID
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,43 @@
+package lalog
+
+import (
+	"context"
+	"testing"
+)
+
+func TestTraceID(t *testing.T) {
+	if id1, id2 := NewTraceID(), NewTraceID(); len(id1) != 12 || id1 == id2 {
+		t.Fatal(id1, id2)
+	}
+	if id := TraceIDFromContext(context.Background()); id != "" {
+		t.Fatal(id)
+	}
+	ctx := ContextWithTraceID(context.Background(), "abc")
+	if id := TraceIDFromContext(ctx); id != "abc" {
+		t.Fatal(id)
+	}
+
+	logger := Logger{ComponentName: "comp", ComponentID: []LoggerIDField{{"ID", 1}}}
+	if id := logger.TraceID(); id != "" {
+		t.Fatal(id)
+	}
+	traced := logger.WithContext(ctx)
+	if id := traced.TraceID(); id != "abc" {
+		t.Fatal(id)
+	}
+	if msg := traced.Format("fun", "act", nil, "msg"); msg != "comp[ID=1;Trace=abc].fun(act): msg" {
+		t.Fatal(msg)
+	}
+	// The original logger must not be altered
+	if len(logger.ComponentID) != 1 {
+		t.Fatal(logger.ComponentID)
+	}
+	// A logger carries only one trace ID
+	retraced := traced.WithTraceID("def")
+	if len(retraced.ComponentID) != 2 || retraced.TraceID() != "def" {
+		t.Fatal(retraced.ComponentID)
+	}
+	if untraced := traced.WithTraceID(""); len(untraced.ComponentID) != 1 || untraced.TraceID() != "" {
+		t.Fatal(untraced.ComponentID)
+	}
+}
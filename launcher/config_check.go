@@ -0,0 +1,196 @@
+package launcher
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// getJSONPosition returns the line and column numbers of the byte offset in JSON input.
+func getJSONPosition(in []byte, offset int64) (line, col int) {
+	if offset > int64(len(in)) {
+		offset = int64(len(in))
+	} else if offset < 0 {
+		offset = 0
+	}
+	before := in[:offset]
+	line = bytes.Count(before, []byte{'\n'}) + 1
+	col = len(before) - bytes.LastIndexByte(before, '\n')
+	return
+}
+
+/*
+getJSONFields returns the JSON key names (in lower case) VS field types of a structure, including those of embedded
+structures.
+*/
+func getJSONFields(structType reflect.Type) map[string]reflect.Type {
+	ret := make(map[string]reflect.Type)
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if field.Anonymous && name == "" {
+			embeddedType := field.Type
+			if embeddedType.Kind() == reflect.Ptr {
+				embeddedType = embeddedType.Elem()
+			}
+			if embeddedType.Kind() == reflect.Struct {
+				for embeddedName, embeddedFieldType := range getJSONFields(embeddedType) {
+					ret[embeddedName] = embeddedFieldType
+				}
+				continue
+			}
+		}
+		if field.PkgPath != "" {
+			// Unexported field
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		ret[strings.ToLower(name)] = field.Type
+	}
+	return ret
+}
+
+/*
+findUnknownJSONFields walks through the deserialised JSON value alongside the type it deserialises into, and returns
+the JSON paths of object keys that do not correspond to any structure field. These are usually typos, which JSON
+deserialisation silently ignores.
+*/
+func findUnknownJSONFields(value interface{}, valueType reflect.Type, path string) (ret []string) {
+	for valueType.Kind() == reflect.Ptr {
+		valueType = valueType.Elem()
+	}
+	// Types that deserialise themselves are not inspected
+	if reflect.PtrTo(valueType).Implements(jsonUnmarshalerType) || reflect.PtrTo(valueType).Implements(textUnmarshalerType) {
+		return nil
+	}
+	switch valueType.Kind() {
+	case reflect.Struct:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		fields := getJSONFields(valueType)
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fieldPath := key
+			if path != "" {
+				fieldPath = path + "." + key
+			}
+			if fieldType, found := fields[strings.ToLower(key)]; found {
+				ret = append(ret, findUnknownJSONFields(obj[key], fieldType, fieldPath)...)
+			} else {
+				ret = append(ret, fieldPath)
+			}
+		}
+	case reflect.Map:
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			ret = append(ret, findUnknownJSONFields(obj[key], valueType.Elem(), fmt.Sprintf("%s[%q]", path, key))...)
+		}
+	case reflect.Slice, reflect.Array:
+		array, ok := value.([]interface{})
+		if !ok {
+			return nil
+		}
+		for i, elem := range array {
+			ret = append(ret, findUnknownJSONFields(elem, valueType.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return
+}
+
+/*
+CheckConfig deserialises configuration JSON and initialises app features and the daemons without starting them (hence
+without listening on network ports). It returns all problems found along the way, such as syntax errors, unknown
+(misspelled) keys, values of wrong type, and initialisation errors. If daemon names are not given, the daemons that have
+their own configuration sections in the JSON will be checked.
+*/
+func CheckConfig(configJSON []byte, daemonNames []string) (problems []string) {
+	var value interface{}
+	if err := json.Unmarshal(configJSON, &value); err != nil {
+		if syntaxErr, ok := err.(*json.SyntaxError); ok {
+			// The offset is right after the offending character
+			line, col := getJSONPosition(configJSON, syntaxErr.Offset-1)
+			return []string{fmt.Sprintf("line %d column %d: %v", line, col, err)}
+		}
+		return []string{err.Error()}
+	}
+	if _, ok := value.(map[string]interface{}); !ok {
+		return []string{"the configuration must be a JSON object"}
+	}
+	for _, path := range findUnknownJSONFields(value, reflect.TypeOf(Config{}), "") {
+		problems = append(problems, fmt.Sprintf("%s: unknown key, it will be ignored", path))
+	}
+	var config Config
+	if err := json.Unmarshal(configJSON, &config); err != nil {
+		if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+			line, col := getJSONPosition(configJSON, typeErr.Offset)
+			problems = append(problems, fmt.Sprintf("%s (line %d column %d): cannot use JSON %s as %s", typeErr.Field, line, col, typeErr.Value, typeErr.Type))
+		} else {
+			problems = append(problems, err.Error())
+		}
+		return
+	}
+	config.logger.ComponentName = "config"
+	if err := config.Initialise(); err != nil {
+		problems = append(problems, fmt.Sprintf("Features: %v", err))
+		return
+	}
+	for _, profileName := range config.GetProfileNames() {
+		if _, err := config.GetProfileDaemons(profileName); err != nil {
+			problems = append(problems, fmt.Sprintf("Profiles[%q]: %v", profileName, err))
+		}
+	}
+	if len(daemonNames) == 0 {
+		// Key names are not case sensitive
+		sections := make(map[string]bool)
+		for key := range value.(map[string]interface{}) {
+			sections[strings.ToLower(key)] = true
+		}
+		for _, daemonName := range AllDaemons {
+			for _, section := range daemonConfigSections[daemonName] {
+				if sections[strings.ToLower(section)] {
+					daemonNames = append(daemonNames, daemonName)
+					break
+				}
+			}
+		}
+	}
+	// Initialisation errors are memorised instead of aborting the program
+	ctl := &DaemonControl{Config: &config, DaemonNames: daemonNames}
+	for _, daemonName := range daemonNames {
+		config.beginReinit()
+		ctl.getStartFunc(daemonName)
+		if err := config.endReinit(); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", daemonName, err))
+		}
+	}
+	return
+}
@@ -0,0 +1,59 @@
+package launcher
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	// The sample configuration carries two obsolete keys
+	if problems := CheckConfig([]byte(sampleConfigJSON), nil); !reflect.DeepEqual(problems, []string{
+		`MailCommandRunner.CommandTimeoutSec: unknown key, it will be ignored`,
+		`Maintenance.TCPPorts: unknown key, it will be ignored`,
+	}) {
+		t.Fatal(problems)
+	}
+	// Syntax error
+	if problems := CheckConfig([]byte("{\n  \"DNSDaemon\": {\n    \"TCPPort\": 53,,\n  }\n}"), nil); len(problems) != 1 || !strings.HasPrefix(problems[0], "line 3 column 19:") {
+		t.Fatal(problems)
+	}
+	if problems := CheckConfig([]byte(`[]`), nil); len(problems) != 1 {
+		t.Fatal(problems)
+	}
+	// Misspelled keys, the letter case of keys does not matter.
+	problems := CheckConfig([]byte(`{
+  "dnsdaemon": {"Adress": "127.0.0.1", "TCPPort": 45115, "UDPPort": 45115},
+  "DNSFilters": {"PINAndShortcuts": {"PIN": "verysecret", "Shortcut": {}}, "LintText": {"MaxLength": 35}},
+  "Features": {"Shell": {"InterpreterPath": "/bin/sh"}},
+  "HTTPHandlers": {"BrowserEndpointConfig": {}},
+  "SockDeamon": {}
+}`), nil)
+	if !reflect.DeepEqual(problems, []string{
+		`DNSFilters.PINAndShortcuts.Shortcut: unknown key, it will be ignored`,
+		`HTTPHandlers.BrowserEndpointConfig: unknown key, it will be ignored`,
+		`SockDeamon: unknown key, it will be ignored`,
+		`dnsdaemon.Adress: unknown key, it will be ignored`,
+	}) {
+		t.Fatal(problems)
+	}
+	// Value of wrong type
+	problems = CheckConfig([]byte(`{"DNSDaemon": {"TCPPort": "53"}}`), nil)
+	if len(problems) != 1 || !strings.Contains(problems[0], "TCPPort (line 1 column") || !strings.Contains(problems[0], "cannot use JSON string as int") {
+		t.Fatal(problems)
+	}
+	// Daemon initialisation error
+	problems = CheckConfig([]byte(`{"PlainSocketDaemon": {"TCPPort": 45116}}`), nil)
+	if len(problems) != 1 || !strings.HasPrefix(problems[0], "plainsocket: ") {
+		t.Fatal(problems)
+	}
+	// Only the named daemons are checked
+	if problems := CheckConfig([]byte(`{"PlainSocketDaemon": {"TCPPort": 45116}}`), []string{SimpleIPSvcName}); len(problems) != 0 {
+		t.Fatal(problems)
+	}
+	// Profile of unknown daemon
+	problems = CheckConfig([]byte(`{"Profiles": {"home": {"Daemons": ["dnsd"]}, "travel": {"Daemons": ["dnds"]}}}`), []string{SimpleIPSvcName})
+	if len(problems) != 1 || !strings.HasPrefix(problems[0], `Profiles["travel"]: `) {
+		t.Fatal(problems)
+	}
+}
@@ -0,0 +1,45 @@
+package launcher
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ConfigProfile is a named set of daemons to launch, chosen by the -profile flag or on the password input web page.
+type ConfigProfile struct {
+	Daemons []string `json:"Daemons"` // Daemons are the names of daemons to launch, e.g. ["dnsd", "httpd"].
+}
+
+// GetProfileNames returns the sorted names of configuration profiles.
+func (config *Config) GetProfileNames() []string {
+	ret := make([]string, 0, len(config.Profiles))
+	for name := range config.Profiles {
+		ret = append(ret, name)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// GetProfileDaemons returns the names of daemons to launch according to the profile.
+func (config *Config) GetProfileDaemons(profileName string) ([]string, error) {
+	profile, exists := config.Profiles[profileName]
+	if !exists {
+		return nil, fmt.Errorf("GetProfileDaemons: profile \"%s\" is not among the configured profiles %v", profileName, config.GetProfileNames())
+	}
+	if len(profile.Daemons) == 0 {
+		return nil, fmt.Errorf("GetProfileDaemons: profile \"%s\" does not have any daemon", profileName)
+	}
+	for _, daemonName := range profile.Daemons {
+		var found bool
+		for _, goodName := range AllDaemons {
+			if daemonName == goodName {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("GetProfileDaemons: profile \"%s\" has unknown daemon name \"%s\"", profileName, daemonName)
+		}
+	}
+	return profile.Daemons, nil
+}
@@ -0,0 +1,25 @@
+package launcher
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestConfig_GetProfileDaemons(t *testing.T) {
+	config := Config{Profiles: map[string]ConfigProfile{
+		"travel":  {Daemons: []string{DNSDName, TelegramName}},
+		"minimal": {Daemons: []string{}},
+		"typo":    {Daemons: []string{"htpd"}},
+	}}
+	if names := config.GetProfileNames(); !reflect.DeepEqual(names, []string{"minimal", "travel", "typo"}) {
+		t.Fatal(names)
+	}
+	if daemons, err := config.GetProfileDaemons("travel"); err != nil || !reflect.DeepEqual(daemons, []string{DNSDName, TelegramName}) {
+		t.Fatal(daemons, err)
+	}
+	for _, name := range []string{"minimal", "typo", "does not exist"} {
+		if _, err := config.GetProfileDaemons(name); err == nil {
+			t.Fatal("did not error", name)
+		}
+	}
+}
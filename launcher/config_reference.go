@@ -0,0 +1,82 @@
+package launcher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+// ConfigReferenceFilePrefix is the prefix of a configuration reference that reads a secret from a file, e.g. ${file:/path/to/secret}.
+const ConfigReferenceFilePrefix = "file:"
+
+var (
+	// RegexConfigReference finds the references in configuration JSON, as well as the escaped "$${" that stands for a literal "${".
+	RegexConfigReference = regexp.MustCompile(`\$\$\{|\$\{([^{}]*)\}`)
+	// RegexConfigEnvReference finds the environment variable name and optional default value in a configuration reference.
+	RegexConfigEnvReference = regexp.MustCompile(`^([A-Za-z_][A-Za-z0-9_]*)(:-(.*))?$`)
+)
+
+/*
+resolveConfigReference returns the value of a configuration reference, which is one of:
+- "ENV_VAR" or "ENV_VAR:-default value" - the value of an environment variable.
+- "file:/path/to/secret" - the content of a file, which may be encrypted by laitos program data encryption utility.
+- A cloud secret source such as "aws-secretsmanager:REGION:SECRET-ID", see inet.GetCloudSecret for the choices.
+*/
+func resolveConfigReference(ref string) (string, error) {
+	if envRef := RegexConfigEnvReference.FindStringSubmatch(ref); envRef != nil {
+		if value, exists := os.LookupEnv(envRef[1]); exists {
+			return value, nil
+		} else if envRef[2] != "" {
+			return envRef[3], nil
+		}
+		return "", errors.New("the environment variable is not set")
+	}
+	if strings.HasPrefix(ref, ConfigReferenceFilePrefix) {
+		contents, _, err := misc.DecryptIfNecessary(misc.ProgramDataDecryptionPassword, strings.TrimPrefix(ref, ConfigReferenceFilePrefix))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(contents[0])), nil
+	}
+	for _, provider := range []string{inet.CloudSecretAWSSecretsManager, inet.CloudSecretAWSKMS, inet.CloudSecretGCPSecretManager, inet.CloudSecretAzureKeyVault} {
+		if strings.HasPrefix(ref, provider+":") {
+			return inet.GetCloudSecret(ref)
+		}
+	}
+	return "", errors.New("unknown kind of reference")
+}
+
+/*
+ExpandConfigReferences replaces references such as ${ENV_VAR}, ${file:/path/to/secret}, and cloud secrets (e.g.
+${aws-secretsmanager:REGION:SECRET-ID}) in the configuration JSON by their values, so that credentials do not have to be
+stored verbatim in the configuration file. The references are meant to be used inside JSON strings, and the values are
+escaped accordingly. "$${" stands for a literal "${".
+The substitution only takes place when laitos is started with the -expandconfig flag, so that the literal "${" in an
+existing configuration file keeps its meaning.
+*/
+func ExpandConfigReferences(configJSON []byte) ([]byte, error) {
+	var errs []string
+	ret := RegexConfigReference.ReplaceAllFunc(configJSON, func(match []byte) []byte {
+		if string(match) == "$${" {
+			return []byte("${")
+		}
+		ref := string(match[2 : len(match)-1])
+		value, err := resolveConfigReference(ref)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("${%s}: %v", ref, err))
+			return match
+		}
+		escaped, _ := json.Marshal(value)
+		return escaped[1 : len(escaped)-1]
+	})
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("ExpandConfigReferences: failed to resolve references - %s", strings.Join(errs, "; "))
+	}
+	return ret, nil
+}
@@ -0,0 +1,55 @@
+package launcher
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/misc"
+)
+
+func TestExpandConfigReferences(t *testing.T) {
+	secretFile, err := ioutil.TempFile("", "laitos-TestExpandConfigReferences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(secretFile.Name())
+	if _, err := secretFile.WriteString(" file secret \n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := secretFile.Close(); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("LAITOS_TEST_CONFIG_REF", `a "quoted" value`)
+	defer os.Unsetenv("LAITOS_TEST_CONFIG_REF")
+	os.Unsetenv("LAITOS_TEST_CONFIG_REF_UNSET")
+
+	in := `{"A": "${LAITOS_TEST_CONFIG_REF}", "B": "${LAITOS_TEST_CONFIG_REF_UNSET:-default}", "C": "x${file:` + secretFile.Name() + `}y", "D": "$${LAITOS_TEST_CONFIG_REF}"}`
+	out, err := ExpandConfigReferences([]byte(in))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != `{"A": "a \"quoted\" value", "B": "default", "C": "xfile secrety", "D": "${LAITOS_TEST_CONFIG_REF}"}` {
+		t.Fatal(string(out))
+	}
+
+	// The secret file may be encrypted
+	oldPassword := misc.ProgramDataDecryptionPassword
+	defer func() {
+		misc.ProgramDataDecryptionPassword = oldPassword
+	}()
+	misc.ProgramDataDecryptionPassword = "pass"
+	if err := misc.Encrypt(secretFile.Name(), []byte("pass")); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := ExpandConfigReferences([]byte(`"${file:` + secretFile.Name() + `}"`)); err != nil || string(out) != `"file secret"` {
+		t.Fatal(err, string(out))
+	}
+
+	// All unresolvable references are reported
+	_, err = ExpandConfigReferences([]byte(`{"A": "${LAITOS_TEST_CONFIG_REF_UNSET}", "B": "${file:/this/does/not/exist}", "C": "${what is this}"}`))
+	if err == nil || !strings.Contains(err.Error(), "${LAITOS_TEST_CONFIG_REF_UNSET}") || !strings.Contains(err.Error(), "${file:/this/does/not/exist}") || !strings.Contains(err.Error(), "${what is this}") {
+		t.Fatal(err)
+	}
+}
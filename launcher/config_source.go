@@ -0,0 +1,127 @@
+package launcher
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/inet"
+)
+
+const (
+	// ConfigSignatureSuffix is appended to the location of remote configuration to find its detached signature.
+	ConfigSignatureSuffix = ".sig"
+	// RemoteConfigMaxBytes is the maximum size of remote configuration file.
+	RemoteConfigMaxBytes = 4 * 1048576
+	// RemoteConfigTimeoutSec is the timeout in seconds of downloading remote configuration file from an HTTPS URL.
+	RemoteConfigTimeoutSec = 30
+)
+
+// ErrBadConfigSignature is returned when the signature of remote configuration does not match its content.
+var ErrBadConfigSignature = errors.New("the configuration signature does not match its content")
+
+// GenerateConfigSigningKey returns a new pair of base64-encoded ed25519 keys for signing configuration files.
+func GenerateConfigSigningKey() (publicKey, privateKey string, err error) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(pub), base64.StdEncoding.EncodeToString(priv.Seed()), nil
+}
+
+// SignConfig returns the base64-encoded ed25519 signature of the content, made by the base64-encoded private key.
+func SignConfig(privateKey string, content []byte) (string, error) {
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(privateKey))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return "", errors.New("SignConfig: the private key must be a base64-encoded ed25519 seed")
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(ed25519.NewKeyFromSeed(seed), content)), nil
+}
+
+// VerifyConfigSignature returns an error if the base64-encoded signature was not made by the private key of the base64-encoded public key.
+func VerifyConfigSignature(publicKey string, content []byte, signature string) error {
+	pub, err := base64.StdEncoding.DecodeString(strings.TrimSpace(publicKey))
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return errors.New("VerifyConfigSignature: the public key must be a base64-encoded ed25519 public key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(signature))
+	if err != nil || !ed25519.Verify(ed25519.PublicKey(pub), content, sig) {
+		return ErrBadConfigSignature
+	}
+	return nil
+}
+
+/*
+downloadConfig downloads the content at the source, which is either an HTTP(S) URL or an AWS S3 object in the form of
+"s3://BUCKET/KEY" (optionally followed by "?region=REGION").
+*/
+func downloadConfig(source string) ([]byte, error) {
+	if strings.HasPrefix(source, "s3://") {
+		s3URL, err := url.Parse(source)
+		if err != nil || s3URL.Host == "" || strings.Trim(s3URL.Path, "/") == "" {
+			return nil, fmt.Errorf("downloadConfig: S3 source must look like \"s3://BUCKET/KEY\"")
+		}
+		return inet.GetS3Object(s3URL.Query().Get("region"), s3URL.Host, s3URL.Path, RemoteConfigMaxBytes)
+	}
+	resp, err := inet.DoHTTP(inet.HTTPRequest{TimeoutSec: RemoteConfigTimeoutSec, MaxBytes: RemoteConfigMaxBytes}, strings.Replace(source, "%", "%%", -1))
+	if err != nil {
+		return nil, err
+	} else if err = resp.Non2xxToError(); err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// insertSignatureSuffix returns the location of the signature of content at the source.
+func insertSignatureSuffix(source string) string {
+	if strings.HasPrefix(source, "s3://") {
+		if queryIndex := strings.IndexRune(source, '?'); queryIndex != -1 {
+			return source[:queryIndex] + ConfigSignatureSuffix + source[queryIndex:]
+		}
+	}
+	return source + ConfigSignatureSuffix
+}
+
+/*
+FetchRemoteConfig downloads configuration file from the source (an HTTPS URL or an AWS S3 object such as
+"s3://BUCKET/KEY"), along with its detached signature found at the same location with ".sig" suffix. After verifying
+the signature using the base64-encoded ed25519 public key, the configuration is saved to the cache path, from which the
+program then reads its configuration as usual. If the download or verification fails, the previously cached
+configuration remains intact and usable. The remote configuration file may be encrypted.
+*/
+func FetchRemoteConfig(source, publicKey, cachePath string) error {
+	if publicKey == "" {
+		return errors.New("FetchRemoteConfig: the public key for verifying configuration signature is missing")
+	}
+	content, err := downloadConfig(source)
+	if err != nil {
+		return fmt.Errorf("FetchRemoteConfig: failed to download configuration - %v", err)
+	}
+	signature, err := downloadConfig(insertSignatureSuffix(source))
+	if err != nil {
+		return fmt.Errorf("FetchRemoteConfig: failed to download configuration signature - %v", err)
+	}
+	if err := VerifyConfigSignature(publicKey, content, string(signature)); err != nil {
+		return fmt.Errorf("FetchRemoteConfig: %v", err)
+	}
+	// Replace the cached configuration in a single step, so that a crash does not leave behind a partially written file.
+	tmpFile, err := ioutil.TempFile(filepath.Dir(cachePath), filepath.Base(cachePath)+".fetch")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(content); err != nil {
+		_ = tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), cachePath)
+}
@@ -0,0 +1,108 @@
+package launcher
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSignConfig(t *testing.T) {
+	publicKey, privateKey, err := GenerateConfigSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SignConfig("bad key", []byte("content")); err == nil {
+		t.Fatal("did not error")
+	}
+	signature, err := SignConfig(privateKey, []byte("content"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyConfigSignature(publicKey, []byte("content"), signature+"\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyConfigSignature(publicKey, []byte("tampered"), signature); err != ErrBadConfigSignature {
+		t.Fatal(err)
+	}
+	otherPublicKey, _, err := GenerateConfigSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyConfigSignature(otherPublicKey, []byte("content"), signature); err != ErrBadConfigSignature {
+		t.Fatal(err)
+	}
+	if err := VerifyConfigSignature("bad key", []byte("content"), signature); err == nil || err == ErrBadConfigSignature {
+		t.Fatal(err)
+	}
+}
+
+func TestInsertSignatureSuffix(t *testing.T) {
+	for source, sigLocation := range map[string]string{
+		"https://example.com/config.json":            "https://example.com/config.json.sig",
+		"s3://bucket/dir/config.json":                "s3://bucket/dir/config.json.sig",
+		"s3://bucket/dir/config.json?region=us-east": "s3://bucket/dir/config.json.sig?region=us-east",
+	} {
+		if got := insertSignatureSuffix(source); got != sigLocation {
+			t.Fatal(source, got)
+		}
+	}
+}
+
+func TestFetchRemoteConfig(t *testing.T) {
+	publicKey, privateKey, err := GenerateConfigSigningKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := `{"DNSDaemon": {}}`
+	signature, err := SignConfig(privateKey, []byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/config.json", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(content))
+	})
+	mux.HandleFunc("/config.json.sig", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(signature))
+	})
+	mux.HandleFunc("/tampered.json", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"Features": {}}`))
+	})
+	mux.HandleFunc("/tampered.json.sig", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(signature))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "laitos-TestFetchRemoteConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cachePath := filepath.Join(dir, "config.json")
+	if err := FetchRemoteConfig(server.URL+"/config.json", "", cachePath); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := FetchRemoteConfig(server.URL+"/config.json", publicKey, cachePath); err != nil {
+		t.Fatal(err)
+	}
+	if cached, err := ioutil.ReadFile(cachePath); err != nil || string(cached) != content {
+		t.Fatal(err, string(cached))
+	}
+	// Failed download and failed verification leave the cached copy intact
+	if err := FetchRemoteConfig(server.URL+"/does-not-exist.json", publicKey, cachePath); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := FetchRemoteConfig(server.URL+"/tampered.json", publicKey, cachePath); err == nil {
+		t.Fatal("did not error")
+	}
+	if cached, err := ioutil.ReadFile(cachePath); err != nil || string(cached) != content {
+		t.Fatal(err, string(cached))
+	}
+	if files, err := ioutil.ReadDir(dir); err != nil || len(files) != 1 {
+		t.Fatal(err, files)
+	}
+}
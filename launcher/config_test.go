@@ -114,6 +114,8 @@ var sampleConfigJSON = `
       "/"
     ],
     "InformationEndpoint": "/info",
+    "PrometheusMetricsEndpoint": "/metrics",
+    "DNSQueryLogEndpoint": "/dns_query_log",
     "MailMeEndpoint": "/mail_me",
     "MailMeEndpointConfig": {
       "Recipients": [
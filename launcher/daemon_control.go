@@ -0,0 +1,538 @@
+package launcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/daemon/autounlock"
+	"github.com/HouzuoGuo/laitos/daemon/common"
+	"github.com/HouzuoGuo/laitos/daemon/dnsd"
+	"github.com/HouzuoGuo/laitos/daemon/httpd"
+	"github.com/HouzuoGuo/laitos/daemon/maintenance"
+	"github.com/HouzuoGuo/laitos/daemon/phonehome"
+	"github.com/HouzuoGuo/laitos/daemon/plainsocket"
+	"github.com/HouzuoGuo/laitos/daemon/serialport"
+	"github.com/HouzuoGuo/laitos/daemon/simpleipsvcd"
+	"github.com/HouzuoGuo/laitos/daemon/smtpd"
+	"github.com/HouzuoGuo/laitos/daemon/smtpd/mailcmd"
+	"github.com/HouzuoGuo/laitos/daemon/snmpd"
+	"github.com/HouzuoGuo/laitos/daemon/sockd"
+	"github.com/HouzuoGuo/laitos/daemon/sshd"
+	"github.com/HouzuoGuo/laitos/daemon/telegrambot"
+	"github.com/HouzuoGuo/laitos/daemon/tftpd"
+	"github.com/HouzuoGuo/laitos/daemon/tunnelagent"
+	"github.com/HouzuoGuo/laitos/daemon/wireguard"
+	"github.com/HouzuoGuo/laitos/lalog"
+)
+
+/*
+daemonConfigSections are the names of top-level configuration JSON sections that belong to each daemon. All other
+sections, such as app features and the common mail client, are shared by all daemons.
+*/
+var daemonConfigSections = map[string][]string{
+	DNSDName:             {"DNSDaemon", "DNSFilters"},
+	HTTPDName:            {"HTTPDaemon", "HTTPFilters", "HTTPHandlers"},
+	InsecureHTTPDName:    {"HTTPDaemon", "HTTPFilters", "HTTPHandlers"},
+	MaintenanceName:      {"Maintenance"},
+	PhoneHomeName:        {"PhoneHomeDaemon", "PhoneHomeFilters"},
+	PlainSocketName:      {"PlainSocketDaemon", "PlainSocketFilters"},
+	SerialPortDaemonName: {"SerialPortDaemon", "SerialPortFilters"},
+	SimpleIPSvcName:      {"SimpleIPSvcDaemon"},
+	SMTPDName:            {"MailDaemon", "MailCommandRunner", "MailFilters"},
+	SNMPDName:            {"SNMPDaemon"},
+	SOCKDName:            {"SockDaemon"},
+	SSHDName:             {"SSHDaemon", "SSHFilters"},
+	TFTPDName:            {"TFTPDaemon"},
+	TelegramName:         {"TelegramBot", "TelegramFilters"},
+	TunnelAgentName:      {"TunnelAgent"},
+	WireGuardName:        {"WireGuardDaemon"},
+	AutoUnlockName:       {"AutoUnlock"},
+}
+
+// ConfigReloadResult describes the outcome of applying configuration changes to the running daemons.
+type ConfigReloadResult struct {
+	RestartedDaemons []string // RestartedDaemons have been restarted to use their new configuration.
+	FailedDaemons    []string // FailedDaemons could not use their new configuration and carry on with the original configuration.
+	PendingSections  []string // PendingSections are the changed configuration sections that take effect only after program restarts.
+}
+
+// String returns a human-readable summary of the reload result.
+func (result ConfigReloadResult) String() string {
+	if len(result.RestartedDaemons) == 0 && len(result.FailedDaemons) == 0 && len(result.PendingSections) == 0 {
+		return "no change is applicable to the running daemons"
+	}
+	var lines []string
+	if len(result.RestartedDaemons) > 0 {
+		lines = append(lines, "restarted with new configuration: "+strings.Join(result.RestartedDaemons, ", "))
+	}
+	if len(result.FailedDaemons) > 0 {
+		lines = append(lines, "failed to use new configuration: "+strings.Join(result.FailedDaemons, ", "))
+	}
+	if len(result.PendingSections) > 0 {
+		lines = append(lines, "require a full program restart: "+strings.Join(result.PendingSections, ", "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// getConfigSections returns the top-level sections of configuration JSON.
+func getConfigSections(configJSON []byte) (map[string]interface{}, error) {
+	sections := make(map[string]interface{})
+	if len(configJSON) == 0 {
+		return sections, nil
+	}
+	if err := json.Unmarshal(configJSON, &sections); err != nil {
+		return nil, err
+	}
+	return sections, nil
+}
+
+/*
+DaemonControl starts daemons from configuration, and is able to stop and re-initialise an individual daemon from new
+configuration, without interrupting the other daemons running in the same process.
+*/
+type DaemonControl struct {
+	Config      *Config  // Config is the configuration of all running daemons.
+	DaemonNames []string // DaemonNames are the names of daemons to start.
+	/*
+		Run is called to run the blocking start function of a daemon in the background, usually with automatic restarts
+		in case of error. Once the daemon is stopped by DaemonControl, its start function returns nil right away.
+	*/
+	Run func(daemonName string, startAndBlock func() error)
+	// ConfigJSON is the configuration JSON that Config was deserialised from, ReloadConfig compares it against new configuration.
+	ConfigJSON []byte
+
+	// sections are the top-level sections of configuration JSON, updated as daemons restart with new configuration.
+	sections map[string]interface{}
+
+	// generation increases each time a daemon is restarted, stopping earlier start functions from running again.
+	generation map[string]int
+	mutex      sync.Mutex
+	logger     lalog.Logger
+}
+
+// StartAll starts all of the daemons in the background.
+func (ctl *DaemonControl) StartAll() {
+	ctl.mutex.Lock()
+	defer ctl.mutex.Unlock()
+	ctl.logger = lalog.Logger{ComponentName: "DaemonControl"}
+	ctl.generation = make(map[string]int)
+	var err error
+	if ctl.sections, err = getConfigSections(ctl.ConfigJSON); err != nil {
+		ctl.logger.Warning("StartAll", "", err, "failed to deserialise configuration JSON, configuration reload will restart all daemons.")
+		ctl.sections = make(map[string]interface{})
+	}
+	for _, daemonName := range ctl.DaemonNames {
+		ctl.start(daemonName)
+	}
+}
+
+/*
+StopAll stops all of the running daemons in parallel, the daemons wait for their ongoing conversations to finish before
+returning. It returns the context error if some daemons are still stopping when the context expires.
+*/
+func (ctl *DaemonControl) StopAll(ctx context.Context) error {
+	ctl.mutex.Lock()
+	defer ctl.mutex.Unlock()
+	ctl.logger.Info("StopAll", "", nil, "stopping %v", ctl.DaemonNames)
+	wg := new(sync.WaitGroup)
+	for _, daemonName := range ctl.DaemonNames {
+		// Prevent the start functions from running again
+		ctl.generation[daemonName]++
+		wg.Add(1)
+		go func(daemonName string) {
+			defer wg.Done()
+			ctl.stop(daemonName)
+		}(daemonName)
+	}
+	stopped := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// start runs the daemon's start function in the background. Caller must hold the mutex.
+func (ctl *DaemonControl) start(daemonName string) {
+	startAndBlock := ctl.getStartFunc(daemonName)
+	if startAndBlock == nil {
+		return
+	}
+	gen := ctl.generation[daemonName]
+	go ctl.Run(daemonName, func() error {
+		ctl.mutex.Lock()
+		isCurrent := ctl.generation[daemonName] == gen
+		ctl.mutex.Unlock()
+		if !isCurrent {
+			return nil
+		}
+		return startAndBlock()
+	})
+}
+
+// getStartFunc returns the blocking start function of the daemon, the daemon is initialised from configuration if necessary.
+func (ctl *DaemonControl) getStartFunc(daemonName string) func() error {
+	config := ctl.Config
+	switch daemonName {
+	case DNSDName:
+		return config.GetDNSD().StartAndBlock
+	case HTTPDName:
+		return config.GetHTTPD().StartAndBlockWithTLS
+	case InsecureHTTPDName:
+		/*
+			There is not an independent port settings for launching both TLS-enabled and TLS-free HTTP servers
+			at the same time. If user really wishes to launch both at the same time, the TLS-free HTTP server
+			will fallback to use port number 80.
+		*/
+		httpDaemon := config.GetHTTPD()
+		return func() error {
+			return httpDaemon.StartAndBlockNoTLS(80)
+		}
+	case MaintenanceName:
+		maintenance := config.GetMaintenance()
+		if maintenance.LockDownFirewall {
+			// The host firewall lock-down allows the ports of all enabled daemons
+			maintenance.FirewallTCPPorts, maintenance.FirewallUDPPorts = config.GetDaemonPorts(ctl.DaemonNames)
+		}
+		return maintenance.StartAndBlock
+	case PhoneHomeName:
+		return config.GetPhoneHomeDaemon().StartAndBlock
+	case PlainSocketName:
+		return config.GetPlainSocketDaemon().StartAndBlock
+	case SerialPortDaemonName:
+		return config.GetSerialPortDaemon().StartAndBlock
+	case SimpleIPSvcName:
+		return config.GetSimpleIPSvcD().StartAndBlock
+	case SMTPDName:
+		return config.GetMailDaemon().StartAndBlock
+	case SNMPDName:
+		return config.GetSNMPD().StartAndBlock
+	case SOCKDName:
+		return config.GetSockDaemon().StartAndBlock
+	case SSHDName:
+		return config.GetSSHDaemon().StartAndBlock
+	case TFTPDName:
+		return config.GetTFTPD().StartAndBlock
+	case TelegramName:
+		return config.GetTelegramBot().StartAndBlock
+	case TunnelAgentName:
+		return config.GetTunnelAgent().StartAndBlock
+	case WireGuardName:
+		return config.GetWireGuardDaemon().StartAndBlock
+	case AutoUnlockName:
+		return config.GetAutoUnlock().StartAndBlock
+	}
+	return nil
+}
+
+// stop stops the running daemon, its start function will then return.
+func (ctl *DaemonControl) stop(daemonName string) {
+	config := ctl.Config
+	switch daemonName {
+	case DNSDName:
+		config.DNSDaemon.Stop()
+	case HTTPDName:
+		config.HTTPDaemon.StopTLS()
+	case InsecureHTTPDName:
+		config.HTTPDaemon.StopNoTLS()
+	case MaintenanceName:
+		config.Maintenance.Stop()
+	case PhoneHomeName:
+		config.PhoneHomeDaemon.Stop()
+	case PlainSocketName:
+		config.PlainSocketDaemon.Stop()
+	case SerialPortDaemonName:
+		config.SerialPortDaemon.Stop()
+	case SimpleIPSvcName:
+		config.SimpleIPSvcDaemon.Stop()
+	case SMTPDName:
+		config.MailDaemon.Stop()
+	case SNMPDName:
+		config.SNMPDaemon.Stop()
+	case SOCKDName:
+		config.SockDaemon.Stop()
+	case SSHDName:
+		config.SSHDaemon.Stop()
+	case TFTPDName:
+		config.TFTPDaemon.Stop()
+	case TelegramName:
+		config.TelegramBot.Stop()
+	case TunnelAgentName:
+		config.TunnelAgent.Stop()
+	case WireGuardName:
+		config.WireGuardDaemon.Stop()
+	case AutoUnlockName:
+		config.AutoUnlock.Stop()
+	}
+}
+
+/*
+WaitForListeners blocks until the daemons have started listening on their ports, or until the timeout elapses. It
+returns the ports (e.g. "tcp/53") that are still not listened on by then.
+*/
+func (ctl *DaemonControl) WaitForListeners(timeout time.Duration) []string {
+	var tcpPorts, udpPorts []int
+	for _, daemonName := range ctl.DaemonNames {
+		switch daemonName {
+		case WireGuardName:
+			// The kernel listens on the WireGuard port on behalf of laitos
+		case SSHDName:
+			// Tunnel ports are listened on only when tunnel agents connect
+			tcpPorts = append(tcpPorts, ctl.Config.GetSSHDaemon().Port)
+		default:
+			tcp, udp := ctl.Config.GetDaemonPorts([]string{daemonName})
+			tcpPorts = append(tcpPorts, tcp...)
+			udpPorts = append(udpPorts, udp...)
+		}
+	}
+	return common.WaitForListeners(tcpPorts, udpPorts, timeout)
+}
+
+/*
+getAffectedDaemons returns the names of running daemons that share the same daemon instance as the input daemon, they
+must be restarted together.
+*/
+func (ctl *DaemonControl) getAffectedDaemons(daemonName string) (ret []string) {
+	for _, name := range ctl.DaemonNames {
+		if name == daemonName ||
+			(daemonName == HTTPDName || daemonName == InsecureHTTPDName) && (name == HTTPDName || name == InsecureHTTPDName) {
+			ret = append(ret, name)
+		}
+	}
+	return
+}
+
+/*
+replaceDaemonConfig replaces the configuration sections of the daemon by those from another configuration. If
+freshInit is true, the daemon will be initialised anew from the replacement sections, otherwise the daemon instance
+from the other configuration is used as-is.
+*/
+func (config *Config) replaceDaemonConfig(daemonName string, from *Config, freshInit bool) {
+	newInit := func(orig *sync.Once) *sync.Once {
+		if freshInit || orig == nil {
+			return new(sync.Once)
+		}
+		return orig
+	}
+	switch daemonName {
+	case DNSDName:
+		config.DNSDaemon, config.DNSFilters, config.dnsDaemonInit = from.DNSDaemon, from.DNSFilters, newInit(from.dnsDaemonInit)
+		if config.DNSDaemon == nil {
+			config.DNSDaemon = &dnsd.Daemon{}
+		}
+		config.DNSFilters.NotifyViaEmail.MailClient = config.MailClient
+	case HTTPDName, InsecureHTTPDName:
+		config.HTTPDaemon, config.HTTPFilters, config.HTTPHandlers, config.httpDaemonInit = from.HTTPDaemon, from.HTTPFilters, from.HTTPHandlers, newInit(from.httpDaemonInit)
+		if config.HTTPDaemon == nil {
+			config.HTTPDaemon = &httpd.Daemon{}
+		}
+		config.HTTPFilters.NotifyViaEmail.MailClient = config.MailClient
+	case MaintenanceName:
+		config.Maintenance, config.maintenanceInit = from.Maintenance, newInit(from.maintenanceInit)
+		if config.Maintenance == nil {
+			config.Maintenance = &maintenance.Daemon{}
+		}
+	case PhoneHomeName:
+		config.PhoneHomeDaemon, config.PhoneHomeFilters, config.phoneHomeDaemonInit = from.PhoneHomeDaemon, from.PhoneHomeFilters, newInit(from.phoneHomeDaemonInit)
+		if config.PhoneHomeDaemon == nil {
+			config.PhoneHomeDaemon = &phonehome.Daemon{}
+		}
+		config.PhoneHomeFilters.NotifyViaEmail.MailClient = config.MailClient
+	case PlainSocketName:
+		config.PlainSocketDaemon, config.PlainSocketFilters, config.plainSocketDaemonInit = from.PlainSocketDaemon, from.PlainSocketFilters, newInit(from.plainSocketDaemonInit)
+		if config.PlainSocketDaemon == nil {
+			config.PlainSocketDaemon = &plainsocket.Daemon{}
+		}
+		config.PlainSocketFilters.NotifyViaEmail.MailClient = config.MailClient
+	case SerialPortDaemonName:
+		config.SerialPortDaemon, config.SerialPortFilters, config.serialPortDaemonInit = from.SerialPortDaemon, from.SerialPortFilters, newInit(from.serialPortDaemonInit)
+		if config.SerialPortDaemon == nil {
+			config.SerialPortDaemon = &serialport.Daemon{}
+		}
+		config.SerialPortFilters.NotifyViaEmail.MailClient = config.MailClient
+	case SimpleIPSvcName:
+		config.SimpleIPSvcDaemon, config.simpleIPSvcDaemonInit = from.SimpleIPSvcDaemon, newInit(from.simpleIPSvcDaemonInit)
+		if config.SimpleIPSvcDaemon == nil {
+			config.SimpleIPSvcDaemon = &simpleipsvcd.Daemon{}
+		}
+	case SMTPDName:
+		config.MailDaemon, config.mailDaemonInit = from.MailDaemon, newInit(from.mailDaemonInit)
+		config.MailCommandRunner, config.MailFilters, config.mailCommandRunnerInit = from.MailCommandRunner, from.MailFilters, newInit(from.mailCommandRunnerInit)
+		if config.MailDaemon == nil {
+			config.MailDaemon = &smtpd.Daemon{}
+		}
+		if config.MailCommandRunner == nil {
+			config.MailCommandRunner = &mailcmd.CommandRunner{}
+		}
+		config.MailFilters.NotifyViaEmail.MailClient = config.MailClient
+	case SNMPDName:
+		config.SNMPDaemon, config.snmpDaemonInit = from.SNMPDaemon, newInit(from.snmpDaemonInit)
+		if config.SNMPDaemon == nil {
+			config.SNMPDaemon = &snmpd.Daemon{}
+		}
+	case SOCKDName:
+		config.SockDaemon, config.sockDaemonInit = from.SockDaemon, newInit(from.sockDaemonInit)
+		if config.SockDaemon == nil {
+			config.SockDaemon = &sockd.Daemon{}
+		}
+	case SSHDName:
+		config.SSHDaemon, config.SSHFilters, config.sshDaemonInit = from.SSHDaemon, from.SSHFilters, newInit(from.sshDaemonInit)
+		if config.SSHDaemon == nil {
+			config.SSHDaemon = &sshd.Daemon{}
+		}
+		config.SSHFilters.NotifyViaEmail.MailClient = config.MailClient
+	case TFTPDName:
+		config.TFTPDaemon, config.tftpDaemonInit = from.TFTPDaemon, newInit(from.tftpDaemonInit)
+		if config.TFTPDaemon == nil {
+			config.TFTPDaemon = &tftpd.Daemon{}
+		}
+	case TelegramName:
+		config.TelegramBot, config.TelegramFilters, config.telegramBotInit = from.TelegramBot, from.TelegramFilters, newInit(from.telegramBotInit)
+		if config.TelegramBot == nil {
+			config.TelegramBot = &telegrambot.Daemon{}
+		}
+		config.TelegramFilters.NotifyViaEmail.MailClient = config.MailClient
+	case TunnelAgentName:
+		config.TunnelAgent, config.tunnelAgentInit = from.TunnelAgent, newInit(from.tunnelAgentInit)
+		if config.TunnelAgent == nil {
+			config.TunnelAgent = &tunnelagent.Daemon{}
+		}
+	case WireGuardName:
+		config.WireGuardDaemon, config.wireGuardDaemonInit = from.WireGuardDaemon, newInit(from.wireGuardDaemonInit)
+		if config.WireGuardDaemon == nil {
+			config.WireGuardDaemon = &wireguard.Daemon{}
+		}
+	case AutoUnlockName:
+		config.AutoUnlock, config.autoUnlockInit = from.AutoUnlock, newInit(from.autoUnlockInit)
+		if config.AutoUnlock == nil {
+			config.AutoUnlock = &autounlock.Daemon{}
+		}
+	}
+}
+
+/*
+RestartDaemon stops a running daemon, re-initialises it using its configuration sections from the configuration JSON,
+and then starts it again. The other daemons carry on without interruption, and they are not affected by the rest of
+configuration JSON. HTTP daemons with and without TLS share the same configuration, hence they are restarted together.
+If the new configuration fails to initialise, the daemon is started again using its original configuration.
+*/
+func (ctl *DaemonControl) RestartDaemon(daemonName string, configJSON []byte) error {
+	ctl.mutex.Lock()
+	defer ctl.mutex.Unlock()
+	affected := ctl.getAffectedDaemons(daemonName)
+	if len(affected) == 0 {
+		return fmt.Errorf("DaemonControl.RestartDaemon: daemon \"%s\" is not running", daemonName)
+	}
+	var newConfig Config
+	if err := json.Unmarshal(configJSON, &newConfig); err != nil {
+		return fmt.Errorf("DaemonControl.RestartDaemon: failed to deserialise configuration - %v", err)
+	}
+	newSections, err := getConfigSections(configJSON)
+	if err != nil {
+		return fmt.Errorf("DaemonControl.RestartDaemon: failed to deserialise configuration - %v", err)
+	}
+	ctl.logger.Info("RestartDaemon", daemonName, nil, "stopping %v", affected)
+	for _, name := range affected {
+		ctl.generation[name]++
+		ctl.stop(name)
+	}
+	origConfig := *ctl.Config
+	ctl.Config.replaceDaemonConfig(daemonName, &newConfig, true)
+	// Initialise the daemon right away to find out whether the new configuration is usable
+	ctl.Config.beginReinit()
+	for _, name := range affected {
+		ctl.getStartFunc(name)
+	}
+	initErr := ctl.Config.endReinit()
+	if initErr != nil {
+		ctl.logger.Warning("RestartDaemon", daemonName, initErr, "reverting to the original configuration")
+		ctl.Config.replaceDaemonConfig(daemonName, &origConfig, false)
+	}
+	for _, name := range affected {
+		ctl.start(name)
+	}
+	if initErr != nil {
+		return fmt.Errorf("DaemonControl.RestartDaemon: the daemon is restarted with its original configuration, because the new configuration failed to initialise - %v", initErr)
+	}
+	for _, section := range daemonConfigSections[daemonName] {
+		if value, exists := newSections[section]; exists {
+			ctl.sections[section] = value
+		} else {
+			delete(ctl.sections, section)
+		}
+	}
+	ctl.logger.Info("RestartDaemon", daemonName, nil, "successfully restarted %v with new configuration", affected)
+	return nil
+}
+
+/*
+ReloadConfig compares the configuration JSON against the configuration of running daemons, and restarts those daemons
+whose configuration sections have changed, e.g. DNS forwarders, allowed client IPs, web handlers, or PIN. Changes to
+the other sections, such as app features, are reported in the result as they take effect only after program restarts.
+*/
+func (ctl *DaemonControl) ReloadConfig(configJSON []byte) (result ConfigReloadResult, err error) {
+	if err = json.Unmarshal(configJSON, &Config{}); err != nil {
+		return result, fmt.Errorf("DaemonControl.ReloadConfig: failed to deserialise configuration - %v", err)
+	}
+	newSections, err := getConfigSections(configJSON)
+	if err != nil {
+		return result, fmt.Errorf("DaemonControl.ReloadConfig: failed to deserialise configuration - %v", err)
+	}
+	ctl.mutex.Lock()
+	changedSections := make(map[string]bool)
+	for section, value := range newSections {
+		if !reflect.DeepEqual(value, ctl.sections[section]) {
+			changedSections[section] = true
+		}
+	}
+	for section := range ctl.sections {
+		if _, exists := newSections[section]; !exists {
+			changedSections[section] = true
+		}
+	}
+	ctl.mutex.Unlock()
+	// Figure out which running daemons are affected by the changes
+	var toRestart []string
+	restarting := make(map[string]bool)
+	for _, daemonName := range ctl.DaemonNames {
+		for _, section := range daemonConfigSections[daemonName] {
+			if changedSections[section] && !restarting[daemonName] {
+				toRestart = append(toRestart, daemonName)
+				// Daemons sharing the same configuration restart together
+				for _, affected := range ctl.getAffectedDaemons(daemonName) {
+					restarting[affected] = true
+				}
+			}
+		}
+	}
+	// Configuration sections of daemons that are not running do not matter
+	for _, sections := range daemonConfigSections {
+		for _, section := range sections {
+			delete(changedSections, section)
+		}
+	}
+	for section := range changedSections {
+		result.PendingSections = append(result.PendingSections, section)
+	}
+	sort.Strings(result.PendingSections)
+	for _, daemonName := range toRestart {
+		if err := ctl.RestartDaemon(daemonName, configJSON); err != nil {
+			result.FailedDaemons = append(result.FailedDaemons, daemonName)
+		} else {
+			result.RestartedDaemons = append(result.RestartedDaemons, daemonName)
+		}
+	}
+	ctl.logger.Info("ReloadConfig", "", nil, "%s", result.String())
+	return result, nil
+}
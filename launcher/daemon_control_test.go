@@ -0,0 +1,136 @@
+package launcher
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const daemonControlConfigJSON = `{
+  "PlainSocketDaemon": {
+    "TCPPort": 43721
+  },
+  "PlainSocketFilters": {
+    "LintText": {
+      "MaxLength": 120
+    },
+    "PINAndShortcuts": {
+      "PIN": "verysecret"
+    }
+  },
+  "SimpleIPSvcDaemon": {
+    "Address": "127.0.0.1",
+    "ActiveUsersPort": 43722,
+    "DayTimePort": 43723,
+    "QOTDPort": 43724
+  }
+}`
+
+// isListening returns true only if the TCP port on localhost accepts a connection.
+func isListening(port int) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), 1*time.Second)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+func TestDaemonControl_RestartDaemon(t *testing.T) {
+	var config Config
+	if err := config.DeserialiseFromJSON([]byte(daemonControlConfigJSON)); err != nil {
+		t.Fatal(err)
+	}
+	ctl := &DaemonControl{
+		Config:      &config,
+		DaemonNames: []string{PlainSocketName, SimpleIPSvcName},
+		Run: func(_ string, startAndBlock func() error) {
+			if err := startAndBlock(); err != nil {
+				panic(err)
+			}
+		},
+	}
+	ctl.StartAll()
+	time.Sleep(1 * time.Second)
+	if !isListening(43721) || !isListening(43722) {
+		t.Fatal("daemons did not start")
+	}
+
+	// Daemons that are not running cannot be restarted
+	if err := ctl.RestartDaemon(DNSDName, []byte(daemonControlConfigJSON)); err == nil {
+		t.Fatal("did not error")
+	}
+	// Restart a daemon with new ports, the other daemon is unaffected.
+	if err := ctl.RestartDaemon(SimpleIPSvcName, []byte(`{"SimpleIPSvcDaemon": {"Address": "127.0.0.1", "ActiveUsersPort": 43732, "DayTimePort": 43733, "QOTDPort": 43734}}`)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1 * time.Second)
+	if isListening(43722) || !isListening(43732) || !isListening(43721) {
+		t.Fatal("did not restart with new configuration")
+	}
+	// A daemon with faulty configuration keeps running with its original configuration
+	if err := ctl.RestartDaemon(PlainSocketName, []byte(`{"PlainSocketDaemon": {"TCPPort": 43741}}`)); err == nil {
+		t.Fatal("did not error")
+	}
+	time.Sleep(1 * time.Second)
+	if !isListening(43721) || isListening(43741) || !isListening(43732) {
+		t.Fatal("did not revert to original configuration")
+	}
+	config.GetPlainSocketDaemon().Stop()
+	config.GetSimpleIPSvcD().Stop()
+}
+
+func TestDaemonControl_ReloadConfig(t *testing.T) {
+	configJSON := `{"SimpleIPSvcDaemon": {"Address": "127.0.0.1", "ActiveUsersPort": 43752, "DayTimePort": 43753, "QOTDPort": 43754}}`
+	var config Config
+	if err := config.DeserialiseFromJSON([]byte(configJSON)); err != nil {
+		t.Fatal(err)
+	}
+	ctl := &DaemonControl{
+		Config:      &config,
+		DaemonNames: []string{SimpleIPSvcName},
+		ConfigJSON:  []byte(configJSON),
+		Run: func(_ string, startAndBlock func() error) {
+			if err := startAndBlock(); err != nil {
+				panic(err)
+			}
+		},
+	}
+	ctl.StartAll()
+	time.Sleep(1 * time.Second)
+	if !isListening(43752) {
+		t.Fatal("daemon did not start")
+	}
+
+	if _, err := ctl.ReloadConfig([]byte(`this is not json`)); err == nil {
+		t.Fatal("did not error")
+	}
+	// Nothing changes
+	if result, err := ctl.ReloadConfig([]byte(configJSON)); err != nil || !reflect.DeepEqual(result, ConfigReloadResult{}) {
+		t.Fatalf("%+v %v", result, err)
+	}
+	// Changes to daemons that are not running do not matter
+	if result, err := ctl.ReloadConfig([]byte(`{"DNSDaemon": {"TCPPort": 1}, "SimpleIPSvcDaemon": {"Address": "127.0.0.1", "QOTDPort": 43754, "DayTimePort": 43753, "ActiveUsersPort": 43752}}`)); err != nil || !reflect.DeepEqual(result, ConfigReloadResult{}) {
+		t.Fatalf("%+v %v", result, err)
+	}
+	// Restart the daemon and report the change to app features
+	result, err := ctl.ReloadConfig([]byte(`{"Features": {}, "SimpleIPSvcDaemon": {"Address": "127.0.0.1", "ActiveUsersPort": 43762, "DayTimePort": 43763, "QOTDPort": 43764}}`))
+	if err != nil || !reflect.DeepEqual(result, ConfigReloadResult{RestartedDaemons: []string{SimpleIPSvcName}, PendingSections: []string{"Features"}}) {
+		t.Fatalf("%+v %v", result, err)
+	}
+	if result.String() != "restarted with new configuration: simpleipsvcd\nrequire a full program restart: Features" {
+		t.Fatal(result.String())
+	}
+	time.Sleep(1 * time.Second)
+	if isListening(43752) || !isListening(43762) {
+		t.Fatal("did not restart with new configuration")
+	}
+	// The daemon is not restarted again, though the app features still require a program restart.
+	result, err = ctl.ReloadConfig([]byte(`{"Features": {}, "SimpleIPSvcDaemon": {"Address": "127.0.0.1", "ActiveUsersPort": 43762, "DayTimePort": 43763, "QOTDPort": 43764}}`))
+	if err != nil || !reflect.DeepEqual(result, ConfigReloadResult{PendingSections: []string{"Features"}}) {
+		t.Fatalf("%+v %v", result, err)
+	}
+	config.GetSimpleIPSvcD().Stop()
+}
@@ -2,7 +2,18 @@ package passwdserver
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
 	"os"
@@ -13,16 +24,19 @@ import (
 	"sync"
 	"time"
 
+	"github.com/HouzuoGuo/laitos/daemon/telegrambot"
+	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/launcher"
 	"github.com/HouzuoGuo/laitos/misc"
 	"github.com/HouzuoGuo/laitos/platform"
+	"github.com/HouzuoGuo/laitos/toolbox"
 )
 
 const (
 	/*
-		The constants ContentLocationMagic and PasswordInputName are copied into autounlock package in order to avoid
-		import cycle. Looks ugly, sorry.
+		The constants ContentLocationMagic, PasswordInputName, and TOTPInputName are copied into inet package for the
+		unlocking clients, in order to avoid import cycle. Looks ugly, sorry.
 	*/
 
 	/*
@@ -33,6 +47,19 @@ const (
 	ContentLocationMagic = "vmseuijt5oj4d5x7fygfqj4398"
 	// PasswordInputName is the HTML element name that accepts password input.
 	PasswordInputName = "password"
+	// TOTPInputName is the HTML element name that accepts TOTP (second factor) input.
+	TOTPInputName = "totp"
+	// ProfileInputName is the HTML element name that accepts the optional configuration profile to launch.
+	ProfileInputName = "profile"
+	// MaxFailedAttempts is the number of consecutive failed unlocking attempts an IP may make before it is locked out.
+	MaxFailedAttempts = 3
+	// InitialLockout is the duration of the first lockout, each further failed attempt doubles the duration.
+	InitialLockout = 1 * time.Minute
+	// MaxLockout is the maximum duration of a lockout.
+	MaxLockout = 24 * time.Hour
+	// RateLimitIntervalSec and RateLimitMaxCount permit each IP to visit the unlock page a number of times per interval.
+	RateLimitIntervalSec = 10
+	RateLimitMaxCount    = 5
 
 	// IOTimeout is the timeout (in seconds) used for transfering data between password input web server and clients.
 	IOTimeout = 30 * time.Second
@@ -43,6 +70,10 @@ const (
 	ShutdownTimeout = 10 * time.Second
 	// CLIFlag is the command line flag that enables this password input web server to launch.
 	CLIFlag = `pwdserver`
+	// SelfSignedCertValidity is the validity period of the ephemeral self-signed certificate.
+	SelfSignedCertValidity = 30 * 24 * time.Hour
+	// TOTPInputHTML is inserted into PageHTML to ask for a TOTP input.
+	TOTPInputHTML = `<p>Enter the current two factor authentication code: <input type="text" name="` + TOTPInputName + `" autocomplete="off"/></p>`
 	// PageHTML is the content of HTML page that asks for a password input.
 	PageHTML = `<html>
 <head>
@@ -52,6 +83,8 @@ const (
 	<pre>%s</pre>
     <form action="%s" method="post">
         <p>Enter password to launch main program: <input type="password" name="` + PasswordInputName + `"/></p>
+        %s
+        <p>Optionally enter the configuration profile to launch: <input type="text" name="` + ProfileInputName + `" autocomplete="off"/></p>
         <p><input type="submit" value="Launch"/></p>
         <p>%s</p>
     </form>
@@ -81,21 +114,232 @@ Num CPU/GOMAXPROCS/goroutines: %d / %d / %d
 }
 
 /*
-WebServer runs an HTTP (not HTTPS) server that serves a single web page at a pre-designated URL, the page then allows a
-visitor to enter a correct password to decrypt program data and configuration, and finally launches a supervisor along
-with daemons using decrypted data.
+FormatCertFingerprint returns the SHA-256 fingerprint of a DER-encoded certificate in the colon-separated hex format
+that is displayed by web browsers.
+*/
+func FormatCertFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	hexDigits := make([]string, len(sum))
+	for i, b := range sum {
+		hexDigits[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hexDigits, ":")
+}
+
+/*
+GenerateSelfSignedCert generates an ephemeral ECDSA key and a self-signed certificate for the host names and IP
+addresses. The certificate is kept in memory only.
+*/
+func GenerateSelfSignedCert(hosts []string) (cert tls.Certificate, fingerprint string, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "laitos password unlock"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(SelfSignedCertValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, FormatCertFingerprint(der), nil
+}
+
+/*
+AlertConfig tells the password input web server how to notify the operator of failed unlocking attempts and the
+successful unlocking. The web server reads it from a plain JSON file, because the program configuration remains
+encrypted until it is unlocked.
+*/
+type AlertConfig struct {
+	MailClient inet.MailClient `json:"MailClient"` // MailClient delivers notification mails to the recipients.
+	Recipients []string        `json:"Recipients"` // Recipients are the mail addresses of the operator.
+	// TelegramBotToken and TelegramChatID let a telegram bot send notification messages to the operator's chat.
+	TelegramBotToken string `json:"TelegramBotToken"`
+	TelegramChatID   int64  `json:"TelegramChatID"`
+}
+
+// failedAttempts keeps track of consecutive failed unlocking attempts made by a client IP.
+type failedAttempts struct {
+	count       int       // count is the number of consecutive failed attempts.
+	lockedUntil time.Time // lockedUntil is the time the client IP may make another attempt.
+}
+
+/*
+WebServer runs an HTTP server that serves a single web page at a pre-designated URL, the page then allows a visitor to
+enter a correct password to decrypt program data and configuration, and finally launches a supervisor along with
+daemons using decrypted data.
+The server optionally serves HTTPS so that the password does not transit the Internet in clear text.
 */
 type WebServer struct {
 	Port int    // Port is the TCP port to listen on.
 	URL  string // URL is the secretive URL that serves the unlock page. The URL must include leading slash.
+	// TLSCertPath and TLSKeyPath are the PEM-encoded certificate and key files to serve HTTPS with.
+	TLSCertPath string
+	TLSKeyPath  string
+	/*
+		SelfSignedTLS serves HTTPS with an ephemeral self-signed certificate if TLSCertPath is not specified. The
+		certificate's fingerprint is logged to the console, compare it against the one shown by the web browser before
+		entering the password.
+	*/
+	SelfSignedTLS bool
+	/*
+		TOTPSecretFile is the path to a file that contains the base32 secret of time-based one-time password (TOTP). If
+		specified, the unlock page asks for a TOTP in addition to the password. Store the file outside of the encrypted
+		program data, so that knowledge of the password alone is not sufficient to launch the program.
+	*/
+	TOTPSecretFile string
+	/*
+		ShamirThreshold is the number of secret shares (made by misc.ShamirSplit) required to reconstruct the password. If
+		it is greater than 0, each submission on the unlock page carries a share instead of the password, possibly made by
+		different people, and the program data is unlocked once sufficient shares have been collected.
+	*/
+	ShamirThreshold int
+	/*
+		AlertConfigFile is the path to a JSON file of AlertConfig. If specified, the operator is notified of client IPs that
+		are locked out after repeated failed unlocking attempts, as well as the successful unlocking.
+	*/
+	AlertConfigFile string
 
 	server          *http.Server // server is the HTTP server after it is started.
 	handlerMutex    *sync.Mutex  // handlerMutex prevents concurrent unlocking attempts from being made at once.
 	alreadyUnlocked bool         // alreadyUnlocked is set to true after a successful unlocking attempt has been made
+	totpSecret      string       // totpSecret is read from TOTPSecretFile upon start.
+	shamirShares    []string     // shamirShares are the secret shares collected so far.
+	alert           AlertConfig  // alert is read from AlertConfigFile upon start.
+	// failures are the consecutive failed unlocking attempts made by each client IP.
+	failures  map[string]*failedAttempts
+	rateLimit *misc.RateLimit // rateLimit restricts the number of visits from each client IP.
 
 	logger lalog.Logger
 }
 
+// writePage responds to the visitor with the unlock page that carries a message.
+func (ws *WebServer) writePage(w http.ResponseWriter, r *http.Request, message string) {
+	totpInput := ""
+	if ws.totpSecret != "" {
+		totpInput = TOTPInputHTML
+	}
+	_, _ = w.Write([]byte(fmt.Sprintf(PageHTML, GetSysInfoText(), r.RequestURI, totpInput, message)))
+}
+
+// checkTOTP returns true only if the input code matches the TOTP of the previous, current, or next time interval.
+func (ws *WebServer) checkTOTP(code string) bool {
+	code = strings.TrimSpace(code)
+	prev, current, next, err := toolbox.GetTwoFACodes(ws.totpSecret)
+	if err != nil || code == "" {
+		return false
+	}
+	match := 0
+	for _, expected := range []string{prev, current, next} {
+		match |= subtle.ConstantTimeCompare([]byte(code), []byte(expected))
+	}
+	return match == 1
+}
+
+// getClientIP returns the IP address of the client that made the request.
+func getClientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// getLockout returns the remaining duration of lockout of the client IP, or 0 if it may make an unlocking attempt.
+func (ws *WebServer) getLockout(clientIP string) time.Duration {
+	if failure, exists := ws.failures[clientIP]; exists {
+		if remaining := time.Until(failure.lockedUntil); remaining > 0 {
+			return remaining
+		}
+	}
+	return 0
+}
+
+/*
+recordFailure counts a failed unlocking attempt of the client. Once the client IP has made MaxFailedAttempts
+consecutive failed attempts, it is locked out for InitialLockout, and each further failed attempt doubles the duration
+up to MaxLockout. The operator is notified of each lockout.
+The attempts in between are throttled by the rate limit of the client IP, rather than by stalling the handler, which
+would hold up the visitors from all other IPs.
+*/
+func (ws *WebServer) recordFailure(clientIP, reason string) {
+	failure, exists := ws.failures[clientIP]
+	if !exists {
+		failure = &failedAttempts{}
+		ws.failures[clientIP] = failure
+	}
+	failure.count++
+	if failure.count < MaxFailedAttempts {
+		return
+	}
+	lockout := MaxLockout
+	if shift := failure.count - MaxFailedAttempts; shift < 20 {
+		if doubled := InitialLockout << uint(shift); doubled < MaxLockout {
+			lockout = doubled
+		}
+	}
+	failure.lockedUntil = time.Now().Add(lockout)
+	ws.logger.Warning("recordFailure", clientIP, nil, "locked out for %s after %d failed unlocking attempts, the latest failure: %s", lockout, failure.count, reason)
+	go ws.notifyOperator("unlocking attempts locked out", fmt.Sprintf("The password input web server has locked out %s for %s after %d failed unlocking attempts. The latest failure: %s", clientIP, lockout, failure.count, reason))
+}
+
+// notifyOperator sends the message to the operator via mail and telegram bot, if they are set up in AlertConfigFile.
+func (ws *WebServer) notifyOperator(subject, message string) {
+	if ws.alert.MailClient.IsConfigured() && len(ws.alert.Recipients) > 0 {
+		if err := ws.alert.MailClient.Send(inet.OutgoingMailSubjectKeyword+"-passwdserver: "+subject, message, ws.alert.Recipients...); err != nil {
+			ws.logger.Warning("notifyOperator", "", err, "failed to send notification mail")
+		}
+	}
+	if ws.alert.TelegramBotToken != "" && ws.alert.TelegramChatID != 0 {
+		bot := &telegrambot.Daemon{AuthorizationToken: ws.alert.TelegramBotToken}
+		if err := bot.ReplyTo(ws.alert.TelegramChatID, message); err != nil {
+			ws.logger.Warning("notifyOperator", "", err, "failed to send notification telegram message")
+		}
+	}
+}
+
+/*
+collectShamirShare memorises a secret share. Once sufficient shares have been collected, it returns the reconstructed
+password and forgets the shares; otherwise, it returns an empty password and a message for the visitor. The ok return
+value is false if the share is malformed or the shares cannot be combined.
+*/
+func (ws *WebServer) collectShamirShare(share string) (key, message string, ok bool) {
+	for _, existing := range ws.shamirShares {
+		if existing == share {
+			return "", "the share has already been submitted", true
+		}
+	}
+	if err := misc.ValidateShamirShare(share); err != nil {
+		return "", err.Error(), false
+	}
+	ws.shamirShares = append(ws.shamirShares, share)
+	if len(ws.shamirShares) < ws.ShamirThreshold {
+		return "", fmt.Sprintf("accepted the share, %d of %d shares have been collected", len(ws.shamirShares), ws.ShamirThreshold), true
+	}
+	secret, err := misc.ShamirCombine(ws.shamirShares)
+	ws.shamirShares = nil
+	if err != nil {
+		return "", fmt.Sprintf("%v, please submit all shares again", err), false
+	}
+	return string(secret), "", true
+}
+
 /*
 pageHandler serves an HTML page that allows visitor to decrypt a program data archive via a correct password.
 If successful, the web server will stop, and then launches laitos supervisor program along with daemons using
@@ -105,6 +349,12 @@ func (ws *WebServer) pageHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	w.Header().Set("Content-Location", ContentLocationMagic)
 	w.Header().Set("Content-Type", "text/html")
+	// Check the rate limit before waiting for the handler, so that a flood of visits from one IP does not hold up the others.
+	clientIP := getClientIP(r)
+	if !ws.rateLimit.Add(clientIP, true) {
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
 	ws.handlerMutex.Lock()
 	defer ws.handlerMutex.Unlock()
 	if ws.alreadyUnlocked {
@@ -114,29 +364,67 @@ func (ws *WebServer) pageHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	switch r.Method {
 	case http.MethodPost:
-		ws.logger.Info("pageHandler", r.RemoteAddr, nil, "an unlock attempt has been made")
-
+		ws.logger.Info("pageHandler", clientIP, nil, "an unlock attempt has been made")
+		// A locked out client does not get to have its password checked at all
+		if lockout := ws.getLockout(clientIP); lockout > 0 {
+			ws.writePage(w, r, fmt.Sprintf("too many failed attempts, try again in %s", lockout.Round(time.Second)))
+			return
+		}
+		// The second factor is checked before the password, so that the page does not reveal whether the password is correct.
+		if ws.totpSecret != "" && !ws.checkTOTP(r.FormValue(TOTPInputName)) {
+			ws.recordFailure(clientIP, "wrong two factor authentication code")
+			ws.writePage(w, r, "wrong key or two factor authentication code")
+			return
+		}
 		var err error
-		// Try decrypting program configuration JSON file using the input password
 		key := strings.TrimSpace(r.FormValue(PasswordInputName))
+		if ws.ShamirThreshold > 0 {
+			var message string
+			var ok bool
+			if key, message, ok = ws.collectShamirShare(key); key == "" {
+				if !ok {
+					ws.recordFailure(clientIP, message)
+				}
+				ws.writePage(w, r, message)
+				return
+			}
+		}
+		// Try decrypting program configuration JSON file using the input password
 		decryptedConfig, err := misc.Decrypt(misc.ConfigFilePath, key)
 		if err != nil {
-			_, _ = w.Write([]byte(fmt.Sprintf(PageHTML, GetSysInfoText(), r.RequestURI, err.Error())))
+			ws.recordFailure(clientIP, err.Error())
+			ws.writePage(w, r, err.Error())
 			return
 		}
 		if decryptedConfig[0] != '{' {
-			_, _ = w.Write([]byte(fmt.Sprintf(PageHTML, GetSysInfoText(), r.RequestURI, "wrong key or malformed config file")))
+			ws.recordFailure(clientIP, "wrong key or malformed config file")
+			ws.writePage(w, r, "wrong key or malformed config file")
 			return
 		}
+		// The password is correct, the optional profile must be among those configured.
+		profile := strings.TrimSpace(r.FormValue(ProfileInputName))
+		if profile != "" {
+			var config launcher.Config
+			if err := json.Unmarshal(decryptedConfig, &config); err != nil {
+				ws.writePage(w, r, err.Error())
+				return
+			}
+			if _, err := config.GetProfileDaemons(profile); err != nil {
+				ws.writePage(w, r, err.Error())
+				return
+			}
+		}
 		// Success!
-		_, _ = w.Write([]byte(fmt.Sprintf(PageHTML, GetSysInfoText(), r.RequestURI, "success")))
+		ws.writePage(w, r, "success")
 		ws.alreadyUnlocked = true
+		delete(ws.failures, clientIP)
+		go ws.notifyOperator("program data unlocked", fmt.Sprintf("The password input web server has unlocked the program data upon request from %s.", clientIP))
 		// A short moment later, the function will launch laitos supervisor along with daemons.
-		go ws.LaunchMainProgram(strings.TrimSpace(r.FormValue("password")))
+		go ws.LaunchMainProgram(key, profile)
 		return
 	default:
-		ws.logger.Info("pageHandler", r.RemoteAddr, nil, "just visiting")
-		_, _ = w.Write([]byte(fmt.Sprintf(PageHTML, GetSysInfoText(), r.RequestURI, "")))
+		ws.logger.Info("pageHandler", clientIP, nil, "just visiting")
+		ws.writePage(w, r, "")
 		return
 	}
 }
@@ -148,6 +436,36 @@ func (ws *WebServer) Start() error {
 		ComponentID:   []lalog.LoggerIDField{{Key: "Port", Value: ws.Port}},
 	}
 	ws.handlerMutex = new(sync.Mutex)
+	ws.failures = make(map[string]*failedAttempts)
+	ws.rateLimit = &misc.RateLimit{
+		UnitSecs: RateLimitIntervalSec,
+		MaxCount: RateLimitMaxCount,
+		Logger:   ws.logger,
+	}
+	ws.rateLimit.Initialise()
+	ws.alert = AlertConfig{}
+	if ws.AlertConfigFile != "" {
+		alertJSON, err := ioutil.ReadFile(ws.AlertConfigFile)
+		if err != nil {
+			ws.logger.Warning("Start", "", err, "failed to read alert configuration file")
+			return err
+		}
+		if err := json.Unmarshal(alertJSON, &ws.alert); err != nil {
+			return fmt.Errorf("passwdserver.Start: failed to deserialise alert configuration file - %v", err)
+		}
+	}
+	ws.totpSecret = ""
+	if ws.TOTPSecretFile != "" {
+		secret, err := ioutil.ReadFile(ws.TOTPSecretFile)
+		if err != nil {
+			ws.logger.Warning("Start", "", err, "failed to read TOTP secret file")
+			return err
+		}
+		ws.totpSecret = strings.TrimSpace(string(secret))
+		if _, err := toolbox.GetTwoFACodeForTimeDivision(ws.totpSecret, 0); err != nil || ws.totpSecret == "" {
+			return fmt.Errorf("passwdserver.Start: TOTP secret file must contain a base32 secret - %v", err)
+		}
+	}
 	mux := http.NewServeMux()
 	// Visitor must visit the pre-configured URL for a meaningful response
 	mux.HandleFunc(ws.URL, ws.pageHandler)
@@ -162,8 +480,31 @@ func (ws *WebServer) Start() error {
 		ReadTimeout: IOTimeout, ReadHeaderTimeout: IOTimeout,
 		WriteTimeout: IOTimeout, IdleTimeout: IOTimeout,
 	}
-	ws.logger.Info("Start", "", nil, "will listen on TCP port %d", ws.Port)
-	if err := ws.server.ListenAndServe(); err != nil && !strings.Contains(err.Error(), "closed") {
+	var err error
+	if ws.TLSCertPath != "" || ws.SelfSignedTLS {
+		var cert tls.Certificate
+		if ws.TLSCertPath != "" {
+			if cert, err = tls.LoadX509KeyPair(ws.TLSCertPath, ws.TLSKeyPath); err != nil {
+				ws.logger.Warning("Start", "", err, "failed to load TLS certificate and key")
+				return err
+			}
+		} else {
+			hostName, _ := os.Hostname()
+			var fingerprint string
+			if cert, fingerprint, err = GenerateSelfSignedCert([]string{hostName, "localhost", "127.0.0.1"}); err != nil {
+				ws.logger.Warning("Start", "", err, "failed to generate self-signed TLS certificate")
+				return err
+			}
+			ws.logger.Info("Start", "", nil, "the SHA-256 fingerprint of self-signed certificate is %s", fingerprint)
+		}
+		ws.server.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		ws.logger.Info("Start", "", nil, "will listen for HTTPS on TCP port %d", ws.Port)
+		err = ws.server.ListenAndServeTLS("", "")
+	} else {
+		ws.logger.Info("Start", "", nil, "will listen on TCP port %d", ws.Port)
+		err = ws.server.ListenAndServe()
+	}
+	if err != nil && !strings.Contains(err.Error(), "closed") {
 		ws.logger.Warning("Start", "", err, "failed to listen on TCP port")
 		return err
 	}
@@ -180,11 +521,11 @@ func (ws *WebServer) Shutdown() error {
 
 /*
 LaunchMainProgram shuts down the web server, and forks a process of laitos program itself to launch main program using
-decrypted data from ramdisk.
+decrypted data from ramdisk. If a configuration profile is given, the main program launches the daemons of the profile.
 If an error occurs, this program will exit abnormally and the function will not return.
 If the forked main program exits normally, the function will return.
 */
-func (ws *WebServer) LaunchMainProgram(decryptionPassword string) {
+func (ws *WebServer) LaunchMainProgram(decryptionPassword, profile string) {
 	// Replicate the CLI flagsNoExec that were used to launch this password web server.
 	flagsNoExec := make([]string, len(os.Args))
 	copy(flagsNoExec, os.Args[1:])
@@ -204,6 +545,12 @@ func (ws *WebServer) LaunchMainProgram(decryptionPassword string) {
 	flagsNoExec = launcher.RemoveFromFlags(func(s string) bool {
 		return strings.HasPrefix(s, "-"+CLIFlag)
 	}, flagsNoExec)
+	if profile != "" {
+		flagsNoExec = launcher.RemoveFromFlags(func(s string) bool {
+			return strings.HasPrefix(s, "-"+launcher.ProfileFlagName)
+		}, flagsNoExec)
+		flagsNoExec = append(flagsNoExec, "-"+launcher.ProfileFlagName, profile)
+	}
 	ws.logger.Info("LaunchMainProgram", "", nil, "about to launch with CLI flags %v", flagsNoExec)
 	cmd = exec.Command(executablePath, flagsNoExec...)
 	cmd.Stdout = os.Stdout
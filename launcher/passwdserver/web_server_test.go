@@ -2,12 +2,16 @@ package passwdserver
 
 import (
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/HouzuoGuo/laitos/inet"
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/toolbox"
 )
 
 func TestGetSysInfoText(t *testing.T) {
@@ -43,7 +47,7 @@ func TestWebServer(t *testing.T) {
 	}
 	// Access the correct URL for password unlock page
 	resp, err = inet.DoHTTP(inet.HTTPRequest{}, "http://localhost:54396/test-url")
-	if err != nil || !strings.Contains(string(resp.Body), "Clock") || !strings.Contains(string(resp.Body), "Enter password") {
+	if err != nil || !strings.Contains(string(resp.Body), "Clock") || !strings.Contains(string(resp.Body), "Enter password") || !strings.Contains(string(resp.Body), `name="`+ProfileInputName+`"`) {
 		t.Fatal(string(resp.Body))
 	}
 	// Pretend that unlock attempt has been made successfully, the client shall get an OK prompt upon next visit.
@@ -59,3 +63,176 @@ func TestWebServer(t *testing.T) {
 		t.Fatal(err, shutdown)
 	}
 }
+
+func TestWebServer_SelfSignedTLS(t *testing.T) {
+	cert, fingerprint, err := GenerateSelfSignedCert([]string{"localhost", "127.0.0.1"})
+	if err != nil || len(cert.Certificate) != 1 || len(fingerprint) != 32*3-1 {
+		t.Fatal(err, fingerprint)
+	}
+	if FormatCertFingerprint(cert.Certificate[0]) != fingerprint {
+		t.Fatal("fingerprint mismatch")
+	}
+	ws := WebServer{
+		Port:          54397,
+		URL:           "/test-url",
+		SelfSignedTLS: true,
+	}
+	go func() {
+		if err := ws.Start(); err != nil {
+			panic(err)
+		}
+	}()
+	time.Sleep(1 * time.Second)
+	// The server must not serve unencrypted HTTP
+	if resp, err := inet.DoHTTP(inet.HTTPRequest{MaxRetry: 1}, "http://localhost:54397/test-url"); err == nil && strings.Contains(string(resp.Body), "Enter password") {
+		t.Fatal("should not have served HTTP")
+	}
+	resp, err := inet.DoHTTP(inet.HTTPRequest{InsecureTLS: true}, "https://localhost:54397/test-url")
+	if err != nil || !strings.Contains(string(resp.Body), "Enter password") {
+		t.Fatal(err, string(resp.Body))
+	}
+	if err := ws.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebServer_CheckTOTP(t *testing.T) {
+	secretFile, err := ioutil.TempFile("", "laitos-TestWebServer_CheckTOTP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(secretFile.Name())
+	if err := ioutil.WriteFile(secretFile.Name(), []byte(" JBSWY3DPEHPK3PXP \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ws := WebServer{
+		Port:           54398,
+		URL:            "/test-url",
+		TOTPSecretFile: secretFile.Name(),
+	}
+	go func() {
+		if err := ws.Start(); err != nil {
+			panic(err)
+		}
+	}()
+	time.Sleep(1 * time.Second)
+	resp, err := inet.DoHTTP(inet.HTTPRequest{}, "http://localhost:54398/test-url")
+	if err != nil || !strings.Contains(string(resp.Body), `name="`+TOTPInputName+`"`) {
+		t.Fatal(err, string(resp.Body))
+	}
+	_, current, _, err := toolbox.GetTwoFACodes("JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ws.checkTOTP(current) || ws.checkTOTP("") || ws.checkTOTP("abcdef") {
+		t.Fatal("incorrect TOTP verification")
+	}
+	// A wrong TOTP must be rejected before the password is checked
+	resp, err = inet.DoHTTP(inet.HTTPRequest{
+		Method: http.MethodPost,
+		Body:   strings.NewReader(url.Values{PasswordInputName: {"pass"}, TOTPInputName: {"000000"}}.Encode()),
+	}, "http://localhost:54398/test-url")
+	if err != nil || !strings.Contains(string(resp.Body), "two factor") || ws.alreadyUnlocked {
+		t.Fatal(err, string(resp.Body))
+	}
+	if err := ws.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	// The server must refuse to start with a malformed secret
+	if err := ioutil.WriteFile(secretFile.Name(), []byte("1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&WebServer{Port: 54399, URL: "/", TOTPSecretFile: secretFile.Name()}).Start(); err == nil {
+		t.Fatal("did not error")
+	}
+}
+
+func TestWebServer_CollectShamirShare(t *testing.T) {
+	shares, err := misc.ShamirSplit([]byte("password"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ws := WebServer{ShamirThreshold: 2}
+	if key, msg, ok := ws.collectShamirShare(shares[0]); key != "" || !strings.Contains(msg, "1 of 2") || !ok {
+		t.Fatal(key, msg)
+	}
+	if key, msg, ok := ws.collectShamirShare(shares[0]); key != "" || !strings.Contains(msg, "already") || !ok {
+		t.Fatal(key, msg)
+	}
+	if key, _, ok := ws.collectShamirShare("malformed"); key != "" || ok {
+		t.Fatal(key)
+	}
+	if key, _, ok := ws.collectShamirShare(shares[2]); key != "password" || len(ws.shamirShares) != 0 || !ok {
+		t.Fatal(key, ws.shamirShares)
+	}
+}
+
+func TestWebServer_Lockout(t *testing.T) {
+	alertFile, err := ioutil.TempFile("", "laitos-TestWebServer_Lockout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(alertFile.Name())
+	if err := ioutil.WriteFile(alertFile.Name(), []byte(`{"Recipients": ["root@localhost"]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	ws := WebServer{
+		Port:            54400,
+		URL:             "/test-url",
+		AlertConfigFile: alertFile.Name(),
+	}
+	go func() {
+		if err := ws.Start(); err != nil {
+			panic(err)
+		}
+	}()
+	time.Sleep(1 * time.Second)
+	if len(ws.alert.Recipients) != 1 {
+		t.Fatal(ws.alert)
+	}
+	unlock := func() string {
+		resp, err := inet.DoHTTP(inet.HTTPRequest{
+			Method: http.MethodPost,
+			Body:   strings.NewReader(url.Values{PasswordInputName: {"wrong password"}}.Encode()),
+		}, "http://localhost:54400/test-url")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(resp.Body)
+	}
+	// The client is locked out after several failed attempts, and the password is no longer checked.
+	for i := 0; i < MaxFailedAttempts; i++ {
+		if body := unlock(); strings.Contains(body, "too many") {
+			t.Fatal(i, body)
+		}
+	}
+	if body := unlock(); !strings.Contains(body, "too many failed attempts, try again in") {
+		t.Fatal(body)
+	}
+	// Each further failure doubles the lockout duration
+	ws.handlerMutex.Lock()
+	ws.failures["127.0.0.1"].lockedUntil = time.Time{}
+	ws.recordFailure("127.0.0.1", "test")
+	if lockout := ws.getLockout("127.0.0.1"); lockout < InitialLockout || lockout > 2*InitialLockout {
+		t.Fatal(lockout)
+	}
+	ws.failures["127.0.0.1"].count = 100
+	ws.recordFailure("127.0.0.1", "test")
+	if lockout := ws.getLockout("127.0.0.1"); lockout < MaxLockout-time.Minute || lockout > MaxLockout {
+		t.Fatal(lockout)
+	}
+	if ws.getLockout("127.0.0.2") != 0 {
+		t.Fatal("should not have locked out another IP")
+	}
+	ws.handlerMutex.Unlock()
+	// Excessive visits are refused regardless of the lockout, without a retry that may outlast the rate limit interval.
+	for i := 0; i < RateLimitMaxCount; i++ {
+		_, _ = inet.DoHTTP(inet.HTTPRequest{MaxRetry: 1}, "http://localhost:54400/test-url")
+	}
+	if resp, err := inet.DoHTTP(inet.HTTPRequest{MaxRetry: 1}, "http://localhost:54400/test-url"); err != nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatal(err, resp.StatusCode)
+	}
+	if err := ws.Shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
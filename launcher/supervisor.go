@@ -1,23 +1,42 @@
 package launcher
 
 import (
+	"bufio"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/platform"
 )
 
 const (
 	ConfigFlagName     = "config"     // ConfigFlagName is the CLI string flag that tells a path to configuration file JSON
 	SupervisorFlagName = "supervisor" // SupervisorFlagName is the CLI boolean flag that determines whether supervisor should run
 	DaemonsFlagName    = "daemons"    // DaemonsFlagName is the CLI string flag of daemon names (comma separated) to launch
+	// WindowsServiceFlagName is the CLI string flag that installs, uninstalls, or runs laitos as a Windows service.
+	WindowsServiceFlagName = "windowsservice"
+	// UnlockFromCloudFlagName is the CLI string flag that tells the cloud secret source of program data decryption password.
+	UnlockFromCloudFlagName = "unlockfromcloud"
+	// UnlockFromTPMFlagName is the CLI string flag that tells the directory of TPM-sealed program data decryption password.
+	UnlockFromTPMFlagName = "unlockfromtpm"
+	// ConfigURLFlagName is the CLI string flag that tells the remote location to download configuration file from.
+	ConfigURLFlagName = "configurl"
+	// ConfigPubKeyFlagName is the CLI string flag of the public key that verifies the signature of remote configuration file.
+	ConfigPubKeyFlagName = "configpubkey"
+	// ProfileFlagName is the CLI string flag that chooses the configuration profile of daemons to launch.
+	ProfileFlagName = "profile"
 
 	// Individual daemon names as provided by user in CLI to launch laitos:
 	DNSDName             = "dnsd"
@@ -30,6 +49,10 @@ const (
 	SMTPDName            = "smtpd"
 	SNMPDName            = "snmpd"
 	SOCKDName            = "sockd"
+	SSHDName             = "sshd"
+	TFTPDName            = "tftpd"
+	TunnelAgentName      = "tunnelagent"
+	WireGuardName        = "wireguard"
 	TelegramName         = "telegram"
 	AutoUnlockName       = "autounlock"
 	PhoneHomeName        = "phonehome"
@@ -41,6 +64,13 @@ const (
 	FailureThresholdSec = 20 * 60
 	// StartAttemptIntervalSec is the amount of time to wait between supervisor's attempts to start main program.
 	StartAttemptIntervalSec = 10
+	/*
+		MaxStartAttemptIntervalSec is the maximum amount of time to wait between attempts to start main program. The
+		interval doubles after each consecutive failure, until it reaches this maximum.
+	*/
+	MaxStartAttemptIntervalSec = 10 * 60
+	// RestartHistoryLen is the number of latest main program failures memorised in the status summary.
+	RestartHistoryLen = 5
 	// MemoriseOutputCapacity is the size of laitos main program output to memorise for notification purpose.
 	MemoriseOutputCapacity = 4 * 1024
 )
@@ -48,7 +78,7 @@ const (
 // AllDaemons is an unsorted list of string daemon names.
 var AllDaemons = []string{
 	AutoUnlockName, DNSDName, HTTPDName, InsecureHTTPDName, MaintenanceName, PhoneHomeName,
-	PlainSocketName, SerialPortDaemonName, SimpleIPSvcName, SMTPDName, SNMPDName, SOCKDName, TelegramName,
+	PlainSocketName, SerialPortDaemonName, SimpleIPSvcName, SMTPDName, SNMPDName, SOCKDName, SSHDName, TFTPDName, TelegramName, TunnelAgentName, WireGuardName,
 }
 
 /*
@@ -68,11 +98,11 @@ instances of laitos program on the LAN or Internet.
 If program continues to crash rapidly and repeatedly,
 */
 var ShedOrder = []string{
-	MaintenanceName,                       // 1
-	SerialPortDaemonName, SimpleIPSvcName, // 2
+	MaintenanceName,                                  // 1
+	SerialPortDaemonName, SimpleIPSvcName, TFTPDName, // 2
 	SNMPDName, DNSDName, // 3
-	SOCKDName, SMTPDName, HTTPDName, // 4
-	InsecureHTTPDName, PlainSocketName, TelegramName, PhoneHomeName, // 5
+	SOCKDName, WireGuardName, SMTPDName, HTTPDName, // 4
+	InsecureHTTPDName, PlainSocketName, SSHDName, TelegramName, TunnelAgentName, PhoneHomeName, // 5
 	// Never shed - AutoUnlockName
 }
 
@@ -122,12 +152,29 @@ type Supervisor struct {
 	MailClient inet.MailClient
 	// DaemonNames are the original set of daemon names that user asked to start.
 	DaemonNames []string
+	// Output receives the main program's stdout and stderr. If left nil, they go to stdout and stderr respectively.
+	Output io.Writer
 	// shedSequence is the sequence at which daemon shedding takes place. Each latter array has one daemon less than the previous.
 	shedSequence [][]string
 	// mainStdout keeps last several KB of program stdout content for failure notification and forwards everything to stdout.
 	mainStdout *lalog.ByteLogWriter
 	// mainStderr keeps last several KB of program stderr content for failure notification and forward everything to stderr.
 	mainStderr *lalog.ByteLogWriter
+	// notifiedReady is 1 after systemd is told of the readiness of the main program for the first time.
+	notifiedReady int32
+	// inheritedSockets are the sockets passed down by systemd socket activation, the supervisor passes them on to the main program.
+	inheritedSockets []*os.File
+	// mainProgram is the latest instance of the main program started by supervisor.
+	mainProgram      *exec.Cmd
+	mainProgramMutex sync.Mutex
+	// stopping is 1 after Stop is called, the supervisor will no longer restart the main program.
+	stopping int32
+	// numFailures is the total number of main program crashes and launch failures.
+	numFailures int
+	// consecutiveFailures is the number of failures that occurred in rapid succession, it determines the restart delay.
+	consecutiveFailures int
+	// restartHistory are the latest main program failures, the latest failure comes last.
+	restartHistory []string
 
 	logger lalog.Logger
 }
@@ -138,11 +185,25 @@ func (sup *Supervisor) initialise() {
 		ComponentName: "supervisor",
 		ComponentID:   []lalog.LoggerIDField{{Key: "PID", Value: os.Getpid()}, {Key: "Daemons", Value: sup.DaemonNames}},
 	}
-	sup.mainStdout = lalog.NewByteLogWriter(os.Stdout, MemoriseOutputCapacity)
-	sup.mainStderr = lalog.NewByteLogWriter(os.Stderr, MemoriseOutputCapacity)
-	// Remove daemon names from CLI flags, because they will be appended by GetLaunchParameters.
+	var stdout, stderr io.Writer = os.Stdout, os.Stderr
+	if sup.Output != nil {
+		stdout, stderr = sup.Output, sup.Output
+	}
+	sup.mainStdout = lalog.NewByteLogWriter(stdout, MemoriseOutputCapacity)
+	sup.mainStderr = lalog.NewByteLogWriter(stderr, MemoriseOutputCapacity)
+	sup.inheritedSockets = platform.GetInheritedSocketFiles()
+	/*
+		Remove daemon names from CLI flags, because they will be appended by GetLaunchParameters. Also remove Windows
+		service flag, because only the supervisor itself runs as a Windows service. The cloud secret source and TPM-sealed
+		password are removed too, because the supervisor feeds the decryption password to main program via STDIN. The
+		remote configuration source is removed as well, because the main program reads the copy fetched by supervisor. The
+		configuration profile is removed too, because the supervisor has already turned it into daemon names.
+	*/
 	sup.CLIFlags = RemoveFromFlags(func(s string) bool {
-		return strings.HasPrefix(s, "-"+DaemonsFlagName)
+		return strings.HasPrefix(s, "-"+DaemonsFlagName) || strings.HasPrefix(s, "-"+WindowsServiceFlagName) ||
+			strings.HasPrefix(s, "-"+UnlockFromCloudFlagName) || strings.HasPrefix(s, "-"+UnlockFromTPMFlagName) ||
+			strings.HasPrefix(s, "-"+ConfigURLFlagName) || strings.HasPrefix(s, "-"+ConfigPubKeyFlagName) ||
+			strings.HasPrefix(s, "-"+ProfileFlagName)
 	}, sup.CLIFlags)
 	// Construct daemon shedding sequence
 	sup.shedSequence = make([][]string, 0, len(sup.DaemonNames))
@@ -211,6 +272,41 @@ Latest stderr: %s
 	}
 }
 
+/*
+recordFailure memorises a main program failure, and returns the amount of time to wait before the next start attempt.
+If the main program ran longer than FailureThresholdSec before failing, the failure is not considered rapid, and the
+restart delay starts over from StartAttemptIntervalSec.
+*/
+func (sup *Supervisor) recordFailure(daemonNames []string, err error, ranSec int64) (delaySec int) {
+	if ranSec >= FailureThresholdSec {
+		sup.consecutiveFailures = 0
+	}
+	sup.consecutiveFailures++
+	sup.numFailures++
+	sup.restartHistory = append(sup.restartHistory, fmt.Sprintf("%s %v (daemons %s)",
+		time.Now().Format(time.RFC3339), err, strings.Join(daemonNames, ",")))
+	if len(sup.restartHistory) > RestartHistoryLen {
+		sup.restartHistory = sup.restartHistory[len(sup.restartHistory)-RestartHistoryLen:]
+	}
+	delaySec = StartAttemptIntervalSec
+	for i := 1; i < sup.consecutiveFailures && delaySec < MaxStartAttemptIntervalSec; i++ {
+		delaySec *= 2
+	}
+	if delaySec > MaxStartAttemptIntervalSec {
+		delaySec = MaxStartAttemptIntervalSec
+	}
+	return
+}
+
+// GetStatusSummary returns a single line of text that summarises the main program's failures and restarts.
+func (sup *Supervisor) GetStatusSummary() string {
+	if sup.numFailures == 0 {
+		return "no failure"
+	}
+	return fmt.Sprintf("%d failures (%d in rapid succession), latest: %s", sup.numFailures, sup.consecutiveFailures,
+		strings.Join(sup.restartHistory, " | "))
+}
+
 // FeedDecryptionPasswordToStdinAndStart starts the main program and writes the universal decryption password into its stdin.
 func FeedDecryptionPasswordToStdinAndStart(decryptionPassword string, cmd *exec.Cmd) error {
 	// Start laitos main program
@@ -231,12 +327,14 @@ func FeedDecryptionPasswordToStdinAndStart(decryptionPassword string, cmd *exec.
 /*
 Start will fork and launch laitos main program and restarts it in case of crash.
 If consecutive crashes occur within 20 minutes, each crash will lead to reduced set of daemons being restarted
-with the main program. If Email notification recipients are configured, a crash report will be delivered to those
-recipients.
+with the main program, and the delay between restarts doubles each time. If Email notification recipients are
+configured, a crash report will be delivered to those recipients. The main program finds a summary of restart history
+in its environment.
 The function blocks caller indefinitely.
 */
 func (sup *Supervisor) Start() {
 	sup.initialise()
+	sup.relayReloadSignal()
 	paramChoice := 0
 	lastAttemptTime := time.Now().Unix()
 	executablePath, err := os.Executable()
@@ -246,24 +344,62 @@ func (sup *Supervisor) Start() {
 	}
 
 	for {
-		cliFlags, _ := sup.GetLaunchParameters(paramChoice)
+		cliFlags, daemonNames := sup.GetLaunchParameters(paramChoice)
 		sup.logger.Info("Start", strconv.Itoa(paramChoice), nil, "attempting to start main program with CLI flags - %v", cliFlags)
 
 		mainProgram := exec.Command(executablePath, cliFlags...)
 		mainProgram.Stdout = sup.mainStdout
 		mainProgram.Stderr = sup.mainStderr
-		if err := FeedDecryptionPasswordToStdinAndStart(misc.ProgramDataDecryptionPassword, mainProgram); err != nil {
+		/*
+			Only the supervisor itself talks to systemd, the main program is its child and systemd would ignore it. The main
+			program notifies the supervisor instead, and pings it at the interval of the systemd watchdog.
+		*/
+		mainProgram.Env = platform.FilterEnv(os.Environ(), nil,
+			[]string{platform.SDNotifySocketEnv, platform.SDWatchdogUSecEnv, platform.SDWatchdogPIDEnv})
+		if interval := platform.SDWatchdogInterval(); interval > 0 {
+			mainProgram.Env = append(mainProgram.Env, platform.SDWatchdogUSecEnv+"="+strconv.FormatInt(int64(interval/time.Microsecond), 10))
+		}
+		mainProgram.Env = append(mainProgram.Env, misc.SupervisorStatusEnvName+"="+sup.GetStatusSummary())
+		sup.mainProgramMutex.Lock()
+		if atomic.LoadInt32(&sup.stopping) == 1 {
+			sup.mainProgramMutex.Unlock()
+			return
+		}
+		sup.mainProgram = mainProgram
+		sup.passInheritedSockets(mainProgram)
+		keyReader, keyWriter := sup.openKeyPipe(mainProgram)
+		notifyReader, notifyWriter := sup.openNotifyPipe(mainProgram)
+		err := FeedDecryptionPasswordToStdinAndStart(misc.ProgramDataDecryptionPassword, mainProgram)
+		sup.mainProgramMutex.Unlock()
+		// The main program keeps its own copy of the pipes' write end
+		if keyReader != nil {
+			sup.logger.MaybeMinorError(keyWriter.Close())
+			go sup.receiveNewPassword(keyReader)
+		}
+		if notifyReader != nil {
+			sup.logger.MaybeMinorError(notifyWriter.Close())
+			go sup.relayNotifications(notifyReader)
+		}
+		if err != nil {
 			sup.logger.Warning("Start", strconv.Itoa(paramChoice), err, "failed to start main program")
 			time.Sleep(1 * time.Second)
 			sup.notifyFailure(cliFlags, err)
-			if time.Now().Unix()-lastAttemptTime < FailureThresholdSec {
+			ranSec := time.Now().Unix() - lastAttemptTime
+			if ranSec < FailureThresholdSec {
 				paramChoice++
 			}
-			time.Sleep(StartAttemptIntervalSec * time.Second)
+			delaySec := sup.recordFailure(daemonNames, err, ranSec)
+			sup.logger.Info("Start", strconv.Itoa(paramChoice), nil, "will try again in %d seconds", delaySec)
+			time.Sleep(time.Duration(delaySec) * time.Second)
 			continue
 		}
 		lastAttemptTime = time.Now().Unix()
-		if err := mainProgram.Wait(); err != nil {
+		err = mainProgram.Wait()
+		if atomic.LoadInt32(&sup.stopping) == 1 {
+			sup.logger.Info("Start", strconv.Itoa(paramChoice), err, "main program has stopped and supervisor is stopping")
+			return
+		}
+		if err != nil {
 			sup.logger.Warning("Start", strconv.Itoa(paramChoice), err, "main program has crashed")
 			/*
 				Unsure what's going on - the main program crashes, the buffer storing latest stderr content just barely
@@ -272,16 +408,154 @@ func (sup *Supervisor) Start() {
 			*/
 			time.Sleep(1 * time.Second)
 			sup.notifyFailure(cliFlags, err)
-			if time.Now().Unix()-lastAttemptTime < FailureThresholdSec {
+			ranSec := time.Now().Unix() - lastAttemptTime
+			if ranSec < FailureThresholdSec {
 				paramChoice++
 			}
-			time.Sleep(StartAttemptIntervalSec * time.Second)
+			delaySec := sup.recordFailure(daemonNames, err, ranSec)
+			sup.logger.Info("Start", strconv.Itoa(paramChoice), nil, "will restart main program in %d seconds", delaySec)
+			time.Sleep(time.Duration(delaySec) * time.Second)
 			continue
 		}
 		// laitos main program is not supposed to exit, therefore, restart it in the next iteration even if it exits normally.
 	}
 }
 
+/*
+passInheritedSockets gives the main program the sockets passed down by systemd socket activation. Just like systemd, the
+supervisor places the sockets at file descriptor 3 onwards and tells their number and names in the environment.
+*/
+func (sup *Supervisor) passInheritedSockets(mainProgram *exec.Cmd) {
+	if len(sup.inheritedSockets) == 0 {
+		return
+	}
+	names := make([]string, 0, len(sup.inheritedSockets))
+	for _, file := range sup.inheritedSockets {
+		names = append(names, file.Name())
+	}
+	// The first extra file becomes file descriptor 3, right after stdin, stdout, and stderr.
+	mainProgram.ExtraFiles = append(mainProgram.ExtraFiles, sup.inheritedSockets...)
+	mainProgram.Env = append(mainProgram.Env,
+		platform.SDListenFDsEnv+"="+strconv.Itoa(len(sup.inheritedSockets)),
+		platform.SDListenFDNamesEnv+"="+strings.Join(names, ":"),
+		platform.SupervisorListenPPIDEnv+"="+strconv.Itoa(os.Getpid()))
+}
+
+/*
+openKeyPipe gives the main program a pipe, into which the main program writes the new program data decryption password
+after re-encrypting program data. The function returns both ends of the pipe, or nil if the pipe is unavailable. The
+write end should be closed by the supervisor after starting the main program.
+*/
+func (sup *Supervisor) openKeyPipe(mainProgram *exec.Cmd) (reader, writer *os.File) {
+	// Windows does not let a child process inherit additional files
+	if runtime.GOOS == "windows" {
+		return nil, nil
+	}
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		sup.logger.Warning("openKeyPipe", "", err, "failed to create pipe, the main program will be unable to change password.")
+		return nil, nil
+	}
+	// The pipe comes after the inherited sockets, if there are any.
+	mainProgram.ExtraFiles = append(mainProgram.ExtraFiles, writer)
+	mainProgram.Env = append(mainProgram.Env, misc.SupervisorKeyFDEnvName+"="+strconv.Itoa(2+len(mainProgram.ExtraFiles)))
+	return reader, writer
+}
+
+// receiveNewPassword reads the new program data decryption passwords written by the main program until it exits.
+func (sup *Supervisor) receiveNewPassword(reader *os.File) {
+	defer func() {
+		sup.logger.MaybeMinorError(reader.Close())
+	}()
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		if newPassword := scanner.Text(); newPassword != "" {
+			sup.mainProgramMutex.Lock()
+			misc.ProgramDataDecryptionPassword = newPassword
+			sup.mainProgramMutex.Unlock()
+			sup.logger.Info("receiveNewPassword", "", nil, "the main program will be restarted using the new password")
+		}
+	}
+}
+
+/*
+openNotifyPipe gives the main program a pipe, into which the main program writes its systemd state notifications. The
+function returns both ends of the pipe, or nil if the pipe is unavailable. The write end should be closed by the
+supervisor after starting the main program.
+*/
+func (sup *Supervisor) openNotifyPipe(mainProgram *exec.Cmd) (reader, writer *os.File) {
+	// Windows does not let a child process inherit additional files, and there is no systemd to notify either.
+	if runtime.GOOS == "windows" {
+		return nil, nil
+	}
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		sup.logger.Warning("openNotifyPipe", "", err, "failed to create pipe, systemd will not be notified of the main program's state.")
+		return nil, nil
+	}
+	mainProgram.ExtraFiles = append(mainProgram.ExtraFiles, writer)
+	mainProgram.Env = append(mainProgram.Env, platform.SupervisorNotifyFDEnv+"="+strconv.Itoa(2+len(mainProgram.ExtraFiles)))
+	return reader, writer
+}
+
+/*
+relayNotifications reads the state notifications written by the main program until it exits, and relays them to
+systemd. Systemd is told of readiness once the main program has its daemons listening for the first time, and afterwards
+the systemd watchdog is pinged only as long as the main program keeps pinging the supervisor.
+*/
+func (sup *Supervisor) relayNotifications(reader *os.File) {
+	defer func() {
+		sup.logger.MaybeMinorError(reader.Close())
+	}()
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		switch state := scanner.Text(); state {
+		case platform.SDNotifyReady:
+			if !atomic.CompareAndSwapInt32(&sup.notifiedReady, 0, 1) {
+				continue
+			}
+			if notified, err := platform.SDNotify(state); err != nil {
+				sup.logger.Warning("relayNotifications", "", err, "failed to notify systemd of readiness")
+			} else if notified {
+				sup.logger.Info("relayNotifications", "", nil, "notified systemd of readiness")
+			}
+		case platform.SDNotifyWatchdog:
+			if _, err := platform.SDNotify(state); err != nil {
+				sup.logger.Warning("relayNotifications", "", err, "failed to ping systemd watchdog")
+			}
+		}
+	}
+}
+
+// relayReloadSignal passes SIGHUP signal received by supervisor on to the main program, which then reloads its configuration.
+func (sup *Supervisor) relayReloadSignal() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			sup.mainProgramMutex.Lock()
+			if sup.mainProgram != nil && sup.mainProgram.Process != nil {
+				if err := sup.mainProgram.Process.Signal(syscall.SIGHUP); err != nil {
+					sup.logger.Warning("relayReloadSignal", "", err, "failed to send SIGHUP to main program")
+				}
+			}
+			sup.mainProgramMutex.Unlock()
+		}
+	}()
+}
+
+// Stop terminates the main program, and consequently Start returns instead of restarting the main program.
+func (sup *Supervisor) Stop() {
+	atomic.StoreInt32(&sup.stopping, 1)
+	sup.mainProgramMutex.Lock()
+	defer sup.mainProgramMutex.Unlock()
+	if sup.mainProgram != nil && sup.mainProgram.Process != nil {
+		if !platform.KillProcess(sup.mainProgram.Process) {
+			sup.logger.Warning("Stop", "", nil, "failed to terminate main program")
+		}
+	}
+}
+
 /*
 GetLaunchParameters returns the parameters used for launching laitos program for the N-th attempt.
 The very first attempt is the 0th attempt.
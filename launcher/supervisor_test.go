@@ -1,9 +1,21 @@
 package launcher
 
 import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
 	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/platform"
 )
 
 func TestRemoveFromFlags(t *testing.T) {
@@ -125,3 +137,134 @@ func TestSupervisor_GetLaunchParameters(t *testing.T) {
 		}
 	}
 }
+
+func TestSupervisor_RecordFailure(t *testing.T) {
+	sup := &Supervisor{}
+	if summary := sup.GetStatusSummary(); summary != "no failure" {
+		t.Fatal(summary)
+	}
+	// The delay doubles after each rapid failure until it reaches the maximum
+	for i, expected := range []int{10, 20, 40, 80, 160, 320, 600, 600} {
+		if delaySec := sup.recordFailure([]string{"dnsd", "httpd"}, errors.New("crash"), 1); delaySec != expected {
+			t.Fatal(i, delaySec)
+		}
+	}
+	if len(sup.restartHistory) != RestartHistoryLen {
+		t.Fatal(sup.restartHistory)
+	}
+	// A failure after a long run restarts the delay from the beginning
+	if delaySec := sup.recordFailure([]string{"dnsd"}, errors.New("crash"), FailureThresholdSec); delaySec != StartAttemptIntervalSec {
+		t.Fatal(delaySec)
+	}
+	if summary := sup.GetStatusSummary(); !strings.HasPrefix(summary, "9 failures (1 in rapid succession)") || !strings.Contains(summary, "crash (daemons dnsd)") {
+		t.Fatal(summary)
+	}
+}
+
+func TestSupervisor_PassInheritedSockets(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("socket activation is not supported on windows")
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	file, err := listener.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	sup := &Supervisor{inheritedSockets: []*os.File{file}}
+	// The main program is played by a copy of the test program
+	cmd := exec.Command(os.Args[0], "-test.run=TestSupervisor_PassInheritedSocketsHelper")
+	cmd.Env = append(os.Environ(), "LAITOS_TEST_LISTEN_ADDR="+listener.Addr().String(), misc.SupervisorStatusEnvName+"=no failure")
+	sup.passInheritedSockets(cmd)
+	keyReader, keyWriter := sup.openKeyPipe(cmd)
+	defer keyReader.Close()
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatal(err, string(out))
+	}
+	// The main program is still able to reach supervisor via the key pipe, which comes after the sockets.
+	if err := keyWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if newPassword, err := ioutil.ReadAll(keyReader); err != nil || string(newPassword) != "new-password\n" {
+		t.Fatal(err, string(newPassword), string(out))
+	}
+}
+
+func TestSupervisor_PassInheritedSocketsHelper(t *testing.T) {
+	addr := os.Getenv("LAITOS_TEST_LISTEN_ADDR")
+	if addr == "" {
+		t.Skip("this is a helper of TestSupervisor_PassInheritedSockets")
+	}
+	files := platform.GetInheritedSocketFiles()
+	if len(files) != 1 {
+		t.Fatal(files)
+	}
+	listener, err := net.FileListener(files[0])
+	if err != nil || listener.Addr().String() != addr {
+		t.Fatal(err, listener)
+	}
+	if err := misc.TellSupervisorNewPassword("new-password"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSupervisor_RelayNotifications(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("systemd notification is not supported on windows")
+	}
+	// Play the role of systemd
+	socketPath := path.Join(os.TempDir(), "laitos-supervisor-notify-test-"+strconv.Itoa(os.Getpid()))
+	defer os.Remove(socketPath)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	os.Setenv(platform.SDNotifySocketEnv, socketPath)
+	defer os.Unsetenv(platform.SDNotifySocketEnv)
+	// The main program is played by a copy of the test program, it notifies the supervisor instead of systemd.
+	sup := &Supervisor{}
+	cmd := exec.Command(os.Args[0], "-test.run=TestSupervisor_RelayNotificationsHelper")
+	cmd.Env = append(platform.FilterEnv(os.Environ(), nil, []string{platform.SDNotifySocketEnv}), "LAITOS_TEST_NOTIFY=1")
+	notifyReader, notifyWriter := sup.openNotifyPipe(cmd)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := notifyWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	go sup.relayNotifications(notifyReader)
+	// Readiness is relayed only once, the watchdog pings are relayed every time.
+	for _, expected := range []string{platform.SDNotifyReady, platform.SDNotifyWatchdog, platform.SDNotifyWatchdog} {
+		buf := make([]byte, 64)
+		_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != expected {
+			t.Fatal(err, string(buf[:n]), expected)
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	// Nothing else arrives after the main program exits
+	_ = conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	if n, err := conn.Read(make([]byte, 64)); err == nil {
+		t.Fatal("unexpected notification", n)
+	}
+}
+
+func TestSupervisor_RelayNotificationsHelper(t *testing.T) {
+	if os.Getenv("LAITOS_TEST_NOTIFY") == "" {
+		t.Skip("this is a helper of TestSupervisor_RelayNotifications")
+	}
+	for _, state := range []string{platform.SDNotifyReady, platform.SDNotifyWatchdog, platform.SDNotifyReady, platform.SDNotifyWatchdog} {
+		if notified, err := platform.SDNotify(state); !notified || err != nil {
+			t.Fatal(notified, err)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -14,16 +15,26 @@ import (
 	"time"
 
 	"github.com/HouzuoGuo/laitos/hzgl"
+	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/lambda"
 	"github.com/HouzuoGuo/laitos/launcher"
 	"github.com/HouzuoGuo/laitos/launcher/passwdserver"
 	"github.com/HouzuoGuo/laitos/misc"
 	"github.com/HouzuoGuo/laitos/platform"
+	"github.com/HouzuoGuo/laitos/toolbox"
 )
 
 const (
 	ProfilerHTTPPort = 19151 // ProfilerHTTPPort is to be listened by net/http/pprof HTTP server when benchmark is turned on
+	// DropPrivilegeListenerTimeoutSec is the maximum amount of time to wait for daemons to listen on their ports before dropping privileges, applying sandbox, and notifying systemd of readiness.
+	DropPrivilegeListenerTimeoutSec = 60
+	// CloudSecretRetryInterval is the interval between attempts of retrieving decryption password from cloud secret service.
+	CloudSecretRetryInterval = 10 * time.Second
+	// ConfigWatchIntervalSec is the interval between checks of configuration file modification, if -watchconfig is turned on.
+	ConfigWatchIntervalSec = 10
+	// ShutdownExtraSec is the number of seconds, in addition to the drain period, that daemons are given to stop upon SIGTERM.
+	ShutdownExtraSec = 5
 )
 
 var logger = lalog.Logger{ComponentName: "main", ComponentID: []lalog.LoggerIDField{{Key: "PID", Value: os.Getpid()}}}
@@ -75,14 +86,209 @@ func EncryptFile(filePath string) {
 	}
 }
 
+/*
+RekeyFiles is a distinct routine of laitos main program, it reads the current and new passwords from standard input and
+uses them to re-encrypt the input file in-place. If the input is a directory, all encrypted files in it are re-encrypted.
+*/
+func RekeyFiles(filePath string) {
+	filePaths := []string{filePath}
+	if info, err := os.Stat(filePath); err != nil {
+		lalog.DefaultLogger.Abort("RekeyFiles", "main", err, "failed to read the file")
+		return
+	} else if info.IsDir() {
+		if filePaths, err = misc.FindEncryptedFiles(filePath); err != nil || len(filePaths) == 0 {
+			lalog.DefaultLogger.Abort("RekeyFiles", "main", err, "failed to find encrypted files in the directory")
+			return
+		}
+	}
+	reader := bufio.NewReader(os.Stdin)
+	passwords := make([]string, 3)
+	for i, prompt := range []string{"Please enter the current password (no echo):", "Please enter the new password (no echo):", "Please enter the new password again (no echo):"} {
+		fmt.Println(prompt)
+		platform.SetTermEcho(false)
+		password, _, err := reader.ReadLine()
+		platform.SetTermEcho(true)
+		if err != nil {
+			lalog.DefaultLogger.Abort("RekeyFiles", "main", err, "failed to read password")
+			return
+		}
+		passwords[i] = strings.TrimSpace(string(password))
+	}
+	if passwords[1] != passwords[2] {
+		lalog.DefaultLogger.Abort("RekeyFiles", "main", nil, "the new passwords do not match")
+		return
+	}
+	if err := misc.RekeyFiles(passwords[0], passwords[1], filePaths...); err != nil {
+		lalog.DefaultLogger.Abort("RekeyFiles", "main", err, "failed to re-encrypt files")
+		return
+	}
+	lalog.DefaultLogger.Info("RekeyFiles", "main", nil, "successfully re-encrypted %v", filePaths)
+}
+
+/*
+SealPasswordToTPM is a distinct routine of laitos main program, it reads password from standard input and seals it
+using the host TPM into the directory, bound to the selection of platform configuration registers.
+*/
+func SealPasswordToTPM(dirPath, pcrs string) {
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Println("Please enter the password to seal into TPM (no echo):")
+	platform.SetTermEcho(false)
+	password, _, err := reader.ReadLine()
+	platform.SetTermEcho(true)
+	if err != nil {
+		lalog.DefaultLogger.Abort("SealPasswordToTPM", "main", err, "failed to read password")
+		return
+	}
+	if err := misc.SealToTPM([]byte(strings.TrimSpace(string(password))), pcrs, dirPath); err != nil {
+		lalog.DefaultLogger.Abort("SealPasswordToTPM", "main", err, "failed to seal password")
+		return
+	}
+	lalog.DefaultLogger.Info("SealPasswordToTPM", "main", nil, "successfully sealed the password into %s", dirPath)
+}
+
+/*
+SignConfigFile is a distinct routine of laitos main program, it reads an ed25519 private key from standard input and
+uses it to sign the configuration file, the signature is written alongside the file with ".sig" suffix. If no key is
+entered, a new key pair is generated and printed.
+*/
+func SignConfigFile(filePath string) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		lalog.DefaultLogger.Abort("SignConfigFile", "main", err, "failed to read configuration file")
+		return
+	}
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Println("Please enter the base64 private key, or leave it empty to generate a new key pair (no echo):")
+	platform.SetTermEcho(false)
+	privateKey, _, err := reader.ReadLine()
+	platform.SetTermEcho(true)
+	if err != nil {
+		lalog.DefaultLogger.Abort("SignConfigFile", "main", err, "failed to read private key")
+		return
+	}
+	if strings.TrimSpace(string(privateKey)) == "" {
+		publicKey, newPrivateKey, err := launcher.GenerateConfigSigningKey()
+		if err != nil {
+			lalog.DefaultLogger.Abort("SignConfigFile", "main", err, "failed to generate key pair")
+			return
+		}
+		fmt.Printf("Start laitos with -%s=%s\nKeep the private key secret, use it to sign future configuration: %s\n", launcher.ConfigPubKeyFlagName, publicKey, newPrivateKey)
+		privateKey = []byte(newPrivateKey)
+	}
+	signature, err := launcher.SignConfig(string(privateKey), content)
+	if err != nil {
+		lalog.DefaultLogger.Abort("SignConfigFile", "main", err, "failed to sign configuration file")
+		return
+	}
+	if err := ioutil.WriteFile(filePath+launcher.ConfigSignatureSuffix, []byte(signature), 0644); err != nil {
+		lalog.DefaultLogger.Abort("SignConfigFile", "main", err, "failed to write signature file")
+		return
+	}
+	lalog.DefaultLogger.Info("SignConfigFile", "main", nil, "upload both %s and %s", filePath, filePath+launcher.ConfigSignatureSuffix)
+}
+
+/*
+SplitPasswordIntoShares is a distinct routine of laitos main program, it reads password from standard input and splits
+it into secret shares, any threshold number of which are able to reconstruct the password.
+*/
+func SplitPasswordIntoShares(numShares, threshold int) {
+	reader := bufio.NewReader(os.Stdin)
+	fmt.Println("Please enter the password to split into shares (no echo):")
+	platform.SetTermEcho(false)
+	password, _, err := reader.ReadLine()
+	platform.SetTermEcho(true)
+	if err != nil {
+		lalog.DefaultLogger.Abort("SplitPasswordIntoShares", "main", err, "failed to read password")
+		return
+	}
+	shares, err := misc.ShamirSplit([]byte(strings.TrimSpace(string(password))), numShares, threshold)
+	if err != nil {
+		lalog.DefaultLogger.Abort("SplitPasswordIntoShares", "main", err, "failed to split password")
+		return
+	}
+	fmt.Printf("Any %d of the following %d shares are able to reconstruct the password, hand them to different people:\n", threshold, numShares)
+	for _, share := range shares {
+		fmt.Println(share)
+	}
+}
+
+/*
+GenerateReportKeyPair is a distinct routine of laitos main program, it prints a new X25519 key pair for sealing the
+subject reports exchanged between the phone-home daemon and the message processor.
+*/
+func GenerateReportKeyPair() {
+	publicKey, privateKey, err := toolbox.GenerateReportKeyPair()
+	if err != nil {
+		lalog.DefaultLogger.Abort("GenerateReportKeyPair", "main", err, "failed to generate key pair")
+		return
+	}
+	fmt.Printf("Give the public key to the other party: %s\nKeep the private key secret, use it as PrivateKey in the configuration: %s\n", publicKey, privateKey)
+}
+
+/*
+CheckConfigFile is a distinct routine of laitos main program, it prints the problems found in configuration file and
+initialisation of the daemons, and exits with status 1 if there is any problem.
+*/
+func CheckConfigFile(configBytes []byte, daemonNames []string) {
+	problems := launcher.CheckConfig(configBytes, daemonNames)
+	if len(problems) == 0 {
+		fmt.Printf("No problem is found in %s\n", misc.ConfigFilePath)
+		return
+	}
+	fmt.Printf("Found %d problems in %s:\n", len(problems), misc.ConfigFilePath)
+	for _, problem := range problems {
+		fmt.Println(problem)
+	}
+	os.Exit(1)
+}
+
+/*
+RetrievePasswordFromTPM unseals program data decryption password using the host TPM and feeds it to the main function.
+If the TPM refuses to unseal the password, e.g. because the boot configuration has changed, the password must be entered
+via other means.
+*/
+func RetrievePasswordFromTPM(dirPath string) {
+	pwd, err := misc.UnsealFromTPM(dirPath)
+	if err != nil {
+		logger.Warning("RetrievePasswordFromTPM", "", err, "failed to unseal decryption password, please enter it via STDIN instead.")
+		return
+	}
+	logger.Info("RetrievePasswordFromTPM", "", nil, "successfully unsealed decryption password")
+	misc.ProgramDataDecryptionPasswordInput <- strings.TrimSpace(string(pwd))
+}
+
+/*
+RetrievePasswordFromCloud retrieves program data decryption password from a cloud secret service and feeds it to the main
+function. In case of failure, the retrieval is retried until it succeeds, as the instance identity may not be ready
+immediately after the computer boots.
+*/
+func RetrievePasswordFromCloud(source string) {
+	for attempt := 0; ; attempt++ {
+		pwd, err := inet.GetCloudSecret(source)
+		if err == nil {
+			logger.Info("RetrievePasswordFromCloud", "", nil, "successfully retrieved decryption password from cloud")
+			misc.ProgramDataDecryptionPasswordInput <- pwd
+			return
+		}
+		logger.Warning("RetrievePasswordFromCloud", "", err, "failed to retrieve decryption password in attempt %d, will retry shortly.", attempt)
+		time.Sleep(CloudSecretRetryInterval)
+	}
+}
+
 /*
 StartPasswordWebServer is a distinct routine of laitos main program, it starts a simple web server to accept a password
 input in order to decrypt laitos program data and launch the daemons.
 */
-func StartPasswordWebServer(port int, url string) {
+func StartPasswordWebServer(port int, url, tlsCertPath, tlsKeyPath string, selfSignedTLS bool, totpSecretFile string, shamirThreshold int, alertConfigFile string) {
 	ws := passwdserver.WebServer{
-		Port: port,
-		URL:  url,
+		Port:            port,
+		URL:             url,
+		TLSCertPath:     tlsCertPath,
+		TLSKeyPath:      tlsKeyPath,
+		SelfSignedTLS:   selfSignedTLS,
+		TOTPSecretFile:  totpSecretFile,
+		ShamirThreshold: shamirThreshold,
+		AlertConfigFile: alertConfigFile,
 	}
 	/*
 		On Amazon ElasitcBeanstalk, application update cannot reliably kill the old program prior to launching the new
@@ -97,7 +303,19 @@ func StartPasswordWebServer(port int, url string) {
 /*
 main runs one of several distinct routines according to the presented combination of command line flags:
 
-- Maintain encrypted program data files: -datautil=encrypt|decrypt
+- Maintain encrypted program data files: -datautil=encrypt|decrypt|rekey
+
+- Seal program data decryption password using the host TPM: -datautil=tpmseal -datautilfile=/sealed/dir [-tpmpcrs=sha256:0,7]
+  Then start laitos with -unlockfromtpm=/sealed/dir to unlock the program data automatically at boot.
+
+- Sign configuration file for laitos to download from a remote location: -datautil=sign -datautilfile=config.json
+  Then start laitos with -config=config.json -configurl=https://... -configpubkey=KEY to download the configuration.
+
+- Split program data decryption password into secret shares: -datautil=shamirsplit -shamirshares=5 -shamirthreshold=3
+  Then start the password web server with -pwdservershamir=3 to unlock the program data using any 3 of the 5 shares.
+
+- Generate a key pair for sealing phone-home reports: -datautil=reportkey
+  Then give the public key to the other party of the phone-home report exchange.
 
 - Launch a simple web server to collect program data decryption password, and proceeds to launch laitos with supervisor:
   -pwdserver -pwdserverport=12345 -pwdserverurl=/my-password-input-page
@@ -111,6 +329,10 @@ main runs one of several distinct routines according to the presented combinatio
 
 - Launch all specified daemons: -config c.json -daemons httpd,smtpd... -supervisor=false
   Supervisor launches laitos main process this way.
+  Instead of -daemons, use -profile to launch the daemons of a named profile from configuration: -profile home
+
+- Install or uninstall laitos as a Windows service: -windowsservice=install|uninstall -config c.json -daemons httpd,smtpd...
+  The service runs laitos with the same program flags, and writes log messages to Windows event log.
 
 - Launch a benchmark routine that feeds random input to (nearly) all started daemons: -benchmark=true
   This routine is occasionally used for fuzzy-test daemons.
@@ -120,31 +342,79 @@ func main() {
 	hzgl.HZGL()
 	// Process command line flags
 	var daemonList string
-	var disableConflicts, debug, benchmark, awsLambda bool
+	var disableConflicts, debug, benchmark, awsLambda, asyncLog, watchConfig, checkConfig, expandConfig bool
 	var gomaxprocs int
 	flag.StringVar(&misc.ConfigFilePath, launcher.ConfigFlagName, "", "(Mandatory) path to configuration file in JSON syntax")
-	flag.StringVar(&daemonList, launcher.DaemonsFlagName, "", "(Mandatory) comma-separated daemons to start (autounlock, dnsd, httpd, insecurehttpd, maintenance, plainsocket, serialport, simpleipsvcd, smtpd, snmpd, sockd, telegram)")
+	flag.StringVar(&daemonList, launcher.DaemonsFlagName, "", "(Mandatory) comma-separated daemons to start (autounlock, dnsd, httpd, insecurehttpd, maintenance, plainsocket, serialport, simpleipsvcd, smtpd, snmpd, sockd, sshd, telegram, tftpd, tunnelagent, wireguard)")
+	var profile string
+	flag.StringVar(&profile, launcher.ProfileFlagName, "", "(Optional) start the daemons of this profile from \"Profiles\" in the configuration file, instead of those given in -daemons")
 	flag.BoolVar(&disableConflicts, "disableconflicts", false, "(Optional) automatically stop and disable other daemon programs that may cause port usage conflicts")
 	flag.BoolVar(&awsLambda, "awslambda", false, "(Optional) run AWS Lambda handler to proxy HTTP requests to laitos web server")
+	flag.BoolVar(&expandConfig, "expandconfig", false, "(Optional) substitute references such as ${ENV_VAR} and ${file:/path/to/secret} in the configuration file by their values, write $${ for a literal ${")
+	flag.BoolVar(&checkConfig, "checkconfig", false, "(Optional) check the configuration file for errors and initialise the daemons (-daemons, or those configured) without starting them, then exit")
+	flag.BoolVar(&watchConfig, "watchconfig", false, "(Optional) apply changes of configuration file to the running daemons as soon as the file is saved, in addition to upon receiving SIGHUP signal")
 	flag.BoolVar(&debug, "debug", false, "(Optional) print goroutine stack traces upon receiving interrupt signal")
 	flag.BoolVar(&benchmark, "benchmark", false, fmt.Sprintf("(Optional) continuously run benchmark routines on active daemons while exposing net/http/pprof on port %d", ProfilerHTTPPort))
 	flag.IntVar(&gomaxprocs, "gomaxprocs", 0, "(Optional) set gomaxprocs")
+	var windowsService string
+	flag.StringVar(&windowsService, launcher.WindowsServiceFlagName, "", "(Optional) install|uninstall laitos as a Windows service that starts automatically, or run as the service")
+	flag.BoolVar(&asyncLog, "asynclog", false, "(Optional) print log messages in background, and drop them if the output (e.g. serial console) cannot keep up")
 	// Data unlocker (password input server) flags
 	var pwdServer bool
 	var pwdServerPort int
 	var pwdServerURL string
+	var pwdServerTLSCert, pwdServerTLSKey string
+	var pwdServerSelfSigned bool
+	var pwdServerTOTPSecretFile string
+	var pwdServerShamir int
+	var pwdServerAlertFile string
 	flag.BoolVar(&pwdServer, passwdserver.CLIFlag, false, "(Optional) launch web server to accept password for decrypting encrypted program data")
 	flag.IntVar(&pwdServerPort, passwdserver.CLIFlag+"port", 80, "(Optional) port number of the password web server")
 	flag.StringVar(&pwdServerURL, passwdserver.CLIFlag+"url", "", "(Optional) password input URL")
+	flag.StringVar(&pwdServerTLSCert, passwdserver.CLIFlag+"tlscert", "", "(Optional) serve the password web server over HTTPS using this PEM certificate file")
+	flag.StringVar(&pwdServerTLSKey, passwdserver.CLIFlag+"tlskey", "", "(Optional) PEM key file of the password web server's certificate")
+	flag.BoolVar(&pwdServerSelfSigned, passwdserver.CLIFlag+"selfsigned", false, "(Optional) serve the password web server over HTTPS using an ephemeral self-signed certificate, its fingerprint is printed to the console")
+	flag.StringVar(&pwdServerTOTPSecretFile, passwdserver.CLIFlag+"totpsecretfile", "", "(Optional) path to a file of base32 TOTP secret, stored outside of the encrypted program data, to require a two factor authentication code in addition to the password")
+	flag.IntVar(&pwdServerShamir, passwdserver.CLIFlag+"shamir", 0, "(Optional) collect this number of secret shares (made by -datautil=shamirsplit) instead of the password on the password web server")
+	flag.StringVar(&pwdServerAlertFile, passwdserver.CLIFlag+"alertfile", "", "(Optional) path to a JSON file of mail and telegram settings, stored outside of the encrypted program data, to notify the operator of lockouts from failed unlocking attempts on the password web server")
+	var unlockFromCloud string
+	flag.StringVar(&unlockFromCloud, launcher.UnlockFromCloudFlagName, "", "(Optional) retrieve program data decryption password from cloud secret service using the instance identity: aws-secretsmanager:REGION:SECRET-ID | aws-kms:REGION:BASE64-CIPHERTEXT | gcp-secretmanager:projects/P/secrets/S/versions/V | azure-keyvault:https://VAULT.vault.azure.net/secrets/NAME")
+	var configURL, configPubKey string
+	flag.StringVar(&configURL, launcher.ConfigURLFlagName, "", "(Optional) download the configuration file from this HTTPS URL or s3://BUCKET/KEY[?region=REGION] into -config location at startup, along with its signature (made by -datautil=sign) at the same location with .sig suffix")
+	flag.StringVar(&configPubKey, launcher.ConfigPubKeyFlagName, "", "(Optional) the public key (made by -datautil=sign) that verifies the signature of the downloaded configuration file")
 	// Data encryption utility flags
 	var dataUtil, dataUtilFile string
-	flag.StringVar(&dataUtil, "datautil", "", "(Optional) program data encryption utility: encrypt|decrypt")
-	flag.StringVar(&dataUtilFile, "datautilfile", "", "(Optional) program data encryption utility: encrypt/decrypt file location")
+	var tpmPCRs, unlockFromTPM string
+	var shamirShares, shamirThreshold int
+	flag.StringVar(&dataUtil, "datautil", "", "(Optional) program data encryption utility: encrypt|decrypt|rekey|tpmseal|shamirsplit|sign|reportkey")
+	flag.IntVar(&shamirShares, "shamirshares", 5, "(Optional) program data encryption utility: the number of secret shares to split the password into")
+	flag.IntVar(&shamirThreshold, "shamirthreshold", 3, "(Optional) program data encryption utility: the number of secret shares required to reconstruct the password")
+	flag.StringVar(&dataUtilFile, "datautilfile", "", "(Optional) program data encryption utility: encrypt/decrypt/rekey file location (rekey also takes a directory), or the directory of TPM-sealed password")
+	flag.StringVar(&tpmPCRs, "tpmpcrs", misc.DefaultTPMPCRs, "(Optional) the TPM platform configuration registers that the sealed password is bound to")
+	flag.StringVar(&unlockFromTPM, launcher.UnlockFromTPMFlagName, "", "(Optional) unseal program data decryption password using the host TPM from this directory, as previously sealed by -datautil=tpmseal")
 	// Internal supervisor flag
 	var isSupervisor = true
 	flag.BoolVar(&isSupervisor, launcher.SupervisorFlagName, true, "(Internal use only) launch a supervisor process to auto-restart laitos main process in case of crash")
 
 	flag.Parse()
+	if asyncLog {
+		lalog.EnableAsyncOutput(lalog.DefaultAsyncQueueLen)
+	}
+
+	// Windows service routine - install, uninstall, or connect to Windows service control manager.
+	var supervisor *launcher.Supervisor
+	var serviceOutput io.Writer
+	if windowsService != "" {
+		var exit bool
+		serviceOutput, exit = ManageWindowsService(windowsService, func() {
+			if supervisor != nil {
+				supervisor.Stop()
+			}
+		})
+		if exit {
+			return
+		}
+	}
 
 	// Common diagnosis and security practices
 	platform.LockMemory()
@@ -156,6 +426,14 @@ func main() {
 	// ========================================================================
 	// Utility routines - maintain encrypted laitos program data, no need to run any daemon.
 	// ========================================================================
+	if dataUtil == "shamirsplit" {
+		SplitPasswordIntoShares(shamirShares, shamirThreshold)
+		return
+	}
+	if dataUtil == "reportkey" {
+		GenerateReportKeyPair()
+		return
+	}
 	if dataUtil != "" {
 		if dataUtilFile == "" {
 			logger.Abort("main", "", nil, "please provide data utility target file in parameter \"-datautilfile\"")
@@ -166,8 +444,14 @@ func main() {
 			EncryptFile(dataUtilFile)
 		case "decrypt":
 			DecryptFile(dataUtilFile)
+		case "rekey":
+			RekeyFiles(dataUtilFile)
+		case "tpmseal":
+			SealPasswordToTPM(dataUtilFile, tpmPCRs)
+		case "sign":
+			SignConfigFile(dataUtilFile)
 		default:
-			logger.Abort("main", "", nil, "please provide mode of operation (encrypt|decrypt) for parameter \"-datautil\"")
+			logger.Abort("main", "", nil, "please provide mode of operation (encrypt|decrypt|rekey|tpmseal|shamirsplit|sign|reportkey) for parameter \"-datautil\"")
 		}
 		return
 	}
@@ -187,7 +471,7 @@ func main() {
 	// Password input web server - start the web server to accept password input for decrypting program data.
 	// ========================================================================
 	if pwdServer {
-		StartPasswordWebServer(pwdServerPort, pwdServerURL)
+		StartPasswordWebServer(pwdServerPort, pwdServerURL, pwdServerTLSCert, pwdServerTLSKey, pwdServerSelfSigned, pwdServerTOTPSecretFile, pwdServerShamir, pwdServerAlertFile)
 		return
 	}
 	/*
@@ -208,6 +492,18 @@ func main() {
 		logger.Abort("main", "", err, "failed to determine absolute path of config file \"%s\"", misc.ConfigFilePath)
 		return
 	}
+	// Download the latest configuration file, the cached copy is used if the download fails.
+	if configURL != "" {
+		if err := launcher.FetchRemoteConfig(configURL, configPubKey, misc.ConfigFilePath); err != nil {
+			if _, statErr := os.Stat(misc.ConfigFilePath); statErr != nil {
+				logger.Abort("main", configURL, err, "failed to download configuration file and there is not a cached copy")
+				return
+			}
+			logger.Warning("main", configURL, err, "failed to download configuration file, using the cached copy at %s", misc.ConfigFilePath)
+		} else {
+			logger.Info("main", configURL, nil, "downloaded and verified configuration file")
+		}
+	}
 	// If config file is encrypted, read its password from standard input.
 	configBytes, isEncrypted, err := misc.IsEncrypted(misc.ConfigFilePath)
 	if err != nil {
@@ -226,6 +522,12 @@ func main() {
 				logger.Warning("main", "", err, "failed to read decryption password from STDIN")
 			}
 		}()
+		if unlockFromCloud != "" {
+			go RetrievePasswordFromCloud(unlockFromCloud)
+		}
+		if unlockFromTPM != "" {
+			go RetrievePasswordFromTPM(unlockFromTPM)
+		}
 		// AWS lambda handler may also supply this password
 		pwd := <-misc.ProgramDataDecryptionPasswordInput
 		misc.ProgramDataDecryptionPassword = pwd
@@ -235,6 +537,14 @@ func main() {
 		}
 	}
 
+	// Substitute environment variables and secrets referenced by the configuration
+	if expandConfig {
+		if configBytes, err = launcher.ExpandConfigReferences(configBytes); err != nil {
+			logger.Abort("main", "", err, "failed to expand references in config file \"%s\"", misc.ConfigFilePath)
+			return
+		}
+	}
+
 	var config launcher.Config
 	/*
 		Certain features (such as browser-in-browser and line oriented browser) rely on utilities in order to
@@ -242,14 +552,25 @@ func main() {
 		deserialising and initialising configuration.
 	*/
 	PrepareUtilitiesAndInBackground()
+	if checkConfig {
+		CheckConfigFile(configBytes, regexp.MustCompile(`\w+`).FindAllString(daemonList, -1))
+		return
+	}
 	if err := config.DeserialiseFromJSON(configBytes); err != nil {
 		logger.Abort("main", "", err, "failed to deserialise/initialise config file \"%s\"", misc.ConfigFilePath)
 		return
 	}
 	// Figure out what daemons are to be started
 	daemonNames := regexp.MustCompile(`\w+`).FindAllString(daemonList, -1)
+	if profile != "" {
+		if daemonNames, err = config.GetProfileDaemons(profile); err != nil {
+			logger.Abort("main", "", err, "failed to determine the daemons to start")
+			return
+		}
+		logger.Info("main", "", nil, "starting daemons %v of profile \"%s\"", daemonNames, profile)
+	}
 	if len(daemonNames) == 0 {
-		logger.Abort("main", "", nil, "please provide comma-separated list of daemon services to start (-daemons).")
+		logger.Abort("main", "", nil, "please provide comma-separated list of daemon services to start (-daemons) or a configuration profile (-profile).")
 		return
 	}
 	// Make sure all daemon names are valid
@@ -272,11 +593,12 @@ func main() {
 	// for a user to turn it off manually.
 	// ========================================================================
 	if isSupervisor {
-		supervisor := &launcher.Supervisor{
+		supervisor = &launcher.Supervisor{
 			CLIFlags:               os.Args[1:],
 			NotificationRecipients: config.SupervisorNotificationRecipients,
 			MailClient:             config.MailClient,
 			DaemonNames:            daemonNames,
+			Output:                 serviceOutput,
 		}
 		supervisor.Start()
 		return
@@ -296,44 +618,59 @@ func main() {
 		DisableConflicts()
 	}
 
-	for _, daemonName := range daemonNames {
-		// Daemons are started asynchronously and the order does not matter
-		switch daemonName {
-		case launcher.DNSDName:
-			go AutoRestart(logger, daemonName, config.GetDNSD().StartAndBlock)
-		case launcher.HTTPDName:
-			go AutoRestart(logger, daemonName, config.GetHTTPD().StartAndBlockWithTLS)
-		case launcher.InsecureHTTPDName:
-			/*
-				There is not an independent port settings for launching both TLS-enabled and TLS-free HTTP servers
-				at the same time. If user really wishes to launch both at the same time, the TLS-free HTTP server
-				will fallback to use port number 80.
-			*/
-			go AutoRestart(logger, daemonName, func() error {
-				return config.GetHTTPD().StartAndBlockNoTLS(80)
-			})
-		case launcher.MaintenanceName:
-			go AutoRestart(logger, daemonName, config.GetMaintenance().StartAndBlock)
-		case launcher.PhoneHomeName:
-			go AutoRestart(logger, daemonName, config.GetPhoneHomeDaemon().StartAndBlock)
-		case launcher.PlainSocketName:
-			go AutoRestart(logger, daemonName, config.GetPlainSocketDaemon().StartAndBlock)
-		case launcher.SerialPortDaemonName:
-			go AutoRestart(logger, daemonName, config.GetSerialPortDaemon().StartAndBlock)
-		case launcher.SimpleIPSvcName:
-			go AutoRestart(logger, daemonName, config.GetSimpleIPSvcD().StartAndBlock)
-		case launcher.SMTPDName:
-			go AutoRestart(logger, daemonName, config.GetMailDaemon().StartAndBlock)
-		case launcher.SNMPDName:
-			go AutoRestart(logger, daemonName, config.GetSNMPD().StartAndBlock)
-		case launcher.SOCKDName:
-			go AutoRestart(logger, daemonName, config.GetSockDaemon().StartAndBlock)
-		case launcher.TelegramName:
-			go AutoRestart(logger, daemonName, config.GetTelegramBot().StartAndBlock)
-		case launcher.AutoUnlockName:
-			go AutoRestart(logger, daemonName, config.GetAutoUnlock().StartAndBlock)
+	// Daemons are started asynchronously and the order does not matter
+	daemonControl := &launcher.DaemonControl{
+		Config:      &config,
+		DaemonNames: daemonNames,
+		ConfigJSON:  configBytes,
+		Run: func(daemonName string, startAndBlock func() error) {
+			AutoRestart(logger, daemonName, startAndBlock)
+		},
+	}
+	daemonControl.StartAll()
+	readConfigFile := func() ([]byte, error) {
+		configBytes, err := misc.ReadConfigFile()
+		if err != nil || !expandConfig {
+			return configBytes, err
+		}
+		return launcher.ExpandConfigReferences(configBytes)
+	}
+	misc.DaemonRestarter = func(daemonName string) error {
+		configBytes, err := readConfigFile()
+		if err != nil {
+			return err
 		}
+		return daemonControl.RestartDaemon(daemonName, configBytes)
 	}
+	misc.ConfigReloader = func() (string, error) {
+		configBytes, err := readConfigFile()
+		if err != nil {
+			return "", err
+		}
+		result, err := daemonControl.ReloadConfig(configBytes)
+		return result.String(), err
+	}
+	ReloadConfigOnSignalOrChange(watchConfig)
+	StopDaemonsOnSignal(daemonControl)
+
+	go func() {
+		// Daemons must have bound their privileged ports before privileges are dropped, and before systemd is told of readiness.
+		if notListening := daemonControl.WaitForListeners(DropPrivilegeListenerTimeoutSec * time.Second); len(notListening) > 0 {
+			logger.Warning("main", "", nil, "daemons are not yet listening on %v, carrying on anyway", notListening)
+		}
+		if config.DropPrivilegeUser != "" {
+			if err := platform.DropPrivileges(config.DropPrivilegeUser, config.DropPrivilegeKeepNetBind); err != nil {
+				logger.Warning("main", config.DropPrivilegeUser, err, "failed to drop privileges, laitos continues to run as the current user")
+			}
+		}
+		if config.Sandbox.IsEnabled() {
+			if err := config.Sandbox.Apply(); err != nil {
+				logger.Warning("main", "", err, "failed to apply sandbox, laitos continues to run without it")
+			}
+		}
+		// When laitos runs as a systemd service of Type=notify, tell systemd (directly or via supervisor) that the daemons have started.
+		platform.StartSDWatchdog(nil)
+	}()
 
 	if benchmark {
 		// Wait a short while for daemons to settle, then run benchmark in the background.
@@ -1,18 +1,27 @@
 package main
 
 import (
+	"context"
 	cryptoRand "crypto/rand"
 	"encoding/binary"
+	"io"
+	"log"
 	pseudoRand "math/rand"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"path/filepath"
 	runtimePprof "runtime/pprof"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"github.com/HouzuoGuo/laitos/daemon/common"
 	"github.com/HouzuoGuo/laitos/lalog"
+	"github.com/HouzuoGuo/laitos/launcher"
 	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/platform"
 )
 
 // DumpGoroutinesOnInterrupt installs an interrupt signal handler that dumps all goroutine traces to standard error.
@@ -26,6 +35,68 @@ func DumpGoroutinesOnInterrupt() {
 	}()
 }
 
+/*
+ReloadConfigOnSignalOrChange applies the latest content of configuration file to the running daemons upon receiving
+SIGHUP signal. If watchFile is true, the changes are also applied as soon as the file is modified.
+*/
+func ReloadConfigOnSignalOrChange(watchFile bool) {
+	reload := func(reason string) {
+		summary, err := misc.ConfigReloader()
+		if err != nil {
+			logger.Warning("ReloadConfigOnSignalOrChange", reason, err, "failed to reload configuration file")
+			return
+		}
+		logger.Info("ReloadConfigOnSignalOrChange", reason, nil, "configuration file is reloaded - %s", summary)
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			reload("SIGHUP")
+		}
+	}()
+	if !watchFile {
+		return
+	}
+	go func() {
+		var lastModTime time.Time
+		if info, err := os.Stat(misc.ConfigFilePath); err == nil {
+			lastModTime = info.ModTime()
+		}
+		for {
+			time.Sleep(ConfigWatchIntervalSec * time.Second)
+			info, err := os.Stat(misc.ConfigFilePath)
+			if err != nil || info.ModTime().Equal(lastModTime) {
+				continue
+			}
+			lastModTime = info.ModTime()
+			reload("file change")
+		}
+	}()
+}
+
+/*
+StopDaemonsOnSignal stops all daemons upon receiving SIGTERM signal, and then exits the program. The daemons are given
+the drain period to finish their ongoing conversations, such as DNS answers and HTTP responses.
+*/
+func StopDaemonsOnSignal(daemonControl *launcher.DaemonControl) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGTERM)
+	go func() {
+		<-c
+		logger.Warning("StopDaemonsOnSignal", "SIGTERM", nil, "stopping all daemons, this may take up to %d seconds", common.DrainTimeoutSec)
+		// Each daemon waits for the drain period on its own, allow a little extra time for them to return.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(common.DrainTimeoutSec+ShutdownExtraSec)*time.Second)
+		defer cancel()
+		if err := daemonControl.StopAll(ctx); err != nil {
+			logger.Warning("StopDaemonsOnSignal", "SIGTERM", err, "some daemons did not stop in time")
+		}
+		lalog.FlushRepeatedMessages()
+		lalog.FlushAsyncOutput(1 * time.Second)
+		os.Exit(0)
+	}()
+}
+
 /*
 ReseedPseudoRandAndContinue immediately re-seeds PRNG using cryptographic RNG, and then continues in background at
 regular interval (3 minutes). This helps some laitos daemons that use the common PRNG instance for their operations.
@@ -123,3 +194,65 @@ func AutoRestart(logger lalog.Logger, logActorName string, fun func() error) {
 		}
 	}
 }
+
+/*
+ManageWindowsService installs (mode "install") or uninstalls (mode "uninstall") laitos Windows service, and then the
+caller should exit. The service runs laitos with the same program flags as the installation command.
+In mode "run", the function connects laitos to Windows service control manager and sends log messages to Windows event
+log, the returned event log writer is also suitable for receiving laitos main program's output. When Windows asks the
+service to stop, onStop is called before laitos exits.
+*/
+func ManageWindowsService(mode string, onStop func()) (eventLog io.Writer, exit bool) {
+	switch mode {
+	case "install":
+		// The service does not start in the current working directory, hence use absolute path to config file.
+		args := launcher.RemoveFromFlags(func(s string) bool {
+			return strings.HasPrefix(s, "-"+launcher.WindowsServiceFlagName) || s == "-"+launcher.ConfigFlagName || strings.HasPrefix(s, "-"+launcher.ConfigFlagName+"=")
+		}, os.Args[1:])
+		if misc.ConfigFilePath != "" {
+			configPath, err := filepath.Abs(misc.ConfigFilePath)
+			if err != nil {
+				logger.Abort("ManageWindowsService", mode, err, "failed to determine absolute path of config file")
+				return nil, true
+			}
+			args = append(args, "-"+launcher.ConfigFlagName, configPath)
+		}
+		args = append(args, "-"+launcher.WindowsServiceFlagName+"=run")
+		if err := platform.InstallWindowsService(platform.WindowsServiceName, "laitos - personal Internet infrastructure", args); err != nil {
+			logger.Abort("ManageWindowsService", mode, err, "failed to install Windows service")
+			return nil, true
+		}
+		logger.Info("ManageWindowsService", mode, nil, "successfully installed Windows service \"%s\" with program flags %v", platform.WindowsServiceName, args)
+		return nil, true
+	case "uninstall":
+		if err := platform.UninstallWindowsService(platform.WindowsServiceName); err != nil {
+			logger.Abort("ManageWindowsService", mode, err, "failed to uninstall Windows service")
+			return nil, true
+		}
+		logger.Info("ManageWindowsService", mode, nil, "successfully uninstalled Windows service \"%s\"", platform.WindowsServiceName)
+		return nil, true
+	case "run":
+		writer, err := platform.NewWindowsEventLogWriter(platform.WindowsServiceName)
+		if err != nil {
+			logger.Warning("ManageWindowsService", mode, err, "failed to open event log, log messages will not be kept.")
+		} else {
+			log.SetOutput(writer)
+			eventLog = writer
+		}
+		// Windows starts services in system directory, change it to config file's directory where program data usually reside.
+		if misc.ConfigFilePath != "" {
+			if err := os.Chdir(filepath.Dir(misc.ConfigFilePath)); err != nil {
+				logger.Warning("ManageWindowsService", mode, err, "failed to change working directory")
+			}
+		}
+		if err := platform.StartWindowsService(platform.WindowsServiceName, onStop); err != nil {
+			logger.Abort("ManageWindowsService", mode, err, "failed to start Windows service")
+			return nil, true
+		}
+		logger.Info("ManageWindowsService", mode, nil, "laitos is now running as Windows service \"%s\"", platform.WindowsServiceName)
+		return eventLog, false
+	default:
+		logger.Abort("ManageWindowsService", mode, nil, "please provide mode of operation (install|uninstall|run) for parameter \"-%s\"", launcher.WindowsServiceFlagName)
+		return nil, true
+	}
+}
@@ -0,0 +1,132 @@
+package misc
+
+import (
+	"io/ioutil"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	// CgroupFSRoot is the directory where cgroup file systems are mounted.
+	CgroupFSRoot = "/sys/fs/cgroup"
+	// ProcSelfCgroupPath is the location of the file that tells cgroup membership of this process.
+	ProcSelfCgroupPath = "/proc/self/cgroup"
+
+	RegexCgroupV2InactiveFile = regexp.MustCompile(`(?m)^inactive_file\s+(\d+)`)       // Parse inactive_file value from cgroup v2 memory.stat
+	RegexCgroupV1InactiveFile = regexp.MustCompile(`(?m)^total_inactive_file\s+(\d+)`) // Parse total_inactive_file value from cgroup v1 memory.stat
+)
+
+/*
+cgroupUnlimited is the threshold above which a cgroup v1 memory limit is considered absent. The kernel represents the
+absence of limit by a very large number that is rounded down to page size.
+*/
+const cgroupUnlimited = int64(1) << 60
+
+// readCgroupInt reads an integer from a cgroup control file. It returns false if the file is absent or reads "max".
+func readCgroupInt(filePath string) (int64, bool) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return 0, false
+	}
+	val, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return val, true
+}
+
+/*
+getCgroupDirs returns the candidate directories of cgroup controller of this process, the most specific directory comes
+first. For cgroup v2 the controller name is ignored. The root of the hierarchy is always the last candidate, because the
+process running in a container usually sees its own cgroup as the root.
+*/
+func getCgroupDirs(v1Controller string) (dirs []string) {
+	isV2 := IsCgroupV2()
+	hierarchyRoot := CgroupFSRoot
+	if !isV2 {
+		hierarchyRoot = path.Join(CgroupFSRoot, v1Controller)
+	}
+	if content, err := ioutil.ReadFile(ProcSelfCgroupPath); err == nil {
+		// Each line looks like "hierarchy-ID:controller-list:cgroup-path"
+		for _, line := range strings.Split(string(content), "\n") {
+			fields := strings.SplitN(strings.TrimSpace(line), ":", 3)
+			if len(fields) != 3 || fields[2] == "/" {
+				continue
+			}
+			if isV2 && fields[0] == "0" && fields[1] == "" {
+				dirs = append(dirs, path.Join(hierarchyRoot, fields[2]))
+			} else if !isV2 {
+				for _, controller := range strings.Split(fields[1], ",") {
+					if controller == v1Controller {
+						dirs = append(dirs, path.Join(hierarchyRoot, fields[2]))
+					}
+				}
+			}
+		}
+	}
+	return append(dirs, hierarchyRoot)
+}
+
+// IsCgroupV2 returns true only if the cgroup file system is the unified (v2) hierarchy.
+func IsCgroupV2() bool {
+	_, err := ioutil.ReadFile(path.Join(CgroupFSRoot, "cgroup.controllers"))
+	return err == nil
+}
+
+/*
+GetCgroupMemoryUsageKB returns the memory usage and memory limit of the cgroup (e.g. Docker container) this process
+belongs to. Page cache that can be reclaimed is not counted as used. The boolean return value is false if there is no
+memory limit imposed on the cgroup.
+*/
+func GetCgroupMemoryUsageKB() (usedKB, limitKB int, limited bool) {
+	limitFile, usageFile, statFile, inactiveRegex := "memory.limit_in_bytes", "memory.usage_in_bytes", "memory.stat", RegexCgroupV1InactiveFile
+	if IsCgroupV2() {
+		limitFile, usageFile, inactiveRegex = "memory.max", "memory.current", RegexCgroupV2InactiveFile
+	}
+	for _, dir := range getCgroupDirs("memory") {
+		limit, hasLimit := readCgroupInt(path.Join(dir, limitFile))
+		if !hasLimit || limit <= 0 || limit >= cgroupUnlimited {
+			continue
+		}
+		usage, _ := readCgroupInt(path.Join(dir, usageFile))
+		if stat, err := ioutil.ReadFile(path.Join(dir, statFile)); err == nil {
+			if inactive := int64(FindNumInRegexGroup(inactiveRegex, string(stat), 1)); inactive < usage {
+				usage -= inactive
+			}
+		}
+		return int(usage / 1024), int(limit / 1024), true
+	}
+	return 0, 0, false
+}
+
+/*
+GetCgroupCPULimit returns the number of CPUs (may be fractional) that the cgroup this process belongs to is allowed to
+use. The boolean return value is false if there is no CPU quota imposed on the cgroup.
+*/
+func GetCgroupCPULimit() (numCPUs float64, limited bool) {
+	for _, dir := range getCgroupDirs("cpu") {
+		var quota, period int64
+		if IsCgroupV2() {
+			// cpu.max looks like "quota period" or "max period"
+			content, err := ioutil.ReadFile(path.Join(dir, "cpu.max"))
+			if err != nil {
+				continue
+			}
+			fields := strings.Fields(string(content))
+			if len(fields) != 2 {
+				continue
+			}
+			quota, _ = strconv.ParseInt(fields[0], 10, 64)
+			period, _ = strconv.ParseInt(fields[1], 10, 64)
+		} else {
+			quota, _ = readCgroupInt(path.Join(dir, "cpu.cfs_quota_us"))
+			period, _ = readCgroupInt(path.Join(dir, "cpu.cfs_period_us"))
+		}
+		if quota > 0 && period > 0 {
+			return float64(quota) / float64(period), true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,83 @@
+package misc
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCgroup(t *testing.T) {
+	origRoot, origSelf := CgroupFSRoot, ProcSelfCgroupPath
+	defer func() {
+		CgroupFSRoot, ProcSelfCgroupPath = origRoot, origSelf
+	}()
+	tmpDir, err := ioutil.TempDir("", "laitos-TestCgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	writeFile := func(name, content string) {
+		if err := os.MkdirAll(path.Dir(path.Join(tmpDir, name)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(tmpDir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	CgroupFSRoot = path.Join(tmpDir, "v1")
+	ProcSelfCgroupPath = path.Join(tmpDir, "self-v1")
+
+	// cgroup v1 without limits
+	writeFile("self-v1", "4:memory:/docker/abc\n2:cpu,cpuacct:/docker/abc\n1:name=systemd:/\n")
+	writeFile("v1/memory/docker/abc/memory.limit_in_bytes", "9223372036854771712\n")
+	writeFile("v1/cpu/docker/abc/cpu.cfs_quota_us", "-1\n")
+	writeFile("v1/cpu/docker/abc/cpu.cfs_period_us", "100000\n")
+	if IsCgroupV2() {
+		t.Fatal("should be v1")
+	}
+	if _, _, limited := GetCgroupMemoryUsageKB(); limited {
+		t.Fatal("should not have memory limit")
+	}
+	if _, limited := GetCgroupCPULimit(); limited {
+		t.Fatal("should not have CPU limit")
+	}
+	// cgroup v1 with limits
+	writeFile("v1/memory/docker/abc/memory.limit_in_bytes", "1048576\n")
+	writeFile("v1/memory/docker/abc/memory.usage_in_bytes", "524288\n")
+	writeFile("v1/memory/docker/abc/memory.stat", "cache 0\ntotal_inactive_file 102400\n")
+	writeFile("v1/cpu/docker/abc/cpu.cfs_quota_us", "150000\n")
+	if used, limit, limited := GetCgroupMemoryUsageKB(); !limited || used != 412 || limit != 1024 {
+		t.Fatal(used, limit, limited)
+	}
+	if cpus, limited := GetCgroupCPULimit(); !limited || cpus != 1.5 {
+		t.Fatal(cpus, limited)
+	}
+
+	// cgroup v2 with limits on the root of hierarchy (as seen from inside a container)
+	CgroupFSRoot = path.Join(tmpDir, "v2")
+	ProcSelfCgroupPath = path.Join(tmpDir, "self-v2")
+	writeFile("self-v2", "0::/\n")
+	writeFile("v2/cgroup.controllers", "cpu memory\n")
+	writeFile("v2/memory.max", "max\n")
+	writeFile("v2/cpu.max", "max 100000\n")
+	if !IsCgroupV2() {
+		t.Fatal("should be v2")
+	}
+	if _, _, limited := GetCgroupMemoryUsageKB(); limited {
+		t.Fatal("should not have memory limit")
+	}
+	if _, limited := GetCgroupCPULimit(); limited {
+		t.Fatal("should not have CPU limit")
+	}
+	writeFile("v2/memory.max", "2097152\n")
+	writeFile("v2/memory.current", "1048576\n")
+	writeFile("v2/memory.stat", "anon 0\ninactive_file 1048576\n")
+	writeFile("v2/cpu.max", "50000 100000\n")
+	if used, limit, limited := GetCgroupMemoryUsageKB(); !limited || used != 1024 || limit != 2048 {
+		t.Fatal(used, limit, limited)
+	}
+	if cpus, limited := GetCgroupCPULimit(); !limited || cpus != 0.5 {
+		t.Fatal(cpus, limited)
+	}
+}
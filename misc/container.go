@@ -0,0 +1,70 @@
+package misc
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	ContainerDocker     = "docker"     // ContainerDocker is the name of docker container runtime.
+	ContainerKubernetes = "kubernetes" // ContainerKubernetes is the name of a kubernetes pod, regardless of its container runtime.
+	ContainerContainerd = "containerd" // ContainerContainerd is the name of containerd container runtime used without docker.
+	ContainerPodman     = "podman"     // ContainerPodman is the name of podman container runtime.
+	ContainerLXC        = "lxc"        // ContainerLXC is the name of LXC container runtime.
+)
+
+var (
+	// DockerEnvPath is the location of the file created by docker at the root of container file system.
+	DockerEnvPath = "/.dockerenv"
+	// PodmanEnvPath is the location of the file created by podman in the container.
+	PodmanEnvPath = "/run/.containerenv"
+	// ProcSelfMountInfoPath is the location of the file that tells the mount points of this process.
+	ProcSelfMountInfoPath = "/proc/self/mountinfo"
+)
+
+/*
+containerRuntimeFromProcFile looks for the traces left by container runtimes in the content of process cgroup membership
+or mount information. It returns an empty string if no trace is found.
+*/
+func containerRuntimeFromProcFile(content string) string {
+	// Kubernetes comes first because a pod is usually run by docker or containerd
+	switch {
+	case strings.Contains(content, "kubepods") || strings.Contains(content, "/kubelet/pods/"):
+		return ContainerKubernetes
+	case strings.Contains(content, "/docker/") || strings.Contains(content, "docker-"):
+		return ContainerDocker
+	case strings.Contains(content, "libpod"):
+		return ContainerPodman
+	case strings.Contains(content, "containerd"):
+		return ContainerContainerd
+	case strings.Contains(content, "/lxc/") || strings.Contains(content, "lxc.payload"):
+		return ContainerLXC
+	}
+	return ""
+}
+
+/*
+GetContainerRuntime returns the name of the container runtime (e.g. ContainerDocker) that runs this program. It returns
+an empty string if the program does not appear to run in a container.
+*/
+func GetContainerRuntime() string {
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return ContainerKubernetes
+	}
+	if _, err := os.Stat(DockerEnvPath); err == nil {
+		return ContainerDocker
+	}
+	if _, err := os.Stat(PodmanEnvPath); err == nil {
+		return ContainerPodman
+	}
+	// cgroup v2 does not reveal the container's cgroup path from the inside, though the mount points often do.
+	for _, procFilePath := range []string{ProcSelfCgroupPath, ProcSelfMountInfoPath} {
+		if content, err := ioutil.ReadFile(procFilePath); err == nil {
+			if runtime := containerRuntimeFromProcFile(string(content)); runtime != "" {
+				return runtime
+			}
+		}
+	}
+	return ""
+}
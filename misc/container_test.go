@@ -0,0 +1,24 @@
+package misc
+
+import "testing"
+
+func TestContainerRuntimeFromProcFile(t *testing.T) {
+	for content, expected := range map[string]string{
+		"":                                   "",
+		"0::/\n":                             "",
+		"0::/init.scope\n":                   "",
+		"12:memory:/docker/0123456789abcdef": ContainerDocker,
+		"0::/system.slice/docker-0123456789abcdef.scope":               ContainerDocker,
+		"11:cpu:/kubepods/burstable/pod123/0123456789abcdef":           ContainerKubernetes,
+		"1234 1 0:1 /var/lib/kubelet/pods/abc/volumes /run/secrets rw": ContainerKubernetes,
+		"0::/machine.slice/libpod-0123456789abcdef.scope":              ContainerPodman,
+		"0::/system.slice/containerd.service/ns:abc":                   ContainerContainerd,
+		"0::/lxc.payload.test":                                         ContainerLXC,
+	} {
+		if runtime := containerRuntimeFromProcFile(content); runtime != expected {
+			t.Fatal(content, runtime)
+		}
+	}
+	// The detection must not crash regardless of the environment
+	t.Log(GetContainerRuntime())
+}
@@ -0,0 +1,141 @@
+package misc
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/HouzuoGuo/laitos/platform"
+)
+
+// RegexWindowsLoadPercentage parses the CPU load percentage figures from the output of "wmic cpu get LoadPercentage".
+var RegexWindowsLoadPercentage = regexp.MustCompile(`(?m)^\s*(\d+)\s*$`)
+
+// CPUTimes is the accumulated amount of time a CPU (or all CPUs combined) has spent since system boot.
+type CPUTimes struct {
+	Name  string // Name is "cpu" for all CPUs combined, or "cpuN" for an individual core.
+	Busy  uint64 // Busy is the amount of time spent on running programs and kernel, in USER_HZ unit.
+	Total uint64 // Total is the amount of time including idle and IO wait, in USER_HZ unit.
+}
+
+// CPUUsage is the utilisation of a CPU (or all CPUs combined) over an interval.
+type CPUUsage struct {
+	Name    string  // Name is "cpu" for all CPUs combined, or "cpuN" for an individual core.
+	Percent float64 // Percent is the percentage (0-100) of time the CPU was busy.
+}
+
+var (
+	// lastCPUTimes is the CPU times sampled by the previous call to GetCPUUsage.
+	lastCPUTimes      []CPUTimes
+	lastCPUTimesMutex = new(sync.Mutex)
+)
+
+// ParseProcStat returns the CPU times of all CPUs combined, followed by each individual core, from /proc/stat content.
+func ParseProcStat(content string) (ret []CPUTimes) {
+	ret = make([]CPUTimes, 0, 8)
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 || !strings.HasPrefix(fields[0], "cpu") {
+			continue
+		}
+		times := CPUTimes{Name: fields[0]}
+		// user nice system idle iowait irq softirq steal, guest time is already included in user time.
+		for i, field := range fields[1:] {
+			if i >= 8 {
+				break
+			}
+			val, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				continue
+			}
+			times.Total += val
+			if i != 3 && i != 4 {
+				times.Busy += val
+			}
+		}
+		ret = append(ret, times)
+	}
+	return
+}
+
+/*
+CalculateCPUUsage returns the utilisation of each CPU between the two samples of CPU times. CPUs absent from the
+earlier sample are measured since system boot.
+*/
+func CalculateCPUUsage(earlier, later []CPUTimes) (ret []CPUUsage) {
+	ret = make([]CPUUsage, 0, len(later))
+	for _, laterTimes := range later {
+		busy, total := laterTimes.Busy, laterTimes.Total
+		for _, earlierTimes := range earlier {
+			if earlierTimes.Name == laterTimes.Name && earlierTimes.Total <= laterTimes.Total && earlierTimes.Busy <= laterTimes.Busy {
+				busy -= earlierTimes.Busy
+				total -= earlierTimes.Total
+				break
+			}
+		}
+		usage := CPUUsage{Name: laterTimes.Name}
+		if total > 0 {
+			usage.Percent = float64(busy) * 100 / float64(total)
+		}
+		ret = append(ret, usage)
+	}
+	return
+}
+
+/*
+GetCPUUsage returns the utilisation of all CPUs combined (named "cpu"), followed by each individual core (named "cpuN"),
+over the interval since the previous call of this function. Upon the first call, the utilisation is averaged since
+system boot. On Windows, only the current utilisation of all CPUs combined is returned. Returns an empty slice if the
+utilisation cannot be determined.
+*/
+func GetCPUUsage() []CPUUsage {
+	if HostIsWindows() {
+		return getWindowsCPUUsage()
+	}
+	content, err := ioutil.ReadFile("/proc/stat")
+	if err != nil {
+		return []CPUUsage{}
+	}
+	latest := ParseProcStat(string(content))
+	lastCPUTimesMutex.Lock()
+	defer lastCPUTimesMutex.Unlock()
+	ret := CalculateCPUUsage(lastCPUTimes, latest)
+	lastCPUTimes = latest
+	return ret
+}
+
+// getWindowsCPUUsage returns the current load percentage of all processors combined as reported by WMI.
+func getWindowsCPUUsage() []CPUUsage {
+	out, err := platform.InvokeProgram(nil, CommonOSCmdTimeoutSec, "wmic", "cpu", "get", "LoadPercentage")
+	if err != nil {
+		return []CPUUsage{}
+	}
+	// There is one line of load percentage for each processor socket
+	var sum, count int
+	for _, match := range RegexWindowsLoadPercentage.FindAllStringSubmatch(out, -1) {
+		if val, err := strconv.Atoi(match[1]); err == nil {
+			sum += val
+			count++
+		}
+	}
+	if count == 0 {
+		return []CPUUsage{}
+	}
+	return []CPUUsage{{Name: "cpu", Percent: float64(sum) / float64(count)}}
+}
+
+// FormatCPUUsage returns the CPU utilisation figures in a single line of text, e.g. "cpu 12.5%, cpu0 20.0%, cpu1 5.0%".
+func FormatCPUUsage(usage []CPUUsage) string {
+	var buf bytes.Buffer
+	for i, cpu := range usage {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(fmt.Sprintf("%s %.1f%%", cpu.Name, cpu.Percent))
+	}
+	return buf.String()
+}
@@ -0,0 +1,46 @@
+package misc
+
+import (
+	"runtime"
+	"testing"
+)
+
+func TestCalculateCPUUsage(t *testing.T) {
+	earlier := ParseProcStat(`cpu  100 0 100 700 100 0 0 0 0 0
+cpu0 50 0 50 350 50 0 0 0 0 0
+cpu1 50 0 50 350 50 0 0 0 0 0
+intr 556135 0 0 0
+`)
+	if len(earlier) != 3 || earlier[0].Name != "cpu" || earlier[0].Busy != 200 || earlier[0].Total != 1000 {
+		t.Fatal(earlier)
+	}
+	later := ParseProcStat(`cpu  200 0 200 800 100 0 0 0 0 0
+cpu0 150 0 150 350 50 0 0 0 0 0
+cpu1 50 0 50 450 50 0 0 0 0 0
+`)
+	usage := CalculateCPUUsage(earlier, later)
+	if len(usage) != 3 || usage[0].Percent != 200.0/3 || usage[1].Percent != 100 || usage[2].Percent != 0 {
+		t.Fatal(usage)
+	}
+	if str := FormatCPUUsage(usage); str != "cpu 66.7%, cpu0 100.0%, cpu1 0.0%" {
+		t.Fatal(str)
+	}
+	// Without an earlier sample the usage is calculated since boot
+	if usage := CalculateCPUUsage(nil, earlier); usage[0].Percent != 20 {
+		t.Fatal(usage)
+	}
+}
+
+func TestGetCPUUsage(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		// Just make sure the function does not crash
+		GetCPUUsage()
+		return
+	}
+	if usage := GetCPUUsage(); len(usage) < 2 || usage[0].Name != "cpu" {
+		t.Fatal(usage)
+	}
+	if usage := GetCPUUsage(); len(usage) < 2 || usage[0].Percent < 0 || usage[0].Percent > 100 {
+		t.Fatal(usage)
+	}
+}
@@ -0,0 +1,101 @@
+package misc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// SecureEraseBufSize is the size of each chunk of random data written over a file by SecureErase.
+const SecureEraseBufSize = 64 * 1024
+
+// overwriteFile writes random data over the entire content of a file, and then flushes it to disk.
+func overwriteFile(filePath string, size int64) error {
+	fh, err := os.OpenFile(filePath, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, SecureEraseBufSize)
+	for written := int64(0); written < size; {
+		chunk := buf
+		if remaining := size - written; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		if _, err := io.ReadFull(rand.Reader, chunk); err != nil {
+			_ = fh.Close()
+			return err
+		}
+		n, err := fh.Write(chunk)
+		if err != nil {
+			_ = fh.Close()
+			return err
+		}
+		written += int64(n)
+	}
+	if err := fh.Sync(); err != nil {
+		_ = fh.Close()
+		return err
+	}
+	return fh.Close()
+}
+
+/*
+eraseFile overwrites a regular file, renames it to conceal the original name, and then deletes it. The file is deleted
+even if it cannot be overwritten, in which case the overwriting error is returned.
+*/
+func eraseFile(filePath string, info os.FileInfo) error {
+	var overwriteErr error
+	if info.Mode().IsRegular() && info.Size() > 0 {
+		overwriteErr = overwriteFile(filePath, info.Size())
+	}
+	randName := make([]byte, 8)
+	if _, err := rand.Read(randName); err == nil {
+		concealedPath := filepath.Join(filepath.Dir(filePath), hex.EncodeToString(randName))
+		if err := os.Rename(filePath, concealedPath); err == nil {
+			filePath = concealedPath
+		}
+	}
+	removeErr := os.Remove(filePath)
+	if overwriteErr != nil {
+		if removeErr != nil {
+			return fmt.Errorf("failed to overwrite file - %v, and failed to delete it - %v", overwriteErr, removeErr)
+		}
+		return fmt.Errorf("failed to overwrite file before deleting it - %v", overwriteErr)
+	}
+	return removeErr
+}
+
+/*
+SecureErase overwrites the content of a sensitive file with random data before deleting it, which reduces the plain
+text remnants on disk. If the path is a directory, all files underneath are erased before the directory is deleted.
+Symbolic links are deleted without touching their destination. The function does nothing if the path does not exist.
+Be aware that journaling, copy-on-write file systems and flash storage may still retain copies of the original content.
+*/
+func SecureErase(filePath string) error {
+	info, err := os.Lstat(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return eraseFile(filePath, info)
+	}
+	var firstErr error
+	_ = filepath.Walk(filePath, func(thisPath string, thisInfo os.FileInfo, walkErr error) error {
+		if walkErr == nil && !thisInfo.IsDir() {
+			walkErr = eraseFile(thisPath, thisInfo)
+		}
+		if walkErr != nil && firstErr == nil {
+			firstErr = walkErr
+		}
+		return nil
+	})
+	if err := os.RemoveAll(filePath); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
@@ -0,0 +1,74 @@
+package misc
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecureErase(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "laitos-TestSecureErase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	// Non-existent path is not an error
+	if err := SecureErase(filepath.Join(tmpDir, "does-not-exist")); err != nil {
+		t.Fatal(err)
+	}
+	// Erase a file larger than the buffer
+	filePath := filepath.Join(tmpDir, "file")
+	if err := ioutil.WriteFile(filePath, make([]byte, SecureEraseBufSize*2+1), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := overwriteFile(filePath, SecureEraseBufSize*2+1); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := ioutil.ReadFile(filePath); err != nil || len(content) != SecureEraseBufSize*2+1 || string(content) == string(make([]byte, SecureEraseBufSize*2+1)) {
+		t.Fatal("file content was not overwritten", err)
+	}
+	if err := SecureErase(filePath); err != nil {
+		t.Fatal(err)
+	}
+	// Erase a directory tree, leaving the destination of a symbolic link intact.
+	linkDest := filepath.Join(tmpDir, "link-dest")
+	if err := ioutil.WriteFile(linkDest, []byte("keep"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	subDir := filepath.Join(tmpDir, "dir", "sub")
+	if err := os.MkdirAll(subDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(subDir, "a"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(linkDest, filepath.Join(subDir, "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := SecureErase(filepath.Join(tmpDir, "dir")); err != nil {
+		t.Fatal(err)
+	}
+	if entries, err := ioutil.ReadDir(tmpDir); err != nil || len(entries) != 1 || entries[0].Name() != "link-dest" {
+		t.Fatal(entries, err)
+	}
+	if content, err := ioutil.ReadFile(linkDest); err != nil || string(content) != "keep" {
+		t.Fatal(string(content), err)
+	}
+	// The file is deleted even if it cannot be overwritten - a directory in place of the file cannot be opened for writing.
+	info, err := os.Stat(linkDest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notWritable := filepath.Join(tmpDir, "not-writable")
+	if err := os.Mkdir(notWritable, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := eraseFile(notWritable, info); err == nil || !strings.Contains(err.Error(), "failed to overwrite") {
+		t.Fatal(err)
+	}
+	if entries, err := ioutil.ReadDir(tmpDir); err != nil || len(entries) != 1 || entries[0].Name() != "link-dest" {
+		t.Fatal(entries, err)
+	}
+}
@@ -1,57 +1,131 @@
 package misc
 
 import (
+	"bytes"
 	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/HouzuoGuo/laitos/lalog"
 )
 
 var (
-	AutoUnlockStats     = NewStats()
-	CommandStats        = NewStats()
-	DNSDStatsTCP        = NewStats()
-	DNSDStatsUDP        = NewStats()
-	HTTPDStats          = NewStats()
-	PlainSocketStatsTCP = NewStats()
-	PlainSocketStatsUDP = NewStats()
-	SerialDevicesStats  = NewStats()
-	SimpleIPStatsTCP    = NewStats()
-	SimpleIPStatsUDP    = NewStats()
-	SMTPDStats          = NewStats()
-	SNMPStats           = NewStats()
-	SOCKDStatsTCP       = NewStats()
-	SOCKDStatsUDP       = NewStats()
-	TelegramBotStats    = NewStats()
-
 	// OutstandingMailBytes is the total size of all outstanding mails waiting to be delivered.
-	OutstandingMailBytes int64
+	OutstandingMailBytes = lalog.GetGauge("inet.OutstandingMailBytes")
+	// DNSDBlackListSize is the number of domain names and IP addresses blocked by DNS daemon's blacklist.
+	DNSDBlackListSize = lalog.GetGauge("dnsd.BlackListSize")
+	// SOCKDTCPTrafficBytes is the total size of data relayed by TCP connections of sock daemon.
+	SOCKDTCPTrafficBytes = lalog.GetCounter("sockd.TCPTrafficBytes")
+	// SOCKDUDPTrafficBytes is the total size of data relayed by UDP packets of sock daemon.
+	SOCKDUDPTrafficBytes = lalog.GetCounter("sockd.UDPTrafficBytes")
+)
+
+var (
+	allStats      = make(map[string]*Stats)
+	allStatsMutex = new(sync.Mutex)
 )
 
-// GetLatestStats returns statistic information from all front-end daemons in a piece of multi-line, formatted text.
+/*
+GetStats returns the stats registered under the name, the stats is created and registered if it does not yet exist.
+Stats registered this way time the requests and conversations of daemons and handlers in nanoseconds, they appear in the
+plain-text stats report and Prometheus metrics along with the counters and gauges of lalog. Stats live for the entire
+lifetime of the program, callers should retrieve a stats once and keep it.
+*/
+func GetStats(name string) *Stats {
+	allStatsMutex.Lock()
+	defer allStatsMutex.Unlock()
+	stats, exists := allStats[name]
+	if !exists {
+		stats = NewStats()
+		allStats[name] = stats
+	}
+	return stats
+}
+
+// getSortedStatsNames returns the names of all registered stats in sorted order.
+func getSortedStatsNames() []string {
+	allStatsMutex.Lock()
+	defer allStatsMutex.Unlock()
+	names := make([]string, 0, len(allStats))
+	for name := range allStats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/*
+GetLatestStats returns statistic information from all registered stats in a piece of multi-line, formatted text. Each line
+shows lowest/average/highest,total(count) in seconds, followed by the 50th/95th/99th percentiles of the latest triggers and
+the number of triggers per second in the recent window.
+*/
 func GetLatestStats() string {
 	numDecimals := 2
 	factor := 1000000000.0
-	return fmt.Sprintf(`Auto-unlock events        %s
-Commands processed        %s
-DNS server TCP|UDP        %s | %s
-HTTP/S server             %s
-Plain text server TCP|UDP %s | %s
-Serial port devices       %s
-Simple IP servers         %s | %s
-SMTP server:              %s
-SNMP server:              %s
-Sock server TCP|UDP:      %s | %s
-Telegram commands:        %s
-Mail to deliver:          %d KiloBytes
-`,
-		AutoUnlockStats.Format(factor, numDecimals),
-		CommandStats.Format(factor, numDecimals),
-		DNSDStatsTCP.Format(factor, numDecimals), DNSDStatsUDP.Format(factor, numDecimals),
-		HTTPDStats.Format(factor, numDecimals),
-		PlainSocketStatsTCP.Format(factor, numDecimals), PlainSocketStatsUDP.Format(factor, numDecimals),
-		SerialDevicesStats.Format(factor, numDecimals),
-		SimpleIPStatsTCP.Format(factor, numDecimals), SimpleIPStatsUDP.Format(factor, numDecimals),
-		SMTPDStats.Format(factor, numDecimals),
-		SNMPStats.Format(factor, numDecimals),
-		SOCKDStatsTCP.Format(factor, numDecimals), SOCKDStatsUDP.Format(factor, numDecimals),
-		TelegramBotStats.Format(factor, numDecimals),
-		OutstandingMailBytes/1024)
+	var buf bytes.Buffer
+	for _, name := range getSortedStatsNames() {
+		stats := GetStats(name)
+		buf.WriteString(fmt.Sprintf("%-26s %s | %s\n", name, stats.Format(factor, numDecimals), stats.FormatPercentiles(factor, numDecimals)))
+	}
+	buf.WriteString(fmt.Sprintf("%-26s %d KiloBytes\n", "Mail to deliver", OutstandingMailBytes.Value()/1024))
+	return buf.String()
+}
+
+// prometheusMetricName turns a metric name such as "dnsd.BlackListSize" into a valid Prometheus metric name.
+func prometheusMetricName(name string) string {
+	return "laitos_" + strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// writePrometheusValues writes the metric values of a type (counter or gauge) in Prometheus text exposition format.
+func writePrometheusValues(out io.Writer, metricType, suffix string, values map[string]int64) error {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		promName := prometheusMetricName(name) + suffix
+		if _, err := fmt.Fprintf(out, "# TYPE %s %s\n%s %d\n", promName, metricType, promName, values[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+WritePrometheusMetrics writes all lalog counters and gauges, as well as the registered stats, in Prometheus text
+exposition format. Each stats becomes a summary of durations in seconds.
+*/
+func WritePrometheusMetrics(out io.Writer) error {
+	if err := writePrometheusValues(out, "counter", "_total", lalog.GetCounterValues()); err != nil {
+		return err
+	}
+	if err := writePrometheusValues(out, "gauge", "", lalog.GetGaugeValues()); err != nil {
+		return err
+	}
+	for _, name := range getSortedStatsNames() {
+		stats := GetStats(name)
+		promName := prometheusMetricName(name) + "_seconds"
+		percentiles := stats.Percentiles(50, 95, 99)
+		stats.mutex.Lock()
+		count, total := stats.count, stats.total
+		stats.mutex.Unlock()
+		if _, err := fmt.Fprintf(out, "# TYPE %s summary\n%s{quantile=\"0.5\"} %g\n%s{quantile=\"0.95\"} %g\n%s{quantile=\"0.99\"} %g\n%s_sum %g\n%s_count %d\n",
+			promName,
+			promName, percentiles[0]/1e9,
+			promName, percentiles[1]/1e9,
+			promName, percentiles[2]/1e9,
+			promName, total/1e9,
+			promName, count); err != nil {
+			return err
+		}
+	}
+	return nil
 }
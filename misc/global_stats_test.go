@@ -1,15 +1,42 @@
 package misc
 
 import (
+	"bytes"
 	"strings"
 	"testing"
+
+	"github.com/HouzuoGuo/laitos/lalog"
 )
 
 func TestGetLatestStats(t *testing.T) {
+	if GetStats("test.Stats") != GetStats("test.Stats") {
+		t.Fatal("did not return the registered stats")
+	}
 	for i := 0; i < 1928; i++ {
-		AutoUnlockStats.Trigger(1)
+		GetStats("test.Stats").Trigger(1)
 	}
-	if s := GetLatestStats(); !strings.Contains(s, "1928") {
+	if s := GetLatestStats(); !strings.Contains(s, "test.Stats") || !strings.Contains(s, "1928") {
 		t.Fatal(s)
 	}
 }
+
+func TestWritePrometheusMetrics(t *testing.T) {
+	lalog.GetCounter("test.Counter").Add(12)
+	lalog.GetGauge("test.Gauge").Set(34)
+	GetStats("test.Latency").Trigger(2000000000)
+	var buf bytes.Buffer
+	if err := WritePrometheusMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"# TYPE laitos_test_Counter_total counter\nlaitos_test_Counter_total 12\n",
+		"# TYPE laitos_test_Gauge gauge\nlaitos_test_Gauge 34\n",
+		"# TYPE laitos_test_Latency_seconds summary\n",
+		"laitos_test_Latency_seconds{quantile=\"0.99\"} 2\n",
+		"laitos_test_Latency_seconds_sum 2\nlaitos_test_Latency_seconds_count 1\n",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Fatal(expected, buf.String())
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package misc
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HouzuoGuo/laitos/platform"
+)
+
+// NetInterfaceStats is the accumulated traffic counters of a network interface.
+type NetInterfaceStats struct {
+	Name      string // Name is the network interface name, e.g. eth0. On Windows it is "all" for all interfaces combined.
+	RXBytes   uint64
+	RXPackets uint64
+	RXErrors  uint64
+	TXBytes   uint64
+	TXPackets uint64
+	TXErrors  uint64
+}
+
+// NetInterfaceDelta is the change of a network interface's traffic counters over an interval.
+type NetInterfaceDelta struct {
+	NetInterfaceStats               // NetInterfaceStats are the latest accumulated counters.
+	Interval          time.Duration // Interval is the amount of time since the earlier sample, or 0 if there is not one.
+	RXBytesDelta      uint64
+	RXPacketsDelta    uint64
+	RXErrorsDelta     uint64
+	TXBytesDelta      uint64
+	TXPacketsDelta    uint64
+	TXErrorsDelta     uint64
+}
+
+var (
+	// lastNetInterfaceStats is the network interface counters sampled by the previous call to GetNetInterfaceDelta.
+	lastNetInterfaceStats      []NetInterfaceStats
+	lastNetInterfaceStatsTime  time.Time
+	lastNetInterfaceStatsMutex = new(sync.Mutex)
+)
+
+// ParseProcNetDev returns the traffic counters of each network interface from /proc/net/dev content.
+func ParseProcNetDev(content string) (ret []NetInterfaceStats) {
+	ret = make([]NetInterfaceStats, 0, 8)
+	for _, line := range strings.Split(content, "\n") {
+		// Each interface line looks like "eth0: rx-bytes rx-packets rx-errs ... tx-bytes tx-packets tx-errs ..."
+		colon := strings.IndexRune(line, ':')
+		if colon < 1 {
+			continue
+		}
+		fields := strings.Fields(line[colon+1:])
+		if len(fields) < 16 {
+			continue
+		}
+		nums := make([]uint64, 16)
+		for i := range nums {
+			nums[i], _ = strconv.ParseUint(fields[i], 10, 64)
+		}
+		ret = append(ret, NetInterfaceStats{
+			Name:      strings.TrimSpace(line[:colon]),
+			RXBytes:   nums[0],
+			RXPackets: nums[1],
+			RXErrors:  nums[2],
+			TXBytes:   nums[8],
+			TXPackets: nums[9],
+			TXErrors:  nums[10],
+		})
+	}
+	return
+}
+
+/*
+ParseWindowsNetstat returns the traffic counters of all network interfaces combined from the output of "netstat -e".
+Windows does not offer per-interface counters via netstat.
+*/
+func ParseWindowsNetstat(out string) (ret []NetInterfaceStats) {
+	stats := NetInterfaceStats{Name: "all"}
+	found := false
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		rx, rxErr := strconv.ParseUint(fields[len(fields)-2], 10, 64)
+		tx, txErr := strconv.ParseUint(fields[len(fields)-1], 10, 64)
+		if rxErr != nil || txErr != nil {
+			continue
+		}
+		label := strings.ToLower(strings.Join(fields[:len(fields)-2], " "))
+		switch {
+		case label == "bytes":
+			stats.RXBytes, stats.TXBytes = rx, tx
+			found = true
+		case strings.HasSuffix(label, "packets"):
+			// Unicast and non-unicast packets
+			stats.RXPackets += rx
+			stats.TXPackets += tx
+		case label == "errors":
+			stats.RXErrors, stats.TXErrors = rx, tx
+		}
+	}
+	if !found {
+		return []NetInterfaceStats{}
+	}
+	return []NetInterfaceStats{stats}
+}
+
+// GetNetInterfaceStats returns the accumulated traffic counters of network interfaces, or an empty slice upon failure.
+func GetNetInterfaceStats() []NetInterfaceStats {
+	if HostIsWindows() {
+		out, err := platform.InvokeProgram(nil, CommonOSCmdTimeoutSec, "netstat", "-e")
+		if err != nil {
+			return []NetInterfaceStats{}
+		}
+		return ParseWindowsNetstat(out)
+	}
+	content, err := ioutil.ReadFile("/proc/net/dev")
+	if err != nil {
+		return []NetInterfaceStats{}
+	}
+	return ParseProcNetDev(string(content))
+}
+
+/*
+CalculateNetInterfaceDelta returns the change of traffic counters of each network interface between the two samples.
+Interfaces absent from the earlier sample, or whose counters have been reset, are measured since the counters began.
+*/
+func CalculateNetInterfaceDelta(earlier, later []NetInterfaceStats, interval time.Duration) (ret []NetInterfaceDelta) {
+	ret = make([]NetInterfaceDelta, 0, len(later))
+	for _, laterStats := range later {
+		delta := NetInterfaceDelta{
+			NetInterfaceStats: laterStats,
+			RXBytesDelta:      laterStats.RXBytes,
+			RXPacketsDelta:    laterStats.RXPackets,
+			RXErrorsDelta:     laterStats.RXErrors,
+			TXBytesDelta:      laterStats.TXBytes,
+			TXPacketsDelta:    laterStats.TXPackets,
+			TXErrorsDelta:     laterStats.TXErrors,
+		}
+		for _, e := range earlier {
+			if e.Name == laterStats.Name && e.RXBytes <= laterStats.RXBytes && e.TXBytes <= laterStats.TXBytes &&
+				e.RXPackets <= laterStats.RXPackets && e.TXPackets <= laterStats.TXPackets &&
+				e.RXErrors <= laterStats.RXErrors && e.TXErrors <= laterStats.TXErrors {
+				delta.Interval = interval
+				delta.RXBytesDelta -= e.RXBytes
+				delta.RXPacketsDelta -= e.RXPackets
+				delta.RXErrorsDelta -= e.RXErrors
+				delta.TXBytesDelta -= e.TXBytes
+				delta.TXPacketsDelta -= e.TXPackets
+				delta.TXErrorsDelta -= e.TXErrors
+				break
+			}
+		}
+		ret = append(ret, delta)
+	}
+	return
+}
+
+/*
+GetNetInterfaceDelta returns the traffic counters of network interfaces and their change since the previous call of
+this function. Upon the first call, the change is measured since the counters began (usually system boot).
+*/
+func GetNetInterfaceDelta() []NetInterfaceDelta {
+	latest := GetNetInterfaceStats()
+	now := time.Now()
+	lastNetInterfaceStatsMutex.Lock()
+	defer lastNetInterfaceStatsMutex.Unlock()
+	ret := CalculateNetInterfaceDelta(lastNetInterfaceStats, latest, now.Sub(lastNetInterfaceStatsTime))
+	lastNetInterfaceStats = latest
+	lastNetInterfaceStatsTime = now
+	return ret
+}
+
+// FormatNetInterfaceDelta returns the network interface traffic figures in a multi-line text, one interface per line.
+func FormatNetInterfaceDelta(deltas []NetInterfaceDelta) string {
+	var buf bytes.Buffer
+	for _, delta := range deltas {
+		buf.WriteString(fmt.Sprintf("%s RX/TX: %d / %d KB, %d / %d packets, %d / %d errors",
+			delta.Name, delta.RXBytes/1024, delta.TXBytes/1024, delta.RXPackets, delta.TXPackets, delta.RXErrors, delta.TXErrors))
+		if delta.Interval > 0 {
+			buf.WriteString(fmt.Sprintf("; in the past %s: %d / %d KB, %d / %d packets, %d / %d errors",
+				delta.Interval.Round(time.Second).String(), delta.RXBytesDelta/1024, delta.TXBytesDelta/1024,
+				delta.RXPacketsDelta, delta.TXPacketsDelta, delta.RXErrorsDelta, delta.TXErrorsDelta))
+		}
+		buf.WriteRune('\n')
+	}
+	return buf.String()
+}
@@ -0,0 +1,71 @@
+package misc
+
+import (
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseProcNetDev(t *testing.T) {
+	earlier := ParseProcNetDev(`Inter-|   Receive                                                |  Transmit
+ face |bytes    packets errs drop fifo frame compressed multicast|bytes    packets errs drop fifo colls carrier compressed
+    lo: 4096  10    0    0    0     0          0         0 4096  10    0    0    0     0       0          0
+  eth0:  10240    30    1    0    0     0          0         0  20480    40    2    0    0     0       0          0
+`)
+	if len(earlier) != 2 || earlier[1].Name != "eth0" || earlier[1].RXBytes != 10240 || earlier[1].RXPackets != 30 ||
+		earlier[1].RXErrors != 1 || earlier[1].TXBytes != 20480 || earlier[1].TXPackets != 40 || earlier[1].TXErrors != 2 {
+		t.Fatal(earlier)
+	}
+	later := []NetInterfaceStats{
+		{Name: "lo", RXBytes: 1024},
+		{Name: "eth0", RXBytes: 20480, RXPackets: 35, RXErrors: 1, TXBytes: 40960, TXPackets: 50, TXErrors: 2},
+	}
+	deltas := CalculateNetInterfaceDelta(earlier, later, 10*time.Second)
+	// Counters of lo have been reset
+	if deltas[0].Interval != 0 || deltas[0].RXBytesDelta != 1024 {
+		t.Fatal(deltas[0])
+	}
+	if deltas[1].Interval != 10*time.Second || deltas[1].RXBytesDelta != 10240 || deltas[1].RXPacketsDelta != 5 ||
+		deltas[1].TXBytesDelta != 20480 || deltas[1].TXPacketsDelta != 10 || deltas[1].TXErrorsDelta != 0 {
+		t.Fatal(deltas[1])
+	}
+	if str := FormatNetInterfaceDelta(deltas); str != `lo RX/TX: 1 / 0 KB, 0 / 0 packets, 0 / 0 errors
+eth0 RX/TX: 20 / 40 KB, 35 / 50 packets, 1 / 2 errors; in the past 10s: 10 / 20 KB, 5 / 10 packets, 0 / 0 errors
+` {
+		t.Fatal(str)
+	}
+}
+
+func TestParseWindowsNetstat(t *testing.T) {
+	stats := ParseWindowsNetstat(`Interface Statistics
+
+                           Received            Sent
+
+Bytes                    3508204580       353497129
+Unicast packets             3027433         1698424
+Non-unicast packets           12345            1234
+Discards                          0               0
+Errors                            5               6
+Unknown protocols                 0
+`)
+	if len(stats) != 1 || stats[0].RXBytes != 3508204580 || stats[0].TXBytes != 353497129 ||
+		stats[0].RXPackets != 3039778 || stats[0].TXPackets != 1699658 || stats[0].RXErrors != 5 || stats[0].TXErrors != 6 {
+		t.Fatal(stats)
+	}
+	if stats := ParseWindowsNetstat("garbage"); len(stats) != 0 {
+		t.Fatal(stats)
+	}
+}
+
+func TestGetNetInterfaceDelta(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		// Just make sure the function does not crash
+		GetNetInterfaceDelta()
+		return
+	}
+	GetNetInterfaceDelta()
+	if str := FormatNetInterfaceDelta(GetNetInterfaceDelta()); !strings.Contains(str, "lo RX/TX") || !strings.Contains(str, "in the past") {
+		t.Fatal(str)
+	}
+}
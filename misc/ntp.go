@@ -0,0 +1,124 @@
+package misc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// NTPPort is the well-known UDP port number of NTP servers.
+	NTPPort = 123
+	// NTPTimeoutSec is the timeout in seconds of each query made to an NTP server.
+	NTPTimeoutSec = 5
+
+	ntpPacketLen = 48
+	// ntpEpochOffsetSec is the number of seconds between NTP epoch (1900-01-01) and Unix epoch (1970-01-01).
+	ntpEpochOffsetSec = 2208988800
+	// ntpClientRequest is the first byte of a client request: leap indicator 0, version 4, mode 3 (client).
+	ntpClientRequest = 0x23
+	ntpModeServer    = 4
+)
+
+// DefaultNTPServers are the NTP servers queried for clock offset by default.
+var DefaultNTPServers = []string{"pool.ntp.org", "time.google.com", "time.cloudflare.com"}
+
+// NTPResult is the clock offset measured against an NTP server.
+type NTPResult struct {
+	Server  string        // Server is the host name of NTP server.
+	Offset  time.Duration // Offset is the amount of time to add to the local clock for it to agree with the server.
+	RTT     time.Duration // RTT is the round trip delay of the query, excluding the time the server took to respond.
+	Stratum int           // Stratum is the distance of the server from its reference clock.
+}
+
+// toNTPTimestamp encodes the time into a 64-bit NTP timestamp.
+func toNTPTimestamp(t time.Time, buf []byte) {
+	nanos := t.UnixNano()
+	sec := uint64(nanos/int64(time.Second)) + ntpEpochOffsetSec
+	frac := (uint64(nanos%int64(time.Second)) << 32) / uint64(time.Second)
+	binary.BigEndian.PutUint64(buf, sec<<32|frac)
+}
+
+// fromNTPTimestamp decodes a 64-bit NTP timestamp.
+func fromNTPTimestamp(buf []byte) time.Time {
+	val := binary.BigEndian.Uint64(buf)
+	sec, frac := int64(val>>32)-ntpEpochOffsetSec, int64(((val&0xffffffff)*uint64(time.Second))>>32)
+	return time.Unix(sec, frac)
+}
+
+/*
+QueryNTP sends a query to the NTP server (host name or host:port) and measures the offset of the local clock against
+the server's clock.
+*/
+func QueryNTP(server string, timeoutSec int) (result NTPResult, err error) {
+	result.Server = server
+	addr := server
+	if _, _, splitErr := net.SplitHostPort(server); splitErr != nil {
+		addr = net.JoinHostPort(server, strconv.Itoa(NTPPort))
+	}
+	conn, err := net.DialTimeout("udp", addr, time.Duration(timeoutSec)*time.Second)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(time.Duration(timeoutSec) * time.Second)); err != nil {
+		return
+	}
+	req := make([]byte, ntpPacketLen)
+	req[0] = ntpClientRequest
+	sendTime := time.Now()
+	// The server copies the transmit timestamp of the request into the originate timestamp of its response
+	toNTPTimestamp(sendTime, req[40:48])
+	if _, err = conn.Write(req); err != nil {
+		return
+	}
+	resp := make([]byte, ntpPacketLen)
+	n, err := conn.Read(resp)
+	recvTime := time.Now()
+	if err != nil {
+		return
+	}
+	if n < ntpPacketLen || resp[0]&0x7 != ntpModeServer || string(resp[24:32]) != string(req[40:48]) {
+		err = errors.New("QueryNTP: malformed or unexpected response")
+		return
+	}
+	result.Stratum = int(resp[1])
+	if result.Stratum == 0 {
+		err = fmt.Errorf("QueryNTP: server refused to serve the query (kiss code %q)", string(resp[12:16]))
+		return
+	}
+	// The monotonic clock readings are preferred for measuring the local elapsed time
+	serverRecvTime, serverSendTime := fromNTPTimestamp(resp[32:40]), fromNTPTimestamp(resp[40:48])
+	result.Offset = (serverRecvTime.Sub(sendTime.Round(0)) + serverSendTime.Sub(recvTime.Round(0))) / 2
+	result.RTT = recvTime.Sub(sendTime) - serverSendTime.Sub(serverRecvTime)
+	return
+}
+
+/*
+GetClockOffset queries all of the NTP servers and returns the result from the server with the shortest round trip delay,
+which is usually the most accurate measurement. An error is returned only if none of the servers responded.
+*/
+func GetClockOffset(servers []string, timeoutSec int) (best NTPResult, err error) {
+	if len(servers) == 0 {
+		servers = DefaultNTPServers
+	}
+	found := false
+	for _, server := range servers {
+		result, queryErr := QueryNTP(server, timeoutSec)
+		if queryErr != nil {
+			err = queryErr
+			continue
+		}
+		if !found || result.RTT < best.RTT {
+			best = result
+			found = true
+		}
+	}
+	if found {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,55 @@
+package misc
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestNTPTimestamp(t *testing.T) {
+	buf := make([]byte, 8)
+	now := time.Now()
+	toNTPTimestamp(now, buf)
+	if diff := fromNTPTimestamp(buf).Sub(now); diff > time.Microsecond || diff < -time.Microsecond {
+		t.Fatal(diff)
+	}
+}
+
+func TestQueryNTP(t *testing.T) {
+	// Serve NTP queries with a clock that is an hour ahead
+	serverConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer serverConn.Close()
+	go func() {
+		req := make([]byte, ntpPacketLen)
+		for {
+			_, client, err := serverConn.ReadFrom(req)
+			if err != nil {
+				return
+			}
+			resp := make([]byte, ntpPacketLen)
+			resp[0] = 0x24
+			resp[1] = 2
+			copy(resp[24:32], req[40:48])
+			toNTPTimestamp(time.Now().Add(time.Hour), resp[32:40])
+			toNTPTimestamp(time.Now().Add(time.Hour), resp[40:48])
+			_, _ = serverConn.WriteTo(resp, client)
+		}
+	}()
+	result, err := QueryNTP(serverConn.LocalAddr().String(), 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Stratum != 2 || result.Offset < time.Hour-time.Second || result.Offset > time.Hour+time.Second || result.RTT > time.Second {
+		t.Fatalf("%+v", result)
+	}
+	// The responsive server is picked over the unresponsive one
+	if result, err := GetClockOffset([]string{"127.0.0.1:1", serverConn.LocalAddr().String()}, 1); err != nil || result.Server != serverConn.LocalAddr().String() {
+		t.Fatal(result, err)
+	}
+	if _, err := GetClockOffset([]string{"127.0.0.1:1"}, 1); err == nil {
+		t.Fatal("should have failed")
+	}
+}
@@ -2,9 +2,12 @@ package misc
 
 import (
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/HouzuoGuo/laitos/lalog"
@@ -34,10 +37,87 @@ var (
 	*/
 	ProgramDataDecryptionPasswordInput = make(chan string)
 
+	// SupervisorStatusEnvName is the environment variable that carries the supervisor's restart history to the main program.
+	SupervisorStatusEnvName = "LAITOS_SUPERVISOR_STATUS"
+	/*
+		SupervisorKeyFDEnvName is the environment variable that carries the file descriptor of a pipe to the supervisor,
+		the main program writes the new program data decryption password into the pipe after re-encrypting program data.
+	*/
+	SupervisorKeyFDEnvName = "LAITOS_SUPERVISOR_KEY_FD"
+
+	/*
+		DaemonRestarter is installed by the main program to re-initialise an individual daemon from the latest content of
+		configuration file, without interrupting the other daemons.
+	*/
+	DaemonRestarter func(daemonName string) error
+	/*
+		ConfigReloader is installed by the main program to apply the latest content of configuration file to the running
+		daemons. It returns a summary of applied changes and changes that require a program restart.
+	*/
+	ConfigReloader func() (string, error)
+	/*
+		DNSCachePurger is installed by the DNS daemon to remove all responses from its cache. It returns the number of
+		responses removed.
+	*/
+	DNSCachePurger func() int
+	/*
+		DNSQueryLogReader is installed by the DNS daemon to retrieve the most recent queries made by a client IP (or all
+		clients if it is empty) from its query log.
+	*/
+	DNSQueryLogReader func(clientIP string) (string, error)
+	/*
+		DNSForwarderStatsReader is installed by the DNS daemon to retrieve the health, latency, and number of successful
+		and failed queries of each of its forwarders.
+	*/
+	DNSForwarderStatsReader func() string
+
+	// supervisorKeyPipe is the pipe that carries the new program data decryption password to the supervisor.
+	supervisorKeyPipe     *os.File
+	supervisorKeyPipeOnce = new(sync.Once)
+
 	// logger is used by some of the miscellaneous actions affecting laitos process globally.
 	logger = lalog.Logger{ComponentName: "misc", ComponentID: []lalog.LoggerIDField{{Key: "PID", Value: os.Getpid()}}}
 )
 
+/*
+TellSupervisorNewPassword gives the new program data decryption password to the supervisor of this program, so that
+the supervisor uses the new password to start this program after a crash or restart. The function does nothing if this
+program is not supervised, and returns an error if it is supervised but cannot reach the supervisor.
+*/
+func TellSupervisorNewPassword(newPassword string) error {
+	if os.Getenv(SupervisorStatusEnvName) == "" {
+		return nil
+	}
+	// The pipe is opened once and kept open, as the file is closed when it is garbage collected.
+	supervisorKeyPipeOnce.Do(func() {
+		if fd, err := strconv.Atoi(os.Getenv(SupervisorKeyFDEnvName)); err == nil && fd > 2 {
+			supervisorKeyPipe = os.NewFile(uintptr(fd), "supervisor-key")
+		}
+	})
+	if supervisorKeyPipe == nil {
+		return errors.New("the supervisor does not accept a new password")
+	}
+	if _, err := supervisorKeyPipe.Write([]byte(newPassword + "\n")); err != nil {
+		return fmt.Errorf("failed to give the new password to supervisor - %v", err)
+	}
+	return nil
+}
+
+/*
+ReadConfigFile reads the latest content of configuration file that was used to launch this program. If the file is
+encrypted, it is decrypted using the program data decryption password.
+*/
+func ReadConfigFile() ([]byte, error) {
+	if ConfigFilePath == "" {
+		return nil, errors.New("ReadConfigFile: the program was not launched with a configuration file")
+	}
+	content, isEncrypted, err := IsEncrypted(ConfigFilePath)
+	if err != nil || !isEncrypted {
+		return content, err
+	}
+	return Decrypt(ConfigFilePath, ProgramDataDecryptionPassword)
+}
+
 /*
 TriggerEmergencyLockDown turns on EmergencyLockDown flag, so that features and daemons will immediately (or very soon)
 stop functioning or refuse to serve more requests. The program process will keep running (i.e. not going to crash).
@@ -1,37 +1,138 @@
 package misc
 
 import (
+	"math"
+	"net"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/HouzuoGuo/laitos/lalog"
 )
 
+const (
+	/*
+		RateLimitFixedWindow is the default rate limit algorithm. It counts the hits of each actor and resets all
+		counters to zero at regular interval, which may block an actor's legitimate burst of hits if it happens towards
+		the end of an interval.
+	*/
+	RateLimitFixedWindow = "fixed-window"
+	/*
+		RateLimitTokenBucket gives each actor a bucket of Burst tokens (MaxCount by default), each hit consumes a token
+		and the tokens refill at the rate of MaxCount per UnitSecs.
+	*/
+	RateLimitTokenBucket = "token-bucket"
+	/*
+		RateLimitSlidingWindow estimates the number of hits made by an actor during the latest UnitSecs by weighing the
+		counter of the previous interval against the counter of the current interval.
+	*/
+	RateLimitSlidingWindow = "sliding-window"
+
+	// GlobalRateLimitActor is the actor name under which a rate limit counts the hits from all sources combined.
+	GlobalRateLimitActor = "(all clients)"
+
+	// RateLimitMinSweepIntervalSec is the minimum interval at which token bucket and sliding window limits forget idle actors.
+	RateLimitMinSweepIntervalSec = 60
+)
+
+// tokenBucket is the state of an actor under token bucket rate limit.
+type tokenBucket struct {
+	tokens     float64
+	lastRefill time.Time
+}
+
+// networkRateLimit is the rate limit of the actors whose IP address is in the network, a nil limit exempts them.
+type networkRateLimit struct {
+	network *net.IPNet
+	limit   *RateLimit
+}
+
+// slidingWindow is the state of an actor under sliding window rate limit.
+type slidingWindow struct {
+	windowStart  time.Time
+	currentCount int
+	prevCount    int
+}
+
 /*
 RateLimit tracks number of hits performed by each source ("actor") to determine whether a source has exceeded
-specified rate limit. Instead of being a rolling counter, the tracking data is reset to empty at regular interval.
+specified rate limit. The algorithm is fixed window by default, in which the tracking data is reset to empty at regular
+interval; token bucket and sliding window algorithms track each actor continuously and forget idle actors periodically.
 Remember to call Initialise() before use!
 */
 type RateLimit struct {
-	UnitSecs      int64
-	MaxCount      int
+	UnitSecs int64
+	MaxCount int
+	// Algorithm is one of RateLimitFixedWindow (default), RateLimitTokenBucket, or RateLimitSlidingWindow.
+	Algorithm string
+	// Burst is the maximum number of hits an actor may make in quick succession under token bucket algorithm, it defaults to MaxCount.
+	Burst int
+	/*
+		Overrides are the limits (hits per UnitSecs) of the actors whose IP address is in the network of CIDR notation
+		(e.g. "192.168.0.0/16"), they take precedence over MaxCount and the smallest matching network wins. The burst of
+		each override is proportional to its limit. A limit of 0 exempts the actors from rate limit.
+	*/
+	Overrides map[string]int
+
 	Logger        lalog.Logger
 	lastTimestamp int64
 	counter       map[string]int
+	buckets       map[string]*tokenBucket
+	windows       map[string]*slidingWindow
+	lastSweep     time.Time
 	logged        map[string]struct{}
 	counterMutex  *sync.Mutex
+	// overrideLimits are the rate limits made from Overrides, ordered from the smallest network to the largest.
+	overrideLimits []networkRateLimit
 }
 
 // Initialise rate limiter internal states.
 func (limit *RateLimit) Initialise() {
 	limit.counter = make(map[string]int)
+	limit.buckets = make(map[string]*tokenBucket)
+	limit.windows = make(map[string]*slidingWindow)
+	limit.logged = make(map[string]struct{})
+	limit.lastSweep = time.Now()
 	limit.counterMutex = new(sync.Mutex)
 	if limit.UnitSecs < 1 || limit.MaxCount < 1 {
 		limit.Logger.Panic("Initialise", "RateLimit", nil, "UnitSecs and MaxCount must be greater than 0")
 		return
 	}
+	switch limit.Algorithm {
+	case "":
+		limit.Algorithm = RateLimitFixedWindow
+	case RateLimitFixedWindow, RateLimitTokenBucket, RateLimitSlidingWindow:
+	default:
+		limit.Logger.Panic("Initialise", "RateLimit", nil, "unknown rate limit algorithm \"%s\"", limit.Algorithm)
+		return
+	}
+	limit.overrideLimits = make([]networkRateLimit, 0, len(limit.Overrides))
+	for cidr, maxCount := range limit.Overrides {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			limit.Logger.Panic("Initialise", "RateLimit", err, "failed to parse the network of override \"%s\"", cidr)
+			return
+		}
+		override := networkRateLimit{network: network}
+		if maxCount > 0 {
+			override.limit = &RateLimit{UnitSecs: limit.UnitSecs, MaxCount: maxCount, Algorithm: limit.Algorithm, Logger: limit.Logger}
+			if limit.Burst > 0 {
+				override.limit.Burst = limit.Burst * maxCount / limit.MaxCount
+			}
+			override.limit.Initialise()
+		}
+		limit.overrideLimits = append(limit.overrideLimits, override)
+	}
+	sort.Slice(limit.overrideLimits, func(i, j int) bool {
+		iOnes, _ := limit.overrideLimits[i].network.Mask.Size()
+		jOnes, _ := limit.overrideLimits[j].network.Mask.Size()
+		return iOnes > jOnes
+	})
+	if limit.Burst < 1 {
+		limit.Burst = limit.MaxCount
+	}
 	// Turn per-second limit into greater limit over multiple seconds to reduce log spamming
-	if limit.UnitSecs == 1 {
+	if limit.UnitSecs == 1 && limit.Algorithm == RateLimitFixedWindow {
 		for _, factor := range []int{11, 7, 5, 3, 2} {
 			if limit.MaxCount%factor == 0 {
 				limit.UnitSecs = int64(factor)
@@ -44,27 +145,135 @@ func (limit *RateLimit) Initialise() {
 
 // Increase counter of the actor by one. If the counter exceeds max limit, return false, otherwise return true.
 func (limit *RateLimit) Add(actor string, logIfLimitHit bool) bool {
+	// The overrides do not change after initialisation, hence they are looked up without locking the mutex.
+	if len(limit.overrideLimits) > 0 {
+		if ip := net.ParseIP(actor); ip != nil {
+			for _, override := range limit.overrideLimits {
+				if override.network.Contains(ip) {
+					return override.limit == nil || override.limit.Add(actor, logIfLimitHit)
+				}
+			}
+		}
+	}
 	limit.counterMutex.Lock()
+	defer limit.counterMutex.Unlock()
+	now := time.Now()
+	var allowed bool
+	switch limit.Algorithm {
+	case RateLimitTokenBucket:
+		allowed = limit.addTokenBucket(actor, now)
+	case RateLimitSlidingWindow:
+		allowed = limit.addSlidingWindow(actor, now)
+	default:
+		allowed = limit.addFixedWindow(actor, now)
+	}
+	if limit.Algorithm != RateLimitFixedWindow {
+		limit.sweep(now)
+	}
+	if !allowed {
+		// Count the rejected hits among metrics of the component that uses the rate limit
+		limit.Logger.Counter("RateLimitHits").Increment()
+		if _, hasLogged := limit.logged[actor]; !hasLogged && logIfLimitHit {
+			limit.Logger.Warning("Add", "RateLimit", nil, "%s exceeded limit of %d hits per %d seconds", actor, limit.MaxCount, limit.UnitSecs)
+			limit.logged[actor] = struct{}{}
+		}
+	}
+	return allowed
+}
+
+// addFixedWindow counts a hit of the actor in the current interval, and returns true if the actor is within the limit.
+func (limit *RateLimit) addFixedWindow(actor string, now time.Time) bool {
 	// Reset all counters if unit of time has past
-	if now := time.Now().Unix(); now-limit.lastTimestamp >= limit.UnitSecs {
+	if nowSec := now.Unix(); nowSec-limit.lastTimestamp >= limit.UnitSecs {
 		limit.counter = make(map[string]int)
 		limit.logged = make(map[string]struct{})
-		limit.lastTimestamp = now
+		limit.lastTimestamp = nowSec
 	}
-	if count, exists := limit.counter[actor]; exists {
-		if count >= limit.MaxCount {
-			if _, hasLogged := limit.logged[actor]; !hasLogged && logIfLimitHit {
-				limit.Logger.Warning("Add", "RateLimit", nil, "%s exceeded limit of %d hits per %d seconds", actor, limit.MaxCount, limit.UnitSecs)
-				limit.logged[actor] = struct{}{}
-			}
-			limit.counterMutex.Unlock()
-			return false
-		} else {
-			limit.counter[actor] = count + 1
-		}
-	} else {
-		limit.counter[actor] = 1
+	if count := limit.counter[actor]; count >= limit.MaxCount {
+		return false
+	}
+	limit.counter[actor]++
+	return true
+}
+
+// addTokenBucket takes a token from the actor's bucket, and returns true if the bucket had a token to give.
+func (limit *RateLimit) addTokenBucket(actor string, now time.Time) bool {
+	bucket, exists := limit.buckets[actor]
+	if !exists {
+		bucket = &tokenBucket{tokens: float64(limit.Burst), lastRefill: now}
+		limit.buckets[actor] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.lastRefill).Seconds() * float64(limit.MaxCount) / float64(limit.UnitSecs)
+	if bucket.tokens > float64(limit.Burst) {
+		bucket.tokens = float64(limit.Burst)
+	}
+	bucket.lastRefill = now
+	if bucket.tokens < 1 {
+		return false
 	}
-	limit.counterMutex.Unlock()
+	bucket.tokens--
 	return true
 }
+
+// addSlidingWindow counts a hit of the actor, and returns true if the estimated hits during the latest interval are within the limit.
+func (limit *RateLimit) addSlidingWindow(actor string, now time.Time) bool {
+	unit := time.Duration(limit.UnitSecs) * time.Second
+	window, exists := limit.windows[actor]
+	if !exists {
+		window = &slidingWindow{windowStart: now}
+		limit.windows[actor] = window
+	}
+	if elapsed := now.Sub(window.windowStart); elapsed >= 2*unit {
+		// The actor has been idle for the entire previous interval
+		window.prevCount, window.currentCount = 0, 0
+		window.windowStart = now
+	} else if elapsed >= unit {
+		window.prevCount, window.currentCount = window.currentCount, 0
+		window.windowStart = window.windowStart.Add(unit)
+	}
+	// Round up the weighted hits of the previous interval to err on the safe side
+	prevWeight := 1 - float64(now.Sub(window.windowStart))/float64(unit)
+	if int(math.Ceil(float64(window.prevCount)*prevWeight))+window.currentCount >= limit.MaxCount {
+		return false
+	}
+	window.currentCount++
+	return true
+}
+
+// sweep forgets the actors who have been idle long enough for their state to be as good as new.
+func (limit *RateLimit) sweep(now time.Time) {
+	interval := time.Duration(limit.UnitSecs) * time.Second
+	if interval < RateLimitMinSweepIntervalSec*time.Second {
+		interval = RateLimitMinSweepIntervalSec * time.Second
+	}
+	if now.Sub(limit.lastSweep) < interval {
+		return
+	}
+	limit.lastSweep = now
+	fullRefill := time.Duration(float64(limit.Burst) / float64(limit.MaxCount) * float64(limit.UnitSecs) * float64(time.Second))
+	for actor, bucket := range limit.buckets {
+		if now.Sub(bucket.lastRefill) >= fullRefill {
+			delete(limit.buckets, actor)
+			delete(limit.logged, actor)
+		}
+	}
+	for actor, window := range limit.windows {
+		if now.Sub(window.windowStart) >= 2*time.Duration(limit.UnitSecs)*time.Second {
+			delete(limit.windows, actor)
+			delete(limit.logged, actor)
+		}
+	}
+}
+
+// NumActors returns the number of actors whose hits are being tracked.
+func (limit *RateLimit) NumActors() int {
+	num := 0
+	for _, override := range limit.overrideLimits {
+		if override.limit != nil {
+			num += override.limit.NumActors()
+		}
+	}
+	limit.counterMutex.Lock()
+	defer limit.counterMutex.Unlock()
+	return num + len(limit.counter) + len(limit.buckets) + len(limit.windows)
+}
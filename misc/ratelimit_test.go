@@ -66,3 +66,133 @@ func TestRateLimit(t *testing.T) {
 		}
 	}
 }
+
+func TestRateLimit_TokenBucket(t *testing.T) {
+	limit := RateLimit{UnitSecs: 1, MaxCount: 10, Burst: 3, Algorithm: RateLimitTokenBucket}
+	limit.Initialise()
+	if limit.UnitSecs != 1 || limit.MaxCount != 10 {
+		t.Fatalf("%+v", limit)
+	}
+	// The burst is allowed right away, further hits have to wait for refill.
+	for i := 0; i < 3; i++ {
+		if !limit.Add("a", true) {
+			t.Fatal(i)
+		}
+	}
+	if limit.Add("a", true) {
+		t.Fatal("should have hit limit")
+	}
+	if !limit.Add("b", true) {
+		t.Fatal("another actor should not be affected")
+	}
+	// A token refills every 100 milliseconds
+	time.Sleep(250 * time.Millisecond)
+	if !limit.Add("a", true) || !limit.Add("a", true) || limit.Add("a", true) {
+		t.Fatal("should have refilled two tokens")
+	}
+	// Idle actors are forgotten by the sweep
+	if limit.NumActors() != 2 {
+		t.Fatal(limit.NumActors())
+	}
+	limit.counterMutex.Lock()
+	limit.lastSweep = time.Now().Add(-RateLimitMinSweepIntervalSec * time.Second)
+	limit.buckets["b"].lastRefill = time.Now().Add(-time.Second)
+	limit.counterMutex.Unlock()
+	limit.Add("a", true)
+	if limit.NumActors() != 1 {
+		t.Fatal(limit.NumActors())
+	}
+}
+
+func TestRateLimit_SlidingWindow(t *testing.T) {
+	limit := RateLimit{UnitSecs: 2, MaxCount: 4, Algorithm: RateLimitSlidingWindow}
+	limit.Initialise()
+	for i := 0; i < 4; i++ {
+		if !limit.Add("a", true) {
+			t.Fatal(i)
+		}
+	}
+	if limit.Add("a", true) {
+		t.Fatal("should have hit limit")
+	}
+	/*
+		Half way through the next interval, the previous interval's 4 hits weigh as 2, hence 2 more hits are allowed.
+		Unlike fixed window, the actor does not get a fresh allowance of 4 hits right after the interval.
+	*/
+	limit.counterMutex.Lock()
+	limit.windows["a"].windowStart = time.Now().Add(-3 * time.Second)
+	limit.counterMutex.Unlock()
+	if !limit.Add("a", true) || !limit.Add("a", true) || limit.Add("a", true) {
+		t.Fatal("should have allowed exactly two hits")
+	}
+	// Idle actors are forgotten by the sweep
+	limit.counterMutex.Lock()
+	limit.lastSweep = time.Now().Add(-RateLimitMinSweepIntervalSec * time.Second)
+	limit.windows["a"].windowStart = time.Now().Add(-4 * time.Second)
+	limit.counterMutex.Unlock()
+	if !limit.Add("b", true) || limit.NumActors() != 1 {
+		t.Fatal(limit.NumActors())
+	}
+}
+
+func TestRateLimit_Overrides(t *testing.T) {
+	limit := RateLimit{UnitSecs: 1, MaxCount: 2, Burst: 4, Algorithm: RateLimitTokenBucket, Overrides: map[string]int{
+		"192.168.0.0/16": 0,
+		"192.168.1.0/24": 10,
+		"2001:db8::/32":  0,
+	}}
+	limit.Initialise()
+	// Actors without an override get the default burst
+	for i := 0; i < 4; i++ {
+		if !limit.Add("10.0.0.1", true) {
+			t.Fatal(i)
+		}
+	}
+	if limit.Add("10.0.0.1", true) {
+		t.Fatal("should have hit limit")
+	}
+	// The smallest network wins, its burst is proportional to its limit.
+	for i := 0; i < 20; i++ {
+		if !limit.Add("192.168.1.1", true) {
+			t.Fatal(i)
+		}
+	}
+	if limit.Add("192.168.1.1", true) {
+		t.Fatal("should have hit limit")
+	}
+	// Exempted actors are never limited
+	for i := 0; i < 100; i++ {
+		if !limit.Add("192.168.2.1", true) || !limit.Add("2001:db8::1", true) {
+			t.Fatal(i)
+		}
+	}
+	// An address outside of the networks gets the default limit
+	for i := 0; i < 4; i++ {
+		if !limit.Add("192.16.1.1", true) {
+			t.Fatal(i)
+		}
+	}
+	if limit.Add("192.16.1.1", true) {
+		t.Fatal("should have hit limit")
+	}
+	// Actors that are not IP addresses get the default limit
+	for i := 0; i < 4; i++ {
+		if !limit.Add(GlobalRateLimitActor, true) {
+			t.Fatal(i)
+		}
+	}
+	if limit.Add(GlobalRateLimitActor, true) {
+		t.Fatal("should have hit limit")
+	}
+	if limit.NumActors() != 4 {
+		t.Fatal(limit.NumActors())
+	}
+	// Overrides must be networks in CIDR notation
+	defer func() {
+		if recover() == nil {
+			t.Fatal("did not panic")
+		}
+	}()
+	malformed := RateLimit{UnitSecs: 1, MaxCount: 2, Overrides: map[string]int{"192.168.": 0}}
+	malformed.Initialise()
+}
@@ -0,0 +1,147 @@
+package misc
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// HwmonRoot is the sysfs directory where Linux kernel exposes hardware monitoring chips and their sensors.
+var HwmonRoot = "/sys/class/hwmon"
+
+// RegexHwmonInput parses sensor type and index from the name of a sensor's input file, e.g. "temp1_input".
+var RegexHwmonInput = regexp.MustCompile(`^(temp|fan|in)(\d+)_input$`)
+
+// SensorReading is the latest reading of a hardware sensor.
+type SensorReading struct {
+	Chip  string  // Chip is the name of the hardware monitoring chip, e.g. "coretemp".
+	Label string  // Label is the sensor label given by the driver (e.g. "Core 0"), or the input name (e.g. "temp1").
+	Type  string  // Type is "temp", "fan", or "in" (voltage).
+	Value float64 // Value is in degree Celsius for temperature, RPM for fan, and volt for voltage.
+	// Max is the temperature at or above which the hardware is considered to be too hot, or 0 if it is unknown.
+	Max float64
+}
+
+// Unit returns the measurement unit of the sensor reading.
+func (reading SensorReading) Unit() string {
+	switch reading.Type {
+	case "temp":
+		return "C"
+	case "fan":
+		return "RPM"
+	case "in":
+		return "V"
+	}
+	return ""
+}
+
+// readSysfsNum reads a number from a sysfs file, it returns false if the file is absent or does not contain a number.
+func readSysfsNum(filePath string) (float64, bool) {
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return 0, false
+	}
+	val, err := strconv.ParseFloat(strings.TrimSpace(string(content)), 64)
+	if err != nil {
+		return 0, false
+	}
+	return val, true
+}
+
+/*
+GetHardwareSensors returns the latest readings of temperature, fan, and voltage sensors exposed by Linux hwmon sysfs.
+It returns an empty slice if the system does not have any sensor (e.g. virtual machines) or the platform is not Linux.
+*/
+func GetHardwareSensors() (ret []SensorReading) {
+	ret = make([]SensorReading, 0, 16)
+	chipDirs, err := ioutil.ReadDir(HwmonRoot)
+	if err != nil {
+		return
+	}
+	for _, chipDir := range chipDirs {
+		chipPath := path.Join(HwmonRoot, chipDir.Name())
+		chipName := chipDir.Name()
+		if name, err := ioutil.ReadFile(path.Join(chipPath, "name")); err == nil {
+			chipName = strings.TrimSpace(string(name))
+		}
+		sensorFiles, err := ioutil.ReadDir(chipPath)
+		if err != nil {
+			continue
+		}
+		for _, sensorFile := range sensorFiles {
+			match := RegexHwmonInput.FindStringSubmatch(sensorFile.Name())
+			if match == nil {
+				continue
+			}
+			prefix := match[1] + match[2]
+			val, ok := readSysfsNum(path.Join(chipPath, sensorFile.Name()))
+			if !ok {
+				continue
+			}
+			reading := SensorReading{Chip: chipName, Label: prefix, Type: match[1], Value: val}
+			if label, err := ioutil.ReadFile(path.Join(chipPath, prefix+"_label")); err == nil {
+				reading.Label = strings.TrimSpace(string(label))
+			}
+			switch reading.Type {
+			case "temp":
+				// Temperature is in milli-degree Celsius, the critical threshold takes precedence over the maximum.
+				reading.Value /= 1000
+				if crit, ok := readSysfsNum(path.Join(chipPath, prefix+"_crit")); ok && crit > 0 {
+					reading.Max = crit / 1000
+				} else if max, ok := readSysfsNum(path.Join(chipPath, prefix+"_max")); ok && max > 0 {
+					reading.Max = max / 1000
+				}
+			case "in":
+				// Voltage is in milli-volt
+				reading.Value /= 1000
+			}
+			ret = append(ret, reading)
+		}
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		if ret[i].Chip != ret[j].Chip {
+			return ret[i].Chip < ret[j].Chip
+		}
+		return ret[i].Label < ret[j].Label
+	})
+	return
+}
+
+/*
+GetOverheatingSensors returns the temperature sensors whose reading is at or above the limit. If limit is 0, then
+each sensor's own critical/maximum threshold is used instead.
+*/
+func GetOverheatingSensors(readings []SensorReading, limitCelsius float64) (ret []SensorReading) {
+	ret = make([]SensorReading, 0)
+	for _, reading := range readings {
+		if reading.Type != "temp" {
+			continue
+		}
+		limit := limitCelsius
+		if limit <= 0 {
+			limit = reading.Max
+		}
+		if limit > 0 && reading.Value >= limit {
+			ret = append(ret, reading)
+		}
+	}
+	return
+}
+
+// FormatSensorReadings returns the sensor readings in a multi-line text, one sensor per line.
+func FormatSensorReadings(readings []SensorReading) string {
+	var buf bytes.Buffer
+	for _, reading := range readings {
+		buf.WriteString(fmt.Sprintf("%s %s: %.1f %s", reading.Chip, reading.Label, reading.Value, reading.Unit()))
+		if reading.Max > 0 {
+			buf.WriteString(fmt.Sprintf(" (max %.1f %s)", reading.Max, reading.Unit()))
+		}
+		buf.WriteRune('\n')
+	}
+	return buf.String()
+}
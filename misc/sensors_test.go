@@ -0,0 +1,58 @@
+package misc
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestGetHardwareSensors(t *testing.T) {
+	origRoot := HwmonRoot
+	defer func() {
+		HwmonRoot = origRoot
+	}()
+	tmpDir, err := ioutil.TempDir("", "laitos-TestGetHardwareSensors")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	HwmonRoot = path.Join(tmpDir, "does-not-exist")
+	if readings := GetHardwareSensors(); len(readings) != 0 {
+		t.Fatal(readings)
+	}
+
+	HwmonRoot = tmpDir
+	for name, content := range map[string]string{
+		"hwmon0/name":        "coretemp\n",
+		"hwmon0/temp1_input": "45000\n",
+		"hwmon0/temp1_label": "Core 0\n",
+		"hwmon0/temp1_crit":  "100000\n",
+		"hwmon0/temp2_input": "101000\n",
+		"hwmon0/temp2_max":   "90000\n",
+		"hwmon1/fan1_input":  "1200\n",
+		"hwmon1/in0_input":   "1250\n",
+		"hwmon1/in0_min":     "1000\n",
+	} {
+		if err := os.MkdirAll(path.Dir(path.Join(tmpDir, name)), 0700); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path.Join(tmpDir, name), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readings := GetHardwareSensors()
+	if str := FormatSensorReadings(readings); str != `coretemp Core 0: 45.0 C (max 100.0 C)
+coretemp temp2: 101.0 C (max 90.0 C)
+hwmon1 fan1: 1200.0 RPM
+hwmon1 in0: 1.2 V
+` {
+		t.Fatal(str)
+	}
+	if hot := GetOverheatingSensors(readings, 0); len(hot) != 1 || hot[0].Label != "temp2" {
+		t.Fatal(hot)
+	}
+	if hot := GetOverheatingSensors(readings, 40); len(hot) != 2 {
+		t.Fatal(hot)
+	}
+}
@@ -0,0 +1,136 @@
+package misc
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// MaxShamirShares is the maximum number of shares a secret may be split into, limited by the size of GF(256).
+const MaxShamirShares = 255
+
+// ErrMalformedShamirShare is returned when a share cannot be decoded.
+var ErrMalformedShamirShare = errors.New("malformed secret share")
+
+// gf256Mul multiplies two elements of GF(256) using the AES reduction polynomial x^8 + x^4 + x^3 + x + 1.
+func gf256Mul(a, b byte) (product byte) {
+	for b > 0 {
+		if b&1 == 1 {
+			product ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return
+}
+
+// gf256Inv returns the multiplicative inverse of a non-zero element of GF(256), which is a^254.
+func gf256Inv(a byte) byte {
+	inv := byte(1)
+	for i := 0; i < 254; i++ {
+		inv = gf256Mul(inv, a)
+	}
+	return inv
+}
+
+/*
+ShamirSplit splits the secret into N shares using Shamir's secret sharing, any K (threshold) of which are able to
+reconstruct the secret, whereas fewer than K shares reveal nothing about it. Each share is a hex string that begins with
+the share's index.
+*/
+func ShamirSplit(secret []byte, numShares, threshold int) ([]string, error) {
+	if len(secret) == 0 {
+		return nil, errors.New("ShamirSplit: the secret must not be empty")
+	}
+	if threshold < 2 || threshold > numShares || numShares > MaxShamirShares {
+		return nil, fmt.Errorf("ShamirSplit: the threshold must be between 2 and the number of shares, which is at most %d", MaxShamirShares)
+	}
+	shares := make([][]byte, numShares)
+	for i := range shares {
+		shares[i] = make([]byte, 1+len(secret))
+		shares[i][0] = byte(i + 1)
+	}
+	// Each byte of the secret is the constant term of a random polynomial of degree K-1
+	coefficients := make([]byte, threshold)
+	for pos, secretByte := range secret {
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, err
+		}
+		coefficients[0] = secretByte
+		for _, share := range shares {
+			// Evaluate the polynomial at the share's index using Horner's method
+			var y byte
+			for c := threshold - 1; c >= 0; c-- {
+				y = gf256Mul(y, share[0]) ^ coefficients[c]
+			}
+			share[1+pos] = y
+		}
+	}
+	ret := make([]string, numShares)
+	for i, share := range shares {
+		ret[i] = hex.EncodeToString(share)
+	}
+	return ret, nil
+}
+
+// decodeShamirShare decodes a share produced by ShamirSplit into its index followed by data.
+func decodeShamirShare(share string) ([]byte, error) {
+	decoded, err := hex.DecodeString(strings.TrimSpace(share))
+	if err != nil || len(decoded) < 2 || decoded[0] == 0 {
+		return nil, ErrMalformedShamirShare
+	}
+	return decoded, nil
+}
+
+// ValidateShamirShare returns an error if the share does not look like one produced by ShamirSplit.
+func ValidateShamirShare(share string) error {
+	_, err := decodeShamirShare(share)
+	return err
+}
+
+/*
+ShamirCombine reconstructs the secret from shares produced by ShamirSplit. The number of shares must be at least the
+threshold used in splitting, or the result will not be the original secret.
+*/
+func ShamirCombine(shares []string) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("ShamirCombine: at least two shares are required")
+	}
+	decoded := make([][]byte, len(shares))
+	seenIndex := make(map[byte]bool)
+	for i, share := range shares {
+		share, err := decodeShamirShare(share)
+		if err != nil {
+			return nil, err
+		}
+		if i > 0 && len(share) != len(decoded[0]) {
+			return nil, errors.New("ShamirCombine: shares have different lengths")
+		}
+		if seenIndex[share[0]] {
+			return nil, errors.New("ShamirCombine: duplicated share")
+		}
+		seenIndex[share[0]] = true
+		decoded[i] = share
+	}
+	// Lagrange interpolation at x=0
+	secret := make([]byte, len(decoded[0])-1)
+	for i, share := range decoded {
+		// In GF(256), subtraction is the same as addition (XOR)
+		basis := byte(1)
+		for j, other := range decoded {
+			if i != j {
+				basis = gf256Mul(basis, gf256Mul(other[0], gf256Inv(other[0]^share[0])))
+			}
+		}
+		for pos := range secret {
+			secret[pos] ^= gf256Mul(share[1+pos], basis)
+		}
+	}
+	return secret, nil
+}
@@ -0,0 +1,43 @@
+package misc
+
+import (
+	"testing"
+)
+
+func TestShamir(t *testing.T) {
+	if _, err := ShamirSplit([]byte("a"), 3, 1); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := ShamirSplit([]byte("a"), 2, 3); err == nil {
+		t.Fatal("did not error")
+	}
+	secret := "this is a secret password"
+	shares, err := ShamirSplit([]byte(secret), 5, 3)
+	if err != nil || len(shares) != 5 {
+		t.Fatal(err, shares)
+	}
+	// Any three shares reconstruct the secret
+	for _, combination := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4}, {0, 1, 2, 3, 4}} {
+		input := make([]string, 0, len(combination))
+		for _, i := range combination {
+			input = append(input, shares[i])
+		}
+		if result, err := ShamirCombine(input); err != nil || string(result) != secret {
+			t.Fatal(combination, err, string(result))
+		}
+	}
+	// Two shares are insufficient
+	if result, err := ShamirCombine(shares[:2]); err != nil || string(result) == secret {
+		t.Fatal(err, string(result))
+	}
+	// Malformed and duplicated shares
+	if _, err := ShamirCombine([]string{shares[0], "zz"}); err != ErrMalformedShamirShare {
+		t.Fatal(err)
+	}
+	if _, err := ShamirCombine([]string{shares[0], shares[0], shares[1]}); err == nil {
+		t.Fatal("did not error")
+	}
+	if _, err := ShamirCombine([]string{shares[0], shares[1][:10]}); err == nil {
+		t.Fatal("did not error")
+	}
+}
@@ -0,0 +1,148 @@
+package misc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/platform"
+)
+
+const (
+	// SmartctlTimeoutSec is the timeout of each smartctl invocation.
+	SmartctlTimeoutSec = 60
+	// DiskWearoutWarningPercent is the percentage of SSD endurance used at or above which the disk is considered to be wearing out.
+	DiskWearoutWarningPercent = 90
+)
+
+var (
+	// RegexSmartAttribute parses an ATA S.M.A.R.T. attribute line of smartctl output, capturing name, normalised value, and raw value.
+	RegexSmartAttribute = regexp.MustCompile(`^\s*\d+\s+(\S+)\s+0x[0-9a-fA-F]+\s+(\d+)\s+\d+\s+\d+\s+\S+\s+\S+\s+\S+\s+(\d+)`)
+	// RegexSmartNVMeField parses an NVMe health information line of smartctl output, capturing name and number.
+	RegexSmartNVMeField = regexp.MustCompile(`^([A-Za-z][A-Za-z ]+):\s+(0x[0-9a-fA-F]+|[\d,]+)%?`)
+	// ErrSmartctlNotFound is returned by GetDiskHealth if smartctl is not installed.
+	ErrSmartctlNotFound = errors.New("smartctl is not installed")
+)
+
+// DiskHealth is the S.M.A.R.T. health information of a disk.
+type DiskHealth struct {
+	Device string // Device is the device path of the disk, e.g. /dev/sda.
+	// SelfAssessment is the overall health self-assessment reported by the disk, e.g. "PASSED", or empty if unknown.
+	SelfAssessment string
+	// Attributes are the raw values of S.M.A.R.T. attributes (ATA) and health information (NVMe), by their names.
+	Attributes map[string]int64
+	// Warnings describe the signs of failure found in the health information, the disk is healthy if it is empty.
+	Warnings []string
+}
+
+/*
+ParseSmartctl parses the output of "smartctl -H -A" of an ATA, NVMe, or SCSI disk, and looks for the signs of failure
+- failed self-assessment, reallocated/pending/uncorrectable sectors, media errors, and SSD wearout.
+*/
+func ParseSmartctl(device, output string) (health DiskHealth) {
+	health.Device = device
+	health.Attributes = make(map[string]int64)
+	// Normalised value of the attributes that count down from 100 as the SSD wears out
+	wearoutRemaining := -1
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.HasPrefix(line, "SMART overall-health self-assessment test result:") || strings.HasPrefix(line, "SMART Health Status:") {
+			health.SelfAssessment = strings.TrimSpace(line[strings.Index(line, ":")+1:])
+			continue
+		}
+		if match := RegexSmartAttribute.FindStringSubmatch(line); match != nil {
+			raw, _ := strconv.ParseInt(match[3], 10, 64)
+			health.Attributes[match[1]] = raw
+			switch match[1] {
+			case "Media_Wearout_Indicator", "Wear_Leveling_Count", "SSD_Life_Left", "Percent_Lifetime_Remain":
+				if normalised, err := strconv.Atoi(match[2]); err == nil && normalised <= 100 {
+					wearoutRemaining = normalised
+				}
+			}
+			continue
+		}
+		if match := RegexSmartNVMeField.FindStringSubmatch(line); match != nil {
+			val, err := strconv.ParseInt(strings.Replace(match[2], ",", "", -1), 0, 64)
+			if err == nil {
+				health.Attributes[match[1]] = val
+			}
+		}
+	}
+	if health.SelfAssessment != "" && health.SelfAssessment != "PASSED" && health.SelfAssessment != "OK" {
+		health.Warnings = append(health.Warnings, "self-assessment result is "+health.SelfAssessment)
+	}
+	for _, name := range []string{"Reallocated_Sector_Ct", "Current_Pending_Sector", "Offline_Uncorrectable", "Reported_Uncorrect",
+		"Critical Warning", "Media and Data Integrity Errors", "Elements in grown defect list"} {
+		if val := health.Attributes[name]; val > 0 {
+			health.Warnings = append(health.Warnings, fmt.Sprintf("%s is %d", name, val))
+		}
+	}
+	if used, exists := health.Attributes["Percentage Used"]; exists && used >= DiskWearoutWarningPercent {
+		health.Warnings = append(health.Warnings, fmt.Sprintf("%d%% of endurance is used", used))
+	}
+	if wearoutRemaining >= 0 && 100-wearoutRemaining >= DiskWearoutWarningPercent {
+		health.Warnings = append(health.Warnings, fmt.Sprintf("%d%% of endurance is remaining", wearoutRemaining))
+	}
+	return
+}
+
+/*
+GetDiskHealth collects S.M.A.R.T. health information of all disks found by smartctl. It returns ErrSmartctlNotFound if
+smartctl is not installed, and an empty slice if there are no disks that support S.M.A.R.T. (e.g. virtual machines).
+*/
+func GetDiskHealth() (ret []DiskHealth, err error) {
+	ret = make([]DiskHealth, 0)
+	scanOut, err := platform.InvokeProgram(nil, SmartctlTimeoutSec, "smartctl", "--scan")
+	if errors.Is(err, exec.ErrNotFound) {
+		return ret, ErrSmartctlNotFound
+	} else if err != nil {
+		return ret, fmt.Errorf("failed to scan for disks - %v - %s", err, strings.TrimSpace(scanOut))
+	}
+	// Each line looks like "/dev/sda -d scsi # /dev/sda, SCSI device"
+	for _, line := range strings.Split(scanOut, "\n") {
+		if hashIndex := strings.IndexRune(line, '#'); hashIndex != -1 {
+			line = line[:hashIndex]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		args := append([]string{"-H", "-A"}, fields[1:]...)
+		args = append(args, fields[0])
+		// smartctl exits with a non-zero status when the disk is failing, hence the output is parsed regardless.
+		out, _ := platform.InvokeProgram(nil, SmartctlTimeoutSec, "smartctl", args...)
+		ret = append(ret, ParseSmartctl(fields[0], out))
+	}
+	return ret, nil
+}
+
+// GetFailingDisks returns the disks that show signs of failure.
+func GetFailingDisks(disks []DiskHealth) (ret []DiskHealth) {
+	ret = make([]DiskHealth, 0)
+	for _, disk := range disks {
+		if len(disk.Warnings) > 0 {
+			ret = append(ret, disk)
+		}
+	}
+	return
+}
+
+// FormatDiskHealth returns the disk health in a multi-line text, one disk per line.
+func FormatDiskHealth(disks []DiskHealth) string {
+	var buf bytes.Buffer
+	for _, disk := range disks {
+		buf.WriteString(disk.Device)
+		if disk.SelfAssessment != "" {
+			buf.WriteString(": " + disk.SelfAssessment)
+		}
+		if len(disk.Warnings) > 0 {
+			buf.WriteString(" - " + strings.Join(disk.Warnings, ", "))
+		}
+		buf.WriteRune('\n')
+	}
+	return buf.String()
+}
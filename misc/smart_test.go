@@ -0,0 +1,74 @@
+package misc
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseSmartctl(t *testing.T) {
+	ata := `smartctl 7.1 2019-12-30 r5022 [x86_64-linux-5.4.0] (local build)
+=== START OF READ SMART DATA SECTION ===
+SMART overall-health self-assessment test result: PASSED
+
+SMART Attributes Data Structure revision number: 1
+Vendor Specific SMART Attributes with Thresholds:
+ID# ATTRIBUTE_NAME          FLAG     VALUE WORST THRESH TYPE      UPDATED  WHEN_FAILED RAW_VALUE
+  5 Reallocated_Sector_Ct   0x0033   100   100   010    Pre-fail  Always       -       8
+  9 Power_On_Hours          0x0032   095   095   000    Old_age   Always       -       21234
+177 Wear_Leveling_Count     0x0013   005   005   000    Pre-fail  Always       -       2950
+190 Airflow_Temperature_Cel 0x0032   064   052   000    Old_age   Always       -       36 (Min/Max 20/48)
+197 Current_Pending_Sector  0x0012   100   100   000    Old_age   Always       -       0
+`
+	health := ParseSmartctl("/dev/sda", ata)
+	if health.Device != "/dev/sda" || health.SelfAssessment != "PASSED" || health.Attributes["Power_On_Hours"] != 21234 ||
+		health.Attributes["Airflow_Temperature_Cel"] != 36 {
+		t.Fatalf("%+v", health)
+	}
+	if !reflect.DeepEqual(health.Warnings, []string{"Reallocated_Sector_Ct is 8", "5% of endurance is remaining"}) {
+		t.Fatalf("%+v", health.Warnings)
+	}
+
+	nvme := `=== START OF SMART DATA SECTION ===
+SMART overall-health self-assessment test result: FAILED!
+- NVM subsystem reliability has been degraded
+
+SMART/Health Information (NVMe Log 0x02)
+Critical Warning:                   0x04
+Temperature:                        35 Celsius
+Percentage Used:                    93%
+Data Units Read:                    1,234,567 [632 GB]
+Media and Data Integrity Errors:    0
+`
+	health = ParseSmartctl("/dev/nvme0", nvme)
+	if health.SelfAssessment != "FAILED!" || health.Attributes["Data Units Read"] != 1234567 || health.Attributes["Temperature"] != 35 {
+		t.Fatalf("%+v", health)
+	}
+	if !reflect.DeepEqual(health.Warnings, []string{"self-assessment result is FAILED!", "Critical Warning is 4", "93% of endurance is used"}) {
+		t.Fatalf("%+v", health.Warnings)
+	}
+
+	scsi := "SMART Health Status: OK\nElements in grown defect list: 0\n"
+	health = ParseSmartctl("/dev/sdb", scsi)
+	if health.SelfAssessment != "OK" || len(health.Warnings) != 0 {
+		t.Fatalf("%+v", health)
+	}
+
+	disks := []DiskHealth{ParseSmartctl("/dev/sda", ata), health}
+	if failing := GetFailingDisks(disks); len(failing) != 1 || failing[0].Device != "/dev/sda" {
+		t.Fatalf("%+v", failing)
+	}
+	if text := FormatDiskHealth(disks); !strings.Contains(text, "/dev/sda: PASSED - Reallocated_Sector_Ct is 8, 5% of endurance is remaining\n") ||
+		!strings.Contains(text, "/dev/sdb: OK\n") {
+		t.Fatal(text)
+	}
+}
+
+func TestGetDiskHealth(t *testing.T) {
+	// The test environment may or may not have smartctl, either way it must not fail.
+	disks, err := GetDiskHealth()
+	if err == ErrSmartctlNotFound && len(disks) != 0 {
+		t.Fatalf("%+v", disks)
+	}
+	t.Log(err, FormatDiskHealth(disks))
+}
@@ -2,15 +2,32 @@ package misc
 
 import (
 	"fmt"
+	"sort"
 	"sync"
+	"time"
 )
 
+const (
+	StatsNumSamples    = 1000 // StatsNumSamples is the number of latest quantities kept by stats for calculating percentiles.
+	StatsRateWindowSec = 60   // StatsRateWindowSec is the size of the recent window in seconds over which the trigger rate is calculated.
+)
+
+// statsRateBucket counts the triggers that occurred during a second.
+type statsRateBucket struct {
+	unixSec int64
+	count   uint64
+}
+
 // Stats collect counter and aggregated numeric data from a stream of triggers.
 type Stats struct {
 	count uint64      // count is the number of times trigger has occurred.
 	mutex *sync.Mutex // mutex protects structure from concurrent modifications.
 
 	lowest, highest, average, total float64
+
+	samples     []float64                           // samples are the latest quantities in a ring buffer, used for calculating percentiles.
+	nextSample  int                                 // nextSample is the index in samples to be overwritten when the ring buffer is full.
+	rateBuckets [StatsRateWindowSec]statsRateBucket // rateBuckets count the triggers of each second in the recent window.
 }
 
 // NewStats returns an initialised stats structure.
@@ -27,6 +44,13 @@ func (s *Stats) Trigger(qty float64) {
 		return
 	}
 	s.count++
+	nowSec := time.Now().Unix()
+	bucket := &s.rateBuckets[nowSec%StatsRateWindowSec]
+	if bucket.unixSec != nowSec {
+		bucket.unixSec = nowSec
+		bucket.count = 0
+	}
+	bucket.count++
 	if qty == 0 {
 		// Interval is too small for updating high/low/average
 		return
@@ -39,6 +63,52 @@ func (s *Stats) Trigger(qty float64) {
 	}
 	s.total += qty
 	s.average = s.total / float64(s.count)
+	if len(s.samples) < StatsNumSamples {
+		s.samples = append(s.samples, qty)
+	} else {
+		s.samples[s.nextSample] = qty
+		s.nextSample = (s.nextSample + 1) % StatsNumSamples
+	}
+}
+
+/*
+Percentiles returns the quantities at each of the input percentiles (e.g. 50, 95, 99) among the latest StatsNumSamples
+triggers, using the nearest-rank method. The quantities are 0 if there has not been a trigger.
+*/
+func (s *Stats) Percentiles(percentiles ...float64) []float64 {
+	s.mutex.Lock()
+	sorted := make([]float64, len(s.samples))
+	copy(sorted, s.samples)
+	s.mutex.Unlock()
+	sort.Float64s(sorted)
+	ret := make([]float64, len(percentiles))
+	if len(sorted) == 0 {
+		return ret
+	}
+	for i, percentile := range percentiles {
+		rank := int(percentile/100*float64(len(sorted))+0.5) - 1
+		if rank < 0 {
+			rank = 0
+		} else if rank >= len(sorted) {
+			rank = len(sorted) - 1
+		}
+		ret[i] = sorted[rank]
+	}
+	return ret
+}
+
+// RecentRate returns the average number of triggers per second during the latest StatsRateWindowSec seconds.
+func (s *Stats) RecentRate() float64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	nowSec := time.Now().Unix()
+	var total uint64
+	for _, bucket := range s.rateBuckets {
+		if nowSec-bucket.unixSec < StatsRateWindowSec {
+			total += bucket.count
+		}
+	}
+	return float64(total) / StatsRateWindowSec
 }
 
 // Count returns the verbatim counter value, that is the number of times some action has triggered.
@@ -53,3 +123,13 @@ func (s *Stats) Format(divisionFactor float64, numDecimals int) string {
 	format := fmt.Sprintf("%%.%df/%%.%df/%%.%df,%%.%df(%%d)", numDecimals, numDecimals, numDecimals, numDecimals)
 	return fmt.Sprintf(format, s.lowest/divisionFactor, s.average/divisionFactor, s.highest/divisionFactor, s.total/divisionFactor, s.count)
 }
+
+/*
+FormatPercentiles returns the 50th, 95th, and 99th percentiles of the latest quantities divided by the factor, followed by
+the number of triggers per second in the recent window, all formatted into a single line of string.
+*/
+func (s *Stats) FormatPercentiles(divisionFactor float64, numDecimals int) string {
+	format := fmt.Sprintf("%%.%df/%%.%df/%%.%df,%%.%df/s", numDecimals, numDecimals, numDecimals, numDecimals)
+	p := s.Percentiles(50, 95, 99)
+	return fmt.Sprintf(format, p[0]/divisionFactor, p[1]/divisionFactor, p[2]/divisionFactor, s.RecentRate())
+}
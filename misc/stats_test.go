@@ -40,3 +40,32 @@ func TestStats(t *testing.T) {
 		t.Fatal(s.Count())
 	}
 }
+
+func TestStats_Percentiles(t *testing.T) {
+	s := NewStats()
+	if p := s.Percentiles(50, 99); p[0] != 0 || p[1] != 0 {
+		t.Fatal(p)
+	}
+	if rate := s.RecentRate(); rate != 0 {
+		t.Fatal(rate)
+	}
+	for i := 1; i <= 100; i++ {
+		s.Trigger(float64(i))
+	}
+	if p := s.Percentiles(50, 95, 99, 100); p[0] != 50 || p[1] != 95 || p[2] != 99 || p[3] != 100 {
+		t.Fatal(p)
+	}
+	if rate := s.RecentRate(); rate != 100.0/StatsRateWindowSec {
+		t.Fatal(rate)
+	}
+	if str := s.FormatPercentiles(10, 1); str != "5.0/9.5/9.9,1.7/s" {
+		t.Fatal(str)
+	}
+	// Only the latest samples are kept for calculating percentiles
+	for i := 0; i < StatsNumSamples; i++ {
+		s.Trigger(1)
+	}
+	if p := s.Percentiles(99); p[0] != 1 {
+		t.Fatal(p)
+	}
+}
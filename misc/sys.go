@@ -50,7 +50,11 @@ func GetProgramMemoryUsageKB() int {
 	return FindNumInRegexGroup(RegexVmRss, string(statusContent), 1)
 }
 
-// Return operating system memory usage. Return 0 if the memory usage cannot be determined.
+/*
+Return operating system memory usage. Return 0 if the memory usage cannot be determined.
+If this program runs in a cgroup (e.g. Docker container) that has a memory limit smaller than the system memory size, then
+the cgroup's memory usage and limit are returned instead.
+*/
 func GetSystemMemoryUsageKB() (usedKB int, totalKB int) {
 	infoContent, err := ioutil.ReadFile("/proc/meminfo")
 	if err != nil {
@@ -63,9 +67,24 @@ func GetSystemMemoryUsageKB() (usedKB int, totalKB int) {
 	} else {
 		usedKB = totalKB - available
 	}
+	if cgroupUsedKB, cgroupLimitKB, limited := GetCgroupMemoryUsageKB(); limited && cgroupLimitKB < totalKB {
+		return cgroupUsedKB, cgroupLimitKB
+	}
 	return
 }
 
+/*
+GetNumCPUs returns the number of CPUs available to this program, which takes into account the CPU quota imposed by cgroup
+(e.g. Docker container). The number may be fractional.
+*/
+func GetNumCPUs() float64 {
+	numCPUs := float64(runtime.NumCPU())
+	if cgroupCPUs, limited := GetCgroupCPULimit(); limited && cgroupCPUs < numCPUs {
+		return cgroupCPUs
+	}
+	return numCPUs
+}
+
 // Return system load information and number of processes from /proc/loadavg. Return empty string if IO error occurs.
 func GetSystemLoad() string {
 	content, err := ioutil.ReadFile("/proc/loadavg")
@@ -180,6 +199,11 @@ func InvokeShell(timeoutSec int, interpreter string, content string) (out string
 	return platform.InvokeProgram(nil, timeoutSec, interpreter, "-c", content)
 }
 
+// InvokeShellWithOptions launches an external shell process in the same way as InvokeShell, and applies the options.
+func InvokeShellWithOptions(options platform.ProgramOptions, timeoutSec int, interpreter string, content string) (out string, err error) {
+	return platform.InvokeProgramWithOptions(options, nil, timeoutSec, interpreter, "-c", content)
+}
+
 // GetSysctlStr returns string value of a sysctl parameter corresponding to the input key.
 func GetSysctlStr(key string) (string, error) {
 	content, err := ioutil.ReadFile(filepath.Join("/proc/sys/", strings.Replace(key, ".", "/", -1)))
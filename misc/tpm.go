@@ -0,0 +1,103 @@
+package misc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/platform"
+)
+
+const (
+	// DefaultTPMPCRs is the selection of TPM platform configuration registers that the sealed secret is bound to by default.
+	DefaultTPMPCRs = "sha256:0,2,4,7"
+	// TPMTimeoutSec is the timeout in seconds of each TPM tool invocation.
+	TPMTimeoutSec = 30
+
+	tpmSealedPubFile  = "seal.pub"  // tpmSealedPubFile is the public portion of the sealed TPM object.
+	tpmSealedPrivFile = "seal.priv" // tpmSealedPrivFile is the private portion of the sealed TPM object, encrypted by the TPM.
+	tpmPCRsFile       = "pcrs"      // tpmPCRsFile remembers the PCR selection used in sealing.
+)
+
+// createTPMPrimaryKey creates the primary key under TPM owner hierarchy. The same key is created every time on the same TPM.
+func createTPMPrimaryKey(workDir string) (ctxPath string, err error) {
+	ctxPath = filepath.Join(workDir, "primary.ctx")
+	if out, err := platform.InvokeProgram(nil, TPMTimeoutSec, "tpm2_createprimary", "-C", "o", "-g", "sha256", "-G", "ecc", "-c", ctxPath); err != nil {
+		return "", fmt.Errorf("createTPMPrimaryKey: tpm2_createprimary failed - %v %s", err, out)
+	}
+	return
+}
+
+/*
+SealToTPM uses the host TPM to seal the secret, bound to the PCR selection (e.g. DefaultTPMPCRs). The sealed object is
+stored in the directory, and only the same TPM can unseal it, and only when the platform configuration registers (which
+measure firmware, boot loader, secure boot state, etc.) have the same values as they did during sealing. The function
+relies on tpm2-tools.
+*/
+func SealToTPM(secret []byte, pcrs, dirPath string) error {
+	if len(secret) == 0 {
+		return errors.New("SealToTPM: the secret must not be empty")
+	}
+	if pcrs == "" {
+		pcrs = DefaultTPMPCRs
+	}
+	if err := os.MkdirAll(dirPath, 0700); err != nil {
+		return err
+	}
+	workDir, err := ioutil.TempDir("", "laitos-tpm")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = SecureErase(workDir)
+	}()
+	primaryCtx, err := createTPMPrimaryKey(workDir)
+	if err != nil {
+		return err
+	}
+	policyPath := filepath.Join(workDir, "policy.digest")
+	if out, err := platform.InvokeProgram(nil, TPMTimeoutSec, "tpm2_createpolicy", "--policy-pcr", "-l", pcrs, "-L", policyPath); err != nil {
+		return fmt.Errorf("SealToTPM: tpm2_createpolicy failed - %v %s", err, out)
+	}
+	if out, err := platform.InvokeProgramWithOptions(platform.ProgramOptions{Stdin: bytes.NewReader(secret)}, nil, TPMTimeoutSec,
+		"tpm2_create", "-C", primaryCtx, "-g", "sha256", "-L", policyPath, "-i", "-",
+		"-u", filepath.Join(dirPath, tpmSealedPubFile), "-r", filepath.Join(dirPath, tpmSealedPrivFile)); err != nil {
+		return fmt.Errorf("SealToTPM: tpm2_create failed - %v %s", err, out)
+	}
+	return ioutil.WriteFile(filepath.Join(dirPath, tpmPCRsFile), []byte(pcrs), 0600)
+}
+
+// UnsealFromTPM uses the host TPM to unseal the secret previously sealed by SealToTPM into the directory.
+func UnsealFromTPM(dirPath string) ([]byte, error) {
+	pcrs, err := ioutil.ReadFile(filepath.Join(dirPath, tpmPCRsFile))
+	if err != nil {
+		return nil, err
+	}
+	workDir, err := ioutil.TempDir("", "laitos-tpm")
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = SecureErase(workDir)
+	}()
+	primaryCtx, err := createTPMPrimaryKey(workDir)
+	if err != nil {
+		return nil, err
+	}
+	sealedCtx := filepath.Join(workDir, "seal.ctx")
+	if out, err := platform.InvokeProgram(nil, TPMTimeoutSec, "tpm2_load", "-C", primaryCtx,
+		"-u", filepath.Join(dirPath, tpmSealedPubFile), "-r", filepath.Join(dirPath, tpmSealedPrivFile), "-c", sealedCtx); err != nil {
+		return nil, fmt.Errorf("UnsealFromTPM: tpm2_load failed - %v %s", err, out)
+	}
+	// The secret is written into a file, as the tool's output may carry warning messages too.
+	secretPath := filepath.Join(workDir, "secret")
+	if out, err := platform.InvokeProgram(nil, TPMTimeoutSec, "tpm2_unseal", "-c", sealedCtx,
+		"-p", "pcr:"+strings.TrimSpace(string(pcrs)), "-o", secretPath); err != nil {
+		return nil, fmt.Errorf("UnsealFromTPM: tpm2_unseal failed (has the boot configuration changed?) - %v %s", err, out)
+	}
+	return ioutil.ReadFile(secretPath)
+}
@@ -0,0 +1,22 @@
+package misc
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestTPM(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-TestTPM")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := SealToTPM(nil, "", dir); err == nil {
+		t.Fatal("did not error")
+	}
+	// Nothing has been sealed into the directory
+	if _, err := UnsealFromTPM(dir); err == nil {
+		t.Fatal("did not error")
+	}
+}
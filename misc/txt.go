@@ -4,13 +4,18 @@ import (
 	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"unicode/utf8"
 )
 
 const (
@@ -21,8 +26,23 @@ const (
 	EncryptionIVSizeBytes = aes.BlockSize
 	// EncryptionFileHeader is a piece of plain text prepended to encrypted files as a clue to file readers.
 	EncryptionFileHeader = "encrypted-by-laitos-software"
+	/*
+		EncryptionFileHeaderV2 is prepended to files encrypted using the second version of the format - AES-256-GCM with
+		key derived from the password via PBKDF2-HMAC-SHA256. It begins with EncryptionFileHeader so that older versions of
+		laitos still recognise the file as encrypted. Files without this header were encrypted by AES-CTR (version 1).
+	*/
+	EncryptionFileHeaderV2 = EncryptionFileHeader + "-v2-aes256gcm-pbkdf2sha256\n"
+	// EncryptionKDFIterations is the number of PBKDF2 iterations used to derive encryption key from password.
+	EncryptionKDFIterations = 310000
+	// EncryptionSaltSizeBytes is the number of random bytes used as the salt of key derivation.
+	EncryptionSaltSizeBytes = 16
+	// encryptionKDFIterationsLimit guards against a tampered file that asks for an unreasonable amount of key derivation work.
+	encryptionKDFIterationsLimit = 100 * EncryptionKDFIterations
 )
 
+// ErrDecryptionFailed is returned when an encrypted file cannot be decrypted, because the password is wrong or the file has been tampered with.
+var ErrDecryptionFailed = errors.New("wrong password or the encrypted data has been tampered with")
+
 // EditKeyValue modifies or inserts a key=value pair into the specified file.
 func EditKeyValue(filePath, key, value string) error {
 	content, err := ioutil.ReadFile(filePath)
@@ -123,46 +143,107 @@ func Encrypt(filePath string, key []byte) error {
 	if encrypted {
 		return fmt.Errorf("Encrypt: input file \"%s\" is already encrypted", filePath)
 	}
-	// Generate a random IV
-	iv := make([]byte, EncryptionIVSizeBytes)
-	_, err = rand.Read(iv)
+	encryptedContent, err := encryptV2(content, key, EncryptionKDFIterations)
 	if err != nil {
-		return fmt.Errorf("failed to acquire random numbers - %v", err)
+		return err
+	}
+	return ioutil.WriteFile(filePath, encryptedContent, 0600)
+}
+
+/*
+deriveKey derives a 256-bit key from the password using PBKDF2-HMAC-SHA256 (RFC 8018). The output is exactly one
+block of SHA256, hence the single iteration block.
+*/
+func deriveKey(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	_, _ = mac.Write(salt)
+	_, _ = mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	key := make([]byte, len(u))
+	copy(key, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		_, _ = mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
 	}
-	// In preparation to overwrite input file with encrypted data, prepend it with header string and IV.
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	return key
+}
+
+/*
+encryptV2 encrypts the content using AES-256-GCM. The output consists of EncryptionFileHeaderV2, the number of KDF
+iterations (big endian uint32), KDF salt, GCM nonce, followed by cipher text and authentication tag. The header,
+iterations, and salt are authenticated too.
+*/
+func encryptV2(content, password []byte, iterations int) ([]byte, error) {
+	header := make([]byte, len(EncryptionFileHeaderV2)+4+EncryptionSaltSizeBytes)
+	copy(header, EncryptionFileHeaderV2)
+	binary.BigEndian.PutUint32(header[len(EncryptionFileHeaderV2):], uint32(iterations))
+	salt := header[len(EncryptionFileHeaderV2)+4:]
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("failed to acquire random numbers - %v", err)
+	}
+	keyCipher, err := aes.NewCipher(deriveKey(password, salt, iterations))
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("failed to initialise cipher - %v", err)
 	}
-	defer file.Close()
-	if _, err := file.Write([]byte(EncryptionFileHeader)); err != nil {
-		return err
+	gcm, err := cipher.NewGCM(keyCipher)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialise cipher - %v", err)
 	}
-	if _, err := file.Write(iv); err != nil {
-		return err
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to acquire random numbers - %v", err)
 	}
-	// Initialise encryption data stream using input key and the randomly generated IV
-	if len(key) < 32 {
-		key = append(key, bytes.Repeat([]byte{0}, 32-len(key))...)
+	ret := append(header, nonce...)
+	return gcm.Seal(ret, nonce, content, header), nil
+}
+
+// decryptV2 decrypts the content previously encrypted by encryptV2.
+func decryptV2(encryptedContent, password []byte) ([]byte, error) {
+	headerLen := len(EncryptionFileHeaderV2) + 4 + EncryptionSaltSizeBytes
+	if len(encryptedContent) < headerLen {
+		return nil, ErrDecryptionFailed
 	}
-	keyCipher, err := aes.NewCipher(key)
+	header := encryptedContent[:headerLen]
+	iterations := binary.BigEndian.Uint32(header[len(EncryptionFileHeaderV2):])
+	if iterations < 1 || iterations > encryptionKDFIterationsLimit {
+		return nil, ErrDecryptionFailed
+	}
+	keyCipher, err := aes.NewCipher(deriveKey(password, header[len(EncryptionFileHeaderV2)+4:], int(iterations)))
 	if err != nil {
-		return fmt.Errorf("failed to initialise cipher - %v", err)
+		return nil, fmt.Errorf("failed to initialise cipher - %v", err)
 	}
-	ctrStream := cipher.NewCTR(keyCipher, iv)
-	cipherWriter := &cipher.StreamWriter{S: ctrStream, W: file}
-	// Copy data into encrypted file stream to complete encryptioin
-	_, err = cipherWriter.Write(content)
-	return err
+	gcm, err := cipher.NewGCM(keyCipher)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialise cipher - %v", err)
+	}
+	if len(encryptedContent) < headerLen+gcm.NonceSize()+gcm.Overhead() {
+		return nil, ErrDecryptionFailed
+	}
+	nonce := encryptedContent[headerLen : headerLen+gcm.NonceSize()]
+	content, err := gcm.Open(nil, nonce, encryptedContent[headerLen+gcm.NonceSize():], header)
+	if err != nil {
+		return nil, ErrDecryptionFailed
+	}
+	return content, nil
 }
 
-// Decrypt decrypts the input file and returns its content. The entire operation is conducted in memory.
+/*
+Decrypt decrypts the input file and returns its content. The entire operation is conducted in memory. Files encrypted
+by older versions of laitos (AES-CTR) are still readable, though a wrong password cannot be detected for them.
+*/
 func Decrypt(filePath string, key string) (content []byte, err error) {
 	// Read the input encrypted data in its entirety
 	encryptedContent, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		return nil, err
 	}
+	if bytes.HasPrefix(encryptedContent, []byte(EncryptionFileHeaderV2)) {
+		return decryptV2(encryptedContent, []byte(key))
+	}
 	// Make sure input file was encrypted by laitos
 	if len(encryptedContent) < len(EncryptionFileHeader)+EncryptionIVSizeBytes || string(encryptedContent[:len(EncryptionFileHeader)]) != EncryptionFileHeader {
 		return nil, fmt.Errorf("Decrypt: input file \"%s\" does not appear to have been encrypted by laitos", filePath)
@@ -183,3 +264,91 @@ func Decrypt(filePath string, key string) (content []byte, err error) {
 	content, err = ioutil.ReadAll(cipherReader)
 	return
 }
+
+/*
+RekeyFiles re-encrypts the encrypted files in-place using a new password. All of the files are decrypted using the old
+password before any of them is changed. Each file is re-encrypted into a temporary file, which is verified using the new
+password before it replaces the original file. As a wrong password cannot be detected for files encrypted by older
+versions of laitos, their decrypted content must be valid UTF-8 text (such as configuration and PEM files).
+*/
+func RekeyFiles(oldKey, newKey string, filePaths ...string) error {
+	if newKey == "" {
+		return errors.New("RekeyFiles: the new password must not be empty")
+	}
+	contents := make([][]byte, len(filePaths))
+	for i, filePath := range filePaths {
+		encryptedContent, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		content, err := Decrypt(filePath, oldKey)
+		if err != nil {
+			return fmt.Errorf("RekeyFiles: failed to decrypt \"%s\" - %v", filePath, err)
+		}
+		if !bytes.HasPrefix(encryptedContent, []byte(EncryptionFileHeaderV2)) && !utf8.Valid(content) {
+			return fmt.Errorf("RekeyFiles: failed to decrypt \"%s\" - %v", filePath, ErrDecryptionFailed)
+		}
+		contents[i] = content
+	}
+	for i, filePath := range filePaths {
+		encryptedContent, err := encryptV2(contents[i], []byte(newKey), EncryptionKDFIterations)
+		if err != nil {
+			return err
+		}
+		tmpFile, err := ioutil.TempFile(filepath.Dir(filePath), filepath.Base(filePath)+".rekey")
+		if err != nil {
+			return err
+		}
+		tmpPath := tmpFile.Name()
+		_, err = tmpFile.Write(encryptedContent)
+		if syncErr := tmpFile.Sync(); err == nil {
+			err = syncErr
+		}
+		if closeErr := tmpFile.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			var verified []byte
+			if verified, err = Decrypt(tmpPath, newKey); err == nil && !bytes.Equal(verified, contents[i]) {
+				err = errors.New("the re-encrypted file does not decrypt to the original content")
+			}
+		}
+		if err == nil {
+			if info, statErr := os.Stat(filePath); statErr == nil {
+				_ = os.Chmod(tmpPath, info.Mode())
+			}
+			err = os.Rename(tmpPath, filePath)
+		}
+		if err != nil {
+			_ = os.Remove(tmpPath)
+			return fmt.Errorf("RekeyFiles: failed to re-encrypt \"%s\" - %v", filePath, err)
+		}
+	}
+	return nil
+}
+
+// FindEncryptedFiles returns the paths of files encrypted by laitos in the directory, sub-directories are not searched.
+func FindEncryptedFiles(dirPath string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]string, 0)
+	for _, entry := range entries {
+		if !entry.Mode().IsRegular() {
+			continue
+		}
+		filePath := filepath.Join(dirPath, entry.Name())
+		fh, err := os.Open(filePath)
+		if err != nil {
+			continue
+		}
+		header := make([]byte, len(EncryptionFileHeader))
+		_, err = io.ReadFull(fh, header)
+		_ = fh.Close()
+		if err == nil && string(header) == EncryptionFileHeader {
+			ret = append(ret, filePath)
+		}
+	}
+	return ret, nil
+}
@@ -1,9 +1,14 @@
 package misc
 
 import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
@@ -163,13 +168,103 @@ func TestEncryptDecrypt(t *testing.T) {
 		t.Fatal(err, string(content))
 	}
 
-	// Decrypt with wrong key should not yield any useful content
-	if content, err := Decrypt(tmp.Name(), "wrong key"); err != nil || strings.Contains(string(content), "123") {
+	// Decrypt with wrong key should be detected
+	if content, err := Decrypt(tmp.Name(), "wrong key"); err != ErrDecryptionFailed || strings.Contains(string(content), "123") {
 		t.Fatal(err, string(content))
 	}
+	// Tampering with the encrypted data should be detected
+	encryptedContent, err := ioutil.ReadFile(tmp.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	encryptedContent[len(encryptedContent)-1] ^= 1
+	if err := ioutil.WriteFile(tmp.Name(), encryptedContent, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decrypt(tmp.Name(), "this is a key"); err != ErrDecryptionFailed {
+		t.Fatal(err)
+	}
+	encryptedContent[len(encryptedContent)-1] ^= 1
+	if err := ioutil.WriteFile(tmp.Name(), encryptedContent, 0600); err != nil {
+		t.Fatal(err)
+	}
 
 	if contents, isEncrypted, err := DecryptIfNecessary("this is a key", tmp.Name()); err != nil || len(isEncrypted) != 1 || !isEncrypted[0] ||
 		len(contents) != 1 || string(contents[0]) != sampleContent {
 		t.Fatal(err, isEncrypted, contents)
 	}
 }
+
+func TestDecryptLegacyFormat(t *testing.T) {
+	tmp, err := ioutil.TempFile("", "laitos-TestDecryptLegacyFormat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	// Files encrypted by older versions of laitos use AES-CTR and a zero-padded key
+	sampleContent := []byte(`01234567890abcdefghijklmnopqrstuvwxyz`)
+	key := append([]byte("this is a key"), bytes.Repeat([]byte{0}, 32-len("this is a key"))...)
+	iv := bytes.Repeat([]byte{1}, EncryptionIVSizeBytes)
+	keyCipher, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted := make([]byte, len(sampleContent))
+	cipher.NewCTR(keyCipher, iv).XORKeyStream(encrypted, sampleContent)
+	legacyContent := append(append([]byte(EncryptionFileHeader), iv...), encrypted...)
+	if err := ioutil.WriteFile(tmp.Name(), legacyContent, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, encrypted, err := IsEncrypted(tmp.Name()); err != nil || !encrypted {
+		t.Fatal(err, encrypted)
+	}
+	if content, err := Decrypt(tmp.Name(), "this is a key"); err != nil || !bytes.Equal(content, sampleContent) {
+		t.Fatal(err, string(content))
+	}
+}
+
+func TestDeriveKey(t *testing.T) {
+	// The test vector comes from RFC 7914 section 11
+	expected := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"
+	if key := hex.EncodeToString(deriveKey([]byte("passwd"), []byte("salt"), 1)); key != expected {
+		t.Fatal(key)
+	}
+}
+
+func TestRekeyFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-TestRekeyFiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a", "b", "plain"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("content of "+name), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"a", "b"} {
+		if err := Encrypt(filepath.Join(dir, name), []byte("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	filePaths, err := FindEncryptedFiles(dir)
+	if err != nil || !reflect.DeepEqual(filePaths, []string{filepath.Join(dir, "a"), filepath.Join(dir, "b")}) {
+		t.Fatal(err, filePaths)
+	}
+	// A wrong password must not change any file
+	if err := RekeyFiles("wrong", "new", filePaths...); err == nil {
+		t.Fatal("did not error")
+	}
+	if err := RekeyFiles("old", "new", filePaths...); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "b"} {
+		if content, err := Decrypt(filepath.Join(dir, name), "new"); err != nil || string(content) != "content of "+name {
+			t.Fatal(err, string(content))
+		}
+	}
+	// No temporary file is left behind
+	if entries, err := ioutil.ReadDir(dir); err != nil || len(entries) != 3 {
+		t.Fatal(err, entries)
+	}
+}
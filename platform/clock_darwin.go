@@ -0,0 +1,11 @@
+package platform
+
+import (
+	"errors"
+	"time"
+)
+
+// SlewSystemClock is not supported on macOS.
+func SlewSystemClock(_ time.Duration) error {
+	return errors.New("SlewSystemClock: slewing the clock is not supported on macOS")
+}
@@ -0,0 +1,22 @@
+package platform
+
+import (
+	"reflect"
+	"syscall"
+	"time"
+)
+
+// adjOffsetSingleshot tells adjtimex to gradually adjust the clock by an offset in microseconds, the same as adjtime(3).
+const adjOffsetSingleshot = 0x8001
+
+/*
+SlewSystemClock gradually speeds up or slows down the system clock until the offset is corrected, the kernel slews
+the clock by at most 0.5 milliseconds per second.
+*/
+func SlewSystemClock(offset time.Duration) error {
+	tx := syscall.Timex{Modes: adjOffsetSingleshot}
+	// The width of Timex fields differs among CPU architectures
+	reflect.ValueOf(&tx.Offset).Elem().SetInt(int64(offset / time.Microsecond))
+	_, err := syscall.Adjtimex(&tx)
+	return err
+}
@@ -0,0 +1,14 @@
+// +build darwin linux
+
+package platform
+
+import (
+	"syscall"
+	"time"
+)
+
+// StepSystemClock immediately moves the system clock forward (positive offset) or backward (negative offset).
+func StepSystemClock(offset time.Duration) error {
+	tv := syscall.NsecToTimeval(time.Now().Add(offset).UnixNano())
+	return syscall.Settimeofday(&tv)
+}
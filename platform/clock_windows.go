@@ -0,0 +1,16 @@
+package platform
+
+import (
+	"errors"
+	"time"
+)
+
+// StepSystemClock is not supported on Windows, use w32tm.exe instead.
+func StepSystemClock(_ time.Duration) error {
+	return errors.New("StepSystemClock: stepping the clock is not supported on Windows")
+}
+
+// SlewSystemClock is not supported on Windows, use w32tm.exe instead.
+func SlewSystemClock(_ time.Duration) error {
+	return errors.New("SlewSystemClock: slewing the clock is not supported on Windows")
+}
@@ -1,7 +1,10 @@
 package platform
 
 import (
+	"context"
+	"io"
 	"os"
+	"strings"
 
 	"github.com/HouzuoGuo/laitos/lalog"
 )
@@ -36,3 +39,104 @@ var (
 	// logger is used by some of the OS platform specific actions that affect laitos process globally.
 	logger = lalog.Logger{ComponentName: "platform", ComponentID: []lalog.LoggerIDField{{Key: "PID", Value: os.Getpid()}}}
 )
+
+// ProgramOptions customise the way InvokeProgramWithOptions launches an external program.
+type ProgramOptions struct {
+	/*
+		Output receives stdout and stderr output of the program as it runs. The output is written sequentially, and is
+		not subjected to MaxExternalProgramOutputBytes. A slow writer holds up the program's output.
+	*/
+	Output io.Writer
+	// Stdin is read by the program as its standard input. By default the program reads from the null device.
+	Stdin io.Reader
+	/*
+		RunAsUser is the name of a local user to run the program as, the program runs with the user's primary group,
+		supplementary groups, and home directory. Running as another user requires laitos to run as root. If the program
+		runs in a transient cgroup, systemd switches to the user after placing the program in the cgroup, and the program
+		runs with the user's primary group only. This option is not supported on Windows.
+	*/
+	RunAsUser string
+	// WorkingDirectory is the working directory of the program. By default it inherits laitos' working directory.
+	WorkingDirectory string
+	/*
+		Umask is the file mode creation mask of the program (e.g. 0077), and 0 is a valid mask. By default (nil) the
+		program inherits laitos' umask. This option is not supported on Windows.
+	*/
+	Umask *int
+	// Limits restrict the system resources the program may consume. This option is not supported on Windows.
+	Limits ProgramLimits
+	/*
+		EnvAllowlist is the names of laitos' own environment variables that the program may inherit, a name ending with
+		an asterisk matches all names of the prefix (e.g. "LC_*"). By default the program inherits all of them.
+		Environment variables given to InvokeProgramWithOptions explicitly are not subjected to the allowlist.
+	*/
+	EnvAllowlist []string
+	/*
+		EnvDenylist is the names of laitos' own environment variables that the program must not inherit, e.g.
+		"AWS_SECRET_ACCESS_KEY". The names are matched in the same way as EnvAllowlist, and the denylist takes
+		precedence over the allowlist.
+	*/
+	EnvDenylist []string
+	/*
+		Context, if not nil, kills the program when it is cancelled, e.g. after the client that asked for the program
+		has gone away. The time limit of the program applies regardless.
+	*/
+	Context context.Context
+}
+
+// done returns the channel that is closed when the program's context is cancelled, or nil if there is no context.
+func (options ProgramOptions) done() <-chan struct{} {
+	if options.Context == nil {
+		return nil
+	}
+	return options.Context.Done()
+}
+
+/*
+InvokeProgram launches an external program with time constraints. The external program inherits laitos' environment
+mixed with additional input environment variables. The additional variables take precedence over inherited ones.
+Returns stdout+stderr output combined, and error if there is any. The maximum amount of output returned is capped to
+MaxExternalProgramOutputBytes.
+*/
+func InvokeProgram(envVars []string, timeoutSec int, program string, args ...string) (out string, err error) {
+	return InvokeProgramWithOptions(ProgramOptions{}, envVars, timeoutSec, program, args...)
+}
+
+// envNameMatches returns true if the environment variable name matches any of the patterns, case-insensitively.
+func envNameMatches(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if prefix := pattern[:len(pattern)-1]; len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(name, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+FilterEnv returns the environment variables (in "name=value" form) that satisfy the allowlist and denylist. An empty
+allowlist allows all variables, and the denylist takes precedence over the allowlist.
+*/
+func FilterEnv(env, allowlist, denylist []string) []string {
+	if len(allowlist) == 0 && len(denylist) == 0 {
+		return env
+	}
+	ret := make([]string, 0, len(env))
+	for _, keyValue := range env {
+		// Windows has special variables such as "=C:=C:\Windows", whose name begins with an equal sign.
+		name := keyValue
+		if equal := strings.IndexRune(keyValue, '='); equal == 0 {
+			name = keyValue[:strings.IndexRune(keyValue[1:], '=')+1]
+		} else if equal > 0 {
+			name = keyValue[:equal]
+		}
+		if len(allowlist) > 0 && !envNameMatches(name, allowlist) || envNameMatches(name, denylist) {
+			continue
+		}
+		ret = append(ret, keyValue)
+	}
+	return ret
+}
@@ -0,0 +1,109 @@
+package platform
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// ProcMountsPath is the location of the mount table of Linux kernel.
+const ProcMountsPath = "/proc/self/mounts"
+
+// DiskUsage describes the space and inode usage of a mounted file system.
+type DiskUsage struct {
+	Device      string // Device is the block device or pseudo device name of the file system.
+	MountPoint  string // MountPoint is the directory where the file system is mounted.
+	FSType      string // FSType is the type of file system, e.g. ext4.
+	UsedKB      int64
+	FreeKB      int64
+	TotalKB     int64
+	UsedInodes  int64
+	FreeInodes  int64
+	TotalInodes int64
+}
+
+/*
+pseudoFSTypes are the types of kernel pseudo file systems that do not store user data, they are excluded from disk
+usage reports.
+*/
+var pseudoFSTypes = map[string]bool{
+	"autofs": true, "binfmt_misc": true, "bpf": true, "cgroup": true, "cgroup2": true, "configfs": true,
+	"debugfs": true, "devpts": true, "devtmpfs": true, "fusectl": true, "hugetlbfs": true, "mqueue": true,
+	"nsfs": true, "proc": true, "pstore": true, "securityfs": true, "sysfs": true,
+	"tracefs": true, "efivarfs": true, "rpc_pipefs": true, "selinuxfs": true,
+}
+
+/*
+GetAllDiskUsage returns space and inode usage of all mounted file systems that store data, excluding kernel pseudo file
+systems and duplicated mounts of the same block device or directory. If the mount table cannot be read (e.g. on MacOS), the
+function returns usage of the file system mounted on / alone. On Windows the function returns an empty slice.
+*/
+func GetAllDiskUsage() (ret []DiskUsage) {
+	ret = make([]DiskUsage, 0, 8)
+	mounts, err := ioutil.ReadFile(ProcMountsPath)
+	if err != nil {
+		if usage, ok := getFileSystemUsage("/"); ok {
+			ret = append(ret, usage)
+		}
+		return
+	}
+	seenDevices := make(map[string]bool)
+	seenMountPoints := make(map[string]bool)
+	for _, entry := range ParseMounts(string(mounts)) {
+		if pseudoFSTypes[entry.FSType] || seenMountPoints[entry.MountPoint] {
+			continue
+		}
+		seenMountPoints[entry.MountPoint] = true
+		// Bind mounts of a block device would otherwise show up multiple times
+		if strings.HasPrefix(entry.Device, "/") {
+			if seenDevices[entry.Device] {
+				continue
+			}
+			seenDevices[entry.Device] = true
+		}
+		usage, ok := getFileSystemUsage(entry.MountPoint)
+		if !ok || usage.TotalKB == 0 {
+			continue
+		}
+		usage.Device = entry.Device
+		usage.FSType = entry.FSType
+		ret = append(ret, usage)
+	}
+	return
+}
+
+// ParseMounts returns device, mount point, and file system type of each entry in the content of a mount table file.
+func ParseMounts(content string) (ret []DiskUsage) {
+	ret = make([]DiskUsage, 0, 32)
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		ret = append(ret, DiskUsage{
+			Device:     unescapeMountField(fields[0]),
+			MountPoint: unescapeMountField(fields[1]),
+			FSType:     fields[2],
+		})
+	}
+	return
+}
+
+// unescapeMountField decodes octal escape sequences (e.g. \040 for space) used by the kernel in mount table fields.
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	var ret strings.Builder
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+4 <= len(field) {
+			if char, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				ret.WriteByte(byte(char))
+				i += 3
+				continue
+			}
+		}
+		ret.WriteByte(field[i])
+	}
+	return ret.String()
+}
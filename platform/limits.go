@@ -0,0 +1,92 @@
+package platform
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+// ProgramLimits restrict the system resources that an external program may consume. A zero value means unlimited.
+type ProgramLimits struct {
+	CPUTimeSec int `json:"CPUTimeSec"` // CPUTimeSec is the maximum amount of CPU time in seconds.
+	MemoryMB   int `json:"MemoryMB"`   // MemoryMB is the maximum size of virtual memory in megabytes.
+	FileSizeMB int `json:"FileSizeMB"` // FileSizeMB is the maximum size of a file the program may write in megabytes.
+	NumFiles   int `json:"NumFiles"`   // NumFiles is the maximum number of open file descriptors.
+	/*
+		TransientCgroup additionally runs the program in a transient cgroup created by systemd, the cgroup restricts the
+		program's memory usage (MemoryMB) and CPU usage (CPUPercent) together with all of its child processes. The option
+		takes effect only if laitos runs as root on a system managed by systemd.
+	*/
+	TransientCgroup bool `json:"TransientCgroup"`
+	// CPUPercent is the maximum percentage of a single CPU's time the transient cgroup may use, e.g. 150 for 1.5 CPUs.
+	CPUPercent int `json:"CPUPercent"`
+}
+
+// IsEmpty returns true if there is no limit to apply.
+func (limits ProgramLimits) IsEmpty() bool {
+	return limits.CPUTimeSec <= 0 && limits.MemoryMB <= 0 && limits.FileSizeMB <= 0 && limits.NumFiles <= 0 &&
+		(!limits.TransientCgroup || limits.MemoryMB <= 0 && limits.CPUPercent <= 0)
+}
+
+/*
+ulimitCommands returns the POSIX shell commands that set resource limits on the shell process, and the limits are
+inherited by the program the shell executes.
+*/
+func (limits ProgramLimits) ulimitCommands() (ret []string) {
+	if limits.CPUTimeSec > 0 {
+		ret = append(ret, fmt.Sprintf("ulimit -t %d", limits.CPUTimeSec))
+	}
+	if limits.MemoryMB > 0 {
+		ret = append(ret, fmt.Sprintf("ulimit -v %d", limits.MemoryMB*1024))
+	}
+	if limits.FileSizeMB > 0 {
+		// POSIX shells measure file size in blocks of 512 bytes
+		ret = append(ret, fmt.Sprintf("ulimit -f %d", limits.FileSizeMB*2048))
+	}
+	if limits.NumFiles > 0 {
+		ret = append(ret, fmt.Sprintf("ulimit -n %d", limits.NumFiles))
+	}
+	return
+}
+
+// canUseTransientCgroup returns true only if laitos runs as root on a system managed by systemd.
+func canUseTransientCgroup() bool {
+	if os.Getuid() != 0 {
+		return false
+	}
+	if _, err := os.Stat("/run/systemd/system"); err != nil {
+		return false
+	}
+	_, err := exec.LookPath("systemd-run")
+	return err == nil
+}
+
+/*
+wrapInTransientCgroup returns the program and arguments that run the input program in a transient systemd scope that
+enforces the memory and CPU limits, and true if the program is wrapped. If transient cgroup is not desired or not
+available, the input program and arguments are returned as-is.
+Only root may create the scope, hence if the program is to run as another user, systemd-run switches to the user
+after placing the program in the scope, and the caller must not change the credential of systemd-run itself.
+*/
+func (limits ProgramLimits) wrapInTransientCgroup(program string, args []string, runAsUser string) (string, []string, bool) {
+	if !limits.TransientCgroup || (limits.MemoryMB <= 0 && limits.CPUPercent <= 0) || !canUseTransientCgroup() {
+		return program, args, false
+	}
+	return "systemd-run", limits.transientCgroupArgs(program, args, runAsUser), true
+}
+
+// transientCgroupArgs returns the systemd-run arguments that run the program in a transient scope, optionally as another user.
+func (limits ProgramLimits) transientCgroupArgs(program string, args []string, runAsUser string) []string {
+	scopeArgs := []string{"--scope", "--quiet"}
+	if runAsUser != "" {
+		scopeArgs = append(scopeArgs, "--uid="+runAsUser)
+	}
+	if limits.MemoryMB > 0 {
+		scopeArgs = append(scopeArgs, "-p", fmt.Sprintf("MemoryMax=%dM", limits.MemoryMB))
+	}
+	if limits.CPUPercent > 0 {
+		scopeArgs = append(scopeArgs, "-p", fmt.Sprintf("CPUQuota=%d%%", limits.CPUPercent))
+	}
+	scopeArgs = append(scopeArgs, "--", program)
+	return append(scopeArgs, args...)
+}
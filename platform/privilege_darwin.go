@@ -0,0 +1,37 @@
+package platform
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+/*
+DropPrivileges switches laitos process from root to the unprivileged user, along with the user's primary group and
+supplementary groups. MacOS does not support retaining the capability to listen on privileged ports, hence
+keepNetBindService is ignored. This is not reversible.
+*/
+func DropPrivileges(userName string, _ bool) error {
+	if os.Getuid() != 0 {
+		return fmt.Errorf("DropPrivileges: laitos is not running as root")
+	}
+	cred, _, err := getUserCredential(userName)
+	if err != nil {
+		return fmt.Errorf("DropPrivileges: failed to look up user \"%s\" - %v", userName, err)
+	}
+	groups := make([]int, 0, len(cred.Groups))
+	for _, gid := range cred.Groups {
+		groups = append(groups, int(gid))
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("DropPrivileges: failed to set supplementary groups - %v", err)
+	}
+	if err := syscall.Setgid(int(cred.Gid)); err != nil {
+		return fmt.Errorf("DropPrivileges: failed to set group ID - %v", err)
+	}
+	if err := syscall.Setuid(int(cred.Uid)); err != nil {
+		return fmt.Errorf("DropPrivileges: failed to set user ID - %v", err)
+	}
+	logger.Info("DropPrivileges", userName, nil, "now running as UID %d GID %d", os.Getuid(), os.Getgid())
+	return nil
+}
@@ -0,0 +1,75 @@
+package platform
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	linuxPRSetKeepCaps        = 8          // PR_SET_KEEPCAPS
+	linuxCapabilityVersion3   = 0x20080522 // _LINUX_CAPABILITY_VERSION_3
+	linuxCapNetBindService    = 10         // CAP_NET_BIND_SERVICE
+	linuxCapabilityDataLength = 2          // _LINUX_CAPABILITY_U32S_3
+)
+
+// linuxCapHeader is the __user_cap_header_struct of capset system call.
+type linuxCapHeader struct {
+	Version uint32
+	PID     int32
+}
+
+// linuxCapData is the __user_cap_data_struct of capset system call.
+type linuxCapData struct {
+	Effective   uint32
+	Permitted   uint32
+	Inheritable uint32
+}
+
+/*
+DropPrivileges switches laitos process from root to the unprivileged user, along with the user's primary group and
+supplementary groups. If keepNetBindService is true, the process retains the capability to listen on privileged ports
+(below 1024) so that daemons may still restart after the privileges are dropped. This is not reversible.
+*/
+func DropPrivileges(userName string, keepNetBindService bool) error {
+	if os.Getuid() != 0 {
+		return fmt.Errorf("DropPrivileges: laitos is not running as root")
+	}
+	cred, _, err := getUserCredential(userName)
+	if err != nil {
+		return fmt.Errorf("DropPrivileges: failed to look up user \"%s\" - %v", userName, err)
+	}
+	if keepNetBindService {
+		// Keep the permitted capabilities across the change of user ID, they are narrowed down afterwards.
+		if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, linuxPRSetKeepCaps, 1, 0); errno != 0 {
+			logger.Warning("DropPrivileges", userName, errno, "unable to retain capability to listen on privileged ports")
+			keepNetBindService = false
+		}
+	}
+	groups := make([]int, 0, len(cred.Groups))
+	for _, gid := range cred.Groups {
+		groups = append(groups, int(gid))
+	}
+	if err := syscall.Setgroups(groups); err != nil {
+		return fmt.Errorf("DropPrivileges: failed to set supplementary groups - %v", err)
+	}
+	if err := syscall.Setgid(int(cred.Gid)); err != nil {
+		return fmt.Errorf("DropPrivileges: failed to set group ID - %v", err)
+	}
+	if err := syscall.Setuid(int(cred.Uid)); err != nil {
+		return fmt.Errorf("DropPrivileges: failed to set user ID - %v", err)
+	}
+	if keepNetBindService {
+		header := linuxCapHeader{Version: linuxCapabilityVersion3}
+		data := [linuxCapabilityDataLength]linuxCapData{}
+		data[0].Effective = 1 << linuxCapNetBindService
+		data[0].Permitted = 1 << linuxCapNetBindService
+		if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_CAPSET,
+			uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+			return fmt.Errorf("DropPrivileges: failed to retain capability to listen on privileged ports - %v", errno)
+		}
+	}
+	logger.Info("DropPrivileges", userName, nil, "now running as UID %d GID %d", os.Getuid(), os.Getgid())
+	return nil
+}
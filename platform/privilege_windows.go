@@ -0,0 +1,8 @@
+package platform
+
+import "errors"
+
+// DropPrivileges is not supported on Windows.
+func DropPrivileges(_ string, _ bool) error {
+	return errors.New("DropPrivileges: dropping privileges is not supported on Windows")
+}
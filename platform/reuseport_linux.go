@@ -0,0 +1,14 @@
+package platform
+
+import "syscall"
+
+// SetReusePort turns on SO_REUSEPORT for the socket, allowing several sockets to bind to the same address and port.
+func SetReusePort(conn syscall.RawConn) error {
+	var sockErr error
+	if err := conn.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, linuxSOReusePort, 1)
+	}); err != nil {
+		return err
+	}
+	return sockErr
+}
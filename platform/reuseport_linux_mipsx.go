@@ -0,0 +1,8 @@
+//go:build linux && (mips || mipsle || mips64 || mips64le)
+// +build linux
+// +build mips mipsle mips64 mips64le
+
+package platform
+
+// linuxSOReusePort is SO_REUSEPORT on MIPS.
+const linuxSOReusePort = 0x200
@@ -0,0 +1,11 @@
+package platform
+
+import (
+	"errors"
+	"syscall"
+)
+
+// SetReusePort is not supported on Windows.
+func SetReusePort(_ syscall.RawConn) error {
+	return errors.New("SetReusePort: SO_REUSEPORT is not supported on Windows")
+}
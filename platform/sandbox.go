@@ -0,0 +1,62 @@
+package platform
+
+import (
+	"os"
+)
+
+/*
+Sandbox is an optional hardening mode that restricts laitos process after initialisation, it offers defence in depth on
+hosts exposed to the Internet. The restrictions also apply to all programs started by laitos, including shell commands.
+Sandbox is only supported on Linux.
+*/
+type Sandbox struct {
+	/*
+		Seccomp installs a seccomp-bpf filter that denies system calls laitos never needs, such as ptrace, loading kernel
+		modules, mounting file systems, and rebooting the computer.
+	*/
+	Seccomp bool `json:"Seccomp"`
+	// Landlock restricts file system access to the read-only and read-write paths. It requires Linux kernel 5.13 or newer.
+	Landlock bool `json:"Landlock"`
+	// LandlockReadOnlyPaths are the files and directories that may be read and executed. The default is "/".
+	LandlockReadOnlyPaths []string `json:"LandlockReadOnlyPaths"`
+	/*
+		LandlockReadWritePaths are the files and directories that may be modified. The default is the working directory,
+		the temporary directory, and /dev/null.
+	*/
+	LandlockReadWritePaths []string `json:"LandlockReadWritePaths"`
+}
+
+// IsEnabled returns true if any of the sandbox restrictions are to be applied.
+func (sandbox Sandbox) IsEnabled() bool {
+	return sandbox.Seccomp || sandbox.Landlock
+}
+
+/*
+Apply restricts laitos process (all of its threads) and its future child processes according to the sandbox
+configuration. The restrictions cannot be lifted afterwards.
+*/
+func (sandbox Sandbox) Apply() error {
+	if sandbox.Landlock {
+		readOnly, readWrite := sandbox.LandlockReadOnlyPaths, sandbox.LandlockReadWritePaths
+		if len(readOnly) == 0 {
+			readOnly = []string{"/"}
+		}
+		if len(readWrite) == 0 {
+			readWrite = []string{os.TempDir(), os.DevNull}
+			if workDir, err := os.Getwd(); err == nil {
+				readWrite = append(readWrite, workDir)
+			}
+		}
+		if err := applyLandlock(readOnly, readWrite); err != nil {
+			return err
+		}
+		logger.Info("Apply", "", nil, "restricted file system access to read-only %v and read-write %v", readOnly, readWrite)
+	}
+	if sandbox.Seccomp {
+		if err := applySeccomp(); err != nil {
+			return err
+		}
+		logger.Info("Apply", "", nil, "installed seccomp filter")
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package platform
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	linuxPRSetNoNewPrivs = 38 // PR_SET_NO_NEW_PRIVS
+
+	// The system call numbers of Landlock are identical across all architectures.
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+	landlockRulePathBeneath  = 1        // LANDLOCK_RULE_PATH_BENEATH
+	linuxOPath               = 0x200000 // O_PATH
+
+	// Landlock ABI version 1 file system access rights
+	landlockAccessExecute    = 1 << 0
+	landlockAccessWriteFile  = 1 << 1
+	landlockAccessReadFile   = 1 << 2
+	landlockAccessReadDir    = 1 << 3
+	landlockAccessRemoveDir  = 1 << 4
+	landlockAccessRemoveFile = 1 << 5
+	landlockAccessMakeChar   = 1 << 6
+	landlockAccessMakeDir    = 1 << 7
+	landlockAccessMakeReg    = 1 << 8
+	landlockAccessMakeSock   = 1 << 9
+	landlockAccessMakeFifo   = 1 << 10
+	landlockAccessMakeBlock  = 1 << 11
+	landlockAccessMakeSym    = 1 << 12
+	landlockAccessAll        = 1<<13 - 1
+	landlockAccessReadOnly   = landlockAccessExecute | landlockAccessReadFile | landlockAccessReadDir
+	// landlockAccessFile are the only access rights applicable to a file as opposed to a directory.
+	landlockAccessFile = landlockAccessExecute | landlockAccessWriteFile | landlockAccessReadFile
+
+	seccompSetModeFilter  = 1          // SECCOMP_SET_MODE_FILTER
+	seccompFlagTSync      = 1          // SECCOMP_FILTER_FLAG_TSYNC
+	seccompRetAllow       = 0x7fff0000 // SECCOMP_RET_ALLOW
+	seccompRetErrno       = 0x00050000 // SECCOMP_RET_ERRNO
+	bpfLoadWordAbsolute   = 0x20       // BPF_LD | BPF_W | BPF_ABS
+	bpfJumpEqualConstant  = 0x15       // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJumpGEConstant     = 0x35       // BPF_JMP | BPF_JGE | BPF_K
+	bpfReturnConstant     = 0x06       // BPF_RET | BPF_K
+	seccompDataNrOffset   = 0          // offsetof(struct seccomp_data, nr)
+	seccompDataArchOffset = 4          // offsetof(struct seccomp_data, arch)
+)
+
+// landlockRulesetAttr is the landlock_ruleset_attr structure.
+type landlockRulesetAttr struct {
+	HandledAccessFS uint64
+}
+
+// landlockPathBeneathAttr is the landlock_path_beneath_attr structure, the kernel reads it without padding.
+type landlockPathBeneathAttr struct {
+	AllowedAccess uint64
+	ParentFD      int32
+}
+
+// bpfInstruction is the sock_filter structure of a classic BPF instruction.
+type bpfInstruction struct {
+	Code uint16
+	JT   uint8
+	JF   uint8
+	K    uint32
+}
+
+// bpfProgram is the sock_fprog structure.
+type bpfProgram struct {
+	Len    uint16
+	Filter *bpfInstruction
+}
+
+// setNoNewPrivs prevents all threads and their child processes from gaining privileges, e.g. via setuid executables.
+func setNoNewPrivs() error {
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, linuxPRSetNoNewPrivs, 1, 0); errno == syscall.ENOTSUP {
+		// Go runtime cannot run a system call on all threads when cgo is used.
+		return fmt.Errorf("sandbox requires laitos to be built with CGO_ENABLED=0")
+	} else if errno != 0 {
+		return fmt.Errorf("failed to set no_new_privs - %v", errno)
+	}
+	return nil
+}
+
+// addLandlockRule allows the access rights to the path and everything beneath it.
+func addLandlockRule(rulesetFD uintptr, path string, access uint64) error {
+	fd, err := syscall.Open(path, linuxOPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open \"%s\" - %v", path, err)
+	}
+	defer syscall.Close(fd)
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(fd, &stat); err != nil {
+		return fmt.Errorf("failed to stat \"%s\" - %v", path, err)
+	}
+	if stat.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		access &= landlockAccessFile
+	}
+	attr := landlockPathBeneathAttr{AllowedAccess: access, ParentFD: int32(fd)}
+	if _, _, errno := syscall.Syscall6(sysLandlockAddRule,
+		rulesetFD, landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr)), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("failed to add rule for \"%s\" - %v", path, errno)
+	}
+	return nil
+}
+
+// applyLandlock restricts file system access of all threads to the read-only and read-write paths.
+func applyLandlock(readOnlyPaths, readWritePaths []string) error {
+	attr := landlockRulesetAttr{HandledAccessFS: landlockAccessAll}
+	rulesetFD, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("applyLandlock: Landlock is not available - %v", errno)
+	}
+	defer syscall.Close(int(rulesetFD))
+	for _, path := range readOnlyPaths {
+		if err := addLandlockRule(rulesetFD, path, landlockAccessReadOnly); err != nil {
+			return fmt.Errorf("applyLandlock: %v", err)
+		}
+	}
+	for _, path := range readWritePaths {
+		if err := addLandlockRule(rulesetFD, path, landlockAccessAll); err != nil {
+			return fmt.Errorf("applyLandlock: %v", err)
+		}
+	}
+	if err := setNoNewPrivs(); err != nil {
+		return fmt.Errorf("applyLandlock: %v", err)
+	}
+	// Landlock restricts the calling thread only, hence restrict each and every thread.
+	if _, _, errno := syscall.AllThreadsSyscall(sysLandlockRestrictSelf, rulesetFD, 0, 0); errno != 0 {
+		return fmt.Errorf("applyLandlock: failed to restrict threads - %v", errno)
+	}
+	return nil
+}
+
+/*
+buildSeccompFilter returns the seccomp filter program that denies the system calls laitos never needs with EPERM. The
+system calls of a foreign architecture (e.g. i386 system calls made via "int 0x80" on amd64) and of the x32 ABI are
+denied altogether, otherwise they would get past the native system call numbers on the deny list.
+*/
+func buildSeccompFilter() []bpfInstruction {
+	filter := []bpfInstruction{
+		{Code: bpfLoadWordAbsolute, K: seccompDataArchOffset},
+		{Code: bpfJumpEqualConstant, JT: 1, JF: 0, K: seccompAuditArch},
+		{Code: bpfReturnConstant, K: seccompRetErrno | uint32(syscall.EPERM)},
+		{Code: bpfLoadWordAbsolute, K: seccompDataNrOffset},
+	}
+	if seccompX32SyscallBit != 0 {
+		filter = append(filter,
+			bpfInstruction{Code: bpfJumpGEConstant, JT: 0, JF: 1, K: seccompX32SyscallBit},
+			bpfInstruction{Code: bpfReturnConstant, K: seccompRetErrno | uint32(syscall.EPERM)})
+	}
+	for _, nr := range seccompDeniedSyscalls {
+		filter = append(filter,
+			bpfInstruction{Code: bpfJumpEqualConstant, JT: 0, JF: 1, K: nr},
+			bpfInstruction{Code: bpfReturnConstant, K: seccompRetErrno | uint32(syscall.EPERM)})
+	}
+	return append(filter, bpfInstruction{Code: bpfReturnConstant, K: seccompRetAllow})
+}
+
+// applySeccomp installs a seccomp filter on all threads, the filter denies the system calls laitos never needs.
+func applySeccomp() error {
+	if seccompAuditArch == 0 {
+		return fmt.Errorf("applySeccomp: seccomp filter is not available on %s", runtime.GOARCH)
+	}
+	filter := buildSeccompFilter()
+	program := bpfProgram{Len: uint16(len(filter)), Filter: &filter[0]}
+	if err := setNoNewPrivs(); err != nil {
+		return fmt.Errorf("applySeccomp: %v", err)
+	}
+	// The TSYNC flag installs the filter on all threads
+	if _, _, errno := syscall.Syscall(sysSeccomp,
+		seccompSetModeFilter, seccompFlagTSync, uintptr(unsafe.Pointer(&program))); errno != 0 {
+		return fmt.Errorf("applySeccomp: failed to install seccomp filter - %v", errno)
+	}
+	return nil
+}
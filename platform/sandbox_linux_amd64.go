@@ -0,0 +1,37 @@
+package platform
+
+const (
+	seccompAuditArch = 0xc000003e // AUDIT_ARCH_X86_64
+	sysSeccomp       = 317
+	/*
+		seccompX32SyscallBit is __X32_SYSCALL_BIT. The system calls of x32 ABI share the audit architecture of x86-64,
+		and their numbers carry the bit in addition to the native numbers.
+	*/
+	seccompX32SyscallBit = 0x40000000
+)
+
+// seccompDeniedSyscalls are the system calls that the seccomp filter denies on x86-64.
+var seccompDeniedSyscalls = []uint32{
+	101, // ptrace
+	310, // process_vm_readv
+	311, // process_vm_writev
+	175, // init_module
+	313, // finit_module
+	176, // delete_module
+	246, // kexec_load
+	320, // kexec_file_load
+	165, // mount
+	166, // umount2
+	155, // pivot_root
+	167, // swapon
+	169, // reboot
+	163, // acct
+	321, // bpf
+	298, // perf_event_open
+	248, // add_key
+	249, // request_key
+	250, // keyctl
+	323, // userfaultfd
+	172, // iopl
+	173, // ioperm
+}
@@ -0,0 +1,92 @@
+package platform
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// runSeccompFilter evaluates the classic BPF filter program against the system call of the architecture and number.
+func runSeccompFilter(t *testing.T, filter []bpfInstruction, arch, nr uint32) uint32 {
+	var acc uint32
+	for pc := 0; pc < len(filter); pc++ {
+		insn := filter[pc]
+		switch insn.Code {
+		case bpfLoadWordAbsolute:
+			switch insn.K {
+			case seccompDataArchOffset:
+				acc = arch
+			case seccompDataNrOffset:
+				acc = nr
+			default:
+				t.Fatalf("unexpected offset %d", insn.K)
+			}
+		case bpfJumpEqualConstant, bpfJumpGEConstant:
+			if (insn.Code == bpfJumpEqualConstant && acc == insn.K) || (insn.Code == bpfJumpGEConstant && acc >= insn.K) {
+				pc += int(insn.JT)
+			} else {
+				pc += int(insn.JF)
+			}
+		case bpfReturnConstant:
+			return insn.K
+		default:
+			t.Fatalf("unexpected instruction %+v", insn)
+		}
+	}
+	t.Fatal("the filter did not return")
+	return 0
+}
+
+func TestBuildSeccompFilter(t *testing.T) {
+	filter := buildSeccompFilter()
+	denied := seccompRetErrno | uint32(syscall.EPERM)
+	// Native system calls are allowed unless they are on the deny list
+	if ret := runSeccompFilter(t, filter, seccompAuditArch, syscall.SYS_GETPID); ret != seccompRetAllow {
+		t.Fatalf("%x", ret)
+	}
+	for _, nr := range seccompDeniedSyscalls {
+		if ret := runSeccompFilter(t, filter, seccompAuditArch, nr); ret != denied {
+			t.Fatalf("%d: %x", nr, ret)
+		}
+	}
+	// i386 system calls (AUDIT_ARCH_I386) are denied, even those of a harmless number.
+	if ret := runSeccompFilter(t, filter, 0x40000003, 20); ret != denied {
+		t.Fatalf("%x", ret)
+	}
+	// x32 system calls are denied
+	if ret := runSeccompFilter(t, filter, seccompAuditArch, seccompX32SyscallBit|syscall.SYS_GETPID); ret != denied {
+		t.Fatalf("%x", ret)
+	}
+}
+
+func TestSandboxSeccompX32(t *testing.T) {
+	// The seccomp filter cannot be lifted, hence apply it to a copy of the test program.
+	cmd := exec.Command(os.Args[0], "-test.run=TestSandboxSeccompX32Helper")
+	cmd.Env = append(os.Environ(), "LAITOS_TEST_SANDBOX_X32=1")
+	out, err := cmd.CombinedOutput()
+	if strings.Contains(string(out), "CGO_ENABLED=0") {
+		t.Skip("seccomp filter is not available in this build", string(out))
+	}
+	if err != nil {
+		t.Fatal(err, string(out))
+	}
+}
+
+func TestSandboxSeccompX32Helper(t *testing.T) {
+	if os.Getenv("LAITOS_TEST_SANDBOX_X32") == "" {
+		t.Skip("this is a helper of TestSandboxSeccompX32")
+	}
+	if err := (Sandbox{Seccomp: true}).Apply(); err != nil {
+		t.Fatal(err)
+	}
+	// The x32 variant of a system call must not get past the seccomp filter
+	if _, _, errno := syscall.RawSyscall(seccompX32SyscallBit|syscall.SYS_GETPID, 0, 0, 0); errno != syscall.EPERM {
+		t.Fatal("should have denied x32 system call", errno)
+	}
+	// Native system calls that are not on the deny list continue to work
+	if pid, _, errno := syscall.RawSyscall(syscall.SYS_GETPID, 0, 0, 0); errno != 0 || int(pid) != os.Getpid() {
+		t.Fatal(pid, errno)
+	}
+}
@@ -0,0 +1,31 @@
+package platform
+
+const (
+	seccompAuditArch     = 0xc00000b7 // AUDIT_ARCH_AARCH64
+	sysSeccomp           = 277
+	seccompX32SyscallBit = 0 // there is not an x32 ABI on arm64
+)
+
+// seccompDeniedSyscalls are the system calls that the seccomp filter denies on arm64.
+var seccompDeniedSyscalls = []uint32{
+	117, // ptrace
+	270, // process_vm_readv
+	271, // process_vm_writev
+	105, // init_module
+	273, // finit_module
+	106, // delete_module
+	104, // kexec_load
+	294, // kexec_file_load
+	40,  // mount
+	39,  // umount2
+	41,  // pivot_root
+	224, // swapon
+	142, // reboot
+	89,  // acct
+	280, // bpf
+	241, // perf_event_open
+	217, // add_key
+	218, // request_key
+	219, // keyctl
+	282, // userfaultfd
+}
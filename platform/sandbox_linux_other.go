@@ -0,0 +1,12 @@
+//go:build linux && !amd64 && !arm64
+// +build linux,!amd64,!arm64
+
+package platform
+
+const (
+	seccompAuditArch     = 0 // seccomp filter is not implemented for this architecture
+	sysSeccomp           = 0
+	seccompX32SyscallBit = 0
+)
+
+var seccompDeniedSyscalls []uint32
@@ -0,0 +1,62 @@
+package platform
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestSandbox(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		if err := (Sandbox{Seccomp: true}).Apply(); err == nil {
+			t.Fatal("should have failed")
+		}
+		return
+	}
+	if (Sandbox{}).IsEnabled() || !(Sandbox{Landlock: true}).IsEnabled() {
+		t.Fatal("wrong IsEnabled")
+	}
+	// The sandbox cannot be lifted, hence apply it to a copy of the test program.
+	tmpDir, err := ioutil.TempDir("", "laitos-TestSandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+	cmd := exec.Command(os.Args[0], "-test.run=TestSandboxHelper")
+	cmd.Env = append(os.Environ(), "LAITOS_TEST_SANDBOX_DIR="+tmpDir)
+	out, err := cmd.CombinedOutput()
+	if strings.Contains(string(out), "Landlock is not available") || strings.Contains(string(out), "CGO_ENABLED=0") {
+		t.Skip("sandbox is not available on this system or build", string(out))
+	}
+	if err != nil {
+		t.Fatal(err, string(out))
+	}
+}
+
+func TestSandboxHelper(t *testing.T) {
+	tmpDir := os.Getenv("LAITOS_TEST_SANDBOX_DIR")
+	if tmpDir == "" {
+		t.Skip("this is a helper of TestSandbox")
+	}
+	sandbox := Sandbox{Seccomp: true, Landlock: true, LandlockReadWritePaths: []string{path.Join(tmpDir)}}
+	if err := sandbox.Apply(); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(tmpDir, "a"), []byte("a"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadFile("/proc/self/status"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path.Join(os.TempDir(), "laitos-TestSandboxHelper"), []byte("a"), 0600); err == nil {
+		t.Fatal("should not have been able to write outside of read-write paths")
+	}
+	// Child processes inherit the restrictions, and mount is denied by seccomp filter.
+	if out, err := InvokeProgram(nil, 10, "mount", "-t", "tmpfs", "tmpfs", tmpDir); err == nil {
+		t.Fatal("should not have been able to mount", out)
+	}
+}
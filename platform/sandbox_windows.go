@@ -0,0 +1,15 @@
+package platform
+
+import "errors"
+
+var errSandboxLinuxOnly = errors.New("sandbox is only supported on Linux")
+
+// applyLandlock is only supported on Linux.
+func applyLandlock(_, _ []string) error {
+	return errSandboxLinuxOnly
+}
+
+// applySeccomp is only supported on Linux.
+func applySeccomp() error {
+	return errSandboxLinuxOnly
+}
@@ -0,0 +1,131 @@
+package platform
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	SDNotifySocketEnv   = "NOTIFY_SOCKET" // SDNotifySocketEnv is the environment variable that tells the systemd notification socket.
+	SDWatchdogUSecEnv   = "WATCHDOG_USEC" // SDWatchdogUSecEnv is the environment variable that tells the watchdog timeout in microseconds.
+	SDWatchdogPIDEnv    = "WATCHDOG_PID"  // SDWatchdogPIDEnv is the environment variable that tells the process expected to ping the watchdog.
+	SDNotifyReady       = "READY=1"       // SDNotifyReady tells systemd that the service has completed its start up.
+	SDNotifyStopping    = "STOPPING=1"    // SDNotifyStopping tells systemd that the service is shutting down.
+	SDNotifyWatchdog    = "WATCHDOG=1"    // SDNotifyWatchdog pings the systemd watchdog to tell that the service is alive.
+	sdNotifyDialTimeout = 3 * time.Second
+
+	SDListenPIDEnv     = "LISTEN_PID"     // SDListenPIDEnv is the environment variable that tells the process expected to use the activated sockets.
+	SDListenFDsEnv     = "LISTEN_FDS"     // SDListenFDsEnv is the environment variable that tells the number of activated sockets.
+	SDListenFDNamesEnv = "LISTEN_FDNAMES" // SDListenFDNamesEnv is the environment variable that tells the colon-separated names of activated sockets.
+	/*
+		SupervisorListenPPIDEnv is the environment variable set by the supervisor in place of LISTEN_PID when it passes the
+		activated sockets down to the main program. The supervisor cannot know the PID of the main program before starting
+		it, hence the main program checks that the PID of its parent matches instead.
+	*/
+	SupervisorListenPPIDEnv = "LAITOS_SUPERVISOR_LISTEN_PPID"
+	/*
+		SupervisorNotifyFDEnv is the environment variable that carries the file descriptor of a pipe to the supervisor, the
+		main program writes its state notifications into the pipe one per line, and the supervisor relays them to systemd.
+	*/
+	SupervisorNotifyFDEnv = "LAITOS_SUPERVISOR_NOTIFY_FD"
+)
+
+var (
+	supervisorNotifyPipe     *os.File
+	supervisorNotifyPipeOnce = new(sync.Once)
+)
+
+/*
+SDNotify sends a state notification (e.g. SDNotifyReady) to systemd, or to the supervisor that relays it to systemd.
+The function returns false without an error if laitos was not started by a systemd service of Type=notify, and in that
+case there is nothing to notify.
+*/
+func SDNotify(state string) (bool, error) {
+	socketAddr := os.Getenv(SDNotifySocketEnv)
+	if socketAddr == "" {
+		return notifySupervisor(state)
+	}
+	// An address beginning with "@" is in the abstract namespace
+	if socketAddr[0] == '@' {
+		socketAddr = "\x00" + socketAddr[1:]
+	}
+	conn, err := net.DialTimeout("unixgram", socketAddr, sdNotifyDialTimeout)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+/*
+notifySupervisor writes the state notification into the pipe given by the supervisor. The function returns false
+without an error if this program is not started by a supervisor.
+*/
+func notifySupervisor(state string) (bool, error) {
+	// The pipe is opened once and kept open, as the file is closed when it is garbage collected.
+	supervisorNotifyPipeOnce.Do(func() {
+		if fd, err := strconv.Atoi(os.Getenv(SupervisorNotifyFDEnv)); err == nil && fd > 2 {
+			supervisorNotifyPipe = os.NewFile(uintptr(fd), "supervisor-notify")
+		}
+	})
+	if supervisorNotifyPipe == nil {
+		return false, nil
+	}
+	if _, err := supervisorNotifyPipe.Write([]byte(state + "\n")); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+/*
+SDWatchdogInterval returns the watchdog timeout configured by systemd (WatchdogSec) for this process. It returns 0 if
+the watchdog is not enabled or it expects another process to ping it.
+*/
+func SDWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv(SDWatchdogUSecEnv), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pidStr := os.Getenv(SDWatchdogPIDEnv); pidStr != "" {
+		if pid, err := strconv.Atoi(pidStr); err != nil || pid != os.Getpid() {
+			return 0
+		}
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+/*
+StartSDWatchdog notifies systemd of readiness, and then pings the systemd watchdog at half of its timeout interval for
+as long as isAlive returns true. The function returns immediately and the pings are sent by a background goroutine.
+*/
+func StartSDWatchdog(isAlive func() bool) {
+	if notified, err := SDNotify(SDNotifyReady); err != nil {
+		logger.Warning("StartSDWatchdog", "", err, "failed to notify systemd of readiness")
+	} else if notified {
+		logger.Info("StartSDWatchdog", "", nil, "notified systemd of readiness")
+	}
+	interval := SDWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	logger.Info("StartSDWatchdog", "", nil, "pinging systemd watchdog every %s", (interval / 2).String())
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for range ticker.C {
+			if isAlive != nil && !isAlive() {
+				logger.Warning("StartSDWatchdog", "", nil, "skipped a watchdog ping because the program is not healthy")
+				continue
+			}
+			if _, err := SDNotify(SDNotifyWatchdog); err != nil {
+				logger.Warning("StartSDWatchdog", "", err, "failed to ping systemd watchdog")
+			}
+		}
+	}()
+}
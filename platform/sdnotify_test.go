@@ -0,0 +1,60 @@
+package platform
+
+import (
+	"net"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSDNotify(t *testing.T) {
+	os.Unsetenv(SDNotifySocketEnv)
+	if notified, err := SDNotify(SDNotifyReady); notified || err != nil {
+		t.Fatal(notified, err)
+	}
+	if runtime.GOOS == "windows" {
+		return
+	}
+	socketPath := path.Join(os.TempDir(), "laitos-sdnotify-test-"+strconv.Itoa(os.Getpid()))
+	defer os.Remove(socketPath)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	os.Setenv(SDNotifySocketEnv, socketPath)
+	defer os.Unsetenv(SDNotifySocketEnv)
+	if notified, err := SDNotify(SDNotifyReady); !notified || err != nil {
+		t.Fatal(notified, err)
+	}
+	buf := make([]byte, 64)
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != SDNotifyReady {
+		t.Fatal(err, string(buf[:n]))
+	}
+}
+
+func TestSDWatchdogInterval(t *testing.T) {
+	defer os.Unsetenv(SDWatchdogUSecEnv)
+	defer os.Unsetenv(SDWatchdogPIDEnv)
+	os.Unsetenv(SDWatchdogUSecEnv)
+	if interval := SDWatchdogInterval(); interval != 0 {
+		t.Fatal(interval)
+	}
+	os.Setenv(SDWatchdogUSecEnv, "30000000")
+	if interval := SDWatchdogInterval(); interval != 30*time.Second {
+		t.Fatal(interval)
+	}
+	os.Setenv(SDWatchdogPIDEnv, strconv.Itoa(os.Getpid()+1))
+	if interval := SDWatchdogInterval(); interval != 0 {
+		t.Fatal(interval)
+	}
+	os.Setenv(SDWatchdogPIDEnv, strconv.Itoa(os.Getpid()))
+	if interval := SDWatchdogInterval(); interval != 30*time.Second {
+		t.Fatal(interval)
+	}
+}
@@ -2,6 +2,7 @@ package platform
 
 import (
 	"os"
+	"reflect"
 	"runtime"
 	"strings"
 	"testing"
@@ -72,7 +73,155 @@ func TestInvokeProgram(t *testing.T) {
 	}
 }
 
+// timedWriter memorises the time of each write.
+type timedWriter struct {
+	chunks []string
+	times  []time.Time
+}
+
+func (writer *timedWriter) Write(p []byte) (int, error) {
+	writer.chunks = append(writer.chunks, string(p))
+	writer.times = append(writer.times, time.Now())
+	return len(p), nil
+}
+
+func TestInvokeProgramWithOptions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	writer := new(timedWriter)
+	out, err := InvokeProgramWithOptions(ProgramOptions{Output: writer}, nil, 10, "sh", "-c", "echo a; sleep 1; echo b >&2")
+	if err != nil || out != "a\nb\n" {
+		t.Fatal(err, out)
+	}
+	// The output should have arrived while the program was still running
+	if len(writer.chunks) != 2 || writer.chunks[0] != "a\n" || writer.chunks[1] != "b\n" || writer.times[1].Sub(writer.times[0]) < 900*time.Millisecond {
+		t.Fatal(writer.chunks, writer.times)
+	}
+}
+
+func TestInvokeProgramAsUser(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		if _, err := InvokeProgramWithOptions(ProgramOptions{RunAsUser: "nobody"}, nil, 10, "hostname"); err == nil {
+			t.Fatal("should not have supported run-as on Windows")
+		}
+		return
+	}
+	umask := 0027
+	out, err := InvokeProgramWithOptions(ProgramOptions{WorkingDirectory: "/", Umask: &umask}, nil, 10, "sh", "-c", "pwd; umask")
+	if err != nil || out != "/\n0027\n" {
+		t.Fatal(err, out)
+	}
+	// 0 is a valid umask that differs from the inherited one
+	umask = 0
+	out, err = InvokeProgramWithOptions(ProgramOptions{Umask: &umask}, nil, 10, "sh", "-c", "umask")
+	if err != nil || out != "0000\n" {
+		t.Fatal(err, out)
+	}
+	if _, err := InvokeProgramWithOptions(ProgramOptions{RunAsUser: "this-user-does-not-exist"}, nil, 10, "true"); err == nil {
+		t.Fatal("should have failed")
+	}
+	if os.Getuid() != 0 {
+		t.Skip("the remainder of the test requires root privilege")
+	}
+	out, err = InvokeProgramWithOptions(ProgramOptions{RunAsUser: "nobody"}, nil, 10, "id", "-un")
+	if err != nil || out != "nobody\n" {
+		t.Fatal(err, out)
+	}
+}
+
+func TestInvokeProgramWithLimits(t *testing.T) {
+	limits := ProgramLimits{CPUTimeSec: 7, FileSizeMB: 1, NumFiles: 99}
+	if runtime.GOOS == "windows" {
+		if _, err := InvokeProgramWithOptions(ProgramOptions{Limits: limits}, nil, 10, "hostname"); err == nil {
+			t.Fatal("should not have supported resource limits on Windows")
+		}
+		return
+	}
+	if !(ProgramLimits{}).IsEmpty() || limits.IsEmpty() || !(ProgramLimits{TransientCgroup: true}).IsEmpty() {
+		t.Fatal("wrong IsEmpty")
+	}
+	// The transient cgroup is created by root, systemd-run switches to the user afterwards
+	cgroupLimits := ProgramLimits{TransientCgroup: true, MemoryMB: 64, CPUPercent: 50}
+	if args := cgroupLimits.transientCgroupArgs("sh", []string{"-c", "id"}, "nobody"); !reflect.DeepEqual(args, []string{
+		"--scope", "--quiet", "--uid=nobody", "-p", "MemoryMax=64M", "-p", "CPUQuota=50%", "--", "sh", "-c", "id"}) {
+		t.Fatal(args)
+	}
+	if args := cgroupLimits.transientCgroupArgs("id", nil, ""); !reflect.DeepEqual(args, []string{
+		"--scope", "--quiet", "-p", "MemoryMax=64M", "-p", "CPUQuota=50%", "--", "id"}) {
+		t.Fatal(args)
+	}
+	umask := 0022
+	out, err := InvokeProgramWithOptions(ProgramOptions{Limits: limits, Umask: &umask}, nil, 10, "sh", "-c", "ulimit -t; ulimit -f; ulimit -n; umask")
+	if err != nil || out != "7\n2048\n99\n0022\n" {
+		t.Fatal(err, out)
+	}
+}
+
+func TestFilterEnv(t *testing.T) {
+	env := []string{"PATH=/bin", "LC_ALL=C", "LC_TIME=C", "AWS_SECRET_ACCESS_KEY=abc", "=C:=C:\\Windows"}
+	if ret := FilterEnv(env, nil, nil); !reflect.DeepEqual(ret, env) {
+		t.Fatal(ret)
+	}
+	if ret := FilterEnv(env, []string{"path", "LC_*"}, []string{"LC_TIME"}); !reflect.DeepEqual(ret, []string{"PATH=/bin", "LC_ALL=C"}) {
+		t.Fatal(ret)
+	}
+	if ret := FilterEnv(env, nil, []string{"AWS_*", "=C:"}); !reflect.DeepEqual(ret, env[:3]) {
+		t.Fatal(ret)
+	}
+	if runtime.GOOS == "windows" {
+		return
+	}
+	os.Setenv("LAITOS_TEST_FILTER_ENV", "secret")
+	defer os.Unsetenv("LAITOS_TEST_FILTER_ENV")
+	out, err := InvokeProgramWithOptions(ProgramOptions{EnvDenylist: []string{"LAITOS_TEST_*"}}, []string{"A=b"}, 10, "env")
+	if err != nil || strings.Contains(out, "LAITOS_TEST_FILTER_ENV") || !strings.Contains(out, "A=b") || !strings.Contains(out, "PATH=") {
+		t.Fatal(err, out)
+	}
+}
+
+func TestDropPrivileges(t *testing.T) {
+	// Successfully dropping privileges would affect the remaining tests, hence only test the failure cases.
+	if err := DropPrivileges("this-user-does-not-exist", true); err == nil {
+		t.Fatal("should have failed")
+	}
+}
+
 func TestLockMemory(t *testing.T) {
 	// just make sure it does not panic
 	LockMemory()
 }
+
+func TestParseMounts(t *testing.T) {
+	mounts := ParseMounts(`/dev/sda1 / ext4 rw,relatime 0 0
+proc /proc proc rw,nosuid,nodev,noexec,relatime 0 0
+/dev/sdb1 /mnt/my\040disk vfat rw 0 0
+
+`)
+	if len(mounts) != 3 {
+		t.Fatal(mounts)
+	}
+	if mounts[0].Device != "/dev/sda1" || mounts[0].MountPoint != "/" || mounts[0].FSType != "ext4" {
+		t.Fatal(mounts[0])
+	}
+	if mounts[2].MountPoint != "/mnt/my disk" {
+		t.Fatal(mounts[2])
+	}
+}
+
+func TestGetAllDiskUsage(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Getenv("CIRCLECI") != "" {
+		// Just make sure the function does not crash
+		GetAllDiskUsage()
+		return
+	}
+	all := GetAllDiskUsage()
+	if len(all) == 0 {
+		t.Fatal("did not find any file system")
+	}
+	for _, usage := range all {
+		if usage.MountPoint == "" || usage.TotalKB == 0 || usage.UsedKB+usage.FreeKB != usage.TotalKB {
+			t.Fatal(usage)
+		}
+	}
+}
@@ -4,9 +4,14 @@ package platform
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -26,18 +31,32 @@ func GetRootDiskUsageKB() (usedKB, freeKB, totalKB int) {
 	return
 }
 
+// getFileSystemUsage returns space and inode usage of the file system mounted on the directory.
+func getFileSystemUsage(mountPoint string) (usage DiskUsage, ok bool) {
+	fs := syscall.Statfs_t{}
+	if err := syscall.Statfs(mountPoint, &fs); err != nil {
+		return
+	}
+	usage.MountPoint = mountPoint
+	usage.TotalKB = int64(fs.Blocks) * int64(fs.Bsize) / 1024
+	usage.FreeKB = int64(fs.Bfree) * int64(fs.Bsize) / 1024
+	usage.UsedKB = usage.TotalKB - usage.FreeKB
+	usage.TotalInodes = int64(fs.Files)
+	usage.FreeInodes = int64(fs.Ffree)
+	usage.UsedInodes = usage.TotalInodes - usage.FreeInodes
+	return usage, true
+}
+
 /*
-InvokeProgram launches an external program with time constraints. The external program inherits laitos' environment
-mixed with additional input environment variables. The additional variables take precedence over inherited ones.
-Returns stdout+stderr output combined, and error if there is any. The maximum amount of output returned is capped to
-MaxExternalProgramOutputBytes.
+InvokeProgramWithOptions launches an external program with time constraints, in the same way as InvokeProgram, and
+additionally applies the options to the program.
 */
-func InvokeProgram(envVars []string, timeoutSec int, program string, args ...string) (out string, err error) {
+func InvokeProgramWithOptions(options ProgramOptions, envVars []string, timeoutSec int, program string, args ...string) (out string, err error) {
 	if timeoutSec < 1 {
 		return "", errors.New("invalid time limit")
 	}
 	// Make an environment variable array of common PATH, inherited values, and newly specified values.
-	defaultOSEnv := os.Environ()
+	defaultOSEnv := FilterEnv(os.Environ(), options.EnvAllowlist, options.EnvDenylist)
 	combinedEnv := make([]string, 0, 1+len(defaultOSEnv))
 	// Inherit environment variables from program environment
 	combinedEnv = append(combinedEnv, defaultOSEnv...)
@@ -51,13 +70,45 @@ func InvokeProgram(envVars []string, timeoutSec int, program string, args ...str
 		combinedEnv = append(combinedEnv, envVars...)
 	}
 	// Collect stdout and stderr all together in a single buffer
-	outBuf := lalog.NewByteLogWriter(ioutil.Discard, MaxExternalProgramOutputBytes)
+	var outDest io.Writer = ioutil.Discard
+	if options.Output != nil {
+		// Stream the output to caller as the program runs
+		outDest = options.Output
+	}
+	outBuf := lalog.NewByteLogWriter(outDest, MaxExternalProgramOutputBytes)
+	/*
+		Umask and resource limits are process-wide attributes, hence a shell sets them on itself and then executes the
+		program, which inherits them.
+	*/
+	preamble := options.Limits.ulimitCommands()
+	if options.Umask != nil {
+		preamble = append(preamble, fmt.Sprintf("umask %04o", *options.Umask))
+	}
+	if len(preamble) > 0 {
+		args = append([]string{"-c", strings.Join(preamble, " && ") + " && exec \"$0\" \"$@\"", program}, args...)
+		program = "/bin/sh"
+	}
+	program, args, inTransientCgroup := options.Limits.wrapInTransientCgroup(program, args, options.RunAsUser)
 	proc := exec.Command(program, args...)
-	proc.Env = combinedEnv
+	proc.Dir = options.WorkingDirectory
+	proc.Stdin = options.Stdin
 	proc.Stdout = outBuf
 	proc.Stderr = outBuf
 	// Use process group so that child processes are also killed upon time out, Windows does not require this.
 	proc.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if options.RunAsUser != "" {
+		cred, userEnv, credErr := getUserCredential(options.RunAsUser)
+		if credErr != nil {
+			err = credErr
+			return
+		}
+		// systemd-run must remain root to create the transient cgroup, it switches to the user on its own.
+		if !inTransientCgroup {
+			proc.SysProcAttr.Credential = cred
+		}
+		combinedEnv = append(combinedEnv, userEnv...)
+	}
+	proc.Env = combinedEnv
 	// Start external process
 	unixSecAtStart := time.Now().Unix()
 	timeLimitExceeded := time.After(time.Duration(timeoutSec) * time.Second)
@@ -97,6 +148,15 @@ processMonitorLoop:
 			err = errors.New("time limit exceeded")
 			minuteTicker.Stop()
 			break processMonitorLoop
+		case <-options.done():
+			// Forcibly kill the process as its result is no longer wanted
+			logger.Warning("InvokeProgram", program, nil, "killing the program due to cancellation - %v", options.Context.Err())
+			if proc.Process != nil && !KillProcess(proc.Process) {
+				logger.Warning("InvokeProgram", program, nil, "failed to kill after cancellation")
+			}
+			err = options.Context.Err()
+			minuteTicker.Stop()
+			break processMonitorLoop
 		case exitErr := <-processExitChan:
 			// Normal or abnormal exit that is not a time out
 			err = exitErr
@@ -108,6 +168,35 @@ processMonitorLoop:
 	return
 }
 
+/*
+getUserCredential returns the process credential made of the user's UID, primary GID, and supplementary GIDs, as well as
+the environment variables that describe the user's identity and home directory.
+*/
+func getUserCredential(userName string) (cred *syscall.Credential, env []string, err error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return
+	}
+	cred = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
+	if groupIDs, groupErr := u.GroupIds(); groupErr == nil {
+		for _, groupID := range groupIDs {
+			if gid, err := strconv.ParseUint(groupID, 10, 32); err == nil {
+				cred.Groups = append(cred.Groups, uint32(gid))
+			}
+		}
+	}
+	env = []string{"HOME=" + u.HomeDir, "USER=" + u.Username, "LOGNAME=" + u.Username}
+	return
+}
+
 // KillProcess kills the process and its child processes. The function gives the processes a second to clean up after themselves.
 func KillProcess(proc *os.Process) (success bool) {
 	if proc == nil {
@@ -159,3 +248,49 @@ func LockMemory() {
 		logger.Warning("LockMemory", "", nil, "program is not running as root (UID 0) hence memory cannot be locked, your private information may leak onto disk.")
 	}
 }
+
+/*
+GetInheritedSocketFiles returns the listening sockets passed down by systemd socket activation (LISTEN_PID and LISTEN_FDS
+environment variables), either directly or by way of the supervisor. The environment variables are removed afterwards so
+that child processes do not mistake the sockets for their own.
+*/
+func GetInheritedSocketFiles() (files []*os.File) {
+	defer func() {
+		_ = os.Unsetenv(SDListenPIDEnv)
+		_ = os.Unsetenv(SDListenFDsEnv)
+		_ = os.Unsetenv(SDListenFDNamesEnv)
+		_ = os.Unsetenv(SupervisorListenPPIDEnv)
+	}()
+	if !isInheritedSocketsOwner() {
+		return nil
+	}
+	numFDs, err := strconv.Atoi(os.Getenv(SDListenFDsEnv))
+	if err != nil || numFDs < 1 {
+		return nil
+	}
+	names := strings.Split(os.Getenv(SDListenFDNamesEnv), ":")
+	// The file descriptors of activated sockets start right after stdin, stdout, and stderr
+	for fd := 3; fd < 3+numFDs; fd++ {
+		syscall.CloseOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i := fd - 3; i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		files = append(files, os.NewFile(uintptr(fd), name))
+	}
+	logger.Info("GetInheritedSocketFiles", "", nil, "received %d sockets from systemd socket activation", len(files))
+	return
+}
+
+/*
+isInheritedSocketsOwner returns true if the activated sockets are meant for this process, which is either started by
+systemd (LISTEN_PID) or by the supervisor that has received the sockets from systemd (SupervisorListenPPIDEnv).
+*/
+func isInheritedSocketsOwner() bool {
+	if pidStr := os.Getenv(SDListenPIDEnv); pidStr != "" {
+		pid, err := strconv.Atoi(pidStr)
+		return err == nil && pid == os.Getpid()
+	}
+	ppid, err := strconv.Atoi(os.Getenv(SupervisorListenPPIDEnv))
+	return err == nil && ppid == os.Getppid()
+}
@@ -2,6 +2,7 @@ package platform
 
 import (
 	"errors"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
@@ -16,20 +17,26 @@ func GetRootDiskUsageKB() (usedKB, freeKB, totalKB int) {
 	return 0, 0, 0
 }
 
+// getFileSystemUsage is not implemented on Windows and always returns false.
+func getFileSystemUsage(_ string) (usage DiskUsage, ok bool) {
+	return
+}
+
 /*
-InvokeProgram launches an external program with time constraints. The external program inherits laitos' environment
-mixed with additional input environment variables. The additional variables take precedence over inherited ones.
+InvokeProgramWithOptions launches an external program with time constraints, in the same way as InvokeProgram, and
+additionally applies the options to the program.
 Once the external program is launched, its scheduling priority is lowered to "below normal", as a safety measure,
 because Windows is pretty bad keeping up when system is busy.
-Returns stdout+stderr output combined, and error if there is any. The maximum amount of output returned is capped to
-MaxExternalProgramOutputBytes.
 */
-func InvokeProgram(envVars []string, timeoutSec int, program string, args ...string) (out string, err error) {
+func InvokeProgramWithOptions(options ProgramOptions, envVars []string, timeoutSec int, program string, args ...string) (out string, err error) {
 	if timeoutSec < 1 {
 		return "", errors.New("invalid time limit")
 	}
+	if options.RunAsUser != "" || options.Umask != nil || !options.Limits.IsEmpty() {
+		return "", errors.New("running as another user, setting umask, and resource limits are not supported on Windows")
+	}
 	// Make an environment variable array of common PATH, inherited values, and newly specified values.
-	defaultOSEnv := os.Environ()
+	defaultOSEnv := FilterEnv(os.Environ(), options.EnvAllowlist, options.EnvDenylist)
 	combinedEnv := make([]string, 0, 1+len(defaultOSEnv))
 	// Inherit environment variables from program environment
 	combinedEnv = append(combinedEnv, defaultOSEnv...)
@@ -37,9 +44,16 @@ func InvokeProgram(envVars []string, timeoutSec int, program string, args ...str
 		combinedEnv = append(combinedEnv, envVars...)
 	}
 	// Collect stdout and stderr all together in a single buffer
-	outBuf := lalog.NewByteLogWriter(ioutil.Discard, MaxExternalProgramOutputBytes)
+	var outDest io.Writer = ioutil.Discard
+	if options.Output != nil {
+		// Stream the output to caller as the program runs
+		outDest = options.Output
+	}
+	outBuf := lalog.NewByteLogWriter(outDest, MaxExternalProgramOutputBytes)
 	proc := exec.Command(program, args...)
 	proc.Env = combinedEnv
+	proc.Dir = options.WorkingDirectory
+	proc.Stdin = options.Stdin
 	proc.Stdout = outBuf
 	proc.Stderr = outBuf
 	// Start external process
@@ -86,6 +100,15 @@ processMonitorLoop:
 			err = errors.New("time limit exceeded")
 			minuteTicker.Stop()
 			break processMonitorLoop
+		case <-options.done():
+			// Forcibly kill the process as its result is no longer wanted
+			logger.Warning("InvokeProgram", program, nil, "killing the program due to cancellation - %v", options.Context.Err())
+			if proc.Process != nil && !KillProcess(proc.Process) {
+				logger.Warning("InvokeProgram", program, nil, "failed to kill after cancellation")
+			}
+			err = options.Context.Err()
+			minuteTicker.Stop()
+			break processMonitorLoop
 		case exitErr := <-processExitChan:
 			// Normal or abnormal exit that is not a time out
 			err = exitErr
@@ -131,3 +154,8 @@ func KillProcess(proc *os.Process) (success bool) {
 func LockMemory() {
 	logger.Warning("LockMemory", "", nil, "memory locking is not supported on Windows, your private information may leak onto disk.")
 }
+
+// GetInheritedSocketFiles returns nil because systemd socket activation is not supported on Windows.
+func GetInheritedSocketFiles() []*os.File {
+	return nil
+}
@@ -0,0 +1,34 @@
+// +build darwin linux
+
+package platform
+
+import (
+	"errors"
+	"io"
+)
+
+// WindowsServiceName is the name under which laitos is installed as a Windows service and writes to Windows event log.
+const WindowsServiceName = "laitos"
+
+// ErrWindowsOnly is returned by Windows service functions on other operating systems.
+var ErrWindowsOnly = errors.New("Windows service is only supported on Windows")
+
+// StartWindowsService is only supported on Windows.
+func StartWindowsService(_ string, _ func()) error {
+	return ErrWindowsOnly
+}
+
+// InstallWindowsService is only supported on Windows.
+func InstallWindowsService(_, _ string, _ []string) error {
+	return ErrWindowsOnly
+}
+
+// UninstallWindowsService is only supported on Windows.
+func UninstallWindowsService(_ string) error {
+	return ErrWindowsOnly
+}
+
+// NewWindowsEventLogWriter is only supported on Windows.
+func NewWindowsEventLogWriter(_ string) (io.WriteCloser, error) {
+	return nil, ErrWindowsOnly
+}
@@ -0,0 +1,297 @@
+package platform
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// WindowsServiceName is the name under which laitos is installed as a Windows service and writes to Windows event log.
+const WindowsServiceName = "laitos"
+
+const (
+	winServiceWin32OwnProcess  = 0x10
+	winServiceStopped          = 1
+	winServiceStartPending     = 2
+	winServiceStopPending      = 3
+	winServiceRunning          = 4
+	winServiceAcceptStop       = 1
+	winServiceAcceptShutdown   = 4
+	winServiceControlStop      = 1
+	winServiceControlInterrog  = 4
+	winServiceControlShutdown  = 5
+	winServiceAutoStart        = 2
+	winServiceErrorNormal      = 1
+	winServiceAllAccess        = 0xF01FF
+	winServiceDelete           = 0x10000
+	winSCManagerAllAccess      = 0xF003F
+	winErrorCallNotImplemented = 120
+	winEventLogErrorType       = 1
+	winEventLogWarningType     = 2
+	winEventLogInformationType = 4
+	winRegExpandSZ             = 2
+	winRegDWORD                = 4
+	// winEventLogKey is the registry key under which event log sources of Windows applications are registered.
+	winEventLogKey = `SYSTEM\CurrentControlSet\Services\EventLog\Application\`
+	/*
+		winEventCreateMessageFile is the message file of the built-in "eventcreate" utility, it defines event IDs 1-1000
+		whose message is the verbatim text given by the event source.
+	*/
+	winEventCreateMessageFile = `%SystemRoot%\System32\EventCreate.exe`
+	winEventID                = 1
+)
+
+var (
+	advapi32                          = syscall.NewLazyDLL("advapi32.dll")
+	procStartServiceCtrlDispatcherW   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerExW = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus              = advapi32.NewProc("SetServiceStatus")
+	procOpenSCManagerW                = advapi32.NewProc("OpenSCManagerW")
+	procCreateServiceW                = advapi32.NewProc("CreateServiceW")
+	procOpenServiceW                  = advapi32.NewProc("OpenServiceW")
+	procDeleteService                 = advapi32.NewProc("DeleteService")
+	procCloseServiceHandle            = advapi32.NewProc("CloseServiceHandle")
+	procRegisterEventSourceW          = advapi32.NewProc("RegisterEventSourceW")
+	procDeregisterEventSource         = advapi32.NewProc("DeregisterEventSource")
+	procReportEventW                  = advapi32.NewProc("ReportEventW")
+	procRegCreateKeyExW               = advapi32.NewProc("RegCreateKeyExW")
+	procRegSetValueExW                = advapi32.NewProc("RegSetValueExW")
+	procRegDeleteKeyW                 = advapi32.NewProc("RegDeleteKeyW")
+)
+
+// winServiceStatus is the SERVICE_STATUS structure of Windows service control API.
+type winServiceStatus struct {
+	ServiceType             uint32
+	CurrentState            uint32
+	ControlsAccepted        uint32
+	Win32ExitCode           uint32
+	ServiceSpecificExitCode uint32
+	CheckPoint              uint32
+	WaitHint                uint32
+}
+
+// winServiceTableEntry is the SERVICE_TABLE_ENTRYW structure of Windows service control API.
+type winServiceTableEntry struct {
+	ServiceName *uint16
+	ServiceProc uintptr
+}
+
+var (
+	// The states below belong to the only Windows service that laitos process may run as.
+	winServiceNamePtr      *uint16
+	winServiceStatusHandle uintptr
+	winServiceCheckPoint   uint32
+	winServiceOnStop       func()
+	winServiceStopOnce     = new(sync.Once)
+	winServiceStopDone     = make(chan struct{})
+	winServiceStartResult  = make(chan error, 2)
+)
+
+// setWinServiceStatus reports the latest state of laitos service to Windows service control manager.
+func setWinServiceStatus(state uint32) {
+	status := winServiceStatus{ServiceType: winServiceWin32OwnProcess, CurrentState: state}
+	switch state {
+	case winServiceRunning:
+		status.ControlsAccepted = winServiceAcceptStop | winServiceAcceptShutdown
+	case winServiceStartPending, winServiceStopPending:
+		winServiceCheckPoint++
+		status.CheckPoint = winServiceCheckPoint
+		status.WaitHint = 30000
+	}
+	if ret, _, err := procSetServiceStatus.Call(winServiceStatusHandle, uintptr(unsafe.Pointer(&status))); ret == 0 {
+		logger.Warning("setWinServiceStatus", "", err, "failed to report service state %d", state)
+	}
+}
+
+// winServiceHandler is the HandlerEx callback that receives service control requests.
+func winServiceHandler(control, eventType, eventData, context uintptr) uintptr {
+	switch control {
+	case winServiceControlStop, winServiceControlShutdown:
+		winServiceStopOnce.Do(func() {
+			logger.Info("winServiceHandler", "", nil, "received service control %d, stopping now", control)
+			setWinServiceStatus(winServiceStopPending)
+			go func() {
+				if winServiceOnStop != nil {
+					winServiceOnStop()
+				}
+				close(winServiceStopDone)
+			}()
+		})
+		return 0
+	case winServiceControlInterrog:
+		return 0
+	}
+	return winErrorCallNotImplemented
+}
+
+// winServiceMain is the ServiceMain callback invoked by the service control dispatcher.
+func winServiceMain(argc, argv uintptr) uintptr {
+	handle, _, err := procRegisterServiceCtrlHandlerExW.Call(
+		uintptr(unsafe.Pointer(winServiceNamePtr)), syscall.NewCallback(winServiceHandler), 0)
+	if handle == 0 {
+		winServiceStartResult <- fmt.Errorf("failed to register service control handler - %v", err)
+		return 0
+	}
+	winServiceStatusHandle = handle
+	setWinServiceStatus(winServiceRunning)
+	winServiceStartResult <- nil
+	<-winServiceStopDone
+	setWinServiceStatus(winServiceStopped)
+	return 0
+}
+
+/*
+StartWindowsService connects laitos process to Windows service control manager, so that laitos runs as the service of
+the name. The function returns as soon as the service is reported as running, or returns an error if the process was not
+started by the service control manager. When the service control manager asks the service to stop, the onStop function
+is called, and then the process exits.
+*/
+func StartWindowsService(name string, onStop func()) error {
+	namePtr, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	winServiceNamePtr = namePtr
+	winServiceOnStop = onStop
+	go func() {
+		runtime.LockOSThread()
+		table := []winServiceTableEntry{{ServiceName: namePtr, ServiceProc: syscall.NewCallback(winServiceMain)}, {}}
+		if ret, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0]))); ret == 0 {
+			winServiceStartResult <- fmt.Errorf("failed to connect to service control manager - %v", err)
+			return
+		}
+		// The dispatcher returns after the service has stopped
+		logger.Info("StartWindowsService", name, nil, "the service has stopped")
+		os.Exit(0)
+	}()
+	return <-winServiceStartResult
+}
+
+/*
+InstallWindowsService installs laitos as an automatically started Windows service that runs this executable with the
+program arguments, and registers the event log source of the same name.
+*/
+func InstallWindowsService(name, description string, args []string) error {
+	exePath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmdLine := make([]string, 0, 1+len(args))
+	cmdLine = append(cmdLine, syscall.EscapeArg(exePath))
+	for _, arg := range args {
+		cmdLine = append(cmdLine, syscall.EscapeArg(arg))
+	}
+	scm, _, err := procOpenSCManagerW.Call(0, 0, winSCManagerAllAccess)
+	if scm == 0 {
+		return fmt.Errorf("failed to open service control manager - %v", err)
+	}
+	defer procCloseServiceHandle.Call(scm)
+	svc, _, err := procCreateServiceW.Call(scm,
+		uintptr(unsafe.Pointer(utf16Ptr(name))), uintptr(unsafe.Pointer(utf16Ptr(description))),
+		winServiceAllAccess, winServiceWin32OwnProcess, winServiceAutoStart, winServiceErrorNormal,
+		uintptr(unsafe.Pointer(utf16Ptr(strings.Join(cmdLine, " ")))), 0, 0, 0, 0, 0)
+	if svc == 0 {
+		return fmt.Errorf("failed to create service \"%s\" - %v", name, err)
+	}
+	procCloseServiceHandle.Call(svc)
+	return installWinEventLogSource(name)
+}
+
+// UninstallWindowsService removes the Windows service and its event log source.
+func UninstallWindowsService(name string) error {
+	scm, _, err := procOpenSCManagerW.Call(0, 0, winSCManagerAllAccess)
+	if scm == 0 {
+		return fmt.Errorf("failed to open service control manager - %v", err)
+	}
+	defer procCloseServiceHandle.Call(scm)
+	svc, _, err := procOpenServiceW.Call(scm, uintptr(unsafe.Pointer(utf16Ptr(name))), winServiceDelete)
+	if svc == 0 {
+		return fmt.Errorf("failed to open service \"%s\" - %v", name, err)
+	}
+	defer procCloseServiceHandle.Call(svc)
+	if ret, _, err := procDeleteService.Call(svc); ret == 0 {
+		return fmt.Errorf("failed to delete service \"%s\" - %v", name, err)
+	}
+	if ret, _, _ := procRegDeleteKeyW.Call(
+		uintptr(syscall.HKEY_LOCAL_MACHINE), uintptr(unsafe.Pointer(utf16Ptr(winEventLogKey+name)))); ret != 0 {
+		return fmt.Errorf("failed to remove event log source \"%s\" - %v", name, syscall.Errno(ret))
+	}
+	return nil
+}
+
+// installWinEventLogSource registers the event log source that writes verbatim text messages.
+func installWinEventLogSource(name string) error {
+	var key syscall.Handle
+	if ret, _, _ := procRegCreateKeyExW.Call(
+		uintptr(syscall.HKEY_LOCAL_MACHINE), uintptr(unsafe.Pointer(utf16Ptr(winEventLogKey+name))), 0, 0, 0,
+		syscall.KEY_ALL_ACCESS, 0, uintptr(unsafe.Pointer(&key)), 0); ret != 0 {
+		return fmt.Errorf("failed to create event log source \"%s\" - %v", name, syscall.Errno(ret))
+	}
+	defer syscall.RegCloseKey(key)
+	msgFile := syscall.StringToUTF16(winEventCreateMessageFile)
+	if ret, _, _ := procRegSetValueExW.Call(uintptr(key), uintptr(unsafe.Pointer(utf16Ptr("EventMessageFile"))), 0, winRegExpandSZ,
+		uintptr(unsafe.Pointer(&msgFile[0])), uintptr(len(msgFile)*2)); ret != 0 {
+		return fmt.Errorf("failed to set event message file - %v", syscall.Errno(ret))
+	}
+	supportedTypes := uint32(winEventLogErrorType | winEventLogWarningType | winEventLogInformationType)
+	if ret, _, _ := procRegSetValueExW.Call(uintptr(key), uintptr(unsafe.Pointer(utf16Ptr("TypesSupported"))), 0, winRegDWORD,
+		uintptr(unsafe.Pointer(&supportedTypes)), 4); ret != 0 {
+		return fmt.Errorf("failed to set supported event types - %v", syscall.Errno(ret))
+	}
+	return nil
+}
+
+// WindowsEventLogWriter writes each log message into Windows event log.
+type WindowsEventLogWriter struct {
+	handle uintptr
+}
+
+// NewWindowsEventLogWriter opens the event log source of the name for writing.
+func NewWindowsEventLogWriter(name string) (io.WriteCloser, error) {
+	handle, _, err := procRegisterEventSourceW.Call(0, uintptr(unsafe.Pointer(utf16Ptr(name))))
+	if handle == 0 {
+		return nil, fmt.Errorf("failed to open event log source \"%s\" - %v", name, err)
+	}
+	return &WindowsEventLogWriter{handle: handle}, nil
+}
+
+// Write writes the log message as an event. Messages that come with an error are written as warning events.
+func (writer *WindowsEventLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSpace(strings.Replace(string(p), "\x00", "", -1))
+	eventType := winEventLogInformationType
+	if strings.Contains(msg, `: Error "`) {
+		eventType = winEventLogWarningType
+	}
+	msgPtr, err := syscall.UTF16PtrFromString(msg)
+	if err != nil {
+		return 0, err
+	}
+	if ret, _, err := procReportEventW.Call(writer.handle, uintptr(eventType), 0, winEventID, 0, 1, 0,
+		uintptr(unsafe.Pointer(&msgPtr)), 0); ret == 0 {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the event log source.
+func (writer *WindowsEventLogWriter) Close() error {
+	if ret, _, err := procDeregisterEventSource.Call(writer.handle); ret == 0 {
+		return err
+	}
+	return nil
+}
+
+// utf16Ptr returns the pointer to a NUL-terminated UTF-16 copy of the string, for passing to Windows API.
+func utf16Ptr(s string) *uint16 {
+	ptr, err := syscall.UTF16PtrFromString(s)
+	if err != nil {
+		// The string contains a NUL character, it is not a valid argument.
+		return &[]uint16{0}[0]
+	}
+	return ptr
+}
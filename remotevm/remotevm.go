@@ -5,10 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"image/jpeg"
-	"io"
 	"io/ioutil"
 	"net"
-	"net/http"
 	"net/textproto"
 	"os"
 	"os/exec"
@@ -18,6 +16,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/HouzuoGuo/laitos/inet"
 	"github.com/HouzuoGuo/laitos/lalog"
 	"github.com/HouzuoGuo/laitos/misc"
 	"github.com/HouzuoGuo/laitos/platform"
@@ -68,40 +67,35 @@ func (vm *VM) Initialise() error {
 	return nil
 }
 
-// DownloadISO downloads an ISO file from the input URL and saves it in a file. There is a hard limit of 15 minutes for the download operation to complete.
+/*
+DownloadISO downloads an ISO file from the input URL and saves it in a file. There is a hard limit of 15 minutes for each
+download attempt, and an interrupted download resumes from where it left off, including the partial file left behind by
+an earlier call that downloaded the same URL.
+*/
 func (vm *VM) DownloadISO(isoURL string, destPath string) error {
-	client := &http.Client{Timeout: 15 * time.Minute}
-	resp, err := client.Get(isoURL)
 	fmt.Fprintf(vm.emulatorDebugOutput, "DownloadISO: saving %s to %s, this may take a while.\n", isoURL, destPath)
+	var lastReportMB int64
+	size, err := inet.DownloadFile(inet.DownloadRequest{
+		HTTPRequest:   inet.HTTPRequest{TimeoutSec: 15 * 60},
+		DestPath:      destPath,
+		ResumePartial: true,
+		ProgressFunc: func(received, total int64) {
+			// Report the progress every 64MB
+			if receivedMB := received / 1048576; receivedMB >= lastReportMB+64 {
+				lastReportMB = receivedMB
+				fmt.Fprintf(vm.emulatorDebugOutput, "DownloadISO: received %d of %d MB\n", receivedMB, total/1048576)
+			}
+		},
+	}, isoURL)
 	if err != nil {
 		fmt.Fprintf(vm.emulatorDebugOutput, "DownloadISO: download failed - %v\n", err)
 		return fmt.Errorf("DownloadISO: failed to download %s - %w", isoURL, err)
 	}
-	defer resp.Body.Close()
-	destFile, err := os.OpenFile(destPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
-	if err != nil {
-		fmt.Fprintf(vm.emulatorDebugOutput, "DownloadISO: failed to truncate destination file - %v\n", err)
-		return fmt.Errorf("DownloadISO: failed to truncate destination file - %w", err)
-	}
-	_, err = io.Copy(destFile, resp.Body)
-	if err != nil {
-		fmt.Fprintf(vm.emulatorDebugOutput, "DownloadISO: download failed - %v\n", err)
-		return fmt.Errorf("DownloadISO: failed to download %s - %w", isoURL, err)
-	}
-	if err := destFile.Close(); err != nil {
-		fmt.Fprintf(vm.emulatorDebugOutput, "DownloadISO: failed to save file - %v\n", err)
-		return fmt.Errorf("DownloadISO: failed to save file %s - %w", destFile.Name(), err)
+	if size < 8*1048576 {
+		fmt.Fprintf(vm.emulatorDebugOutput, "DownloadISO: ISO file seems too small (only %d MB)\n", size/1048576)
+		return fmt.Errorf("DownloadISO: ISO file seems too small (only %d MB)", size/1048576)
 	}
-	stat, err := os.Stat(destFile.Name())
-	if err != nil {
-		fmt.Fprintf(vm.emulatorDebugOutput, "DownloadISO: failed to read file - %v\n", err)
-		return fmt.Errorf("DownloadISO: failed to read file %s - %w", destFile.Name(), err)
-	}
-	if stat.Size() < 8*1048576 {
-		fmt.Fprintf(vm.emulatorDebugOutput, "DownloadISO: ISO file seems too small (only %d MB)\n", stat.Size()/1048576)
-		return fmt.Errorf("DownloadISO: ISO file seems too small (only %d MB)", stat.Size()/1048576)
-	}
-	fmt.Fprintf(vm.emulatorDebugOutput, "DownloadISO: successfully saved %s (%d MB) to %s\n", isoURL, stat.Size()/1048576, destPath)
+	fmt.Fprintf(vm.emulatorDebugOutput, "DownloadISO: successfully saved %s (%d MB) to %s\n", isoURL, size/1048576, destPath)
 	return nil
 }
 
@@ -224,6 +218,18 @@ func (vm *VM) GetDebugOutput() string {
 	return ""
 }
 
+/*
+GetDebugOutputSince returns the emulator output written after the mark, along with a new mark for retrieving the output
+that comes next. Mark 0 retrieves all of the recent output.
+*/
+func (vm *VM) GetDebugOutputSince(mark int64) (string, int64) {
+	if vm.emulatorDebugOutput != nil {
+		out, newMark := vm.emulatorDebugOutput.RetrieveSinceMark(mark, true)
+		return string(out), newMark
+	}
+	return "", 0
+}
+
 /*
 TakeScreenshot takes a screenshot of the emulator video display, the screenshot image format is JPEG.
 The function also updates the screen total resolution tracked internally for calculating mouse movement coordinates.
@@ -235,7 +241,9 @@ func (vm *VM) TakeScreenshot(outputFileName string) error {
 		return err
 	}
 	_ = tmpFile.Close()
-	defer os.Remove(tmpFile.Name())
+	defer func() {
+		_ = misc.SecureErase(tmpFile.Name())
+	}()
 	// Ask QEMU to take the screenshot
 	_, err = vm.executeQMP(map[string]interface{}{
 		"execute": "screendump",
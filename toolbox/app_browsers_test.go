@@ -1,6 +1,7 @@
 package toolbox
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strings"
@@ -37,107 +38,107 @@ func TestBrowserSlimerJS_Execute(t *testing.T) {
 	if err := bro.SelfTest(); err != nil {
 		t.Fatal(err)
 	}
-	if ret := bro.Execute(Command{TimeoutSec: 10, Content: "haha hoho"}); ret.Error != ErrBadBrowserParam {
+	if ret := bro.Execute(context.Background(), Command{TimeoutSec: 10, Content: "haha hoho"}); ret.Error != ErrBadBrowserParam {
 		t.Fatal(ret.Error, ret.Output)
 	}
 	delay := func() {
 		time.Sleep(3 * time.Second)
 	}
 	// Browse distorwatch home page
-	if ret := bro.Execute(Command{TimeoutSec: 10, Content: "g https://distrowatch.com"}); ret.Error != nil {
+	if ret := bro.Execute(context.Background(), Command{TimeoutSec: 10, Content: "g https://distrowatch.com"}); ret.Error != nil {
 		t.Fatal(ret.Error, ret.Output)
 	}
 	// Expect page to be ready in a few seconds
 	time.Sleep(30 * time.Second)
 	// Go back and forward
-	if ret := bro.Execute(Command{TimeoutSec: 10, Content: "b"}); ret.Error != nil || !strings.Contains(strings.ToLower(ret.Output), "distrowatch") {
+	if ret := bro.Execute(context.Background(), Command{TimeoutSec: 10, Content: "b"}); ret.Error != nil || !strings.Contains(strings.ToLower(ret.Output), "distrowatch") {
 		t.Fatal(ret.Error, ret.Output)
 	} else {
 		fmt.Println(ret.Output)
 	}
 	delay()
-	if ret := bro.Execute(Command{TimeoutSec: 10, Content: "f"}); ret.Error != nil || !strings.Contains(strings.ToLower(ret.Output), "distrowatch") {
+	if ret := bro.Execute(context.Background(), Command{TimeoutSec: 10, Content: "f"}); ret.Error != nil || !strings.Contains(strings.ToLower(ret.Output), "distrowatch") {
 		t.Fatal(ret.Error, ret.Output)
 	} else {
 		fmt.Println(ret.Output)
 	}
 	delay()
 	// Navigate to elements
-	if ret := bro.Execute(Command{TimeoutSec: 10, Content: "n"}); ret.Error != nil || len(ret.Output) < 20 {
+	if ret := bro.Execute(context.Background(), Command{TimeoutSec: 10, Content: "n"}); ret.Error != nil || len(ret.Output) < 20 {
 		t.Fatal(ret.Error, ret.Output)
 	} else {
 		fmt.Println(ret.Output)
 	}
 	delay()
-	if ret := bro.Execute(Command{TimeoutSec: 10, Content: "p"}); ret.Error != nil || len(ret.Output) < 20 {
+	if ret := bro.Execute(context.Background(), Command{TimeoutSec: 10, Content: "p"}); ret.Error != nil || len(ret.Output) < 20 {
 		t.Fatal(ret.Error, ret.Output)
 	} else {
 		fmt.Println(ret.Output)
 	}
 	delay()
-	if ret := bro.Execute(Command{TimeoutSec: 10, Content: "nn 10"}); ret.Error != nil || len(ret.Output) < 200 {
+	if ret := bro.Execute(context.Background(), Command{TimeoutSec: 10, Content: "nn 10"}); ret.Error != nil || len(ret.Output) < 200 {
 		t.Fatal(ret.Error, ret.Output)
 	} else {
 		fmt.Println(ret.Output)
 	}
 	delay()
-	if ret := bro.Execute(Command{TimeoutSec: 10, Content: "0"}); ret.Error != nil || len(ret.Output) < 20 {
+	if ret := bro.Execute(context.Background(), Command{TimeoutSec: 10, Content: "0"}); ret.Error != nil || len(ret.Output) < 20 {
 		t.Fatal(ret.Error, ret.Output)
 	} else {
 		fmt.Println(ret.Output)
 	}
 	delay()
 	// Reload and get page info
-	if ret := bro.Execute(Command{TimeoutSec: 10, Content: "r"}); ret.Error != nil || !strings.Contains(strings.ToLower(ret.Output), "distrowatch") {
+	if ret := bro.Execute(context.Background(), Command{TimeoutSec: 10, Content: "r"}); ret.Error != nil || !strings.Contains(strings.ToLower(ret.Output), "distrowatch") {
 		t.Fatal(ret.Error, ret.Output)
 	} else {
 		fmt.Println(ret.Output)
 	}
 	delay()
-	if ret := bro.Execute(Command{TimeoutSec: 10, Content: "i"}); ret.Error != nil || !strings.Contains(strings.ToLower(ret.Output), "distrowatch") {
+	if ret := bro.Execute(context.Background(), Command{TimeoutSec: 10, Content: "i"}); ret.Error != nil || !strings.Contains(strings.ToLower(ret.Output), "distrowatch") {
 		t.Fatal(ret.Error, ret.Output)
 	} else {
 		fmt.Println(ret.Output)
 	}
 	delay()
 	// Pointer, enter value, and keys
-	if ret := bro.Execute(Command{TimeoutSec: 10, Content: "ptr mousemove left"}); ret.Error != nil || !strings.Contains(strings.ToLower(ret.Output), "distrowatch") {
+	if ret := bro.Execute(context.Background(), Command{TimeoutSec: 10, Content: "ptr mousemove left"}); ret.Error != nil || !strings.Contains(strings.ToLower(ret.Output), "distrowatch") {
 		t.Fatal(ret.Error, ret.Output)
 	} else {
 		fmt.Println(ret.Output)
 	}
 	delay()
-	if ret := bro.Execute(Command{TimeoutSec: 10, Content: "val new value hahaha"}); ret.Error != nil || !strings.Contains(strings.ToLower(ret.Output), "distrowatch") {
+	if ret := bro.Execute(context.Background(), Command{TimeoutSec: 10, Content: "val new value hahaha"}); ret.Error != nil || !strings.Contains(strings.ToLower(ret.Output), "distrowatch") {
 		t.Fatal(ret.Error, ret.Output)
 	} else {
 		fmt.Println(ret.Output)
 	}
 	delay()
-	if ret := bro.Execute(Command{TimeoutSec: 10, Content: "enter"}); ret.Error != nil || !strings.Contains(strings.ToLower(ret.Output), "distrowatch") {
+	if ret := bro.Execute(context.Background(), Command{TimeoutSec: 10, Content: "enter"}); ret.Error != nil || !strings.Contains(strings.ToLower(ret.Output), "distrowatch") {
 		t.Fatal(ret.Error, ret.Output)
 	} else {
 		fmt.Println(ret.Output)
 	}
 	delay()
-	if ret := bro.Execute(Command{TimeoutSec: 10, Content: "backsp"}); ret.Error != nil || !strings.Contains(strings.ToLower(ret.Output), "distrowatch") {
+	if ret := bro.Execute(context.Background(), Command{TimeoutSec: 10, Content: "backsp"}); ret.Error != nil || !strings.Contains(strings.ToLower(ret.Output), "distrowatch") {
 		t.Fatal(ret.Error, ret.Output)
 	} else {
 		fmt.Println(ret.Output)
 	}
 	delay()
 	// Kill browser finally
-	if ret := bro.Execute(Command{TimeoutSec: 10, Content: "k"}); ret.Error != nil || !strings.Contains(strings.ToLower(ret.Output), "killed") {
+	if ret := bro.Execute(context.Background(), Command{TimeoutSec: 10, Content: "k"}); ret.Error != nil || !strings.Contains(strings.ToLower(ret.Output), "killed") {
 		t.Fatal(ret.Error, ret.Output)
 	} else {
 		fmt.Println(ret.Output)
 	}
 	delay()
 	// Make sure a new browser may start again
-	if ret := bro.Execute(Command{TimeoutSec: 10, Content: "g https://distrowatch.com"}); ret.Error != nil {
+	if ret := bro.Execute(context.Background(), Command{TimeoutSec: 10, Content: "g https://distrowatch.com"}); ret.Error != nil {
 		t.Fatal(ret.Error, ret.Output)
 	}
 	delay()
-	if ret := bro.Execute(Command{TimeoutSec: 10, Content: "i"}); ret.Error != nil || !strings.Contains(strings.ToLower(ret.Output), "distrowatch") {
+	if ret := bro.Execute(context.Background(), Command{TimeoutSec: 10, Content: "i"}); ret.Error != nil || !strings.Contains(strings.ToLower(ret.Output), "distrowatch") {
 		t.Fatal(ret.Error, ret.Output)
 	} else {
 		fmt.Println(ret.Output)
@@ -2,9 +2,12 @@ package toolbox
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
 	"runtime/pprof"
 	"strconv"
@@ -17,7 +20,12 @@ import (
 	"github.com/HouzuoGuo/laitos/platform"
 )
 
-var ErrBadEnvInfoChoice = errors.New(`lock | stop | kill | log | warn | runtime | stack | tune`)
+var ErrBadEnvInfoChoice = errors.New(`lock | stop | kill | log | warn | runtime | stack | tune | reload | purgedns | dnslog [client-ip] | rekey old new | restart daemon`)
+
+// ErrRekeyOverPlainChannel is returned when the rekey command arrives over a channel that is not encrypted.
+var ErrRekeyOverPlainChannel = errors.New("rekey only works over an encrypted channel such as SSH or HTTPS")
+
+const EnvControlTrigger = ".e" // EnvControlTrigger is the trigger prefix string of EnvControl feature.
 
 // Retrieve environment information and trigger emergency stop upon request.
 type EnvControl struct {
@@ -36,13 +44,36 @@ func (info *EnvControl) Initialise() error {
 }
 
 func (info *EnvControl) Trigger() Trigger {
-	return ".e"
+	return EnvControlTrigger
 }
 
-func (info *EnvControl) Execute(cmd Command) *Result {
+func (info *EnvControl) Execute(ctx context.Context, cmd Command) *Result {
 	if errResult := cmd.Trim(); errResult != nil {
 		return errResult
 	}
+	if params := strings.Fields(cmd.Content); len(params) > 0 && strings.ToLower(params[0]) == "rekey" {
+		if len(params) != 3 {
+			return &Result{Error: ErrBadEnvInfoChoice}
+		}
+		if !cmd.Encrypted {
+			return &Result{Error: ErrRekeyOverPlainChannel}
+		}
+		return RekeyProgramData(params[1], params[2])
+	} else if len(params) > 0 && strings.ToLower(params[0]) == "restart" {
+		if len(params) != 2 {
+			return &Result{Error: ErrBadEnvInfoChoice}
+		}
+		return RestartDaemon(strings.ToLower(params[1]))
+	} else if len(params) > 0 && strings.ToLower(params[0]) == "dnslog" {
+		if len(params) > 2 {
+			return &Result{Error: ErrBadEnvInfoChoice}
+		}
+		var clientIP string
+		if len(params) == 2 {
+			clientIP = params[1]
+		}
+		return GetDNSQueryLog(clientIP)
+	}
 	switch strings.ToLower(cmd.Content) {
 	case "lock":
 		misc.TriggerEmergencyLockDown()
@@ -63,32 +94,136 @@ func (info *EnvControl) Execute(cmd Command) *Result {
 		return &Result{Output: GetGoroutineStacktraces()}
 	case "tune":
 		return &Result{Output: TuneLinux()}
+	case "reload":
+		return ReloadConfig()
+	case "purgedns":
+		return PurgeDNSCache()
 	default:
 		return &Result{Error: ErrBadEnvInfoChoice}
 	}
 }
 
+/*
+RekeyProgramData re-encrypts all encrypted program data files that reside in the directory of configuration file using
+a new password. The current password must be given for verification. The supervisor of this program is given the new
+password too, so that it can restart this program after a crash; if the supervisor cannot be reached, the files are
+re-encrypted using the current password again.
+*/
+func RekeyProgramData(oldKey, newKey string) *Result {
+	if misc.ConfigFilePath == "" || subtle.ConstantTimeCompare([]byte(oldKey), []byte(misc.ProgramDataDecryptionPassword)) != 1 {
+		return &Result{Error: errors.New("the current password is incorrect")}
+	}
+	filePaths, err := misc.FindEncryptedFiles(filepath.Dir(misc.ConfigFilePath))
+	if err != nil {
+		return &Result{Error: err}
+	} else if len(filePaths) == 0 {
+		return &Result{Error: errors.New("program data is not encrypted")}
+	}
+	if err := misc.RekeyFiles(oldKey, newKey, filePaths...); err != nil {
+		return &Result{Error: err}
+	}
+	if err := misc.TellSupervisorNewPassword(newKey); err != nil {
+		if rollbackErr := misc.RekeyFiles(newKey, oldKey, filePaths...); rollbackErr != nil {
+			return &Result{Error: fmt.Errorf("%v, and failed to restore the current password - %v", err, rollbackErr)}
+		}
+		return &Result{Error: err}
+	}
+	misc.ProgramDataDecryptionPassword = newKey
+	return &Result{Output: fmt.Sprintf("OK - re-encrypted %d files", len(filePaths))}
+}
+
+/*
+RestartDaemon stops a running daemon and starts it again using the latest content of configuration file, the other
+daemons carry on without interruption.
+*/
+func RestartDaemon(daemonName string) *Result {
+	if misc.DaemonRestarter == nil {
+		return &Result{Error: errors.New("daemons are not running in this program")}
+	}
+	if err := misc.DaemonRestarter(daemonName); err != nil {
+		return &Result{Error: err}
+	}
+	return &Result{Output: "OK - restarted " + daemonName}
+}
+
+/*
+ReloadConfig applies the latest content of configuration file to the running daemons, and tells which changes require
+a program restart.
+*/
+func ReloadConfig() *Result {
+	if misc.ConfigReloader == nil {
+		return &Result{Error: errors.New("daemons are not running in this program")}
+	}
+	summary, err := misc.ConfigReloader()
+	return &Result{Output: summary, Error: err}
+}
+
+// PurgeDNSCache removes all responses from the response cache of DNS daemon.
+func PurgeDNSCache() *Result {
+	if misc.DNSCachePurger == nil {
+		return &Result{Error: errors.New("DNS daemon is not running in this program")}
+	}
+	return &Result{Output: fmt.Sprintf("OK - removed %d cached DNS responses", misc.DNSCachePurger())}
+}
+
+// GetDNSQueryLog returns the most recent queries made by the client IP (or all clients if it is empty) to DNS daemon.
+func GetDNSQueryLog(clientIP string) *Result {
+	if misc.DNSQueryLogReader == nil {
+		return &Result{Error: errors.New("DNS daemon is not running in this program")}
+	}
+	queries, err := misc.DNSQueryLogReader(clientIP)
+	return &Result{Output: queries, Error: err}
+}
+
 // Return runtime information (uptime, CPUs, goroutines, memory usage) in a multi-line text.
 func GetRuntimeInfo() string {
 	usedMem, totalMem := misc.GetSystemMemoryUsageKB()
 	usedRoot, freeRoot, totalRoot := platform.GetRootDiskUsageKB()
+	container := misc.GetContainerRuntime()
+	if container == "" {
+		container = "none"
+	}
+	supervisorStatus := os.Getenv(misc.SupervisorStatusEnvName)
+	if supervisorStatus == "" {
+		supervisorStatus = "not supervised"
+	}
 	return fmt.Sprintf(`IP: %s
+Container: %s
+Cloud: %s
 Clock: %s
 Sys/prog uptime: %s / %s
 Total/used/prog mem: %d / %d / %d MB
 Total/used/free rootfs: %d / %d / %d MB
 Sys load: %s
-Num CPU/GOMAXPROCS/goroutines: %d / %d / %d
+CPU usage: %s
+Num CPU/quota/GOMAXPROCS/goroutines: %d / %.2f / %d / %d
 Program flags: %v
+Supervisor: %s
 `,
 		inet.GetPublicIP(),
+		container,
+		inet.GetCloudInstance().String(),
 		time.Now().String(),
 		time.Duration(misc.GetSystemUptimeSec()*int(time.Second)).String(), time.Since(misc.StartupTime).String(),
 		totalMem/1024, usedMem/1024, misc.GetProgramMemoryUsageKB()/1024,
 		totalRoot/1024, usedRoot/1024, freeRoot/1024,
 		misc.GetSystemLoad(),
-		runtime.NumCPU(), runtime.GOMAXPROCS(0), runtime.NumGoroutine(),
-		os.Args[1:])
+		misc.FormatCPUUsage(misc.GetCPUUsage()),
+		runtime.NumCPU(), misc.GetNumCPUs(), runtime.GOMAXPROCS(0), runtime.NumGoroutine(),
+		os.Args[1:],
+		supervisorStatus)
+}
+
+// GetDiskUsageInfo returns space and inode usage of all mounted file systems in a multi-line text, one file system per line.
+func GetDiskUsageInfo() string {
+	var buf bytes.Buffer
+	for _, usage := range platform.GetAllDiskUsage() {
+		buf.WriteString(fmt.Sprintf("%s (%s on %s) total/used/free: %d / %d / %d MB, inodes: %d / %d / %d\n",
+			usage.MountPoint, usage.FSType, usage.Device,
+			usage.TotalKB/1024, usage.UsedKB/1024, usage.FreeKB/1024,
+			usage.TotalInodes, usage.UsedInodes, usage.FreeInodes))
+	}
+	return buf.String()
 }
 
 // Return latest log entry of all kinds in a multi-line text, one log entry per line. Latest log entry comes first.
@@ -1,7 +1,11 @@
 package toolbox
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -20,34 +24,55 @@ func TestEnvControl_Execute(t *testing.T) {
 	if err := info.SelfTest(); err != nil {
 		t.Fatal(err)
 	}
-	if ret := info.Execute(Command{Content: "wrong"}); ret.Error != ErrBadEnvInfoChoice {
+	if ret := info.Execute(context.Background(), Command{Content: "wrong"}); ret.Error != ErrBadEnvInfoChoice {
 		t.Fatal(ret)
 	}
-	if ret := info.Execute(Command{Content: "info"}); ret.Error != nil || !strings.Contains(ret.Output, "Sys/prog uptime") {
+	if ret := info.Execute(context.Background(), Command{Content: "info"}); ret.Error != nil || !strings.Contains(ret.Output, "Sys/prog uptime") {
 		t.Fatal(ret)
 	}
 	// Test log retrieval
 	logger := lalog.Logger{}
 	logger.Info("envinfo printf test", "", nil, "")
 	logger.Warning("envinfo warningf test", "", nil, "")
-	if ret := info.Execute(Command{Content: "log"}); ret.Error != nil || !strings.Contains(ret.Output, "envinfo printf test") {
+	if ret := info.Execute(context.Background(), Command{Content: "log"}); ret.Error != nil || !strings.Contains(ret.Output, "envinfo printf test") {
 		t.Fatal(ret)
 	}
-	if ret := info.Execute(Command{Content: "warn"}); ret.Error != nil || !strings.Contains(ret.Output, "envinfo warningf test") {
+	if ret := info.Execute(context.Background(), Command{Content: "warn"}); ret.Error != nil || !strings.Contains(ret.Output, "envinfo warningf test") {
 		t.Fatal(ret)
 	}
 	// Test stack retrieval
-	if ret := info.Execute(Command{Content: "stack"}); ret.Error != nil || !strings.Contains(ret.Output, "routine") {
+	if ret := info.Execute(context.Background(), Command{Content: "stack"}); ret.Error != nil || !strings.Contains(ret.Output, "routine") {
 		t.Fatal(ret)
 	}
 	// Test system tuning
-	ret := info.Execute(Command{Content: "tune"})
+	ret := info.Execute(context.Background(), Command{Content: "tune"})
 	fmt.Println(ret.Output)
 	if ret.Error != nil {
 		t.Fatal(ret)
 	}
+	// Test DNS cache purge
+	if ret := info.Execute(context.Background(), Command{Content: "purgedns"}); ret.Error == nil {
+		t.Fatal(ret)
+	}
+	misc.DNSCachePurger = func() int { return 3 }
+	if ret := info.Execute(context.Background(), Command{Content: "purgedns"}); ret.Error != nil || ret.Output != "OK - removed 3 cached DNS responses" {
+		t.Fatal(ret)
+	}
+	misc.DNSCachePurger = nil
+	// Test DNS query log retrieval
+	if ret := info.Execute(context.Background(), Command{Content: "dnslog"}); ret.Error == nil {
+		t.Fatal(ret)
+	}
+	misc.DNSQueryLogReader = func(clientIP string) (string, error) { return "queries of " + clientIP, nil }
+	if ret := info.Execute(context.Background(), Command{Content: "dnslog 1.2.3.4"}); ret.Error != nil || ret.Output != "queries of 1.2.3.4" {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(context.Background(), Command{Content: "dnslog 1.2.3.4 5.6.7.8"}); ret.Error != ErrBadEnvInfoChoice {
+		t.Fatal(ret)
+	}
+	misc.DNSQueryLogReader = nil
 	// Test lockdown
-	if ret := info.Execute(Command{Content: "lock"}); !strings.Contains(ret.Output, "OK") {
+	if ret := info.Execute(context.Background(), Command{Content: "lock"}); !strings.Contains(ret.Output, "OK") {
 		t.Fatal(ret)
 	}
 	if !misc.EmergencyLockDown {
@@ -55,3 +80,49 @@ func TestEnvControl_Execute(t *testing.T) {
 	}
 	misc.EmergencyLockDown = false
 }
+
+func TestEnvControl_Rekey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-TestEnvControl_Rekey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configPath := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(configPath, []byte(`{}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := misc.Encrypt(configPath, []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+	oldConfigPath, oldPassword := misc.ConfigFilePath, misc.ProgramDataDecryptionPassword
+	defer func() {
+		misc.ConfigFilePath, misc.ProgramDataDecryptionPassword = oldConfigPath, oldPassword
+	}()
+	misc.ConfigFilePath, misc.ProgramDataDecryptionPassword = configPath, "old"
+	info := EnvControl{}
+	if ret := info.Execute(context.Background(), Command{Content: "rekey old", Encrypted: true}); ret.Error != ErrBadEnvInfoChoice {
+		t.Fatal(ret)
+	}
+	if ret := info.Execute(context.Background(), Command{Content: "rekey wrong new", Encrypted: true}); ret.Error == nil {
+		t.Fatal("did not error")
+	}
+	// Rekey does not work over plain channels
+	if ret := info.Execute(context.Background(), Command{Content: "rekey old new"}); ret.Error != ErrRekeyOverPlainChannel {
+		t.Fatal(ret)
+	}
+	// Files are restored to the current password if the supervisor cannot be reached
+	_ = os.Setenv(misc.SupervisorStatusEnvName, "no failure")
+	if ret := info.Execute(context.Background(), Command{Content: "rekey old new", Encrypted: true}); ret.Error == nil || misc.ProgramDataDecryptionPassword != "old" {
+		t.Fatal(ret)
+	}
+	_ = os.Unsetenv(misc.SupervisorStatusEnvName)
+	if content, err := misc.Decrypt(configPath, "old"); err != nil || string(content) != `{}` {
+		t.Fatal(err, string(content))
+	}
+	if ret := info.Execute(context.Background(), Command{Content: "rekey old new", Encrypted: true}); ret.Error != nil {
+		t.Fatal(ret.Error)
+	}
+	if content, err := misc.Decrypt(configPath, "new"); err != nil || string(content) != `{}` || misc.ProgramDataDecryptionPassword != "new" {
+		t.Fatal(err, string(content))
+	}
+}
@@ -3,6 +3,7 @@ package toolbox
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -380,6 +381,7 @@ func (imap *IMAPAccounts) ListMails(cmd Command) *Result {
 		return &Result{Error: err}
 	}
 	var output bytes.Buffer
+	var choices []Choice
 	for i := toNum; i >= fromNum; i-- {
 		header, found := headers[i]
 		if !found {
@@ -391,8 +393,12 @@ func (imap *IMAPAccounts) ListMails(cmd Command) *Result {
 			continue
 		}
 		output.WriteString(fmt.Sprintf("%d %s %s\n", i, prop.FromAddress, prop.Subject))
+		choices = append(choices, Choice{
+			Label:   fmt.Sprintf("%d %s", i, prop.Subject),
+			Command: fmt.Sprintf("%s%s %s %d", imap.Trigger(), MailboxRead, mbox, i),
+		})
 	}
-	return &Result{Output: output.String()}
+	return &Result{Output: output.String(), Choices: choices}
 }
 
 func (imap *IMAPAccounts) ReadMessage(cmd Command) *Result {
@@ -443,7 +449,7 @@ func (imap *IMAPAccounts) ReadMessage(cmd Command) *Result {
 	}
 }
 
-func (imap *IMAPAccounts) Execute(cmd Command) (ret *Result) {
+func (imap *IMAPAccounts) Execute(ctx context.Context, cmd Command) (ret *Result) {
 	if errResult := cmd.Trim(); errResult != nil {
 		return errResult
 	}
@@ -0,0 +1,207 @@
+package toolbox
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/inet"
+)
+
+const (
+	LocalMailboxesTrigger = ".l" // LocalMailboxesTrigger is the trigger prefix string of LocalMailboxes app.
+	MailboxDelete         = "d"  // Prefix string to trigger deleting a message.
+)
+
+// ErrBadLocalMailboxParam is returned when the parameters of LocalMailboxes app are malformed.
+var ErrBadLocalMailboxParam = fmt.Errorf("%s box skip# count# | %s box to-read# | %s box to-delete#", MailboxList, MailboxRead, MailboxDelete)
+
+/*
+LocalMailboxes lists, reads, and deletes the mails stored in local maildirs, such as the ones that the mail server (smtpd)
+stores arriving mails in. Message numbers are assigned in the order of delivery, the latest message has the largest
+number.
+*/
+type LocalMailboxes struct {
+	Mailboxes map[string]string `json:"Mailboxes"` // Mailboxes are the mailbox names vs. paths to their maildirs
+}
+
+func (box *LocalMailboxes) IsConfigured() bool {
+	return len(box.Mailboxes) > 0
+}
+
+func (box *LocalMailboxes) SelfTest() error {
+	if !box.IsConfigured() {
+		return ErrIncompleteConfig
+	}
+	for name, dir := range box.Mailboxes {
+		if _, err := (inet.Maildir{Dir: dir}).List(); err != nil {
+			return fmt.Errorf("LocalMailboxes.SelfTest: mailbox \"%s\" - %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (box *LocalMailboxes) Initialise() error {
+	for name, dir := range box.Mailboxes {
+		if dir == "" {
+			return fmt.Errorf("LocalMailboxes.Initialise: mailbox \"%s\" does not have a maildir path", name)
+		}
+		// The maildir may not have received any mail yet
+		if err := (inet.Maildir{Dir: dir}).Initialise(); err != nil {
+			return fmt.Errorf("LocalMailboxes.Initialise: mailbox \"%s\" - %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (box *LocalMailboxes) Trigger() Trigger {
+	return LocalMailboxesTrigger
+}
+
+// getMessage returns the maildir of the mailbox and the message of the number (1 is the oldest).
+func (box *LocalMailboxes) getMessage(mboxName string, number int) (inet.Maildir, inet.MaildirMessage, error) {
+	dir, found := box.Mailboxes[mboxName]
+	if !found {
+		return inet.Maildir{}, inet.MaildirMessage{}, fmt.Errorf("LocalMailboxes: cannot find mailbox \"%s\"", mboxName)
+	}
+	maildir := inet.Maildir{Dir: dir}
+	messages, err := maildir.List()
+	if err != nil {
+		return maildir, inet.MaildirMessage{}, err
+	}
+	if number < 1 || number > len(messages) {
+		return maildir, inet.MaildirMessage{}, fmt.Errorf("LocalMailboxes: message number must be between 1 and %d", len(messages))
+	}
+	return maildir, messages[number-1], nil
+}
+
+func (box *LocalMailboxes) ListMails(cmd Command) *Result {
+	params := RegexMailboxAndTwoNumbers.FindStringSubmatch(cmd.Content)
+	if len(params) < 4 {
+		return &Result{Error: ErrBadLocalMailboxParam}
+	}
+	skip, skipErr := strconv.Atoi(params[2])
+	count, countErr := strconv.Atoi(params[3])
+	if skipErr != nil || countErr != nil {
+		return &Result{Error: ErrBadLocalMailboxParam}
+	}
+	if skip < 0 {
+		skip = 0
+	}
+	if count > 200 {
+		count = 200
+	}
+	if count < 1 {
+		count = 1
+	}
+	dir, found := box.Mailboxes[params[1]]
+	if !found {
+		return &Result{Error: fmt.Errorf("LocalMailboxes.ListMails: cannot find mailbox \"%s\"", params[1])}
+	}
+	maildir := inet.Maildir{Dir: dir}
+	messages, err := maildir.List()
+	if err != nil {
+		return &Result{Error: err}
+	}
+	if len(messages) == 0 {
+		return &Result{Output: "no mails"}
+	}
+	if skip >= len(messages) {
+		return &Result{Error: fmt.Errorf("LocalMailboxes.ListMails: skip must be less than %d", len(messages))}
+	}
+	// List the latest messages first
+	var output bytes.Buffer
+	var choices []Choice
+	for i := len(messages) - skip; i > 0 && i > len(messages)-skip-count; i-- {
+		msg := messages[i-1]
+		var fromAddr, subject string
+		if content, err := maildir.Peek(msg.Name); err == nil {
+			if prop, _, err := inet.ReadMailMessage(content); err == nil {
+				fromAddr, subject = prop.FromAddress, prop.Subject
+			}
+		}
+		var unread string
+		if !msg.Seen {
+			unread = "*"
+		}
+		output.WriteString(fmt.Sprintf("%d%s %s %s\n", i, unread, fromAddr, subject))
+		choices = append(choices, Choice{
+			Label:   fmt.Sprintf("%d %s", i, subject),
+			Command: fmt.Sprintf("%s%s %s %d", LocalMailboxesTrigger, MailboxRead, params[1], i),
+		})
+	}
+	return &Result{Output: output.String(), Choices: choices}
+}
+
+func (box *LocalMailboxes) ReadMessage(cmd Command) *Result {
+	params := RegexMailboxAndNumber.FindStringSubmatch(cmd.Content)
+	if len(params) < 3 {
+		return &Result{Error: ErrBadLocalMailboxParam}
+	}
+	number, err := strconv.Atoi(params[2])
+	if err != nil {
+		return &Result{Error: ErrBadLocalMailboxParam}
+	}
+	maildir, msg, err := box.getMessage(params[1], number)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	content, err := maildir.Read(msg.Name)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	// If mail is multi-part, prefer to retrieve the plain text mail body.
+	var anyText, plainText string
+	err = inet.WalkMailMessage(content, func(prop inet.BasicMail, body []byte) (bool, error) {
+		if !strings.Contains(prop.ContentType, "plain") {
+			anyText = string(body)
+		} else {
+			plainText = string(body)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return &Result{Error: err}
+	}
+	if plainText == "" {
+		return &Result{Output: anyText}
+	}
+	return &Result{Output: plainText}
+}
+
+func (box *LocalMailboxes) DeleteMessage(cmd Command) *Result {
+	params := RegexMailboxAndNumber.FindStringSubmatch(cmd.Content)
+	if len(params) < 3 {
+		return &Result{Error: ErrBadLocalMailboxParam}
+	}
+	number, err := strconv.Atoi(params[2])
+	if err != nil {
+		return &Result{Error: ErrBadLocalMailboxParam}
+	}
+	maildir, msg, err := box.getMessage(params[1], number)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	if err := maildir.Delete(msg.Name); err != nil {
+		return &Result{Error: err}
+	}
+	return &Result{Output: fmt.Sprintf("deleted message %d", number)}
+}
+
+func (box *LocalMailboxes) Execute(ctx context.Context, cmd Command) (ret *Result) {
+	if errResult := cmd.Trim(); errResult != nil {
+		return errResult
+	}
+	if cmd.FindAndRemovePrefix(MailboxList) {
+		ret = box.ListMails(cmd)
+	} else if cmd.FindAndRemovePrefix(MailboxRead) {
+		ret = box.ReadMessage(cmd)
+	} else if cmd.FindAndRemovePrefix(MailboxDelete) {
+		ret = box.DeleteMessage(cmd)
+	} else {
+		ret = &Result{Error: ErrBadLocalMailboxParam}
+	}
+	return
+}
@@ -0,0 +1,92 @@
+package toolbox
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/inet"
+)
+
+func TestLocalMailboxes_Execute(t *testing.T) {
+	dir, err := ioutil.TempDir("", "laitos-TestLocalMailboxes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	box := LocalMailboxes{}
+	if box.IsConfigured() {
+		t.Fatal("should not be configured")
+	}
+	if err := box.SelfTest(); err != ErrIncompleteConfig {
+		t.Fatal(err)
+	}
+	box.Mailboxes = map[string]string{"a": ""}
+	if err := box.Initialise(); err == nil || !strings.Contains(err.Error(), "maildir path") {
+		t.Fatal(err)
+	}
+	box.Mailboxes = map[string]string{"a": filepath.Join(dir, "a")}
+	if err := box.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if err := box.SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+	if ret := box.Execute(context.Background(), Command{TimeoutSec: 10, Content: MailboxList + "a 0 10"}); ret.Error != nil || ret.Output != "no mails" {
+		t.Fatal(ret)
+	}
+	maildir := inet.Maildir{Dir: box.Mailboxes["a"]}
+	for _, mail := range []string{
+		"From: howard@example.com\r\nSubject: first\r\n\r\nbody 1",
+		"From: Someone <someone@example.com>\r\nSubject: second\r\n\r\nbody 2",
+		"From: howard@example.com\r\nSubject: third\r\nContent-Type: multipart/alternative; boundary=\"b\"\r\n\r\n" +
+			"--b\r\nContent-Type: text/html\r\n\r\n<p>body 3</p>\r\n--b\r\nContent-Type: text/plain\r\n\r\nbody 3\r\n--b--\r\n",
+	} {
+		if _, err := maildir.Deliver([]byte(mail)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Bad parameters
+	for _, content := range []string{"!@$!@%#%#$@%", MailboxList, MailboxList + "a 1", MailboxRead + "a", MailboxDelete + "a b"} {
+		if ret := box.Execute(context.Background(), Command{TimeoutSec: 10, Content: content}); ret.Error != ErrBadLocalMailboxParam {
+			t.Fatal(content, ret)
+		}
+	}
+	if ret := box.Execute(context.Background(), Command{TimeoutSec: 10, Content: MailboxList + "b 0 10"}); ret.Error == nil || !strings.Contains(ret.Error.Error(), "find mailbox") {
+		t.Fatal(ret)
+	}
+	if ret := box.Execute(context.Background(), Command{TimeoutSec: 10, Content: MailboxRead + "a 4"}); ret.Error == nil || !strings.Contains(ret.Error.Error(), "between 1 and 3") {
+		t.Fatal(ret)
+	}
+	if ret := box.Execute(context.Background(), Command{TimeoutSec: 10, Content: MailboxList + "a 3 10"}); ret.Error == nil || !strings.Contains(ret.Error.Error(), "skip must be") {
+		t.Fatal(ret)
+	}
+	// List the latest messages first
+	ret := box.Execute(context.Background(), Command{TimeoutSec: 10, Content: MailboxList + "a 0 2"})
+	if ret.Error != nil || ret.Output != "3* howard@example.com third\n2* someone@example.com second\n" {
+		t.Fatal(ret)
+	}
+	if len(ret.Choices) != 2 || ret.Choices[0] != (Choice{Label: "3 third", Command: ".lr a 3"}) || ret.Choices[1].Command != ".lr a 2" {
+		t.Fatal(ret.Choices)
+	}
+	// Read a message and prefer its plain text content
+	if ret := box.Execute(context.Background(), Command{TimeoutSec: 10, Content: MailboxRead + "a 3"}); ret.Error != nil || ret.Output != "body 3" {
+		t.Fatal(ret)
+	}
+	if ret := box.Execute(context.Background(), Command{TimeoutSec: 10, Content: MailboxList + "a 0 10"}); ret.Error != nil || ret.Output != "3 howard@example.com third\n2* someone@example.com second\n1* howard@example.com first\n" {
+		t.Fatal(ret)
+	}
+	// Delete a message
+	if ret := box.Execute(context.Background(), Command{TimeoutSec: 10, Content: MailboxDelete + "a 2"}); ret.Error != nil || ret.Output != "deleted message 2" {
+		t.Fatal(ret)
+	}
+	if ret := box.Execute(context.Background(), Command{TimeoutSec: 10, Content: MailboxList + "a 0 10"}); ret.Error != nil || ret.Output != "2 howard@example.com third\n1* howard@example.com first\n" {
+		t.Fatal(ret)
+	}
+	if ret := box.Execute(context.Background(), Command{TimeoutSec: 10, Content: MailboxRead + "a 1"}); ret.Error != nil || ret.Output != "body 1" {
+		t.Fatal(ret)
+	}
+}
@@ -0,0 +1,155 @@
+package toolbox
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/HouzuoGuo/laitos/inet"
+)
+
+var (
+	// RegexRemoteUnlock finds a shortcut name and an optional password.
+	RegexRemoteUnlock = regexp.MustCompile(`^(\w+)\s*(.*)$`)
+	// RegexRemoteUnlockTOTP finds the TOTP code that follows the optional password.
+	RegexRemoteUnlockTOTP   = regexp.MustCompile(`^(?:(.*\S)\s+)?(\d{6,8})$`)
+	ErrBadRemoteUnlockParam = errors.New(`example: shortcut [password] [TOTP]`)
+)
+
+const RemoteUnlockTrigger = ".u" // RemoteUnlockTrigger is the trigger prefix string of RemoteUnlock feature.
+
+/*
+RemoteUnlock submits a password to the password input web server of another laitos computer in order to unlock its
+program data. An operator may use it via any app command channel (e.g. DNS or telegram bot) to unlock a freshly rebooted
+server, without having to visit the hidden unlock URL over HTTP.
+If the server splits its password into secret shares, submit a share in place of the password.
+*/
+type RemoteUnlock struct {
+	URLs      map[string]string `json:"URLs"`      // URLs contains shortcut name VS URL of password input web server
+	Passwords map[string]string `json:"Passwords"` // Passwords optionally contains shortcut name VS unlock password (or secret share)
+	/*
+		PinnedPublicKeys optionally contains shortcut name VS base64-encoded SHA256 digests of the SubjectPublicKeyInfo
+		of certificates trusted to identify the server. The URL of a pinned server must be HTTPS.
+	*/
+	PinnedPublicKeys map[string][]string `json:"PinnedPublicKeys"`
+	/*
+		TOTPSecrets optionally contains shortcut name VS base32 secret of the TOTP asked by the server. Without a secret,
+		the TOTP code must be given at the end of the command.
+	*/
+	TOTPSecrets map[string]string `json:"TOTPSecrets"`
+
+	tlsConfigs map[string]*tls.Config // tlsConfigs contains shortcut name VS TLS configuration that verifies the pinned public keys
+}
+
+func (unlock *RemoteUnlock) IsConfigured() bool {
+	return len(unlock.URLs) > 0
+}
+
+func (unlock *RemoteUnlock) SelfTest() error {
+	if !unlock.IsConfigured() {
+		return ErrIncompleteConfig
+	}
+	return nil
+}
+
+func (unlock *RemoteUnlock) Initialise() error {
+	for shortcut, aURL := range unlock.URLs {
+		if _, err := url.Parse(aURL); err != nil || aURL == "" {
+			return fmt.Errorf("RemoteUnlock.Initialise: failed to parse URL of shortcut \"%s\" - %v", shortcut, err)
+		}
+	}
+	for shortcut := range unlock.Passwords {
+		if _, found := unlock.URLs[shortcut]; !found {
+			return fmt.Errorf("RemoteUnlock.Initialise: password shortcut \"%s\" does not have a URL", shortcut)
+		}
+	}
+	for shortcut, secret := range unlock.TOTPSecrets {
+		if _, found := unlock.URLs[shortcut]; !found {
+			return fmt.Errorf("RemoteUnlock.Initialise: TOTP shortcut \"%s\" does not have a URL", shortcut)
+		}
+		if _, _, _, err := GetTwoFACodes(secret); err != nil {
+			return fmt.Errorf("RemoteUnlock.Initialise: TOTP secret of shortcut \"%s\" is malformed - %v", shortcut, err)
+		}
+	}
+	unlock.tlsConfigs = make(map[string]*tls.Config)
+	for shortcut, pinnedKeys := range unlock.PinnedPublicKeys {
+		aURL, found := unlock.URLs[shortcut]
+		if !found {
+			return fmt.Errorf("RemoteUnlock.Initialise: pinned public key shortcut \"%s\" does not have a URL", shortcut)
+		}
+		if parsedURL, _ := url.Parse(aURL); parsedURL.Scheme != "https" {
+			return fmt.Errorf("RemoteUnlock.Initialise: URL of shortcut \"%s\" must use https to verify the pinned public keys", shortcut)
+		}
+		pins, err := inet.ParsePublicKeyPins(pinnedKeys)
+		if err != nil {
+			return fmt.Errorf("RemoteUnlock.Initialise: %v", err)
+		}
+		unlock.tlsConfigs[shortcut] = inet.GetPinnedTLSConfig(pins)
+	}
+	return nil
+}
+
+func (unlock *RemoteUnlock) Trigger() Trigger {
+	return RemoteUnlockTrigger
+}
+
+/*
+Execute submits the password of the server identified by the shortcut name. If the command does not specify a password,
+the password from configuration is used. If the server asks for a TOTP, the code is calculated from the configured
+secret, or otherwise taken from the end of the command.
+*/
+func (unlock *RemoteUnlock) Execute(ctx context.Context, cmd Command) *Result {
+	if errResult := cmd.Trim(); errResult != nil {
+		return errResult
+	}
+	params := RegexRemoteUnlock.FindStringSubmatch(cmd.Content)
+	if len(params) != 3 {
+		return &Result{Error: ErrBadRemoteUnlockParam}
+	}
+	shortcut := params[1]
+	aURL, found := unlock.URLs[shortcut]
+	if !found {
+		shortcuts := make([]string, 0, len(unlock.URLs))
+		for shortcut := range unlock.URLs {
+			shortcuts = append(shortcuts, shortcut)
+		}
+		sort.Strings(shortcuts)
+		return &Result{Error: fmt.Errorf("cannot find %s among %s", shortcut, strings.Join(shortcuts, ","))}
+	}
+	client := inet.PasswdServerClient{URL: aURL, TLSConfig: unlock.tlsConfigs[shortcut]}
+	isPasswdServer, wantsTOTP, err := client.Probe()
+	if err != nil {
+		return &Result{Error: err}
+	} else if !isPasswdServer {
+		return &Result{Error: errors.New("the URL is not a password input server, the server may have already been unlocked")}
+	}
+	passwd := strings.TrimSpace(params[2])
+	var totp string
+	if wantsTOTP {
+		if secret := unlock.TOTPSecrets[shortcut]; secret != "" {
+			if _, totp, _, err = GetTwoFACodes(secret); err != nil {
+				return &Result{Error: err}
+			}
+		} else if match := RegexRemoteUnlockTOTP.FindStringSubmatch(passwd); match != nil {
+			passwd, totp = match[1], match[2]
+		} else {
+			return &Result{Error: errors.New("the server asks for a TOTP, " + ErrBadRemoteUnlockParam.Error())}
+		}
+	}
+	if passwd == "" {
+		passwd = unlock.Passwords[shortcut]
+	}
+	if passwd == "" {
+		return &Result{Error: ErrBadRemoteUnlockParam}
+	}
+	response, err := client.Submit(passwd, totp)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	return &Result{Output: response}
+}
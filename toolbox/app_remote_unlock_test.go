@@ -0,0 +1,143 @@
+package toolbox
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/HouzuoGuo/laitos/inet"
+)
+
+func TestRemoteUnlock(t *testing.T) {
+	unlock := RemoteUnlock{}
+	if unlock.IsConfigured() {
+		t.Fatal("not right")
+	}
+	var unlockedWith, unlockedTOTP string
+	var wantsTOTP bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if unlockedWith != "" {
+			_, _ = w.Write([]byte("OK"))
+		} else if r.Method == http.MethodGet {
+			w.Header().Set("Content-Location", inet.PasswdServerContentLocationMagic)
+			if wantsTOTP {
+				_, _ = w.Write([]byte(`<form><input type="text" name="` + inet.PasswdServerTOTPInputName + `"/></form>`))
+			}
+		} else if r.Method == http.MethodPost {
+			unlockedWith = r.FormValue(inet.PasswdServerPasswordInputName)
+			unlockedTOTP = r.FormValue(inet.PasswdServerTOTPInputName)
+			_, _ = w.Write([]byte("<html><form>\n<p>success</p>\n</form></html>"))
+		}
+	}))
+	defer srv.Close()
+	unlock.URLs = map[string]string{"srv": srv.URL}
+	unlock.Passwords = map[string]string{"nosuchsrv": "pass"}
+	if err := unlock.Initialise(); err == nil {
+		t.Fatal("did not error")
+	}
+	unlock.Passwords = map[string]string{"srv": "stored password"}
+	if !unlock.IsConfigured() {
+		t.Fatal("not configured")
+	}
+	if err := unlock.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if err := unlock.SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+	// Bad input
+	if ret := unlock.Execute(context.Background(), Command{TimeoutSec: 10, Content: "!"}); ret.Error != ErrBadRemoteUnlockParam {
+		t.Fatal(ret)
+	}
+	if ret := unlock.Execute(context.Background(), Command{TimeoutSec: 10, Content: "nosuchsrv"}); ret.Error == nil {
+		t.Fatal("did not error")
+	}
+	// Unlock using the password given in the command
+	if ret := unlock.Execute(context.Background(), Command{TimeoutSec: 10, Content: "srv given password"}); ret.Error != nil || ret.Output != "success" || unlockedWith != "given password" || unlockedTOTP != "" {
+		t.Fatal(ret, unlockedWith)
+	}
+	// The server no longer asks for a password
+	if ret := unlock.Execute(context.Background(), Command{TimeoutSec: 10, Content: "srv"}); ret.Error == nil {
+		t.Fatal("did not error")
+	}
+	// Unlock using the password from configuration
+	unlockedWith = ""
+	if ret := unlock.Execute(context.Background(), Command{TimeoutSec: 10, Content: "srv"}); ret.Error != nil || unlockedWith != "stored password" {
+		t.Fatal(ret, unlockedWith)
+	}
+
+	// The server asks for a TOTP, which is taken from the end of the command
+	unlockedWith = ""
+	wantsTOTP = true
+	if ret := unlock.Execute(context.Background(), Command{TimeoutSec: 10, Content: "srv given password"}); ret.Error == nil || unlockedWith != "" {
+		t.Fatal(ret, unlockedWith)
+	}
+	if ret := unlock.Execute(context.Background(), Command{TimeoutSec: 10, Content: "srv given password 123456"}); ret.Error != nil || unlockedWith != "given password" || unlockedTOTP != "123456" {
+		t.Fatal(ret, unlockedWith, unlockedTOTP)
+	}
+	unlockedWith = ""
+	if ret := unlock.Execute(context.Background(), Command{TimeoutSec: 10, Content: "srv 654321"}); ret.Error != nil || unlockedWith != "stored password" || unlockedTOTP != "654321" {
+		t.Fatal(ret, unlockedWith, unlockedTOTP)
+	}
+	// The TOTP is calculated from the configured secret
+	unlock.TOTPSecrets = map[string]string{"srv": "not base32!"}
+	if err := unlock.Initialise(); err == nil {
+		t.Fatal("should have rejected malformed TOTP secret")
+	}
+	unlock.TOTPSecrets = map[string]string{"srv": "JBSWY3DPEHPK3PXP"}
+	if err := unlock.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	_, expectedTOTP, _, err := GetTwoFACodes("JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unlockedWith = ""
+	if ret := unlock.Execute(context.Background(), Command{TimeoutSec: 10, Content: "srv"}); ret.Error != nil || unlockedWith != "stored password" || unlockedTOTP != expectedTOTP {
+		t.Fatal(ret, unlockedWith, unlockedTOTP, expectedTOTP)
+	}
+}
+
+func TestRemoteUnlock_PinnedPublicKeys(t *testing.T) {
+	var unlockedWith string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			w.Header().Set("Content-Location", inet.PasswdServerContentLocationMagic)
+		} else if r.Method == http.MethodPost {
+			unlockedWith = r.FormValue(inet.PasswdServerPasswordInputName)
+			_, _ = w.Write([]byte("<form><p>accepted the share, 1 of 2 shares have been collected</p></form>"))
+		}
+	}))
+	defer srv.Close()
+	digest := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	wrongDigest := sha256.Sum256([]byte("wrong"))
+	// Pinned public keys only work with https
+	unlock := RemoteUnlock{
+		URLs:             map[string]string{"srv": strings.Replace(srv.URL, "https", "http", 1)},
+		PinnedPublicKeys: map[string][]string{"srv": {base64.StdEncoding.EncodeToString(digest[:])}},
+	}
+	if err := unlock.Initialise(); err == nil {
+		t.Fatal("should have rejected http URL")
+	}
+	// The password must not be submitted to a server of a different key
+	unlock.URLs["srv"] = srv.URL
+	unlock.PinnedPublicKeys["srv"] = []string{base64.StdEncoding.EncodeToString(wrongDigest[:])}
+	if err := unlock.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if ret := unlock.Execute(context.Background(), Command{TimeoutSec: 10, Content: "srv 01abcd"}); ret.Error == nil || unlockedWith != "" {
+		t.Fatal(ret, unlockedWith)
+	}
+	// Submit a secret share to the server of the pinned key, which is self-signed.
+	unlock.PinnedPublicKeys["srv"] = []string{base64.StdEncoding.EncodeToString(digest[:])}
+	if err := unlock.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if ret := unlock.Execute(context.Background(), Command{TimeoutSec: 10, Content: "srv 01abcd"}); ret.Error != nil || unlockedWith != "01abcd" || ret.Output != "accepted the share, 1 of 2 shares have been collected" {
+		t.Fatal(ret, unlockedWith)
+	}
+}
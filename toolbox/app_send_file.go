@@ -0,0 +1,77 @@
+package toolbox
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// SendFileDefaultMaxSizeMB is the default maximum size of a file sent by the app, it is the limit of telegram chat bots.
+const SendFileDefaultMaxSizeMB = 20
+
+/*
+SendFile is an app that reads a file (such as a log file or a screenshot) on the server and attaches it to the command
+result. Daemons capable of transferring files (e.g. telegram bot) send the file to the user, the other daemons only
+present the name and size of the file.
+*/
+type SendFile struct {
+	MaxSizeMB int `json:"MaxSizeMB"` // MaxSizeMB is the maximum size of a file to be sent.
+}
+
+// IsConfigured always returns true because configuration is not required for this feature.
+func (snd *SendFile) IsConfigured() bool {
+	return true
+}
+
+// SelfTest does nothing because there is nothing to test.
+func (snd *SendFile) SelfTest() error {
+	return nil
+}
+
+// Initialise sets the default file size limit.
+func (snd *SendFile) Initialise() error {
+	if snd.MaxSizeMB < 1 {
+		snd.MaxSizeMB = SendFileDefaultMaxSizeMB
+	}
+	return nil
+}
+
+// Trigger returns the trigger prefix string ".f".
+func (snd *SendFile) Trigger() Trigger {
+	return ".f"
+}
+
+// Execute reads the file at the path specified by command input, and attaches the file content to the result.
+func (snd *SendFile) Execute(ctx context.Context, cmd Command) *Result {
+	if errResult := cmd.Trim(); errResult != nil {
+		return errResult
+	}
+	filePath := cmd.Content
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	if info.IsDir() {
+		return &Result{Error: fmt.Errorf("%s is a directory", filePath)}
+	}
+	maxSizeMB := snd.MaxSizeMB
+	if maxSizeMB < 1 {
+		maxSizeMB = SendFileDefaultMaxSizeMB
+	}
+	if info.Size() > int64(maxSizeMB*1048576) {
+		return &Result{Error: fmt.Errorf("file size exceeds the limit of %d MB", maxSizeMB)}
+	}
+	content, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return &Result{Error: err}
+	}
+	if len(content) > maxSizeMB*1048576 {
+		return &Result{Error: errors.New("file size exceeds the limit while it is being read")}
+	}
+	return &Result{
+		Output:     fmt.Sprintf("%s (%d bytes)", filePath, len(content)),
+		Attachment: &Attachment{Name: filePath, Content: content},
+	}
+}
@@ -0,0 +1,62 @@
+package toolbox
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSendFile_Execute(t *testing.T) {
+	snd := SendFile{}
+	if !snd.IsConfigured() {
+		t.Fatal("should be configured")
+	}
+	if err := snd.Initialise(); err != nil || snd.MaxSizeMB != SendFileDefaultMaxSizeMB {
+		t.Fatal(err, snd.MaxSizeMB)
+	}
+	if err := snd.SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "laitos-TestSendFile_Execute")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filePath := filepath.Join(dir, "report.txt")
+	if err := ioutil.WriteFile(filePath, []byte("hello file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Missing file path
+	if result := snd.Execute(context.Background(), Command{TimeoutSec: 10, Content: "   "}); result.Error != ErrEmptyCommand {
+		t.Fatal(result)
+	}
+	// File does not exist
+	if result := snd.Execute(context.Background(), Command{TimeoutSec: 10, Content: filepath.Join(dir, "does-not-exist")}); result.Error == nil || result.Attachment != nil {
+		t.Fatal(result)
+	}
+	// Directory cannot be sent
+	if result := snd.Execute(context.Background(), Command{TimeoutSec: 10, Content: dir}); result.Error == nil || result.Attachment != nil {
+		t.Fatal(result)
+	}
+	// Send the file
+	result := snd.Execute(context.Background(), Command{TimeoutSec: 10, Content: " " + filePath + " "})
+	if result.Error != nil || result.Output != filePath+" (10 bytes)" {
+		t.Fatal(result)
+	}
+	if result.Attachment == nil || result.Attachment.Name != filePath || !bytes.Equal(result.Attachment.Content, []byte("hello file")) {
+		t.Fatalf("%+v", result.Attachment)
+	}
+	// File exceeds size limit
+	if err := ioutil.WriteFile(filePath, bytes.Repeat([]byte{0}, 1048577), 0600); err != nil {
+		t.Fatal(err)
+	}
+	snd.MaxSizeMB = 1
+	if result := snd.Execute(context.Background(), Command{TimeoutSec: 10, Content: filePath}); result.Error == nil || result.Attachment != nil {
+		t.Fatal(result)
+	}
+}
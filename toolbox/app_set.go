@@ -23,7 +23,10 @@ type FeatureSet struct {
 	EnvControl         EnvControl         `json:"EnvControl"`
 	IMAPAccounts       IMAPAccounts       `json:"IMAPAccounts"`
 	Joke               Joke               `json:"Joke"`
+	LocalMailboxes     LocalMailboxes     `json:"LocalMailboxes"`
+	RemoteUnlock       RemoteUnlock       `json:"RemoteUnlock"`
 	RSS                RSS                `json:"RSS"`
+	SendFile           SendFile           `json:"SendFile"`
 	SendMail           SendMail           `json:"SendMail"`
 	Shell              Shell              `json:"Shell"`
 	TextSearch         TextSearch         `json:"TextSearch"`
@@ -50,7 +53,10 @@ func (fs *FeatureSet) Initialise() error {
 		fs.TextSearch.Trigger():         &fs.TextSearch,         // g
 		fs.IMAPAccounts.Trigger():       &fs.IMAPAccounts,       // i
 		fs.Joke.Trigger():               &fs.Joke,               // j
+		fs.LocalMailboxes.Trigger():     &fs.LocalMailboxes,     // l
 		fs.RSS.Trigger():                &fs.RSS,                // r
+		fs.RemoteUnlock.Trigger():       &fs.RemoteUnlock,       // u
+		fs.SendFile.Trigger():           &fs.SendFile,           // f
 		fs.SendMail.Trigger():           &fs.SendMail,           // m
 		fs.Shell.Trigger():              &fs.Shell,              // s
 		fs.Twilio.Trigger():             &fs.Twilio,             // p
@@ -127,7 +133,10 @@ func (fs *FeatureSet) DeserialiseFromJSON(configJSON json.RawMessage) error {
 		"EnvControl":         &fs.EnvControl,
 		"IMAPAccounts":       &fs.IMAPAccounts,
 		"Joke":               &fs.Joke,
+		"LocalMailboxes":     &fs.LocalMailboxes,
 		"RSS":                &fs.RSS,
+		"RemoteUnlock":       &fs.RemoteUnlock,
+		"SendFile":           &fs.SendFile,
 		"SendMail":           &fs.SendMail,
 		"Shell":              &fs.Shell,
 		"Twilio":             &fs.Twilio,
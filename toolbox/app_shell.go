@@ -1,15 +1,36 @@
 package toolbox
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/HouzuoGuo/laitos/misc"
+	"github.com/HouzuoGuo/laitos/platform"
 )
 
+/*
+ShellStdinSeparator is a line that separates the shell command from the text fed to the command's standard input, e.g.
+"patch -p1\n.stdin\n--- a/file ...". Without the separator, the shell command reads nothing from its standard input.
+*/
+const ShellStdinSeparator = "\n.stdin\n"
+
 // Execute shell commands with a timeout limit.
 type Shell struct {
-	InterpreterPath string `json:"InterpreterPath"` // Path to *nix shell interpreter
+	InterpreterPath  string `json:"InterpreterPath"`  // Path to *nix shell interpreter
+	RunAsUser        string `json:"RunAsUser"`        // RunAsUser is the name of an unprivileged user to run shell commands as
+	WorkingDirectory string `json:"WorkingDirectory"` // WorkingDirectory is the working directory of shell commands
+	Umask            string `json:"Umask"`            // Umask is the file mode creation mask of shell commands in octal, e.g. "0077"
+	// Limits restrict the system resources that each shell command may consume
+	Limits platform.ProgramLimits `json:"Limits"`
+	// EnvAllowlist is the names of laitos' environment variables that shell commands may inherit, e.g. "LANG" or "LC_*"
+	EnvAllowlist []string `json:"EnvAllowlist"`
+	// EnvDenylist is the names of laitos' environment variables that shell commands must not inherit, e.g. "AWS_*"
+	EnvDenylist []string `json:"EnvDenylist"`
+
+	options platform.ProgramOptions
 }
 
 func (sh *Shell) IsConfigured() bool {
@@ -22,7 +43,7 @@ func (sh *Shell) SelfTest() error {
 		return errors.New("Shell.SelfTest: OS is not compatible")
 	}
 	// The timeout for testing shell is gracious enough to allow disk to spin up from sleep
-	if _, err := misc.InvokeShell(misc.CommonOSCmdTimeoutSec, sh.InterpreterPath, "echo test"); err != nil {
+	if _, err := misc.InvokeShellWithOptions(sh.options, misc.CommonOSCmdTimeoutSec, sh.InterpreterPath, "echo test"); err != nil {
 		return fmt.Errorf("Shell.SelfTest: interpreter \"%s\" is not working - %v", sh.InterpreterPath, err)
 	}
 	return nil
@@ -35,6 +56,22 @@ func (sh *Shell) Initialise() error {
 	if sh.InterpreterPath == "" {
 		return errors.New("Shell.Initialise: failed to find a working shell interpreter")
 	}
+	sh.options = platform.ProgramOptions{
+		RunAsUser:        sh.RunAsUser,
+		WorkingDirectory: sh.WorkingDirectory,
+		Limits:           sh.Limits,
+		EnvAllowlist:     sh.EnvAllowlist,
+		EnvDenylist:      sh.EnvDenylist,
+	}
+	if sh.Umask != "" {
+		umask, err := strconv.ParseUint(sh.Umask, 8, 32)
+		if err != nil || umask > 0777 {
+			return fmt.Errorf("Shell.Initialise: umask \"%s\" is not a valid octal number", sh.Umask)
+		}
+		// An explicit "0000" is a valid umask too, it differs from leaving the umask unset.
+		umaskInt := int(umask)
+		sh.options.Umask = &umaskInt
+	}
 	return nil
 }
 
@@ -42,10 +79,17 @@ func (sh *Shell) Trigger() Trigger {
 	return ".s"
 }
 
-func (sh *Shell) Execute(cmd Command) *Result {
+func (sh *Shell) Execute(ctx context.Context, cmd Command) *Result {
 	if errResult := cmd.Trim(); errResult != nil {
 		return errResult
 	}
-	procOut, procErr := misc.InvokeShell(cmd.TimeoutSec, sh.InterpreterPath, cmd.Content)
+	options := sh.options
+	options.Context = ctx
+	content := cmd.Content
+	if sepIndex := strings.Index(content, ShellStdinSeparator); sepIndex != -1 {
+		options.Stdin = strings.NewReader(content[sepIndex+len(ShellStdinSeparator):])
+		content = content[:sepIndex]
+	}
+	procOut, procErr := misc.InvokeShellWithOptions(options, cmd.TimeoutSec, sh.InterpreterPath, content)
 	return &Result{Error: procErr, Output: procOut}
 }
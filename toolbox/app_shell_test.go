@@ -1,6 +1,7 @@
 package toolbox
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -26,7 +27,7 @@ func TestShell_WindowsExecute(t *testing.T) {
 	}
 
 	// Execute empty command
-	ret := sh.Execute(Command{TimeoutSec: 1, Content: "      "})
+	ret := sh.Execute(context.Background(), Command{TimeoutSec: 1, Content: "      "})
 	if ret.Error != ErrEmptyCommand ||
 		ret.ErrText() != ErrEmptyCommand.Error() ||
 		ret.Output != "" ||
@@ -35,7 +36,7 @@ func TestShell_WindowsExecute(t *testing.T) {
 	}
 
 	// Execute a successful command
-	ret = sh.Execute(Command{TimeoutSec: 3, Content: `echo '"abc"'`})
+	ret = sh.Execute(context.Background(), Command{TimeoutSec: 3, Content: `echo '"abc"'`})
 	if ret.Error != nil ||
 		ret.ErrText() != "" ||
 		strings.TrimSpace(ret.Output) != `"abc"` ||
@@ -44,7 +45,7 @@ func TestShell_WindowsExecute(t *testing.T) {
 	}
 
 	// Execute a failing command
-	ret = sh.Execute(Command{TimeoutSec: 3, Content: `does-not-exist`})
+	ret = sh.Execute(context.Background(), Command{TimeoutSec: 3, Content: `does-not-exist`})
 	if ret.Error == nil ||
 		ret.ErrText() != "exit status 1" ||
 		!strings.Contains(ret.Output, "CommandNotFoundException") ||
@@ -69,7 +70,7 @@ func TestShell_NonWindowsExecute(t *testing.T) {
 	}
 
 	// Execute empty command
-	ret := sh.Execute(Command{TimeoutSec: 1, Content: "      "})
+	ret := sh.Execute(context.Background(), Command{TimeoutSec: 1, Content: "      "})
 	if ret.Error != ErrEmptyCommand ||
 		ret.ErrText() != ErrEmptyCommand.Error() ||
 		ret.Output != "" ||
@@ -78,7 +79,7 @@ func TestShell_NonWindowsExecute(t *testing.T) {
 	}
 
 	// Execute a successful command
-	ret = sh.Execute(Command{TimeoutSec: 1, Content: `echo -n '"abc"' > /proc/self/fd/2`})
+	ret = sh.Execute(context.Background(), Command{TimeoutSec: 1, Content: `echo -n '"abc"' > /proc/self/fd/2`})
 	if ret.Error != nil ||
 		ret.ErrText() != "" ||
 		ret.Output != `"abc"` ||
@@ -87,7 +88,7 @@ func TestShell_NonWindowsExecute(t *testing.T) {
 	}
 
 	// Execute a failing command
-	ret = sh.Execute(Command{TimeoutSec: 1, Content: `echo -e 'a\nb' && false # this is a comment`})
+	ret = sh.Execute(context.Background(), Command{TimeoutSec: 1, Content: `echo -e 'a\nb' && false # this is a comment`})
 	if ret.Error == nil ||
 		ret.ErrText() != "exit status 1" ||
 		ret.Output != "a\nb\n" ||
@@ -95,6 +96,17 @@ func TestShell_NonWindowsExecute(t *testing.T) {
 		t.Fatalf("%v\n%s\n%s\n%s", ret.Error, ret.ErrText(), ret.Output, ret.ResetCombinedText())
 	}
 
+	// Feed text to the command's standard input
+	ret = sh.Execute(context.Background(), Command{TimeoutSec: 3, Content: "tr a-z A-Z" + ShellStdinSeparator + "abc\ndef"})
+	if ret.Error != nil || ret.Output != "ABC\nDEF" {
+		t.Fatalf("%v\n%s", ret.Error, ret.Output)
+	}
+	// Without the separator the command reads nothing
+	ret = sh.Execute(context.Background(), Command{TimeoutSec: 3, Content: "cat"})
+	if ret.Error != nil || ret.Output != "" {
+		t.Fatalf("%v\n%s", ret.Error, ret.Output)
+	}
+
 	// Execute a timeout command - it should not remove the temp file after timing out
 	tmpFile, err := ioutil.TempFile("", "")
 	if err != nil {
@@ -102,7 +114,7 @@ func TestShell_NonWindowsExecute(t *testing.T) {
 	}
 	defer os.Remove(tmpFile.Name())
 	start := time.Now().Unix()
-	ret = sh.Execute(Command{TimeoutSec: 2, Content: `echo -n abc && sleep 5 && rm ` + tmpFile.Name()})
+	ret = sh.Execute(context.Background(), Command{TimeoutSec: 2, Content: `echo -n abc && sleep 5 && rm ` + tmpFile.Name()})
 	if !strings.Contains(ret.Error.Error(), "time limit") ||
 		ret.Output != "abc" ||
 		!strings.Contains(ret.ResetCombinedText(), "time limit") || !strings.Contains(ret.ResetCombinedText(), CombinedTextSeparator+"abc") {
@@ -118,3 +130,27 @@ func TestShell_NonWindowsExecute(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestShell_Umask(t *testing.T) {
+	if misc.HostIsWindows() {
+		t.Skip("this test is skipped on Windows")
+	}
+	if err := (&Shell{Umask: "0999"}).Initialise(); err == nil {
+		t.Fatal("should have rejected invalid umask")
+	}
+	// An explicit 0 umask is honoured rather than treated as unset
+	sh := Shell{Umask: "0000"}
+	if err := sh.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if ret := sh.Execute(context.Background(), Command{TimeoutSec: 3, Content: "umask"}); ret.Error != nil || strings.TrimSpace(ret.Output) != "0000" {
+		t.Fatalf("%v\n%s", ret.Error, ret.Output)
+	}
+	sh = Shell{Umask: "0077"}
+	if err := sh.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if ret := sh.Execute(context.Background(), Command{TimeoutSec: 3, Content: "umask"}); ret.Error != nil || strings.TrimSpace(ret.Output) != "0077" {
+		t.Fatalf("%v\n%s", ret.Error, ret.Output)
+	}
+}
@@ -1,6 +1,7 @@
 package toolbox
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -64,22 +65,22 @@ func (twi *Twilio) Trigger() Trigger {
 	return ".p"
 }
 
-func (twi *Twilio) Execute(cmd Command) (ret *Result) {
+func (twi *Twilio) Execute(ctx context.Context, cmd Command) (ret *Result) {
 	if errResult := cmd.Trim(); errResult != nil {
 		return errResult
 	}
 
 	if strings.HasPrefix(cmd.Content, TwilioMakeCall) {
-		ret = twi.MakeCall(cmd)
+		ret = twi.MakeCall(ctx, cmd)
 	} else if strings.HasPrefix(cmd.Content, TwilioSendSMS) {
-		ret = twi.SendSMS(cmd)
+		ret = twi.SendSMS(ctx, cmd)
 	} else {
 		ret = &Result{Error: ErrBadTwilioParam}
 	}
 	return
 }
 
-func (twi *Twilio) MakeCall(cmd Command) *Result {
+func (twi *Twilio) MakeCall(ctx context.Context, cmd Command) *Result {
 	params := RegexPhoneNumberAndMessage.FindStringSubmatch(strings.TrimPrefix(cmd.Content, TwilioMakeCall))
 	if len(params) < 3 {
 		return &Result{Error: ErrBadTwilioParam}
@@ -101,6 +102,7 @@ repeat again.
 over.`, message, message, message))},
 	}
 	resp, err := inet.DoHTTP(inet.HTTPRequest{
+		Context:    ctx,
 		TimeoutSec: cmd.TimeoutSec,
 		Method:     http.MethodPost,
 		Body:       strings.NewReader(formParams.Encode()),
@@ -116,7 +118,7 @@ over.`, message, message, message))},
 	return &Result{Error: nil, Output: strconv.Itoa(len(toNumber) + len(message))}
 }
 
-func (twi *Twilio) SendSMS(cmd Command) *Result {
+func (twi *Twilio) SendSMS(ctx context.Context, cmd Command) *Result {
 	params := RegexPhoneNumberAndMessage.FindStringSubmatch(strings.TrimSpace(strings.TrimPrefix(cmd.Content, TwilioMakeCall)))
 	if len(params) < 3 {
 		return &Result{Error: ErrBadTwilioParam}
@@ -130,6 +132,7 @@ func (twi *Twilio) SendSMS(cmd Command) *Result {
 		"Body": {message},
 	}
 	resp, err := inet.DoHTTP(inet.HTTPRequest{
+		Context:    ctx,
 		TimeoutSec: cmd.TimeoutSec,
 		Method:     http.MethodPost,
 		Body:       strings.NewReader(formParams.Encode()),
@@ -1,6 +1,7 @@
 package toolbox
 
 import (
+	"context"
 	"strconv"
 	"testing"
 )
@@ -16,25 +17,25 @@ func TestTwilio_Execute(t *testing.T) {
 		t.Fatal(err)
 	}
 	// Nothing to do
-	if ret := TestTwilio.Execute(Command{TimeoutSec: 30, Content: "!@$!@%#%#$@%"}); ret.Error != ErrBadTwilioParam {
+	if ret := TestTwilio.Execute(context.Background(), Command{TimeoutSec: 30, Content: "!@$!@%#%#$@%"}); ret.Error != ErrBadTwilioParam {
 		t.Fatal(ret)
 	}
 	// Sending an empty SMS should result in error
-	if ret := TestTwilio.Execute(Command{TimeoutSec: 30, Content: TwilioSendSMS + "+123456"}); ret.Error != ErrBadTwilioParam {
+	if ret := TestTwilio.Execute(context.Background(), Command{TimeoutSec: 30, Content: TwilioSendSMS + "+123456"}); ret.Error != ErrBadTwilioParam {
 		t.Fatal(ret)
 	}
 	// Send an SMS
 	message := "laitos twilio test pls ignore"
 	expectedOutput := strconv.Itoa(len(TestTwilio.TestPhoneNumber) + len(message))
-	if ret := TestTwilio.Execute(Command{TimeoutSec: 30, Content: TwilioSendSMS + TestTwilio.TestPhoneNumber + "," + message}); ret.Error != nil || ret.Output != expectedOutput {
+	if ret := TestTwilio.Execute(context.Background(), Command{TimeoutSec: 30, Content: TwilioSendSMS + TestTwilio.TestPhoneNumber + "," + message}); ret.Error != nil || ret.Output != expectedOutput {
 		t.Fatal(ret)
 	}
 	// Making a call without a message should result in error
-	if ret := TestTwilio.Execute(Command{TimeoutSec: 30, Content: TwilioMakeCall + "+123456"}); ret.Error != ErrBadTwilioParam {
+	if ret := TestTwilio.Execute(context.Background(), Command{TimeoutSec: 30, Content: TwilioMakeCall + "+123456"}); ret.Error != ErrBadTwilioParam {
 		t.Fatal(ret)
 	}
 	// Make a call
-	if ret := TestTwilio.Execute(Command{TimeoutSec: 30, Content: TwilioMakeCall + TestTwilio.TestPhoneNumber + "," + message}); ret.Error != nil || ret.Output != expectedOutput {
+	if ret := TestTwilio.Execute(context.Background(), Command{TimeoutSec: 30, Content: TwilioMakeCall + TestTwilio.TestPhoneNumber + "," + message}); ret.Error != nil || ret.Output != expectedOutput {
 		t.Fatal(ret)
 	}
 }
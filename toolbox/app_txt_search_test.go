@@ -1,6 +1,7 @@
 package toolbox
 
 import (
+	"context"
 	"io/ioutil"
 	"os"
 	"strings"
@@ -46,20 +47,20 @@ Where is the USB type C port`)
 		t.Fatal(err)
 	}
 	// Search for text using bad parameters
-	if ret := txt.Execute(Command{Content: ""}); ret.Error == nil {
+	if ret := txt.Execute(context.Background(), Command{Content: ""}); ret.Error == nil {
 		t.Fatal("did not error")
 	}
-	if ret := txt.Execute(Command{Content: "intro"}); ret.Error != ErrBadTextSearchParam {
+	if ret := txt.Execute(context.Background(), Command{Content: "intro"}); ret.Error != ErrBadTextSearchParam {
 		t.Fatal(ret.Error)
 	}
-	if ret := txt.Execute(Command{Content: "shortcut-does-not-exist search this"}); !strings.HasPrefix(ret.Error.Error(), "cannot find") {
+	if ret := txt.Execute(context.Background(), Command{Content: "shortcut-does-not-exist search this"}); !strings.HasPrefix(ret.Error.Error(), "cannot find") {
 		t.Fatal(ret.Error)
 	}
 	// Search for text using good parameters
-	if ret := txt.Execute(Command{Content: "intro then how the "}); ret.Error != nil || ret.Output != "1 and Then How the Hinge works\n" {
+	if ret := txt.Execute(context.Background(), Command{Content: "intro then how the "}); ret.Error != nil || ret.Output != "1 and Then How the Hinge works\n" {
 		t.Fatal(ret)
 	}
-	if ret := txt.Execute(Command{Content: "intro where"}); ret.Error != nil || ret.Output != "2 where The volume button is\nWhere is the USB type C port" {
+	if ret := txt.Execute(context.Background(), Command{Content: "intro where"}); ret.Error != nil || ret.Output != "2 where The volume button is\nWhere is the USB type C port" {
 		t.Fatal(ret)
 	}
 }
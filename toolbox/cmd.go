@@ -2,6 +2,7 @@
 package toolbox
 
 import (
+	"context"
 	"errors"
 	"strings"
 
@@ -24,10 +25,17 @@ type Command struct {
 	ClientID string
 	// DaemonName is the name of daemon that received this command, this is used for logging.
 	DaemonName string
+	// TraceID identifies the handling of the request that carried the command among log entries, it is optional.
+	TraceID string
 	// TimeoutSec is what the daemon thinks the timeout of command execution shall be.
 	TimeoutSec int
 	// Content is the app command input.
 	Content string
+	/*
+		Encrypted is true only if the command input arrived over an encrypted channel, such as SSH or HTTPS. Apps that
+		handle secrets refuse to work over plain channels such as SMS, DNS, and plain socket.
+	*/
+	Encrypted bool
 }
 
 // Modify command content to remove leading and trailing white spaces. Return error result if command becomes empty afterwards.
@@ -57,19 +65,41 @@ type Trigger string // Trigger is a prefix string that is matched against comman
 
 // Represent a useful feature that is capable of execution and provide execution result as feedback.
 type Feature interface {
-	IsConfigured() bool      // Return true only if configuration is present, this is called prior to Initialise().
-	SelfTest() error         // Validate and test configuration. It may work only after Initialise() succeeds.
-	Initialise() error       // Prepare internal states.
-	Trigger() Trigger        // Return a prefix string that is matched against command input to trigger a feature, each feature has a unique trigger.
-	Execute(Command) *Result // Execute the command with trigger prefix removed, and return execution result.
+	IsConfigured() bool // Return true only if configuration is present, this is called prior to Initialise().
+	SelfTest() error    // Validate and test configuration. It may work only after Initialise() succeeds.
+	Initialise() error  // Prepare internal states.
+	Trigger() Trigger   // Return a prefix string that is matched against command input to trigger a feature, each feature has a unique trigger.
+	// Execute the command with trigger prefix removed, and return execution result. The execution should be aborted as soon
+	// as the context is cancelled, e.g. when the client who issued the command has gone away.
+	Execute(context.Context, Command) *Result
+}
+
+/*
+Choice is a follow-up app command offered along with a command result, such as reading one of the listed mails. Daemons
+capable of presenting buttons (e.g. telegram bot) let user run the choice without typing the command.
+*/
+type Choice struct {
+	Label   string // Label is a short human readable description of the choice
+	Command string // Command is the app command to run (excluding password PIN) when the choice is made
+}
+
+/*
+Attachment is a file that comes along with a command result. Daemons capable of transferring files (e.g. telegram bot)
+send the file to the user.
+*/
+type Attachment struct {
+	Name    string // Name is the name (or path) of the file
+	Content []byte // Content is the complete file content
 }
 
 // Feature's execution result that includes human readable output and error (if any).
 type Result struct {
-	Command        Command // Help CommandProcessor to keep track of command in execution result
-	Error          error   // Result error if there is any
-	Output         string  // Human readable normal output excluding error text
-	CombinedOutput string  // Human readable error text + normal output. This is set when calling SetCombinedText() function.
+	Command        Command     // Help CommandProcessor to keep track of command in execution result
+	Error          error       // Result error if there is any
+	Output         string      // Human readable normal output excluding error text
+	CombinedOutput string      // Human readable error text + normal output. This is set when calling SetCombinedText() function.
+	Choices        []Choice    // Choices are the optional follow-up commands that user may choose from
+	Attachment     *Attachment // Attachment is the optional file that comes along with the result
 }
 
 // Return error text or empty string if error is absent.
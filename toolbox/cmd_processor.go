@@ -1,12 +1,14 @@
 package toolbox
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -14,6 +16,9 @@ import (
 	"github.com/HouzuoGuo/laitos/misc"
 )
 
+// commandStats times the execution of app commands.
+var commandStats = misc.GetStats("toolbox.Commands")
+
 const (
 	//ErrBadProcessorConfig is used as the prefix string in all errors returned by "IsSaneForInternet" function.
 	ErrBadProcessorConfig = "bad configuration: "
@@ -86,6 +91,7 @@ func (proc *CommandProcessor) initialiseOnce() {
 			}
 			proc.rateLimit.Initialise()
 		}
+		proc.redactPIN()
 	})
 }
 
@@ -96,6 +102,16 @@ func (proc *CommandProcessor) SetLogger(logger lalog.Logger) {
 	for _, b := range proc.ResultFilters {
 		b.SetLogger(logger)
 	}
+	proc.redactPIN()
+}
+
+// redactPIN keeps the password PIN out of all log messages, including those written by other components.
+func (proc *CommandProcessor) redactPIN() {
+	for _, cmdFilter := range proc.CommandFilters {
+		if pinFilter, ok := cmdFilter.(*PINAndShortcuts); ok && pinFilter.PIN != "" {
+			lalog.RegisterRedaction(pinFilter.PIN)
+		}
+	}
 }
 
 /*
@@ -178,9 +194,15 @@ Process applies filters to the command, invokes toolbox feature functions to pro
 filters to the execution result and return.
 A special content prefix called "PLT prefix" alters filter settings to temporarily override timeout and max.length
 settings, and it may optionally discard a number of characters from the beginning.
+The context is handed to the feature, which aborts the execution when the context is cancelled, e.g. when the client who
+issued the command has gone away.
 */
-func (proc *CommandProcessor) Process(cmd Command, runResultFilters bool) (ret *Result) {
+func (proc *CommandProcessor) Process(ctx context.Context, cmd Command, runResultFilters bool) (ret *Result) {
 	proc.initialiseOnce()
+	// Do not bother executing a command that nobody waits for
+	if err := ctx.Err(); err != nil {
+		return &Result{Error: err}
+	}
 	// Refuse to execute a command if global lock down has been triggered
 	if misc.EmergencyLockDown {
 		return &Result{Error: misc.ErrEmergencyLockDown}
@@ -208,6 +230,7 @@ func (proc *CommandProcessor) Process(cmd Command, runResultFilters bool) (ret *
 	var overrideLintText LintText
 	var hasOverrideLintText bool
 	var logCommandContent string
+	var logger lalog.Logger
 	// Walk the command through all filters
 	for _, cmdBridge := range proc.CommandFilters {
 		cmd, filterDisapproval = cmdBridge.Transform(cmd)
@@ -218,7 +241,7 @@ func (proc *CommandProcessor) Process(cmd Command, runResultFilters bool) (ret *
 	}
 	// If filters approve, then the command execution is to be tracked in stats.
 	defer func() {
-		misc.CommandStats.Trigger(float64(time.Now().UnixNano() - beginTimeNano))
+		commandStats.Trigger(float64(time.Now().UnixNano() - beginTimeNano))
 	}()
 	// Trim spaces and expect non-empty command
 	if ret = cmd.Trim(); ret != nil {
@@ -272,9 +295,12 @@ func (proc *CommandProcessor) Process(cmd Command, runResultFilters bool) (ret *
 	// Look for command's prefix among configured features
 	for prefix, configuredFeature := range proc.Features.LookupByTrigger {
 		if cmd.FindAndRemovePrefix(string(prefix)) {
-			// Hacky workaround - do not log content of AES decryption commands as they can reveal encryption key
-			if prefix == AESDecryptTrigger || prefix == TwoFATrigger {
-				logCommandContent = "<hidden due to AESDecryptTrigger or TwoFATrigger>"
+			// Hacky workaround - do not log content of AES decryption and remote unlock commands as they can reveal encryption key
+			if prefix == AESDecryptTrigger || prefix == TwoFATrigger || prefix == RemoteUnlockTrigger {
+				logCommandContent = "<hidden due to AESDecryptTrigger, TwoFATrigger, or RemoteUnlockTrigger>"
+			}
+			if prefix == EnvControlTrigger && strings.Contains(strings.ToLower(cmd.Content), "rekey") {
+				logCommandContent = "<hidden due to EnvControlTrigger rekey>"
 			}
 			matchedFeature = configuredFeature
 			break
@@ -286,11 +312,12 @@ func (proc *CommandProcessor) Process(cmd Command, runResultFilters bool) (ret *
 		goto result
 	}
 	// Run the feature
-	proc.logger.Info("Process", fmt.Sprintf("%s-%s", cmd.DaemonName, cmd.ClientID), nil, "running \"%s\" (post-process result? %v)", logCommandContent, runResultFilters)
+	logger = proc.logger.WithTraceID(cmd.TraceID)
+	logger.Info("Process", fmt.Sprintf("%s-%s", cmd.DaemonName, cmd.ClientID), nil, "running \"%s\" (post-process result? %v)", logCommandContent, runResultFilters)
 	defer func() {
-		proc.logger.Info("Process", fmt.Sprintf("%s-%s", cmd.DaemonName, cmd.ClientID), nil, "completed \"%s\" (ok? %v post-process reslt? %v)", logCommandContent, ret.Error == nil, runResultFilters)
+		logger.Info("Process", fmt.Sprintf("%s-%s", cmd.DaemonName, cmd.ClientID), nil, "completed \"%s\" (ok? %v post-process reslt? %v)", logCommandContent, ret.Error == nil, runResultFilters)
 	}()
-	ret = matchedFeature.Execute(cmd)
+	ret = matchedFeature.Execute(ctx, cmd)
 result:
 	// Command in the result structure is mainly used for logging purpose
 	ret.Command = cmd
@@ -1,6 +1,7 @@
 package toolbox
 
 import (
+	"context"
 	"reflect"
 	"strings"
 	"testing"
@@ -34,7 +35,7 @@ func TestCommandProcessor_NonWindows(t *testing.T) {
 
 	// Try mismatching PIN so that command bridge return early
 	cmd := Command{TimeoutSec: 5, Content: "badpin.secho alpha"}
-	result := proc.Process(cmd, true)
+	result := proc.Process(context.Background(), cmd, true)
 	if !reflect.DeepEqual(result.Command, Command{TimeoutSec: 5, Content: ""}) ||
 		result.Error != ErrPINAndShortcutNotFound || result.Output != "" ||
 		result.CombinedOutput != ErrPINAndShortcutNotFound.Error()[0:2] {
@@ -43,7 +44,7 @@ func TestCommandProcessor_NonWindows(t *testing.T) {
 
 	// Run a failing command - be aware of the word substitution conducted by command filter
 	cmd = Command{TimeoutSec: 5, Content: "mypin.secho alpha; does-not-exist"}
-	result = proc.Process(cmd, true)
+	result = proc.Process(context.Background(), cmd, true)
 	if !reflect.DeepEqual(result.Command, Command{TimeoutSec: 5, Content: ".secho beta; does-not-exist"}) ||
 		result.Error == nil || !strings.Contains(result.Output, "beta") || result.CombinedOutput != result.Error.Error()[0:2] {
 		t.Fatalf("%+v", result)
@@ -51,7 +52,7 @@ func TestCommandProcessor_NonWindows(t *testing.T) {
 
 	// Run a command that does not trigger a configured feature
 	cmd = Command{TimeoutSec: 5, Content: "mypin.tz"}
-	result = proc.Process(cmd, true)
+	result = proc.Process(context.Background(), cmd, true)
 	if !reflect.DeepEqual(result.Command, Command{TimeoutSec: 5, Content: ".tz"}) ||
 		result.Error != ErrBadPrefix || result.Output != "" || result.CombinedOutput != ErrBadPrefix.Error()[0:2] {
 		t.Fatalf("%+v", result)
@@ -59,14 +60,14 @@ func TestCommandProcessor_NonWindows(t *testing.T) {
 
 	// Run a successful command - be aware of the word substitution conducted by command filter
 	cmd = Command{TimeoutSec: 5, Content: "mypin.secho alpha"}
-	result = proc.Process(cmd, true)
+	result = proc.Process(context.Background(), cmd, true)
 	if !reflect.DeepEqual(result.Command, Command{TimeoutSec: 5, Content: ".secho beta"}) ||
 		result.Error != nil || !strings.Contains(result.Output, "beta") || result.CombinedOutput != "be" {
 		t.Fatalf("%+v", result)
 	}
 	// Test the tolerance to extra spaces in feature prefix matcher
 	cmd = Command{TimeoutSec: 5, Content: " mypin .s echo alpha "}
-	result = proc.Process(cmd, true)
+	result = proc.Process(context.Background(), cmd, true)
 	if !reflect.DeepEqual(result.Command, Command{TimeoutSec: 5, Content: ".s echo beta"}) ||
 		result.Error != nil || !strings.Contains(result.Output, "beta") || result.CombinedOutput != "be" {
 		t.Fatalf("%+v", result)
@@ -74,14 +75,14 @@ func TestCommandProcessor_NonWindows(t *testing.T) {
 
 	// Override PLT but PLT parameter values are not given
 	cmd = Command{TimeoutSec: 5, Content: "mypin  .plt   sadf asdf "}
-	result = proc.Process(cmd, true)
+	result = proc.Process(context.Background(), cmd, true)
 	if !reflect.DeepEqual(result.Command, Command{TimeoutSec: 5, Content: ""}) ||
 		result.Error != ErrBadPLT || result.Output != "" || result.CombinedOutput != ErrBadPLT.Error()[0:2] {
 		t.Fatalf("%v | %v | %v |%+v", result.Error, result.Output, result.CombinedOutput, result.Command)
 	}
 	// Override PLT using good PLT parameter values
 	cmd = Command{TimeoutSec: 1, Content: "mypin  .plt  2, 5. 4  .s  sleep 2 ; echo 0123456789 "}
-	result = proc.Process(cmd, true)
+	result = proc.Process(context.Background(), cmd, true)
 	if !reflect.DeepEqual(result.Command, Command{TimeoutSec: 4, Content: "  .s  sleep 2 ; echo 0123456789"}) ||
 		result.Error != nil || !strings.Contains(result.Output, "0123456789") || result.CombinedOutput != "23456" {
 		t.Fatalf("%v | %v | %v | %+v", result.Error, result.Output, result.CombinedOutput, result.Command)
@@ -90,7 +91,7 @@ func TestCommandProcessor_NonWindows(t *testing.T) {
 	// Trigger emergency lock down and try
 	misc.TriggerEmergencyLockDown()
 	cmd = Command{TimeoutSec: 1, Content: "mypin  .plt  2, 5. 3  .s  sleep 2 ;  echo 0123456789 "}
-	if result := proc.Process(cmd, true); result.Error != misc.ErrEmergencyLockDown {
+	if result := proc.Process(context.Background(), cmd, true); result.Error != misc.ErrEmergencyLockDown {
 		t.Fatal(result)
 	}
 	misc.EmergencyLockDown = false
@@ -99,7 +100,7 @@ func TestCommandProcessor_NonWindows(t *testing.T) {
 func TestCommandProcessor_LengthLimit(t *testing.T) {
 	proc := GetTestCommandProcessor()
 
-	result := proc.Process(Command{Content: TestCommandProcessorPIN + ".s " + strings.Repeat("a", MaxCmdLength)}, true)
+	result := proc.Process(context.Background(), Command{Content: TestCommandProcessorPIN + ".s " + strings.Repeat("a", MaxCmdLength)}, true)
 	if result.Error != ErrCommandTooLong {
 		t.Fatalf("%+v", result)
 	}
@@ -113,7 +114,7 @@ func TestCommandProcessor_RateLimit(t *testing.T) {
 	succeeded := 0
 	failed := 0
 	for i := 0; i < 30; i++ {
-		if result := proc.Process(Command{Content: "verysecret .elog", TimeoutSec: 10}, true); result.Error == nil {
+		if result := proc.Process(context.Background(), Command{Content: "verysecret .elog", TimeoutSec: 10}, true); result.Error == nil {
 			succeeded++
 		} else if result.Error == ErrRateLimitExceeded {
 			failed++
@@ -125,13 +126,13 @@ func TestCommandProcessor_RateLimit(t *testing.T) {
 
 	// Wait for rate limit to expire and retry
 	time.Sleep(2 * time.Second)
-	if result := proc.Process(Command{Content: "verysecret .elog", TimeoutSec: 10}, true); result.Error != nil {
+	if result := proc.Process(context.Background(), Command{Content: "verysecret .elog", TimeoutSec: 10}, true); result.Error != nil {
 		t.Fatal(result.Error)
 	}
 
 	// Use the default hard upper limit with a new command processor
 	proc = GetTestCommandProcessor()
-	if result := proc.Process(Command{Content: "verysecret .elog", TimeoutSec: 10}, true); result.Error != nil {
+	if result := proc.Process(context.Background(), Command{Content: "verysecret .elog", TimeoutSec: 10}, true); result.Error != nil {
 		t.Fatal(result.Error)
 	}
 	if proc.MaxCmdPerSec != MaxCmdPerSecHardLimit {
@@ -139,6 +140,29 @@ func TestCommandProcessor_RateLimit(t *testing.T) {
 	}
 }
 
+func TestCommandProcessor_ContextCancellation(t *testing.T) {
+	if misc.HostIsWindows() {
+		t.Skip("this test is skipped on Windows")
+	}
+	proc := GetTestCommandProcessor()
+	// Do not run a command if nobody waits for it
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if result := proc.Process(ctx, Command{Content: TestCommandProcessorPIN + ".s echo hi", TimeoutSec: 10}, true); result.Error != context.Canceled {
+		t.Fatalf("%+v", result)
+	}
+	// Abort an ongoing command when the context is cancelled
+	ctx, cancel = context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+	start := time.Now()
+	if result := proc.Process(ctx, Command{Content: TestCommandProcessorPIN + ".s sleep 8; echo hi", TimeoutSec: 10}, true); result.Error == nil || strings.Contains(result.Output, "hi") {
+		t.Fatalf("%+v", result)
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Fatal(elapsed)
+	}
+}
+
 func TestCommandProcessorIsSaneForInternet(t *testing.T) {
 	proc := CommandProcessor{
 		Features:       nil,
@@ -221,7 +245,7 @@ func TestGetTestCommandProcessor(t *testing.T) {
 		t.Fatal(testErr)
 	} else if saneErrs := proc.IsSaneForInternet(); len(saneErrs) > 0 {
 		t.Fatal(saneErrs)
-	} else if result := proc.Process(Command{Content: "verysecret .elog", TimeoutSec: 10}, true); result.Error != nil {
+	} else if result := proc.Process(context.Background(), Command{Content: "verysecret .elog", TimeoutSec: 10}, true); result.Error != nil {
 		t.Fatal(result.Error)
 	}
 }
@@ -235,9 +259,9 @@ func TestConcealedLogMessages(t *testing.T) {
 	if err := proc.Features.Initialise(); err != nil {
 		t.Fatal(err)
 	}
-	proc.Process(Command{Content: "verysecret .a does not matter", TimeoutSec: 10}, true)
-	proc.Process(Command{Content: "verysecret .2 does not matter", TimeoutSec: 10}, true)
-	t.Log("Please observe <hidden due to AESDecryptTrigger or TwoFATrigger> from log output, otherwise consider this test is failed")
+	proc.Process(context.Background(), Command{Content: "verysecret .a does not matter", TimeoutSec: 10}, true)
+	proc.Process(context.Background(), Command{Content: "verysecret .2 does not matter", TimeoutSec: 10}, true)
+	t.Log("Please observe <hidden due to AESDecryptTrigger, TwoFATrigger, or RemoteUnlockTrigger> from log output, otherwise consider this test is failed")
 }
 
 func TestGetEmptyCommandProcessor(t *testing.T) {
@@ -246,7 +270,7 @@ func TestGetEmptyCommandProcessor(t *testing.T) {
 		t.Fatal(testErr)
 	} else if saneErrs := proc.IsSaneForInternet(); len(saneErrs) > 0 {
 		t.Fatal(saneErrs)
-	} else if result := proc.Process(Command{Content: "verysecret .elog", TimeoutSec: 10}, true); result.Error == nil {
+	} else if result := proc.Process(context.Background(), Command{Content: "verysecret .elog", TimeoutSec: 10}, true); result.Error == nil {
 		t.Fatal("did not error")
 	}
 }
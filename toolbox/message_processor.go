@@ -1,6 +1,7 @@
 package toolbox
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -27,6 +28,8 @@ const (
 	CommandResponseRetentionSec = ReportIntervalSec * 10
 	// SubjectExpirySecond is the number of seconds after which if a subject is not heard from again it will be removed.
 	SubjectExpirySecond = 72 * 3600
+	// MaxOutgoingCommandResultsPerHostName is the maximum number of outgoing app command results to be kept in memory per subject.
+	MaxOutgoingCommandResultsPerHostName = 20
 	/*
 		StoreAndForwardMessageProcessorTrigger is the toolbox app command invocation prefix for the store&forward message processor.
 		"mp" would have been more suitable, however "m" letter is already taken by send-mail app.
@@ -70,9 +73,16 @@ type MessageProcessor struct {
 	IncomingAppCommands map[string]*IncomingAppCommand `json:"-"`
 	/*
 		OutgoingAppCommands is a map of subject's self reported host name and an app command that this message processor would like the subject to run.
-		This command is delivered to the subject when it sends the next report.
+		This command is delivered to the subject in reply to each of its reports, until the subject returns the command result in a report.
 	*/
 	OutgoingAppCommands map[string]string `json:"-"`
+	/*
+		QueuedAppCommands is a map of subject's self reported host name and the app commands queued behind its outgoing app command.
+		The first queued command becomes the outgoing command as soon as the subject returns the result of the outgoing command.
+	*/
+	QueuedAppCommands map[string][]string `json:"-"`
+	// OutgoingCommandResults is a map of subject's self reported host name and the results of outgoing app commands, sorted from earliest to latest.
+	OutgoingCommandResults map[string][]AppCommandResponse `json:"-"`
 	// CmdProcessor processes app commands as requested by a remote server.
 	CmdProcessor *CommandProcessor `json:"-"`
 
@@ -81,9 +91,20 @@ type MessageProcessor struct {
 		self reported host name.
 	*/
 	MaxReportsPerHostName int `json:"MaxReportsPerHostName"`
+	/*
+		SubjectSharedKeys is a map of key ID and the pre-shared key that seals the reports of a subject.
+		If either SubjectSharedKeys or SubjectPublicKeys is configured, the message processor rejects reports that are not sealed.
+	*/
+	SubjectSharedKeys map[string]string `json:"SubjectSharedKeys"`
+	// SubjectPublicKeys is a map of key ID and the base64-encoded X25519 public key of a subject, used along with PrivateKey.
+	SubjectPublicKeys map[string]string `json:"SubjectPublicKeys"`
+	// PrivateKey is the base64-encoded X25519 private key of this message processor, its public key is given to subjects.
+	PrivateKey string `json:"PrivateKey"`
 	// OwnerName is the name of the component that carries this message processor. This is used for logging purpose.
 	OwnerName string `json:"-"`
 
+	// subjectKeys is a map of key ID and the key that seals the reports of a subject.
+	subjectKeys map[string]*ReportKey
 	// totalReports is the total number of reports received thus far.
 	totalReports int
 	// mutex prevents concurrent modifications made to internal structures.
@@ -91,17 +112,88 @@ type MessageProcessor struct {
 	logger lalog.Logger
 }
 
-// SetOutgoingCommand stores an app command that the message processor carries in a reply to a subject report.
+/*
+SetOutgoingCommand stores an app command that the message processor carries in a reply to a subject report, replacing
+the outgoing command of the subject. An empty command clears both the outgoing command and the queued commands.
+*/
 func (proc *MessageProcessor) SetOutgoingCommand(hostName, cmdContent string) {
 	hostName = strings.ToLower(hostName)
 	proc.mutex.Lock()
 	defer proc.mutex.Unlock()
 	if cmdContent == "" {
 		delete(proc.OutgoingAppCommands, hostName)
+		delete(proc.QueuedAppCommands, hostName)
+		return
 	}
 	proc.OutgoingAppCommands[hostName] = cmdContent
 }
 
+/*
+QueueOutgoingCommand adds an app command to the queue of commands for a subject to run. The subject picks up the
+commands one after another, each in a reply to its report, and returns the command results in its subsequent reports.
+The function returns the number of commands in the queue, including the outgoing command.
+*/
+func (proc *MessageProcessor) QueueOutgoingCommand(hostName, cmdContent string) int {
+	hostName = strings.ToLower(hostName)
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	if proc.OutgoingAppCommands[hostName] == "" {
+		proc.OutgoingAppCommands[hostName] = cmdContent
+	} else {
+		proc.QueuedAppCommands[hostName] = append(proc.QueuedAppCommands[hostName], cmdContent)
+	}
+	return 1 + len(proc.QueuedAppCommands[hostName])
+}
+
+// GetOutgoingCommandQueue returns the outgoing app command of a subject followed by the commands queued behind it.
+func (proc *MessageProcessor) GetOutgoingCommandQueue(hostName string) []string {
+	hostName = strings.ToLower(hostName)
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	ret := make([]string, 0)
+	if cmd := proc.OutgoingAppCommands[hostName]; cmd != "" {
+		ret = append(ret, cmd)
+	}
+	return append(ret, proc.QueuedAppCommands[hostName]...)
+}
+
+// GetOutgoingCommandResults returns the results of outgoing app commands returned by a subject, sorted from earliest to latest.
+func (proc *MessageProcessor) GetOutgoingCommandResults(hostName string) []AppCommandResponse {
+	hostName = strings.ToLower(hostName)
+	proc.mutex.Lock()
+	defer proc.mutex.Unlock()
+	return append([]AppCommandResponse{}, proc.OutgoingCommandResults[hostName]...)
+}
+
+/*
+collectOutgoingCommandResult memorises the result of the outgoing command carried by a subject report, and then moves
+the next queued command into its place. The internal function assumes that its caller is holding the mutex.
+Keep in mind that a subject runs an app command only once if it is requested several times in a row, in which case
+the subject returns the same result for each of them.
+*/
+func (proc *MessageProcessor) collectOutgoingCommandResult(request SubjectReportRequest) {
+	hostName := request.SubjectHostName
+	outgoingCmd := proc.OutgoingAppCommands[hostName]
+	if outgoingCmd == "" || request.CommandResponse.Command != outgoingCmd {
+		return
+	}
+	results := append(proc.OutgoingCommandResults[hostName], request.CommandResponse)
+	if len(results) > MaxOutgoingCommandResultsPerHostName {
+		results = results[len(results)-MaxOutgoingCommandResultsPerHostName:]
+	}
+	proc.OutgoingCommandResults[hostName] = results
+	if queue := proc.QueuedAppCommands[hostName]; len(queue) > 0 {
+		proc.OutgoingAppCommands[hostName] = queue[0]
+		if len(queue) == 1 {
+			delete(proc.QueuedAppCommands, hostName)
+		} else {
+			proc.QueuedAppCommands[hostName] = queue[1:]
+		}
+	} else {
+		delete(proc.OutgoingAppCommands, hostName)
+	}
+}
+
 // GetAllOutgoingCommands returns a copy of all app commands that are about to be delivered to reporting subjects.
 func (proc *MessageProcessor) GetAllOutgoingCommands() map[string]string {
 	proc.mutex.Lock()
@@ -150,6 +242,8 @@ func (proc *MessageProcessor) StoreReport(request SubjectReportRequest, clientID
 	if proc.totalReports%proc.MaxReportsPerHostName == 0 {
 		proc.removeExpiredSubjects()
 	}
+	// The report may carry the result of outgoing command, in which case the reply will carry the next queued command.
+	proc.collectOutgoingCommandResult(request)
 	outgoingCommandForSubject := proc.OutgoingAppCommands[request.SubjectHostName]
 	// Release the lock for report handling is now completed. The app command (if requested) will run without holding the lock.
 	proc.mutex.Unlock()
@@ -229,9 +323,9 @@ func (proc *MessageProcessor) processCommandRequest(request SubjectReportRequest
 			Result:         Result{Command: cmd},
 		}
 		proc.mutex.Unlock()
-		// Run the app command and then memorise the result
+		// Run the app command and then memorise the result, the subject collects the result later on in another report.
 		startTimeSec := time.Now().Unix()
-		result := proc.CmdProcessor.Process(cmd, true)
+		result := proc.CmdProcessor.Process(context.Background(), cmd, true)
 		durationSec := time.Now().Unix() - startTimeSec
 		proc.mutex.Lock()
 		proc.IncomingAppCommands[request.SubjectHostName] = &IncomingAppCommand{
@@ -352,6 +446,8 @@ func (proc *MessageProcessor) removeExpiredSubjects() {
 		delete(proc.SubjectReports, subject)
 		delete(proc.IncomingAppCommands, subject)
 		delete(proc.OutgoingAppCommands, subject)
+		delete(proc.QueuedAppCommands, subject)
+		delete(proc.OutgoingCommandResults, subject)
 	}
 }
 
@@ -374,7 +470,30 @@ func (proc *MessageProcessor) Initialise() error {
 	proc.SubjectReports = make(map[string]*[]SubjectReport)
 	proc.IncomingAppCommands = make(map[string]*IncomingAppCommand)
 	proc.OutgoingAppCommands = make(map[string]string)
+	proc.QueuedAppCommands = make(map[string][]string)
+	proc.OutgoingCommandResults = make(map[string][]AppCommandResponse)
 	proc.mutex = new(sync.Mutex)
+	proc.subjectKeys = make(map[string]*ReportKey)
+	for id, sharedKey := range proc.SubjectSharedKeys {
+		key, err := NewSharedReportKey(id, sharedKey)
+		if err != nil {
+			return fmt.Errorf("MessageProcessor.Initialise: %w", err)
+		}
+		proc.subjectKeys[key.ID] = key
+	}
+	if len(proc.SubjectPublicKeys) > 0 && proc.PrivateKey == "" {
+		return errors.New("MessageProcessor.Initialise: PrivateKey must be present to use SubjectPublicKeys")
+	}
+	for id, publicKey := range proc.SubjectPublicKeys {
+		key, err := NewPublicReportKey(id, proc.PrivateKey, publicKey)
+		if err != nil {
+			return fmt.Errorf("MessageProcessor.Initialise: %w", err)
+		}
+		if _, exists := proc.subjectKeys[key.ID]; exists {
+			return fmt.Errorf("MessageProcessor.Initialise: key ID \"%s\" is defined more than once", key.ID)
+		}
+		proc.subjectKeys[key.ID] = key
+	}
 	if proc.CmdProcessor != nil {
 		if errs := proc.CmdProcessor.IsSaneForInternet(); len(errs) > 0 {
 			return fmt.Errorf("MessageProcessor.Initialise: %+v", errs)
@@ -391,13 +510,35 @@ func (proc *MessageProcessor) Trigger() Trigger {
 	return StoreAndForwardMessageProcessorTrigger
 }
 
-func (proc *MessageProcessor) Execute(cmd Command) *Result {
+func (proc *MessageProcessor) Execute(ctx context.Context, cmd Command) *Result {
 	if errResult := cmd.Trim(); errResult != nil {
 		return errResult
 	}
-	// Subject report arrives as a compacted string
+	// Subject report arrives as a compacted string, which may have been sealed by the subject's key.
+	content := cmd.Content
+	var key *ReportKey
+	var reportNonce []byte
+	if keyID, encrypted, isSealed := ParseSealedReport(cmd.Content); isSealed {
+		if key = proc.subjectKeys[keyID]; key == nil {
+			proc.logger.Warning("Execute", cmd.ClientID, nil, "rejected a sealed report of unknown key ID \"%s\"", keyID)
+			return &Result{Error: fmt.Errorf("unknown key ID \"%s\"", keyID)}
+		}
+		var err error
+		if content, reportNonce, err = key.OpenReport(encrypted); err != nil {
+			proc.logger.Warning("Execute", cmd.ClientID, err, "rejected a sealed report of key ID \"%s\"", keyID)
+			return &Result{Error: err}
+		}
+	} else if len(proc.subjectKeys) > 0 {
+		proc.logger.Warning("Execute", cmd.ClientID, nil, "rejected an unauthenticated report")
+		return &Result{Error: ErrUnauthenticatedReport}
+	}
 	var incomingReport SubjectReportRequest
-	if err := incomingReport.DeserialiseFromCompact(cmd.Content); err == ErrSubjectReportTruncated {
+	err := incomingReport.DeserialiseFromCompact(content)
+	if key != nil {
+		// The authenticated key ID takes precedence over the self-reported host name
+		incomingReport.SubjectHostName = key.ID
+	}
+	if err == ErrSubjectReportTruncated {
 		proc.logger.Info("Execute", cmd.ClientID, nil, "the subject report request was truncated")
 		// It is OK to continue with a truncated report
 	} else if err != nil {
@@ -417,5 +558,12 @@ func (proc *MessageProcessor) Execute(cmd Command) *Result {
 	if err != nil {
 		return &Result{Error: fmt.Errorf("failed to encode JSON response: %w", err)}
 	}
+	if key != nil {
+		sealedResp, err := key.SealResponse(respBytes, reportNonce)
+		if err != nil {
+			return &Result{Error: fmt.Errorf("failed to seal response: %w", err)}
+		}
+		return &Result{Output: sealedResp}
+	}
 	return &Result{Output: string(respBytes)}
 }
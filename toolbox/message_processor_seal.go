@@ -0,0 +1,233 @@
+package toolbox
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	/*
+		SealedReportMarker is the character that begins and ends the key ID of a sealed subject report, as well as the
+		character that begins a sealed report response. The marker is followed by the encrypted report in lower case
+		Latin letters, which suit DNS queries.
+	*/
+	SealedReportMarker = '~'
+	// SealedReportTimeWindowSec is the maximum difference between the time a sealed report was made and the time it is opened.
+	SealedReportTimeWindowSec = 5 * 60
+	// ReportSharedKeyMinLength is the minimum length of a pre-shared key that seals subject reports.
+	ReportSharedKeyMinLength = 16
+	// sealedReportOverhead is the length of random nonce, timestamp, and authentication tag that come with each sealed report.
+	sealedReportOverhead = 12 + 4 + 16
+)
+
+var (
+	// RegexReportKeyID matches a valid key ID that identifies a subject to the message processor.
+	RegexReportKeyID = regexp.MustCompile(`^[a-z0-9-]{1,32}$`)
+	// ErrUnauthenticatedReport is returned when a message processor that requires sealed reports receives a plain report.
+	ErrUnauthenticatedReport = errors.New("the message processor only accepts sealed subject reports")
+	// ErrBadSealedReport is returned when a sealed report or response cannot be decrypted and authenticated.
+	ErrBadSealedReport = errors.New("failed to decrypt and authenticate the sealed report")
+)
+
+/*
+ReportKey encrypts and authenticates the subject reports exchanged between a subject and a message processor, as well
+as the responses that come back from the message processor. The key is either derived from a pre-shared key, or
+agreed upon by X25519 key exchange between the private key of one party and the public key of the other.
+*/
+type ReportKey struct {
+	ID   string // ID identifies the subject that owns the key, it is also the host name under which its reports are stored.
+	aead cipher.AEAD
+}
+
+// newReportKey returns a report key that uses AES-256-GCM with the SHA256 digest of the secret.
+func newReportKey(id string, secret []byte) (*ReportKey, error) {
+	id = strings.ToLower(strings.TrimSpace(id))
+	if !RegexReportKeyID.MatchString(id) {
+		return nil, fmt.Errorf("key ID \"%s\" must comprise 1 to 32 lower case letters, numbers, or hyphens", id)
+	}
+	digest := sha256.Sum256(secret)
+	block, err := aes.NewCipher(digest[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &ReportKey{ID: id, aead: aead}, nil
+}
+
+// NewSharedReportKey returns a report key derived from a pre-shared key.
+func NewSharedReportKey(id, sharedKey string) (*ReportKey, error) {
+	if len(sharedKey) < ReportSharedKeyMinLength {
+		return nil, fmt.Errorf("the shared key of \"%s\" must be at least %d characters long", id, ReportSharedKeyMinLength)
+	}
+	return newReportKey(id, []byte(sharedKey))
+}
+
+/*
+NewPublicReportKey returns a report key agreed upon by X25519 key exchange between the base64-encoded private key of
+this party and the base64-encoded public key of the other party.
+*/
+func NewPublicReportKey(id, privateKey, peerPublicKey string) (*ReportKey, error) {
+	priv, err := base64.StdEncoding.DecodeString(strings.TrimSpace(privateKey))
+	if err != nil || len(priv) != curve25519.ScalarSize {
+		return nil, errors.New("the private key must be a base64-encoded X25519 private key")
+	}
+	pub, err := base64.StdEncoding.DecodeString(strings.TrimSpace(peerPublicKey))
+	if err != nil || len(pub) != curve25519.PointSize {
+		return nil, fmt.Errorf("the public key of \"%s\" must be a base64-encoded X25519 public key", id)
+	}
+	shared, err := curve25519.X25519(priv, pub)
+	if err != nil {
+		return nil, fmt.Errorf("failed to agree upon a key with \"%s\" - %v", id, err)
+	}
+	return newReportKey(id, shared)
+}
+
+// GenerateReportKeyPair returns a new pair of base64-encoded X25519 keys for sealing subject reports.
+func GenerateReportKeyPair() (publicKey, privateKey string, err error) {
+	priv := make([]byte, curve25519.ScalarSize)
+	if _, err = rand.Read(priv); err != nil {
+		return
+	}
+	pub, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil {
+		return
+	}
+	return base64.StdEncoding.EncodeToString(pub), base64.StdEncoding.EncodeToString(priv), nil
+}
+
+// SealedReportPrefix returns the prefix of sealed reports, which identifies the key to the message processor.
+func (key *ReportKey) SealedReportPrefix() string {
+	return string(SealedReportMarker) + key.ID + string(SealedReportMarker)
+}
+
+/*
+SealReport encrypts and authenticates the compacted subject report along with the current time. The sealed report
+begins with the prefix. If maxLen is greater than 0, the report is truncated so that the encrypted portion following
+the prefix does not exceed maxLen characters. The random nonce is returned for opening the response.
+*/
+func (key *ReportKey) SealReport(report string, maxLen int) (sealed string, nonce []byte, err error) {
+	if maxLen > 0 {
+		maxReportLen := maxLen/2 - sealedReportOverhead
+		if maxReportLen < 1 {
+			return "", nil, fmt.Errorf("there is no room for the report in %d characters", maxLen)
+		}
+		if len(report) > maxReportLen {
+			report = report[:maxReportLen]
+		}
+	}
+	nonce = make([]byte, key.aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	plain := make([]byte, 4, 4+len(report))
+	binary.BigEndian.PutUint32(plain, uint32(time.Now().Unix()))
+	plain = append(plain, report...)
+	cipherText := key.aead.Seal(nonce, nonce, plain, []byte(key.ID))
+	return key.SealedReportPrefix() + encodeToLetters(cipherText), nonce, nil
+}
+
+/*
+ParseSealedReport returns the key ID and encrypted portion of a sealed report. If the content is not a sealed report,
+the function returns false.
+*/
+func ParseSealedReport(content string) (keyID, encrypted string, isSealed bool) {
+	if len(content) < 2 || content[0] != SealedReportMarker {
+		return "", "", false
+	}
+	end := strings.IndexRune(content[1:], SealedReportMarker)
+	if end < 0 {
+		return "", "", false
+	}
+	return strings.ToLower(content[1 : end+1]), content[end+2:], true
+}
+
+/*
+OpenReport decrypts and authenticates the encrypted portion of a sealed report, and verifies that the report was made
+recently. It returns the compacted subject report and the nonce for sealing the response.
+*/
+func (key *ReportKey) OpenReport(encrypted string) (report string, nonce []byte, err error) {
+	cipherText, err := decodeFromLetters(strings.ToLower(encrypted))
+	if err != nil || len(cipherText) < sealedReportOverhead {
+		return "", nil, ErrBadSealedReport
+	}
+	nonce = cipherText[:key.aead.NonceSize()]
+	plain, err := key.aead.Open(nil, nonce, cipherText[key.aead.NonceSize():], []byte(key.ID))
+	if err != nil {
+		return "", nil, ErrBadSealedReport
+	}
+	if timeDiff := time.Now().Unix() - int64(binary.BigEndian.Uint32(plain)); timeDiff > SealedReportTimeWindowSec || timeDiff < -SealedReportTimeWindowSec {
+		return "", nil, fmt.Errorf("the sealed report was made %d seconds away from the current time", timeDiff)
+	}
+	return string(plain[4:]), nonce, nil
+}
+
+/*
+SealResponse encrypts and authenticates the message processor's response to a sealed report. The response is bound to
+the nonce of the report, so that it cannot be replayed in response to another report.
+*/
+func (key *ReportKey) SealResponse(response []byte, reportNonce []byte) (string, error) {
+	nonce := make([]byte, key.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	cipherText := key.aead.Seal(nonce, nonce, response, append([]byte(key.ID), reportNonce...))
+	return string(SealedReportMarker) + base64.StdEncoding.EncodeToString(cipherText), nil
+}
+
+// OpenResponse decrypts and authenticates the message processor's response to the sealed report of the nonce.
+func (key *ReportKey) OpenResponse(sealed string, reportNonce []byte) ([]byte, error) {
+	if len(sealed) < 1 || sealed[0] != SealedReportMarker {
+		return nil, ErrUnauthenticatedReport
+	}
+	cipherText, err := base64.StdEncoding.DecodeString(sealed[1:])
+	if err != nil || len(cipherText) < key.aead.NonceSize() {
+		return nil, ErrBadSealedReport
+	}
+	nonceSize := key.aead.NonceSize()
+	response, err := key.aead.Open(nil, cipherText[:nonceSize], cipherText[nonceSize:], append([]byte(key.ID), reportNonce...))
+	if err != nil {
+		return nil, ErrBadSealedReport
+	}
+	return response, nil
+}
+
+// encodeToLetters encodes each half of a byte into a Latin letter between "a" and "p".
+func encodeToLetters(in []byte) string {
+	var out bytes.Buffer
+	for _, b := range in {
+		out.WriteByte('a' + b>>4)
+		out.WriteByte('a' + b&0xf)
+	}
+	return out.String()
+}
+
+// decodeFromLetters decodes the output of encodeToLetters.
+func decodeFromLetters(in string) ([]byte, error) {
+	if len(in)%2 != 0 {
+		return nil, errors.New("the input length must be an even number")
+	}
+	out := make([]byte, len(in)/2)
+	for i := 0; i < len(in); i += 2 {
+		hi, lo := in[i]-'a', in[i+1]-'a'
+		if hi > 0xf || lo > 0xf {
+			return nil, errors.New("the input must only contain letters between a and p")
+		}
+		out[i/2] = hi<<4 | lo
+	}
+	return out, nil
+}
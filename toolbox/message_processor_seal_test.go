@@ -0,0 +1,151 @@
+package toolbox
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestReportKey(t *testing.T) {
+	if _, err := NewSharedReportKey("subject", "short"); err == nil {
+		t.Fatal("should have failed")
+	}
+	if _, err := NewSharedReportKey("bad id", "0123456789abcdef"); err == nil {
+		t.Fatal("should have failed")
+	}
+	subjectPub, subjectPriv, err := GenerateReportKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPub, serverPriv, err := GenerateReportKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	subjectSharedKey, err := NewSharedReportKey("Subject", "0123456789abcdef")
+	if err != nil || subjectSharedKey.ID != "subject" {
+		t.Fatal(err, subjectSharedKey)
+	}
+	serverSharedKey, _ := NewSharedReportKey("subject", "0123456789abcdef")
+	subjectPublicKey, err := NewPublicReportKey("subject", subjectPriv, serverPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverPublicKey, err := NewPublicReportKey("subject", serverPriv, subjectPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, keys := range [][2]*ReportKey{{subjectSharedKey, serverSharedKey}, {subjectPublicKey, serverPublicKey}} {
+		subjectKey, serverKey := keys[0], keys[1]
+		sealed, nonce, err := subjectKey.SealReport("hello world", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyID, encrypted, isSealed := ParseSealedReport(sealed)
+		if !isSealed || keyID != "subject" || strings.Trim(encrypted, "abcdefghijklmnop") != "" {
+			t.Fatal(sealed)
+		}
+		report, serverNonce, err := serverKey.OpenReport(encrypted)
+		if err != nil || report != "hello world" || string(serverNonce) != string(nonce) {
+			t.Fatal(err, report)
+		}
+		// Tampered report must fail authentication
+		tampered := []byte(encrypted)
+		tampered[len(tampered)-1] = 'a' + (tampered[len(tampered)-1]-'a'+1)%16
+		if _, _, err := serverKey.OpenReport(string(tampered)); err != ErrBadSealedReport {
+			t.Fatal(err)
+		}
+		// The response must be opened with the nonce of its report
+		sealedResp, err := serverKey.SealResponse([]byte("response"), serverNonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp, err := subjectKey.OpenResponse(sealedResp, nonce); err != nil || string(resp) != "response" {
+			t.Fatal(err, string(resp))
+		}
+		if _, err := subjectKey.OpenResponse(sealedResp, []byte("another nonce")); err != ErrBadSealedReport {
+			t.Fatal(err)
+		}
+		if _, err := subjectKey.OpenResponse("response", nonce); err != ErrUnauthenticatedReport {
+			t.Fatal(err)
+		}
+	}
+	// A different key must not open the report
+	sealed, _, _ := subjectSharedKey.SealReport("hello world", 0)
+	_, encrypted, _ := ParseSealedReport(sealed)
+	if _, _, err := serverPublicKey.OpenReport(encrypted); err != ErrBadSealedReport {
+		t.Fatal(err)
+	}
+	// Truncate the report to fit into the maximum length
+	sealed, _, err = subjectSharedKey.SealReport(strings.Repeat("a", 1000), 100)
+	if err != nil || len(sealed) > len(subjectSharedKey.SealedReportPrefix())+100 {
+		t.Fatal(err, sealed)
+	}
+	if _, _, err := subjectSharedKey.SealReport("hello world", 10); err == nil {
+		t.Fatal("should have failed")
+	}
+}
+
+func TestMessageProcessor_SealedReport(t *testing.T) {
+	subjectPub, subjectPriv, _ := GenerateReportKeyPair()
+	serverPub, serverPriv, _ := GenerateReportKeyPair()
+	proc := &MessageProcessor{
+		CmdProcessor:          GetTestCommandProcessor(),
+		MaxReportsPerHostName: 100,
+		SubjectSharedKeys:     map[string]string{"shared-subject": "0123456789abcdef"},
+		SubjectPublicKeys:     map[string]string{"public-subject": subjectPub},
+	}
+	// Public keys require the private key of message processor
+	if err := proc.Initialise(); err == nil {
+		t.Fatal("should have failed")
+	}
+	proc.PrivateKey = serverPriv
+	if err := proc.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	report := SubjectReportRequest{
+		SubjectHostName: "spoofed-host-name",
+		SubjectPlatform: "subject-platform",
+		CommandRequest:  AppCommandRequest{Command: TestCommandProcessorPIN + ".s echo hi"},
+	}
+	// Plain reports are rejected
+	if result := proc.Execute(context.Background(), Command{ClientID: "subject-ip", DaemonName: "daemon", Content: report.SerialiseCompact()}); result.Error != ErrUnauthenticatedReport {
+		t.Fatalf("%+v", result)
+	}
+	// So are the reports of unknown keys
+	unknownKey, _ := NewSharedReportKey("unknown-subject", "0123456789abcdef")
+	sealed, _, _ := unknownKey.SealReport(report.SerialiseCompact(), 0)
+	if result := proc.Execute(context.Background(), Command{ClientID: "subject-ip", DaemonName: "daemon", Content: sealed}); result.Error == nil {
+		t.Fatalf("%+v", result)
+	}
+	sharedKey, _ := NewSharedReportKey("shared-subject", "0123456789abcdef")
+	publicKey, _ := NewPublicReportKey("public-subject", subjectPriv, serverPub)
+	for _, key := range []*ReportKey{sharedKey, publicKey} {
+		sealed, nonce, err := key.SealReport(report.SerialiseCompact(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := proc.Execute(context.Background(), Command{ClientID: "subject-ip", DaemonName: "daemon", Content: sealed})
+		if result.Error != nil {
+			t.Fatalf("%+v", result)
+		}
+		respJSON, err := key.OpenResponse(result.Output, nonce)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var resp SubjectReportResponse
+		if err := json.Unmarshal(respJSON, &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.CommandResponse.Result != "hi" {
+			t.Fatalf("%+v", resp)
+		}
+		// The report is stored under the key ID rather than the self-reported host name
+		if reports := proc.GetLatestReportsFromSubject(key.ID, 10); len(reports) != 1 || reports[0].OriginalRequest.SubjectPlatform != "subject-platform" {
+			t.Fatalf("%+v", reports)
+		}
+	}
+	if reports := proc.GetLatestReportsFromSubject("spoofed-host-name", 10); len(reports) != 0 {
+		t.Fatalf("%+v", reports)
+	}
+}
@@ -1,6 +1,7 @@
 package toolbox
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"os"
@@ -186,6 +187,64 @@ func TestMessageProcessor_PendingCommandRequest(t *testing.T) {
 	}
 }
 
+func TestMessageProcessor_QueueOutgoingCommand(t *testing.T) {
+	proc := &MessageProcessor{CmdProcessor: GetTestCommandProcessor(), MaxReportsPerHostName: 100}
+	if err := proc.Initialise(); err != nil {
+		t.Fatal(err)
+	}
+	if n := proc.QueueOutgoingCommand("subject-host-NAME1", "cmd1"); n != 1 {
+		t.Fatal(n)
+	}
+	if n := proc.QueueOutgoingCommand("subject-host-NAME1", "cmd2"); n != 2 {
+		t.Fatal(n)
+	}
+	if queue := proc.GetOutgoingCommandQueue("subject-host-name1"); len(queue) != 2 || queue[0] != "cmd1" || queue[1] != "cmd2" {
+		t.Fatalf("%+v", queue)
+	}
+	// The outgoing command is delivered until the subject returns its result
+	for i := 0; i < 2; i++ {
+		if resp := proc.StoreReport(SubjectReportRequest{SubjectHostName: "subject-host-name1"}, "ip", "daemon"); resp.CommandRequest.Command != "cmd1" {
+			t.Fatalf("%+v", resp)
+		}
+	}
+	// The reply to the report that carries the result delivers the next command
+	resp := proc.StoreReport(SubjectReportRequest{
+		SubjectHostName: "subject-host-name1",
+		CommandResponse: AppCommandResponse{Command: "cmd1", Result: "result1"},
+	}, "ip", "daemon")
+	if resp.CommandRequest.Command != "cmd2" {
+		t.Fatalf("%+v", resp)
+	}
+	// Further reports that carry the same result do not affect the queue
+	resp = proc.StoreReport(SubjectReportRequest{
+		SubjectHostName: "subject-host-name1",
+		CommandResponse: AppCommandResponse{Command: "cmd1", Result: "result1"},
+	}, "ip", "daemon")
+	if resp.CommandRequest.Command != "cmd2" {
+		t.Fatalf("%+v", resp)
+	}
+	resp = proc.StoreReport(SubjectReportRequest{
+		SubjectHostName: "subject-host-name1",
+		CommandResponse: AppCommandResponse{Command: "cmd2", Result: "result2"},
+	}, "ip", "daemon")
+	if resp.CommandRequest.Command != "" {
+		t.Fatalf("%+v", resp)
+	}
+	if queue := proc.GetOutgoingCommandQueue("subject-host-name1"); len(queue) != 0 {
+		t.Fatalf("%+v", queue)
+	}
+	if results := proc.GetOutgoingCommandResults("subject-host-NAME1"); len(results) != 2 || results[0].Result != "result1" || results[1].Result != "result2" {
+		t.Fatalf("%+v", results)
+	}
+	// Clear the queue
+	proc.QueueOutgoingCommand("subject-host-name1", "cmd3")
+	proc.QueueOutgoingCommand("subject-host-name1", "cmd4")
+	proc.SetOutgoingCommand("subject-host-name1", "")
+	if queue := proc.GetOutgoingCommandQueue("subject-host-name1"); len(queue) != 0 {
+		t.Fatalf("%+v", queue)
+	}
+}
+
 func TestMessageProcessor_processCommandRequest_QuickCommand(t *testing.T) {
 	proc := &MessageProcessor{CmdProcessor: GetTestCommandProcessor(), MaxReportsPerHostName: 100}
 	if err := proc.Initialise(); err != nil {
@@ -438,7 +497,7 @@ func TestMessageProcessor_App(t *testing.T) {
 	}
 
 	// Send it to app for execution
-	result := proc.Execute(Command{
+	result := proc.Execute(context.Background(), Command{
 		ClientID:   "subject-ip",
 		DaemonName: "command-daemon-name",
 		Content:    report.SerialiseCompact(),